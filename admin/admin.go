@@ -0,0 +1,219 @@
+// Package admin contains an optional HTTP server for inspecting and
+// controlling a running proxy: its module pipeline, open client
+// connections, per-module statistics, slow requests, build information and
+// Prometheus metrics.
+package admin
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mongodbinc-interns/mongoproxy/cursors"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	"github.com/mongodbinc-interns/mongoproxy/slowop"
+)
+
+// Version is the proxy's version string, reported by the buildinfo
+// endpoint. It can be set at build time with
+// -ldflags "-X github.com/mongodbinc-interns/mongoproxy/admin.Version=<version>".
+var Version = "dev"
+
+// A Proxy is the view of a running proxy that the admin API works with.
+type Proxy interface {
+	// Modules returns descriptions of the modules in the current pipeline.
+	Modules() []server.ModuleInfo
+
+	// Clients returns the currently open client connections.
+	Clients() []*messages.Client
+
+	// Reload rebuilds the module pipeline from a fresh configuration.
+	Reload() error
+
+	// Drain stops accepting connections and closes open ones once idle.
+	Drain() error
+
+	// SlowOps returns recent slow requests that match the query.
+	SlowOps(slowop.Query) []slowop.Record
+}
+
+// the proxy that the handlers report on.
+var proxy Proxy
+
+var started = time.Now()
+
+// Setup creates the admin HTTP server for the given proxy, and returns it
+// so the caller can run it on the port of its choice.
+func Setup(p Proxy) *gin.Engine {
+	proxy = p
+
+	r := gin.New()
+	r.GET("/pipeline", getPipeline)
+	r.GET("/connections", getConnections)
+	r.GET("/stats", getStats)
+	r.GET("/buildinfo", getBuildInfo)
+	r.POST("/reload", postReload)
+	r.POST("/drain", postDrain)
+	r.GET("/slowops", getSlowOps)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	return r
+}
+
+// getPipeline is the handler for listing the modules in the pipeline,
+// with their sanitized configurations.
+func getPipeline(c *gin.Context) {
+	modules := proxy.Modules()
+	for i := range modules {
+		// statistics have their own endpoint
+		modules[i].Stats = server.StatsReport{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"modules": modules,
+	})
+}
+
+// getConnections is the handler for listing open client connections.
+func getConnections(c *gin.Context) {
+	clients := proxy.Clients()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+
+	connections := make([]gin.H, len(clients))
+	for i, client := range clients {
+		connections[i] = gin.H{
+			"id":         client.ID,
+			"remoteAddr": client.RemoteAddr,
+			"connected":  client.Connected,
+			"requests":   client.Requests(),
+			"metadata":   client.Metadata(),
+		}
+		if user := client.User(); user != nil {
+			connections[i]["user"] = user.String()
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"connections": connections,
+	})
+}
+
+// getStats is the handler for per-module request statistics, and counts
+// of the cursors the proxy keeps and the sessions it follows.
+func getStats(c *gin.Context) {
+	modules := proxy.Modules()
+	stats := make([]gin.H, len(modules))
+	for i, module := range modules {
+		stats[i] = gin.H{
+			"name":  module.Name,
+			"alias": module.Alias,
+			"stats": module.Stats,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"uptimeSeconds": time.Since(started).Seconds(),
+		"connections":   len(proxy.Clients()),
+		"modules":       stats,
+		"cursors":       cursors.Default.Stats(),
+		"sessions":      sessions.Default.Stats(),
+	})
+}
+
+// getBuildInfo is the handler for the proxy's version and build details.
+func getBuildInfo(c *gin.Context) {
+	info := gin.H{
+		"version":   Version,
+		"goVersion": runtime.Version(),
+		"os":        runtime.GOOS,
+		"arch":      runtime.GOARCH,
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info["module"] = build.Main.Path
+		info["moduleVersion"] = build.Main.Version
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["gitRevision"] = setting.Value
+			case "vcs.time":
+				info["gitTime"] = setting.Value
+			case "vcs.modified":
+				info["gitModified"] = setting.Value == "true"
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// postReload is the handler for reloading the proxy configuration.
+func postReload(c *gin.Context) {
+	err := proxy.Reload()
+	if err != nil {
+		Log(ERROR, "Admin reload failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"ok":    0,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ok": 1,
+	})
+}
+
+// postDrain is the handler for draining the proxy.
+func postDrain(c *gin.Context) {
+	err := proxy.Drain()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"ok":    0,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ok": 1,
+	})
+}
+
+// the number of slow operations returned when the request sets no limit.
+const defaultSlowOpLimit = 100
+
+// getSlowOps is the handler for listing recent slow requests, newest
+// first. They can be filtered by the command, ns, appName and minMillis
+// query parameters, and limited with limit.
+func getSlowOps(c *gin.Context) {
+	q := slowop.Query{
+		Command:   c.Query("command"),
+		Namespace: c.Query("ns"),
+		AppName:   c.Query("appName"),
+		Limit:     defaultSlowOpLimit,
+	}
+
+	var err error
+	if minMillis := c.Query("minMillis"); len(minMillis) > 0 {
+		q.MinMillis, err = strconv.ParseFloat(minMillis, 64)
+	}
+	if limit := c.Query("limit"); err == nil && len(limit) > 0 {
+		q.Limit, err = strconv.Atoi(limit)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+			"ok":    0,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"slowOps": proxy.SlowOps(q),
+	})
+}
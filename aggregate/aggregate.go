@@ -0,0 +1,111 @@
+// Package aggregate runs MongoDB aggregation pipelines over documents in
+// memory, for modules that answer aggregate themselves or combine the
+// results of several backends.
+package aggregate
+
+import (
+	"fmt"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errorf returns an error as the query package does, so that callers
+// handle one kind.
+func errorf(code int32, format string, args ...interface{}) *query.Error {
+	return &query.Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// A Source returns the documents of a collection of the database a
+// pipeline runs in, for stages such as $lookup that read others.
+type Source func(collection string) ([]bson.D, error)
+
+// A Pipeline is a compiled aggregation pipeline.
+type Pipeline struct {
+	stages []stage
+}
+
+// A stage is a compiled stage, which takes the documents of the stage
+// before it.
+type stage func(docs []bson.D, src Source) ([]bson.D, error)
+
+// stages compile the stages of pipelines, by name.
+var stages map[string]func(spec interface{}) (stage, error)
+
+func init() {
+	stages = map[string]func(spec interface{}) (stage, error){
+		"$match":       compileMatch,
+		"$project":     compileProject,
+		"$addFields":   compileAddFields,
+		"$set":         compileAddFields,
+		"$unset":       compileUnset,
+		"$replaceRoot": compileReplaceRoot,
+		"$replaceWith": compileReplaceWith,
+		"$group":       compileGroup,
+		"$sort":        compileSort,
+		"$limit":       compileLimit,
+		"$skip":        compileSkip,
+		"$unwind":      compileUnwind,
+		"$count":       compileCount,
+		"$sortByCount": compileSortByCount,
+		"$lookup":      compileLookup,
+		"$facet":       compileFacet,
+	}
+}
+
+// Compile compiles a pipeline, given as its array of stages.
+func Compile(pipeline []interface{}) (*Pipeline, error) {
+	p := &Pipeline{}
+	for _, spec := range pipeline {
+		doc := bsonutil.ToD(spec)
+		if len(doc) != 1 {
+			return nil, errorf(messages.TypeMismatch, "A pipeline stage specification object must contain exactly one field.")
+		}
+		compile, ok := stages[doc[0].Name]
+		if !ok {
+			return nil, errorf(messages.FailedToParse, "Unrecognized pipeline stage name: '%s'", doc[0].Name)
+		}
+		s, err := compile(doc[0].Value)
+		if err != nil {
+			return nil, err
+		}
+		p.stages = append(p.stages, s)
+	}
+	return p, nil
+}
+
+// StageNames returns the names of a pipeline's stages, for callers that
+// allow only some.
+func StageNames(pipeline []interface{}) []string {
+	names := []string{}
+	for _, spec := range pipeline {
+		if doc := bsonutil.ToD(spec); len(doc) > 0 {
+			names = append(names, doc[0].Name)
+		}
+	}
+	return names
+}
+
+// Run runs the pipeline over documents, which it does not change, reading
+// other collections from a source, which may be nil for pipelines that do
+// not.
+func (p *Pipeline) Run(docs []bson.D, src Source) ([]bson.D, error) {
+	for _, s := range p.stages {
+		var err error
+		if docs, err = s(docs, src); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// format writes a value for error messages.
+func format(v interface{}) string {
+	out, err := bsonutil.MarshalExtJSON(v, bsonutil.Relaxed)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
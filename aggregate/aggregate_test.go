@@ -0,0 +1,235 @@
+package aggregate
+
+import (
+	"testing"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// d builds documents tersely: d("a", 1, "b", 2).
+func d(pairs ...interface{}) bson.D {
+	doc := bson.D{}
+	for i := 0; i < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
+
+func a(values ...interface{}) []interface{} {
+	return append([]interface{}{}, values...)
+}
+
+func bsonString(v interface{}) string {
+	out, _ := bsonutil.MarshalExtJSON(v, bsonutil.Relaxed)
+	return string(out)
+}
+
+var orders = []bson.D{
+	d("_id", 1, "item", "pen", "qty", 2, "price", 1.5, "tags", a("blue", "cheap")),
+	d("_id", 2, "item", "ink", "qty", 5, "price", 4.0, "tags", a()),
+	d("_id", 3, "item", "pen", "qty", 1, "price", 2.5),
+	d("_id", 4, "item", "pad", "qty", 3, "price", 3.0, "tags", "paper"),
+}
+
+var items = []bson.D{
+	d("_id", "pen", "maker", "Acme"),
+	d("_id", "ink", "maker", "Inkco"),
+	d("_id", "pen", "maker", "Other"),
+}
+
+func source(coll string) ([]bson.D, error) {
+	if coll == "items" {
+		return items, nil
+	}
+	return []bson.D{}, nil
+}
+
+// a run is a pipeline, and the documents it turns the orders into.
+type run struct {
+	name     string
+	pipeline []interface{}
+	want     []bson.D
+}
+
+var runs = []run{
+	{
+		name:     "$match, $sort and $project",
+		pipeline: a(d("$match", d("item", "pen")), d("$sort", d("qty", 1)), d("$project", d("_id", 0, "qty", 1))),
+		want:     []bson.D{d("qty", 1), d("qty", 2)},
+	},
+	{
+		name:     "$skip and $limit",
+		pipeline: a(d("$skip", 1), d("$limit", 2), d("$project", d("_id", 1))),
+		want:     []bson.D{d("_id", 2), d("_id", 3)},
+	},
+	{
+		name:     "$addFields and $unset",
+		pipeline: a(d("$match", d("_id", 1)), d("$set", d("total", d("$multiply", a("$qty", "$price")))), d("$unset", a("tags", "price", "item"))),
+		want:     []bson.D{d("_id", 1, "qty", 2, "total", 3.0)},
+	},
+	{
+		name: "$group with accumulators",
+		pipeline: a(
+			d("$group", d(
+				"_id", "$item",
+				"n", d("$count", d()),
+				"qty", d("$sum", "$qty"),
+				"avg", d("$avg", "$price"),
+				"min", d("$min", "$price"),
+				"max", d("$max", "$price"),
+				"first", d("$first", "$_id"),
+				"last", d("$last", "$_id"),
+				"ids", d("$push", "$_id"),
+				"tags", d("$addToSet", "$tags"),
+			)),
+			d("$sort", d("_id", 1)),
+		),
+		want: []bson.D{
+			d("_id", "ink", "n", 1, "qty", 5, "avg", 4.0, "min", 4.0, "max", 4.0, "first", 2, "last", 2, "ids", a(2), "tags", a(a())),
+			d("_id", "pad", "n", 1, "qty", 3, "avg", 3.0, "min", 3.0, "max", 3.0, "first", 4, "last", 4, "ids", a(4), "tags", a("paper")),
+			d("_id", "pen", "n", 2, "qty", 3, "avg", 2.0, "min", 1.5, "max", 2.5, "first", 1, "last", 3, "ids", a(1, 3), "tags", a(a("blue", "cheap"))),
+		},
+	},
+	{
+		name:     "$group of everything",
+		pipeline: a(d("$group", d("_id", nil, "total", d("$sum", d("$multiply", a("$qty", "$price")))))),
+		want:     []bson.D{d("_id", nil, "total", 34.5)},
+	},
+	{
+		name:     "$group with equal numbers in one group",
+		pipeline: a(d("$group", d("_id", d("$cond", a(d("$gt", a("$qty", 2)), 1, 1.0)), "n", d("$sum", 1)))),
+		want:     []bson.D{d("_id", 1.0, "n", 4)},
+	},
+	{
+		name:     "$group by expressions",
+		pipeline: a(d("$group", d("_id", d("big", d("$gte", a("$qty", 3))), "n", d("$sum", 1))), d("$sort", d("_id.big", -1))),
+		want:     []bson.D{d("_id", d("big", true), "n", 2), d("_id", d("big", false), "n", 2)},
+	},
+	{
+		name:     "$unwind",
+		pipeline: a(d("$unwind", "$tags"), d("$project", d("tags", 1))),
+		want:     []bson.D{d("_id", 1, "tags", "blue"), d("_id", 1, "tags", "cheap"), d("_id", 4, "tags", "paper")},
+	},
+	{
+		name:     "$unwind preserving nulls and empty arrays",
+		pipeline: a(d("$unwind", d("path", "$tags", "includeArrayIndex", "i", "preserveNullAndEmptyArrays", true)), d("$project", d("tags", 1, "i", 1))),
+		want: []bson.D{
+			d("_id", 1, "tags", "blue", "i", int64(0)), d("_id", 1, "tags", "cheap", "i", int64(1)),
+			d("_id", 2, "i", nil), d("_id", 3, "i", nil), d("_id", 4, "tags", "paper", "i", nil),
+		},
+	},
+	{
+		name:     "$count",
+		pipeline: a(d("$match", d("qty", d("$gt", 1))), d("$count", "n")),
+		want:     []bson.D{d("n", 3)},
+	},
+	{
+		name:     "$count of nothing",
+		pipeline: a(d("$match", d("qty", 100)), d("$count", "n")),
+		want:     []bson.D{},
+	},
+	{
+		name:     "$sortByCount",
+		pipeline: a(d("$sortByCount", "$item"), d("$limit", 1)),
+		want:     []bson.D{d("_id", "pen", "count", 2)},
+	},
+	{
+		name: "$lookup",
+		pipeline: a(
+			d("$match", d("_id", d("$lte", 2))),
+			d("$lookup", d("from", "items", "localField", "item", "foreignField", "_id", "as", "made")),
+			d("$project", d("made.maker", 1)),
+		),
+		want: []bson.D{
+			d("_id", 1, "made", a(d("maker", "Acme"), d("maker", "Other"))),
+			d("_id", 2, "made", a(d("maker", "Inkco"))),
+		},
+	},
+	{
+		name: "$lookup with a pipeline",
+		pipeline: a(
+			d("$match", d("_id", 1)),
+			d("$lookup", d("from", "items", "pipeline", a(d("$match", d("maker", "Inkco")), d("$project", d("_id", 1))), "as", "ink")),
+			d("$project", d("ink", 1)),
+		),
+		want: []bson.D{d("_id", 1, "ink", a(d("_id", "ink")))},
+	},
+	{
+		name: "$facet",
+		pipeline: a(d("$facet", d(
+			"count", a(d("$count", "n")),
+			"top", a(d("$sort", d("qty", -1)), d("$limit", 1), d("$project", d("item", 1))),
+		))),
+		want: []bson.D{d("count", a(d("n", 4)), "top", a(d("_id", 2, "item", "ink")))},
+	},
+	{
+		name:     "$replaceRoot",
+		pipeline: a(d("$match", d("_id", 4)), d("$replaceRoot", d("newRoot", d("item", "$item")))),
+		want:     []bson.D{d("item", "pad")},
+	},
+}
+
+func TestPipelines(t *testing.T) {
+	Convey("Run pipelines as MongoDB does", t, func() {
+		before := bsonString(orders)
+		for _, r := range runs {
+			p, err := Compile(r.pipeline)
+			So(err, ShouldBeNil)
+			out, err := p.Run(orders, source)
+			So(err, ShouldBeNil)
+			So(r.name+": "+bsonString(out), ShouldEqual, r.name+": "+bsonString(r.want))
+		}
+		So(bsonString(orders), ShouldEqual, before)
+	})
+
+	Convey("Fail pipelines whose expressions fail", t, func() {
+		p, err := Compile(a(d("$match", d("$expr", d("$divide", a(1, 0))))))
+		So(err, ShouldBeNil)
+		_, err = p.Run(orders, source)
+		So(err, ShouldNotBeNil)
+		So(err.(*query.Error).Code, ShouldEqual, messages.BadValue)
+	})
+
+	Convey("Refuse bad pipelines", t, func() {
+		for _, pipeline := range [][]interface{}{
+			a(d("$foo", 1)),
+			a(d("$match", d(), "$limit", 1)),
+			a(1),
+			a(d("$match", d("$foo", 1))),
+			a(d("$limit", 0)),
+			a(d("$skip", -1)),
+			a(d("$sort", d())),
+			a(d("$project", d())),
+			a(d("$group", d("n", d("$sum", 1)))),
+			a(d("$group", d("_id", nil, "n", 1))),
+			a(d("$group", d("_id", nil, "n", d("$foo", 1)))),
+			a(d("$group", d("_id", nil, "a.b", d("$sum", 1)))),
+			a(d("$unwind", "tags")),
+			a(d("$unwind", d("path", "$tags", "foo", 1))),
+			a(d("$count", "$n")),
+			a(d("$count", "a.b")),
+			a(d("$lookup", d("from", "items", "as", "x"))),
+			a(d("$lookup", d("from", "items", "localField", "a", "as", "x"))),
+			a(d("$facet", d("x", a(d("$facet", d()))))),
+			a(d("$sortByCount", "item")),
+		} {
+			_, err := Compile(pipeline)
+			So(err, ShouldNotBeNil)
+			So(err.(*query.Error).Code, ShouldNotEqual, 0)
+		}
+
+		p, err := Compile(a(d("$replaceWith", "$qty")))
+		So(err, ShouldBeNil)
+		_, err = p.Run(orders, nil)
+		So(err.(*query.Error).Code, ShouldEqual, messages.BadValue)
+
+		p, err = Compile(a(d("$lookup", d("from", "items", "localField", "item", "foreignField", "_id", "as", "x"))))
+		So(err, ShouldBeNil)
+		_, err = p.Run(orders, nil)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,411 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// An accumulator accumulates the values of a field of a group.
+type accumulator interface {
+	add(v interface{}) error
+	result() interface{}
+}
+
+// accumulators create the accumulators of $group, by name.
+var accumulators = map[string]func() accumulator{
+	"$sum":          func() accumulator { return &sum{total: 0} },
+	"$count":        func() accumulator { return &sum{total: 0} },
+	"$avg":          func() accumulator { return &avg{} },
+	"$min":          func() accumulator { return &extreme{sign: -1} },
+	"$max":          func() accumulator { return &extreme{sign: 1} },
+	"$first":        func() accumulator { return &first{} },
+	"$last":         func() accumulator { return &last{} },
+	"$push":         func() accumulator { return &push{values: []interface{}{}} },
+	"$addToSet":     func() accumulator { return &addToSet{values: []interface{}{}} },
+	"$mergeObjects": func() accumulator { return &mergeObjects{doc: bson.D{}} },
+	"$stdDevPop":    func() accumulator { return &stdDev{} },
+	"$stdDevSamp":   func() accumulator { return &stdDev{sample: true} },
+}
+
+// sum adds numbers, ignoring other values.
+type sum struct {
+	total interface{}
+}
+
+func (s *sum) add(v interface{}) error {
+	if !bsonutil.IsNumber(v) {
+		return nil
+	}
+	total, err := query.Add(s.total, v)
+	s.total = total
+	return err
+}
+
+func (s *sum) result() interface{} {
+	return s.total
+}
+
+// avg averages numbers, ignoring other values, and is null without any.
+type avg struct {
+	total float64
+	n     int
+}
+
+func (a *avg) add(v interface{}) error {
+	if f, ok := toFloat(v); ok {
+		a.total += f
+		a.n++
+	}
+	return nil
+}
+
+func (a *avg) result() interface{} {
+	if a.n == 0 {
+		return nil
+	}
+	return a.total / float64(a.n)
+}
+
+// extreme keeps the least or greatest value, by sign, ignoring nulls.
+type extreme struct {
+	sign int
+	best interface{}
+	seen bool
+}
+
+func (e *extreme) add(v interface{}) error {
+	if v == nil || v == query.Missing || v == bson.Undefined {
+		return nil
+	}
+	if !e.seen || bsonutil.Compare(v, e.best)*e.sign > 0 {
+		e.best, e.seen = v, true
+	}
+	return nil
+}
+
+func (e *extreme) result() interface{} {
+	return e.best
+}
+
+type first struct {
+	value interface{}
+	seen  bool
+}
+
+func (f *first) add(v interface{}) error {
+	if !f.seen {
+		f.value, f.seen = nullIfMissing(v), true
+	}
+	return nil
+}
+
+func (f *first) result() interface{} {
+	return f.value
+}
+
+type last struct {
+	value interface{}
+}
+
+func (l *last) add(v interface{}) error {
+	l.value = nullIfMissing(v)
+	return nil
+}
+
+func (l *last) result() interface{} {
+	return l.value
+}
+
+// push collects values, leaving out missing ones.
+type push struct {
+	values []interface{}
+}
+
+func (p *push) add(v interface{}) error {
+	if v != query.Missing {
+		p.values = append(p.values, v)
+	}
+	return nil
+}
+
+func (p *push) result() interface{} {
+	return p.values
+}
+
+// addToSet collects distinct values, leaving out missing ones.
+type addToSet struct {
+	values []interface{}
+}
+
+func (a *addToSet) add(v interface{}) error {
+	if v == query.Missing {
+		return nil
+	}
+	for _, value := range a.values {
+		if bsonutil.Equal(value, v) {
+			return nil
+		}
+	}
+	a.values = append(a.values, v)
+	return nil
+}
+
+func (a *addToSet) result() interface{} {
+	return a.values
+}
+
+// mergeObjects merges documents, ignoring nulls.
+type mergeObjects struct {
+	doc bson.D
+}
+
+func (m *mergeObjects) add(v interface{}) error {
+	if v == nil || v == query.Missing {
+		return nil
+	}
+	doc := bsonutil.ToD(v)
+	if doc == nil {
+		return errorf(messages.TypeMismatch, "$mergeObjects requires object inputs, but input %s is of type %s", format(v), query.TypeName(v))
+	}
+	for _, elem := range doc {
+		m.doc = query.SetField(m.doc, []string{elem.Name}, elem.Value)
+	}
+	return nil
+}
+
+func (m *mergeObjects) result() interface{} {
+	return m.doc
+}
+
+// stdDev computes the standard deviation of numbers, ignoring other
+// values, of the population or of a sample.
+type stdDev struct {
+	sample bool
+	values []float64
+}
+
+func (s *stdDev) add(v interface{}) error {
+	if f, ok := toFloat(v); ok {
+		s.values = append(s.values, f)
+	}
+	return nil
+}
+
+func (s *stdDev) result() interface{} {
+	n := float64(len(s.values))
+	if n == 0 || (s.sample && n == 1) {
+		return nil
+	}
+	mean := 0.0
+	for _, f := range s.values {
+		mean += f
+	}
+	mean /= n
+	squares := 0.0
+	for _, f := range s.values {
+		squares += (f - mean) * (f - mean)
+	}
+	if s.sample {
+		n--
+	}
+	return math.Sqrt(squares / n)
+}
+
+func nullIfMissing(v interface{}) interface{} {
+	if v == query.Missing {
+		return nil
+	}
+	return v
+}
+
+// toFloat returns a number as a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// A groupField is an accumulated field of the documents of $group.
+type groupField struct {
+	name       string
+	accumulate func() accumulator
+	expr       *query.Expression
+}
+
+// A group is the documents of one _id, as $group accumulates them.
+type group struct {
+	id     interface{}
+	fields []accumulator
+}
+
+func compileGroup(spec interface{}) (stage, error) {
+	doc := bsonutil.ToD(spec)
+	if doc == nil {
+		return nil, errorf(messages.FailedToParse, "a group's fields must be specified in an object")
+	}
+	var id *query.Expression
+	fields := []groupField{}
+	for _, elem := range doc {
+		if elem.Name == "_id" {
+			var err error
+			if id, err = query.CompileExpression(elem.Value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.Contains(elem.Name, ".") {
+			return nil, errorf(messages.FailedToParse, "The field name '%s' cannot contain '.'", elem.Name)
+		}
+		f, err := compileGroupField(elem)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	if id == nil {
+		return nil, errorf(messages.FailedToParse, "a group specification must include an _id")
+	}
+
+	return func(docs []bson.D, _ Source) ([]bson.D, error) {
+		groups := []*group{}
+		byKey := map[string]*group{}
+		for _, doc := range docs {
+			value, err := id.Evaluate(doc)
+			if err != nil {
+				return nil, err
+			}
+			value = nullIfMissing(value)
+			key := groupKey(value)
+			g, ok := byKey[key]
+			if !ok {
+				g = &group{id: value}
+				for _, f := range fields {
+					g.fields = append(g.fields, f.accumulate())
+				}
+				byKey[key] = g
+				groups = append(groups, g)
+			}
+			for i, f := range fields {
+				v, err := f.expr.Evaluate(doc)
+				if err != nil {
+					return nil, err
+				}
+				if err := g.fields[i].add(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		out := make([]bson.D, len(groups))
+		for i, g := range groups {
+			doc := bson.D{{Name: "_id", Value: g.id}}
+			for j, f := range fields {
+				doc = append(doc, bson.DocElem{Name: f.name, Value: g.fields[j].result()})
+			}
+			out[i] = doc
+		}
+		return out, nil
+	}, nil
+}
+
+// compileGroupField compiles a field of $group, an accumulator and its
+// expression.
+func compileGroupField(elem bson.DocElem) (groupField, error) {
+	f := groupField{name: elem.Name}
+	spec := bsonutil.ToD(elem.Value)
+	if len(spec) != 1 {
+		return f, errorf(messages.FailedToParse, "The field '%s' must be an accumulator object", elem.Name)
+	}
+	var ok bool
+	if f.accumulate, ok = accumulators[spec[0].Name]; !ok {
+		return f, errorf(messages.FailedToParse, "unknown group operator '%s'", spec[0].Name)
+	}
+	arg := spec[0].Value
+	if spec[0].Name == "$count" {
+		if d := bsonutil.ToD(arg); d == nil || len(d) > 0 {
+			return f, errorf(messages.FailedToParse, "$count takes no arguments, i.e. $count:{}")
+		}
+		arg = 1
+	}
+	if bsonutil.ToArray(arg) != nil {
+		return f, errorf(messages.FailedToParse, "The %s accumulator is a unary operator", spec[0].Name)
+	}
+	var err error
+	f.expr, err = query.CompileExpression(arg)
+	return f, err
+}
+
+// groupKey returns a key for a group's _id that is the same for equal
+// values, such as 1 and 1.0.
+func groupKey(v interface{}) string {
+	out, _ := bson.Marshal(bson.D{{Name: "", Value: normalize(v)}})
+	return string(out)
+}
+
+// normalize makes every number in a value a float64, and every document
+// a bson.D.
+func normalize(v interface{}) interface{} {
+	if f, ok := toFloat(v); ok {
+		if f == 0 {
+			// -0 is 0
+			return float64(0)
+		}
+		return f
+	}
+	if doc := bsonutil.ToD(v); doc != nil {
+		out := make(bson.D, len(doc))
+		for i, elem := range doc {
+			out[i] = bson.DocElem{Name: elem.Name, Value: normalize(elem.Value)}
+		}
+		return out
+	}
+	if array := bsonutil.ToArray(v); array != nil {
+		out := make([]interface{}, len(array))
+		for i, elem := range array {
+			out[i] = normalize(elem)
+		}
+		return out
+	}
+	return v
+}
+
+// compileSortByCount compiles $sortByCount, which groups by an
+// expression and sorts the groups by their sizes, largest first.
+func compileSortByCount(spec interface{}) (stage, error) {
+	if s, ok := spec.(string); !ok || !strings.HasPrefix(s, "$") {
+		if d := bsonutil.ToD(spec); len(d) != 1 || !strings.HasPrefix(d[0].Name, "$") {
+			return nil, errorf(messages.FailedToParse, "the sortByCount field must be defined as a $-prefixed path or an expression")
+		}
+	}
+	g, err := compileGroup(bson.D{
+		{Name: "_id", Value: spec},
+		{Name: "count", Value: bson.D{{Name: "$sum", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(docs []bson.D, src Source) ([]bson.D, error) {
+		groups, err := g(docs, src)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(groups, func(i, j int) bool {
+			return bsonutil.Compare(groups[i][1].Value, groups[j][1].Value) > 0
+		})
+		return groups, nil
+	}, nil
+}
@@ -0,0 +1,515 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// each returns a stage that maps documents one to one.
+func each(apply func(doc bson.D) (bson.D, error)) stage {
+	return func(docs []bson.D, _ Source) ([]bson.D, error) {
+		out := make([]bson.D, 0, len(docs))
+		for _, doc := range docs {
+			doc, err := apply(doc)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, doc)
+		}
+		return out, nil
+	}
+}
+
+func compileMatch(spec interface{}) (stage, error) {
+	filter := bsonutil.ToD(spec)
+	if filter == nil {
+		return nil, errorf(messages.BadValue, "the match filter must be an expression in an object")
+	}
+	f, err := query.Compile(filter)
+	if err != nil {
+		return nil, err
+	}
+	return func(docs []bson.D, _ Source) ([]bson.D, error) {
+		out := []bson.D{}
+		for _, doc := range docs {
+			matched, err := f.Matches(doc)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				out = append(out, doc)
+			}
+		}
+		return out, nil
+	}, nil
+}
+
+func compileProject(spec interface{}) (stage, error) {
+	doc := bsonutil.ToD(spec)
+	if len(doc) == 0 {
+		return nil, errorf(messages.FailedToParse, "$project specification must be an object with at least one field")
+	}
+	p, err := query.CompileProjection(doc)
+	if err != nil {
+		return nil, err
+	}
+	return each(p.Apply), nil
+}
+
+// A computedField is a field $addFields sets to the value of an
+// expression.
+type computedField struct {
+	parts []string
+	expr  *query.Expression
+}
+
+// flattenFields compiles the fields of $addFields, where documents that
+// are not expressions stand for their fields.
+func flattenFields(spec bson.D, prefix string) ([]computedField, error) {
+	fields := []computedField{}
+	for _, elem := range spec {
+		if strings.HasPrefix(elem.Name, "$") {
+			return nil, errorf(messages.BadValue, "FieldPath field names may not start with '$'.")
+		}
+		path := prefix + elem.Name
+		if doc := bsonutil.ToD(elem.Value); len(doc) > 0 && !strings.HasPrefix(doc[0].Name, "$") {
+			sub, err := flattenFields(doc, path+".")
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, sub...)
+			continue
+		}
+		expr, err := query.CompileExpression(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, computedField{parts: strings.Split(path, "."), expr: expr})
+	}
+	return fields, nil
+}
+
+func compileAddFields(spec interface{}) (stage, error) {
+	doc := bsonutil.ToD(spec)
+	if doc == nil {
+		return nil, errorf(messages.FailedToParse, "$addFields specification stage must be an object, got %s", query.TypeName(spec))
+	}
+	fields, err := flattenFields(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	return each(func(doc bson.D) (bson.D, error) {
+		out := doc
+		for _, f := range fields {
+			value, err := f.expr.Evaluate(doc)
+			if err != nil {
+				return nil, err
+			}
+			if value == query.Missing {
+				out = query.RemoveField(out, f.parts)
+			} else {
+				out = query.SetField(out, f.parts, value)
+			}
+		}
+		return out, nil
+	}), nil
+}
+
+func compileUnset(spec interface{}) (stage, error) {
+	paths := []interface{}{spec}
+	if array := bsonutil.ToArray(spec); array != nil {
+		paths = array
+	}
+	fields := [][]string{}
+	for _, path := range paths {
+		s, ok := path.(string)
+		if !ok || len(s) == 0 {
+			return nil, errorf(messages.FailedToParse, "$unset specification must be a string or an array containing only string values")
+		}
+		fields = append(fields, strings.Split(s, "."))
+	}
+	return each(func(doc bson.D) (bson.D, error) {
+		for _, parts := range fields {
+			doc = query.RemoveField(doc, parts)
+		}
+		return doc, nil
+	}), nil
+}
+
+func compileReplaceRoot(spec interface{}) (stage, error) {
+	doc := bsonutil.ToD(spec)
+	if len(doc) != 1 || doc[0].Name != "newRoot" {
+		return nil, errorf(messages.FailedToParse, "$replaceRoot expects an object with only a 'newRoot' field")
+	}
+	return compileReplaceWith(doc[0].Value)
+}
+
+func compileReplaceWith(spec interface{}) (stage, error) {
+	expr, err := query.CompileExpression(spec)
+	if err != nil {
+		return nil, err
+	}
+	return each(func(doc bson.D) (bson.D, error) {
+		value, err := expr.Evaluate(doc)
+		if err != nil {
+			return nil, err
+		}
+		root := bsonutil.ToD(value)
+		if root == nil {
+			return nil, errorf(messages.BadValue, "'newRoot' expression must evaluate to an object, but resulting value was: %s. Type of resulting value: '%s'. Input document: %s",
+				format(value), query.TypeName(value), format(doc))
+		}
+		return root, nil
+	}), nil
+}
+
+func compileSort(spec interface{}) (stage, error) {
+	doc := bsonutil.ToD(spec)
+	if len(doc) == 0 {
+		return nil, errorf(messages.FailedToParse, "the $sort key specification must be an object with at least one field")
+	}
+	s, err := query.CompileSort(doc)
+	if err != nil {
+		return nil, err
+	}
+	return func(docs []bson.D, _ Source) ([]bson.D, error) {
+		out := append([]bson.D{}, docs...)
+		sort.SliceStable(out, func(i, j int) bool {
+			return s.Compare(out[i], out[j]) < 0
+		})
+		return out, nil
+	}, nil
+}
+
+// integer returns a number as an int64, if it is integral.
+func integer(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && !math.IsInf(n, 0) {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+func compileLimit(spec interface{}) (stage, error) {
+	n, ok := integer(spec)
+	if !ok || n <= 0 {
+		return nil, errorf(messages.FailedToParse, "the limit must be positive")
+	}
+	return func(docs []bson.D, _ Source) ([]bson.D, error) {
+		if int64(len(docs)) > n {
+			docs = docs[:n]
+		}
+		return docs, nil
+	}, nil
+}
+
+func compileSkip(spec interface{}) (stage, error) {
+	n, ok := integer(spec)
+	if !ok || n < 0 {
+		return nil, errorf(messages.FailedToParse, "invalid argument to $skip stage: Expected a non-negative number in: $skip: %s", format(spec))
+	}
+	return func(docs []bson.D, _ Source) ([]bson.D, error) {
+		if int64(len(docs)) < n {
+			n = int64(len(docs))
+		}
+		return docs[n:], nil
+	}, nil
+}
+
+// documentValue returns the value at a path through documents, and
+// whether there is one.
+func documentValue(doc bson.D, parts []string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range parts {
+		d := bsonutil.ToD(v)
+		if d == nil {
+			return nil, false
+		}
+		found := false
+		for _, elem := range d {
+			if elem.Name == part {
+				v, found = elem.Value, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// fieldPath returns the parts of a path given as "$path", as $unwind
+// takes it.
+func fieldPath(name string, v interface{}) ([]string, error) {
+	path, ok := v.(string)
+	if !ok || !strings.HasPrefix(path, "$") || len(path) == 1 {
+		return nil, errorf(messages.FailedToParse, "%s must be a field path prefixed with '$', found: %s", name, format(v))
+	}
+	return strings.Split(path[1:], "."), nil
+}
+
+func compileUnwind(spec interface{}) (stage, error) {
+	var parts []string
+	var err error
+	index := ""
+	preserve := false
+	if doc := bsonutil.ToD(spec); doc != nil {
+		for _, elem := range doc {
+			switch elem.Name {
+			case "path":
+				parts, err = fieldPath("$unwind path", elem.Value)
+			case "includeArrayIndex":
+				var ok bool
+				index, ok = elem.Value.(string)
+				if !ok || len(index) == 0 || strings.HasPrefix(index, "$") {
+					return nil, errorf(messages.FailedToParse, "includeArrayIndex must be a non-empty string not starting with '$'")
+				}
+			case "preserveNullAndEmptyArrays":
+				var ok bool
+				if preserve, ok = elem.Value.(bool); !ok {
+					return nil, errorf(messages.FailedToParse, "expected a boolean for the preserveNullAndEmptyArrays option to $unwind stage")
+				}
+			default:
+				return nil, errorf(messages.FailedToParse, "unrecognized option to $unwind stage: %s", elem.Name)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if parts == nil {
+			return nil, errorf(messages.FailedToParse, "no path specified to $unwind stage")
+		}
+	} else if parts, err = fieldPath("$unwind", spec); err != nil {
+		return nil, err
+	}
+
+	var indexParts []string
+	if len(index) > 0 {
+		indexParts = strings.Split(index, ".")
+	}
+	return func(docs []bson.D, _ Source) ([]bson.D, error) {
+		out := []bson.D{}
+		for _, doc := range docs {
+			value, ok := documentValue(doc, parts)
+			array := bsonutil.ToArray(value)
+			switch {
+			case array != nil && len(array) > 0:
+				for i, elem := range array {
+					unwound := query.SetField(doc, parts, elem)
+					if indexParts != nil {
+						unwound = query.SetField(unwound, indexParts, int64(i))
+					}
+					out = append(out, unwound)
+				}
+			case array == nil && ok && value != nil && value != bson.Undefined:
+				// values that are not arrays unwind to themselves
+				if indexParts != nil {
+					doc = query.SetField(doc, indexParts, nil)
+				}
+				out = append(out, doc)
+			case preserve:
+				if array != nil {
+					doc = query.RemoveField(doc, parts)
+				}
+				if indexParts != nil {
+					doc = query.SetField(doc, indexParts, nil)
+				}
+				out = append(out, doc)
+			}
+		}
+		return out, nil
+	}, nil
+}
+
+func compileCount(spec interface{}) (stage, error) {
+	name, ok := spec.(string)
+	switch {
+	case !ok:
+		return nil, errorf(messages.FailedToParse, "the count field must be a non-empty string")
+	case len(name) == 0:
+		return nil, errorf(messages.FailedToParse, "the count field must be a non-empty string")
+	case strings.HasPrefix(name, "$"):
+		return nil, errorf(messages.FailedToParse, "the count field cannot be a $-prefixed path")
+	case strings.Contains(name, "."):
+		return nil, errorf(messages.FailedToParse, "the count field cannot contain '.'")
+	}
+	return func(docs []bson.D, _ Source) ([]bson.D, error) {
+		if len(docs) == 0 {
+			return []bson.D{}, nil
+		}
+		return []bson.D{{{Name: name, Value: len(docs)}}}, nil
+	}, nil
+}
+
+// compileLookup compiles $lookup, which joins the documents of another
+// collection whose foreignField equals a document's localField, and
+// passes them through a pipeline, if it has one.
+func compileLookup(spec interface{}) (stage, error) {
+	doc := bsonutil.ToD(spec)
+	if doc == nil {
+		return nil, errorf(messages.FailedToParse, "the $lookup specification must be an Object, but found %s", query.TypeName(spec))
+	}
+	args := map[string]string{}
+	var pipeline *Pipeline
+	for _, elem := range doc {
+		switch elem.Name {
+		case "from", "as", "localField", "foreignField":
+			s, ok := elem.Value.(string)
+			if !ok || len(s) == 0 {
+				return nil, errorf(messages.FailedToParse, "$lookup argument '%s' must be a non-empty string", elem.Name)
+			}
+			args[elem.Name] = s
+		case "pipeline":
+			stages := bsonutil.ToArray(elem.Value)
+			if stages == nil {
+				return nil, errorf(messages.FailedToParse, "$lookup argument 'pipeline' must be an array")
+			}
+			var err error
+			if pipeline, err = Compile(stages); err != nil {
+				return nil, err
+			}
+		case "let":
+			return nil, errorf(messages.FailedToParse, "$lookup with 'let' is not supported")
+		default:
+			return nil, errorf(messages.FailedToParse, "unknown argument to $lookup: %s", elem.Name)
+		}
+	}
+	_, hasLocal := args["localField"]
+	_, hasForeign := args["foreignField"]
+	switch {
+	case len(args["from"]) == 0:
+		return nil, errorf(messages.FailedToParse, "missing 'from' option to $lookup stage specification")
+	case len(args["as"]) == 0:
+		return nil, errorf(messages.FailedToParse, "must specify 'as' field for a $lookup")
+	case hasLocal != hasForeign:
+		return nil, errorf(messages.FailedToParse, "$lookup requires both or neither of 'localField' and 'foreignField' to be specified")
+	case !hasLocal && pipeline == nil:
+		return nil, errorf(messages.FailedToParse, "$lookup requires either 'pipeline' or both 'localField' and 'foreignField' to be specified")
+	}
+
+	var local *query.Expression
+	if hasLocal {
+		var err error
+		if local, err = query.CompileExpression("$" + args["localField"]); err != nil {
+			return nil, err
+		}
+	}
+	as := strings.Split(args["as"], ".")
+	return func(docs []bson.D, src Source) ([]bson.D, error) {
+		if src == nil {
+			return nil, errorf(messages.IllegalOperation, "$lookup is not supported here")
+		}
+		foreign, err := src(args["from"])
+		if err != nil {
+			return nil, err
+		}
+		out := make([]bson.D, len(docs))
+		for i, doc := range docs {
+			joined := foreign
+			if local != nil {
+				if joined, err = equalOn(foreign, args["foreignField"], doc, local); err != nil {
+					return nil, err
+				}
+			}
+			if pipeline != nil {
+				if joined, err = pipeline.Run(joined, src); err != nil {
+					return nil, err
+				}
+			}
+			array := make([]interface{}, len(joined))
+			for j, d := range joined {
+				array[j] = d
+			}
+			out[i] = query.SetField(doc, as, array)
+		}
+		return out, nil
+	}, nil
+}
+
+// equalOn returns the foreign documents whose field equals the value of
+// the local expression in a document, or one of its elements if it is an
+// array. A missing local value matches null.
+func equalOn(foreign []bson.D, path string, doc bson.D, local *query.Expression) ([]bson.D, error) {
+	value, err := local.Evaluate(doc)
+	if err != nil {
+		return nil, err
+	}
+	values := []interface{}{value}
+	switch {
+	case value == query.Missing:
+		values = []interface{}{nil}
+	case bsonutil.ToArray(value) != nil:
+		values = append(bsonutil.ToArray(value), value)
+	}
+	filters := make([]interface{}, len(values))
+	for i, v := range values {
+		filters[i] = bson.D{{Name: path, Value: bson.D{{Name: "$eq", Value: v}}}}
+	}
+	f, err := query.Compile(bson.D{{Name: "$or", Value: filters}})
+	if err != nil {
+		return nil, err
+	}
+	out := []bson.D{}
+	for _, d := range foreign {
+		// equality filters cannot fail
+		if matched, _ := f.Matches(d); matched {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// compileFacet compiles $facet, which runs pipelines over the same
+// documents into one document of their results.
+func compileFacet(spec interface{}) (stage, error) {
+	doc := bsonutil.ToD(spec)
+	if len(doc) == 0 {
+		return nil, errorf(messages.FailedToParse, "the $facet specification must be a non-empty object")
+	}
+	pipelines := make([]*Pipeline, len(doc))
+	for i, elem := range doc {
+		stages := bsonutil.ToArray(elem.Value)
+		if stages == nil {
+			return nil, errorf(messages.FailedToParse, "arguments to $facet must be arrays, %s is type %s", elem.Name, query.TypeName(elem.Value))
+		}
+		for _, name := range StageNames(stages) {
+			if name == "$facet" {
+				return nil, errorf(messages.FailedToParse, "$facet is not allowed to be used within a $facet stage")
+			}
+		}
+		var err error
+		if pipelines[i], err = Compile(stages); err != nil {
+			return nil, err
+		}
+	}
+	return func(docs []bson.D, src Source) ([]bson.D, error) {
+		out := bson.D{}
+		for i, p := range pipelines {
+			results, err := p.Run(docs, src)
+			if err != nil {
+				return nil, err
+			}
+			array := make([]interface{}, len(results))
+			for j, d := range results {
+				array[j] = d
+			}
+			out = append(out, bson.DocElem{Name: doc[i].Name, Value: array})
+		}
+		return []bson.D{out}, nil
+	}, nil
+}
@@ -0,0 +1,421 @@
+// Package balancer spreads requests over a group of backend targets, such
+// as the replicas of a service, choosing for each request by its read
+// preference and by how many requests each target has outstanding, and
+// taking unhealthy targets out of rotation until they recover.
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+)
+
+var logger = GetLogger("balancer")
+
+// ErrNoTarget is returned, wrapped, by Pick when no healthy target suits
+// the read preference.
+var ErrNoTarget = errors.New("No healthy backend matches the read preference")
+
+// A Role is the part a target plays: primaries take writes, and reads
+// that must see them, while secondaries take the reads that allow it.
+type Role string
+
+const (
+	RolePrimary   Role = "primary"
+	RoleSecondary Role = "secondary"
+)
+
+// A Target is one backend in a group.
+type Target struct {
+	// Address says where the target is, such as a URL. It must be unique
+	// in the group.
+	Address string
+
+	// Weight is the share of requests the target takes, relative to the
+	// other targets it is chosen among. It must be positive.
+	Weight int
+
+	Role Role
+	Tags map[string]string
+
+	// the rest is guarded by the group's mutex
+	outstanding int
+	ejected     bool
+	ejectedAt   time.Time
+	failures    int
+	successes   int
+	lag         time.Duration
+	rtt         time.Duration
+}
+
+// A Health is what a health check learned about a target.
+type Health struct {
+	// Lag is how far a secondary is behind the primary, if known.
+	Lag time.Duration
+}
+
+// A Checker checks a target's health, returning an error if it is
+// unhealthy.
+type Checker func(ctx context.Context, t *Target) (Health, error)
+
+// Config holds the settings for a group.
+type Config struct {
+	// HealthCheckInterval is how often targets are checked, if the group
+	// has a Checker.
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// UnhealthyThreshold is the number of consecutive failures, of
+	// requests or of health checks, after which a target is ejected.
+	UnhealthyThreshold int
+
+	// HealthyThreshold is the number of consecutive health checks an
+	// ejected target must pass to be readmitted.
+	HealthyThreshold int
+
+	// EjectionTime is how long an ejected target stays out, if the group
+	// has no Checker to readmit it.
+	EjectionTime time.Duration
+
+	// LocalThreshold is the latency window for the nearest mode: targets
+	// whose health checks take longer than the fastest by more than this
+	// are not chosen.
+	LocalThreshold time.Duration
+
+	// AffinityTimeout is how long a binding lasts unused.
+	AffinityTimeout time.Duration
+}
+
+// DefaultConfig returns the default settings.
+func DefaultConfig() Config {
+	return Config{
+		HealthCheckInterval: 10 * time.Second,
+		HealthCheckTimeout:  5 * time.Second,
+		UnhealthyThreshold:  3,
+		HealthyThreshold:    2,
+		EjectionTime:        30 * time.Second,
+		LocalThreshold:      15 * time.Millisecond,
+		AffinityTimeout:     10 * time.Minute,
+	}
+}
+
+// A Group is a set of targets that requests are balanced over.
+type Group struct {
+	name    string
+	targets []*Target
+	conf    Config
+	check   Checker
+
+	mutex     sync.Mutex
+	bindings  map[string]*binding
+	lastPrune time.Time
+
+	done chan struct{}
+}
+
+// a binding sends the requests with a key, such as a cursor ID, to one
+// target.
+type binding struct {
+	target   *Target
+	lastUsed time.Time
+}
+
+// NewGroup creates a group of targets, and starts checking their health
+// if check is not nil. name identifies the group in logs and metrics.
+func NewGroup(name string, targets []*Target, conf Config, check Checker) (*Group, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("A backend group needs at least one target")
+	}
+	seen := map[string]bool{}
+	for _, t := range targets {
+		if seen[t.Address] {
+			return nil, fmt.Errorf("Backend “%s” is listed more than once", t.Address)
+		}
+		seen[t.Address] = true
+		if t.Weight <= 0 {
+			return nil, fmt.Errorf("Backend “%s” must have a positive weight, not %d", t.Address, t.Weight)
+		}
+		if t.Role != RolePrimary && t.Role != RoleSecondary {
+			return nil, fmt.Errorf("Backend “%s” must have role %s or %s, not “%s”", t.Address, RolePrimary, RoleSecondary, t.Role)
+		}
+		targetHealthy.With(name, t.Address).Set(1)
+	}
+
+	g := &Group{
+		name:     name,
+		targets:  targets,
+		conf:     conf,
+		check:    check,
+		bindings: make(map[string]*binding),
+		done:     make(chan struct{}),
+	}
+	if check != nil && conf.HealthCheckInterval > 0 {
+		go g.checkLoop()
+	}
+	return g, nil
+}
+
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Close stops the group's health checks.
+func (g *Group) Close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	select {
+	case <-g.done:
+	default:
+		close(g.done)
+	}
+}
+
+// Pick chooses the target for a request with the given read preference:
+// among the healthy targets that suit it, one with the fewest outstanding
+// requests for its weight. The request must be reported with
+// Done.
+func (g *Group) Pick(pref ReadPreference) (*Target, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var primaries, secondaries []*Target
+	for _, t := range g.targets {
+		if !g.available(t) {
+			continue
+		}
+		if t.Role == RolePrimary {
+			primaries = append(primaries, t)
+		} else {
+			secondaries = append(secondaries, t)
+		}
+	}
+
+	var candidates []*Target
+	switch pref.Mode {
+	case Primary:
+		candidates = primaries
+	case PrimaryPreferred:
+		candidates = primaries
+		if len(candidates) == 0 {
+			candidates = eligible(secondaries, pref)
+		}
+	case Secondary:
+		candidates = eligible(secondaries, pref)
+	case SecondaryPreferred:
+		candidates = eligible(secondaries, pref)
+		if len(candidates) == 0 {
+			candidates = primaries
+		}
+	case Nearest:
+		candidates = g.nearest(eligible(append(primaries, secondaries...), pref))
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: %s in %s", ErrNoTarget, pref.Mode, g.name)
+	}
+	t := leastLoaded(candidates)
+	g.begin(t)
+	return t, nil
+}
+
+// PickBound returns the target bound to key, or nil if there is none. A
+// bound target is returned even if it has been ejected, since only it can
+// serve the request. The request must be reported with Done.
+func (g *Group) PickBound(key string) *Target {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	b, ok := g.bindings[key]
+	if !ok {
+		return nil
+	}
+	b.lastUsed = time.Now()
+	g.begin(b.target)
+	return b.target
+}
+
+func (g *Group) begin(t *Target) {
+	t.outstanding++
+	outstandingRequests.With(g.name, t.Address).Inc()
+}
+
+// Done reports that a request to a target has finished, and whether the
+// target failed to serve it.
+func (g *Group) Done(t *Target, failed bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	t.outstanding--
+	outstandingRequests.With(g.name, t.Address).Dec()
+	g.record(t, !failed, false)
+}
+
+// Bind sends the requests with key to a target, until Unbind, or until it
+// goes unused for the affinity timeout.
+func (g *Group) Bind(key string, t *Target) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	g.bindings[key] = &binding{target: t, lastUsed: now}
+
+	if g.conf.AffinityTimeout > 0 && now.Sub(g.lastPrune) > g.conf.AffinityTimeout {
+		for key, b := range g.bindings {
+			if now.Sub(b.lastUsed) > g.conf.AffinityTimeout {
+				delete(g.bindings, key)
+			}
+		}
+		g.lastPrune = now
+	}
+}
+
+// Unbind forgets the target bound to key.
+func (g *Group) Unbind(key string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.bindings, key)
+}
+
+// available returns whether a target may be picked, readmitting ejected
+// targets whose time is up if there are no health checks to do so.
+func (g *Group) available(t *Target) bool {
+	if !t.ejected {
+		return true
+	}
+	if g.check == nil && time.Since(t.ejectedAt) >= g.conf.EjectionTime {
+		g.readmit(t)
+		return true
+	}
+	return false
+}
+
+// record records the outcome of a request or health check, ejecting or
+// readmitting the target as needed.
+func (g *Group) record(t *Target, ok bool, checked bool) {
+	if ok {
+		t.failures = 0
+		if t.ejected && checked {
+			t.successes++
+			if t.successes >= g.conf.HealthyThreshold {
+				g.readmit(t)
+			}
+		}
+		return
+	}
+
+	t.successes = 0
+	t.failures++
+	if !t.ejected && t.failures >= g.conf.UnhealthyThreshold {
+		logger.Log(WARNING, "Ejecting backend %s from %s after %d failures", t.Address, g.name, t.failures)
+		t.ejected = true
+		t.ejectedAt = time.Now()
+		ejections.With(g.name, t.Address).Inc()
+		targetHealthy.With(g.name, t.Address).Set(0)
+	}
+}
+
+func (g *Group) readmit(t *Target) {
+	logger.Log(NOTICE, "Readmitting backend %s to %s", t.Address, g.name)
+	t.ejected = false
+	t.failures = 0
+	t.successes = 0
+	targetHealthy.With(g.name, t.Address).Set(1)
+}
+
+// eligible returns the targets that are fresh enough for the read
+// preference, narrowed by its first tag set that matches any of them.
+func eligible(targets []*Target, pref ReadPreference) []*Target {
+	fresh := []*Target{}
+	for _, t := range targets {
+		if t.Role == RolePrimary {
+			fresh = append(fresh, t)
+			continue
+		}
+		if pref.MaxStaleness > 0 && t.lag > pref.MaxStaleness {
+			continue
+		}
+		if !pref.After.IsZero() && t.lag > time.Since(pref.After) {
+			continue
+		}
+		fresh = append(fresh, t)
+	}
+	if len(pref.TagSets) == 0 {
+		return fresh
+	}
+
+	for _, tags := range pref.TagSets {
+		matching := []*Target{}
+		for _, t := range fresh {
+			if matchesTags(t, tags) {
+				matching = append(matching, t)
+			}
+		}
+		if len(matching) > 0 {
+			return matching
+		}
+	}
+	return nil
+}
+
+func matchesTags(t *Target, tags map[string]string) bool {
+	for name, value := range tags {
+		if t.Tags[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// nearest returns the targets within the latency window of the fastest.
+func (g *Group) nearest(targets []*Target) []*Target {
+	if len(targets) == 0 {
+		return targets
+	}
+	fastest := targets[0].rtt
+	for _, t := range targets[1:] {
+		if t.rtt < fastest {
+			fastest = t.rtt
+		}
+	}
+	near := []*Target{}
+	for _, t := range targets {
+		if t.rtt-fastest <= g.conf.LocalThreshold {
+			near = append(near, t)
+		}
+	}
+	return near
+}
+
+// leastLoaded returns one of the targets with the fewest outstanding
+// requests for their weight, chosen at random in proportion to weight, so
+// that idle targets share requests by weight too.
+func leastLoaded(targets []*Target) *Target {
+	var best []*Target
+	var bestLoad float64
+	total := 0
+	for _, t := range targets {
+		load := float64(t.outstanding) / float64(t.Weight)
+		switch {
+		case len(best) == 0 || load < bestLoad:
+			best = []*Target{t}
+			bestLoad = load
+			total = t.Weight
+		case load == bestLoad:
+			best = append(best, t)
+			total += t.Weight
+		}
+	}
+
+	n := rand.Intn(total)
+	for _, t := range best {
+		if n < t.Weight {
+			return t
+		}
+		n -= t.Weight
+	}
+	return best[len(best)-1]
+}
@@ -0,0 +1,215 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func replicaSet() []*Target {
+	return []*Target{
+		{Address: "primary", Weight: 1, Role: RolePrimary, Tags: map[string]string{"dc": "east"}},
+		{Address: "east", Weight: 1, Role: RoleSecondary, Tags: map[string]string{"dc": "east"}},
+		{Address: "west", Weight: 1, Role: RoleSecondary, Tags: map[string]string{"dc": "west"}},
+	}
+}
+
+// picks picks n times without finishing the requests, and counts the
+// picks of each target.
+func picks(g *Group, pref ReadPreference, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		t, err := g.Pick(pref)
+		So(err, ShouldBeNil)
+		counts[t.Address]++
+	}
+	return counts
+}
+
+func TestParseReadPreference(t *testing.T) {
+	Convey("Parse read preferences", t, func() {
+		pref, err := ParseReadPreference(bson.D{
+			{Name: "mode", Value: "secondaryPreferred"},
+			{Name: "tags", Value: []interface{}{bson.D{{Name: "dc", Value: "west"}}, bson.D{}}},
+			{Name: "maxStalenessSeconds", Value: 120},
+		})
+		So(err, ShouldBeNil)
+		So(pref.Mode, ShouldEqual, SecondaryPreferred)
+		So(pref.TagSets, ShouldResemble, []map[string]string{{"dc": "west"}, {}})
+		So(pref.MaxStaleness, ShouldEqual, 2*time.Minute)
+
+		Convey("defaulting to primary", func() {
+			pref, err := ReadPreferenceOf(bson.D{{Name: "find", Value: "orders"}}, PrimaryOnly)
+			So(err, ShouldBeNil)
+			So(pref.Mode, ShouldEqual, Primary)
+		})
+
+		Convey("rejecting invalid ones", func() {
+			for _, doc := range []bson.M{
+				{"mode": "fastest"},
+				{"mode": "nearest", "maxStalenessSeconds": 30},
+				{"mode": "primary", "tags": []interface{}{bson.M{"dc": "east"}}},
+				{"mode": "nearest", "tags": []interface{}{bson.M{"rack": 1}}},
+			} {
+				_, err := ParseReadPreference(doc)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestPick(t *testing.T) {
+	Convey("Pick targets by read preference", t, func() {
+		targets := replicaSet()
+		g, err := NewGroup("test", targets, DefaultConfig(), nil)
+		So(err, ShouldBeNil)
+
+		Convey("sending primary reads to the primary", func() {
+			So(picks(g, PrimaryOnly, 3), ShouldResemble, map[string]int{"primary": 3})
+		})
+
+		Convey("spreading secondary reads by outstanding requests", func() {
+			So(picks(g, ReadPreference{Mode: SecondaryPreferred}, 4), ShouldResemble, map[string]int{"east": 2, "west": 2})
+		})
+
+		Convey("honoring tag sets in order", func() {
+			pref := ReadPreference{Mode: Secondary, TagSets: []map[string]string{{"dc": "north"}, {"dc": "west"}}}
+			So(picks(g, pref, 2), ShouldResemble, map[string]int{"west": 2})
+
+			pref = ReadPreference{Mode: Nearest, TagSets: []map[string]string{{"dc": "east"}}}
+			So(picks(g, pref, 4), ShouldResemble, map[string]int{"primary": 2, "east": 2})
+
+			_, err := g.Pick(ReadPreference{Mode: Secondary, TagSets: []map[string]string{{"dc": "north"}}})
+			So(errors.Is(err, ErrNoTarget), ShouldBeTrue)
+		})
+
+		Convey("ruling out stale secondaries", func() {
+			targets[1].lag = 5 * time.Minute
+			pref := ReadPreference{Mode: Secondary, MaxStaleness: 2 * time.Minute}
+			So(picks(g, pref, 2), ShouldResemble, map[string]int{"west": 2})
+		})
+
+		Convey("ruling out secondaries that may not have caught up", func() {
+			targets[1].lag = 5 * time.Second
+			pref := ReadPreference{Mode: SecondaryPreferred, After: time.Now().Add(-time.Second)}
+			So(picks(g, pref, 2), ShouldResemble, map[string]int{"west": 2})
+
+			targets[2].lag = 5 * time.Second
+			So(picks(g, pref, 2), ShouldResemble, map[string]int{"primary": 2})
+
+			// west still has the first two outstanding
+			pref.After = time.Now().Add(-time.Minute)
+			So(picks(g, pref, 2), ShouldResemble, map[string]int{"east": 2})
+		})
+
+		Convey("favoring heavier targets", func() {
+			targets[2].Weight = 3
+			counts := map[string]int{}
+			for i := 0; i < 600; i++ {
+				t, err := g.Pick(ReadPreference{Mode: Secondary})
+				So(err, ShouldBeNil)
+				counts[t.Address]++
+				g.Done(t, false)
+			}
+			So(counts["west"], ShouldBeGreaterThan, 2*counts["east"])
+			So(counts["east"], ShouldBeGreaterThan, 0)
+		})
+
+		Convey("sending finished requests' targets more", func() {
+			first, _ := g.Pick(ReadPreference{Mode: Secondary})
+			g.Done(first, false)
+			second, _ := g.Pick(ReadPreference{Mode: Secondary})
+			third, _ := g.Pick(ReadPreference{Mode: Secondary})
+			So(second, ShouldNotEqual, third)
+		})
+
+		Convey("sending bound requests to their target", func() {
+			g.Bind("cursor:1", targets[2])
+			So(g.PickBound("cursor:1"), ShouldEqual, targets[2])
+			g.Unbind("cursor:1")
+			So(g.PickBound("cursor:1"), ShouldBeNil)
+		})
+	})
+}
+
+func TestEjection(t *testing.T) {
+	Convey("Eject failing targets", t, func() {
+		targets := replicaSet()
+		conf := DefaultConfig()
+		conf.UnhealthyThreshold = 2
+		conf.EjectionTime = 50 * time.Millisecond
+		g, err := NewGroup("test", targets, conf, nil)
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 2; i++ {
+			g.Done(targets[1], true)
+		}
+		So(picks(g, ReadPreference{Mode: Secondary}, 2), ShouldResemble, map[string]int{"west": 2})
+
+		Convey("falling back to the primary", func() {
+			for i := 0; i < 2; i++ {
+				g.Done(targets[2], true)
+			}
+			So(picks(g, ReadPreference{Mode: SecondaryPreferred}, 1), ShouldResemble, map[string]int{"primary": 1})
+			_, err := g.Pick(ReadPreference{Mode: Secondary})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("and readmitting them after a while", func() {
+			time.Sleep(60 * time.Millisecond)
+			counts := picks(g, ReadPreference{Mode: Secondary}, 4)
+			So(counts["east"], ShouldBeGreaterThan, 0)
+		})
+	})
+
+	Convey("Check targets' health", t, func() {
+		var mutex sync.Mutex
+		down := map[string]bool{"west": true}
+		check := func(ctx context.Context, t *Target) (Health, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if down[t.Address] {
+				return Health{}, errors.New("down")
+			}
+			return Health{Lag: time.Second}, nil
+		}
+
+		conf := DefaultConfig()
+		conf.HealthCheckInterval = 10 * time.Millisecond
+		conf.UnhealthyThreshold = 1
+		conf.HealthyThreshold = 2
+		g, err := NewGroup("test", replicaSet(), conf, check)
+		So(err, ShouldBeNil)
+		defer g.Close()
+
+		time.Sleep(50 * time.Millisecond)
+		So(picks(g, ReadPreference{Mode: Secondary}, 2), ShouldResemble, map[string]int{"east": 2})
+
+		mutex.Lock()
+		down["west"] = false
+		mutex.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		So(picks(g, ReadPreference{Mode: Secondary}, 4)["west"], ShouldBeGreaterThan, 0)
+	})
+}
+
+func TestNewGroup(t *testing.T) {
+	Convey("Validate targets", t, func() {
+		_, err := NewGroup("test", nil, DefaultConfig(), nil)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewGroup("test", []*Target{{Address: "a", Weight: 0, Role: RolePrimary}}, DefaultConfig(), nil)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewGroup("test", []*Target{
+			{Address: "a", Weight: 1, Role: RolePrimary},
+			{Address: "a", Weight: 1, Role: RoleSecondary},
+		}, DefaultConfig(), nil)
+		So(err, ShouldNotBeNil)
+	})
+}
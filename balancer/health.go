@@ -0,0 +1,72 @@
+package balancer
+
+import (
+	"context"
+	"time"
+
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+)
+
+// checkLoop checks every target's health each interval, until the group
+// is closed.
+func (g *Group) checkLoop() {
+	ticker := time.NewTicker(g.conf.HealthCheckInterval)
+	defer ticker.Stop()
+
+	g.checkAll()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			g.checkAll()
+		}
+	}
+}
+
+// checkAll checks the targets at once, so that a slow target does not
+// hold up the others.
+func (g *Group) checkAll() {
+	results := make(chan struct{}, len(g.targets))
+	for _, t := range g.targets {
+		go func(t *Target) {
+			g.checkOne(t)
+			results <- struct{}{}
+		}(t)
+	}
+	for range g.targets {
+		<-results
+	}
+}
+
+func (g *Group) checkOne(t *Target) {
+	ctx := context.Background()
+	if g.conf.HealthCheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.conf.HealthCheckTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	health, err := g.check(ctx, t)
+	rtt := time.Since(start)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if err != nil {
+		healthCheckFailures.With(g.name, t.Address).Inc()
+		logger.Log(INFO, "Health check of %s in %s failed: %v", t.Address, g.name, err)
+		g.record(t, false, true)
+		return
+	}
+
+	// a moving average, so one slow check does not move a target out of
+	// the latency window
+	if t.rtt == 0 {
+		t.rtt = rtt
+	} else {
+		t.rtt = (4*t.rtt + rtt) / 5
+	}
+	t.lag = health.Lag
+	g.record(t, true, true)
+}
@@ -0,0 +1,25 @@
+package balancer
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+)
+
+var targetHealthy = metrics.NewGaugeVec("mongoproxy_balancer_target_healthy",
+	"Whether a backend is in rotation (1) or ejected (0), by group and target.",
+	"group", "target")
+
+var outstandingRequests = metrics.NewGaugeVec("mongoproxy_balancer_outstanding_requests",
+	"Requests sent to a backend and not yet answered, by group and target.",
+	"group", "target")
+
+var ejections = metrics.NewCounterVec("mongoproxy_balancer_ejections_total",
+	"Times a backend was taken out of rotation for failing, by group and target.",
+	"group", "target")
+
+var healthCheckFailures = metrics.NewCounterVec("mongoproxy_balancer_health_check_failures_total",
+	"Failed health checks, by group and target.",
+	"group", "target")
+
+func init() {
+	metrics.MustRegister(targetHealthy, outstandingRequests, ejections, healthCheckFailures)
+}
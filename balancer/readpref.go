@@ -0,0 +1,133 @@
+package balancer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A Mode is a read preference mode.
+type Mode int
+
+const (
+	Primary Mode = iota
+	PrimaryPreferred
+	Secondary
+	SecondaryPreferred
+	Nearest
+)
+
+var modeNames = map[Mode]string{
+	Primary:            "primary",
+	PrimaryPreferred:   "primaryPreferred",
+	Secondary:          "secondary",
+	SecondaryPreferred: "secondaryPreferred",
+	Nearest:            "nearest",
+}
+
+func (m Mode) String() string {
+	return modeNames[m]
+}
+
+// ParseMode returns the mode with the given name, as in $readPreference.
+func ParseMode(name string) (Mode, error) {
+	for mode, modeName := range modeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return Primary, fmt.Errorf("Unknown read preference mode “%s”", name)
+}
+
+// MinMaxStaleness is the smallest maxStalenessSeconds allowed, as in
+// MongoDB.
+const MinMaxStaleness = 90 * time.Second
+
+// A ReadPreference says which targets may serve a read.
+type ReadPreference struct {
+	Mode Mode
+
+	// TagSets are tried in order, and the first that matches any
+	// eligible target restricts the choice to the targets it matches. An
+	// empty tag set matches every target.
+	TagSets []map[string]string
+
+	// MaxStaleness, if set, rules out secondaries that lag further
+	// behind the primary.
+	MaxStaleness time.Duration
+
+	// After, if set, rules out secondaries that may not have caught up
+	// with writes made then, as for reads with afterClusterTime: those
+	// that lag further behind the primary than the time since.
+	After time.Time
+}
+
+// PrimaryOnly is the default read preference, and the only one for writes.
+var PrimaryOnly = ReadPreference{Mode: Primary}
+
+// ParseReadPreference reads a read preference document, as in the
+// $readPreference field of an OP_MSG: a mode, with optional tags and
+// maxStalenessSeconds.
+func ParseReadPreference(v interface{}) (ReadPreference, error) {
+	doc := convert.ToBSONMap(v)
+	if doc == nil {
+		return PrimaryOnly, fmt.Errorf("$readPreference must be a document, not %v", v)
+	}
+
+	name, ok := doc["mode"].(string)
+	if !ok {
+		return PrimaryOnly, fmt.Errorf("$readPreference.mode must be a string, not %v", doc["mode"])
+	}
+	mode, err := ParseMode(name)
+	if err != nil {
+		return PrimaryOnly, err
+	}
+	pref := ReadPreference{Mode: mode}
+
+	if tags, ok := doc["tags"]; ok {
+		sets, err := convert.ConvertToBSONMapSlice(tags)
+		if err != nil {
+			return PrimaryOnly, fmt.Errorf("$readPreference.tags must be an array of documents, not %v", tags)
+		}
+		for _, set := range sets {
+			tagSet := map[string]string{}
+			for name, value := range set {
+				str, ok := value.(string)
+				if !ok {
+					return PrimaryOnly, fmt.Errorf("$readPreference.tags: value of “%s” must be a string, not %v", name, value)
+				}
+				tagSet[name] = str
+			}
+			pref.TagSets = append(pref.TagSets, tagSet)
+		}
+	}
+
+	if value, ok := doc["maxStalenessSeconds"]; ok {
+		secs := convert.ToFloat64(value, 0)
+		switch {
+		case secs == -1:
+		case secs*float64(time.Second) < float64(MinMaxStaleness):
+			return PrimaryOnly, fmt.Errorf("$readPreference.maxStalenessSeconds must be -1 or at least %.0f, not %v", MinMaxStaleness.Seconds(), value)
+		default:
+			pref.MaxStaleness = time.Duration(secs * float64(time.Second))
+		}
+	}
+
+	if mode == Primary && (len(pref.TagSets) > 0 || pref.MaxStaleness > 0) {
+		return PrimaryOnly, fmt.Errorf("$readPreference with mode primary cannot have tags or maxStalenessSeconds")
+	}
+	return pref, nil
+}
+
+// ReadPreferenceOf returns the read preference of a command, from its
+// $readPreference field, or def if it has none.
+func ReadPreferenceOf(body bson.D, def ReadPreference) (ReadPreference, error) {
+	value := bsonutil.FindValueByKey("$readPreference", body)
+	if value == nil {
+		return def, nil
+	}
+	return ParseReadPreference(value)
+}
@@ -0,0 +1,342 @@
+package bsonutil
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Canonical type ranks, in the order MongoDB sorts values of different
+// types.
+const (
+	rankMinKey = iota
+	rankNull
+	rankNumber
+	rankString
+	rankObject
+	rankArray
+	rankBinary
+	rankObjectId
+	rankBoolean
+	rankDate
+	rankTimestamp
+	rankRegex
+	rankMaxKey
+)
+
+// typeRank returns the canonical rank of a value's type. Values of types
+// that BSON has no place for rank with null.
+func typeRank(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return rankNull
+	case int, int32, int64, float64, float32, bson.Decimal128:
+		return rankNumber
+	case string, bson.Symbol:
+		return rankString
+	case bson.D, bson.M, map[string]interface{}, bson.RawD:
+		return rankObject
+	case []interface{}, []bson.D, []bson.M, []string:
+		return rankArray
+	case []byte, bson.Binary:
+		return rankBinary
+	case bson.ObjectId:
+		return rankObjectId
+	case bool:
+		return rankBoolean
+	case time.Time:
+		return rankDate
+	case bson.MongoTimestamp:
+		return rankTimestamp
+	case bson.RegEx:
+		return rankRegex
+	default:
+		if v == bson.MinKey {
+			return rankMinKey
+		}
+		if v == bson.MaxKey {
+			return rankMaxKey
+		}
+		if v == bson.Undefined {
+			return rankNull
+		}
+	}
+	return rankNull
+}
+
+// IsNumber returns whether a value is a BSON number.
+func IsNumber(v interface{}) bool {
+	return typeRank(v) == rankNumber
+}
+
+// SameType returns whether two values have the same canonical type, as
+// query comparisons such as $gt require: any two numbers do.
+func SameType(a, b interface{}) bool {
+	return typeRank(a) == typeRank(b)
+}
+
+// Compare orders two BSON values as MongoDB does, returning -1, 0 or 1:
+// first by the canonical order of their types, so that, for instance,
+// every number sorts before every string, and then by value. Numbers of
+// different types compare by value, documents field by field, and arrays
+// element by element.
+func Compare(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+
+	switch ra {
+	case rankNumber:
+		return compareNumbers(a, b)
+	case rankString:
+		return strings.Compare(toString(a), toString(b))
+	case rankObject:
+		return compareDocs(ToD(a), ToD(b))
+	case rankArray:
+		return compareArrays(ToArray(a), ToArray(b))
+	case rankBinary:
+		return compareBinary(a, b)
+	case rankObjectId:
+		return strings.Compare(string(a.(bson.ObjectId)), string(b.(bson.ObjectId)))
+	case rankBoolean:
+		return compareBools(a.(bool), b.(bool))
+	case rankDate:
+		ta, tb := a.(time.Time), b.(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+	case rankTimestamp:
+		ta, tb := uint64(a.(bson.MongoTimestamp)), uint64(b.(bson.MongoTimestamp))
+		switch {
+		case ta < tb:
+			return -1
+		case ta > tb:
+			return 1
+		}
+	case rankRegex:
+		ra, rb := a.(bson.RegEx), b.(bson.RegEx)
+		if c := strings.Compare(ra.Pattern, rb.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(ra.Options, rb.Options)
+	}
+	return 0
+}
+
+// Equal returns whether two BSON values are equal, as MongoDB compares
+// them: numbers of different types are equal if their values are.
+func Equal(a, b interface{}) bool {
+	return Compare(a, b) == 0
+}
+
+// ToD returns a document as a bson.D, or nil if it is not a document.
+// Fields of maps come in sorted order.
+func ToD(v interface{}) bson.D {
+	switch doc := v.(type) {
+	case bson.D:
+		return doc
+	case bson.RawD:
+		d := bson.D{}
+		for _, elem := range doc {
+			var value interface{}
+			elem.Value.Unmarshal(&value)
+			d = append(d, bson.DocElem{Name: elem.Name, Value: value})
+		}
+		return d
+	case bson.M:
+		return mapToD(doc)
+	case map[string]interface{}:
+		return mapToD(doc)
+	}
+	return nil
+}
+
+func mapToD(m map[string]interface{}) bson.D {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d := make(bson.D, len(names))
+	for i, name := range names {
+		d[i] = bson.DocElem{Name: name, Value: m[name]}
+	}
+	return d
+}
+
+// ToArray returns an array as a []interface{}, or nil if it is not an
+// array.
+func ToArray(v interface{}) []interface{} {
+	switch array := v.(type) {
+	case []interface{}:
+		return array
+	case []bson.D:
+		out := make([]interface{}, len(array))
+		for i, doc := range array {
+			out[i] = doc
+		}
+		return out
+	case []bson.M:
+		out := make([]interface{}, len(array))
+		for i, doc := range array {
+			out[i] = doc
+		}
+		return out
+	case []string:
+		out := make([]interface{}, len(array))
+		for i, s := range array {
+			out[i] = s
+		}
+		return out
+	}
+	return nil
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
+	return 1
+}
+
+// compareNumbers compares integers exactly, and anything else as floats,
+// with NaN below every other number, as in MongoDB.
+func compareNumbers(a, b interface{}) int {
+	ia, aInt := toInt64(a)
+	ib, bInt := toInt64(b)
+	if aInt && bInt {
+		return compareInts(ia, ib)
+	}
+
+	fa, fb := toFloat64(a), toFloat64(b)
+	switch {
+	case math.IsNaN(fa) && math.IsNaN(fb):
+		return 0
+	case math.IsNaN(fa):
+		return -1
+	case math.IsNaN(fb):
+		return 1
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	}
+	return 0
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return math.NaN()
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case bson.Symbol:
+		return string(s)
+	}
+	return ""
+}
+
+// compareDocs compares documents field by field: by the type of each
+// field's value, then its name, then its value. A document that is a
+// prefix of another sorts first.
+func compareDocs(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ra, rb := typeRank(a[i].Value), typeRank(b[i].Value)
+		if ra != rb {
+			return compareInts(int64(ra), int64(rb))
+		}
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := Compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
+
+func compareArrays(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
+
+// compareBinary compares binary data by length, then subtype, then bytes.
+func compareBinary(a, b interface{}) int {
+	ka, da := binaryParts(a)
+	kb, db := binaryParts(b)
+	if c := compareInts(int64(len(da)), int64(len(db))); c != 0 {
+		return c
+	}
+	if c := compareInts(int64(ka), int64(kb)); c != 0 {
+		return c
+	}
+	return bytes.Compare(da, db)
+}
+
+func binaryParts(v interface{}) (byte, []byte) {
+	switch b := v.(type) {
+	case bson.Binary:
+		return b.Kind, b.Data
+	case []byte:
+		return 0, b
+	}
+	return 0, nil
+}
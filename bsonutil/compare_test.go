@@ -0,0 +1,67 @@
+package bsonutil
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCompare(t *testing.T) {
+	Convey("Order values of different types canonically", t, func() {
+		ordered := []interface{}{
+			bson.MinKey,
+			nil,
+			math.NaN(),
+			-1,
+			int64(2),
+			2.5,
+			"",
+			"a",
+			bson.D{},
+			bson.D{{Name: "a", Value: 1}},
+			[]interface{}{},
+			[]interface{}{1},
+			[]byte("x"),
+			bson.ObjectIdHex("5f0000000000000000000000"),
+			false,
+			true,
+			time.Unix(0, 0),
+			bson.MongoTimestamp(1),
+			bson.RegEx{Pattern: "a"},
+			bson.MaxKey,
+		}
+		for i := range ordered {
+			for j := range ordered {
+				want := 0
+				if i < j {
+					want = -1
+				} else if i > j {
+					want = 1
+				}
+				So(Compare(ordered[i], ordered[j]), ShouldEqual, want)
+			}
+		}
+	})
+
+	Convey("Compare numbers by value", t, func() {
+		So(Equal(1, 1.0), ShouldBeTrue)
+		So(Equal(int32(7), int64(7)), ShouldBeTrue)
+		So(Compare(int64(math.MaxInt64), int64(math.MaxInt64-1)), ShouldEqual, 1)
+		So(Compare(bson.Undefined, nil), ShouldEqual, 0)
+	})
+
+	Convey("Compare documents field by field", t, func() {
+		So(Compare(bson.D{{Name: "a", Value: 1}}, bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 1}}), ShouldEqual, -1)
+		So(Compare(bson.D{{Name: "a", Value: 2}}, bson.D{{Name: "b", Value: 1}}), ShouldEqual, -1)
+		So(Compare(bson.D{{Name: "a", Value: "x"}}, bson.D{{Name: "a", Value: 5}}), ShouldEqual, 1)
+		So(Equal(bson.M{"b": 2, "a": 1}, bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2.0}}), ShouldBeTrue)
+	})
+
+	Convey("Compare binary data by length first", t, func() {
+		So(Compare([]byte("zz"), []byte("aaa")), ShouldEqual, -1)
+		So(Compare(bson.Binary{Kind: 4, Data: []byte("a")}, bson.Binary{Kind: 0, Data: []byte("b")}), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,593 @@
+package bsonutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ExtJSONMode selects between the two formats of MongoDB Extended JSON v2.
+type ExtJSONMode int
+
+const (
+	// Canonical Extended JSON wraps every value whose type JSON cannot
+	// express, including all numbers, so that types survive a round trip.
+	Canonical ExtJSONMode = iota
+
+	// Relaxed Extended JSON writes numbers and recent dates as plain JSON,
+	// which is easier to read, but loses the distinction between int32,
+	// int64 and integral doubles.
+	Relaxed
+)
+
+// the layout of relaxed dates, which are always in UTC.
+const extJSONDateLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// MarshalExtJSON returns v, a BSON document or value, as Extended JSON v2
+// in the given mode. Documents given as bson.D keep their field order;
+// maps are written with their keys sorted.
+func MarshalExtJSON(v interface{}, mode ExtJSONMode) ([]byte, error) {
+	e := &extJSONEncoder{mode: mode}
+	if err := e.value(v); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+type extJSONEncoder struct {
+	buf  bytes.Buffer
+	mode ExtJSONMode
+}
+
+func (e *extJSONEncoder) string(s string) {
+	encoded, _ := json.Marshal(s)
+	e.buf.Write(encoded)
+}
+
+// wrapper writes a single-field object, {"<name>": <value>}, where value
+// is already encoded.
+func (e *extJSONEncoder) wrapper(name string, value string) {
+	e.buf.WriteString(`{"` + name + `":` + value + `}`)
+}
+
+func quote(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+func (e *extJSONEncoder) value(v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		e.buf.WriteString("null")
+	case bool:
+		e.buf.WriteString(strconv.FormatBool(val))
+	case string:
+		e.string(val)
+	case int:
+		if val >= math.MinInt32 && val <= math.MaxInt32 {
+			e.int32(int32(val))
+		} else {
+			e.int64(int64(val))
+		}
+	case int8:
+		e.int32(int32(val))
+	case int16:
+		e.int32(int32(val))
+	case int32:
+		e.int32(val)
+	case uint8:
+		e.int32(int32(val))
+	case uint16:
+		e.int32(int32(val))
+	case uint32:
+		e.int64(int64(val))
+	case int64:
+		e.int64(val)
+	case uint64:
+		if val > math.MaxInt64 {
+			return fmt.Errorf("%d overflows a BSON int64", val)
+		}
+		e.int64(int64(val))
+	case float32:
+		e.double(float64(val))
+	case float64:
+		e.double(val)
+	case time.Time:
+		e.date(val)
+	case bson.ObjectId:
+		if len(val) != 12 {
+			return fmt.Errorf("Invalid ObjectId: %q", string(val))
+		}
+		e.wrapper("$oid", quote(hex.EncodeToString([]byte(val))))
+	case bson.Decimal128:
+		e.wrapper("$numberDecimal", quote(val.String()))
+	case []byte:
+		e.binary(0, val)
+	case bson.Binary:
+		e.binary(val.Kind, val.Data)
+	case bson.RegEx:
+		options := []byte(val.Options)
+		sort.Slice(options, func(i, j int) bool { return options[i] < options[j] })
+		e.wrapper("$regularExpression",
+			`{"pattern":`+quote(val.Pattern)+`,"options":`+quote(string(options))+`}`)
+	case bson.MongoTimestamp:
+		e.wrapper("$timestamp", fmt.Sprintf(`{"t":%d,"i":%d}`, uint32(val>>32), uint32(val)))
+	case bson.Symbol:
+		e.wrapper("$symbol", quote(string(val)))
+	case bson.JavaScript:
+		e.buf.WriteString(`{"$code":` + quote(val.Code))
+		if val.Scope != nil {
+			e.buf.WriteString(`,"$scope":`)
+			if err := e.value(val.Scope); err != nil {
+				return err
+			}
+		}
+		e.buf.WriteByte('}')
+	case bson.DBPointer:
+		e.buf.WriteString(`{"$dbPointer":{"$ref":` + quote(val.Namespace) + `,"$id":`)
+		if err := e.value(val.Id); err != nil {
+			return err
+		}
+		e.buf.WriteString(`}}`)
+	case bson.D:
+		return e.document(val)
+	case bson.RawD:
+		doc := bson.D{}
+		for _, elem := range val {
+			var value interface{}
+			if err := elem.Value.Unmarshal(&value); err != nil {
+				return err
+			}
+			doc = append(doc, bson.DocElem{Name: elem.Name, Value: value})
+		}
+		return e.document(doc)
+	case bson.Raw:
+		var value interface{}
+		if err := val.Unmarshal(&value); err != nil {
+			return err
+		}
+		return e.value(value)
+	case []interface{}:
+		e.buf.WriteByte('[')
+		for i, item := range val {
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			if err := e.value(item); err != nil {
+				return err
+			}
+		}
+		e.buf.WriteByte(']')
+	default:
+		switch {
+		case v == bson.MinKey:
+			e.wrapper("$minKey", "1")
+		case v == bson.MaxKey:
+			e.wrapper("$maxKey", "1")
+		case v == bson.Undefined:
+			e.wrapper("$undefined", "true")
+		default:
+			return e.reflectValue(v)
+		}
+	}
+	return nil
+}
+
+func (e *extJSONEncoder) int32(n int32) {
+	if e.mode == Relaxed {
+		e.buf.WriteString(strconv.FormatInt(int64(n), 10))
+		return
+	}
+	e.wrapper("$numberInt", quote(strconv.FormatInt(int64(n), 10)))
+}
+
+func (e *extJSONEncoder) int64(n int64) {
+	if e.mode == Relaxed {
+		e.buf.WriteString(strconv.FormatInt(n, 10))
+		return
+	}
+	e.wrapper("$numberLong", quote(strconv.FormatInt(n, 10)))
+}
+
+func (e *extJSONEncoder) double(f float64) {
+	var s string
+	switch {
+	case math.IsNaN(f):
+		s = "NaN"
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	default:
+		s = strconv.FormatFloat(f, 'G', -1, 64)
+		// keep integral doubles recognizable as doubles
+		if !strings.ContainsAny(s, ".E") {
+			s += ".0"
+		}
+		if e.mode == Relaxed {
+			e.buf.WriteString(s)
+			return
+		}
+	}
+	e.wrapper("$numberDouble", quote(s))
+}
+
+func (e *extJSONEncoder) date(t time.Time) {
+	t = t.UTC()
+	if e.mode == Relaxed && t.Year() >= 1970 && t.Year() <= 9999 {
+		e.wrapper("$date", quote(t.Format(extJSONDateLayout)))
+		return
+	}
+	millis := t.Unix()*1000 + int64(t.Nanosecond()/int(time.Millisecond))
+	e.wrapper("$date", `{"$numberLong":`+quote(strconv.FormatInt(millis, 10))+`}`)
+}
+
+func (e *extJSONEncoder) binary(kind byte, data []byte) {
+	e.wrapper("$binary", `{"base64":`+quote(base64.StdEncoding.EncodeToString(data))+
+		`,"subType":`+quote(fmt.Sprintf("%02x", kind))+`}`)
+}
+
+func (e *extJSONEncoder) document(doc bson.D) error {
+	e.buf.WriteByte('{')
+	for i, elem := range doc {
+		if i > 0 {
+			e.buf.WriteByte(',')
+		}
+		e.string(elem.Name)
+		e.buf.WriteByte(':')
+		if err := e.value(elem.Value); err != nil {
+			return err
+		}
+	}
+	e.buf.WriteByte('}')
+	return nil
+}
+
+// reflectValue encodes maps, slices and pointers of any type, and anything
+// else by the way the bson package marshals it.
+func (e *extJSONEncoder) reflectValue(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			e.buf.WriteString("null")
+			return nil
+		}
+		return e.value(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			e.buf.WriteString("null")
+			return nil
+		}
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			items[i] = rv.Index(i).Interface()
+		}
+		return e.value(items)
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("Cannot encode a map with %v keys as Extended JSON", rv.Type().Key())
+		}
+		keys := make([]string, 0, rv.Len())
+		for _, key := range rv.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		doc := make(bson.D, len(keys))
+		for i, key := range keys {
+			value := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+			doc[i] = bson.DocElem{Name: key, Value: value.Interface()}
+		}
+		return e.document(doc)
+	}
+
+	// structs and other types go through the bson package, so that field
+	// names and types are the same as in BSON.
+	raw, err := bson.Marshal(bson.M{"v": v})
+	if err != nil {
+		return fmt.Errorf("Cannot encode %T as Extended JSON: %v", v, err)
+	}
+	var wrapped bson.D
+	if err := bson.Unmarshal(raw, &wrapped); err != nil {
+		return fmt.Errorf("Cannot encode %T as Extended JSON: %v", v, err)
+	}
+	return e.value(wrapped[0].Value)
+}
+
+// UnmarshalExtJSON parses a value in Extended JSON v2, in either mode, and
+// returns it as the types the bson package uses: documents as bson.D,
+// arrays as []interface{}, int32 values as int, and so on. Legacy formats
+// of $date, $binary and $regex are accepted too.
+func UnmarshalExtJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	value, err := decodeExtJSON(dec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Extended JSON: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("Invalid Extended JSON: unexpected data after the value")
+	}
+	return value, nil
+}
+
+// UnmarshalExtJSONDoc parses a document in Extended JSON v2.
+func UnmarshalExtJSONDoc(data []byte) (bson.D, error) {
+	value, err := UnmarshalExtJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("Invalid Extended JSON: expected a document, not %T", value)
+	}
+	return doc, nil
+}
+
+func decodeExtJSON(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok := token.(type) {
+	case json.Delim:
+		switch tok {
+		case '{':
+			doc := bson.D{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeExtJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				doc = append(doc, bson.DocElem{Name: key.(string), Value: value})
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return unwrapExtJSON(doc)
+		case '[':
+			array := []interface{}{}
+			for dec.More() {
+				value, err := decodeExtJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return array, nil
+		}
+		return nil, fmt.Errorf("unexpected %v", tok)
+	case json.Number:
+		return relaxedNumber(tok)
+	}
+	// strings, booleans and null
+	return token, nil
+}
+
+// relaxedNumber returns the BSON value of a plain JSON number: an int32 or
+// int64 if it is an integer that fits, or a double.
+func relaxedNumber(n json.Number) (interface{}, error) {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int(i), nil
+			}
+			return i, nil
+		}
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// unwrapExtJSON returns the value that a document stands for, if it is one
+// of the Extended JSON type wrappers, or the document itself.
+func unwrapExtJSON(doc bson.D) (interface{}, error) {
+	if len(doc) == 0 || len(doc) > 2 || !strings.HasPrefix(doc[0].Name, "$") {
+		return doc, nil
+	}
+
+	if len(doc) == 2 {
+		names := doc[0].Name + "," + doc[1].Name
+		switch names {
+		case "$regex,$options", "$options,$regex":
+			m := doc.Map()
+			pattern, ok1 := m["$regex"].(string)
+			options, ok2 := m["$options"].(string)
+			if !ok1 || !ok2 {
+				// a query's $regex operator
+				return doc, nil
+			}
+			return bson.RegEx{Pattern: pattern, Options: options}, nil
+		case "$binary,$type", "$type,$binary":
+			m := doc.Map()
+			data, ok1 := m["$binary"].(string)
+			kind, ok2 := m["$type"].(string)
+			if !ok1 || !ok2 {
+				// a query's $type operator
+				return doc, nil
+			}
+			return decodeBinary(data, kind)
+		case "$code,$scope":
+			code, ok := doc[0].Value.(string)
+			scope, isDoc := doc[1].Value.(bson.D)
+			if !ok || !isDoc {
+				return nil, fmt.Errorf("invalid $code with $scope")
+			}
+			return bson.JavaScript{Code: code, Scope: scope}, nil
+		}
+		return doc, nil
+	}
+
+	name, value := doc[0].Name, doc[0].Value
+	str, isString := value.(string)
+	sub, isDoc := value.(bson.D)
+
+	switch name {
+	case "$oid":
+		if !isString || !bson.IsObjectIdHex(str) {
+			return nil, fmt.Errorf("invalid $oid: %v", value)
+		}
+		return bson.ObjectIdHex(str), nil
+	case "$symbol":
+		if !isString {
+			return nil, fmt.Errorf("invalid $symbol: %v", value)
+		}
+		return bson.Symbol(str), nil
+	case "$numberInt":
+		n, err := strconv.ParseInt(str, 10, 32)
+		if !isString || err != nil {
+			return nil, fmt.Errorf("invalid $numberInt: %v", value)
+		}
+		return int(n), nil
+	case "$numberLong":
+		n, err := strconv.ParseInt(str, 10, 64)
+		if !isString || err != nil {
+			return nil, fmt.Errorf("invalid $numberLong: %v", value)
+		}
+		return n, nil
+	case "$numberDouble":
+		if !isString {
+			return nil, fmt.Errorf("invalid $numberDouble: %v", value)
+		}
+		switch str {
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		case "NaN":
+			return math.NaN(), nil
+		}
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid $numberDouble: %v", value)
+		}
+		return f, nil
+	case "$numberDecimal":
+		d, err := bson.ParseDecimal128(str)
+		if !isString || err != nil {
+			return nil, fmt.Errorf("invalid $numberDecimal: %v", value)
+		}
+		return d, nil
+	case "$binary":
+		if !isDoc || len(sub) != 2 {
+			return nil, fmt.Errorf("invalid $binary: %v", value)
+		}
+		m := sub.Map()
+		data, ok1 := m["base64"].(string)
+		kind, ok2 := m["subType"].(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid $binary: %v", value)
+		}
+		return decodeBinary(data, kind)
+	case "$uuid":
+		data, err := hex.DecodeString(strings.Replace(str, "-", "", -1))
+		if !isString || err != nil || len(data) != 16 {
+			return nil, fmt.Errorf("invalid $uuid: %v", value)
+		}
+		return bson.Binary{Kind: 4, Data: data}, nil
+	case "$code":
+		if !isString {
+			return nil, fmt.Errorf("invalid $code: %v", value)
+		}
+		return bson.JavaScript{Code: str}, nil
+	case "$timestamp":
+		m := sub.Map()
+		t, ok1 := m["t"].(int64)
+		i, ok2 := m["i"].(int64)
+		if t32, ok := m["t"].(int); ok {
+			t, ok1 = int64(t32), true
+		}
+		if i32, ok := m["i"].(int); ok {
+			i, ok2 = int64(i32), true
+		}
+		if !isDoc || !ok1 || !ok2 || t < 0 || i < 0 || t > math.MaxUint32 || i > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid $timestamp: %v", value)
+		}
+		return bson.MongoTimestamp(t<<32 | i), nil
+	case "$regularExpression":
+		m := sub.Map()
+		pattern, ok1 := m["pattern"].(string)
+		options, ok2 := m["options"].(string)
+		if !isDoc || !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid $regularExpression: %v", value)
+		}
+		return bson.RegEx{Pattern: pattern, Options: options}, nil
+	case "$dbPointer":
+		m := sub.Map()
+		ns, ok1 := m["$ref"].(string)
+		id, ok2 := m["$id"].(bson.ObjectId)
+		if !isDoc || !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid $dbPointer: %v", value)
+		}
+		return bson.DBPointer{Namespace: ns, Id: id}, nil
+	case "$date":
+		return decodeDate(value)
+	case "$minKey":
+		return bson.MinKey, nil
+	case "$maxKey":
+		return bson.MaxKey, nil
+	case "$undefined":
+		return bson.Undefined, nil
+	}
+
+	// query operators, such as $gt, are ordinary fields
+	return doc, nil
+}
+
+func decodeBinary(data string, kind string) (interface{}, error) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 in $binary: %v", err)
+	}
+	subType, err := strconv.ParseUint(kind, 16, 8)
+	if err != nil || len(kind) > 2 {
+		return nil, fmt.Errorf("invalid $binary subtype: %q", kind)
+	}
+	if subType == 0 {
+		return raw, nil
+	}
+	return bson.Binary{Kind: byte(subType), Data: raw}, nil
+}
+
+// decodeDate returns the time of a $date, which is an ISO-8601 string in
+// relaxed mode, a $numberLong of milliseconds in canonical mode, or a
+// plain number of milliseconds in the legacy format.
+func decodeDate(value interface{}) (interface{}, error) {
+	var millis int64
+	switch val := value.(type) {
+	case string:
+		for _, layout := range []string{extJSONDateLayout, time.RFC3339Nano, "2006-01-02T15:04:05Z0700"} {
+			if t, err := time.Parse(layout, val); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid $date: %q", val)
+	case int64:
+		millis = val
+	case int:
+		millis = int64(val)
+	default:
+		return nil, fmt.Errorf("invalid $date: %v", value)
+	}
+	return time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond)).UTC(), nil
+}
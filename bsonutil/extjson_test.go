@@ -0,0 +1,148 @@
+package bsonutil
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMarshalExtJSON(t *testing.T) {
+	date := time.Date(2021, 3, 4, 5, 6, 7, 890*int(time.Millisecond), time.UTC)
+	decimal, _ := bson.ParseDecimal128("1.50")
+	doc := bson.D{
+		{Name: "_id", Value: bson.ObjectIdHex("5f1e6b7c8d9e0f1a2b3c4d5e")},
+		{Name: "int", Value: 1},
+		{Name: "long", Value: int64(2)},
+		{Name: "double", Value: 3.0},
+		{Name: "decimal", Value: decimal},
+		{Name: "date", Value: date},
+		{Name: "bin", Value: bson.Binary{Kind: 4, Data: []byte{1, 2}}},
+		{Name: "re", Value: bson.RegEx{Pattern: "^a", Options: "mi"}},
+		{Name: "ts", Value: bson.MongoTimestamp(5<<32 | 6)},
+		{Name: "list", Value: []interface{}{"a", true, nil}},
+	}
+
+	Convey("Marshal Extended JSON", t, func() {
+		Convey("in canonical mode", func() {
+			out, err := MarshalExtJSON(doc, Canonical)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, `{"_id":{"$oid":"5f1e6b7c8d9e0f1a2b3c4d5e"},`+
+				`"int":{"$numberInt":"1"},"long":{"$numberLong":"2"},"double":{"$numberDouble":"3.0"},`+
+				`"decimal":{"$numberDecimal":"1.50"},"date":{"$date":{"$numberLong":"1614834367890"}},`+
+				`"bin":{"$binary":{"base64":"AQI=","subType":"04"}},`+
+				`"re":{"$regularExpression":{"pattern":"^a","options":"im"}},`+
+				`"ts":{"$timestamp":{"t":5,"i":6}},"list":["a",true,null]}`)
+		})
+
+		Convey("in relaxed mode", func() {
+			out, err := MarshalExtJSON(doc[1:6], Relaxed)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, `{"int":1,"long":2,"double":3.0,`+
+				`"decimal":{"$numberDecimal":"1.50"},"date":{"$date":"2021-03-04T05:06:07.890Z"}}`)
+		})
+
+		Convey("with maps in key order", func() {
+			out, err := MarshalExtJSON(bson.M{"b": 1, "a": bson.M{"c": "d"}}, Relaxed)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, `{"a":{"c":"d"},"b":1}`)
+		})
+
+		Convey("with special doubles", func() {
+			out, err := MarshalExtJSON([]interface{}{math.Inf(-1), math.NaN()}, Relaxed)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, `[{"$numberDouble":"-Infinity"},{"$numberDouble":"NaN"}]`)
+		})
+
+		Convey("with structs as the bson package marshals them", func() {
+			out, err := MarshalExtJSON(struct {
+				Name  string
+				Count int64 `bson:"n"`
+			}{"x", 4}, Canonical)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, `{"name":"x","n":{"$numberLong":"4"}}`)
+		})
+	})
+
+	Convey("Round trip Extended JSON", t, func() {
+		for _, mode := range []ExtJSONMode{Canonical, Relaxed} {
+			out, err := MarshalExtJSON(doc, mode)
+			So(err, ShouldBeNil)
+			back, err := UnmarshalExtJSONDoc(out)
+			So(err, ShouldBeNil)
+			So(len(back), ShouldEqual, len(doc))
+			So(back[0].Value, ShouldEqual, doc[0].Value)
+			So(back[4].Value, ShouldResemble, decimal)
+			So(back[5].Value.(time.Time).Equal(date), ShouldBeTrue)
+			So(back[6].Value, ShouldResemble, doc[6].Value)
+			So(back[7].Value, ShouldResemble, bson.RegEx{Pattern: "^a", Options: "im"})
+			So(back[8].Value, ShouldEqual, doc[8].Value)
+		}
+
+		out, _ := MarshalExtJSON(doc, Canonical)
+		back, _ := UnmarshalExtJSONDoc(out)
+		So(back[1].Value, ShouldEqual, 1)
+		So(back[2].Value, ShouldEqual, int64(2))
+		So(back[3].Value, ShouldEqual, 3.0)
+	})
+}
+
+func TestUnmarshalExtJSON(t *testing.T) {
+	Convey("Unmarshal Extended JSON", t, func() {
+		Convey("keeping field order", func() {
+			doc, err := UnmarshalExtJSONDoc([]byte(`{"z": 1, "a": 2, "m": {"y": 1, "b": 2}}`))
+			So(err, ShouldBeNil)
+			So(doc[0].Name, ShouldEqual, "z")
+			So(doc[2].Value.(bson.D)[0].Name, ShouldEqual, "y")
+		})
+
+		Convey("with relaxed numbers", func() {
+			doc, err := UnmarshalExtJSONDoc([]byte(`{"i": 7, "l": 3000000000, "d": 1.5, "e": 1e3}`))
+			So(err, ShouldBeNil)
+			So(doc[0].Value, ShouldEqual, 7)
+			So(doc[1].Value, ShouldEqual, int64(3000000000))
+			So(doc[2].Value, ShouldEqual, 1.5)
+			So(doc[3].Value, ShouldEqual, 1000.0)
+		})
+
+		Convey("keeping query operators as fields", func() {
+			doc, err := UnmarshalExtJSONDoc([]byte(`{"n": {"$gt": 5}, "s": {"$type": "string"}}`))
+			So(err, ShouldBeNil)
+			So(doc[0].Value, ShouldResemble, bson.D{{Name: "$gt", Value: 5}})
+			So(doc[1].Value, ShouldResemble, bson.D{{Name: "$type", Value: "string"}})
+		})
+
+		Convey("with legacy formats", func() {
+			doc, err := UnmarshalExtJSONDoc([]byte(
+				`{"d": {"$date": 1000}, "b": {"$binary": "AQI=", "$type": "80"}, "r": {"$regex": "a", "$options": "i"}}`))
+			So(err, ShouldBeNil)
+			So(doc[0].Value.(time.Time).Unix(), ShouldEqual, 1)
+			So(doc[1].Value, ShouldResemble, bson.Binary{Kind: 0x80, Data: []byte{1, 2}})
+			So(doc[2].Value, ShouldResemble, bson.RegEx{Pattern: "a", Options: "i"})
+		})
+
+		Convey("with special values", func() {
+			doc, err := UnmarshalExtJSONDoc([]byte(`{"min": {"$minKey": 1}, "max": {"$maxKey": 1}, ` +
+				`"u": {"$uuid": "00112233-4455-6677-8899-aabbccddeeff"}}`))
+			So(err, ShouldBeNil)
+			So(doc[0].Value, ShouldEqual, bson.MinKey)
+			So(doc[1].Value, ShouldEqual, bson.MaxKey)
+			So(doc[2].Value.(bson.Binary).Kind, ShouldEqual, 4)
+		})
+
+		Convey("rejecting invalid wrappers", func() {
+			for _, input := range []string{
+				`{"x": {"$oid": "nothex"}}`,
+				`{"x": {"$numberInt": "3000000000"}}`,
+				`{"x": {"$date": "yesterday"}}`,
+				`{"x": 1} {"y": 2}`,
+				`[1, 2]`,
+			} {
+				_, err := UnmarshalExtJSONDoc([]byte(input))
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
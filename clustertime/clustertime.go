@@ -0,0 +1,170 @@
+// Package clustertime keeps the proxy's cluster time: the logical clock
+// that drivers gossip, in $clusterTime, and read operationTime from, for
+// causally consistent sessions.
+package clustertime
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A Timestamp is a cluster time: seconds since the epoch in its high 32
+// bits, and an increment that orders times within a second in its low
+// 32 bits.
+type Timestamp = bson.MongoTimestamp
+
+// NewTimestamp returns the timestamp with the given seconds and increment.
+func NewTimestamp(secs uint32, inc uint32) Timestamp {
+	return Timestamp(int64(secs)<<32 | int64(inc))
+}
+
+// Time returns the wall clock time of a timestamp, to the second.
+func Time(ts Timestamp) time.Time {
+	return time.Unix(int64(uint64(ts)>>32), 0)
+}
+
+// MaxDrift is how far ahead of the wall clock the cluster time may move,
+// as with MongoDB's maxAcceptableLogicalClockDriftSecs, so that a client
+// cannot gossip a time that leaves the clock nowhere to tick to.
+const MaxDrift = 365 * 24 * time.Hour
+
+// ErrTooFarAhead is returned for cluster times further ahead of the wall
+// clock than MaxDrift, or past the last second a timestamp can hold.
+var ErrTooFarAhead = fmt.Errorf("Cluster time is too far ahead of the wall clock")
+
+// A Clock is a cluster time that only moves forward.
+type Clock struct {
+	mutex   sync.Mutex
+	time    Timestamp
+	advance chan struct{}
+
+	// now is the wall clock, which tests replace
+	now func() time.Time
+}
+
+// Default is the clock the proxy gossips, which outlives configuration
+// reloads.
+var Default = NewClock()
+
+// NewClock creates a clock at time zero.
+func NewClock() *Clock {
+	return &Clock{
+		advance: make(chan struct{}),
+		now:     time.Now,
+	}
+}
+
+// Time returns the current cluster time.
+func (c *Clock) Time() Timestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.time
+}
+
+// Advance moves the clock forward to ts, as gossiped by a client or
+// backend, returning whether it moved. It fails with ErrTooFarAhead for
+// times too far ahead of the wall clock, leaving the clock as it is.
+func (c *Clock) Advance(ts Timestamp) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ts <= c.time {
+		return false, nil
+	}
+	if err := c.check(ts); err != nil {
+		return false, err
+	}
+	c.set(ts)
+	return true, nil
+}
+
+// Tick returns a new cluster time, later than any before, for a write:
+// the current second, or the second of the last time, with the next
+// increment, or the second after it once its increments run out. It
+// fails with ErrTooFarAhead rather than overflow.
+func (c *Clock) Tick() (Timestamp, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ts := NewTimestamp(uint32(c.now().Unix()), 1)
+	if ts <= c.time {
+		secs, inc := uint32(uint64(c.time)>>32), uint32(c.time)
+		if inc == math.MaxUint32 {
+			ts = NewTimestamp(secs+1, 1)
+		} else {
+			ts = c.time + 1
+		}
+	}
+	if err := c.check(ts); err != nil {
+		return 0, err
+	}
+	c.set(ts)
+	return ts, nil
+}
+
+// check returns ErrTooFarAhead for times more than MaxDrift ahead of the
+// wall clock, or whose seconds do not fit the signed timestamps of BSON.
+func (c *Clock) check(ts Timestamp) error {
+	secs := uint64(ts) >> 32
+	if secs > math.MaxInt32 || int64(secs) > c.now().Add(MaxDrift).Unix() {
+		return ErrTooFarAhead
+	}
+	return nil
+}
+
+// set moves the clock, waking those waiting for it.
+func (c *Clock) set(ts Timestamp) {
+	c.time = ts
+	close(c.advance)
+	c.advance = make(chan struct{})
+}
+
+// WaitFor waits until the cluster time reaches ts, or ctx is done.
+func (c *Clock) WaitFor(ctx context.Context, ts Timestamp) error {
+	for {
+		c.mutex.Lock()
+		if c.time >= ts {
+			c.mutex.Unlock()
+			return nil
+		}
+		advance := c.advance
+		c.mutex.Unlock()
+
+		select {
+		case <-advance:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Gossip returns the cluster time in a $clusterTime document, and whether
+// there is one.
+func Gossip(body bson.D) (Timestamp, bson.M, bool) {
+	doc := convert.ToBSONMap(bsonutil.FindValueByKey("$clusterTime", body))
+	if doc == nil {
+		return 0, nil, false
+	}
+	ts, ok := doc["clusterTime"].(Timestamp)
+	return ts, doc, ok
+}
+
+// OperationTime returns the operationTime of a reply, and whether it has
+// one.
+func OperationTime(body bson.D) (Timestamp, bool) {
+	ts, ok := bsonutil.FindValueByKey("operationTime", body).(Timestamp)
+	return ts, ok
+}
+
+// AfterClusterTime returns the readConcern.afterClusterTime of a command,
+// and whether it has one.
+func AfterClusterTime(body bson.D) (Timestamp, bool) {
+	readConcern := convert.ToBSONMap(bsonutil.FindValueByKey("readConcern", body))
+	ts, ok := readConcern["afterClusterTime"].(Timestamp)
+	return ts, ok
+}
@@ -0,0 +1,118 @@
+package clustertime
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestClock(t *testing.T) {
+	Convey("Keep a cluster time that only moves forward", t, func() {
+		c := NewClock()
+		wall := time.Unix(1700000000, 0)
+		c.now = func() time.Time { return wall }
+
+		tick := func() Timestamp {
+			ts, err := c.Tick()
+			So(err, ShouldBeNil)
+			return ts
+		}
+		advance := func(ts Timestamp) bool {
+			moved, err := c.Advance(ts)
+			So(err, ShouldBeNil)
+			return moved
+		}
+
+		first := tick()
+		So(first, ShouldEqual, NewTimestamp(1700000000, 1))
+		So(tick(), ShouldEqual, NewTimestamp(1700000000, 2))
+		So(Time(first), ShouldResemble, wall)
+
+		So(advance(NewTimestamp(1700000005, 9)), ShouldBeTrue)
+		So(advance(first), ShouldBeFalse)
+		So(c.Time(), ShouldEqual, NewTimestamp(1700000005, 9))
+
+		Convey("ticking past gossiped times from later clocks", func() {
+			So(tick(), ShouldEqual, NewTimestamp(1700000005, 10))
+			wall = wall.Add(time.Minute)
+			So(tick(), ShouldEqual, NewTimestamp(1700000060, 1))
+		})
+
+		Convey("ticking into the next second once increments run out", func() {
+			advance(NewTimestamp(1700000005, math.MaxUint32))
+			So(tick(), ShouldEqual, NewTimestamp(1700000006, 1))
+		})
+
+		Convey("refusing times too far ahead of the wall clock", func() {
+			limit := uint32(wall.Add(MaxDrift).Unix())
+			for _, ts := range []Timestamp{NewTimestamp(limit+1, 0), NewTimestamp(math.MaxInt32, 1)} {
+				moved, err := c.Advance(ts)
+				So(moved, ShouldBeFalse)
+				So(err, ShouldEqual, ErrTooFarAhead)
+			}
+			So(c.Time(), ShouldEqual, NewTimestamp(1700000005, 9))
+			So(advance(NewTimestamp(limit, math.MaxUint32)), ShouldBeTrue)
+
+			_, err := c.Tick()
+			So(err, ShouldEqual, ErrTooFarAhead)
+			So(c.Time(), ShouldEqual, NewTimestamp(limit, math.MaxUint32))
+		})
+
+		Convey("refusing to tick past the last second of a timestamp", func() {
+			wall = time.Unix(math.MaxInt32, 0)
+			advance(NewTimestamp(math.MaxInt32, math.MaxUint32))
+			_, err := c.Tick()
+			So(err, ShouldEqual, ErrTooFarAhead)
+			So(c.Time(), ShouldEqual, NewTimestamp(math.MaxInt32, math.MaxUint32))
+		})
+
+		Convey("waking those waiting for it", func() {
+			target := NewTimestamp(1700000010, 1)
+			done := make(chan error)
+			go func() {
+				done <- c.WaitFor(context.Background(), target)
+			}()
+			advance(NewTimestamp(1700000008, 1))
+			advance(target)
+			So(<-done, ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			So(c.WaitFor(ctx, NewTimestamp(1700000020, 1)), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSigner(t *testing.T) {
+	Convey("Sign cluster times", t, func() {
+		ts := NewTimestamp(1700000000, 3)
+
+		Convey("with a key", func() {
+			s := Signer{KeyID: 7, Key: []byte("secret")}
+			doc := s.Sign(ts).Map()
+			So(doc["clusterTime"], ShouldEqual, ts)
+			So(s.Verify(doc), ShouldBeNil)
+
+			forged := Signer{KeyID: 7, Key: []byte("guess")}.Sign(ts).Map()
+			So(s.Verify(forged), ShouldEqual, ErrProofMismatch)
+
+			otherKey := Signer{KeyID: 8, Key: []byte("secret")}.Sign(ts).Map()
+			So(s.Verify(otherKey), ShouldEqual, ErrKeyNotFound)
+
+			moved := s.Sign(ts).Map()
+			moved["clusterTime"] = ts + 1
+			So(s.Verify(moved), ShouldEqual, ErrProofMismatch)
+		})
+
+		Convey("or without one, accepting anything", func() {
+			s := Signer{}
+			signature := s.Sign(ts).Map()["signature"].(bson.D).Map()
+			So(signature["hash"], ShouldResemble, bson.Binary{Data: make([]byte, 20)})
+			So(s.Verify(bson.M{"clusterTime": ts}), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,78 @@
+package clustertime
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// hashLength is the length of the HMAC-SHA1 signatures of cluster times.
+const hashLength = sha1.Size
+
+// ErrKeyNotFound is returned for cluster times signed with a key the
+// proxy does not have.
+var ErrKeyNotFound = fmt.Errorf("Cluster time is signed with an unknown key")
+
+// ErrProofMismatch is returned for cluster times whose signatures are
+// wrong.
+var ErrProofMismatch = fmt.Errorf("Cluster time signature does not match")
+
+// A Signer signs the cluster times the proxy gossips, so that clients can
+// only gossip back times that the proxy gave out. A Signer without a key
+// signs with a hash of zeros, as servers without authentication do, and
+// accepts every signature.
+type Signer struct {
+	KeyID int64
+	Key   []byte
+}
+
+// proof returns the signature of a cluster time.
+func (s Signer) proof(ts Timestamp) []byte {
+	if len(s.Key) == 0 {
+		return make([]byte, hashLength)
+	}
+	mac := hmac.New(sha1.New, s.Key)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(ts))
+	mac.Write(buf[:])
+	return mac.Sum(nil)
+}
+
+// Sign returns the $clusterTime document of a cluster time.
+func (s Signer) Sign(ts Timestamp) bson.D {
+	return bson.D{
+		{Name: "clusterTime", Value: ts},
+		{Name: "signature", Value: bson.D{
+			{Name: "hash", Value: bson.Binary{Kind: 0, Data: s.proof(ts)}},
+			{Name: "keyId", Value: s.KeyID},
+		}},
+	}
+}
+
+// Verify checks the signature of a $clusterTime document.
+func (s Signer) Verify(doc bson.M) error {
+	if len(s.Key) == 0 {
+		return nil
+	}
+	ts, _ := doc["clusterTime"].(Timestamp)
+	signature := convert.ToBSONMap(doc["signature"])
+	if convert.ToInt64(signature["keyId"]) != s.KeyID {
+		return ErrKeyNotFound
+	}
+
+	var hash []byte
+	switch h := signature["hash"].(type) {
+	case bson.Binary:
+		hash = h.Data
+	case []byte:
+		hash = h
+	}
+	if !hmac.Equal(hash, s.proof(ts)) {
+		return ErrProofMismatch
+	}
+	return nil
+}
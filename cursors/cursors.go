@@ -0,0 +1,329 @@
+// Package cursors keeps cursors on behalf of backends that have none: a
+// backend answers a query with its whole result, and the proxy hands it
+// to the client a batch at a time, as getMore asks for it.
+package cursors
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound is returned for cursors that do not exist, or no longer do.
+var ErrNotFound = errors.New("Cursor not found")
+
+// ErrInUse is returned for cursors that another request is reading.
+var ErrInUse = errors.New("Cursor is in use")
+
+// ErrTooMany is returned by Register when the limit on open cursors has
+// been reached.
+var ErrTooMany = errors.New("Too many open cursors")
+
+// A Cursor is the rest of a result, waiting for getMore.
+type Cursor struct {
+	// ID is assigned by Register.
+	ID int64
+
+	Namespace string
+
+	// Session and User are the session the cursor was opened in, and the
+	// user that opened it, if any. Only requests from them may use it.
+	Session string
+	User    string
+
+	// Timeout is how long the cursor may go unused before it is closed.
+	// Zero means never.
+	Timeout time.Duration
+
+	Created time.Time
+
+	docs []interface{}
+
+	// source, if set, has batches after docs, as the replies of a stream.
+	source messages.ReplyStream
+
+	// the rest is guarded by the registry's mutex
+	lastUsed time.Time
+	inUse    bool
+}
+
+// New creates a cursor over docs, followed by the batches of source, if it
+// is not nil.
+func New(namespace string, docs []interface{}, source messages.ReplyStream) *Cursor {
+	return &Cursor{
+		Namespace: namespace,
+		Created:   time.Now(),
+		docs:      docs,
+		source:    source,
+	}
+}
+
+// Next returns up to n documents, or all that are left if n is not
+// positive, stopping early once they would take more than maxBytes as
+// the elements of a BSON array.
+func (c *Cursor) Next(n int, maxBytes int) ([]interface{}, error) {
+	batch := []interface{}{}
+	size := 0
+	for n <= 0 || len(batch) < n {
+		if len(c.docs) == 0 {
+			if err := c.fill(); err != nil {
+				return batch, err
+			}
+			if len(c.docs) == 0 {
+				break
+			}
+		}
+
+		if maxBytes > 0 {
+			raw, err := bson.Marshal(bson.M{"d": c.docs[0]})
+			if err == nil {
+				// the element is keyed by its index, not "d", and not
+				// wrapped in a document of its own
+				element := len(raw) - len("d") - 5 + len(strconv.Itoa(len(batch)))
+				if len(batch) > 0 && size+element > maxBytes {
+					break
+				}
+				size += element
+			}
+		}
+		batch = append(batch, c.docs[0])
+		c.docs = c.docs[1:]
+	}
+	return batch, nil
+}
+
+// fill reads the next batch from the source, if there is one.
+func (c *Cursor) fill() error {
+	for c.source != nil && len(c.docs) == 0 {
+		reply, err := c.source.Next()
+		if err != nil {
+			c.source = nil
+			return err
+		}
+		if msg, ok := reply.(messages.Message); !ok || msg.FlagBits&messages.OP_MSG_FLAG_MORE_TO_COME == 0 {
+			// the stream has ended
+			c.source = nil
+		}
+		c.docs = Batch(reply.ToBSON())
+	}
+	return nil
+}
+
+// Exhausted returns whether the cursor has nothing left.
+func (c *Cursor) Exhausted() bool {
+	return len(c.docs) == 0 && c.source == nil
+}
+
+// Close releases the source of a cursor that was never registered.
+// Registered cursors are closed by their registry.
+func (c *Cursor) Close() {
+	if c.source != nil {
+		c.source.Close()
+		c.source = nil
+	}
+	c.docs = nil
+}
+
+// Batch returns the documents of a cursor reply: its firstBatch or
+// nextBatch.
+func Batch(reply bson.M) []interface{} {
+	cursor := toMap(reply["cursor"])
+	for _, key := range []string{"firstBatch", "nextBatch"} {
+		switch batch := cursor[key].(type) {
+		case []interface{}:
+			return batch
+		case []bson.D:
+			docs := make([]interface{}, len(batch))
+			for i, doc := range batch {
+				docs[i] = doc
+			}
+			return docs
+		case []bson.M:
+			docs := make([]interface{}, len(batch))
+			for i, doc := range batch {
+				docs[i] = doc
+			}
+			return docs
+		}
+	}
+	return nil
+}
+
+func toMap(v interface{}) bson.M {
+	switch doc := v.(type) {
+	case bson.M:
+		return doc
+	case bson.D:
+		return doc.Map()
+	case map[string]interface{}:
+		return bson.M(doc)
+	}
+	return nil
+}
+
+// Stats are counts of a registry's cursors.
+type Stats struct {
+	Open     int   `json:"open"`
+	Created  int64 `json:"created"`
+	TimedOut int64 `json:"timedOut"`
+	Killed   int64 `json:"killed"`
+}
+
+// A Registry holds open cursors by ID.
+type Registry struct {
+	mutex   sync.Mutex
+	cursors map[int64]*Cursor
+	stats   Stats
+	done    chan struct{}
+}
+
+// Default is the registry modules share, so that cursors outlive
+// configuration reloads.
+var Default = NewRegistry(time.Second)
+
+// NewRegistry creates a registry that looks for cursors that have timed
+// out every reapInterval.
+func NewRegistry(reapInterval time.Duration) *Registry {
+	r := &Registry{
+		cursors: make(map[int64]*Cursor),
+		done:    make(chan struct{}),
+	}
+	go r.reapLoop(reapInterval)
+	return r
+}
+
+// Register adds a cursor, and assigns it an ID, unless max cursors are
+// already open. max of zero means no limit.
+func (r *Registry) Register(c *Cursor, max int) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if max > 0 && len(r.cursors) >= max {
+		return 0, ErrTooMany
+	}
+
+	// cursor IDs are positive, and 0 means there is no cursor
+	for c.ID == 0 || r.cursors[c.ID] != nil {
+		c.ID = rand.Int63()
+	}
+	c.lastUsed = time.Now()
+	r.cursors[c.ID] = c
+	r.stats.Created++
+	openCursors.Inc()
+	return c.ID, nil
+}
+
+// Checkout returns a cursor for a request to read from. It must be given
+// back with Return.
+func (r *Registry) Checkout(id int64) (*Cursor, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, ok := r.cursors[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if c.inUse {
+		return nil, ErrInUse
+	}
+	c.inUse = true
+	return c, nil
+}
+
+// Return gives back a cursor after a request has read from it, closing it
+// if it is exhausted, or was killed while in use.
+func (r *Registry) Return(c *Cursor) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c.inUse = false
+	c.lastUsed = time.Now()
+	if r.cursors[c.ID] != c {
+		c.Close()
+	} else if c.Exhausted() {
+		r.remove(c)
+	}
+}
+
+// Kill closes a cursor, returning whether it was open. A cursor in use is
+// closed once it is returned.
+func (r *Registry) Kill(id int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, ok := r.cursors[id]
+	if !ok {
+		return false
+	}
+	r.stats.Killed++
+	r.remove(c)
+	return true
+}
+
+// Lookup returns an open cursor, or nil, without checking it out: only
+// the fields set before it was registered may be read.
+func (r *Registry) Lookup(id int64) *Cursor {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cursors[id]
+}
+
+func (r *Registry) remove(c *Cursor) {
+	delete(r.cursors, c.ID)
+	openCursors.Dec()
+	if !c.inUse {
+		c.Close()
+	}
+}
+
+// Stats returns counts of the registry's cursors.
+func (r *Registry) Stats() Stats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stats := r.stats
+	stats.Open = len(r.cursors)
+	return stats
+}
+
+// Close closes every cursor and stops looking for timed out ones.
+func (r *Registry) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+		close(r.done)
+	}
+	for _, c := range r.cursors {
+		r.remove(c)
+	}
+}
+
+func (r *Registry) reapLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.reap(now)
+		}
+	}
+}
+
+// reap closes the cursors that have gone unused for longer than their
+// timeouts.
+func (r *Registry) reap(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, c := range r.cursors {
+		if !c.inUse && c.Timeout > 0 && now.Sub(c.lastUsed) > c.Timeout {
+			r.stats.TimedOut++
+			timedOutCursors.Inc()
+			r.remove(c)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package cursors
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func documents(from, to int) []interface{} {
+	docs := []interface{}{}
+	for i := from; i < to; i++ {
+		docs = append(docs, bson.D{{Name: "_id", Value: i}})
+	}
+	return docs
+}
+
+// stream replays batches as the replies of a stream, failing after them if
+// err is set.
+type stream struct {
+	batches [][]interface{}
+	err     error
+	closed  bool
+}
+
+func (s *stream) Next() (messages.ResponseWriter, error) {
+	if len(s.batches) == 0 {
+		return nil, s.err
+	}
+	batch := s.batches[0]
+	s.batches = s.batches[1:]
+	reply := messages.Message{Body: bson.D{
+		{Name: "cursor", Value: bson.D{{Name: "nextBatch", Value: batch}}},
+	}}
+	if len(s.batches) > 0 || s.err != nil {
+		reply.FlagBits = messages.OP_MSG_FLAG_MORE_TO_COME
+	}
+	return reply, nil
+}
+
+func (s *stream) Close() {
+	s.closed = true
+}
+
+func TestCursor(t *testing.T) {
+	Convey("Read a cursor in batches", t, func() {
+		c := New("shop.orders", documents(0, 5), nil)
+		batch, err := c.Next(2, 0)
+		So(err, ShouldBeNil)
+		So(batch, ShouldResemble, documents(0, 2))
+		So(c.Exhausted(), ShouldBeFalse)
+
+		batch, _ = c.Next(0, 0)
+		So(batch, ShouldResemble, documents(2, 5))
+		So(c.Exhausted(), ShouldBeTrue)
+	})
+
+	Convey("Stop batches at the byte limit, but return at least one document", t, func() {
+		c := New("shop.orders", documents(0, 10), nil)
+		batch, _ := c.Next(0, 40)
+		So(len(batch), ShouldBeBetween, 0, 10)
+		batch, _ = c.Next(0, 1)
+		So(len(batch), ShouldEqual, 1)
+
+		// exactly as many as fit, as an array
+		docs := documents(0, 3)
+		raw, _ := bson.Marshal(bson.D{{Name: "0", Value: docs[0]}, {Name: "1", Value: docs[1]}, {Name: "2", Value: docs[2]}})
+		c = New("shop.orders", documents(0, 10), nil)
+		batch, _ = c.Next(0, len(raw)-5)
+		So(batch, ShouldResemble, docs)
+	})
+
+	Convey("Read past the documents into the stream", t, func() {
+		s := &stream{batches: [][]interface{}{documents(2, 4), documents(4, 6)}}
+		c := New("shop.orders", documents(0, 2), s)
+		batch, _ := c.Next(3, 0)
+		So(batch, ShouldResemble, documents(0, 3))
+		batch, _ = c.Next(10, 0)
+		So(batch, ShouldResemble, documents(3, 6))
+		So(c.Exhausted(), ShouldBeTrue)
+	})
+
+	Convey("Return what was read before the stream failed", t, func() {
+		s := &stream{batches: [][]interface{}{documents(0, 2)}, err: errors.New("Connection reset")}
+		c := New("shop.orders", nil, s)
+		batch, err := c.Next(5, 0)
+		So(err, ShouldNotBeNil)
+		So(batch, ShouldResemble, documents(0, 2))
+		So(c.Exhausted(), ShouldBeTrue)
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	Convey("Keep cursors by ID", t, func() {
+		r := NewRegistry(time.Hour)
+		defer r.Close()
+
+		c := New("shop.orders", documents(0, 4), nil)
+		id, err := r.Register(c, 0)
+		So(err, ShouldBeNil)
+		So(id, ShouldBeGreaterThan, 0)
+		So(r.Lookup(id), ShouldEqual, c)
+		So(r.Stats().Open, ShouldEqual, 1)
+
+		Convey("one request at a time", func() {
+			checked, err := r.Checkout(id)
+			So(err, ShouldBeNil)
+			So(checked, ShouldEqual, c)
+			_, err = r.Checkout(id)
+			So(err, ShouldEqual, ErrInUse)
+
+			r.Return(checked)
+			checked, err = r.Checkout(id)
+			So(err, ShouldBeNil)
+			r.Return(checked)
+		})
+
+		Convey("until they are exhausted", func() {
+			checked, _ := r.Checkout(id)
+			checked.Next(0, 0)
+			r.Return(checked)
+			_, err := r.Checkout(id)
+			So(err, ShouldEqual, ErrNotFound)
+			So(r.Stats().Open, ShouldEqual, 0)
+		})
+
+		Convey("or killed, even while in use", func() {
+			s := &stream{batches: [][]interface{}{documents(4, 6)}}
+			c := New("shop.orders", nil, s)
+			id, _ := r.Register(c, 0)
+			checked, _ := r.Checkout(id)
+			So(r.Kill(id), ShouldBeTrue)
+			So(r.Kill(id), ShouldBeFalse)
+			So(s.closed, ShouldBeFalse)
+			r.Return(checked)
+			So(s.closed, ShouldBeTrue)
+			So(r.Stats().Killed, ShouldEqual, 1)
+		})
+
+		Convey("up to a limit", func() {
+			_, err := r.Register(New("shop.orders", documents(0, 1), nil), 1)
+			So(err, ShouldEqual, ErrTooMany)
+		})
+	})
+
+	Convey("Close cursors that go unused too long", t, func() {
+		r := NewRegistry(time.Hour)
+		defer r.Close()
+
+		idle := New("shop.orders", documents(0, 4), nil)
+		idle.Timeout = time.Minute
+		r.Register(idle, 0)
+		forever := New("shop.orders", documents(0, 4), nil)
+		r.Register(forever, 0)
+		busy := New("shop.orders", documents(0, 4), nil)
+		busy.Timeout = time.Minute
+		r.Register(busy, 0)
+		r.Checkout(busy.ID)
+
+		r.reap(time.Now().Add(2 * time.Minute))
+		So(r.Lookup(idle.ID), ShouldBeNil)
+		So(r.Lookup(forever.ID), ShouldNotBeNil)
+		So(r.Lookup(busy.ID), ShouldNotBeNil)
+		So(r.Stats().TimedOut, ShouldEqual, 1)
+	})
+}
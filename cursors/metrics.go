@@ -0,0 +1,15 @@
+package cursors
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+)
+
+var openCursors = metrics.NewGauge("mongoproxy_cursors_open",
+	"Cursors the proxy holds for backends without cursors of their own.")
+
+var timedOutCursors = metrics.NewCounter("mongoproxy_cursors_timed_out_total",
+	"Proxy-held cursors closed for going unused too long.")
+
+func init() {
+	metrics.MustRegister(openCursors, timedOutCursors)
+}
@@ -3,17 +3,18 @@ module github.com/mongodbinc-interns/mongoproxy
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/deckarep/golang-set/v2 v2.1.0
 	github.com/gin-gonic/gin v1.9.0
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/smartystreets/goconvey v1.7.2
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/BurntSushi/toml v1.2.1 // indirect
 	github.com/bytedance/sonic v1.8.0 // indirect
 	github.com/chenzhuoyu/base64x v0.0.0-20221115062448-fe3a3abad311 // indirect
-	github.com/deckarep/golang-set/v2 v2.1.0 // indirect
 	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
@@ -38,5 +39,4 @@ require (
 	golang.org/x/text v0.7.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
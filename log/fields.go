@@ -0,0 +1,127 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// Fields are request-scoped values attached to a log message with LogWith.
+// Zero values are left out of the output.
+type Fields struct {
+	ConnectionID int64
+	RequestID    int32
+	Command      string
+	Namespace    string
+	Module       string
+	Duration     time.Duration
+}
+
+// an entry is a message logged with fields. It is passed to go-logging as
+// the only argument of a record, so that the JSON formatter can find the
+// fields again.
+type entry struct {
+	message string
+	fields  Fields
+}
+
+// String returns the message followed by its fields as key=value pairs,
+// for text output.
+func (e *entry) String() string {
+	var buf bytes.Buffer
+	buf.WriteString(e.message)
+	e.fields.each(func(key string, value interface{}) {
+		fmt.Fprintf(&buf, " %s=%v", key, value)
+	})
+	return buf.String()
+}
+
+// each calls fn with the output key and value of each non-zero field.
+func (f Fields) each(fn func(key string, value interface{})) {
+	if f.ConnectionID != 0 {
+		fn("connectionId", f.ConnectionID)
+	}
+	if f.RequestID != 0 {
+		fn("requestId", f.RequestID)
+	}
+	if len(f.Command) > 0 {
+		fn("command", f.Command)
+	}
+	if len(f.Namespace) > 0 {
+		fn("ns", f.Namespace)
+	}
+	if len(f.Module) > 0 {
+		fn("module", f.Module)
+	}
+	if f.Duration != 0 {
+		fn("durationMillis", float64(f.Duration)/float64(time.Millisecond))
+	}
+}
+
+// jsonFormatter formats each record as a single line of JSON with the
+// timestamp, level, message and any fields.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(`{"t":`)
+	writeJSON(&buf, r.Time.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, r.Level.String())
+
+	var fields Fields
+	message := ""
+	if e, ok := loggedEntry(r); ok {
+		fields = e.fields
+		message = e.message
+	} else {
+		message = r.Message()
+	}
+
+	// the logger's module stands in for the pipeline module when the
+	// message was logged by a module logger.
+	if len(fields.Module) == 0 && r.Module != globalModule {
+		fields.Module = r.Module
+	}
+
+	fields.each(func(key string, value interface{}) {
+		buf.WriteString(`,"` + key + `":`)
+		switch v := value.(type) {
+		case string:
+			writeJSON(&buf, v)
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			fmt.Fprintf(&buf, "%v", v)
+		}
+	})
+
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, message)
+	buf.WriteByte('}')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func loggedEntry(r *logging.Record) (*entry, bool) {
+	if len(r.Args) != 1 {
+		return nil, false
+	}
+	e, ok := r.Args[0].(*entry)
+	return e, ok
+}
+
+func writeJSON(buf *bytes.Buffer, s string) {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		buf.WriteString(`""`)
+		return
+	}
+	buf.Write(encoded)
+}
@@ -2,8 +2,14 @@
 package log
 
 import (
-	"github.com/op/go-logging"
+	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
 )
 
 const (
@@ -15,62 +21,219 @@ const (
 	DEBUG        = 5
 )
 
+// Output formats for SetFormat.
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// the name of the logger used by the package-level functions.
+const globalModule = "global"
+
 // set up the global logger
-var log = logging.MustGetLogger("global")
+var log = GetLogger(globalModule)
 
 var format = logging.MustStringFormatter(
 	"%{color} %{level:.4s} ▶ %{color:reset} %{message}",
 )
 
-var backend = logging.NewLogBackend(os.Stderr, "", 0)
-var backendFormatted = logging.NewBackendFormatter(backend, format)
-var backendLeveled = logging.AddModuleLevel(backendFormatted)
+// plainFormat is the text format for outputs other than a terminal, where
+// color codes would only be noise.
+var plainFormat = logging.MustStringFormatter(
+	"%{time:2006-01-02T15:04:05.000Z07:00} %{level:.4s} %{message}",
+)
+
+var backend = &switchBackend{}
+var backendLeveled = logging.AddModuleLevel(backend)
 
 func init() {
+	backend.set(os.Stderr, TextFormat)
 	logging.SetBackend(backendLeveled)
 	SetLogLevel(NOTICE)
 }
 
+// a switchBackend passes records to a formatted backend that can be
+// swapped out, so that changing the output or format keeps the levels set
+// on the leveled backend wrapping it.
+type switchBackend struct {
+	mutex     sync.RWMutex
+	formatted logging.Backend
+}
+
+func (s *switchBackend) set(w io.Writer, outputFormat string) {
+	var formatter logging.Formatter
+	switch {
+	case outputFormat == JSONFormat:
+		formatter = jsonFormatter{}
+	case w == os.Stderr:
+		formatter = format
+	default:
+		formatter = plainFormat
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.formatted = logging.NewBackendFormatter(logging.NewLogBackend(w, "", 0), formatter)
+}
+
+func (s *switchBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.formatted.Log(level, calldepth+1, rec)
+}
+
+// A Logger logs messages under a module name, so that its verbosity can
+// be set separately from other modules with SetModuleLogLevel.
+type Logger struct {
+	logger *logging.Logger
+}
+
+// GetLogger returns a logger for the given module name.
+func GetLogger(module string) *Logger {
+	return &Logger{logging.MustGetLogger(module)}
+}
+
 // Log logs a formatted message with the specified integer verbosity level.
 // The lower the level, the more critical the message.
-func Log(level int, format string, args ...interface{}) {
+func (l *Logger) Log(level int, format string, args ...interface{}) {
 	switch level {
 	case CRITICAL:
-		log.Criticalf(format, args...)
+		l.logger.Criticalf(format, args...)
 	case ERROR:
-		log.Errorf(format, args...)
+		l.logger.Errorf(format, args...)
 	case WARNING:
-		log.Warningf(format, args...)
+		l.logger.Warningf(format, args...)
 	case NOTICE:
-		log.Noticef(format, args...)
+		l.logger.Noticef(format, args...)
 	case INFO:
-		log.Infof(format, args...)
+		l.logger.Infof(format, args...)
 	case DEBUG:
-		log.Debugf(format, args...)
+		l.logger.Debugf(format, args...)
 	default:
-		log.Errorf(format, args...)
+		l.logger.Errorf(format, args...)
 	}
 }
 
-// SetLogLevel sets the verbosity level of the logger, with 0 being least verbose,
-// and 5 being the most verbose. By default, the verbosity level is 1, which
-// logs critical and error messages.
-func SetLogLevel(level int) {
+// LogWith logs a formatted message like Log, with request-scoped fields
+// attached to it.
+func (l *Logger) LogWith(level int, fields Fields, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	// the message is formatted here rather than by go-logging, so
+	// redactable arguments must be redacted here too.
+	for i, arg := range args {
+		if redactor, ok := arg.(logging.Redactor); ok {
+			args[i] = redactor.Redacted()
+		}
+	}
+	e := &entry{message: fmt.Sprintf(format, args...), fields: fields}
 	switch level {
 	case CRITICAL:
-		backendLeveled.SetLevel(logging.CRITICAL, "global")
+		l.logger.Critical(e)
 	case ERROR:
-		backendLeveled.SetLevel(logging.ERROR, "global")
+		l.logger.Error(e)
 	case WARNING:
-		backendLeveled.SetLevel(logging.WARNING, "global")
+		l.logger.Warning(e)
 	case NOTICE:
-		backendLeveled.SetLevel(logging.NOTICE, "global")
+		l.logger.Notice(e)
 	case INFO:
-		backendLeveled.SetLevel(logging.INFO, "global")
+		l.logger.Info(e)
+	case DEBUG:
+		l.logger.Debug(e)
+	default:
+		l.logger.Error(e)
+	}
+}
+
+// Enabled returns whether messages at the given level are logged. It helps
+// skip building expensive log arguments.
+func (l *Logger) Enabled(level int) bool {
+	return l.logger.IsEnabledFor(toLoggingLevel(level))
+}
+
+// Log logs a formatted message with the specified integer verbosity level.
+// The lower the level, the more critical the message.
+func Log(level int, format string, args ...interface{}) {
+	log.Log(level, format, args...)
+}
+
+// LogWith logs a formatted message like Log, with request-scoped fields
+// attached to it.
+func LogWith(level int, fields Fields, format string, args ...interface{}) {
+	log.LogWith(level, fields, format, args...)
+}
+
+// Enabled returns whether messages at the given level are logged by the
+// package-level functions.
+func Enabled(level int) bool {
+	return log.Enabled(level)
+}
+
+func toLoggingLevel(level int) logging.Level {
+	switch level {
+	case CRITICAL:
+		return logging.CRITICAL
+	case ERROR:
+		return logging.ERROR
+	case WARNING:
+		return logging.WARNING
+	case NOTICE:
+		return logging.NOTICE
+	case INFO:
+		return logging.INFO
 	case DEBUG:
 		fallthrough
 	default:
-		backendLeveled.SetLevel(logging.DEBUG, "global")
+		return logging.DEBUG
 	}
+}
+
+// SetLogLevel sets the verbosity level of the logger, with 0 being least verbose,
+// and 5 being the most verbose. By default, the verbosity level is 1, which
+// logs critical and error messages. Module loggers without a level of their
+// own, set with SetModuleLogLevel, use this level too.
+func SetLogLevel(level int) {
+	backendLeveled.SetLevel(toLoggingLevel(level), "")
+	backendLeveled.SetLevel(toLoggingLevel(level), globalModule)
+}
 
+// SetModuleLogLevel sets the verbosity level of the logger for one module,
+// overriding the level set by SetLogLevel.
+func SetModuleLogLevel(module string, level int) {
+	backendLeveled.SetLevel(toLoggingLevel(level), module)
+}
+
+// ParseModuleLevels parses a comma-separated list of module=level pairs,
+// such as "mockule=5,bi=2", into a map of module names to levels.
+func ParseModuleLevels(spec string) (map[string]int, error) {
+	levels := make(map[string]int)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid module log level “%s”: expected module=level", pair)
+		}
+		level, err := strconv.Atoi(parts[1])
+		if err != nil || level < CRITICAL || level > DEBUG {
+			return nil, fmt.Errorf("Invalid log level for module %s: %s", parts[0], parts[1])
+		}
+		levels[parts[0]] = level
+	}
+	return levels, nil
+}
+
+// SetOutput sets where log messages are written, and in which format:
+// TextFormat or JSONFormat. Text written anywhere but stderr is not colorized.
+func SetOutput(w io.Writer, outputFormat string) error {
+	switch outputFormat {
+	case TextFormat, JSONFormat:
+	default:
+		return fmt.Errorf("Unrecognized log format: “%s”", outputFormat)
+	}
+	backend.set(w, outputFormat)
+	return nil
 }
@@ -0,0 +1,111 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJSONOutput(t *testing.T) {
+	Convey("Log in the JSON format", t, func() {
+		var buf bytes.Buffer
+		So(SetOutput(&buf, JSONFormat), ShouldBeNil)
+		defer SetOutput(os.Stderr, TextFormat)
+		SetLogLevel(DEBUG)
+
+		Convey("with request fields", func() {
+			LogWith(INFO, Fields{
+				ConnectionID: 3,
+				RequestID:    7,
+				Command:      "find",
+				Namespace:    "shop.orders",
+				Duration:     1500 * time.Microsecond,
+			}, "Handled %v", "request")
+
+			line := lastLine(buf.Bytes())
+			So(line["level"], ShouldEqual, "INFO")
+			So(line["msg"], ShouldEqual, "Handled request")
+			So(line["connectionId"], ShouldEqual, 3)
+			So(line["requestId"], ShouldEqual, 7)
+			So(line["command"], ShouldEqual, "find")
+			So(line["ns"], ShouldEqual, "shop.orders")
+			So(line["durationMillis"], ShouldEqual, 1.5)
+			So(line["t"], ShouldNotBeEmpty)
+		})
+
+		Convey("naming the module of a module logger", func() {
+			GetLogger("example").Log(WARNING, "careful")
+
+			line := lastLine(buf.Bytes())
+			So(line["module"], ShouldEqual, "example")
+			So(line["msg"], ShouldEqual, "careful")
+		})
+
+		Convey("honoring per-module levels", func() {
+			SetModuleLogLevel("quiet", ERROR)
+			GetLogger("quiet").Log(INFO, "hidden")
+			So(buf.Len(), ShouldEqual, 0)
+
+			GetLogger("quiet").Log(ERROR, "shown")
+			So(buf.Len(), ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestParseModuleLevels(t *testing.T) {
+	Convey("Parse per-module log levels", t, func() {
+		levels, err := ParseModuleLevels("mockule=5, bi=2")
+		So(err, ShouldBeNil)
+		So(levels, ShouldResemble, map[string]int{"mockule": 5, "bi": 2})
+
+		_, err = ParseModuleLevels("mockule")
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseModuleLevels("mockule=9")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRotatingFile(t *testing.T) {
+	Convey("Write to a rotating file", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy-log")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "proxy.log")
+
+		r, err := OpenRotatingFile(path, 10, 2)
+		So(err, ShouldBeNil)
+		defer r.Close()
+
+		for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+			_, err := r.Write([]byte(line))
+			So(err, ShouldBeNil)
+		}
+
+		So(readFile(path), ShouldEqual, "dddddddd\n")
+		So(readFile(path+".1"), ShouldEqual, "cccccccc\n")
+		So(readFile(path+".2"), ShouldEqual, "bbbbbbbb\n")
+		_, err = os.Stat(path + ".3")
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
+
+// lastLine decodes the last line of JSON log output.
+func lastLine(output []byte) map[string]interface{} {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	var line map[string]interface{}
+	json.Unmarshal([]byte(lines[len(lines)-1]), &line)
+	return line
+}
+
+func readFile(path string) string {
+	content, _ := ioutil.ReadFile(path)
+	return string(content)
+}
@@ -2,14 +2,23 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/mongodbinc-interns/mongoproxy"
+	"github.com/mongodbinc-interns/mongoproxy/admin"
 	"github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/slowop"
 	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
 )
 
 const DEFAULT_PORT int = 8124
 const DEFAULT_CONFIG_URI string = "mongodb://localhost:27017"
 const DEFAULT_CONFIG_NS string = "test.config"
+const DEFAULT_ADMIN_HOST string = "127.0.0.1"
 
 var (
 	port            int
@@ -17,6 +26,15 @@ var (
 	mongoURI        string
 	configNamespace string
 	configFilename  string
+	adminPort       int
+	adminHost       string
+	logFormat       string
+	logFile         string
+	logMaxSizeMB    int
+	logMaxBackups   int
+	moduleLogLevels string
+	slowOpMillis    int
+	slowOpLog       string
 )
 
 func parseFlags() {
@@ -36,29 +54,118 @@ func parseFlags() {
 	)
 	flag.StringVar(&configFilename, "f", "",
 		"Config filename. If set, will be used instead of MongoDB.")
+	flag.IntVar(&adminPort, "adminPort", 0,
+		"Port for the admin HTTP API. If 0, the admin API is disabled.")
+	flag.StringVar(&adminHost, "adminHost", DEFAULT_ADMIN_HOST,
+		"Address the admin HTTP API listens on. It has no authentication, so only expose it on trusted networks.")
+	flag.StringVar(&logFormat, "logFormat", log.TextFormat,
+		"Log output format: text or json")
+	flag.StringVar(&logFile, "logFile", "",
+		"File to write logs to, instead of stderr")
+	flag.IntVar(&logMaxSizeMB, "logMaxSizeMB", 100,
+		"Size in megabytes at which the log file is rotated. If 0, it is never rotated.")
+	flag.IntVar(&logMaxBackups, "logMaxBackups", 5,
+		"Number of rotated log files to keep")
+	flag.StringVar(&moduleLogLevels, "moduleLogLevels", "",
+		"Per-module verbosity overrides, as module=level pairs separated by commas")
+	flag.IntVar(&slowOpMillis, "slowOpThresholdMs", 100,
+		"Requests taking at least this many milliseconds are recorded as slow. If negative, none are.")
+	flag.StringVar(&slowOpLog, "slowOpLog", "",
+		"File to append slow requests to, as JSON lines")
 	flag.Parse()
 }
 
-func main() {
+// setupLogging applies the log output and per-module level flags.
+func setupLogging() error {
+	levels, err := log.ParseModuleLevels(moduleLogLevels)
+	if err != nil {
+		return err
+	}
+	for module, level := range levels {
+		log.SetModuleLogLevel(module, level)
+	}
 
-	parseFlags()
-	log.SetLogLevel(logLevel)
+	output := io.Writer(os.Stderr)
+	if len(logFile) > 0 {
+		output, err = log.OpenRotatingFile(logFile, int64(logMaxSizeMB)*1024*1024, logMaxBackups)
+		if err != nil {
+			return err
+		}
+	}
+	return log.SetOutput(output, logFormat)
+}
 
-	// grab config file
-	var result bson.M
-	var err error
+// setupSlowOps creates the slow operation log for the slow operation flags.
+func setupSlowOps(proxy *mongoproxy.Proxy) error {
+	if slowOpMillis < 0 {
+		return nil
+	}
+
+	var output io.Writer
+	if len(slowOpLog) > 0 {
+		file, err := log.OpenRotatingFile(slowOpLog, int64(logMaxSizeMB)*1024*1024, logMaxBackups)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+	threshold := time.Duration(slowOpMillis) * time.Millisecond
+	proxy.SetSlowOpLog(slowop.NewLog(threshold, slowop.DefaultCapacity, output))
+	return nil
+}
+
+// loadConfig reads the proxy configuration from the file or MongoDB
+// namespace given on the command line.
+func loadConfig() (bson.M, error) {
 	if len(configFilename) > 0 {
-		result, err = mongoproxy.ParseConfigFromFile(configFilename)
+		return mongoproxy.ParseConfigFromFile(configFilename)
 	} else if len(configNamespace) > 0 {
 		log.Log(log.INFO, "namespace=%s", configNamespace)
-		result, err = mongoproxy.ParseConfigFromDB(mongoURI, configNamespace)
-	} else {
-		log.Log(log.ERROR, "Need either a DB namespace or filename for config")
+		return mongoproxy.ParseConfigFromDB(mongoURI, configNamespace)
+	}
+	return nil, fmt.Errorf("Need either a DB namespace or filename for config")
+}
+
+func main() {
+
+	parseFlags()
+	log.SetLogLevel(logLevel)
+	if err := setupLogging(); err != nil {
+		log.Log(log.CRITICAL, "%v", err)
+		return
 	}
 
+	// grab config file
+	result, err := loadConfig()
 	if err != nil {
 		log.Log(log.WARNING, "%v", err)
 	}
 
-	mongoproxy.StartWithConfig(port, result)
+	proxy, err := mongoproxy.NewProxyWithConfig(port, result, loadConfig)
+	if err != nil {
+		log.Log(log.CRITICAL, "%v. Proxy cannot start.", err)
+		return
+	}
+	if err := setupSlowOps(proxy); err != nil {
+		log.Log(log.CRITICAL, "%v. Proxy cannot start.", err)
+		return
+	}
+
+	if adminPort > 0 {
+		r := admin.Setup(proxy)
+		if ip := net.ParseIP(adminHost); adminHost != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			log.Log(log.WARNING, "The admin API, which has no authentication, is exposed on %v", adminHost)
+		}
+		go func() {
+			err := r.Run(net.JoinHostPort(adminHost, strconv.Itoa(adminPort)))
+			if err != nil {
+				log.Log(log.ERROR, "Error running admin API: %v", err)
+			}
+		}()
+	}
+
+	err = proxy.Run()
+	if err != nil {
+		log.Log(log.ERROR, "%v", err)
+	}
 }
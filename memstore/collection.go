@@ -0,0 +1,464 @@
+package memstore
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"github.com/mongodbinc-interns/mongoproxy/update"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A Collection is a collection's documents, in insertion order. Its
+// documents are only touched with the store locked.
+type Collection struct {
+	// Namespace is the collection's full name, database.collection.
+	Namespace string
+	db, name  string
+
+	docs []bson.D
+
+	// ids are the positions of documents in docs by idKey of their _id.
+	ids map[string]int
+
+	// size is the total BSON size of the documents.
+	size int64
+
+	// indexes are the collection's indexes other than the one on _id,
+	// which ids is.
+	indexes []*index
+
+	// journal is the store's, if it has one.
+	journal *journal
+}
+
+func newCollection(db string, coll string) *Collection {
+	return &Collection{
+		Namespace: db + "." + coll,
+		db:        db,
+		name:      coll,
+		ids:       make(map[string]int),
+	}
+}
+
+// insert adds a copy of a document, with an _id first, generating an
+// ObjectId if it has none.
+func (c *Collection) insert(doc bson.D) *Error {
+	doc, err := prepare(doc)
+	if err != nil {
+		return err
+	}
+	key := idKey(doc[0].Value)
+	if _, ok := c.ids[key]; ok {
+		return c.duplicate(idIndex, []interface{}{doc[0].Value})
+	}
+	keys, err := c.indexKeys(doc, key)
+	if err != nil {
+		return err
+	}
+	for i, ix := range c.indexes {
+		ix.add(keys[i], key)
+	}
+	c.ids[key] = len(c.docs)
+	c.docs = append(c.docs, doc)
+	c.size += docSize(doc)
+	c.log(opPut, doc)
+	return nil
+}
+
+// prepare copies a document to be stored, moving its _id first, or
+// generating one.
+func prepare(doc bson.D) (bson.D, *Error) {
+	doc = copyDoc(doc)
+	for i, elem := range doc {
+		if elem.Name != "_id" {
+			continue
+		}
+		switch elem.Value.(type) {
+		case []interface{}:
+			return nil, errorf(messages.BadValue, "can't use an array for _id")
+		case bson.RegEx:
+			return nil, errorf(messages.BadValue, "can't use a regex for _id")
+		}
+		if i > 0 {
+			copy(doc[1:i+1], doc[:i])
+			doc[0] = elem
+		}
+		return doc, nil
+	}
+	return append(bson.D{{Name: "_id", Value: bson.NewObjectId()}}, doc...), nil
+}
+
+// duplicateKey returns the error of a document having the same key as
+// another in a unique index.
+func (c *Collection) duplicateKey(name string, keyPattern bson.D, keyValue bson.D) *Error {
+	fields := make([]string, len(keyValue))
+	for i, elem := range keyValue {
+		fields[i] = elem.Name + ": " + formatValue(elem.Value)
+	}
+	err := errorf(messages.DuplicateKey, "E11000 duplicate key error collection: %s index: %s dup key: { %s }",
+		c.Namespace, name, strings.Join(fields, ", "))
+	err.Details = bson.D{
+		{Name: "keyPattern", Value: keyPattern},
+		{Name: "keyValue", Value: keyValue},
+	}
+	return err
+}
+
+// formatValue writes a value the way mongod's error messages do.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case bson.ObjectId:
+		return "ObjectId('" + v.Hex() + "')"
+	case string:
+		return strconv.Quote(v)
+	}
+	out, err := bsonutil.MarshalExtJSON(v, bsonutil.Relaxed)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
+
+// idKey returns a key for an _id that is the same for equal values, such
+// as 1 and 1.0.
+func idKey(id interface{}) string {
+	out, _ := bson.Marshal(bson.D{{Name: "", Value: normalize(id)}})
+	return string(out)
+}
+
+// normalize makes every number in a value a float64, and every document
+// a bson.D.
+func normalize(v interface{}) interface{} {
+	if bsonutil.IsNumber(v) {
+		f, _ := toFloat(v)
+		if f == 0 {
+			// -0 is 0
+			return float64(0)
+		}
+		return f
+	}
+	if doc := bsonutil.ToD(v); doc != nil {
+		out := make(bson.D, len(doc))
+		for i, elem := range doc {
+			out[i] = bson.DocElem{Name: elem.Name, Value: normalize(elem.Value)}
+		}
+		return out
+	}
+	if array := bsonutil.ToArray(v); array != nil {
+		out := make([]interface{}, len(array))
+		for i, elem := range array {
+			out[i] = normalize(elem)
+		}
+		return out
+	}
+	return v
+}
+
+// toFloat returns a number as a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	}
+	return math.NaN(), false
+}
+
+// positions returns the positions of the documents a filter selects, in
+// a sort order if there is one.
+func (c *Collection) positions(filter bson.D, sortSpec bson.D) ([]int, error) {
+	f, err := query.Compile(filter)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	order, err := query.CompileSort(sortSpec)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	candidates, indexed := c.candidates(filter)
+	positions := []int{}
+	if !indexed {
+		candidates = make([]int, len(c.docs))
+		for i := range c.docs {
+			candidates[i] = i
+		}
+	}
+	for _, p := range candidates {
+		matched, err := f.Matches(c.docs[p])
+		if err != nil {
+			return nil, wrap(err)
+		}
+		if matched {
+			positions = append(positions, p)
+		}
+	}
+	if len(sortSpec) > 0 {
+		sort.SliceStable(positions, func(i, j int) bool {
+			return order.Compare(c.docs[positions[i]], c.docs[positions[j]]) < 0
+		})
+	}
+	return positions, nil
+}
+
+// find returns the documents a filter selects, sorted, skipped and
+// limited. They are the stored documents, not copies.
+func (c *Collection) find(filter bson.D, sortSpec bson.D, skip int, limit int) ([]bson.D, error) {
+	positions, err := c.positions(filter, sortSpec)
+	if err != nil {
+		return nil, err
+	}
+	if skip > len(positions) {
+		skip = len(positions)
+	}
+	positions = positions[skip:]
+	if limit > 0 && limit < len(positions) {
+		positions = positions[:limit]
+	}
+	docs := make([]bson.D, len(positions))
+	for i, p := range positions {
+		docs[i] = c.docs[p]
+	}
+	return docs, nil
+}
+
+// compileUpdate compiles an update, which may not replace documents if it
+// is multi.
+func compileUpdate(spec interface{}, arrayFilters []bson.D, multi bool) (*update.Update, error) {
+	compiled, err := update.Compile(spec, arrayFilters)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if multi && compiled.IsReplacement() {
+		return nil, errorf(messages.FailedToParse, "multi update is not supported for replacement-style update")
+	}
+	return compiled, nil
+}
+
+// update applies an update, to the first document in a sort order unless
+// it is multi. With single set, it also returns copies of the document
+// before and after the update.
+func (c *Collection) update(u Update, sortSpec bson.D, single bool) (result UpdateResult, before bson.D, after bson.D, err error) {
+	compiled, err := compileUpdate(u.Update, u.ArrayFilters, u.Multi)
+	if err != nil {
+		return
+	}
+	positions, err := c.positions(u.Filter, sortSpec)
+	if err != nil {
+		return
+	}
+	if !u.Multi && len(positions) > 1 {
+		positions = positions[:1]
+	}
+
+	opts := update.Options{Filter: u.Filter, Now: time.Now()}
+	for _, p := range positions {
+		old := c.docs[p]
+		var doc bson.D
+		if doc, err = compiled.Apply(old, opts); err != nil {
+			err = wrap(err)
+			return
+		}
+		if doc, err = keepID(old, doc); err != nil {
+			return
+		}
+		result.Matched++
+		if !bytes.Equal(marshal(old), marshal(doc)) {
+			if err = c.replace(p, doc); err != nil {
+				return
+			}
+			result.Modified++
+		}
+		if single {
+			before, after = copyDoc(old), copyDoc(doc)
+		}
+	}
+	if len(positions) > 0 || !u.Upsert {
+		return
+	}
+
+	doc, err := compiled.Upsert(u.Filter, opts)
+	if err != nil {
+		err = wrap(err)
+		return
+	}
+	if insertErr := c.insert(doc); insertErr != nil {
+		err = insertErr
+		return
+	}
+	doc = c.docs[len(c.docs)-1]
+	result.UpsertedID = doc[0].Value
+	if single {
+		after = copyDoc(doc)
+	}
+	return
+}
+
+// replace replaces the document at a position, failing if a unique index
+// has one of its keys for another document.
+func (c *Collection) replace(p int, doc bson.D) error {
+	id := idKey(doc[0].Value)
+	keys, err := c.indexKeys(doc, id)
+	if err != nil {
+		return err
+	}
+	removing := map[string]bool{id: true}
+	for i, ix := range c.indexes {
+		ix.remove(removing)
+		ix.add(keys[i], id)
+	}
+	c.size += docSize(doc) - docSize(c.docs[p])
+	c.docs[p] = doc
+	c.log(opPut, doc)
+	return nil
+}
+
+// keepID returns an updated document with the _id of the original first,
+// failing if the update changed it.
+func keepID(old bson.D, doc bson.D) (bson.D, error) {
+	id := old[0].Value
+	for i, elem := range doc {
+		if elem.Name != "_id" {
+			continue
+		}
+		if !bsonutil.Equal(elem.Value, id) {
+			return nil, errorf(messages.ImmutableField,
+				"Performing an update on the path '_id' would modify the immutable field '_id'")
+		}
+		doc = append(doc[:i:i], doc[i+1:]...)
+		break
+	}
+	return append(bson.D{{Name: "_id", Value: id}}, doc...), nil
+}
+
+// remove removes the documents a filter selects, up to limit of them in
+// a sort order if limit is not 0, and returns them.
+func (c *Collection) remove(filter bson.D, sortSpec bson.D, limit int) ([]bson.D, error) {
+	positions, err := c.positions(filter, sortSpec)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && limit < len(positions) {
+		positions = positions[:limit]
+	}
+	return c.removeAt(positions), nil
+}
+
+// removeAt removes the documents at positions, and returns them.
+func (c *Collection) removeAt(positions []int) []bson.D {
+	if len(positions) == 0 {
+		return nil
+	}
+
+	removing := make(map[int]bool, len(positions))
+	removingIDs := make(map[string]bool, len(positions))
+	removed := make([]bson.D, len(positions))
+	for i, p := range positions {
+		removing[p] = true
+		removingIDs[idKey(c.docs[p][0].Value)] = true
+		removed[i] = c.docs[p]
+		c.size -= docSize(c.docs[p])
+		c.journal.log(record{Op: opDelete, DB: c.db, Coll: c.name, ID: c.docs[p][0].Value})
+	}
+	for _, ix := range c.indexes {
+		ix.remove(removingIDs)
+	}
+	docs := make([]bson.D, 0, len(c.docs)-len(positions))
+	for i, doc := range c.docs {
+		if !removing[i] {
+			docs = append(docs, doc)
+		}
+	}
+	c.docs = docs
+	c.ids = make(map[string]int, len(docs))
+	for i, doc := range docs {
+		c.ids[idKey(doc[0].Value)] = i
+	}
+	return removed
+}
+
+// log records a change to a document in the store's journal.
+func (c *Collection) log(op string, doc bson.D) {
+	c.journal.log(record{Op: op, DB: c.db, Coll: c.name, Doc: doc})
+}
+
+// field returns the value of a document's field, and whether it has it.
+func field(doc bson.D, name string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// lookup returns the values at a dotted path in a value. Paths go into
+// the documents of arrays, so there may be several.
+func lookup(v interface{}, path string) []interface{} {
+	return lookupParts(v, strings.Split(path, "."))
+}
+
+func lookupParts(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+	if doc := bsonutil.ToD(v); doc != nil {
+		if value, ok := field(doc, parts[0]); ok {
+			return lookupParts(value, parts[1:])
+		}
+		return nil
+	}
+	array := bsonutil.ToArray(v)
+	if array == nil {
+		return nil
+	}
+	if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 {
+		if i < len(array) {
+			return lookupParts(array[i], parts[1:])
+		}
+		return nil
+	}
+	values := []interface{}{}
+	for _, elem := range array {
+		if bsonutil.ToD(elem) != nil {
+			values = append(values, lookupParts(elem, parts)...)
+		}
+	}
+	return values
+}
+
+func marshal(doc bson.D) []byte {
+	out, _ := bson.Marshal(doc)
+	return out
+}
+
+func docSize(doc bson.D) int64 {
+	return int64(len(marshal(doc)))
+}
+
+// copyDoc returns a deep copy of a document, with every document in it
+// a bson.D and every array a []interface{}.
+func copyDoc(doc bson.D) bson.D {
+	out := bson.D{}
+	bson.Unmarshal(marshal(doc), &out)
+	return out
+}
+
+// copyValue returns a deep copy of a value, as copyDoc does.
+func copyValue(v interface{}) interface{} {
+	return copyDoc(bson.D{{Name: "v", Value: v}})[0].Value
+}
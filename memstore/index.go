@@ -0,0 +1,562 @@
+package memstore
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// idIndexName is the name of the index every collection has on _id, which
+// is kept as the collection's ids.
+const idIndexName = "_id_"
+
+// An index orders the documents of a collection by the values of some of
+// their fields, and may require those to be unique.
+type index struct {
+	name string
+
+	// spec is the index as listIndexes describes it.
+	spec bson.D
+
+	key     bson.D
+	paths   []string
+	unique  bool
+	sparse  bool
+	partial *query.Filter
+
+	// ttl is set for indexes that expire documents expireAfter after
+	// the date in their field.
+	ttl         bool
+	expireAfter time.Duration
+
+	// entries are sorted by their values, then IDs.
+	entries []indexEntry
+
+	// multikey is set once a document has had an array in the index's
+	// fields, after which a field's bounds may not be intersected, since
+	// different elements may satisfy each.
+	multikey bool
+}
+
+// An indexEntry is the key of a document in an index, with the idKey of
+// the document's _id.
+type indexEntry struct {
+	values []interface{}
+	id     string
+}
+
+// indexOptions are the fields of index specifications, other than the
+// key and name.
+var indexOptions = map[string]bool{
+	"v":                       true,
+	"unique":                  true,
+	"sparse":                  true,
+	"partialFilterExpression": true,
+	"expireAfterSeconds":      true,
+	"background":              true,
+}
+
+// parseIndex parses an index specification, as createIndexes takes.
+func parseIndex(spec bson.D) (*index, error) {
+	ix := &index{}
+	var partial bson.D
+	hasExpire := false
+	var expire interface{}
+	for _, elem := range spec {
+		switch elem.Name {
+		case "key":
+			ix.key = bsonutil.ToD(elem.Value)
+		case "name":
+			name, ok := elem.Value.(string)
+			if !ok || len(name) == 0 {
+				return nil, errorf(messages.TypeMismatch, "The field 'name' must be a non-empty string")
+			}
+			ix.name = name
+		case "unique":
+			ix.unique = query.Truthy(elem.Value)
+		case "sparse":
+			ix.sparse = query.Truthy(elem.Value)
+		case "partialFilterExpression":
+			if partial = bsonutil.ToD(elem.Value); partial == nil {
+				return nil, errorf(messages.TypeMismatch, "The field 'partialFilterExpression' must be an object")
+			}
+		case "expireAfterSeconds":
+			hasExpire, expire = true, elem.Value
+		default:
+			if !indexOptions[elem.Name] {
+				return nil, errorf(messages.InvalidIndexSpecificationOption, "The field '%s' is not valid for an index specification. Specification: %s",
+					elem.Name, formatValue(spec))
+			}
+		}
+	}
+
+	if len(ix.key) == 0 {
+		return nil, errorf(messages.CannotCreateIndex, "Index keys cannot be empty.")
+	}
+	names := []string{}
+	for _, k := range ix.key {
+		f, ok := toFloat(k.Value)
+		if !ok || f == 0 || math.IsNaN(f) {
+			return nil, errorf(messages.CannotCreateIndex, "Values in the index key pattern can only be non-zero numbers; only ascending and descending indexes are supported, found %s",
+				formatValue(k.Value))
+		}
+		if len(k.Name) == 0 || strings.HasPrefix(k.Name, "$") || strings.Contains(k.Name, "..") {
+			return nil, errorf(messages.CannotCreateIndex, "Index key contains an illegal field name: '%s'", k.Name)
+		}
+		ix.paths = append(ix.paths, k.Name)
+		names = append(names, fmt.Sprintf("%s_%v", k.Name, k.Value))
+	}
+	if len(ix.name) == 0 {
+		ix.name = strings.Join(names, "_")
+	}
+
+	isID := sameKey(ix.key, idIndex.key)
+	switch {
+	case ix.sparse && partial != nil:
+		return nil, errorf(messages.CannotCreateIndex, "cannot mix \"partialFilterExpression\" and \"sparse\" options")
+	case isID && (ix.sparse || partial != nil || hasExpire):
+		return nil, errorf(messages.InvalidIndexSpecificationOption, "The _id index cannot be sparse, partial or expire documents")
+	case ix.name == idIndexName && !isID:
+		return nil, errorf(messages.CannotCreateIndex, "The index name '_id_' is reserved for the _id index")
+	}
+	if partial != nil {
+		var err error
+		if ix.partial, err = query.Compile(partial); err != nil {
+			return nil, wrap(err)
+		}
+	}
+	if hasExpire {
+		seconds, ok := toFloat(expire)
+		if !ok || seconds < 0 || seconds != math.Trunc(seconds) {
+			return nil, errorf(messages.CannotCreateIndex, "TTL index 'expireAfterSeconds' option must be a non-negative integer, found %s", formatValue(expire))
+		}
+		if len(ix.key) > 1 {
+			return nil, errorf(messages.CannotCreateIndex, "TTL indexes are single-field indexes, compound indexes do not support TTL")
+		}
+		ix.ttl, ix.expireAfter = true, time.Duration(seconds)*time.Second
+	}
+
+	ix.spec = bson.D{
+		{Name: "v", Value: 2},
+		{Name: "key", Value: ix.key},
+		{Name: "name", Value: ix.name},
+	}
+	if ix.unique {
+		ix.spec = append(ix.spec, bson.DocElem{Name: "unique", Value: true})
+	}
+	if ix.sparse {
+		ix.spec = append(ix.spec, bson.DocElem{Name: "sparse", Value: true})
+	}
+	if partial != nil {
+		ix.spec = append(ix.spec, bson.DocElem{Name: "partialFilterExpression", Value: partial})
+	}
+	if hasExpire {
+		ix.spec = append(ix.spec, bson.DocElem{Name: "expireAfterSeconds", Value: int(ix.expireAfter / time.Second)})
+	}
+	return ix, nil
+}
+
+// idIndex stands for the _id index, which has no entries of its own: the
+// collection's ids are its entries.
+var idIndex = &index{
+	name: idIndexName,
+	spec: bson.D{
+		{Name: "v", Value: 2},
+		{Name: "key", Value: bson.D{{Name: "_id", Value: 1}}},
+		{Name: "name", Value: idIndexName},
+	},
+	key:   bson.D{{Name: "_id", Value: 1}},
+	paths: []string{"_id"},
+}
+
+// sameKey returns whether two key patterns are the same.
+func sameKey(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !bsonutil.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// keys returns the keys of a document in the index: one, or one for each
+// element of the array in one of its fields, or none if the index leaves
+// the document out, as sparse and partial indexes do.
+func (ix *index) keys(doc bson.D) ([][]interface{}, error) {
+	if ix.partial != nil {
+		matched, err := ix.partial.Matches(doc)
+		if err != nil || !matched {
+			return nil, wrap(err)
+		}
+	}
+	values := make([][]interface{}, len(ix.paths))
+	missing := 0
+	arrayAt := -1
+	for i, path := range ix.paths {
+		found := lookup(doc, path)
+		if len(found) == 0 {
+			missing++
+			values[i] = []interface{}{nil}
+			continue
+		}
+		isArray := len(found) > 1
+		for _, v := range found {
+			if array := bsonutil.ToArray(v); array != nil {
+				isArray = true
+				if len(array) == 0 {
+					values[i] = append(values[i], nil)
+				}
+				values[i] = append(values[i], array...)
+			} else {
+				values[i] = append(values[i], v)
+			}
+		}
+		if isArray {
+			ix.multikey = true
+			if arrayAt >= 0 {
+				return nil, errorf(messages.CannotIndexParallelArrays, "cannot index parallel arrays [%s] [%s]", ix.paths[arrayAt], path)
+			}
+			arrayAt = i
+		}
+	}
+	if ix.sparse && missing == len(ix.paths) {
+		return nil, nil
+	}
+
+	if arrayAt < 0 {
+		key := make([]interface{}, len(values))
+		for i, v := range values {
+			key[i] = v[0]
+		}
+		return [][]interface{}{key}, nil
+	}
+	keys := [][]interface{}{}
+	for _, elem := range values[arrayAt] {
+		key := make([]interface{}, len(values))
+		for i, v := range values {
+			key[i] = v[0]
+		}
+		key[arrayAt] = elem
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// compareValues orders keys value by value.
+func compareValues(a, b []interface{}) int {
+	for i := range a {
+		if c := bsonutil.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (e indexEntry) less(other indexEntry) bool {
+	if c := compareValues(e.values, other.values); c != 0 {
+		return c < 0
+	}
+	return e.id < other.id
+}
+
+// search returns the position of the first entry not less than values.
+func (ix *index) search(values []interface{}) int {
+	return sort.Search(len(ix.entries), func(i int) bool {
+		return compareValues(ix.entries[i].values, values) >= 0
+	})
+}
+
+// conflict returns a key of a document that another document in the
+// unique index has too, if there is one.
+func (ix *index) conflict(keys [][]interface{}, id string) ([]interface{}, bool) {
+	if !ix.unique {
+		return nil, false
+	}
+	for _, key := range keys {
+		for i := ix.search(key); i < len(ix.entries) && compareValues(ix.entries[i].values, key) == 0; i++ {
+			if ix.entries[i].id != id {
+				return key, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// add adds the keys of a document.
+func (ix *index) add(keys [][]interface{}, id string) {
+	for _, key := range keys {
+		entry := indexEntry{values: key, id: id}
+		at := sort.Search(len(ix.entries), func(i int) bool {
+			return !ix.entries[i].less(entry)
+		})
+		ix.entries = append(ix.entries, indexEntry{})
+		copy(ix.entries[at+1:], ix.entries[at:])
+		ix.entries[at] = entry
+	}
+}
+
+// remove removes the keys of documents, by the idKeys of their _ids.
+func (ix *index) remove(ids map[string]bool) {
+	entries := ix.entries[:0]
+	for _, e := range ix.entries {
+		if !ids[e.id] {
+			entries = append(entries, e)
+		}
+	}
+	ix.entries = entries
+}
+
+// duplicate returns the duplicate key error of a key in the index.
+func (c *Collection) duplicate(ix *index, key []interface{}) *Error {
+	value := bson.D{}
+	for i, path := range ix.paths {
+		value = append(value, bson.DocElem{Name: path, Value: key[i]})
+	}
+	return c.duplicateKey(ix.name, ix.key, value)
+}
+
+// indexKeys returns the keys of a document in each index, failing if a
+// unique index has one of them for another document.
+func (c *Collection) indexKeys(doc bson.D, id string) ([][][]interface{}, *Error) {
+	keys := make([][][]interface{}, len(c.indexes))
+	for i, ix := range c.indexes {
+		var err error
+		if keys[i], err = ix.keys(doc); err != nil {
+			return nil, err.(*Error)
+		}
+		if key, ok := ix.conflict(keys[i], id); ok {
+			return nil, c.duplicate(ix, key)
+		}
+	}
+	return keys, nil
+}
+
+// index returns the index with a name, or nil.
+func (c *Collection) index(name string) *index {
+	for _, ix := range c.indexes {
+		if ix.name == name {
+			return ix
+		}
+	}
+	return nil
+}
+
+// dropIndexes drops indexes.
+func (c *Collection) dropIndexes(dropping map[*index]bool) {
+	indexes := []*index{}
+	for _, ix := range c.indexes {
+		if dropping[ix] {
+			c.journal.log(record{Op: opDropIndex, DB: c.db, Coll: c.name, Name: ix.name})
+		} else {
+			indexes = append(indexes, ix)
+		}
+	}
+	c.indexes = indexes
+}
+
+// createIndex builds an index of the collection's documents and adds it,
+// unless it exists already.
+func (c *Collection) createIndex(ix *index) error {
+	for _, other := range append([]*index{idIndex}, c.indexes...) {
+		switch {
+		case !sameKey(other.key, ix.key):
+			if other.name == ix.name {
+				return errorf(messages.IndexKeySpecsConflict, "An existing index has the same name as the requested index. Requested index: %s, existing index: %s",
+					formatValue(ix.spec), formatValue(other.spec))
+			}
+			continue
+		case other == idIndex:
+			// it exists already, whatever it is called
+		case other.name != ix.name:
+			return errorf(messages.IndexOptionsConflict, "Index already exists with a different name: %s", other.name)
+		case !bsonutil.Equal(other.spec, ix.spec):
+			return errorf(messages.IndexOptionsConflict, "An existing index has the same name as the requested index but different options. Requested index: %s, existing index: %s",
+				formatValue(ix.spec), formatValue(other.spec))
+		}
+		return nil
+	}
+
+	for _, doc := range c.docs {
+		keys, err := ix.keys(doc)
+		if err != nil {
+			return err
+		}
+		id := idKey(doc[0].Value)
+		for _, key := range keys {
+			ix.entries = append(ix.entries, indexEntry{values: key, id: id})
+		}
+	}
+	sort.Slice(ix.entries, func(i, j int) bool {
+		return ix.entries[i].less(ix.entries[j])
+	})
+	for i := 1; ix.unique && i < len(ix.entries); i++ {
+		a, b := ix.entries[i-1], ix.entries[i]
+		if a.id != b.id && compareValues(a.values, b.values) == 0 {
+			return c.duplicate(ix, b.values)
+		}
+	}
+	c.indexes = append(c.indexes, ix)
+	return nil
+}
+
+// accelerable returns whether a filter value's type is one an index finds
+// the documents equal to, or in a range of, by itself.
+func accelerable(v interface{}) bool {
+	switch v.(type) {
+	case string, bool, time.Time, bson.ObjectId:
+		return true
+	}
+	f, ok := toFloat(v)
+	return ok && !math.IsNaN(f)
+}
+
+// An interval is the range of values a field's condition in a filter
+// selects, with nil for no bound.
+type interval struct {
+	lower, upper         interface{}
+	lowerOpen, upperOpen bool
+
+	// point is set for equality, which one array element must satisfy,
+	// where each bound of a range may be satisfied by a different one.
+	point bool
+}
+
+// bounds returns the interval of a field's condition in a filter, and
+// false if there is none an index can scan.
+func bounds(condition interface{}) (interval, bool) {
+	doc := bsonutil.ToD(condition)
+	if len(doc) == 0 || !strings.HasPrefix(doc[0].Name, "$") {
+		if !accelerable(condition) {
+			return interval{}, false
+		}
+		return interval{lower: condition, upper: condition, point: true}, true
+	}
+	in := interval{}
+	for _, op := range doc {
+		if !accelerable(op.Value) {
+			continue
+		}
+		switch op.Name {
+		case "$eq":
+			return interval{lower: op.Value, upper: op.Value, point: true}, true
+		case "$gt", "$gte":
+			if in.lower == nil || bsonutil.Compare(op.Value, in.lower) > 0 {
+				in.lower, in.lowerOpen = op.Value, op.Name == "$gt"
+			}
+		case "$lt", "$lte":
+			if in.upper == nil || bsonutil.Compare(op.Value, in.upper) < 0 {
+				in.upper, in.upperOpen = op.Value, op.Name == "$lt"
+			}
+		}
+	}
+	return in, in.lower != nil || in.upper != nil
+}
+
+// candidates returns the positions, in order, of the documents that may
+// match a filter, as an index on one of its fields finds them, or false
+// if no index helps. Callers still match the documents against the
+// filter.
+func (c *Collection) candidates(filter bson.D) ([]int, bool) {
+	for _, elem := range filter {
+		if strings.HasPrefix(elem.Name, "$") {
+			continue
+		}
+		ix := c.indexOn(elem.Name)
+		if ix == nil {
+			continue
+		}
+		in, ok := bounds(elem.Value)
+		if !ok {
+			continue
+		}
+		if ix.multikey && !in.point && in.lower != nil {
+			in.upper = nil
+		}
+		return c.scan(ix, in), true
+	}
+	return nil, false
+}
+
+// scan returns the positions, in order, of the documents with a value in
+// an interval in the first field of an index. Values of other types than
+// the bounds' are never in it, as query comparisons go.
+func (c *Collection) scan(ix *index, in interval) []int {
+	bound := in.lower
+	if bound == nil {
+		bound = in.upper
+	}
+	start := sort.Search(len(ix.entries), func(i int) bool {
+		v := ix.entries[i].values[0]
+		if in.lower != nil {
+			return bsonutil.Compare(v, in.lower) >= 0
+		}
+		return bsonutil.SameType(v, bound) || bsonutil.Compare(v, bound) > 0
+	})
+	seen := map[int]bool{}
+	positions := []int{}
+	for _, e := range ix.entries[start:] {
+		v := e.values[0]
+		if !bsonutil.SameType(v, bound) {
+			break
+		}
+		if in.upper != nil {
+			if cmp := bsonutil.Compare(v, in.upper); cmp > 0 || (cmp == 0 && in.upperOpen) {
+				break
+			}
+		}
+		if in.lowerOpen && bsonutil.Compare(v, in.lower) == 0 {
+			continue
+		}
+		if p := c.ids[e.id]; !seen[p] {
+			seen[p] = true
+			positions = append(positions, p)
+		}
+	}
+	sort.Ints(positions)
+	return positions
+}
+
+// indexOn returns an index that has every document, whose first field is
+// a path, or nil. Paths with numeric parts are left to scans, since they
+// may name fields as well as array elements.
+func (c *Collection) indexOn(path string) *index {
+	for _, part := range strings.Split(path, ".") {
+		if len(part) > 0 && strings.Trim(part, "0123456789") == "" {
+			return nil
+		}
+	}
+	for _, ix := range c.indexes {
+		if ix.paths[0] == path && !ix.sparse && ix.partial == nil {
+			return ix
+		}
+	}
+	return nil
+}
+
+// expired returns whether a TTL index expires a document: whether the
+// earliest date in its field was longer ago than the index's expiry.
+func (ix *index) expired(doc bson.D, now time.Time) bool {
+	var earliest *time.Time
+	for _, v := range lookup(doc, ix.paths[0]) {
+		values := []interface{}{v}
+		if array := bsonutil.ToArray(v); array != nil {
+			values = array
+		}
+		for _, value := range values {
+			if t, ok := value.(time.Time); ok && (earliest == nil || t.Before(*earliest)) {
+				earliest = &t
+			}
+		}
+	}
+	return earliest != nil && !earliest.Add(ix.expireAfter).After(now)
+}
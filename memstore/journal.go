@@ -0,0 +1,563 @@
+package memstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Files of a store's data directory. The journal is appended to as the
+// store changes, and the snapshot replaces it when it grows too large.
+const (
+	journalFile  = "journal.bson"
+	snapshotFile = "snapshot.bson"
+)
+
+// A SyncPolicy is when a store flushes its journal to disk.
+type SyncPolicy int
+
+const (
+	// SyncInterval flushes the journal every SyncInterval, so that a
+	// crash of the machine loses at most that much.
+	SyncInterval SyncPolicy = iota
+
+	// SyncAlways flushes the journal before every write returns.
+	SyncAlways
+
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+var syncPolicies = map[string]SyncPolicy{
+	"interval": SyncInterval,
+	"always":   SyncAlways,
+	"never":    SyncNever,
+}
+
+// ParseSyncPolicy returns the policy with a name: "interval", "always" or
+// "never".
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	policy, ok := syncPolicies[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown sync policy %q: it must be interval, always or never", name)
+	}
+	return policy, nil
+}
+
+// Defaults of Options.
+const (
+	DefaultSyncInterval = 100 * time.Millisecond
+	DefaultCompactSize  = 64 << 20
+)
+
+// Options are where and how a store keeps its data on disk.
+type Options struct {
+	// Dir is the data directory, which is created if it does not exist.
+	Dir string
+
+	Sync SyncPolicy
+
+	// SyncInterval is how often SyncInterval flushes the journal, by
+	// default DefaultSyncInterval.
+	SyncInterval time.Duration
+
+	// CompactSize is the size of the journal at which it is compacted
+	// into a snapshot, by default DefaultCompactSize.
+	CompactSize int64
+}
+
+// withDefaults returns the options with defaults for those left unset.
+func (opts Options) withDefaults() Options {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.CompactSize <= 0 {
+		opts.CompactSize = DefaultCompactSize
+	}
+	return opts
+}
+
+// A record is a change to a store, as its journal and snapshot keep it.
+// Documents are recorded as they are after a change, not as the change
+// that was asked for, so that replaying records is deterministic.
+type record struct {
+	Seq  int64       `bson:"seq"`
+	Op   string      `bson:"op"`
+	DB   string      `bson:"db,omitempty"`
+	Coll string      `bson:"coll,omitempty"`
+	Doc  bson.D      `bson:"doc,omitempty"`
+	ID   interface{} `bson:"id"`
+	Name string      `bson:"name,omitempty"`
+}
+
+// Record operations. A snapshot starts with a snapshot record, whose seq
+// is that of the last journal record it includes.
+const (
+	opSnapshot     = "snapshot"
+	opCreate       = "create"
+	opDrop         = "drop"
+	opDropDatabase = "dropDatabase"
+	opPut          = "put"
+	opDelete       = "delete"
+	opCreateIndex  = "createIndex"
+	opDropIndex    = "dropIndex"
+)
+
+// A journal is the write-ahead log of a store that keeps its data on
+// disk. Records are collected as the store changes, and written when the
+// write that made them is done, with the store locked.
+type journal struct {
+	opts Options
+
+	pending []record
+	seq     int64
+
+	// the rest is guarded by mutex, since the sync loop flushes the
+	// file without the store locked
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+	dirty bool
+
+	// err is the first error writing the journal, after which the store
+	// refuses writes, since they could not be made durable.
+	err error
+}
+
+// log adds a record to be written, if there is a journal.
+func (j *journal) log(r record) {
+	if j == nil {
+		return
+	}
+	j.seq++
+	r.Seq = j.seq
+	j.pending = append(j.pending, r)
+}
+
+// Open opens the store kept in a data directory, recovering what its
+// snapshot and journal hold, or creates an empty one. The store removes
+// the documents its TTL indexes expire, and flushes its journal per its
+// sync policy, until it is closed.
+func Open(opts Options) (*Store, error) {
+	opts = opts.withDefaults()
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating the data directory: %v", err)
+	}
+
+	s := &Store{
+		databases: make(map[string]map[string]*Collection),
+		done:      make(chan struct{}),
+	}
+	j := &journal{opts: opts}
+	if err := s.recover(j); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(opts.Dir, journalFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the journal: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error opening the journal: %v", err)
+	}
+	j.file, j.size = file, info.Size()
+	s.journal = j
+	for _, colls := range s.databases {
+		for _, c := range colls {
+			c.journal = j
+		}
+	}
+	if j.size >= opts.CompactSize {
+		if err := j.compact(s); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	go s.expireLoop(TTLInterval)
+	if opts.Sync == SyncInterval {
+		go s.syncLoop(opts.SyncInterval)
+	}
+	return s, nil
+}
+
+// recover replays the snapshot, then the journal records after it, and
+// cuts off a record the journal ends in the middle of, as a crash while
+// writing it leaves it.
+func (s *Store) recover(j *journal) error {
+	snapshot, _, err := readRecords(filepath.Join(j.opts.Dir, snapshotFile))
+	if err != nil {
+		return fmt.Errorf("Error reading the snapshot: %v", err)
+	}
+	if len(snapshot) > 0 {
+		if snapshot[0].Op != opSnapshot {
+			return fmt.Errorf("Error reading the snapshot: it does not start with a snapshot record")
+		}
+		j.seq = snapshot[0].Seq
+		for _, r := range snapshot[1:] {
+			if err := s.apply(r); err != nil {
+				return fmt.Errorf("Error replaying the snapshot: %v", err)
+			}
+		}
+	}
+
+	path := filepath.Join(j.opts.Dir, journalFile)
+	records, end, err := readRecords(path)
+	if err != nil {
+		return fmt.Errorf("Error reading the journal: %v", err)
+	}
+	for _, r := range records {
+		if r.Seq <= j.seq {
+			// the snapshot has it already
+			continue
+		}
+		if err := s.apply(r); err != nil {
+			return fmt.Errorf("Error replaying the journal record %d: %v", r.Seq, err)
+		}
+		j.seq = r.Seq
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > end {
+		if err := os.Truncate(path, end); err != nil {
+			return fmt.Errorf("Error truncating the journal: %v", err)
+		}
+	}
+	return nil
+}
+
+// readRecords reads the records of a file, and returns them with the
+// offset of the end of the last whole one. A missing file has none.
+func readRecords(path string) ([]record, int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	records := []record{}
+	var offset int64
+	for int64(len(data))-offset >= 4 {
+		size := int64(binary.LittleEndian.Uint32(data[offset:]))
+		if size < 5 || offset+size > int64(len(data)) {
+			break
+		}
+		r := record{}
+		if err := bson.Unmarshal(data[offset:offset+size], &r); err != nil {
+			break
+		}
+		records = append(records, r)
+		offset += size
+	}
+	return records, offset, nil
+}
+
+// apply makes the change of a record, as it is replayed.
+func (s *Store) apply(r record) error {
+	switch r.Op {
+	case opDrop:
+		delete(s.databases[r.DB], r.Coll)
+		if len(s.databases[r.DB]) == 0 {
+			delete(s.databases, r.DB)
+		}
+		return nil
+	case opDropDatabase:
+		delete(s.databases, r.DB)
+		return nil
+	}
+
+	c, err := s.collection(r.DB, r.Coll, true)
+	if err != nil {
+		return err
+	}
+	switch r.Op {
+	case opCreate:
+	case opPut:
+		if len(r.Doc) == 0 || r.Doc[0].Name != "_id" {
+			return fmt.Errorf("document without an _id first")
+		}
+		if p, ok := c.ids[idKey(r.Doc[0].Value)]; ok {
+			return c.replace(p, r.Doc)
+		}
+		if err := c.insert(r.Doc); err != nil {
+			return err
+		}
+	case opDelete:
+		if p, ok := c.ids[idKey(r.ID)]; ok {
+			c.removeAt([]int{p})
+		}
+	case opCreateIndex:
+		ix, err := parseIndex(r.Doc)
+		if err != nil {
+			return err
+		}
+		return c.createIndex(ix)
+	case opDropIndex:
+		if ix := c.index(r.Name); ix != nil {
+			c.dropIndexes(map[*index]bool{ix: true})
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+	return nil
+}
+
+// lock locks the store for writing, failing if its journal has failed.
+func (s *Store) lock() error {
+	s.mutex.Lock()
+	if s.journal == nil {
+		return nil
+	}
+	s.journal.mutex.Lock()
+	err := s.journal.err
+	s.journal.mutex.Unlock()
+	if err != nil {
+		s.mutex.Unlock()
+		return errorf(messages.InternalError, "The store's journal failed, so it takes no more writes: %v", err)
+	}
+	return nil
+}
+
+// unlock writes the journal records of a write and unlocks the store. If
+// the journal cannot be written, the write fails, even though the store
+// has made it, since it is not durable.
+func (s *Store) unlock(err *error) {
+	defer s.mutex.Unlock()
+	if s.journal == nil {
+		return
+	}
+	if writeErr := s.journal.commit(s); writeErr != nil && *err == nil {
+		*err = errorf(messages.InternalError, "Error writing the journal: %v", writeErr)
+	}
+}
+
+// commit writes the pending records, compacting the journal once it has
+// grown past its compact size. The store must be locked.
+func (j *journal) commit(s *Store) error {
+	if len(j.pending) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, r := range j.pending {
+		out, err := bson.Marshal(r)
+		if err != nil {
+			return j.fail(err)
+		}
+		buf.Write(out)
+	}
+	j.pending = nil
+
+	j.mutex.Lock()
+	n, err := j.file.Write(buf.Bytes())
+	j.size += int64(n)
+	j.dirty = true
+	if err == nil && j.opts.Sync == SyncAlways {
+		err = j.flush()
+	}
+	size := j.size
+	j.mutex.Unlock()
+	if err != nil {
+		return j.fail(err)
+	}
+
+	if size >= j.opts.CompactSize {
+		return j.compact(s)
+	}
+	return nil
+}
+
+// fail records the journal's first error.
+func (j *journal) fail(err error) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.err == nil {
+		j.err = err
+	}
+	return err
+}
+
+// flush syncs the journal file, if it has been written to since it was
+// last. The journal's mutex must be held.
+func (j *journal) flush() error {
+	if !j.dirty {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.dirty = false
+	return nil
+}
+
+// compact writes a snapshot of the store, which replaces the journal:
+// the snapshot is written aside and renamed over the last one, and the
+// journal is emptied. A crash in between leaves the journal's records in
+// place, which the snapshot's seq skips when they are replayed. The store
+// must be locked.
+func (j *journal) compact(s *Store) error {
+	path := filepath.Join(j.opts.Dir, snapshotFile)
+	if err := writeSnapshot(path+".tmp", j.seq, s); err != nil {
+		return j.fail(fmt.Errorf("Error writing the snapshot: %v", err))
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return j.fail(fmt.Errorf("Error writing the snapshot: %v", err))
+	}
+	if err := syncDir(j.opts.Dir); err != nil {
+		return j.fail(fmt.Errorf("Error writing the snapshot: %v", err))
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if err := j.file.Truncate(0); err != nil {
+		j.err = fmt.Errorf("Error truncating the journal: %v", err)
+		return j.err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.err = fmt.Errorf("Error truncating the journal: %v", err)
+		return j.err
+	}
+	j.size, j.dirty = 0, false
+	return nil
+}
+
+// writeSnapshot writes the records that recreate a store to a file, and
+// syncs it.
+func writeSnapshot(path string, seq int64, s *Store) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := &snapshotWriter{w: file}
+	w.write(record{Seq: seq, Op: opSnapshot})
+	dbs := make([]string, 0, len(s.databases))
+	for db := range s.databases {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	for _, db := range dbs {
+		colls := make([]string, 0, len(s.databases[db]))
+		for coll := range s.databases[db] {
+			colls = append(colls, coll)
+		}
+		sort.Strings(colls)
+		for _, coll := range colls {
+			c := s.databases[db][coll]
+			w.write(record{Op: opCreate, DB: db, Coll: coll})
+			for _, ix := range c.indexes {
+				w.write(record{Op: opCreateIndex, DB: db, Coll: coll, Doc: ix.spec})
+			}
+			for _, doc := range c.docs {
+				w.write(record{Op: opPut, DB: db, Coll: coll, Doc: doc})
+			}
+		}
+	}
+	if w.err == nil {
+		w.err = file.Sync()
+	}
+	if err := file.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+// A snapshotWriter writes records, keeping the first error.
+type snapshotWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *snapshotWriter) write(r record) {
+	if w.err != nil {
+		return
+	}
+	out, err := bson.Marshal(r)
+	if err == nil {
+		_, err = w.w.Write(out)
+	}
+	w.err = err
+}
+
+// syncDir syncs a directory, so that renames in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// some file systems cannot sync directories
+	if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.journal.mutex.Lock()
+			if s.journal.err == nil {
+				if err := s.journal.flush(); err != nil {
+					s.journal.err = err
+				}
+			}
+			s.journal.mutex.Unlock()
+		}
+	}
+}
+
+// Compact writes a snapshot of a store that keeps its data on disk, and
+// empties its journal.
+func (s *Store) Compact() (err error) {
+	if err = s.lock(); err != nil {
+		return err
+	}
+	defer s.unlock(&err)
+	if s.journal == nil {
+		return nil
+	}
+	if err = s.journal.commit(s); err != nil {
+		return err
+	}
+	return s.journal.compact(s)
+}
+
+// closeJournal writes what is left of the journal, syncs it and closes
+// it. The store must be locked.
+func (s *Store) closeJournal() error {
+	j := s.journal
+	if j == nil || j.file == nil {
+		return nil
+	}
+	err := j.commit(s)
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if syncErr := j.flush(); err == nil {
+		err = syncErr
+	}
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	j.file = nil
+	if j.err == nil {
+		j.err = fmt.Errorf("the store is closed")
+	}
+	return err
+}
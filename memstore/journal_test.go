@@ -0,0 +1,159 @@
+package memstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestJournal(t *testing.T) {
+	Convey("Keep stores on disk", t, func() {
+		dir := t.TempDir()
+		journalPath := filepath.Join(dir, journalFile)
+		open := func(opts Options) *Store {
+			opts.Dir = dir
+			s, err := Open(opts)
+			So(err, ShouldBeNil)
+			return s
+		}
+		find := func(s *Store) []interface{} {
+			docs, err := s.Find("shop", "fruit", Query{})
+			So(err, ShouldBeNil)
+			return ids(docs)
+		}
+		named := func(name string) bson.D {
+			return bson.D{{Name: "$set", Value: bson.D{{Name: "name", Value: name}}}}
+		}
+
+		s := open(Options{Sync: SyncAlways})
+		s.Insert("shop", "fruit", fruit(), true)
+		s.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: "date"}}}, true)
+		s.CreateIndexes("shop", "fruit", []bson.D{{
+			{Name: "key", Value: bson.D{{Name: "name", Value: 1}}},
+			{Name: "unique", Value: true},
+		}})
+		s.Update("shop", "fruit", Update{Filter: bson.D{{Name: "_id", Value: 1}}, Update: named("apricot")})
+		s.Delete("shop", "fruit", bson.D{{Name: "_id", Value: 2}}, 0)
+		s.Insert("shop", "fruit", []bson.D{{{Name: "_id", Value: 2}, {Name: "name", Value: "apple"}}}, true)
+		s.Insert("shop", "orders", []bson.D{{{Name: "total", Value: 3}}}, true)
+		s.Drop("shop", "orders")
+		want := find(s)
+		So(want, ShouldHaveLength, 4)
+		So(s.Close(), ShouldBeNil)
+
+		Convey("recovering them when opened again", func() {
+			s := open(Options{})
+			defer s.Close()
+			So(find(s), ShouldResemble, want)
+			docs, _ := s.Find("shop", "fruit", Query{Filter: bson.D{{Name: "_id", Value: 1}}})
+			So(docs[0][1].Value, ShouldEqual, "apricot")
+			So(s.ListCollections("shop"), ShouldResemble, []string{"fruit"})
+
+			_, writeErrors, _ := s.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: "apple"}}}, true)
+			So(writeErrors, ShouldHaveLength, 1)
+			So(writeErrors[0].Err.Code, ShouldEqual, messages.DuplicateKey)
+		})
+
+		Convey("cutting off a record a crash left half written", func() {
+			info, _ := os.Stat(journalPath)
+			file, _ := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+			out, _ := bson.Marshal(record{Seq: 100, Op: opDropDatabase, DB: "shop"})
+			file.Write(out[:len(out)-3])
+			file.Close()
+
+			s := open(Options{})
+			defer s.Close()
+			So(find(s), ShouldResemble, want)
+			after, _ := os.Stat(journalPath)
+			So(after.Size(), ShouldEqual, info.Size())
+		})
+
+		Convey("compacting the journal into a snapshot", func() {
+			before, _ := ioutil.ReadFile(journalPath)
+			s := open(Options{})
+			So(s.Compact(), ShouldBeNil)
+			info, _ := os.Stat(journalPath)
+			So(info.Size(), ShouldEqual, 0)
+			So(s.Close(), ShouldBeNil)
+
+			s = open(Options{})
+			So(find(s), ShouldResemble, want)
+			So(s.Close(), ShouldBeNil)
+
+			Convey("skipping the records it holds if a crash kept them", func() {
+				// replayed over the snapshot, the first update would
+				// take a name another document has now
+				ioutil.WriteFile(journalPath, before, 0644)
+				s := open(Options{})
+				defer s.Close()
+				So(find(s), ShouldResemble, want)
+			})
+		})
+
+		Convey("compacting once the journal grows too large", func() {
+			s := open(Options{Sync: SyncNever, CompactSize: 1})
+			defer s.Close()
+			info, _ := os.Stat(journalPath)
+			So(info.Size(), ShouldEqual, 0)
+			s.Update("shop", "fruit", Update{Filter: bson.D{{Name: "_id", Value: 3}}, Update: named("cranberry")})
+			info, _ = os.Stat(journalPath)
+			So(info.Size(), ShouldEqual, 0)
+			records, _, _ := readRecords(filepath.Join(dir, snapshotFile))
+			So(records[0].Op, ShouldEqual, opSnapshot)
+			So(records[0].Seq, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("refusing writes once closed", func() {
+			_, _, err := s.Insert("shop", "fruit", []bson.D{{}}, true)
+			So(err, ShouldNotBeNil)
+			So(s.Close(), ShouldBeNil)
+		})
+
+		Convey("sharing them by name and directory", func() {
+			shared, err := SharedOpen(t.Name(), Options{Dir: dir})
+			So(err, ShouldBeNil)
+			again, _ := SharedOpen(t.Name(), Options{Dir: dir + "/."})
+			So(again, ShouldEqual, shared)
+			wd, _ := os.Getwd()
+			relative, _ := filepath.Rel(wd, dir)
+			again, _ = SharedOpen(t.Name(), Options{Dir: relative, SyncInterval: DefaultSyncInterval})
+			So(again, ShouldEqual, shared)
+
+			_, err = SharedOpen(t.Name(), Options{Dir: t.TempDir()})
+			So(err, ShouldNotBeNil)
+			_, err = SharedOpen(t.Name()+"/other", Options{Dir: relative})
+			So(err, ShouldNotBeNil)
+			_, err = SharedOpen(t.Name(), Options{Dir: dir, Sync: SyncAlways})
+			So(err, ShouldNotBeNil)
+			_, err = SharedOpen(t.Name(), Options{Dir: dir, CompactSize: 1 << 20})
+			So(err, ShouldNotBeNil)
+			_, err = ParseSyncPolicy("sometimes")
+			So(err, ShouldNotBeNil)
+
+			Convey("closing them once every holder releases them", func() {
+				shared.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: "elderberry"}}}, true)
+				for _, name := range []string{"fig", "grape"} {
+					So(shared.Release(), ShouldBeNil)
+					_, writeErrors, err := shared.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: name}}}, true)
+					So(writeErrors, ShouldBeEmpty)
+					So(err, ShouldBeNil)
+				}
+				So(shared.Release(), ShouldBeNil)
+				_, _, err := shared.Insert("shop", "fruit", []bson.D{{}}, true)
+				So(err, ShouldNotBeNil)
+				So(shared.Release(), ShouldBeNil)
+
+				reopened, err := SharedOpen(t.Name(), Options{Dir: dir, Sync: SyncAlways})
+				So(err, ShouldBeNil)
+				So(reopened, ShouldNotEqual, shared)
+				So(find(reopened), ShouldHaveLength, 7)
+				So(reopened.Release(), ShouldBeNil)
+			})
+		})
+	})
+}
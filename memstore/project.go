@@ -0,0 +1,23 @@
+package memstore
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// project returns copies of documents with a projection applied to them.
+func project(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	p, err := query.CompileProjection(spec)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		projected, err := p.Apply(doc)
+		if err != nil {
+			return nil, wrap(err)
+		}
+		out[i] = copyDoc(projected)
+	}
+	return out, nil
+}
@@ -0,0 +1,660 @@
+// Package memstore is a MongoDB-compatible document store that keeps its
+// databases in memory, for modules to serve commands from without a
+// MongoDB server behind them. Stores opened with Open also keep their
+// changes in a journal on disk, to recover from when they are opened
+// again.
+package memstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mongodbinc-interns/mongoproxy/aggregate"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// An Error is a failed operation, with the MongoDB error code to answer
+// with.
+type Error struct {
+	Code    int32
+	Message string
+
+	// Details are further fields for the error's document, such as the
+	// keyPattern and keyValue of duplicate key errors.
+	Details bson.D
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func errorf(code int32, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// wrap returns query errors as Errors.
+func wrap(err error) error {
+	if e, ok := err.(*query.Error); ok {
+		return &Error{Code: e.Code, Message: e.Message}
+	}
+	return err
+}
+
+// A WriteError is the error of one document of a write.
+type WriteError struct {
+	Index int
+	Err   *Error
+}
+
+// A Store holds databases of collections of documents.
+type Store struct {
+	mutex     sync.RWMutex
+	databases map[string]map[string]*Collection
+	done      chan struct{}
+
+	// journal is where a store opened with Open keeps its changes, and
+	// nil for stores kept only in memory.
+	journal *journal
+}
+
+// New creates an empty store, which removes the documents its TTL indexes
+// expire every TTLInterval until it is closed.
+func New() *Store {
+	s := &Store{
+		databases: make(map[string]map[string]*Collection),
+		done:      make(chan struct{}),
+	}
+	go s.expireLoop(TTLInterval)
+	return s
+}
+
+// stores are the stores created by Shared and SharedOpen, by name, and
+// refs counts the modules holding each store opened by SharedOpen.
+var stores = make(map[string]*Store)
+var refs = make(map[*Store]int)
+var storesMutex sync.Mutex
+
+// Shared returns the store with a name, creating it if it does not exist
+// yet, so that modules keep their data over configuration reloads.
+func Shared(name string) *Store {
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+	s, ok := stores[name]
+	if !ok {
+		s = New()
+		stores[name] = s
+	}
+	return s
+}
+
+// SharedOpen returns the store with a name, opening it with Open if it
+// is not open yet, for a module to hold until it calls Release. It fails
+// if the store is open on another directory, or with other options, or
+// kept only in memory, or if another store is open on the directory.
+func SharedOpen(name string, opts Options) (*Store, error) {
+	dir, err := filepath.Abs(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding the data directory: %v", err)
+	}
+	opts.Dir = dir
+	opts = opts.withDefaults()
+
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+	if s, ok := stores[name]; ok {
+		switch {
+		case s.journal == nil || s.journal.opts.Dir != dir:
+			return nil, fmt.Errorf("The store %q is already open, and not on %s", name, dir)
+		case s.journal.opts != opts:
+			return nil, fmt.Errorf("The store %q is already open with other sync and compaction options, which cannot change until the proxy restarts", name)
+		}
+		refs[s]++
+		return s, nil
+	}
+	for other, s := range stores {
+		if s.journal != nil && s.journal.opts.Dir == dir {
+			return nil, fmt.Errorf("The data directory %s is already open for the store %q", dir, other)
+		}
+	}
+	s, err := Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	stores[name] = s
+	refs[s] = 1
+	return s, nil
+}
+
+// Release gives back a store from SharedOpen. Once every module holding
+// it has, the store is closed, flushing its journal, and the next
+// SharedOpen opens it again.
+func (s *Store) Release() error {
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+	if refs[s] == 0 {
+		return nil
+	}
+	if refs[s]--; refs[s] > 0 {
+		return nil
+	}
+	delete(refs, s)
+	for name, shared := range stores {
+		if shared == s {
+			delete(stores, name)
+		}
+	}
+	return s.Close()
+}
+
+// checkNamespace returns an error for names MongoDB does not allow.
+func checkNamespace(db string, coll string) *Error {
+	if len(db) == 0 || strings.ContainsAny(db, "/\\. \"$") {
+		return errorf(messages.InvalidNamespace, "Invalid database name: “%s”", db)
+	}
+	if len(coll) == 0 || strings.HasPrefix(coll, ".") || strings.Contains(coll, "$") {
+		return errorf(messages.InvalidNamespace, "Invalid collection name: “%s”", coll)
+	}
+	return nil
+}
+
+// collection returns a collection, or nil if it does not exist, unless
+// create is set. The store must be locked, for writing if create is set.
+func (s *Store) collection(db string, coll string, create bool) (*Collection, error) {
+	if err := checkNamespace(db, coll); err != nil {
+		return nil, err
+	}
+	c := s.databases[db][coll]
+	if c == nil && create {
+		if s.databases[db] == nil {
+			s.databases[db] = make(map[string]*Collection)
+		}
+		c = newCollection(db, coll)
+		c.journal = s.journal
+		s.databases[db][coll] = c
+		s.journal.log(record{Op: opCreate, DB: db, Coll: coll})
+	}
+	return c, nil
+}
+
+// Create creates a collection, failing if it exists.
+func (s *Store) Create(db string, coll string) (err error) {
+	if err = s.lock(); err != nil {
+		return err
+	}
+	defer s.unlock(&err)
+	if err := checkNamespace(db, coll); err != nil {
+		return err
+	}
+	if s.databases[db][coll] != nil {
+		return errorf(messages.NamespaceExists, "Collection %s.%s already exists.", db, coll)
+	}
+	_, err = s.collection(db, coll, true)
+	return err
+}
+
+// Drop drops a collection, failing if it does not exist. It returns the
+// number of indexes the collection had, counting the _id index.
+func (s *Store) Drop(db string, coll string) (was int, err error) {
+	if err = s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.unlock(&err)
+	c := s.databases[db][coll]
+	if c == nil {
+		return 0, errorf(messages.NamespaceNotFound, "ns not found")
+	}
+	was = len(c.indexes) + 1
+	s.journal.log(record{Op: opDrop, DB: db, Coll: coll})
+	delete(s.databases[db], coll)
+	if len(s.databases[db]) == 0 {
+		delete(s.databases, db)
+	}
+	return was, nil
+}
+
+// DropDatabase drops a database and its collections.
+func (s *Store) DropDatabase(db string) (err error) {
+	if err = s.lock(); err != nil {
+		return err
+	}
+	defer s.unlock(&err)
+	if s.databases[db] != nil {
+		s.journal.log(record{Op: opDropDatabase, DB: db})
+		delete(s.databases, db)
+	}
+	return nil
+}
+
+// ListCollections returns the names of a database's collections, sorted.
+func (s *Store) ListCollections(db string) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	names := []string{}
+	for name := range s.databases[db] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DatabaseInfo describes a database, as listDatabases does.
+type DatabaseInfo struct {
+	Name       string
+	SizeOnDisk int64
+	Empty      bool
+}
+
+// ListDatabases describes the store's databases, sorted by name.
+func (s *Store) ListDatabases() []DatabaseInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	infos := []DatabaseInfo{}
+	for name, colls := range s.databases {
+		info := DatabaseInfo{Name: name, Empty: true}
+		for _, c := range colls {
+			info.SizeOnDisk += c.size
+			if len(c.docs) > 0 {
+				info.Empty = false
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Insert inserts documents into a collection, creating it if needed, and
+// returns how many were inserted, and the errors of those that were not.
+// Documents without an _id get an ObjectId. Ordered inserts stop at the
+// first error.
+func (s *Store) Insert(db string, coll string, docs []bson.D, ordered bool) (n int, writeErrors []WriteError, err error) {
+	if err = s.lock(); err != nil {
+		return 0, nil, err
+	}
+	defer s.unlock(&err)
+	c, err := s.collection(db, coll, true)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	writeErrors = []WriteError{}
+	for i, doc := range docs {
+		if err := c.insert(doc); err != nil {
+			writeErrors = append(writeErrors, WriteError{Index: i, Err: err})
+			if ordered {
+				break
+			}
+			continue
+		}
+		n++
+	}
+	return n, writeErrors, nil
+}
+
+// A Query selects, orders and shapes the documents of a collection.
+type Query struct {
+	Filter     bson.D
+	Sort       bson.D
+	Projection bson.D
+	Skip       int
+	// Limit of 0 means no limit.
+	Limit int
+}
+
+// Find returns copies of the documents a query selects, in order.
+func (s *Store) Find(db string, coll string, q Query) ([]bson.D, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, err := s.collection(db, coll, false)
+	if err != nil || c == nil {
+		return []bson.D{}, err
+	}
+
+	docs, err := c.find(q.Filter, q.Sort, q.Skip, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return project(docs, q.Projection)
+}
+
+// Count returns how many documents match a filter, after skipping some,
+// up to a limit, if it is not 0.
+func (s *Store) Count(db string, coll string, filter bson.D, skip int, limit int) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, err := s.collection(db, coll, false)
+	if err != nil || c == nil {
+		return 0, err
+	}
+	docs, err := c.find(filter, nil, skip, limit)
+	return len(docs), err
+}
+
+// Distinct returns the distinct values of a field among the documents
+// matching a filter. The elements of arrays count as values of their own.
+func (s *Store) Distinct(db string, coll string, key string, filter bson.D) ([]interface{}, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, err := s.collection(db, coll, false)
+	if err != nil || c == nil {
+		return []interface{}{}, err
+	}
+	docs, err := c.find(filter, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{}
+	add := func(v interface{}) {
+		for _, seen := range values {
+			if bsonutil.Equal(seen, v) {
+				return
+			}
+		}
+		values = append(values, copyValue(v))
+	}
+	for _, doc := range docs {
+		for _, v := range lookup(doc, key) {
+			if array, ok := v.([]interface{}); ok {
+				for _, elem := range array {
+					add(elem)
+				}
+			} else {
+				add(v)
+			}
+		}
+	}
+	return values, nil
+}
+
+// Aggregate runs an aggregation pipeline over a collection's documents,
+// with the other collections of its database for stages such as $lookup,
+// and returns copies of the documents it results in.
+func (s *Store) Aggregate(db string, coll string, pipeline []interface{}) ([]bson.D, error) {
+	p, err := aggregate.Compile(pipeline)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	source := func(name string) ([]bson.D, error) {
+		c, err := s.collection(db, name, false)
+		if err != nil || c == nil {
+			return []bson.D{}, err
+		}
+		return c.docs, nil
+	}
+	docs, err := source(coll)
+	if err != nil {
+		return nil, err
+	}
+	if docs, err = p.Run(docs, source); err != nil {
+		return nil, wrap(err)
+	}
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		out[i] = copyDoc(doc)
+	}
+	return out, nil
+}
+
+// An Update changes the documents a filter selects.
+type Update struct {
+	Filter bson.D
+
+	// Update is an update document of operators, a replacement
+	// document, or a pipeline: an array of stages.
+	Update interface{}
+
+	// ArrayFilters are the filters of the identifiers in $[<identifier>].
+	ArrayFilters []bson.D
+
+	Multi  bool
+	Upsert bool
+}
+
+// An UpdateResult counts what an update did. Matched and Modified differ
+// when updates leave documents as they were.
+type UpdateResult struct {
+	Matched    int
+	Modified   int
+	UpsertedID interface{}
+}
+
+// Update applies an update.
+func (s *Store) Update(db string, coll string, u Update) (result UpdateResult, err error) {
+	if err = s.lock(); err != nil {
+		return result, err
+	}
+	defer s.unlock(&err)
+	c, err := s.collection(db, coll, u.Upsert)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	if c == nil {
+		_, err = compileUpdate(u.Update, u.ArrayFilters, u.Multi)
+		return UpdateResult{}, err
+	}
+	result, _, _, err = c.update(u, nil, false)
+	return result, err
+}
+
+// Delete removes the documents a filter selects, up to limit of them if
+// it is not 0, and returns how many it removed.
+func (s *Store) Delete(db string, coll string, filter bson.D, limit int) (n int, err error) {
+	if err = s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.unlock(&err)
+	c, err := s.collection(db, coll, false)
+	if err != nil || c == nil {
+		return 0, err
+	}
+	removed, err := c.remove(filter, nil, limit)
+	return len(removed), err
+}
+
+// A FindAndModify updates or removes the first document a query selects,
+// in its sort order.
+type FindAndModify struct {
+	Query        bson.D
+	Sort         bson.D
+	Update       interface{}
+	ArrayFilters []bson.D
+	Remove       bool
+	Upsert       bool
+
+	// New returns the document as it is after the update, rather than
+	// before.
+	New    bool
+	Fields bson.D
+}
+
+// A FindAndModifyResult is what findAndModify reports in lastErrorObject.
+type FindAndModifyResult struct {
+	N               int
+	UpdatedExisting bool
+	UpsertedID      interface{}
+}
+
+// FindAndModify applies a findAndModify, returning the document before or
+// after, or nil if there was none.
+func (s *Store) FindAndModify(db string, coll string, f FindAndModify) (doc bson.D, result FindAndModifyResult, err error) {
+	if err = s.lock(); err != nil {
+		return nil, result, err
+	}
+	defer s.unlock(&err)
+	c, err := s.collection(db, coll, f.Upsert)
+	if err != nil || c == nil {
+		return nil, result, err
+	}
+
+	if f.Remove {
+		var removed []bson.D
+		removed, err = c.remove(f.Query, f.Sort, 1)
+		result.N = len(removed)
+		if len(removed) > 0 {
+			doc = removed[0]
+		}
+	} else {
+		var before, after bson.D
+		var updated UpdateResult
+		updated, before, after, err = c.update(Update{Filter: f.Query, Update: f.Update, ArrayFilters: f.ArrayFilters, Upsert: f.Upsert}, f.Sort, true)
+		result.N = updated.Matched
+		result.UpdatedExisting = updated.Matched > 0
+		if updated.UpsertedID != nil {
+			result.N = 1
+			result.UpsertedID = updated.UpsertedID
+		}
+		doc = before
+		if f.New {
+			doc = after
+		}
+	}
+	if err != nil || doc == nil {
+		return nil, result, err
+	}
+	docs, err := project([]bson.D{doc}, f.Fields)
+	if err != nil {
+		return nil, result, err
+	}
+	return docs[0], result, nil
+}
+
+// A CreateIndexesResult is what createIndexes reports.
+type CreateIndexesResult struct {
+	Before  int
+	After   int
+	Created bool
+
+	// Note is set when every index existed already.
+	Note string
+}
+
+// CreateIndexes creates indexes on a collection, creating it if needed.
+// Indexes that exist already are left as they are. If one of the indexes
+// cannot be built, none of them are.
+func (s *Store) CreateIndexes(db string, coll string, specs []bson.D) (result CreateIndexesResult, err error) {
+	indexes := make([]*index, len(specs))
+	for i, spec := range specs {
+		ix, err := parseIndex(spec)
+		if err != nil {
+			return result, err
+		}
+		indexes[i] = ix
+	}
+
+	if err = s.lock(); err != nil {
+		return result, err
+	}
+	defer s.unlock(&err)
+	c, err := s.collection(db, coll, false)
+	if err != nil {
+		return result, err
+	}
+	if c == nil {
+		c, _ = s.collection(db, coll, true)
+		result.Created = true
+	}
+	result.Before = len(c.indexes) + 1
+	for _, ix := range indexes {
+		if err := c.createIndex(ix); err != nil {
+			c.indexes = c.indexes[:result.Before-1]
+			return result, err
+		}
+	}
+	for _, ix := range c.indexes[result.Before-1:] {
+		s.journal.log(record{Op: opCreateIndex, DB: db, Coll: coll, Doc: ix.spec})
+	}
+	result.After = len(c.indexes) + 1
+	if result.After == result.Before {
+		result.Note = "all indexes already exist"
+	}
+	return result, nil
+}
+
+// DropIndexes drops indexes of a collection: "*" for every one but the
+// _id index, or one by name or key pattern, or several by name. It returns
+// how many indexes the collection had before.
+func (s *Store) DropIndexes(db string, coll string, which interface{}) (was int, err error) {
+	if err = s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.unlock(&err)
+	c, err := s.collection(db, coll, false)
+	if err != nil {
+		return 0, err
+	}
+	if c == nil {
+		return 0, errorf(messages.NamespaceNotFound, "ns not found %s.%s", db, coll)
+	}
+	was = len(c.indexes) + 1
+
+	dropping := map[*index]bool{}
+	if key := bsonutil.ToD(which); key != nil {
+		if sameKey(key, idIndex.key) {
+			return was, errorf(messages.InvalidOptions, "cannot drop _id index")
+		}
+		for _, ix := range c.indexes {
+			if sameKey(ix.key, key) {
+				dropping[ix] = true
+			}
+		}
+		if len(dropping) == 0 {
+			return was, errorf(messages.IndexNotFound, "can't find index with key: %s", formatValue(key))
+		}
+	} else if which == "*" {
+		for _, ix := range c.indexes {
+			dropping[ix] = true
+		}
+	} else {
+		names := bsonutil.ToArray(which)
+		if names == nil {
+			names = []interface{}{which}
+		}
+		for _, name := range names {
+			name, ok := name.(string)
+			if !ok {
+				return was, errorf(messages.TypeMismatch, "dropIndexes “index” must be a string, an array of strings or a key pattern")
+			}
+			if name == idIndexName {
+				return was, errorf(messages.InvalidOptions, "cannot drop _id index")
+			}
+			ix := c.index(name)
+			if ix == nil {
+				return was, errorf(messages.IndexNotFound, "index not found with name [%s]", name)
+			}
+			dropping[ix] = true
+		}
+	}
+
+	c.dropIndexes(dropping)
+	return was, nil
+}
+
+// ListIndexes describes a collection's indexes, as listIndexes does, the
+// _id index first.
+func (s *Store) ListIndexes(db string, coll string) ([]bson.D, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, err := s.collection(db, coll, false)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errorf(messages.NamespaceNotFound, "ns does not exist: %s.%s", db, coll)
+	}
+	specs := []bson.D{copyDoc(idIndex.spec)}
+	for _, ix := range c.indexes {
+		specs = append(specs, copyDoc(ix.spec))
+	}
+	return specs, nil
+}
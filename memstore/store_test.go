@@ -0,0 +1,584 @@
+package memstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func fruit() []bson.D {
+	return []bson.D{
+		{{Name: "_id", Value: 1}, {Name: "name", Value: "apple"}, {Name: "qty", Value: 5}, {Name: "tags", Value: []interface{}{"red", "sweet"}}},
+		{{Name: "_id", Value: 2}, {Name: "name", Value: "banana"}, {Name: "qty", Value: 12}, {Name: "tags", Value: []interface{}{"yellow"}}},
+		{{Name: "_id", Value: 3}, {Name: "name", Value: "cherry"}, {Name: "qty", Value: 40}, {Name: "origin", Value: bson.D{{Name: "country", Value: "TR"}}}},
+	}
+}
+
+func ids(docs []bson.D) []interface{} {
+	out := []interface{}{}
+	for _, doc := range docs {
+		out = append(out, doc[0].Value)
+	}
+	return out
+}
+
+func TestInsert(t *testing.T) {
+	Convey("Insert documents", t, func() {
+		s := New()
+		n, writeErrors, err := s.Insert("shop", "fruit", fruit(), true)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 3)
+		So(writeErrors, ShouldBeEmpty)
+		So(s.ListCollections("shop"), ShouldResemble, []string{"fruit"})
+
+		Convey("generating _ids first in the document", func() {
+			_, _, err := s.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: "date"}}}, true)
+			So(err, ShouldBeNil)
+			docs, _ := s.Find("shop", "fruit", Query{Filter: bson.D{{Name: "name", Value: "date"}}})
+			So(docs, ShouldHaveLength, 1)
+			So(docs[0][0].Name, ShouldEqual, "_id")
+			So(docs[0][0].Value, ShouldHaveSameTypeAs, bson.NewObjectId())
+
+			_, _, err = s.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: "fig"}, {Name: "_id", Value: "f"}}}, true)
+			So(err, ShouldBeNil)
+			docs, _ = s.Find("shop", "fruit", Query{Filter: bson.D{{Name: "name", Value: "fig"}}})
+			So(docs[0], ShouldResemble, bson.D{{Name: "_id", Value: "f"}, {Name: "name", Value: "fig"}})
+		})
+
+		Convey("failing duplicate _ids", func() {
+			more := []bson.D{
+				{{Name: "_id", Value: 4}},
+				{{Name: "_id", Value: 1.0}},
+				{{Name: "_id", Value: 5}},
+			}
+			n, writeErrors, _ := s.Insert("shop", "fruit", more, true)
+			So(n, ShouldEqual, 1)
+			So(writeErrors, ShouldHaveLength, 1)
+			So(writeErrors[0].Index, ShouldEqual, 1)
+			So(writeErrors[0].Err.Code, ShouldEqual, messages.DuplicateKey)
+			So(writeErrors[0].Err.Message, ShouldEqual,
+				"E11000 duplicate key error collection: shop.fruit index: _id_ dup key: { _id: 1.0 }")
+
+			Convey("going on past them when unordered", func() {
+				n, writeErrors, _ := s.Insert("shop", "fruit", more, false)
+				So(n, ShouldEqual, 1)
+				So(writeErrors, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("keeping copies", func() {
+			docs := fruit()
+			docs[0][1].Value = "apricot"
+			found, _ := s.Find("shop", "fruit", Query{Filter: bson.D{{Name: "_id", Value: 1}}})
+			So(found[0][1].Value, ShouldEqual, "apple")
+		})
+
+		Convey("rejecting bad names", func() {
+			_, _, err := s.Insert("sh.op", "fruit", fruit(), true)
+			So(err, ShouldNotBeNil)
+			_, _, err = s.Insert("shop", "", fruit(), true)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFind(t *testing.T) {
+	Convey("Find documents", t, func() {
+		s := New()
+		s.Insert("shop", "fruit", fruit(), true)
+
+		find := func(q Query) []interface{} {
+			docs, err := s.Find("shop", "fruit", q)
+			So(err, ShouldBeNil)
+			return ids(docs)
+		}
+
+		Convey("by filter", func() {
+			So(find(Query{}), ShouldResemble, []interface{}{1, 2, 3})
+			So(find(Query{Filter: bson.D{{Name: "tags", Value: "red"}}}), ShouldResemble, []interface{}{1})
+			So(find(Query{Filter: bson.D{{Name: "origin.country", Value: "TR"}}}), ShouldResemble, []interface{}{3})
+			So(find(Query{Filter: bson.D{{Name: "qty", Value: bson.D{{Name: "$gte", Value: 12}, {Name: "$lt", Value: 40.5}}}}}), ShouldResemble, []interface{}{2, 3})
+			So(find(Query{Filter: bson.D{{Name: "qty", Value: bson.D{{Name: "$gt", Value: "a"}}}}}), ShouldBeEmpty)
+			So(find(Query{Filter: bson.D{{Name: "origin", Value: bson.D{{Name: "$exists", Value: false}}}}}), ShouldResemble, []interface{}{1, 2})
+			So(find(Query{Filter: bson.D{{Name: "origin", Value: nil}}}), ShouldResemble, []interface{}{1, 2})
+			So(find(Query{Filter: bson.D{{Name: "$or", Value: []interface{}{
+				bson.D{{Name: "name", Value: "apple"}},
+				bson.D{{Name: "qty", Value: bson.D{{Name: "$in", Value: []interface{}{40, 41}}}}},
+			}}}}), ShouldResemble, []interface{}{1, 3})
+		})
+
+		Convey("sorted, skipped and limited", func() {
+			So(find(Query{Sort: bson.D{{Name: "qty", Value: -1}}, Skip: 1, Limit: 1}), ShouldResemble, []interface{}{2})
+			So(find(Query{Sort: bson.D{{Name: "tags", Value: 1}}}), ShouldResemble, []interface{}{3, 1, 2})
+		})
+
+		Convey("projected", func() {
+			docs, err := s.Find("shop", "fruit", Query{
+				Filter:     bson.D{{Name: "_id", Value: 3}},
+				Projection: bson.D{{Name: "origin.country", Value: 1}, {Name: "name", Value: true}},
+			})
+			So(err, ShouldBeNil)
+			So(docs[0], ShouldResemble, bson.D{
+				{Name: "_id", Value: 3},
+				{Name: "name", Value: "cherry"},
+				{Name: "origin", Value: bson.D{{Name: "country", Value: "TR"}}},
+			})
+
+			docs, _ = s.Find("shop", "fruit", Query{
+				Filter:     bson.D{{Name: "_id", Value: 1}},
+				Projection: bson.D{{Name: "_id", Value: 0}, {Name: "tags", Value: 0}},
+			})
+			So(docs[0], ShouldResemble, bson.D{{Name: "name", Value: "apple"}, {Name: "qty", Value: 5}})
+		})
+
+		Convey("failing bad queries", func() {
+			for _, q := range []Query{
+				{Filter: bson.D{{Name: "qty", Value: bson.D{{Name: "$near", Value: 1}}}}},
+				{Filter: bson.D{{Name: "$or", Value: []interface{}{}}}},
+				{Sort: bson.D{{Name: "qty", Value: 2}}},
+				{Projection: bson.D{{Name: "qty", Value: 1}, {Name: "name", Value: 0}}},
+				{Filter: bson.D{{Name: "$expr", Value: bson.D{{Name: "$divide", Value: []interface{}{1, 0}}}}}},
+			} {
+				_, err := s.Find("shop", "fruit", q)
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("counting and finding distinct values", func() {
+			n, err := s.Count("shop", "fruit", bson.D{{Name: "qty", Value: bson.D{{Name: "$gt", Value: 1}}}}, 1, 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+
+			values, err := s.Distinct("shop", "fruit", "tags", nil)
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []interface{}{"red", "sweet", "yellow"})
+		})
+
+		Convey("in collections that do not exist", func() {
+			docs, err := s.Find("shop", "vegetables", Query{})
+			So(err, ShouldBeNil)
+			So(docs, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	Convey("Update documents", t, func() {
+		s := New()
+		s.Insert("shop", "fruit", fruit(), true)
+
+		get := func(id interface{}) bson.D {
+			docs, _ := s.Find("shop", "fruit", Query{Filter: bson.D{{Name: "_id", Value: id}}})
+			if len(docs) == 0 {
+				return nil
+			}
+			return docs[0]
+		}
+
+		Convey("with operators", func() {
+			result, err := s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "qty", Value: bson.D{{Name: "$lt", Value: 20}}}},
+				Update: bson.D{
+					{Name: "$inc", Value: bson.D{{Name: "qty", Value: 1}}},
+					{Name: "$set", Value: bson.D{{Name: "stock.shelf", Value: "A"}}},
+					{Name: "$unset", Value: bson.D{{Name: "tags", Value: ""}}},
+				},
+				Multi: true,
+			})
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, UpdateResult{Matched: 2, Modified: 2})
+			So(get(2), ShouldResemble, bson.D{
+				{Name: "_id", Value: 2},
+				{Name: "name", Value: "banana"},
+				{Name: "qty", Value: 13},
+				{Name: "stock", Value: bson.D{{Name: "shelf", Value: "A"}}},
+			})
+		})
+
+		Convey("counting only documents that change as modified", func() {
+			result, err := s.Update("shop", "fruit", Update{
+				Update: bson.D{{Name: "$set", Value: bson.D{{Name: "qty", Value: 5}}}},
+				Multi:  true,
+			})
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, UpdateResult{Matched: 3, Modified: 2})
+		})
+
+		Convey("by replacement, keeping the _id", func() {
+			result, err := s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "name", Value: "apple"}},
+				Update: bson.D{{Name: "name", Value: "green apple"}},
+			})
+			So(err, ShouldBeNil)
+			So(result.Modified, ShouldEqual, 1)
+			So(get(1), ShouldResemble, bson.D{{Name: "_id", Value: 1}, {Name: "name", Value: "green apple"}})
+
+			_, err = s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "_id", Value: 1}},
+				Update: bson.D{{Name: "_id", Value: 9}},
+			})
+			So(err.(*Error).Code, ShouldEqual, messages.ImmutableField)
+		})
+
+		Convey("upserting from the filter's equalities", func() {
+			result, err := s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "name", Value: "kiwi"}, {Name: "qty", Value: bson.D{{Name: "$gt", Value: 3}}}},
+				Update: bson.D{
+					{Name: "$inc", Value: bson.D{{Name: "qty", Value: 2}}},
+					{Name: "$setOnInsert", Value: bson.D{{Name: "new", Value: true}}},
+				},
+				Upsert: true,
+			})
+			So(err, ShouldBeNil)
+			So(result.Matched, ShouldEqual, 0)
+			So(result.UpsertedID, ShouldNotBeNil)
+			doc := get(result.UpsertedID)
+			So(doc[1:], ShouldResemble, bson.D{
+				{Name: "name", Value: "kiwi"},
+				{Name: "new", Value: true},
+				{Name: "qty", Value: 2},
+			})
+		})
+
+		Convey("failing bad updates", func() {
+			for _, u := range []Update{
+				{Update: bson.D{{Name: "$rename", Value: bson.D{{Name: "a", Value: 1}}}}},
+				{Update: bson.D{
+					{Name: "$set", Value: bson.D{{Name: "qty", Value: 1}}},
+					{Name: "$inc", Value: bson.D{{Name: "qty", Value: 1}}},
+				}},
+				{Update: bson.D{{Name: "$set", Value: 1}}},
+				{Update: bson.D{{Name: "name", Value: "x"}}, Multi: true},
+				{Update: bson.D{{Name: "$inc", Value: bson.D{{Name: "name", Value: 1}}}}},
+				{Update: bson.D{{Name: "$set", Value: bson.D{{Name: "name.first", Value: 1}}}}},
+			} {
+				_, err := s.Update("shop", "fruit", u)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestDelete(t *testing.T) {
+	Convey("Delete documents", t, func() {
+		s := New()
+		s.Insert("shop", "fruit", fruit(), true)
+
+		n, err := s.Delete("shop", "fruit", bson.D{{Name: "qty", Value: bson.D{{Name: "$lt", Value: 20}}}}, 1)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		n, _ = s.Delete("shop", "fruit", nil, 0)
+		So(n, ShouldEqual, 2)
+
+		Convey("letting their _ids be used again", func() {
+			n, _, _ := s.Insert("shop", "fruit", fruit(), true)
+			So(n, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestFindAndModify(t *testing.T) {
+	Convey("Find and modify documents", t, func() {
+		s := New()
+		s.Insert("shop", "fruit", fruit(), true)
+
+		Convey("returning the document before or after", func() {
+			f := FindAndModify{
+				Sort:   bson.D{{Name: "qty", Value: -1}},
+				Update: bson.D{{Name: "$inc", Value: bson.D{{Name: "qty", Value: -1}}}},
+				Fields: bson.D{{Name: "qty", Value: 1}},
+			}
+			doc, result, err := s.FindAndModify("shop", "fruit", f)
+			So(err, ShouldBeNil)
+			So(doc, ShouldResemble, bson.D{{Name: "_id", Value: 3}, {Name: "qty", Value: 40}})
+			So(result, ShouldResemble, FindAndModifyResult{N: 1, UpdatedExisting: true})
+
+			f.New = true
+			doc, _, _ = s.FindAndModify("shop", "fruit", f)
+			So(doc, ShouldResemble, bson.D{{Name: "_id", Value: 3}, {Name: "qty", Value: 38}})
+		})
+
+		Convey("removing", func() {
+			doc, result, err := s.FindAndModify("shop", "fruit", FindAndModify{
+				Query:  bson.D{{Name: "name", Value: "banana"}},
+				Remove: true,
+			})
+			So(err, ShouldBeNil)
+			So(doc[0].Value, ShouldEqual, 2)
+			So(result.N, ShouldEqual, 1)
+			n, _ := s.Count("shop", "fruit", nil, 0, 0)
+			So(n, ShouldEqual, 2)
+		})
+
+		Convey("upserting", func() {
+			doc, result, err := s.FindAndModify("shop", "fruit", FindAndModify{
+				Query:  bson.D{{Name: "_id", Value: 7}},
+				Update: bson.D{{Name: "$set", Value: bson.D{{Name: "name", Value: "lime"}}}},
+				Upsert: true,
+				New:    true,
+			})
+			So(err, ShouldBeNil)
+			So(doc, ShouldResemble, bson.D{{Name: "_id", Value: 7}, {Name: "name", Value: "lime"}})
+			So(result, ShouldResemble, FindAndModifyResult{N: 1, UpsertedID: 7})
+		})
+
+		Convey("with array filters", func() {
+			s.Insert("shop", "fruit", []bson.D{{{Name: "_id", Value: 8}, {Name: "sizes", Value: []interface{}{1, 5, 9}}}}, true)
+			doc, _, err := s.FindAndModify("shop", "fruit", FindAndModify{
+				Query:        bson.D{{Name: "_id", Value: 8}},
+				Update:       bson.D{{Name: "$set", Value: bson.D{{Name: "sizes.$[big]", Value: 0}}}},
+				ArrayFilters: []bson.D{{{Name: "big", Value: bson.D{{Name: "$gt", Value: 4}}}}},
+				New:          true,
+			})
+			So(err, ShouldBeNil)
+			So(doc, ShouldResemble, bson.D{{Name: "_id", Value: 8}, {Name: "sizes", Value: []interface{}{1, 0, 0}}})
+		})
+
+		Convey("finding nothing", func() {
+			doc, result, err := s.FindAndModify("shop", "fruit", FindAndModify{
+				Query:  bson.D{{Name: "_id", Value: 7}},
+				Remove: true,
+			})
+			So(err, ShouldBeNil)
+			So(doc, ShouldBeNil)
+			So(result.N, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestCollections(t *testing.T) {
+	Convey("Create and drop collections and databases", t, func() {
+		s := New()
+		So(s.Create("shop", "fruit"), ShouldBeNil)
+		So(s.Create("shop", "fruit").(*Error).Code, ShouldEqual, messages.NamespaceExists)
+		s.Insert("shop", "orders", []bson.D{{{Name: "total", Value: 3}}}, true)
+		s.Insert("admin", "users", []bson.D{{{Name: "user", Value: "me"}}}, true)
+		So(s.ListCollections("shop"), ShouldResemble, []string{"fruit", "orders"})
+
+		infos := s.ListDatabases()
+		So(infos, ShouldHaveLength, 2)
+		So(infos[1].Name, ShouldEqual, "shop")
+		So(infos[1].SizeOnDisk, ShouldBeGreaterThan, 0)
+
+		was, err := s.Drop("shop", "fruit")
+		So(err, ShouldBeNil)
+		So(was, ShouldEqual, 1)
+		_, err = s.Drop("shop", "fruit")
+		So(err.(*Error).Code, ShouldEqual, messages.NamespaceNotFound)
+		s.DropDatabase("shop")
+		So(s.ListCollections("shop"), ShouldBeEmpty)
+		So(s.ListDatabases(), ShouldHaveLength, 1)
+
+		So(Shared("test"), ShouldEqual, Shared("test"))
+	})
+}
+
+func TestIndexes(t *testing.T) {
+	Convey("Index collections", t, func() {
+		s := New()
+		defer s.Close()
+		s.Insert("shop", "fruit", fruit(), true)
+		index := func(key bson.D, options ...bson.DocElem) bson.D {
+			return append(bson.D{{Name: "key", Value: key}}, options...)
+		}
+		unique := bson.DocElem{Name: "unique", Value: true}
+		names := func() []interface{} {
+			specs, err := s.ListIndexes("shop", "fruit")
+			So(err, ShouldBeNil)
+			out := []interface{}{}
+			for _, spec := range specs {
+				out = append(out, spec[2].Value)
+			}
+			return out
+		}
+
+		result, err := s.CreateIndexes("shop", "fruit", []bson.D{index(bson.D{{Name: "name", Value: 1}}, unique)})
+		So(err, ShouldBeNil)
+		So(result, ShouldResemble, CreateIndexesResult{Before: 1, After: 2})
+		So(names(), ShouldResemble, []interface{}{"_id_", "name_1"})
+
+		Convey("leaving indexes that exist as they are", func() {
+			result, err := s.CreateIndexes("shop", "fruit", []bson.D{
+				index(bson.D{{Name: "name", Value: 1}}, unique),
+				index(bson.D{{Name: "_id", Value: 1}}),
+			})
+			So(err, ShouldBeNil)
+			So(result.After, ShouldEqual, 2)
+			So(result.Note, ShouldEqual, "all indexes already exist")
+		})
+
+		Convey("enforcing unique keys on insert and update", func() {
+			n, writeErrors, _ := s.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: "apple"}}}, true)
+			So(n, ShouldEqual, 0)
+			So(writeErrors, ShouldHaveLength, 1)
+			So(writeErrors[0].Err.Code, ShouldEqual, messages.DuplicateKey)
+			So(writeErrors[0].Err.Message, ShouldEqual,
+				`E11000 duplicate key error collection: shop.fruit index: name_1 dup key: { name: "apple" }`)
+			So(writeErrors[0].Err.Details, ShouldResemble, bson.D{
+				{Name: "keyPattern", Value: bson.D{{Name: "name", Value: 1}}},
+				{Name: "keyValue", Value: bson.D{{Name: "name", Value: "apple"}}},
+			})
+
+			_, err := s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "_id", Value: 2}},
+				Update: bson.D{{Name: "$set", Value: bson.D{{Name: "name", Value: "apple"}}}},
+			})
+			So(err.(*Error).Code, ShouldEqual, messages.DuplicateKey)
+			_, err = s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "_id", Value: 1}},
+				Update: bson.D{{Name: "$set", Value: bson.D{{Name: "name", Value: "apple"}, {Name: "qty", Value: 6}}}},
+			})
+			So(err, ShouldBeNil)
+
+			s.Delete("shop", "fruit", bson.D{{Name: "name", Value: "apple"}}, 0)
+			_, writeErrors, _ = s.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: "apple"}}}, true)
+			So(writeErrors, ShouldBeEmpty)
+		})
+
+		Convey("with compound, sparse and partial keys", func() {
+			_, err := s.CreateIndexes("shop", "fruit", []bson.D{
+				index(bson.D{{Name: "qty", Value: 1}, {Name: "name", Value: -1}}, unique),
+				index(bson.D{{Name: "origin.country", Value: 1}}, unique, bson.DocElem{Name: "sparse", Value: true}),
+				index(bson.D{{Name: "tags", Value: 1}}, unique,
+					bson.DocElem{Name: "partialFilterExpression", Value: bson.D{{Name: "qty", Value: bson.D{{Name: "$gt", Value: 10}}}}}),
+			})
+			So(err, ShouldBeNil)
+			So(names(), ShouldResemble, []interface{}{"_id_", "name_1", "qty_1_name_-1", "origin.country_1", "tags_1"})
+
+			more := []bson.D{
+				{{Name: "name", Value: "date"}, {Name: "qty", Value: 5}},
+				{{Name: "name", Value: "elderberry"}, {Name: "tags", Value: []interface{}{"red"}}},
+				{{Name: "name", Value: "fig"}, {Name: "qty", Value: 20}, {Name: "tags", Value: []interface{}{"yellow", "purple"}}},
+			}
+			n, writeErrors, _ := s.Insert("shop", "fruit", more, false)
+			So(n, ShouldEqual, 2)
+			So(writeErrors, ShouldHaveLength, 1)
+			So(writeErrors[0].Index, ShouldEqual, 2)
+			So(writeErrors[0].Err.Message, ShouldEqual,
+				`E11000 duplicate key error collection: shop.fruit index: tags_1 dup key: { tags: "yellow" }`)
+		})
+
+		Convey("failing to build indexes the documents break", func() {
+			_, err := s.CreateIndexes("shop", "fruit", []bson.D{
+				index(bson.D{{Name: "qty", Value: 1}}),
+				index(bson.D{{Name: "colour", Value: 1}}, unique),
+			})
+			So(err.(*Error).Code, ShouldEqual, messages.DuplicateKey)
+			So(err.(*Error).Message, ShouldEqual,
+				"E11000 duplicate key error collection: shop.fruit index: colour_1 dup key: { colour: null }")
+			So(names(), ShouldResemble, []interface{}{"_id_", "name_1"})
+
+			s.Insert("shop", "fruit", []bson.D{{{Name: "a", Value: []interface{}{1, 2}}, {Name: "b", Value: []interface{}{3}}}}, true)
+			_, err = s.CreateIndexes("shop", "fruit", []bson.D{index(bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 1}})})
+			So(err.(*Error).Code, ShouldEqual, messages.CannotIndexParallelArrays)
+		})
+
+		Convey("failing bad specifications", func() {
+			bad := []struct {
+				spec bson.D
+				code int32
+			}{
+				{index(bson.D{{Name: "qty", Value: 1}}, bson.DocElem{Name: "name", Value: "name_1"}), messages.IndexKeySpecsConflict},
+				{index(bson.D{{Name: "name", Value: 1}}, bson.DocElem{Name: "name", Value: "byName"}), messages.IndexOptionsConflict},
+				{index(bson.D{{Name: "name", Value: 1}}), messages.IndexOptionsConflict},
+				{index(bson.D{{Name: "qty", Value: 1}}, bson.DocElem{Name: "colour", Value: true}), messages.InvalidIndexSpecificationOption},
+				{index(bson.D{{Name: "qty", Value: "text"}}), messages.CannotCreateIndex},
+				{index(bson.D{}), messages.CannotCreateIndex},
+				{index(bson.D{{Name: "qty", Value: 1}}, bson.DocElem{Name: "sparse", Value: true},
+					bson.DocElem{Name: "partialFilterExpression", Value: bson.D{}}), messages.CannotCreateIndex},
+				{index(bson.D{{Name: "qty", Value: 1}, {Name: "name", Value: 1}},
+					bson.DocElem{Name: "expireAfterSeconds", Value: 10}), messages.CannotCreateIndex},
+				{index(bson.D{{Name: "qty", Value: 1}}, bson.DocElem{Name: "expireAfterSeconds", Value: -1}), messages.CannotCreateIndex},
+			}
+			for _, b := range bad {
+				_, err := s.CreateIndexes("shop", "fruit", []bson.D{b.spec})
+				So(err, ShouldNotBeNil)
+				So(err.(*Error).Code, ShouldEqual, b.code)
+			}
+		})
+
+		Convey("using indexes to find documents", func() {
+			s.Insert("shop", "fruit", []bson.D{{{Name: "_id", Value: 4}, {Name: "qty", Value: []interface{}{1, 10}}}}, true)
+			filters := []bson.D{
+				{{Name: "qty", Value: 12}},
+				{{Name: "qty", Value: bson.D{{Name: "$gt", Value: 3}, {Name: "$lt", Value: 5}}}},
+				{{Name: "qty", Value: bson.D{{Name: "$gte", Value: 5}, {Name: "$lte", Value: 12}}}},
+				{{Name: "qty", Value: bson.D{{Name: "$lt", Value: 10}}}},
+				{{Name: "qty", Value: bson.D{{Name: "$gt", Value: "a"}}}},
+				{{Name: "name", Value: bson.D{{Name: "$gte", Value: "b"}}}, {Name: "qty", Value: bson.D{{Name: "$gt", Value: 20}}}},
+			}
+			scanned := [][]interface{}{}
+			for _, filter := range filters {
+				docs, err := s.Find("shop", "fruit", Query{Filter: filter})
+				So(err, ShouldBeNil)
+				scanned = append(scanned, ids(docs))
+			}
+
+			_, err := s.CreateIndexes("shop", "fruit", []bson.D{index(bson.D{{Name: "qty", Value: -1}})})
+			So(err, ShouldBeNil)
+			c := s.databases["shop"]["fruit"]
+			positions, ok := c.candidates(bson.D{{Name: "qty", Value: bson.D{{Name: "$gte", Value: 12}}}})
+			So(ok, ShouldBeTrue)
+			So(positions, ShouldResemble, []int{1, 2})
+			for i, filter := range filters {
+				docs, err := s.Find("shop", "fruit", Query{Filter: filter})
+				So(err, ShouldBeNil)
+				So(ids(docs), ShouldResemble, scanned[i])
+			}
+			So(scanned[1], ShouldResemble, []interface{}{4})
+		})
+
+		Convey("dropping indexes", func() {
+			s.CreateIndexes("shop", "fruit", []bson.D{
+				index(bson.D{{Name: "qty", Value: 1}}),
+				index(bson.D{{Name: "tags", Value: 1}}),
+			})
+			_, err := s.DropIndexes("shop", "fruit", "_id_")
+			So(err.(*Error).Code, ShouldEqual, messages.InvalidOptions)
+			_, err = s.DropIndexes("shop", "fruit", "colour_1")
+			So(err.(*Error).Code, ShouldEqual, messages.IndexNotFound)
+			_, err = s.DropIndexes("shop", "orders", "*")
+			So(err.(*Error).Code, ShouldEqual, messages.NamespaceNotFound)
+
+			was, err := s.DropIndexes("shop", "fruit", bson.D{{Name: "qty", Value: 1}})
+			So(err, ShouldBeNil)
+			So(was, ShouldEqual, 4)
+			So(names(), ShouldResemble, []interface{}{"_id_", "name_1", "tags_1"})
+			was, _ = s.DropIndexes("shop", "fruit", "*")
+			So(was, ShouldEqual, 3)
+			So(names(), ShouldResemble, []interface{}{"_id_"})
+			_, writeErrors, _ := s.Insert("shop", "fruit", []bson.D{{{Name: "name", Value: "apple"}}}, true)
+			So(writeErrors, ShouldBeEmpty)
+		})
+
+		Convey("expiring documents with TTL indexes", func() {
+			now := time.Now()
+			_, err := s.CreateIndexes("shop", "fruit", []bson.D{
+				index(bson.D{{Name: "picked", Value: 1}}, bson.DocElem{Name: "expireAfterSeconds", Value: 60}),
+			})
+			So(err, ShouldBeNil)
+			s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "_id", Value: 1}},
+				Update: bson.D{{Name: "$set", Value: bson.D{{Name: "picked", Value: now.Add(-2 * time.Minute)}}}},
+			})
+			s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "_id", Value: 2}},
+				Update: bson.D{{Name: "$set", Value: bson.D{{Name: "picked", Value: []interface{}{now, now.Add(-time.Hour)}}}}},
+			})
+			s.Update("shop", "fruit", Update{
+				Filter: bson.D{{Name: "_id", Value: 3}},
+				Update: bson.D{{Name: "$set", Value: bson.D{{Name: "picked", Value: now}}}},
+			})
+			So(s.expire(now), ShouldEqual, 2)
+			docs, _ := s.Find("shop", "fruit", Query{})
+			So(ids(docs), ShouldResemble, []interface{}{3})
+			So(s.expire(now.Add(time.Minute)), ShouldEqual, 1)
+
+			s.Close()
+			s.Close()
+		})
+	})
+}
@@ -0,0 +1,69 @@
+package memstore
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TTLInterval is how often stores remove the documents their TTL indexes
+// expire, as often as mongod does.
+const TTLInterval = time.Minute
+
+func (s *Store) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.expire(now)
+		}
+	}
+}
+
+// expire removes the documents that TTL indexes expire by now, and
+// returns how many.
+func (s *Store) expire(now time.Time) (n int) {
+	var err error
+	if err = s.lock(); err != nil {
+		return 0
+	}
+	defer s.unlock(&err)
+	for _, colls := range s.databases {
+		for _, c := range colls {
+			n += len(c.expire(now))
+		}
+	}
+	return n
+}
+
+// expire removes the documents the collection's TTL indexes expire by
+// now, and returns them.
+func (c *Collection) expire(now time.Time) []bson.D {
+	positions := []int{}
+	for p, doc := range c.docs {
+		for _, ix := range c.indexes {
+			if ix.ttl && ix.expired(doc, now) {
+				positions = append(positions, p)
+				break
+			}
+		}
+	}
+	return c.removeAt(positions)
+}
+
+// Close stops the store's background work, and closes its journal if it
+// has one. A closed store with a journal takes no more writes.
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+		close(s.done)
+	}
+	return s.closeJournal()
+}
@@ -0,0 +1,161 @@
+package messages
+
+import (
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A User is a MongoDB user that a client has authenticated as.
+type User struct {
+	Name      string
+	Database  string
+	Mechanism string
+}
+
+// String returns the user as "name@database".
+func (u User) String() string {
+	return u.Name + "@" + u.Database
+}
+
+// User returns the user the client has authenticated as, or nil if it
+// has not, or has logged out.
+func (c *Client) User() *User {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.user
+}
+
+func (c *Client) setUser(user *User) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.user = user
+}
+
+func (c *Client) setPendingUser(user *User) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pendingUser = user
+}
+
+// completeAuth makes the user of the SASL conversation in progress the
+// client's user.
+func (c *Client) completeAuth() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pendingUser != nil {
+		c.user = c.pendingUser
+		c.pendingUser = nil
+	}
+}
+
+// RecordAuth follows authentication on the client that req arrived on,
+// given the response the pipeline gave it. The proxy does not check
+// credentials itself; it takes a successful reply from a module, such as
+// a backend's, as proof of the user named in the request.
+//
+// The user is known for SCRAM and PLAIN conversations, including ones
+// started speculatively in the handshake, and for authenticate commands
+// that name the user. Other mechanisms leave the client's user unknown.
+func RecordAuth(req Requester, res ModuleResponse) {
+	client := ClientOf(req)
+	if client == nil || res.CommandError != nil || res.Writer == nil {
+		return
+	}
+
+	var name string
+	var args bson.M
+	switch r := req.(type) {
+	case Command:
+		name, args = r.CommandName, r.Args
+	case *Message:
+		name, args = r.CommandName(), r.Body.Map()
+	default:
+		return
+	}
+
+	reply := res.Writer.ToBSON()
+	if convert.ToFloat64(reply["ok"]) != 1 {
+		return
+	}
+
+	switch name {
+	case "saslStart":
+		startSASL(client, args, convert.ToString(args["$db"]), reply)
+	case "saslContinue":
+		if convert.ToBool(reply["done"]) {
+			client.completeAuth()
+		}
+	case "authenticate":
+		if user := convert.ToString(args["user"]); len(user) > 0 {
+			client.setUser(&User{
+				Name:      user,
+				Database:  convert.ToString(args["$db"]),
+				Mechanism: convert.ToString(args["mechanism"]),
+			})
+		}
+	case "logout":
+		client.setUser(nil)
+	case "hello", "isMaster", "ismaster":
+		speculative := convert.ToBSONMap(args["speculativeAuthenticate"])
+		speculativeReply := convert.ToBSONMap(reply["speculativeAuthenticate"])
+		if speculative != nil && speculativeReply != nil {
+			startSASL(client, speculative, convert.ToString(speculative["db"]), speculativeReply)
+		}
+	}
+}
+
+// startSASL records the user a SASL conversation is for, which becomes
+// the client's user once the conversation is done.
+func startSASL(client *Client, args bson.M, db string, reply bson.M) {
+	mechanism := convert.ToString(args["mechanism"])
+	user := saslUser(mechanism, payloadBytes(args["payload"]))
+	if len(user) == 0 {
+		client.setPendingUser(nil)
+		return
+	}
+	client.setPendingUser(&User{Name: user, Database: db, Mechanism: mechanism})
+	if convert.ToBool(reply["done"]) {
+		client.completeAuth()
+	}
+}
+
+func payloadBytes(payload interface{}) []byte {
+	switch p := payload.(type) {
+	case []byte:
+		return p
+	case bson.Binary:
+		return p.Data
+	case string:
+		return []byte(p)
+	}
+	return nil
+}
+
+// saslUser returns the user named in the first message of a SASL
+// conversation, if the mechanism is one whose user can be read.
+func saslUser(mechanism string, payload []byte) string {
+	switch {
+	case strings.HasPrefix(mechanism, "SCRAM-"):
+		// "gs2-header,n=user,r=nonce", with "," and "=" in the user
+		// escaped as "=2C" and "=3D"
+		fields := strings.Split(string(payload), ",")
+		if len(fields) < 3 {
+			return ""
+		}
+		for _, field := range fields[2:] {
+			if strings.HasPrefix(field, "n=") {
+				user := strings.Replace(field[2:], "=2C", ",", -1)
+				return strings.Replace(user, "=3D", "=", -1)
+			}
+		}
+	case mechanism == "PLAIN":
+		// "authzid\x00user\x00password"
+		fields := strings.Split(string(payload), "\x00")
+		if len(fields) == 3 {
+			return fields[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package messages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A Client describes the client connection that a request arrived on. Proxy
+// core creates one per accepted connection and attaches it to every request
+// decoded from that connection, so modules can tell connections apart.
+type Client struct {
+	ID         int64
+	RemoteAddr string
+	Connected  time.Time
+
+	mutex    sync.RWMutex
+	metadata bson.M
+	requests int64
+	done     chan struct{}
+
+	// user is the authenticated user, and pendingUser the user of a SASL
+	// conversation in progress.
+	user        *User
+	pendingUser *User
+}
+
+// NewClient creates a Client for the connection with the given ID and remote address.
+func NewClient(id int64, remoteAddr string) *Client {
+	return &Client{
+		ID:         id,
+		RemoteAddr: remoteAddr,
+		Connected:  time.Now(),
+		done:       make(chan struct{}),
+	}
+}
+
+// Metadata returns the "client" document the driver sent in its handshake,
+// or nil if the handshake has not happened yet.
+func (c *Client) Metadata() bson.M {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.metadata
+}
+
+// SetMetadata records the "client" document from the driver's handshake.
+func (c *Client) SetMetadata(metadata bson.M) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.metadata = metadata
+}
+
+// AppName returns the application name from the handshake metadata, if any.
+func (c *Client) AppName() string {
+	application := convert.ToBSONMap(c.Metadata()["application"])
+	return convert.ToString(application["name"])
+}
+
+// AddRequest increments the number of requests seen on this connection.
+func (c *Client) AddRequest() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.requests++
+}
+
+// Requests returns the number of requests seen on this connection.
+func (c *Client) Requests() int64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.requests
+}
+
+// Close marks the connection as closed. It is safe to call more than once.
+func (c *Client) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+}
+
+// Done returns a channel that is closed once the connection has closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// ClientOf returns the Client that the request arrived on, or nil if the
+// request was not created by proxy core.
+func ClientOf(r Requester) *Client {
+	switch req := r.(type) {
+	case Command:
+		return req.Client
+	case *Command:
+		return req.Client
+	case *Message:
+		return req.Client
+	case Message:
+		return req.Client
+	}
+	return nil
+}
@@ -81,13 +81,12 @@ func createCommand(header MsgHeader, commandName string, database string, args b
 func processHeader(reader io.Reader) (MsgHeader, error) {
 	// read the message header
 	msgHeaderBytes := make([]byte, MSG_HEADER_LENGTH)
-	n, err := reader.Read(msgHeaderBytes)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(reader, msgHeaderBytes)
+	if n == 0 && err == io.EOF {
+		Log(INFO, "connection closed")
 		return MsgHeader{}, err
 	}
-	if n == 0 {
-		// EOF?
-		Log(INFO, "connection closed")
+	if err != nil {
 		return MsgHeader{}, err
 	}
 	mHeader := MsgHeader{}
@@ -148,21 +147,13 @@ func decodeUint32(buffer []byte) (uint32, error) {
 func processOpMsg(msgBody []byte, header MsgHeader) (Requester, error) {
 	flags, err := decodeUint32(msgBody)
 	if err != nil {
-		return nil, err
+		return nil, decodeError("op_msg_flags", err)
 	}
 
-	// exhaustAllowed gets used in service discovery. It may or may
-	// not be something we need to support.
-	if (flags & OP_MSG_FLAG_EXHAUST_ALLOWED) != 0 {
-		Log(WARNING, "exhaustAllowed flag given; discarding …")
-		flags = flags ^ OP_MSG_FLAG_EXHAUST_ALLOWED
-	}
-
-	// moreToCome from a client indicates a fire-and-forget request.
-	// For now we’ll withhold support for that.
-	if (flags & OP_MSG_FLAG_MORE_TO_COME) != 0 {
-		return nil, fmt.Errorf("moreToCome flag given but is forbidden")
-	}
+	// exhaustAllowed and moreToCome are kept in FlagBits: a module may
+	// answer an exhaustAllowed request with a stream of replies, and
+	// moreToCome from a client marks a fire-and-forget request, which
+	// gets no reply.
 
 	msgBodyLen := uint32(len(msgBody))
 	cursor := uint32(4)  // sizeof uint32
@@ -180,8 +171,7 @@ func processOpMsg(msgBody []byte, header MsgHeader) (Requester, error) {
 	for cursor < msgBodyLen {
 		if (msgBodyLen - cursor == 4) {
 			if (flags & OP_MSG_FLAG_CHECKSUM_PRESENT) != 0 {
-				// TODO: Verify checksum
-				Log(DEBUG, "Checksum present; skipping verification (unimplemented)")
+				// the checksum was verified along with the header
 				break
 			}
 		}
@@ -192,19 +182,19 @@ func processOpMsg(msgBody []byte, header MsgHeader) (Requester, error) {
 		switch sectionType {
 			case 0:
 				if (foundType0) {
-					return nil, fmt.Errorf(">1 body section")
+					return nil, decodeError("op_msg_duplicate_body", fmt.Errorf(">1 body section"))
 				}
 
 				foundType0 = true
 
 				doc, bsonLen, err := decodeBSON(msgBody[cursor:])
 				if err != nil {
-					return nil, err
+					return nil, decodeError("op_msg_body_bson", err)
 				}
 
 				for _, DocElem := range doc {
 					if !seenNames.Add(DocElem.Name) {
-						return nil, fmt.Errorf("Duplicate identifier: %s", DocElem.Name)
+						return nil, decodeError("op_msg_duplicate_identifier", fmt.Errorf("Duplicate identifier: %s", DocElem.Name))
 					}
 				}
 
@@ -213,24 +203,24 @@ func processOpMsg(msgBody []byte, header MsgHeader) (Requester, error) {
 				cursor += bsonLen
 
 			case 1:
-				sectionLen, err := decodeUint32(msgBody)
+				sectionLen, err := decodeUint32(msgBody[cursor:])
 				if err != nil {
-					return nil, err
+					return nil, decodeError("op_msg_section_size", err)
 				}
 
 				if sectionLen > msgBodyLen - cursor {
-					return nil, fmt.Errorf("Section claims too much size (%d; only %d left)", sectionLen, msgBodyLen - cursor)
+					return nil, decodeError("op_msg_section_size", fmt.Errorf("Section claims too much size (%d; only %d left)", sectionLen, msgBodyLen - cursor))
 				}
 
 				sectionCursor := 4 + cursor
 
 				identifier, err := decodeCString(msgBody[sectionCursor:])
 				if err != nil {
-					return nil, err
+					return nil, decodeError("op_msg_section_identifier", err)
 				}
 
 				if !seenNames.Add(identifier) {
-					return nil, fmt.Errorf("Duplicate section identifier: %s", identifier)
+					return nil, decodeError("op_msg_duplicate_identifier", fmt.Errorf("Duplicate section identifier: %s", identifier))
 				}
 
 				// “Pre-advance” the cursor.
@@ -243,7 +233,7 @@ func processOpMsg(msgBody []byte, header MsgHeader) (Requester, error) {
 				for sectionCursor < cursor {
 					doc, bsonLen, err := decodeBSON(msgBody[sectionCursor:])
 					if err != nil {
-						return nil, err
+						return nil, decodeError("op_msg_section_bson", err)
 					}
 
 					docs = append(docs, doc)
@@ -253,12 +243,12 @@ func processOpMsg(msgBody []byte, header MsgHeader) (Requester, error) {
 				msg.Auxiliary[identifier] = docs
 
 			default:
-				return nil, fmt.Errorf("Unknown section type: %d", sectionType)
+				return nil, decodeError("op_msg_section_type", fmt.Errorf("Unknown section type: %d", sectionType))
 		}
 	}
 
 	if !foundType0 {
-		return nil, fmt.Errorf("OP_MSG lacks a body section")
+		return nil, decodeError("op_msg_missing_body", fmt.Errorf("OP_MSG lacks a body section"))
 	}
 
 	return &msg, nil
@@ -272,11 +262,11 @@ func processOpQuery(msgBody []byte, header MsgHeader) (Requester, error) {
 	database, collection, err := ParseNamespace(namespace)
 
 	if err != nil {
-		return nil, fmt.Errorf("error parsing namespace: %v", err)
+		return nil, decodeError("op_query_namespace", fmt.Errorf("error parsing namespace: %v", err))
 	}
 
 	if collection != opQueryCollection {
-		return nil, fmt.Errorf("OP_QUERY is only for the “%s” collection, not “%s”", opQueryCollection, collection)
+		return nil, decodeError("op_query_collection", fmt.Errorf("OP_QUERY is only for the “%s” collection, not “%s”", opQueryCollection, collection))
 	}
 
 	// 4 bytes for flags
@@ -289,12 +279,12 @@ func processOpQuery(msgBody []byte, header MsgHeader) (Requester, error) {
 	document := bson.D{}
 	err = bson.Unmarshal(bsonBytes, &document)
 	if err != nil {
-		return nil, err
+		return nil, decodeError("op_query_bson", err)
 	}
 
 	cName, args := splitCommandOpQuery(document)
 	if !opQueryCommandAllowed(cName) {
-		return nil, fmt.Errorf("OP_QUERY forbids the “%s” command (only allows: %v)", cName, allowedOpQueryCommands)
+		return nil, decodeError("op_query_command", fmt.Errorf("OP_QUERY forbids the “%s” command (only allows: %v)", cName, allowedOpQueryCommands))
 	}
 
 	return createCommand(header, cName, database, args), nil
@@ -306,45 +296,50 @@ var opCodeDecoder = map[OpCode]opCodeDecoderT {
 	OP_MSG: processOpMsg,
 }
 
-func slurpMessageBody(ioReader io.Reader, header MsgHeader) ([]byte, error) {
-	bodyLength := header.MessageLength - int32(MSG_HEADER_LENGTH)
-	msgBody := make([]byte, bodyLength)
-
-	_, err := ioReader.Read(msgBody)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read %d-byte message: %v", bodyLength, err)
-	}
-
-	return msgBody, nil
-}
-
 // Decodes a wire protocol message from a connection into a Requester to pass
 // onto modules, a struct containing the header of the original message, and an error.
 // It returns a non-nil error if reading from the connection
 // fails in any way
 func Decode(reader io.Reader) (Requester, MsgHeader, error) {
-	mHeader, err := processHeader(reader)
-
-	var req Requester;
-	var decoderFunc opCodeDecoderT
-
-	if err == nil {
-		decoderFunc = opCodeDecoder[mHeader.OpCode]
-
-		if decoderFunc == nil {
-			err = fmt.Errorf("unimplemented operation: %#v", mHeader)
-		}
+	frame, mHeader, err := ReadFrame(reader)
+	if err != nil {
+		return nil, mHeader, err
 	}
 
-	var msgBody []byte
+	decoderFunc := opCodeDecoder[mHeader.OpCode]
+	if decoderFunc == nil {
+		return nil, mHeader, decodeError("opcode", fmt.Errorf("unimplemented operation: %#v", mHeader))
+	}
 
-	if err == nil {
-		msgBody, err = slurpMessageBody(reader, mHeader)
+	if mHeader.OpCode == OP_MSG && !checksumOK(frame) {
+		return nil, mHeader, decodeError("op_msg_checksum", fmt.Errorf("OP_MSG checksum is wrong"))
 	}
 
-	if err == nil {
-		req, err = decoderFunc(msgBody, mHeader)
+	req, err := decoderFunc(frame[MSG_HEADER_LENGTH:], mHeader)
+	if msg, ok := req.(*Message); ok {
+		msg.Raw = frame
 	}
 
 	return req, mHeader, err
 }
+
+// DecodeMessage decodes an OP_MSG frame, such as one read with ReadFrame.
+func DecodeMessage(frame []byte) (*Message, error) {
+	if len(frame) < minOpMsgLength {
+		return nil, opMsgTooShort(len(frame))
+	}
+	mHeader := FrameHeader(frame)
+	if mHeader.OpCode != OP_MSG {
+		return nil, fmt.Errorf("Expected OP_MSG (%d), not opcode %d", OP_MSG, mHeader.OpCode)
+	}
+	if !checksumOK(frame) {
+		return nil, decodeError("op_msg_checksum", fmt.Errorf("OP_MSG checksum is wrong"))
+	}
+	req, err := processOpMsg(frame[MSG_HEADER_LENGTH:], mHeader)
+	if err != nil {
+		return nil, err
+	}
+	msg := req.(*Message)
+	msg.Raw = frame
+	return msg, nil
+}
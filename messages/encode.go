@@ -92,7 +92,8 @@ func EncodeBSON(reqHeader MsgHeader, b bson.M) ([]byte, error) {
 	return resp, nil
 }
 
-// Encodes a response into a byte slice that represents an OP_REPLY wire protocol message.
+// Encodes a response into a byte slice that represents a wire protocol
+// message: an OP_MSG for OP_MSG requests, and an OP_REPLY otherwise.
 func Encode(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
 
 	Log(DEBUG, "Response: %#v", res)
@@ -102,7 +103,14 @@ func Encode(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
 
 	// error checking
 	if hasError {
-		// reply with an error instead of the actual documents
+		// reply with an error instead of the actual documents, in the
+		// same protocol as the request, since OP_MSG clients do not
+		// accept OP_REPLY
+		if reqHeader.OpCode == OP_MSG {
+			body := ErrorBody(res.CommandError.ErrorCode, res.CommandError.Message)
+			return Message{Body: body}.ToBytes(reqHeader)
+		}
+
 		r := bson.M{}
 		r["ok"] = 0
 		r["errmsg"] = res.CommandError.Message
@@ -112,9 +120,14 @@ func Encode(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
 	}
 
 	if res.Writer == nil {
+		encodeErrors.Inc()
 		return nil, fmt.Errorf("No response was returned.")
 	}
 
-	return res.Writer.ToBytes(reqHeader)
+	out, err := res.Writer.ToBytes(reqHeader)
+	if err != nil {
+		encodeErrors.Inc()
+	}
+	return out, err
 
 }
@@ -0,0 +1,179 @@
+package messages
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Error codes that modules commonly reply with. The names match the
+// codeName field of MongoDB error replies.
+const (
+	InternalError                   int32 = 1
+	BadValue                        int32 = 2
+	HostUnreachable                 int32 = 6
+	HostNotFound                    int32 = 7
+	UnknownError                    int32 = 8
+	FailedToParse                   int32 = 9
+	Unauthorized                    int32 = 13
+	TypeMismatch                    int32 = 14
+	AuthenticationFailed            int32 = 18
+	IllegalOperation                int32 = 20
+	LockTimeout                     int32 = 24
+	NamespaceNotFound               int32 = 26
+	IndexNotFound                   int32 = 27
+	PathNotViable                   int32 = 28
+	ConflictingUpdateOperators      int32 = 40
+	CursorNotFound                  int32 = 43
+	NamespaceExists                 int32 = 48
+	MaxTimeMSExpired                int32 = 50
+	NotSingleValueField             int32 = 54
+	CommandNotFound                 int32 = 59
+	ImmutableField                  int32 = 66
+	CannotCreateIndex               int32 = 67
+	InvalidOptions                  int32 = 72
+	InvalidNamespace                int32 = 73
+	IndexOptionsConflict            int32 = 85
+	IndexKeySpecsConflict           int32 = 86
+	NetworkTimeout                  int32 = 89
+	ShutdownInProgress              int32 = 91
+	OperationFailed                 int32 = 96
+	WriteConflict                   int32 = 112
+	DocumentValidationFailure       int32 = 121
+	CommandFailed                   int32 = 125
+	FailedToSatisfyReadPreference   int32 = 133
+	ExceededMemoryLimit             int32 = 146
+	CannotIndexParallelArrays       int32 = 171
+	PrimarySteppedDown              int32 = 189
+	InvalidIndexSpecificationOption int32 = 197
+	TimeProofMismatch               int32 = 207
+	ClusterTimeFailsRateLimiter     int32 = 209
+	KeyNotFound                     int32 = 211
+	ConversionFailure               int32 = 241
+	ExceededTimeLimit               int32 = 262
+	CursorInUse                     int32 = 292
+	SocketException                 int32 = 9001
+	NotWritablePrimary              int32 = 10107
+	DuplicateKey                    int32 = 11000
+	InterruptedAtShutdown           int32 = 11600
+	Interrupted                     int32 = 11601
+	InterruptedDueToReplChange      int32 = 11602
+	NotPrimaryNoSecondaryOk         int32 = 13435
+	NotPrimaryOrSecondary           int32 = 13436
+)
+
+// codeNames are the names of the error codes above.
+var codeNames = map[int32]string{
+	InternalError:                   "InternalError",
+	BadValue:                        "BadValue",
+	HostUnreachable:                 "HostUnreachable",
+	HostNotFound:                    "HostNotFound",
+	UnknownError:                    "UnknownError",
+	FailedToParse:                   "FailedToParse",
+	Unauthorized:                    "Unauthorized",
+	TypeMismatch:                    "TypeMismatch",
+	AuthenticationFailed:            "AuthenticationFailed",
+	IllegalOperation:                "IllegalOperation",
+	LockTimeout:                     "LockTimeout",
+	NamespaceNotFound:               "NamespaceNotFound",
+	IndexNotFound:                   "IndexNotFound",
+	PathNotViable:                   "PathNotViable",
+	ConflictingUpdateOperators:      "ConflictingUpdateOperators",
+	CursorNotFound:                  "CursorNotFound",
+	NamespaceExists:                 "NamespaceExists",
+	MaxTimeMSExpired:                "MaxTimeMSExpired",
+	NotSingleValueField:             "NotSingleValueField",
+	CommandNotFound:                 "CommandNotFound",
+	ImmutableField:                  "ImmutableField",
+	CannotCreateIndex:               "CannotCreateIndex",
+	InvalidOptions:                  "InvalidOptions",
+	InvalidNamespace:                "InvalidNamespace",
+	IndexOptionsConflict:            "IndexOptionsConflict",
+	IndexKeySpecsConflict:           "IndexKeySpecsConflict",
+	NetworkTimeout:                  "NetworkTimeout",
+	ShutdownInProgress:              "ShutdownInProgress",
+	OperationFailed:                 "OperationFailed",
+	WriteConflict:                   "WriteConflict",
+	DocumentValidationFailure:       "DocumentValidationFailure",
+	CommandFailed:                   "CommandFailed",
+	FailedToSatisfyReadPreference:   "FailedToSatisfyReadPreference",
+	ExceededMemoryLimit:             "ExceededMemoryLimit",
+	CannotIndexParallelArrays:       "CannotIndexParallelArrays",
+	PrimarySteppedDown:              "PrimarySteppedDown",
+	InvalidIndexSpecificationOption: "InvalidIndexSpecificationOption",
+	TimeProofMismatch:               "TimeProofMismatch",
+	ClusterTimeFailsRateLimiter:     "ClusterTimeFailsRateLimiter",
+	KeyNotFound:                     "KeyNotFound",
+	ConversionFailure:               "ConversionFailure",
+	ExceededTimeLimit:               "ExceededTimeLimit",
+	CursorInUse:                     "CursorInUse",
+	SocketException:                 "SocketException",
+	NotWritablePrimary:              "NotWritablePrimary",
+	DuplicateKey:                    "DuplicateKey",
+	InterruptedAtShutdown:           "InterruptedAtShutdown",
+	Interrupted:                     "Interrupted",
+	InterruptedDueToReplChange:      "InterruptedDueToReplStateChange",
+	NotPrimaryNoSecondaryOk:         "NotPrimaryNoSecondaryOk",
+	NotPrimaryOrSecondary:           "NotPrimaryOrSecondary",
+}
+
+// codesByName is the reverse of codeNames.
+var codesByName = make(map[string]int32)
+
+func init() {
+	for code, name := range codeNames {
+		codesByName[name] = code
+	}
+}
+
+// retryableCodes are the error codes that drivers retry reads and
+// retryable writes on, per the retryable reads and writes specifications.
+var retryableCodes = map[int32]bool{
+	HostUnreachable:            true,
+	HostNotFound:               true,
+	NetworkTimeout:             true,
+	ShutdownInProgress:         true,
+	PrimarySteppedDown:         true,
+	ExceededTimeLimit:          true,
+	SocketException:            true,
+	NotWritablePrimary:         true,
+	InterruptedAtShutdown:      true,
+	InterruptedDueToReplChange: true,
+	NotPrimaryNoSecondaryOk:    true,
+	NotPrimaryOrSecondary:      true,
+}
+
+// RetryableWriteLabel is the error label that tells drivers a retryable
+// write may be retried.
+const RetryableWriteLabel = "RetryableWriteError"
+
+// ErrorCodeName returns the codeName of an error code, or "" if the code
+// is not known.
+func ErrorCodeName(code int32) string {
+	return codeNames[code]
+}
+
+// ErrorCodeByName returns the error code with the given codeName, and
+// whether it is known.
+func ErrorCodeByName(name string) (int32, bool) {
+	code, ok := codesByName[name]
+	return code, ok
+}
+
+// IsRetryableCode returns whether drivers retry operations that fail with
+// the given error code.
+func IsRetryableCode(code int32) bool {
+	return retryableCodes[code]
+}
+
+// ErrorBody returns the body of an error reply with the given code and
+// message, and the code's name if it is known.
+func ErrorBody(code int32, errmsg string) bson.D {
+	body := bson.D{
+		{Name: "ok", Value: 0},
+		{Name: "errmsg", Value: errmsg},
+		{Name: "code", Value: code},
+	}
+	if name := ErrorCodeName(code); len(name) > 0 {
+		body = append(body, bson.DocElem{Name: "codeName", Value: name})
+	}
+	return body
+}
@@ -0,0 +1,173 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MaxMessageSizeBytes is the largest wire protocol message accepted, as
+// for mongod.
+const MaxMessageSizeBytes = 48000000
+
+// minOpMsgLength is the length of the shortest OP_MSG there can be: a
+// header, the flag bits and the kind byte of a section.
+const minOpMsgLength = int(MSG_HEADER_LENGTH) + 4 + 1
+
+// castagnoli is the CRC-32C table for OP_MSG checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ReadFrame reads a whole wire protocol message from reader, header
+// included, and returns it with its parsed header.
+func ReadFrame(reader io.Reader) ([]byte, MsgHeader, error) {
+	mHeader, err := processHeader(reader)
+	if err != nil {
+		return nil, mHeader, err
+	}
+	if mHeader.MessageLength > MaxMessageSizeBytes {
+		return nil, mHeader, decodeError("size", fmt.Errorf("Message length %d exceeds the maximum of %d", mHeader.MessageLength, MaxMessageSizeBytes))
+	}
+	if mHeader.OpCode == OP_MSG && int(mHeader.MessageLength) < minOpMsgLength {
+		return nil, mHeader, opMsgTooShort(int(mHeader.MessageLength))
+	}
+
+	frame := make([]byte, mHeader.MessageLength)
+	putHeader(frame, mHeader)
+	_, err = io.ReadFull(reader, frame[MSG_HEADER_LENGTH:])
+	if err != nil {
+		return nil, mHeader, decodeError("read", fmt.Errorf("Failed to read %d-byte message: %w", mHeader.MessageLength, err))
+	}
+	return frame, mHeader, nil
+}
+
+func opMsgTooShort(length int) error {
+	return decodeError("op_msg_length", fmt.Errorf("OP_MSG length %d is too short for its flag bits and a section", length))
+}
+
+func putHeader(frame []byte, h MsgHeader) {
+	binary.LittleEndian.PutUint32(frame[0:], uint32(h.MessageLength))
+	binary.LittleEndian.PutUint32(frame[4:], uint32(h.RequestID))
+	binary.LittleEndian.PutUint32(frame[8:], uint32(h.ResponseTo))
+	binary.LittleEndian.PutUint32(frame[12:], uint32(h.OpCode))
+}
+
+// FrameHeader parses the header of a frame read with ReadFrame.
+func FrameHeader(frame []byte) MsgHeader {
+	return MsgHeader{
+		MessageLength: int32(binary.LittleEndian.Uint32(frame[0:])),
+		RequestID:     RequestID(binary.LittleEndian.Uint32(frame[4:])),
+		ResponseTo:    RequestID(binary.LittleEndian.Uint32(frame[8:])),
+		OpCode:        OpCode(binary.LittleEndian.Uint32(frame[12:])),
+	}
+}
+
+// FrameFlags returns the flag bits of an OP_MSG frame, or 0 if it is too
+// short to have any.
+func FrameFlags(frame []byte) uint32 {
+	if len(frame) < int(MSG_HEADER_LENGTH)+4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(frame[MSG_HEADER_LENGTH:])
+}
+
+// RewriteIDs returns a copy of an OP_MSG frame with the requestID and
+// responseTo in its header replaced, and its checksum, if any, updated.
+func RewriteIDs(frame []byte, requestID, responseTo RequestID) []byte {
+	out := append([]byte{}, frame...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(out[8:], uint32(responseTo))
+	updateChecksum(out)
+	return out
+}
+
+// RewriteFlags returns a copy of an OP_MSG frame with its flag bits
+// replaced, and its checksum, if any, updated. The checksumPresent bit is
+// kept as it was, since it describes the frame's layout.
+func RewriteFlags(frame []byte, flags uint32) []byte {
+	out := append([]byte{}, frame...)
+	checksum := FrameFlags(frame) & OP_MSG_FLAG_CHECKSUM_PRESENT
+	flags = (flags &^ OP_MSG_FLAG_CHECKSUM_PRESENT) | checksum
+	binary.LittleEndian.PutUint32(out[MSG_HEADER_LENGTH:], flags)
+	updateChecksum(out)
+	return out
+}
+
+// updateChecksum recomputes the CRC-32C at the end of an OP_MSG frame that
+// has one.
+func updateChecksum(frame []byte) {
+	if FrameHeader(frame).OpCode != OP_MSG || FrameFlags(frame)&OP_MSG_FLAG_CHECKSUM_PRESENT == 0 {
+		return
+	}
+	end := len(frame) - 4
+	binary.LittleEndian.PutUint32(frame[end:], crc32.Checksum(frame[:end], castagnoli))
+}
+
+// checksumOK returns whether an OP_MSG frame's checksum, if it has one, is
+// right.
+func checksumOK(frame []byte) bool {
+	if FrameFlags(frame)&OP_MSG_FLAG_CHECKSUM_PRESENT == 0 {
+		return true
+	}
+	end := len(frame) - 4
+	if end < int(MSG_HEADER_LENGTH)+4 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(frame[end:]) == crc32.Checksum(frame[:end], castagnoli)
+}
+
+// Encode returns the message as an OP_MSG frame with the given requestID
+// and responseTo, and its own flag bits, less checksumPresent. Document
+// sequences are written in order of their identifiers.
+func (m Message) Encode(requestID, responseTo RequestID) ([]byte, error) {
+	return m.encode(requestID, responseTo, m.FlagBits&^OP_MSG_FLAG_CHECKSUM_PRESENT)
+}
+
+func (m Message) encode(requestID, responseTo RequestID, flags uint32) ([]byte, error) {
+	body, err := bson.Marshal(m.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal OP_MSG body document: %v", err)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, MSG_HEADER_LENGTH, 64+len(body)))
+	binary.Write(buf, binary.LittleEndian, flags)
+	buf.WriteByte(0) // first section is type 0
+	buf.Write(body)
+
+	identifiers := make([]string, 0, len(m.Auxiliary))
+	for identifier := range m.Auxiliary {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+
+	for _, identifier := range identifiers {
+		section := bytes.NewBuffer(make([]byte, 4))
+		section.WriteString(identifier)
+		section.WriteByte(0)
+		for _, doc := range m.Auxiliary[identifier] {
+			docBytes, err := bson.Marshal(doc)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to marshal “%s” document in OP_MSG: %v", identifier, err)
+			}
+			section.Write(docBytes)
+		}
+
+		sectionBytes := section.Bytes()
+		binary.LittleEndian.PutUint32(sectionBytes, uint32(len(sectionBytes)))
+		buf.WriteByte(1) // type 1 section
+		buf.Write(sectionBytes)
+	}
+
+	frame := buf.Bytes()
+	putHeader(frame, MsgHeader{
+		MessageLength: int32(len(frame)),
+		RequestID:     requestID,
+		ResponseTo:    responseTo,
+		OpCode:        OP_MSG,
+	})
+	return frame, nil
+}
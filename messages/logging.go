@@ -0,0 +1,26 @@
+package messages
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/log"
+)
+
+// LogFields returns the request-scoped log fields for a request: the
+// connection and request IDs, the command name and the namespace.
+func LogFields(r Requester) log.Fields {
+	fields := log.Fields{}
+	if client := ClientOf(r); client != nil {
+		fields.ConnectionID = client.ID
+	}
+
+	switch req := r.(type) {
+	case Command:
+		fields.RequestID = int32(req.RequestID)
+		fields.Command = req.CommandName
+		fields.Namespace = req.Database
+	case *Message:
+		fields.RequestID = int32(req.RequestID)
+		fields.Command = req.CommandName()
+		fields.Namespace = req.Namespace()
+	}
+	return fields
+}
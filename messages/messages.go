@@ -3,11 +3,8 @@
 package messages
 
 import (
-	"fmt"
-	"bytes"
-
 	. "github.com/mongodbinc-interns/mongoproxy/log"
-	"github.com/mongodbinc-interns/mongoproxy/buffer"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -48,6 +45,8 @@ type Command struct {
 	Args        bson.M
 	Metadata    bson.M
 	Docs        []bson.D
+	Client      *Client `bson:"-"`
+	Trace       *Trace  `bson:"-"`
 }
 
 func (c Command) Type() string {
@@ -97,54 +96,69 @@ type Message struct {
 	// proxy modules need it, now or in the future.
 	Body 		bson.D   `bson:"main"` //  TODO: remove
 	Auxiliary   MessageAuxiliary
+
+	Client      *Client  `bson:"-"`
+	Trace       *Trace   `bson:"-"`
+
+	// Raw is the message as it was read from the wire, header included,
+	// so that it can be passed on verbatim. Modules that change a message
+	// must set Raw to nil.
+	Raw         []byte   `bson:"-"`
 }
 
 func (_ Message) Type() string {
 	return MessageType
 }
 
-func (m Message) ToBytes(header MsgHeader) ([]byte, error) {
-	resHeader := createResponseHeader(header, OP_MSG)
-
-	mainBson, err := bson.Marshal(m.Body)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal OP_MSG body document: %v", err)
+// CommandName returns the name of the command in the message, which is
+// always the first field of the body section.
+func (m Message) CommandName() string {
+	if len(m.Body) == 0 {
+		return ""
 	}
+	return m.Body[0].Name
+}
 
-	buf := bytes.NewBuffer([]byte{})
-
-	err = buffer.WriteToBuf(
-		buf,
-		resHeader, // size will be filled in later
-		uint32(0), // no flags
-		uint8(0),  // first section is type 0
-		mainBson,
-	)
+// Database returns the database the command runs against, as given in the
+// body's "$db" field.
+func (m Message) Database() string {
+	db, _ := bsonutil.FindValueByKey("$db", m.Body).(string)
+	return db
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("Failed to initialize OP_MSG: %v", err)
+// Collection returns the collection that the command targets, for commands
+// whose first field names a collection (find, insert, and so on), or an
+// empty string otherwise.
+func (m Message) Collection() string {
+	if len(m.Body) == 0 {
+		return ""
 	}
+	collection, _ := m.Body[0].Value.(string)
+	return collection
+}
 
-	for identifier, bsonDocs := range m.Auxiliary {
-		err := buffer.WriteToBuf(
-			buf,
-			uint32(1),            // type 1 section
-			identifier, uint8(0), // NUL-terminated string
-		)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to initialize “%s” in OP_MSG: %v", identifier, err)
-		}
+// Namespace returns the "database.collection" namespace the command targets,
+// or just the database for commands that do not target a collection.
+func (m Message) Namespace() string {
+	collection := m.Collection()
+	if len(collection) == 0 {
+		return m.Database()
+	}
+	return m.Database() + "." + collection
+}
 
-		for _, bsonDoc := range bsonDocs {
-			err := buffer.WriteToBuf( buf, bsonDoc )
-			if err != nil {
-				return nil, fmt.Errorf("Failed to extend “%s” in OP_MSG: %v", identifier, err)
-			}
-		}
+// ToBytes encodes the message as a reply to the request with the given
+// header. A message with Raw set is sent as it is, apart from its header;
+// others are sent without flags.
+func (m Message) ToBytes(header MsgHeader) ([]byte, error) {
+	if m.Raw != nil {
+		return RewriteIDs(m.Raw, 0, header.RequestID), nil
 	}
 
-	respBytes := buf.Bytes()
-	respBytes = setMessageSize(respBytes)
+	respBytes, err := m.encode(0, header.RequestID, 0)
+	if err != nil {
+		return nil, err
+	}
 
 	Log(DEBUG, "response length: %d", len(respBytes))
 
@@ -152,5 +166,5 @@ func (m Message) ToBytes(header MsgHeader) ([]byte, error) {
 }
 
 func (m Message) ToBSON() bson.M {
-	panic("unimplemented")
+	return m.Body.Map()
 }
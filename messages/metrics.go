@@ -0,0 +1,22 @@
+package messages
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+)
+
+var decodeErrors = metrics.NewCounterVec("mongoproxy_decode_errors_total",
+	"Client messages that could not be decoded, by reason.", "reason")
+
+var encodeErrors = metrics.NewCounter("mongoproxy_encode_errors_total",
+	"Responses that could not be encoded.")
+
+func init() {
+	metrics.MustRegister(decodeErrors, encodeErrors)
+}
+
+// decodeError counts a decoding failure under the given reason, and
+// returns err for convenience.
+func decodeError(reason string, err error) error {
+	decodeErrors.With(reason).Inc()
+	return err
+}
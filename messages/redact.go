@@ -0,0 +1,60 @@
+package messages
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/redact"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The Redacted methods implement go-logging's Redactor interface, so that
+// requests and responses passed to the logger are logged with sensitive
+// values masked.
+
+// Redacted returns a copy of the command with sensitive values masked.
+func (c Command) Redacted() interface{} {
+	c.Args = redact.Args(c.CommandName, c.Args)
+	c.Metadata = redact.Value(c.Metadata).(bson.M)
+	docs := make([]bson.D, len(c.Docs))
+	for i, doc := range c.Docs {
+		docs[i] = redact.Document(doc)
+	}
+	c.Docs = docs
+	return c
+}
+
+// Redacted returns a copy of the message with sensitive values masked.
+func (m Message) Redacted() interface{} {
+	m.Body = redact.Document(m.Body)
+	auxiliary := MessageAuxiliary{}
+	for identifier, docs := range m.Auxiliary {
+		auxiliary[identifier] = redact.Section(identifier, docs)
+	}
+	m.Auxiliary = auxiliary
+
+	// the raw bytes hold the same values, unmasked
+	m.Raw = nil
+	return m
+}
+
+// Redacted returns a copy of the response with sensitive values masked.
+func (c CommandResponse) Redacted() interface{} {
+	c.Reply = redact.Value(c.Reply).(bson.M)
+	docs := make([]bson.D, len(c.Documents))
+	for i, doc := range c.Documents {
+		docs[i] = redact.Document(doc)
+	}
+	c.Documents = docs
+	return c
+}
+
+// Redacted returns a copy of the module response with sensitive values in
+// its writer masked.
+func (r ModuleResponse) Redacted() interface{} {
+	if redactor, ok := r.Writer.(interface {
+		Redacted() interface{}
+	}); ok {
+		if writer, ok := redactor.Redacted().(ResponseWriter); ok {
+			r.Writer = writer
+		}
+	}
+	return r
+}
@@ -24,6 +24,9 @@ type Responder interface {
 type ModuleResponse struct {
 	CommandError *ResponderError
 	Writer       ResponseWriter
+
+	// Stream, if set, has the replies that follow Writer.
+	Stream ReplyStream
 }
 
 func (r *ModuleResponse) Type() string {
@@ -37,3 +40,48 @@ func (r *ModuleResponse) Write(writer ResponseWriter) {
 func (r *ModuleResponse) Error(code int32, message string) {
 	r.CommandError = &ResponderError{code, message}
 }
+
+// A ReplyStream delivers the replies that follow a reply with the
+// moreToCome flag set, such as to an exhaust getMore.
+type ReplyStream interface {
+	// Next blocks until the next reply arrives, and returns it. The
+	// stream ends with the first reply without moreToCome set.
+	Next() (ResponseWriter, error)
+
+	// Close abandons the stream, such as when the client has gone.
+	Close()
+}
+
+// A StreamResponder is a Responder that can send a stream of replies,
+// for requests with the exhaustAllowed flag set. Modules must not stream
+// to Responders that are not StreamResponders.
+type StreamResponder interface {
+	Responder
+
+	// WriteStream takes the first reply, which has moreToCome set, and
+	// the stream of those that follow.
+	WriteStream(ResponseWriter, ReplyStream)
+}
+
+func (r *ModuleResponse) WriteStream(first ResponseWriter, rest ReplyStream) {
+	r.Writer = first
+	r.Stream = rest
+}
+
+// Forward gives the response of the next module to the Responder of the
+// module before, streaming it if the Responder can stream.
+func Forward(res Responder, inner ModuleResponse) {
+	switch {
+	case inner.CommandError != nil:
+		res.Error(inner.CommandError.ErrorCode, inner.CommandError.Message)
+	case inner.Stream != nil:
+		if streamer, ok := res.(StreamResponder); ok {
+			streamer.WriteStream(inner.Writer, inner.Stream)
+		} else {
+			inner.Stream.Close()
+			res.Write(inner.Writer)
+		}
+	case inner.Writer != nil:
+		res.Write(inner.Writer)
+	}
+}
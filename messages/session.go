@@ -0,0 +1,62 @@
+package messages
+
+import (
+	"fmt"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SessionInfo is what a request says about the logical session it runs
+// in, and the transaction, if any.
+type SessionInfo struct {
+	// ID identifies the session: its lsid's id, in hex if it is a UUID.
+	ID string
+
+	// TxnNumber numbers the session's transactions and retryable writes.
+	TxnNumber int64
+
+	// InTransaction is set for the statements of a multi-statement
+	// transaction, which drivers send with autocommit false, and
+	// StartTransaction for the first of them.
+	InTransaction    bool
+	StartTransaction bool
+}
+
+// SessionOf returns the session a request runs in, and false if it runs
+// in none.
+func SessionOf(req Requester) (SessionInfo, bool) {
+	msg, ok := req.(*Message)
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return BodySession(msg.Body)
+}
+
+// BodySession returns the session of an OP_MSG body, and false if it
+// names none.
+func BodySession(body bson.D) (SessionInfo, bool) {
+	lsid := convert.ToBSONMap(bsonutil.FindValueByKey("lsid", body))
+	if lsid == nil {
+		return SessionInfo{}, false
+	}
+
+	info := SessionInfo{ID: SessionID(lsid["id"])}
+	info.TxnNumber = convert.ToInt64(bsonutil.FindValueByKey("txnNumber", body))
+	autocommit := bsonutil.FindValueByKey("autocommit", body)
+	info.InTransaction = autocommit != nil && !convert.ToBool(autocommit) &&
+		bsonutil.FindValueByKey("txnNumber", body) != nil
+	info.StartTransaction = info.InTransaction &&
+		convert.ToBool(bsonutil.FindValueByKey("startTransaction", body))
+	return info, true
+}
+
+// SessionID returns the ID of a session as a string, given the id field
+// of its lsid, or of an endSessions entry.
+func SessionID(id interface{}) string {
+	if binary, ok := id.(bson.Binary); ok {
+		return fmt.Sprintf("%x", binary.Data)
+	}
+	return fmt.Sprint(id)
+}
@@ -0,0 +1,64 @@
+package messages
+
+import (
+	"sync"
+	"time"
+)
+
+// A Trace records how long each module in the pipeline spent on a request,
+// excluding time spent in the modules after it. Proxy core attaches one to
+// every request it decodes.
+type Trace struct {
+	mutex   sync.Mutex
+	modules []ModuleTime
+}
+
+// ModuleTime is the time one module spent on a request.
+type ModuleTime struct {
+	Module   string
+	Alias    string
+	Duration time.Duration
+}
+
+// NewTrace creates an empty Trace.
+func NewTrace() *Trace {
+	return &Trace{}
+}
+
+// AddModule records the time a module spent on the request. It does
+// nothing on a nil Trace.
+func (t *Trace) AddModule(module string, alias string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.modules = append(t.modules, ModuleTime{module, alias, d})
+}
+
+// Modules returns the module times recorded so far, in the order the
+// modules finished.
+func (t *Trace) Modules() []ModuleTime {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]ModuleTime(nil), t.modules...)
+}
+
+// TraceOf returns the Trace attached to the request, or nil if the request
+// was not created by proxy core.
+func TraceOf(r Requester) *Trace {
+	switch req := r.(type) {
+	case Command:
+		return req.Trace
+	case *Command:
+		return req.Trace
+	case *Message:
+		return req.Trace
+	case Message:
+		return req.Trace
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var connectionsAccepted = metrics.NewCounter("mongoproxy_connections_accepted_total",
+	"Client connections accepted.")
+
+var connectionsOpen = metrics.NewGauge("mongoproxy_connections_open",
+	"Client connections currently open.")
+
+var messagesReceived = metrics.NewCounterVec("mongoproxy_messages_total",
+	"Wire protocol messages received from clients, by opcode.", "opcode")
+
+var commandsReceived = metrics.NewCounterVec("mongoproxy_commands_total",
+	"Commands received from clients, by command name and database.", "command", "database")
+
+var responseBytes = metrics.NewHistogram("mongoproxy_response_size_bytes",
+	"Size of responses sent to clients.", metrics.SizeBuckets)
+
+func init() {
+	metrics.MustRegister(connectionsAccepted, connectionsOpen, messagesReceived,
+		commandsReceived, responseBytes)
+}
+
+// opCodeNames are the label values for known opcodes; others are labeled
+// by number.
+var opCodeNames = map[messages.OpCode]string{
+	messages.OP_QUERY: "OP_QUERY",
+	messages.OP_REPLY: "OP_REPLY",
+	messages.OP_MSG:   "OP_MSG",
+}
+
+func opCodeName(opCode messages.OpCode) string {
+	name, ok := opCodeNames[opCode]
+	if !ok {
+		return strconv.Itoa(int(opCode))
+	}
+	return name
+}
+
+// knownCommands are the command names that label commands; others, which
+// clients could make up without end, are labeled "other".
+var knownCommands = map[string]bool{}
+
+func init() {
+	for _, name := range []string{
+		"abortTransaction", "aggregate", "authenticate", "buildInfo", "buildinfo",
+		"collMod", "collStats", "commitTransaction", "connectionStatus", "count",
+		"create", "createIndexes", "createUser", "currentOp", "dbStats",
+		"delete", "distinct", "drop", "dropDatabase", "dropIndexes",
+		"dropUser", "endSessions", "explain", "find", "findAndModify",
+		"findandmodify", "getCmdLineOpts", "getLastError", "getLog", "getMore",
+		"getParameter", "hello", "hostInfo", "insert", "isMaster",
+		"ismaster", "killCursors", "killOp", "killSessions", "listCollections",
+		"listDatabases", "listIndexes", "logout", "ping", "refreshSessions",
+		"renameCollection", "replSetGetStatus", "saslContinue", "saslStart", "serverStatus",
+		"startSession", "update", "usersInfo", "validate", "whatsmyuri",
+	} {
+		knownCommands[name] = true
+	}
+}
+
+// commandLabel returns the label of a command name.
+func commandLabel(name string) string {
+	if knownCommands[name] {
+		return name
+	}
+	return "other"
+}
+
+// defaultDatabases label commands whatever the configuration.
+var defaultDatabases = []string{"admin", "config", "local"}
+
+var databasesMutex sync.RWMutex
+
+// knownDatabases are the database names that label commands; others are
+// labeled "other", as with command names.
+var knownDatabases = databaseSet(nil)
+
+func databaseSet(names []string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range append(append([]string{}, defaultDatabases...), names...) {
+		set[name] = true
+	}
+	return set
+}
+
+// databaseLabel returns the label of a database name.
+func databaseLabel(name string) string {
+	databasesMutex.RLock()
+	defer databasesMutex.RUnlock()
+	if knownDatabases[name] {
+		return name
+	}
+	return "other"
+}
+
+// parseMetricsConfig reads the databases to label commands with from the
+// “metrics” configuration object, whose “databases” field is optional.
+func parseMetricsConfig(conf bson.M) ([]string, error) {
+	raw, ok := conf["databases"]
+	if !ok {
+		return nil, nil
+	}
+	databases, err := convert.ConvertToStringSlice(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metrics databases: %v", err)
+	}
+	return databases, nil
+}
+
+// configureMetrics replaces the databases that label commands.
+func configureMetrics(databases []string) {
+	databasesMutex.Lock()
+	defer databasesMutex.Unlock()
+	knownDatabases = databaseSet(databases)
+}
+
+// countRequest updates the message and command counters for a decoded request.
+func countRequest(header messages.MsgHeader, req messages.Requester) {
+	messagesReceived.With(opCodeName(header.OpCode)).Inc()
+
+	switch r := req.(type) {
+	case messages.Command:
+		commandsReceived.With(commandLabel(r.CommandName), databaseLabel(r.Database)).Inc()
+	case *messages.Message:
+		commandsReceived.With(commandLabel(r.CommandName()), databaseLabel(r.Database())).Inc()
+	}
+}
@@ -0,0 +1,183 @@
+// Package metrics contains counters, gauges and histograms that proxy core
+// and modules update as they handle requests, and an HTTP handler that
+// exposes them in the Prometheus text format.
+//
+// Modules add their own metrics by creating them with the New functions and
+// registering them, usually in the module's init function:
+//
+//	var backendErrors = metrics.NewCounterVec("mongoproxy_example_errors_total",
+//		"Errors talking to the example backend.", "reason")
+//
+//	func init() {
+//		metrics.MustRegister(backendErrors)
+//	}
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Collector is a metric that can be registered and written out.
+type Collector interface {
+	// Describe returns the metric's name, help text and type.
+	Describe() (name string, help string, metricType string)
+
+	// Samples returns the metric's current samples.
+	Samples() []Sample
+}
+
+// A Sample is a single value of a metric, identified by its labels. Suffix
+// is appended to the metric name, for the series of a histogram.
+type Sample struct {
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+// A Label is a name and value pair attached to a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// A Registry is a set of collectors with unique names.
+type Registry struct {
+	mutex      sync.RWMutex
+	collectors map[string]Collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+// DefaultRegistry is the registry used by the package-level functions, and
+// holds the metrics of proxy core and all modules.
+var DefaultRegistry = NewRegistry()
+
+// Register adds a collector to the registry. It returns an error if a
+// collector with the same name is already registered.
+func (r *Registry) Register(c Collector) error {
+	name, _, _ := c.Describe()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.collectors[name]; exists {
+		return fmt.Errorf("Metric %v is already registered", name)
+	}
+	r.collectors[name] = c
+	return nil
+}
+
+// MustRegister adds collectors to the registry, and panics if any of them
+// cannot be registered.
+func (r *Registry) MustRegister(collectors ...Collector) {
+	for _, c := range collectors {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register adds a collector to the default registry.
+func Register(c Collector) error {
+	return DefaultRegistry.Register(c)
+}
+
+// MustRegister adds collectors to the default registry, and panics if any
+// of them cannot be registered.
+func MustRegister(collectors ...Collector) {
+	DefaultRegistry.MustRegister(collectors...)
+}
+
+// WriteText writes all metrics in the registry to w in the Prometheus text
+// exposition format, sorted by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]Collector, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.mutex.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		name, help, metricType := c.Describe()
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, metricType)
+		for _, s := range c.Samples() {
+			buf.WriteString(name)
+			buf.WriteString(s.Suffix)
+			writeLabels(buf, s.Labels)
+			buf.WriteByte(' ')
+			buf.WriteString(formatValue(s.Value))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Flush()
+}
+
+// Handler returns an HTTP handler that serves the default registry.
+func Handler() http.Handler {
+	return HandlerFor(DefaultRegistry)
+}
+
+// HandlerFor returns an HTTP handler that serves the given registry.
+func HandlerFor(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+func writeLabels(buf *bufio.Writer, labels []Label) {
+	if len(labels) == 0 {
+		return
+	}
+	buf.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(l.Name)
+		buf.WriteString(`="`)
+		buf.WriteString(escapeLabelValue(l.Value))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	Convey("Write metrics in the Prometheus text format", t, func() {
+		r := NewRegistry()
+
+		Convey("for a counter vector", func() {
+			c := NewCounterVec("test_commands_total", "Commands seen.", "command", "database")
+			r.MustRegister(c)
+			c.With("find", "shop").Inc()
+			c.With("find", "shop").Inc()
+			c.With("insert", `we"ird`).Add(3)
+
+			var buf bytes.Buffer
+			So(r.WriteText(&buf), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `# HELP test_commands_total Commands seen.
+# TYPE test_commands_total counter
+test_commands_total{command="find",database="shop"} 2
+test_commands_total{command="insert",database="we\"ird"} 3
+`)
+		})
+
+		Convey("for a gauge", func() {
+			g := NewGauge("test_open", "Open things.")
+			r.MustRegister(g)
+			g.Inc()
+			g.Inc()
+			g.Dec()
+
+			var buf bytes.Buffer
+			So(r.WriteText(&buf), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 1
+`)
+		})
+
+		Convey("for a histogram", func() {
+			h := NewHistogram("test_seconds", "Time taken.", []float64{1, 5})
+			r.MustRegister(h)
+			h.Observe(0.5)
+			h.Observe(2)
+			h.Observe(10)
+
+			var buf bytes.Buffer
+			So(r.WriteText(&buf), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `# HELP test_seconds Time taken.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 12.5
+test_seconds_count 3
+`)
+		})
+
+		Convey("sorted by name", func() {
+			r.MustRegister(NewCounter("b_total", "B."), NewCounter("a_total", "A."))
+
+			var buf bytes.Buffer
+			So(r.WriteText(&buf), ShouldBeNil)
+			So(buf.String(), ShouldStartWith, "# HELP a_total")
+		})
+
+		Convey("refusing duplicate names", func() {
+			So(r.Register(NewCounter("dup_total", "Dup.")), ShouldBeNil)
+			So(r.Register(NewGauge("dup_total", "Dup.")), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,368 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are histogram buckets suited to request latencies in seconds.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// SizeBuckets are histogram buckets suited to message sizes in bytes.
+var SizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+// a desc holds what every metric has: a name, help text and label names.
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+// a vec holds one child metric per combination of label values.
+type vec struct {
+	desc
+	mutex    sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func newVec(name string, help string, labelNames []string) vec {
+	return vec{
+		desc:     desc{name, help, labelNames},
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+	}
+}
+
+// child returns the child metric for the label values, creating it with
+// create if it does not exist yet.
+func (v *vec) child(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("Metric %v takes %v label values, not %v",
+			v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mutex.RLock()
+	c, ok := v.children[key]
+	v.mutex.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = create()
+		v.children[key] = c
+		v.values[key] = append([]string(nil), labelValues...)
+	}
+	return c
+}
+
+// each calls fn for every child, in order of their label values.
+func (v *vec) each(fn func(labels []Label, child interface{})) {
+	v.mutex.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]interface{}, len(keys))
+	labels := make([][]Label, len(keys))
+	for i, key := range keys {
+		children[i] = v.children[key]
+		labels[i] = make([]Label, len(v.labelNames))
+		for j, name := range v.labelNames {
+			labels[i][j] = Label{name, v.values[key][j]}
+		}
+	}
+	v.mutex.RUnlock()
+
+	for i := range keys {
+		fn(labels[i], children[i])
+	}
+}
+
+// ----------------------------------------------------------------------
+
+// A Counter is a value that only goes up.
+type Counter struct {
+	desc
+	mutex sync.Mutex
+	value float64
+}
+
+// NewCounter creates an unregistered counter.
+func NewCounter(name string, help string) *Counter {
+	return &Counter{desc: desc{name: name, help: help}}
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds a non-negative amount to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.mutex.Lock()
+	c.value += v
+	c.mutex.Unlock()
+}
+
+// Value returns the counter's current value.
+func (c *Counter) Value() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.value
+}
+
+func (c *Counter) Describe() (string, string, string) {
+	return c.name, c.help, "counter"
+}
+
+func (c *Counter) Samples() []Sample {
+	return []Sample{{Value: c.Value()}}
+}
+
+// A CounterVec is a set of counters that differ by their label values.
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec creates an unregistered set of counters with the given labels.
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, labelNames)}
+}
+
+// With returns the counter for the given label values, in the order the
+// label names were given.
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.child(labelValues, func() interface{} {
+		return &Counter{}
+	}).(*Counter)
+}
+
+func (c *CounterVec) Describe() (string, string, string) {
+	return c.name, c.help, "counter"
+}
+
+func (c *CounterVec) Samples() []Sample {
+	var samples []Sample
+	c.each(func(labels []Label, child interface{}) {
+		samples = append(samples, Sample{Labels: labels, Value: child.(*Counter).Value()})
+	})
+	return samples
+}
+
+// ----------------------------------------------------------------------
+
+// A Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	mutex sync.Mutex
+	value float64
+}
+
+// NewGauge creates an unregistered gauge.
+func NewGauge(name string, help string) *Gauge {
+	return &Gauge{desc: desc{name: name, help: help}}
+}
+
+// Set sets the gauge to a value.
+func (g *Gauge) Set(v float64) {
+	g.mutex.Lock()
+	g.value = v
+	g.mutex.Unlock()
+}
+
+// Add adds an amount, which may be negative, to the gauge.
+func (g *Gauge) Add(v float64) {
+	g.mutex.Lock()
+	g.value += v
+	g.mutex.Unlock()
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value returns the gauge's current value.
+func (g *Gauge) Value() float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.value
+}
+
+func (g *Gauge) Describe() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *Gauge) Samples() []Sample {
+	return []Sample{{Value: g.Value()}}
+}
+
+// A GaugeVec is a set of gauges that differ by their label values.
+type GaugeVec struct {
+	vec
+}
+
+// NewGaugeVec creates an unregistered set of gauges with the given labels.
+func NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, labelNames)}
+}
+
+// With returns the gauge for the given label values, in the order the
+// label names were given.
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.child(labelValues, func() interface{} {
+		return &Gauge{}
+	}).(*Gauge)
+}
+
+func (g *GaugeVec) Describe() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *GaugeVec) Samples() []Sample {
+	var samples []Sample
+	g.each(func(labels []Label, child interface{}) {
+		samples = append(samples, Sample{Labels: labels, Value: child.(*Gauge).Value()})
+	})
+	return samples
+}
+
+// ----------------------------------------------------------------------
+
+// A Histogram counts observed values in buckets, and keeps their sum.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mutex  sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates an unregistered histogram with the given bucket
+// upper bounds. If buckets is nil, DefaultBuckets is used.
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	h.desc = desc{name: name, help: help}
+	return h
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe adds a value to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveDuration adds a duration to the histogram, in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Count returns the number of observed values.
+func (h *Histogram) Count() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+func (h *Histogram) samples(labels []Label) []Sample {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	samples := make([]Sample, 0, len(h.buckets)+3)
+	for i, bound := range h.buckets {
+		samples = append(samples, Sample{
+			Suffix: "_bucket",
+			Labels: withLabel(labels, "le", formatValue(bound)),
+			Value:  float64(h.counts[i]),
+		})
+	}
+	samples = append(samples,
+		Sample{Suffix: "_bucket", Labels: withLabel(labels, "le", formatValue(math.Inf(1))), Value: float64(h.count)},
+		Sample{Suffix: "_sum", Labels: labels, Value: h.sum},
+		Sample{Suffix: "_count", Labels: labels, Value: float64(h.count)},
+	)
+	return samples
+}
+
+func withLabel(labels []Label, name string, value string) []Label {
+	out := make([]Label, len(labels), len(labels)+1)
+	copy(out, labels)
+	return append(out, Label{name, value})
+}
+
+func (h *Histogram) Describe() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+func (h *Histogram) Samples() []Sample {
+	return h.samples(nil)
+}
+
+// A HistogramVec is a set of histograms that differ by their label values.
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// NewHistogramVec creates an unregistered set of histograms with the given
+// bucket upper bounds and labels. If buckets is nil, DefaultBuckets is used.
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{newVec(name, help, labelNames), buckets}
+}
+
+// With returns the histogram for the given label values, in the order the
+// label names were given.
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.child(labelValues, func() interface{} {
+		return newHistogram(h.buckets)
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) Describe() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+func (h *HistogramVec) Samples() []Sample {
+	var samples []Sample
+	h.each(func(labels []Label, child interface{}) {
+		samples = append(samples, child.(*Histogram).samples(labels)...)
+	})
+	return samples
+}
@@ -0,0 +1,236 @@
+// Package clustertime contains a module that gossips the proxy's cluster
+// time with clients, for causally consistent sessions, on behalf of the
+// backends after it, which need not know of cluster times.
+package clustertime
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/clustertime"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var logger = GetLogger("clustertime")
+
+// DefaultAfterClusterTimeWait is how long reads wait for the cluster time
+// to reach their afterClusterTime, unless their maxTimeMS is shorter.
+const DefaultAfterClusterTimeWait = 10 * time.Second
+
+// writeCommands are the commands whose replies get a new operationTime.
+// The rest get the current cluster time.
+var writeCommands = map[string]bool{
+	"insert":            true,
+	"update":            true,
+	"delete":            true,
+	"findAndModify":     true,
+	"findandmodify":     true,
+	"bulkWrite":         true,
+	"create":            true,
+	"createIndexes":     true,
+	"collMod":           true,
+	"drop":              true,
+	"dropDatabase":      true,
+	"dropIndexes":       true,
+	"renameCollection":  true,
+	"commitTransaction": true,
+	"abortTransaction":  true,
+}
+
+// The ClusterTime module adds $clusterTime and operationTime to replies,
+// and takes them from clients and backends.
+type ClusterTime struct {
+	clock  *clustertime.Clock
+	signer clustertime.Signer
+	wait   time.Duration
+}
+
+func init() {
+	server.Publish(&ClusterTime{})
+}
+
+func (_ *ClusterTime) New() server.Module {
+	return &ClusterTime{}
+}
+
+func (_ *ClusterTime) Name() string {
+	return "clustertime"
+}
+
+func (c *ClusterTime) Configure(conf bson.M) error {
+	c.clock = clustertime.Default
+
+	c.signer = clustertime.Signer{}
+	// named so that the admin API redacts it
+	if value, ok := conf["secret"]; ok {
+		secret, ok := value.(string)
+		if !ok || len(secret) == 0 {
+			return fmt.Errorf("“secret” must be a non-empty string")
+		}
+		c.signer.Key = []byte(secret)
+		c.signer.KeyID = 1
+	}
+	if value, ok := conf["keyId"]; ok {
+		if c.signer.Key == nil {
+			return fmt.Errorf("“keyId” needs a “secret”")
+		}
+		c.signer.KeyID = convert.ToInt64(value, -1)
+		if c.signer.KeyID < 0 {
+			return fmt.Errorf("“keyId” must be a non-negative integer, not %v", value)
+		}
+	}
+
+	c.wait = DefaultAfterClusterTimeWait
+	if value, ok := conf["afterClusterTimeWaitSecs"]; ok {
+		secs := convert.ToFloat64(value, -1)
+		if secs < 0 {
+			return fmt.Errorf("“afterClusterTimeWaitSecs” must be a non-negative number, not %v", value)
+		}
+		c.wait = time.Duration(secs * float64(time.Second))
+	}
+	return nil
+}
+
+func (c *ClusterTime) Process(req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	msg, err := messages.ToMessageRequest(req)
+	if err != nil {
+		next(req, res)
+		return
+	}
+
+	if ts, doc, ok := clustertime.Gossip(msg.Body); ok {
+		// only times that would move the clock need checking, as servers do
+		if ts > c.clock.Time() {
+			if err := c.signer.Verify(doc); err != nil {
+				logger.LogWith(INFO, messages.LogFields(msg), "rejecting $clusterTime: %v", err)
+				res.Error(signatureErrorCode(err), err.Error())
+				return
+			}
+			if _, err := c.clock.Advance(ts); err != nil {
+				logger.LogWith(INFO, messages.LogFields(msg), "rejecting $clusterTime: %v", err)
+				res.Error(messages.ClusterTimeFailsRateLimiter, err.Error())
+				return
+			}
+		}
+	}
+	if bsonutil.FindValueByKey("$clusterTime", msg.Body) != nil {
+		// backends could not check the proxy's signatures
+		msg = without(msg, "$clusterTime")
+	}
+
+	if after, ok := clustertime.AfterClusterTime(msg.Body); ok {
+		if code, err := c.waitFor(msg, after); err != nil {
+			logger.LogWith(INFO, messages.LogFields(msg), "%v", err)
+			res.Error(code, err.Error())
+			return
+		}
+	}
+
+	inner := messages.ModuleResponse{}
+	next(msg, &inner)
+
+	if e := inner.CommandError; e != nil {
+		// error replies carry the cluster time too
+		res.Write(c.stamp(msg, messages.Message{Body: messages.ErrorBody(e.ErrorCode, e.Message)}))
+		return
+	}
+	reply, ok := inner.Writer.(messages.Message)
+	if !ok || inner.Stream != nil {
+		messages.Forward(res, inner)
+		return
+	}
+	res.Write(c.stamp(msg, reply))
+}
+
+// waitFor waits until the cluster time reaches a read's afterClusterTime,
+// for up to the module's wait, or the read's maxTimeMS, returning the
+// error code to fail with if it does not.
+func (c *ClusterTime) waitFor(msg *messages.Message, after clustertime.Timestamp) (int32, error) {
+	if c.clock.Time() >= after {
+		return 0, nil
+	}
+	wait, code := c.wait, messages.ExceededTimeLimit
+	if maxTimeMS := convert.ToInt64(bsonutil.FindValueByKey("maxTimeMS", msg.Body)); maxTimeMS > 0 {
+		if d := time.Duration(maxTimeMS) * time.Millisecond; d <= wait {
+			wait, code = d, messages.MaxTimeMSExpired
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	if err := c.clock.WaitFor(ctx, after); err != nil {
+		return code, fmt.Errorf("Cluster time did not reach afterClusterTime within %v", wait)
+	}
+	return 0, nil
+}
+
+// stamp returns a reply with the proxy's $clusterTime and an
+// operationTime, taking the backend's into the clock.
+func (c *ClusterTime) stamp(msg *messages.Message, reply messages.Message) messages.Message {
+	if ts, _, ok := clustertime.Gossip(reply.Body); ok {
+		c.advance(msg, ts)
+	}
+
+	operationTime, ok := clustertime.OperationTime(reply.Body)
+	switch {
+	case ok:
+		c.advance(msg, operationTime)
+	case writeCommands[msg.CommandName()] && convert.ToFloat64(reply.ToBSON()["ok"]) == 1:
+		var err error
+		if operationTime, err = c.clock.Tick(); err != nil {
+			// the write is done, so it gets the current time
+			logger.LogWith(WARNING, messages.LogFields(msg), "cannot tick the cluster time: %v", err)
+			operationTime = c.clock.Time()
+		}
+	default:
+		operationTime = c.clock.Time()
+	}
+
+	body := bson.D{}
+	for _, elem := range reply.Body {
+		if elem.Name != "$clusterTime" && elem.Name != "operationTime" {
+			body = append(body, elem)
+		}
+	}
+	body = append(body,
+		bson.DocElem{Name: "$clusterTime", Value: c.signer.Sign(c.clock.Time())},
+		bson.DocElem{Name: "operationTime", Value: operationTime},
+	)
+	return messages.Message{Body: body, FlagBits: reply.FlagBits, Auxiliary: reply.Auxiliary}
+}
+
+// advance moves the clock to a backend's time, which is left out if it is
+// too far ahead.
+func (c *ClusterTime) advance(msg *messages.Message, ts clustertime.Timestamp) {
+	if _, err := c.clock.Advance(ts); err != nil {
+		logger.LogWith(WARNING, messages.LogFields(msg), "ignoring the backend's cluster time: %v", err)
+	}
+}
+
+func signatureErrorCode(err error) int32 {
+	if err == clustertime.ErrKeyNotFound {
+		return messages.KeyNotFound
+	}
+	return messages.TimeProofMismatch
+}
+
+// without returns a copy of a request without a field.
+func without(msg *messages.Message, name string) *messages.Message {
+	copied := *msg
+	copied.Body = bson.D{}
+	for _, elem := range msg.Body {
+		if elem.Name != name {
+			copied.Body = append(copied.Body, elem)
+		}
+	}
+	copied.Raw = nil
+	return &copied
+}
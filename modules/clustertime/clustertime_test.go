@@ -0,0 +1,165 @@
+package clustertime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/clustertime"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func message(body ...bson.DocElem) *messages.Message {
+	return &messages.Message{
+		Body: append(bson.D(body), bson.DocElem{Name: "$db", Value: "shop"}),
+		Raw:  []byte{1},
+	}
+}
+
+// run passes a request through the module to a backend that answers
+// with reply, and returns the reply the module gave, and the request the
+// backend saw, if any.
+func run(c *ClusterTime, req *messages.Message, reply bson.D) (messages.ModuleResponse, *messages.Message) {
+	res := messages.ModuleResponse{}
+	var passed *messages.Message
+	c.Process(req, &res, func(req messages.Requester, res messages.Responder) {
+		passed = req.(*messages.Message)
+		res.Write(messages.Message{Body: reply})
+	})
+	return res, passed
+}
+
+var ok = bson.D{{Name: "ok", Value: 1.0}}
+
+func TestClusterTime(t *testing.T) {
+	Convey("Gossip the cluster time", t, func() {
+		c := &ClusterTime{}
+		So(c.Configure(bson.M{"secret": "correct horse", "afterClusterTimeWaitSecs": 0.05}), ShouldBeNil)
+		c.clock = clustertime.NewClock()
+		start, err := c.clock.Tick()
+		So(err, ShouldBeNil)
+
+		Convey("adding it to replies, with operation times", func() {
+			res, _ := run(c, message(bson.DocElem{Name: "find", Value: "orders"}), ok)
+			reply := res.Writer.ToBSON()
+			So(reply["operationTime"], ShouldEqual, start)
+			gossip := reply["$clusterTime"].(bson.D).Map()
+			So(c.signer.Verify(gossip), ShouldBeNil)
+
+			res, _ = run(c, message(bson.DocElem{Name: "insert", Value: "orders"}), ok)
+			written := res.Writer.ToBSON()["operationTime"].(clustertime.Timestamp)
+			So(written, ShouldBeGreaterThan, start)
+			So(c.clock.Time(), ShouldEqual, written)
+		})
+
+		Convey("adding it to errors from the backend", func() {
+			res := messages.ModuleResponse{}
+			c.Process(message(bson.DocElem{Name: "insert", Value: "orders"}), &res, func(req messages.Requester, res messages.Responder) {
+				res.Error(messages.NotWritablePrimary, "not primary")
+			})
+			So(res.CommandError, ShouldBeNil)
+			reply := res.Writer.ToBSON()
+			So(reply["ok"], ShouldEqual, 0)
+			So(reply["code"], ShouldEqual, messages.NotWritablePrimary)
+			So(reply["errmsg"], ShouldEqual, "not primary")
+			So(reply["operationTime"], ShouldEqual, start)
+			So(c.signer.Verify(reply["$clusterTime"].(bson.D).Map()), ShouldBeNil)
+			So(c.clock.Time(), ShouldEqual, start)
+		})
+
+		Convey("taking backends' times", func() {
+			later := start + 100
+			res, _ := run(c, message(bson.DocElem{Name: "insert", Value: "orders"}), bson.D{
+				{Name: "ok", Value: 1.0},
+				{Name: "operationTime", Value: later},
+			})
+			So(res.Writer.ToBSON()["operationTime"], ShouldEqual, later)
+			So(c.clock.Time(), ShouldEqual, later)
+		})
+
+		Convey("taking clients' signed times, and passing them on stripped", func() {
+			later := start + 5
+			gossip := c.signer.Sign(later)
+			req := message(bson.DocElem{Name: "find", Value: "orders"}, bson.DocElem{Name: "$clusterTime", Value: gossip})
+			res, passed := run(c, req, ok)
+			So(res.CommandError, ShouldBeNil)
+			So(c.clock.Time(), ShouldEqual, later)
+			So(passed.Body.Map()["$clusterTime"], ShouldBeNil)
+			So(passed.Raw, ShouldBeNil)
+			So(req.Body.Map()["$clusterTime"], ShouldNotBeNil)
+		})
+
+		Convey("rejecting times too far ahead of the wall clock", func() {
+			ahead := clustertime.NewTimestamp(uint32(time.Now().Add(clustertime.MaxDrift+time.Hour).Unix()), 1)
+			res, passed := run(c, message(bson.DocElem{Name: "find", Value: "orders"}, bson.DocElem{Name: "$clusterTime", Value: c.signer.Sign(ahead)}), ok)
+			So(passed, ShouldBeNil)
+			So(res.CommandError.ErrorCode, ShouldEqual, messages.ClusterTimeFailsRateLimiter)
+			So(c.clock.Time(), ShouldEqual, start)
+
+			// and backends' too
+			res, _ = run(c, message(bson.DocElem{Name: "find", Value: "orders"}), bson.D{
+				{Name: "ok", Value: 1.0},
+				{Name: "operationTime", Value: ahead},
+			})
+			So(res.CommandError, ShouldBeNil)
+			So(c.clock.Time(), ShouldEqual, start)
+		})
+
+		Convey("rejecting forged times", func() {
+			forged := clustertime.Signer{KeyID: 1, Key: []byte("guess")}.Sign(start + 1000)
+			res, passed := run(c, message(bson.DocElem{Name: "find", Value: "orders"}, bson.DocElem{Name: "$clusterTime", Value: forged}), ok)
+			So(passed, ShouldBeNil)
+			So(res.CommandError.ErrorCode, ShouldEqual, messages.TimeProofMismatch)
+			So(c.clock.Time(), ShouldEqual, start)
+
+			// or unsigned ones, unless they are already past
+			res, _ = run(c, message(bson.DocElem{Name: "find", Value: "orders"}, bson.DocElem{Name: "$clusterTime", Value: forged[:1]}), ok)
+			So(res.CommandError.ErrorCode, ShouldEqual, messages.KeyNotFound)
+			res, _ = run(c, message(bson.DocElem{Name: "find", Value: "orders"}, bson.DocElem{Name: "$clusterTime", Value: bson.D{{Name: "clusterTime", Value: start}}}), ok)
+			So(res.CommandError, ShouldBeNil)
+		})
+
+		Convey("waiting for afterClusterTime", func() {
+			after := start + 1
+			read := message(
+				bson.DocElem{Name: "find", Value: "orders"},
+				bson.DocElem{Name: "readConcern", Value: bson.D{{Name: "afterClusterTime", Value: after}}},
+			)
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				c.clock.Advance(after)
+			}()
+			res, passed := run(c, read, ok)
+			So(res.CommandError, ShouldBeNil)
+			So(passed, ShouldNotBeNil)
+
+			res, passed = run(c, message(
+				bson.DocElem{Name: "find", Value: "orders"},
+				bson.DocElem{Name: "readConcern", Value: bson.D{{Name: "afterClusterTime", Value: after + 1}}},
+			), ok)
+			So(passed, ShouldBeNil)
+			So(res.CommandError.ErrorCode, ShouldEqual, messages.ExceededTimeLimit)
+
+			res, _ = run(c, message(
+				bson.DocElem{Name: "find", Value: "orders"},
+				bson.DocElem{Name: "readConcern", Value: bson.D{{Name: "afterClusterTime", Value: after + 1}}},
+				bson.DocElem{Name: "maxTimeMS", Value: 5},
+			), ok)
+			So(res.CommandError.ErrorCode, ShouldEqual, messages.MaxTimeMSExpired)
+		})
+	})
+
+	Convey("Reject bad configurations", t, func() {
+		bad := []bson.M{
+			{"secret": ""},
+			{"secret": 7},
+			{"keyId": 2},
+			{"secret": "correct horse", "keyId": -1},
+			{"afterClusterTimeWaitSecs": -1},
+		}
+		for _, conf := range bad {
+			So((&ClusterTime{}).Configure(conf), ShouldNotBeNil)
+		}
+	})
+}
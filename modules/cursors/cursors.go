@@ -0,0 +1,408 @@
+// Package cursors contains a module that keeps cursors for the backends
+// after it that have none. It splits the full results they return into
+// batches, and serves getMore and killCursors for them itself.
+package cursors
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	core "github.com/mongodbinc-interns/mongoproxy/cursors"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var logger = GetLogger("cursors")
+
+// DefaultBatchSize is the size of first batches that clients do not give a
+// batchSize for, as with MongoDB.
+const DefaultBatchSize = 101
+
+// DefaultIdleTimeout is how long cursors may go unused before they are
+// closed, as with MongoDB.
+const DefaultIdleTimeout = 10 * time.Minute
+
+// maxReplyBytes bounds the replies that batches go out in, as the
+// largest document size does.
+const maxReplyBytes = 16 * 1024 * 1024
+
+// replyAllowance is room left in replies for fields that modules before
+// this one add, such as $clusterTime.
+const replyAllowance = 16 * 1024
+
+// batchBytes returns how many bytes of documents fit in the batch of a
+// reply, given the reply with an empty batch.
+func batchBytes(reply bson.D) int {
+	raw, err := bson.Marshal(reply)
+	if err != nil {
+		return maxReplyBytes - replyAllowance
+	}
+	return maxReplyBytes - replyAllowance - len(raw)
+}
+
+// cursorCommands are the commands whose replies open cursors.
+var cursorCommands = map[string]bool{
+	"find":            true,
+	"aggregate":       true,
+	"listCollections": true,
+	"listIndexes":     true,
+}
+
+// The Cursors module turns full results from the modules after it into
+// cursors.
+type Cursors struct {
+	batchSize   int
+	idleTimeout time.Duration
+	maxCursors  int
+	registry    *core.Registry
+}
+
+func init() {
+	server.Publish(&Cursors{})
+}
+
+func (_ *Cursors) New() server.Module {
+	return &Cursors{}
+}
+
+func (_ *Cursors) Name() string {
+	return "cursors"
+}
+
+func (c *Cursors) Configure(conf bson.M) error {
+	c.registry = core.Default
+
+	c.batchSize = DefaultBatchSize
+	if value, ok := conf["batchSize"]; ok {
+		c.batchSize = convert.ToInt(value, -1)
+		if c.batchSize <= 0 {
+			return fmt.Errorf("“batchSize” must be a positive integer, not %v", value)
+		}
+	}
+
+	c.idleTimeout = DefaultIdleTimeout
+	if value, ok := conf["idleTimeoutSecs"]; ok {
+		secs := convert.ToFloat64(value, -1)
+		if secs < 0 {
+			return fmt.Errorf("“idleTimeoutSecs” must be a non-negative number, not %v", value)
+		}
+		c.idleTimeout = time.Duration(secs * float64(time.Second))
+	}
+
+	c.maxCursors = 0
+	if value, ok := conf["maxCursors"]; ok {
+		c.maxCursors = convert.ToInt(value, -1)
+		if c.maxCursors < 0 {
+			return fmt.Errorf("“maxCursors” must be a non-negative integer, not %v", value)
+		}
+	}
+	return nil
+}
+
+func (c *Cursors) Process(req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	msg, err := messages.ToMessageRequest(req)
+	if err != nil {
+		next(req, res)
+		return
+	}
+
+	switch name := msg.CommandName(); {
+	case name == "getMore":
+		id := convert.ToInt64(msg.Body[0].Value)
+		if !c.getMore(id, msg, res) {
+			next(req, res)
+		}
+	case name == "killCursors":
+		c.killCursors(msg, res, next)
+	case cursorCommands[name]:
+		c.open(msg, res, next)
+	default:
+		next(req, res)
+	}
+}
+
+// open passes on a command that opens a cursor, and, if the reply has more
+// than a batch of documents and no cursor of its own, keeps the rest for
+// getMore.
+func (c *Cursors) open(msg *messages.Message, res messages.Responder,
+	next server.PipelineFunc) {
+
+	inner := messages.ModuleResponse{}
+	next(msg, &inner)
+
+	reply, ok := inner.Writer.(messages.Message)
+	if inner.CommandError != nil || !ok {
+		messages.Forward(res, inner)
+		return
+	}
+
+	// streams that the client asked for are its to read
+	if inner.Stream != nil && msg.FlagBits&messages.OP_MSG_FLAG_EXHAUST_ALLOWED != 0 {
+		messages.Forward(res, inner)
+		return
+	}
+
+	cursor := convert.ToBSONMap(bsonutil.FindValueByKey("cursor", reply.Body))
+	if cursor == nil || convert.ToInt64(cursor["id"]) != 0 {
+		messages.Forward(res, inner)
+		return
+	}
+
+	batchSize, singleBatch := c.batchSizeOf(msg.Body)
+	docs := core.Batch(reply.ToBSON())
+	if inner.Stream == nil && len(docs) <= batchSize {
+		res.Write(reply)
+		return
+	}
+
+	namespace := convert.ToString(cursor["ns"])
+	if len(namespace) == 0 {
+		namespace = msg.Namespace()
+	}
+	cur := core.New(namespace, docs, inner.Stream)
+	// a batchSize of 0 asks for a cursor and no documents yet
+	first := []interface{}{}
+	var err error
+	if batchSize > 0 {
+		first, err = cur.Next(batchSize, batchBytes(firstBatchReply(reply.Body, first, 0, namespace)))
+		if err != nil {
+			cur.Close()
+			logger.LogWith(WARNING, messages.LogFields(msg), "reading the first batch failed: %v", err)
+			res.Error(messages.HostUnreachable, err.Error())
+			return
+		}
+	}
+
+	var id int64
+	if singleBatch || cur.Exhausted() {
+		cur.Close()
+	} else {
+		cur.Session = sessionOf(msg.Body)
+		cur.User = userOf(msg)
+		cur.Timeout = c.idleTimeout
+		if convert.ToBool(bsonutil.FindValueByKey("noCursorTimeout", msg.Body)) {
+			cur.Timeout = 0
+		}
+
+		id, err = c.registry.Register(cur, c.maxCursors)
+		if err != nil {
+			cur.Close()
+			logger.LogWith(WARNING, messages.LogFields(msg), "not opening a cursor: %v", err)
+			res.Error(messages.OperationFailed, err.Error())
+			return
+		}
+		logger.LogWith(DEBUG, messages.LogFields(msg), "opened cursor %d on %s", id, namespace)
+	}
+
+	res.Write(messages.Message{Body: firstBatchReply(reply.Body, first, id, namespace)})
+}
+
+// firstBatchReply returns the reply with the first batch of a cursor, in
+// place of the next module's reply with all of its documents.
+func firstBatchReply(body bson.D, batch []interface{}, id int64, namespace string) bson.D {
+	return withCursor(body, bson.D{
+		{Name: "firstBatch", Value: batch},
+		{Name: "id", Value: id},
+		{Name: "ns", Value: namespace},
+	})
+}
+
+// getMore serves a getMore for a cursor the module keeps, returning false
+// for cursors it does not know of, which are the next module's.
+func (c *Cursors) getMore(id int64, msg *messages.Message, res messages.Responder) bool {
+	cur, err := c.registry.Checkout(id)
+	if err == core.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		res.Error(messages.CursorInUse, fmt.Sprintf("Cursor %d is in use", id))
+		return true
+	}
+	defer c.registry.Return(cur)
+
+	namespace := msg.Database() + "." + convert.ToString(bsonutil.FindValueByKey("collection", msg.Body))
+	if err := checkOwner(cur, namespace, msg); err != nil {
+		logger.LogWith(INFO, messages.LogFields(msg), "refusing getMore on cursor %d: %v", id, err)
+		res.Error(messages.Unauthorized, err.Error())
+		return true
+	}
+
+	batchSize := convert.ToInt(bsonutil.FindValueByKey("batchSize", msg.Body))
+	batch, err := cur.Next(batchSize, batchBytes(nextBatchReply([]interface{}{}, id, cur.Namespace)))
+	if err != nil {
+		c.registry.Kill(id)
+		logger.LogWith(WARNING, messages.LogFields(msg), "reading cursor %d failed: %v", id, err)
+		res.Error(messages.HostUnreachable, err.Error())
+		return true
+	}
+
+	if cur.Exhausted() {
+		id = 0
+	}
+	res.Write(messages.Message{Body: nextBatchReply(batch, id, cur.Namespace)})
+	return true
+}
+
+// nextBatchReply returns the reply to a getMore.
+func nextBatchReply(batch []interface{}, id int64, namespace string) bson.D {
+	return bson.D{
+		{Name: "cursor", Value: bson.D{
+			{Name: "nextBatch", Value: batch},
+			{Name: "id", Value: id},
+			{Name: "ns", Value: namespace},
+		}},
+		{Name: "ok", Value: 1.0},
+	}
+}
+
+// killCursors kills the cursors the module keeps, and passes the others on.
+func (c *Cursors) killCursors(msg *messages.Message, res messages.Responder,
+	next server.PipelineFunc) {
+
+	namespace := msg.Namespace()
+	ours := []interface{}{}
+	theirs := []interface{}{}
+	cursors, _ := bsonutil.FindValueByKey("cursors", msg.Body).([]interface{})
+	for _, value := range cursors {
+		id := convert.ToInt64(value)
+		cur := c.registry.Lookup(id)
+		if cur == nil {
+			theirs = append(theirs, value)
+			continue
+		}
+		if err := checkOwner(cur, namespace, msg); err != nil {
+			logger.LogWith(INFO, messages.LogFields(msg), "refusing to kill cursor %d: %v", id, err)
+			res.Error(messages.Unauthorized, err.Error())
+			return
+		}
+		ours = append(ours, value)
+	}
+
+	killed := []interface{}{}
+	notFound := []interface{}{}
+	for _, value := range ours {
+		if c.registry.Kill(convert.ToInt64(value)) {
+			killed = append(killed, value)
+		} else {
+			notFound = append(notFound, value)
+		}
+	}
+
+	if len(theirs) == 0 {
+		res.Write(messages.Message{Body: bson.D{
+			{Name: "cursorsKilled", Value: killed},
+			{Name: "cursorsNotFound", Value: notFound},
+			{Name: "cursorsAlive", Value: []interface{}{}},
+			{Name: "cursorsUnknown", Value: []interface{}{}},
+			{Name: "ok", Value: 1.0},
+		}})
+		return
+	}
+	if len(ours) == 0 {
+		next(msg, res)
+		return
+	}
+
+	// pass on a copy naming only the cursors that are not ours
+	body := make(bson.D, len(msg.Body))
+	copy(body, msg.Body)
+	for i := range body {
+		if body[i].Name == "cursors" {
+			body[i].Value = theirs
+		}
+	}
+	passed := *msg
+	passed.Body = body
+	passed.Raw = nil
+
+	inner := messages.ModuleResponse{}
+	next(&passed, &inner)
+	reply, ok := inner.Writer.(messages.Message)
+	if inner.CommandError != nil || !ok {
+		messages.Forward(res, inner)
+		return
+	}
+
+	body = make(bson.D, len(reply.Body))
+	copy(body, reply.Body)
+	for i := range body {
+		switch body[i].Name {
+		case "cursorsKilled":
+			body[i].Value = append(killed, toSlice(body[i].Value)...)
+		case "cursorsNotFound":
+			body[i].Value = append(notFound, toSlice(body[i].Value)...)
+		}
+	}
+	res.Write(messages.Message{Body: body})
+}
+
+// batchSizeOf returns the size of the first batch a command asks for, and
+// whether it asks for no cursor beyond it.
+func (c *Cursors) batchSizeOf(body bson.D) (int, bool) {
+	batchSize := c.batchSize
+	value := bsonutil.FindValueByKey("batchSize", body)
+	if value == nil {
+		cursor := convert.ToBSONMap(bsonutil.FindValueByKey("cursor", body))
+		value = cursor["batchSize"]
+	}
+	if value != nil {
+		batchSize = convert.ToInt(value, c.batchSize)
+	}
+	singleBatch := convert.ToBool(bsonutil.FindValueByKey("singleBatch", body))
+	return batchSize, singleBatch
+}
+
+// checkOwner returns an error unless a request may use a cursor: it must
+// name the cursor's namespace, and come from the session and user that
+// opened it.
+func checkOwner(cur *core.Cursor, namespace string, msg *messages.Message) error {
+	if namespace != cur.Namespace {
+		return fmt.Errorf("Cursor belongs to “%s”, not “%s”", cur.Namespace, namespace)
+	}
+	if sessionOf(msg.Body) != cur.Session {
+		return fmt.Errorf("Cursor belongs to a different session")
+	}
+	if userOf(msg) != cur.User {
+		return fmt.Errorf("Cursor belongs to a different user")
+	}
+	return nil
+}
+
+// sessionOf returns the ID of the session a command runs in, or an empty
+// string.
+func sessionOf(body bson.D) string {
+	info, _ := messages.BodySession(body)
+	return info.ID
+}
+
+// userOf returns the user the client of a request has authenticated as,
+// or an empty string.
+func userOf(msg *messages.Message) string {
+	if msg.Client == nil || msg.Client.User() == nil {
+		return ""
+	}
+	return msg.Client.User().String()
+}
+
+// withCursor returns a copy of a reply body with its cursor replaced.
+func withCursor(body bson.D, cursor bson.D) bson.D {
+	copied := make(bson.D, len(body))
+	copy(copied, body)
+	for i := range copied {
+		if copied[i].Name == "cursor" {
+			copied[i].Value = cursor
+		}
+	}
+	return copied
+}
+
+func toSlice(value interface{}) []interface{} {
+	slice, _ := value.([]interface{})
+	return slice
+}
@@ -0,0 +1,235 @@
+package cursors
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	core "github.com/mongodbinc-interns/mongoproxy/cursors"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func documents(from, to int) []interface{} {
+	docs := []interface{}{}
+	for i := from; i < to; i++ {
+		docs = append(docs, bson.D{{Name: "_id", Value: i}})
+	}
+	return docs
+}
+
+func message(body ...bson.DocElem) *messages.Message {
+	return &messages.Message{
+		Body:   append(bson.D(body), bson.DocElem{Name: "$db", Value: "shop"}),
+		Client: messages.NewClient(1, "10.0.0.1:50000"),
+	}
+}
+
+// backend answers queries with every document at once, as a backend
+// without cursors does, and records the requests it is passed.
+type backend struct {
+	docs   []interface{}
+	passed []*messages.Message
+}
+
+func (b *backend) next(req messages.Requester, res messages.Responder) {
+	msg := req.(*messages.Message)
+	b.passed = append(b.passed, msg)
+	switch msg.CommandName() {
+	case "killCursors":
+		res.Write(messages.Message{Body: bson.D{
+			{Name: "cursorsKilled", Value: bsonValue(msg, "cursors")},
+			{Name: "cursorsNotFound", Value: []interface{}{}},
+			{Name: "ok", Value: 1.0},
+		}})
+	case "getMore":
+		res.Error(messages.CursorNotFound, "cursor not found")
+	default:
+		res.Write(messages.Message{Body: bson.D{
+			{Name: "cursor", Value: bson.D{
+				{Name: "firstBatch", Value: b.docs},
+				{Name: "id", Value: int64(0)},
+				{Name: "ns", Value: msg.Namespace()},
+			}},
+			{Name: "ok", Value: 1.0},
+		}})
+	}
+}
+
+func bsonValue(msg *messages.Message, key string) interface{} {
+	return msg.Body.Map()[key]
+}
+
+func run(c *Cursors, b *backend, req *messages.Message) bson.M {
+	res := messages.ModuleResponse{}
+	c.Process(req, &res, b.next)
+	if res.CommandError != nil {
+		return bson.M{"ok": 0, "code": res.CommandError.ErrorCode}
+	}
+	return res.Writer.ToBSON()
+}
+
+func cursorOf(reply bson.M) (int64, []interface{}) {
+	cursor := convert.ToBSONMap(reply["cursor"])
+	return convert.ToInt64(cursor["id"]), core.Batch(reply)
+}
+
+func TestCursors(t *testing.T) {
+	Convey("Serve full results a batch at a time", t, func() {
+		c := &Cursors{}
+		So(c.Configure(bson.M{"batchSize": 3}), ShouldBeNil)
+		c.registry = core.NewRegistry(time.Hour)
+		defer c.registry.Close()
+		b := &backend{docs: documents(0, 8)}
+
+		reply := run(c, b, message(bson.DocElem{Name: "find", Value: "orders"}))
+		id, batch := cursorOf(reply)
+		So(batch, ShouldResemble, documents(0, 3))
+		So(id, ShouldNotEqual, 0)
+		So(c.registry.Stats().Open, ShouldEqual, 1)
+
+		Convey("with getMore", func() {
+			reply = run(c, b, message(
+				bson.DocElem{Name: "getMore", Value: id},
+				bson.DocElem{Name: "collection", Value: "orders"},
+				bson.DocElem{Name: "batchSize", Value: 4},
+			))
+			nextID, batch := cursorOf(reply)
+			So(batch, ShouldResemble, documents(3, 7))
+			So(nextID, ShouldEqual, id)
+
+			reply = run(c, b, message(
+				bson.DocElem{Name: "getMore", Value: id},
+				bson.DocElem{Name: "collection", Value: "orders"},
+			))
+			nextID, batch = cursorOf(reply)
+			So(batch, ShouldResemble, documents(7, 8))
+			So(nextID, ShouldEqual, 0)
+			So(c.registry.Stats().Open, ShouldEqual, 0)
+			So(len(b.passed), ShouldEqual, 1)
+		})
+
+		Convey("only for their own namespace, session and user", func() {
+			reply = run(c, b, message(
+				bson.DocElem{Name: "getMore", Value: id},
+				bson.DocElem{Name: "collection", Value: "customers"},
+			))
+			So(reply["code"], ShouldEqual, messages.Unauthorized)
+
+			reply = run(c, b, message(
+				bson.DocElem{Name: "getMore", Value: id},
+				bson.DocElem{Name: "collection", Value: "orders"},
+				bson.DocElem{Name: "lsid", Value: bson.D{{Name: "id", Value: bson.Binary{Kind: 4, Data: []byte{1, 2}}}}},
+			))
+			So(reply["code"], ShouldEqual, messages.Unauthorized)
+		})
+
+		Convey("and kill them, passing on the cursors that are not the module's", func() {
+			reply = run(c, b, message(
+				bson.DocElem{Name: "killCursors", Value: "orders"},
+				bson.DocElem{Name: "cursors", Value: []interface{}{id, int64(42)}},
+			))
+			So(reply["cursorsKilled"], ShouldResemble, []interface{}{id, int64(42)})
+			So(b.passed[1].Body.Map()["cursors"], ShouldResemble, []interface{}{int64(42)})
+			So(c.registry.Stats().Open, ShouldEqual, 0)
+
+			reply = run(c, b, message(
+				bson.DocElem{Name: "getMore", Value: id},
+				bson.DocElem{Name: "collection", Value: "orders"},
+			))
+			So(reply["code"], ShouldEqual, messages.CursorNotFound)
+		})
+	})
+
+	Convey("Honor the batch size the client asks for", t, func() {
+		c := &Cursors{}
+		So(c.Configure(bson.M{}), ShouldBeNil)
+		c.registry = core.NewRegistry(time.Hour)
+		defer c.registry.Close()
+		b := &backend{docs: documents(0, 150)}
+
+		_, batch := cursorOf(run(c, b, message(bson.DocElem{Name: "find", Value: "orders"})))
+		So(len(batch), ShouldEqual, DefaultBatchSize)
+
+		_, batch = cursorOf(run(c, b, message(
+			bson.DocElem{Name: "aggregate", Value: "orders"},
+			bson.DocElem{Name: "cursor", Value: bson.D{{Name: "batchSize", Value: 10}}},
+		)))
+		So(len(batch), ShouldEqual, 10)
+
+		id, batch := cursorOf(run(c, b, message(
+			bson.DocElem{Name: "find", Value: "orders"},
+			bson.DocElem{Name: "batchSize", Value: 0},
+		)))
+		So(len(batch), ShouldEqual, 0)
+		So(id, ShouldNotEqual, 0)
+
+		id, batch = cursorOf(run(c, b, message(
+			bson.DocElem{Name: "find", Value: "orders"},
+			bson.DocElem{Name: "batchSize", Value: 5},
+			bson.DocElem{Name: "singleBatch", Value: true},
+		)))
+		So(len(batch), ShouldEqual, 5)
+		So(id, ShouldEqual, 0)
+
+		b.docs = documents(0, 5)
+		id, batch = cursorOf(run(c, b, message(bson.DocElem{Name: "find", Value: "orders"})))
+		So(len(batch), ShouldEqual, 5)
+		So(id, ShouldEqual, 0)
+	})
+
+	Convey("Keep replies, and not just their documents, under 16MB", t, func() {
+		c := &Cursors{}
+		So(c.Configure(bson.M{}), ShouldBeNil)
+		c.registry = core.NewRegistry(time.Hour)
+		defer c.registry.Close()
+
+		// four of these fit in 16MB, but not with the rest of a reply
+		big := bson.D{{Name: "pad", Value: strings.Repeat("x", maxReplyBytes/4-64)}}
+		b := &backend{docs: []interface{}{big, big, big, big, big, big}}
+
+		reply := run(c, b, message(
+			bson.DocElem{Name: "find", Value: "orders"},
+			bson.DocElem{Name: "batchSize", Value: 5},
+		))
+		id, batch := cursorOf(reply)
+		So(len(batch), ShouldEqual, 3)
+		raw, _ := bson.Marshal(reply)
+		So(len(raw), ShouldBeLessThanOrEqualTo, maxReplyBytes-replyAllowance)
+
+		reply = run(c, b, message(
+			bson.DocElem{Name: "getMore", Value: id},
+			bson.DocElem{Name: "collection", Value: "orders"},
+		))
+		_, batch = cursorOf(reply)
+		So(len(batch), ShouldEqual, 3)
+		raw, _ = bson.Marshal(reply)
+		So(len(raw), ShouldBeLessThanOrEqualTo, maxReplyBytes-replyAllowance)
+	})
+
+	Convey("Limit the number of open cursors", t, func() {
+		c := &Cursors{}
+		So(c.Configure(bson.M{"batchSize": 1, "maxCursors": 1}), ShouldBeNil)
+		c.registry = core.NewRegistry(time.Hour)
+		defer c.registry.Close()
+		b := &backend{docs: documents(0, 2)}
+
+		run(c, b, message(bson.DocElem{Name: "find", Value: "orders"}))
+		reply := run(c, b, message(bson.DocElem{Name: "find", Value: "orders"}))
+		So(reply["code"], ShouldEqual, messages.OperationFailed)
+	})
+
+	Convey("Reject bad configurations", t, func() {
+		bad := []bson.M{
+			{"batchSize": 0},
+			{"batchSize": "many"},
+			{"idleTimeoutSecs": -1},
+			{"maxCursors": -1},
+		}
+		for _, conf := range bad {
+			So((&Cursors{}).Configure(conf), ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,280 @@
+package handshake
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// started is when the process started, for uptimes.
+var started = time.Now()
+
+// a commandError is the MongoDB error a command fails with.
+type commandError struct {
+	code    int32
+	message string
+}
+
+// a command returns the reply to a request, without "ok", which is added
+// for it.
+type command func(h *Handshake, r request) (bson.D, *commandError)
+
+// commands are the commands the module answers, by name.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"hello":            (*Handshake).hello,
+		"isMaster":         (*Handshake).hello,
+		"ismaster":         (*Handshake).hello,
+		"ping":             (*Handshake).ping,
+		"buildInfo":        (*Handshake).buildInfo,
+		"buildinfo":        (*Handshake).buildInfo,
+		"getParameter":     (*Handshake).getParameter,
+		"endSessions":      (*Handshake).ping,
+		"listDatabases":    (*Handshake).listDatabases,
+		"getLog":           (*Handshake).getLog,
+		"serverStatus":     (*Handshake).serverStatus,
+		"whatsmyuri":       (*Handshake).whatsmyuri,
+		"connectionStatus": (*Handshake).connectionStatus,
+	}
+}
+
+// hello answers the handshake, as a standalone server or as a member of
+// the configured replica set. A speculative authentication in the request
+// is left unanswered, so that the driver authenticates with the usual
+// commands.
+func (h *Handshake) hello(r request) (bson.D, *commandError) {
+	state := h.await(r)
+	rc := state.conf
+
+	primary := len(rc.name) == 0 || rc.me == state.primary
+	reply := bson.D{}
+	if r.name == "hello" {
+		reply = append(reply, bson.DocElem{Name: "isWritablePrimary", Value: primary})
+	} else {
+		reply = append(reply, bson.DocElem{Name: "ismaster", Value: primary})
+	}
+	if convert.ToBool(r.args["helloOk"]) {
+		reply = append(reply, bson.DocElem{Name: "helloOk", Value: true})
+	}
+	reply = append(reply, bson.DocElem{Name: "topologyVersion", Value: bson.D{
+		{Name: "processId", Value: processID},
+		{Name: "counter", Value: state.counter},
+	}})
+
+	if len(rc.name) > 0 {
+		now := time.Now()
+		reply = append(reply,
+			bson.DocElem{Name: "secondary", Value: !primary && contains(state.hosts, rc.me)},
+			bson.DocElem{Name: "setName", Value: rc.name},
+			bson.DocElem{Name: "setVersion", Value: rc.setVersion},
+			bson.DocElem{Name: "hosts", Value: state.hosts},
+			bson.DocElem{Name: "primary", Value: state.primary},
+			bson.DocElem{Name: "me", Value: rc.me},
+		)
+		if primary {
+			reply = append(reply, bson.DocElem{Name: "electionId", Value: state.electionID()})
+		}
+		// writes are the backend's business, so as far as drivers can
+		// tell, every member is always up to date
+		reply = append(reply, bson.DocElem{Name: "lastWrite", Value: bson.D{
+			{Name: "opTime", Value: bson.D{
+				{Name: "ts", Value: bson.MongoTimestamp(now.Unix() << 32)},
+				{Name: "t", Value: state.term},
+			}},
+			{Name: "lastWriteDate", Value: now},
+		}})
+	}
+
+	reply = append(reply,
+		bson.DocElem{Name: "maxBsonObjectSize", Value: h.identity.MaxBsonObjectSize},
+		bson.DocElem{Name: "maxMessageSizeBytes", Value: h.identity.MaxMessageSizeBytes},
+		bson.DocElem{Name: "maxWriteBatchSize", Value: h.identity.MaxWriteBatchSize},
+		bson.DocElem{Name: "localTime", Value: bson.Now()},
+		bson.DocElem{Name: "logicalSessionTimeoutMinutes", Value: int(sessions.Default.Timeout() / time.Minute)},
+	)
+	if r.client != nil {
+		reply = append(reply, bson.DocElem{Name: "connectionId", Value: r.client.ID})
+	}
+	return append(reply,
+		bson.DocElem{Name: "minWireVersion", Value: h.identity.MinWireVersion},
+		bson.DocElem{Name: "maxWireVersion", Value: h.identity.MaxWireVersion},
+		bson.DocElem{Name: "readOnly", Value: false},
+	), nil
+}
+
+// await returns the topology to answer a hello with. An awaitable hello,
+// whose topologyVersion is current, waits up to its maxAwaitTimeMS for the
+// topology to change, or the client to disconnect.
+func (h *Handshake) await(r request) topologyState {
+	state, changed := h.topology.current()
+
+	version := convert.ToBSONMap(r.args["topologyVersion"])
+	maxAwait, awaitable := r.args["maxAwaitTimeMS"]
+	if version == nil || !awaitable ||
+		version["processId"] != processID || convert.ToInt64(version["counter"]) != state.counter {
+		return state
+	}
+
+	var disconnected <-chan struct{}
+	if r.client != nil {
+		disconnected = r.client.Done()
+	}
+	timer := time.NewTimer(time.Duration(convert.ToInt64(maxAwait)) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-disconnected:
+	}
+
+	state, _ = h.topology.current()
+	return state
+}
+
+func (h *Handshake) ping(r request) (bson.D, *commandError) {
+	return bson.D{}, nil
+}
+
+func (h *Handshake) buildInfo(r request) (bson.D, *commandError) {
+	return bson.D{
+		{Name: "version", Value: h.identity.Version},
+		{Name: "gitVersion", Value: ""},
+		{Name: "modules", Value: []interface{}{}},
+		{Name: "sysInfo", Value: "deprecated"},
+		{Name: "versionArray", Value: h.identity.VersionArray},
+		{Name: "bits", Value: 64},
+		{Name: "debug", Value: false},
+		{Name: "maxBsonObjectSize", Value: h.identity.MaxBsonObjectSize},
+		{Name: "storageEngines", Value: []interface{}{}},
+	}, nil
+}
+
+// sessionParameters are the parameters that report the proxy's session
+// settings, as they are when asked for.
+var sessionParameters = map[string]func() interface{}{
+	"localLogicalSessionTimeoutMinutes": func() interface{} {
+		return int(sessions.Default.Timeout() / time.Minute)
+	},
+	"transactionLifetimeLimitSeconds": func() interface{} {
+		return int(sessions.Default.TransactionLifetime() / time.Second)
+	},
+}
+
+// getParameter answers for the parameters named in the command, or all of
+// them if the command's value is "*". Like mongod, it fails if none
+// of the named parameters are known.
+func (h *Handshake) getParameter(r request) (bson.D, *commandError) {
+	all := r.args["getParameter"] == "*"
+	if spec := convert.ToBSONMap(r.args["getParameter"]); spec != nil {
+		all = convert.ToBool(spec["allParameters"])
+	}
+
+	parameters := bson.M{}
+	for name, value := range h.parameters {
+		parameters[name] = value
+	}
+	for name, value := range sessionParameters {
+		parameters[name] = value()
+	}
+
+	names := []string{}
+	for name := range parameters {
+		if _, requested := r.args[name]; all || requested {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, &commandError{messages.InvalidOptions, "no option found to get"}
+	}
+	sort.Strings(names)
+
+	reply := bson.D{}
+	for _, name := range names {
+		reply = append(reply, bson.DocElem{Name: name, Value: parameters[name]})
+	}
+	return reply, nil
+}
+
+// listDatabases lists the configured databases, which it reports as empty.
+// Filters are not supported.
+func (h *Handshake) listDatabases(r request) (bson.D, *commandError) {
+	nameOnly := convert.ToBool(r.args["nameOnly"])
+	databases := make([]interface{}, len(h.databases))
+	for i, name := range h.databases {
+		if nameOnly {
+			databases[i] = bson.D{{Name: "name", Value: name}}
+		} else {
+			databases[i] = bson.D{
+				{Name: "name", Value: name},
+				{Name: "sizeOnDisk", Value: int64(0)},
+				{Name: "empty", Value: false},
+			}
+		}
+	}
+
+	reply := bson.D{{Name: "databases", Value: databases}}
+	if !nameOnly {
+		reply = append(reply, bson.DocElem{Name: "totalSize", Value: int64(0)})
+	}
+	return reply, nil
+}
+
+// getLog lists the logs, which are always empty, since the proxy keeps
+// its own.
+func (h *Handshake) getLog(r request) (bson.D, *commandError) {
+	switch r.args["getLog"] {
+	case "*":
+		return bson.D{{Name: "names", Value: []string{"global", "startupWarnings"}}}, nil
+	case "global", "startupWarnings":
+		return bson.D{
+			{Name: "totalLinesWritten", Value: 0},
+			{Name: "log", Value: []string{}},
+		}, nil
+	}
+	return nil, &commandError{messages.InvalidOptions, "no RamLog named: " + convert.ToString(r.args["getLog"])}
+}
+
+func (h *Handshake) serverStatus(r request) (bson.D, *commandError) {
+	host, _ := os.Hostname()
+	uptime := time.Since(started)
+	return bson.D{
+		{Name: "host", Value: host},
+		{Name: "version", Value: h.identity.Version},
+		{Name: "process", Value: "mongoproxy"},
+		{Name: "pid", Value: int64(os.Getpid())},
+		{Name: "uptime", Value: uptime.Seconds()},
+		{Name: "uptimeMillis", Value: int64(uptime / time.Millisecond)},
+		{Name: "uptimeEstimate", Value: int64(uptime / time.Second)},
+		{Name: "localTime", Value: bson.Now()},
+	}, nil
+}
+
+func (h *Handshake) whatsmyuri(r request) (bson.D, *commandError) {
+	you := ""
+	if r.client != nil {
+		you = r.client.RemoteAddr
+	}
+	return bson.D{{Name: "you", Value: you}}, nil
+}
+
+// connectionStatus reports the user the client has authenticated as, as
+// far as the proxy knows. Roles are not known.
+func (h *Handshake) connectionStatus(r request) (bson.D, *commandError) {
+	users := []interface{}{}
+	if r.client != nil {
+		if user := r.client.User(); user != nil {
+			users = append(users, bson.D{{Name: "user", Value: user.Name}, {Name: "db", Value: user.Database}})
+		}
+	}
+	return bson.D{{Name: "authInfo", Value: bson.D{
+		{Name: "authenticatedUsers", Value: users},
+		{Name: "authenticatedUserRoles", Value: []interface{}{}},
+	}}}, nil
+}
@@ -0,0 +1,221 @@
+// Package handshake contains a module that answers the driver handshake
+// and standard administrative commands itself, as a server with a
+// configurable identity, and passes every other request on.
+package handshake
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var logger = GetLogger("handshake")
+
+// Identity is what the module tells drivers about the server.
+type Identity struct {
+	Version             string
+	VersionArray        []int
+	MinWireVersion      int
+	MaxWireVersion      int
+	MaxBsonObjectSize   int
+	MaxMessageSizeBytes int
+	MaxWriteBatchSize   int
+}
+
+// DefaultIdentity is that of a MongoDB 6.0 server.
+var DefaultIdentity = Identity{
+	Version:             "6.0.0",
+	VersionArray:        []int{6, 0, 0, 0},
+	MinWireVersion:      6,
+	MaxWireVersion:      17,
+	MaxBsonObjectSize:   16 * 1024 * 1024,
+	MaxMessageSizeBytes: 48000000,
+	MaxWriteBatchSize:   100000,
+}
+
+// The Handshake module answers hello, ping, buildInfo and similar commands
+// without bothering the modules after it.
+type Handshake struct {
+	identity    Identity
+	topology    *topology
+	parameters  bson.M
+	databases   []string
+	passThrough map[string]bool
+}
+
+func init() {
+	server.Publish(&Handshake{})
+}
+
+func (_ *Handshake) New() server.Module {
+	return &Handshake{}
+}
+
+func (_ *Handshake) Name() string {
+	return "handshake"
+}
+
+func (h *Handshake) Configure(conf bson.M) error {
+	h.identity = DefaultIdentity
+
+	if value, ok := conf["version"]; ok {
+		version, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("“version” must be a string, not %v", value)
+		}
+		versionArray, err := parseVersion(version)
+		if err != nil {
+			return err
+		}
+		h.identity.Version = version
+		h.identity.VersionArray = versionArray
+	}
+
+	ints := map[string]*int{
+		"minWireVersion":      &h.identity.MinWireVersion,
+		"maxWireVersion":      &h.identity.MaxWireVersion,
+		"maxBsonObjectSize":   &h.identity.MaxBsonObjectSize,
+		"maxMessageSizeBytes": &h.identity.MaxMessageSizeBytes,
+		"maxWriteBatchSize":   &h.identity.MaxWriteBatchSize,
+	}
+	for name, field := range ints {
+		if value, ok := conf[name]; ok {
+			*field = convert.ToInt(value, -1)
+			if *field < 0 {
+				return fmt.Errorf("“%s” must be a non-negative integer, not %v", name, value)
+			}
+		}
+	}
+	if h.identity.MinWireVersion > h.identity.MaxWireVersion {
+		return fmt.Errorf("“minWireVersion” (%d) is greater than “maxWireVersion” (%d)",
+			h.identity.MinWireVersion, h.identity.MaxWireVersion)
+	}
+
+	rc, err := parseReplicaSet(convert.ToBSONMap(conf[replicaSetConfName]))
+	if err != nil {
+		return err
+	}
+	h.topology, err = sharedTopology(rc)
+	if err != nil {
+		return err
+	}
+
+	// the session settings are the proxy's, and reported as they are
+	if _, ok := conf["logicalSessionTimeoutMinutes"]; ok {
+		return fmt.Errorf("“logicalSessionTimeoutMinutes” belongs in the top-level “sessions” object")
+	}
+	h.parameters = bson.M{
+		"featureCompatibilityVersion": bson.M{"version": fmt.Sprintf("%d.%d",
+			h.identity.VersionArray[0], h.identity.VersionArray[1])},
+	}
+	if value, ok := conf["parameters"]; ok {
+		parameters := convert.ToBSONMap(value)
+		if parameters == nil {
+			return fmt.Errorf("“parameters” must be an object, not %v", value)
+		}
+		for name, value := range parameters {
+			if _, ok := sessionParameters[name]; ok {
+				return fmt.Errorf("“parameters”: “%s” is set by the top-level “sessions” object", name)
+			}
+			h.parameters[name] = value
+		}
+	}
+
+	h.databases = []string{}
+	if value, ok := conf["databases"]; ok {
+		databases, err := convert.ConvertToStringSlice(value)
+		if err != nil {
+			return fmt.Errorf("“databases” must be an array of strings, not %v", value)
+		}
+		h.databases = databases
+	}
+
+	h.passThrough = map[string]bool{}
+	if value, ok := conf["passThrough"]; ok {
+		names, err := convert.ConvertToStringSlice(value)
+		if err != nil {
+			return fmt.Errorf("“passThrough” must be an array of strings, not %v", value)
+		}
+		for _, name := range names {
+			if _, known := commands[name]; !known {
+				return fmt.Errorf("“passThrough”: “%s” is not a command this module answers", name)
+			}
+			h.passThrough[name] = true
+		}
+	}
+
+	return nil
+}
+
+// parseVersion parses a version such as "6.0.4" into the array that
+// buildInfo reports, such as [6, 0, 4, 0].
+func parseVersion(version string) ([]int, error) {
+	// drop suffixes such as "-rc1"
+	parts := strings.Split(strings.SplitN(version, "-", 2)[0], ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("“version” must be like 6.0.4, not %s", version)
+	}
+	versionArray := []int{0, 0, 0, 0}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("“version” must be like 6.0.4, not %s", version)
+		}
+		versionArray[i] = n
+	}
+	return versionArray, nil
+}
+
+// a request is what the commands need to know of a request, whichever
+// opcode it came in.
+type request struct {
+	name   string
+	args   bson.M
+	client *messages.Client
+}
+
+func (h *Handshake) Process(req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	var r request
+	switch req.Type() {
+	case messages.MessageType:
+		message, err := messages.ToMessageRequest(req)
+		if err != nil {
+			break
+		}
+		r = request{message.CommandName(), message.Body.Map(), message.Client}
+	case messages.CommandType:
+		command, err := messages.ToCommandRequest(req)
+		if err != nil {
+			break
+		}
+		r = request{command.CommandName, command.Args, command.Client}
+	}
+
+	command, ok := commands[r.name]
+	if !ok || h.passThrough[r.name] {
+		next(req, res)
+		return
+	}
+
+	reply, err := command(h, r)
+	if err != nil {
+		logger.LogWith(INFO, messages.LogFields(req), "%s failed: %v", r.name, err)
+		res.Error(err.code, err.message)
+		return
+	}
+	reply = append(reply, bson.DocElem{Name: "ok", Value: 1.0})
+
+	if req.Type() == messages.CommandType {
+		res.Write(messages.CommandResponse{Reply: reply.Map()})
+	} else {
+		res.Write(messages.Message{Body: reply})
+	}
+}
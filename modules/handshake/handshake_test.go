@@ -0,0 +1,141 @@
+package handshake
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// run passes a request through a configured module, and returns the reply
+// and whether the request was passed on.
+func run(h *Handshake, req messages.Requester) (messages.ModuleResponse, bool) {
+	res := messages.ModuleResponse{}
+	passed := false
+	h.Process(req, &res, func(messages.Requester, messages.Responder) {
+		passed = true
+	})
+	return res, passed
+}
+
+func message(body ...bson.DocElem) *messages.Message {
+	return &messages.Message{
+		Body:   append(bson.D(body), bson.DocElem{Name: "$db", Value: "admin"}),
+		Client: messages.NewClient(7, "10.0.0.1:50000"),
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	Convey("Answer the handshake and admin commands", t, func() {
+		h := &Handshake{}
+		So(h.Configure(bson.M{
+			"version":        "7.0.2",
+			"maxWireVersion": 21,
+			"databases":      []interface{}{"shop"},
+			"parameters":     bson.M{"authenticationMechanisms": []interface{}{"SCRAM-SHA-256"}},
+			"passThrough":    []interface{}{"listDatabases"},
+		}), ShouldBeNil)
+
+		Convey("hello, with the configured identity", func() {
+			res, passed := run(h, message(
+				bson.DocElem{Name: "hello", Value: 1},
+				bson.DocElem{Name: "helloOk", Value: true},
+				bson.DocElem{Name: "speculativeAuthenticate", Value: bson.D{{Name: "saslStart", Value: 1}}},
+			))
+			So(passed, ShouldBeFalse)
+			reply := res.Writer.ToBSON()
+			So(reply["isWritablePrimary"], ShouldEqual, true)
+			So(reply["helloOk"], ShouldEqual, true)
+			So(reply["maxWireVersion"], ShouldEqual, 21)
+			So(reply["minWireVersion"], ShouldEqual, DefaultIdentity.MinWireVersion)
+			So(reply["connectionId"], ShouldEqual, 7)
+			So(reply["ok"], ShouldEqual, 1)
+			So(reply["speculativeAuthenticate"], ShouldBeNil)
+		})
+
+		Convey("isMaster over OP_QUERY", func() {
+			res, passed := run(h, messages.Command{CommandName: "isMaster", Args: bson.M{"isMaster": 1}})
+			So(passed, ShouldBeFalse)
+			reply, ok := res.Writer.(messages.CommandResponse)
+			So(ok, ShouldBeTrue)
+			So(reply.Reply["ismaster"], ShouldEqual, true)
+		})
+
+		Convey("buildInfo", func() {
+			res, _ := run(h, message(bson.DocElem{Name: "buildInfo", Value: 1}))
+			reply := res.Writer.ToBSON()
+			So(reply["version"], ShouldEqual, "7.0.2")
+			So(reply["versionArray"], ShouldResemble, []int{7, 0, 2, 0})
+		})
+
+		Convey("getParameter", func() {
+			res, _ := run(h, message(
+				bson.DocElem{Name: "getParameter", Value: 1},
+				bson.DocElem{Name: "featureCompatibilityVersion", Value: 1},
+			))
+			So(res.Writer.ToBSON()["featureCompatibilityVersion"], ShouldResemble, bson.M{"version": "7.0"})
+			So(res.Writer.ToBSON()["authenticationMechanisms"], ShouldBeNil)
+
+			res, _ = run(h, message(bson.DocElem{Name: "getParameter", Value: "*"}))
+			So(res.Writer.ToBSON()["authenticationMechanisms"], ShouldNotBeNil)
+
+			res, _ = run(h, message(
+				bson.DocElem{Name: "getParameter", Value: 1},
+				bson.DocElem{Name: "noSuchParameter", Value: 1},
+			))
+			So(res.CommandError.ErrorCode, ShouldEqual, messages.InvalidOptions)
+		})
+
+		Convey("the proxy's session settings, as they are", func() {
+			defer sessions.Default.Configure(sessions.Config{
+				Timeout:             sessions.DefaultTimeout,
+				TransactionLifetime: sessions.DefaultTransactionLifetime,
+			})
+			sessions.Default.Configure(sessions.Config{Timeout: 10 * time.Minute, TransactionLifetime: 90 * time.Second})
+
+			res, _ := run(h, message(bson.DocElem{Name: "hello", Value: 1}))
+			So(res.Writer.ToBSON()["logicalSessionTimeoutMinutes"], ShouldEqual, 10)
+
+			res, _ = run(h, message(bson.DocElem{Name: "getParameter", Value: "*"}))
+			reply := res.Writer.ToBSON()
+			So(reply["localLogicalSessionTimeoutMinutes"], ShouldEqual, 10)
+			So(reply["transactionLifetimeLimitSeconds"], ShouldEqual, 90)
+		})
+
+		Convey("getLog and connectionStatus", func() {
+			res, _ := run(h, message(bson.DocElem{Name: "getLog", Value: "startupWarnings"}))
+			So(res.Writer.ToBSON()["log"], ShouldResemble, []string{})
+
+			res, _ = run(h, message(bson.DocElem{Name: "connectionStatus", Value: 1}))
+			authInfo := res.Writer.ToBSON()["authInfo"].(bson.D).Map()
+			So(authInfo["authenticatedUsers"], ShouldResemble, []interface{}{})
+		})
+
+		Convey("but pass on other commands, and those configured to pass through", func() {
+			_, passed := run(h, message(bson.DocElem{Name: "find", Value: "orders"}))
+			So(passed, ShouldBeTrue)
+			_, passed = run(h, message(bson.DocElem{Name: "listDatabases", Value: 1}))
+			So(passed, ShouldBeTrue)
+		})
+	})
+
+	Convey("Reject bad configurations", t, func() {
+		bad := []bson.M{
+			{"version": "six"},
+			{"version": 6},
+			{"minWireVersion": 18},
+			{"maxBsonObjectSize": -1},
+			{"passThrough": []interface{}{"find"}},
+			{"databases": "shop"},
+			{"parameters": bson.M{"transactionLifetimeLimitSeconds": -5}},
+			{"parameters": bson.M{"transactionLifetimeLimitSeconds": 120}},
+			{"logicalSessionTimeoutMinutes": 10},
+		}
+		for _, conf := range bad {
+			So((&Handshake{}).Configure(conf), ShouldNotBeNil)
+		}
+	})
+}
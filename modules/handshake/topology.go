@@ -0,0 +1,280 @@
+package handshake
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const replicaSetConfName = "replicaSet"
+
+// processID identifies this process in topologyVersions, so that drivers
+// can tell a restarted proxy from one whose topology has changed.
+var processID = bson.NewObjectId()
+
+// replicaSetConfig is the configured replica set that the proxies pretend
+// to be. A zero replicaSetConfig means a standalone server.
+type replicaSetConfig struct {
+	name string
+	me   string
+
+	// hosts, and the primary among them, are static unless read from
+	// hostsFile, which is read again every refresh.
+	hosts     []string
+	primary   string
+	hostsFile string
+	refresh   time.Duration
+
+	setVersion int
+	electionID bson.ObjectId
+}
+
+// parseReplicaSet reads the “replicaSet” configuration object.
+func parseReplicaSet(conf bson.M) (replicaSetConfig, error) {
+	rc := replicaSetConfig{setVersion: 1, refresh: 10 * time.Second}
+	if conf == nil {
+		return rc, nil
+	}
+
+	strs := map[string]*string{
+		"name":      &rc.name,
+		"me":        &rc.me,
+		"primary":   &rc.primary,
+		"hostsFile": &rc.hostsFile,
+	}
+	for name, field := range strs {
+		if value, ok := conf[name]; ok {
+			str, ok := value.(string)
+			if !ok {
+				return rc, fmt.Errorf("%s.%s must be a string, not %v", replicaSetConfName, name, value)
+			}
+			*field = str
+		}
+	}
+	if len(rc.name) == 0 {
+		return rc, fmt.Errorf("%s: missing “name”", replicaSetConfName)
+	}
+	if len(rc.me) == 0 {
+		return rc, fmt.Errorf("%s: missing “me”, this proxy's host:port as listed in the hosts", replicaSetConfName)
+	}
+
+	if value, ok := conf["hosts"]; ok {
+		hosts, err := convert.ConvertToStringSlice(value)
+		if err != nil {
+			return rc, fmt.Errorf("%s.hosts must be an array of strings, not %v", replicaSetConfName, value)
+		}
+		rc.hosts = hosts
+	}
+	if (len(rc.hosts) > 0) == (len(rc.hostsFile) > 0) {
+		return rc, fmt.Errorf("%s: give one of “hosts” or “hostsFile”", replicaSetConfName)
+	}
+	if len(rc.hosts) > 0 && len(rc.primary) > 0 && !contains(rc.hosts, rc.primary) {
+		return rc, fmt.Errorf("%s: primary %s is not one of the hosts", replicaSetConfName, rc.primary)
+	}
+
+	if value, ok := conf["refreshSecs"]; ok {
+		secs := convert.ToFloat64(value, -1)
+		if secs <= 0 {
+			return rc, fmt.Errorf("%s.refreshSecs must be a positive number, not %v", replicaSetConfName, value)
+		}
+		rc.refresh = time.Duration(secs * float64(time.Second))
+	}
+	if value, ok := conf["setVersion"]; ok {
+		rc.setVersion = convert.ToInt(value, -1)
+		if rc.setVersion < 1 {
+			return rc, fmt.Errorf("%s.setVersion must be a positive integer, not %v", replicaSetConfName, value)
+		}
+	}
+	if value, ok := conf["electionId"]; ok {
+		id := convert.ToString(value)
+		if !bson.IsObjectIdHex(id) {
+			return rc, fmt.Errorf("%s.electionId must be an ObjectId in hex, not %v", replicaSetConfName, value)
+		}
+		rc.electionID = bson.ObjectIdHex(id)
+	}
+
+	return rc, nil
+}
+
+// readHostsFile reads a list of hosts, one per line, with the primary
+// marked by “primary” after it. Blank lines and lines starting with # are
+// ignored. Without a marked primary, the first host is primary.
+func readHostsFile(path string) ([]string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	hosts := []string{}
+	primary := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1:
+		case len(fields) == 2 && fields[1] == "primary" && len(primary) == 0:
+			primary = fields[0]
+		default:
+			return nil, "", fmt.Errorf("%s: bad line “%s”", path, line)
+		}
+		hosts = append(hosts, fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(hosts) == 0 {
+		return nil, "", fmt.Errorf("%s lists no hosts", path)
+	}
+	return hosts, primary, nil
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// a topologyState is what a topology tells drivers at one point in time.
+type topologyState struct {
+	conf    replicaSetConfig
+	hosts   []string
+	primary string
+	counter int64
+	term    int64
+}
+
+// electionID returns the configured electionId, or else one that grows
+// with each change of primary, as drivers expect.
+func (s topologyState) electionID() bson.ObjectId {
+	if len(s.conf.electionID) > 0 {
+		return s.conf.electionID
+	}
+	id := make([]byte, 12)
+	binary.BigEndian.PutUint32(id, 0x7fffffff)
+	binary.BigEndian.PutUint64(id[4:], uint64(s.term))
+	return bson.ObjectId(id)
+}
+
+// a topology is the replica set the proxies make up, as this proxy knows
+// it. Its counter goes up each time it changes, for topologyVersions, and
+// hellos awaiting a change wait on the changed channel.
+type topology struct {
+	mutex    sync.Mutex
+	state    topologyState
+	changed  chan struct{}
+	watching bool
+}
+
+// topologies are the topologies created so far, by replica set name, or
+// "" for a standalone. They outlive configuration reloads, so that the
+// topologyVersion counter never goes back.
+var topologies = make(map[string]*topology)
+var topologiesMutex sync.Mutex
+
+// sharedTopology returns the topology for a configuration, applying the
+// configuration to it.
+func sharedTopology(rc replicaSetConfig) (*topology, error) {
+	hosts, primary := rc.hosts, rc.primary
+	if len(rc.hostsFile) > 0 {
+		var err error
+		hosts, primary, err = readHostsFile(rc.hostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", replicaSetConfName, err)
+		}
+	}
+
+	topologiesMutex.Lock()
+	t, ok := topologies[rc.name]
+	if !ok {
+		t = &topology{changed: make(chan struct{})}
+		topologies[rc.name] = t
+	}
+	topologiesMutex.Unlock()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.setLocked(rc, hosts, primary)
+	if len(rc.hostsFile) > 0 && !t.watching {
+		t.watching = true
+		go t.watch()
+	}
+	return t, nil
+}
+
+// setLocked updates the topology, and bumps the counter and wakes waiting
+// hellos if anything changed. It must be called with the mutex held.
+func (t *topology) setLocked(conf replicaSetConfig, hosts []string, primary string) {
+	if len(primary) == 0 && len(hosts) > 0 {
+		primary = hosts[0]
+	}
+	next := topologyState{
+		conf:    conf,
+		hosts:   hosts,
+		primary: primary,
+		counter: t.state.counter,
+		term:    t.state.term,
+	}
+	if t.state.counter > 0 && reflect.DeepEqual(next, t.state) {
+		return
+	}
+	if primary != t.state.primary {
+		next.term++
+	}
+	next.counter++
+	t.state = next
+
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// watch reads the hosts file of the latest configuration every refresh,
+// keeping the last good list if reading fails.
+func (t *topology) watch() {
+	for {
+		t.mutex.Lock()
+		conf := t.state.conf
+		t.mutex.Unlock()
+
+		time.Sleep(conf.refresh)
+		if len(conf.hostsFile) == 0 {
+			continue
+		}
+
+		hosts, primary, err := readHostsFile(conf.hostsFile)
+		if err != nil {
+			logger.Log(WARNING, "Keeping replica set hosts: %v", err)
+			continue
+		}
+
+		t.mutex.Lock()
+		if t.state.conf.hostsFile == conf.hostsFile {
+			t.setLocked(t.state.conf, hosts, primary)
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// current returns the current state, and a channel that is closed once it
+// changes.
+func (t *topology) current() (topologyState, <-chan struct{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state, t.changed
+}
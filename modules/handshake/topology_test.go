@@ -0,0 +1,143 @@
+package handshake
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func hello(h *Handshake, extra ...bson.DocElem) bson.M {
+	res, _ := run(h, message(append([]bson.DocElem{{Name: "hello", Value: 1}}, extra...)...))
+	return res.Writer.ToBSON()
+}
+
+func counterOf(reply bson.M) int64 {
+	return reply["topologyVersion"].(bson.D).Map()["counter"].(int64)
+}
+
+func TestReplicaSet(t *testing.T) {
+	Convey("Pretend to be a member of a replica set", t, func() {
+		conf := bson.M{"replicaSet": bson.M{
+			"name":       "static",
+			"me":         "p2:27017",
+			"hosts":      []interface{}{"p1:27017", "p2:27017", "p3:27017"},
+			"primary":    "p1:27017",
+			"setVersion": 3,
+		}}
+		h := &Handshake{}
+		So(h.Configure(conf), ShouldBeNil)
+
+		reply := hello(h)
+		So(reply["isWritablePrimary"], ShouldEqual, false)
+		So(reply["secondary"], ShouldEqual, true)
+		So(reply["setName"], ShouldEqual, "static")
+		So(reply["setVersion"], ShouldEqual, 3)
+		So(reply["hosts"], ShouldResemble, []string{"p1:27017", "p2:27017", "p3:27017"})
+		So(reply["primary"], ShouldEqual, "p1:27017")
+		So(reply["me"], ShouldEqual, "p2:27017")
+		So(reply["electionId"], ShouldBeNil)
+		So(reply["lastWrite"], ShouldNotBeNil)
+
+		Convey("whose topologyVersion only changes with the topology", func() {
+			counter := counterOf(reply)
+			So(h.Configure(conf), ShouldBeNil)
+			So(counterOf(hello(h)), ShouldEqual, counter)
+
+			conf["replicaSet"].(bson.M)["primary"] = "p2:27017"
+			So(h.Configure(conf), ShouldBeNil)
+			reply := hello(h)
+			So(counterOf(reply), ShouldEqual, counter+1)
+			So(reply["isWritablePrimary"], ShouldEqual, true)
+			So(reply["electionId"], ShouldNotBeNil)
+		})
+
+		Convey("answering awaitable hellos once the wait is over", func() {
+			start := time.Now()
+			reply := hello(h,
+				bson.DocElem{Name: "topologyVersion", Value: reply["topologyVersion"]},
+				bson.DocElem{Name: "maxAwaitTimeMS", Value: int64(50)},
+			)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+			So(reply["ok"], ShouldEqual, 1)
+		})
+	})
+
+	Convey("Follow a hosts file", t, func() {
+		dir, err := ioutil.TempDir("", "handshake")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "hosts")
+		So(ioutil.WriteFile(path, []byte("# proxies\np1:27017\np2:27017\n"), 0644), ShouldBeNil)
+
+		h := &Handshake{}
+		So(h.Configure(bson.M{"replicaSet": bson.M{
+			"name":        "file",
+			"me":          "p2:27017",
+			"hostsFile":   path,
+			"refreshSecs": 0.01,
+		}}), ShouldBeNil)
+
+		before := hello(h)
+		So(before["primary"], ShouldEqual, "p1:27017")
+
+		Convey("waking awaitable hellos when it changes", func() {
+			replies := make(chan bson.M)
+			go func() {
+				replies <- hello(h,
+					bson.DocElem{Name: "topologyVersion", Value: before["topologyVersion"]},
+					bson.DocElem{Name: "maxAwaitTimeMS", Value: int64(10000)},
+				)
+			}()
+			So(ioutil.WriteFile(path, []byte("p1:27017\np2:27017 primary\np3:27017\n"), 0644), ShouldBeNil)
+
+			var after bson.M
+			select {
+			case after = <-replies:
+			case <-time.After(5 * time.Second):
+			}
+			So(after, ShouldNotBeNil)
+			So(counterOf(after), ShouldBeGreaterThan, counterOf(before))
+			So(after["isWritablePrimary"], ShouldEqual, true)
+			So(after["hosts"], ShouldResemble, []string{"p1:27017", "p2:27017", "p3:27017"})
+			So(after["electionId"], ShouldNotBeNil)
+		})
+
+		Convey("or when the client disconnects", func() {
+			msg := message(
+				bson.DocElem{Name: "hello", Value: 1},
+				bson.DocElem{Name: "topologyVersion", Value: before["topologyVersion"]},
+				bson.DocElem{Name: "maxAwaitTimeMS", Value: int64(10000)},
+			)
+			msg.Client.Close()
+			res, _ := run(h, msg)
+			So(counterOf(res.Writer.ToBSON()), ShouldEqual, counterOf(before))
+		})
+	})
+
+	Convey("Reject bad replica set settings", t, func() {
+		bad := []bson.M{
+			{"me": "p1:1", "hosts": []interface{}{"p1:1"}},
+			{"name": "rs", "hosts": []interface{}{"p1:1"}},
+			{"name": "rs", "me": "p1:1"},
+			{"name": "rs", "me": "p1:1", "hosts": []interface{}{"p1:1"}, "hostsFile": "/x"},
+			{"name": "rs", "me": "p1:1", "hosts": []interface{}{"p1:1"}, "primary": "p2:1"},
+			{"name": "rs", "me": "p1:1", "hosts": []interface{}{"p1:1"}, "electionId": "nope"},
+			{"name": "rs", "me": "p1:1", "hostsFile": "/no/such/file"},
+		}
+		for _, conf := range bad {
+			So((&Handshake{}).Configure(bson.M{"replicaSet": conf}), ShouldNotBeNil)
+		}
+	})
+
+	Convey("Order electionIds by term", t, func() {
+		first := topologyState{term: 1}.electionID()
+		second := topologyState{term: 2}.electionID()
+		So(string(second), ShouldBeGreaterThan, string(first))
+		So(topologyState{term: 2, conf: replicaSetConfig{electionID: first}}.electionID(), ShouldEqual, first)
+	})
+}
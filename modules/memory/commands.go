@@ -0,0 +1,478 @@
+package memory
+
+import (
+	"fmt"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/memstore"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// a command returns the reply to a request, without "ok", which is added
+// for it.
+type command func(m *Memory, msg *messages.Message) (bson.D, error)
+
+// commands are the commands the module answers, by name.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"insert":          (*Memory).insert,
+		"find":            (*Memory).find,
+		"aggregate":       (*Memory).aggregate,
+		"update":          (*Memory).update,
+		"delete":          (*Memory).delete,
+		"findAndModify":   (*Memory).findAndModify,
+		"findandmodify":   (*Memory).findAndModify,
+		"count":           (*Memory).count,
+		"distinct":        (*Memory).distinct,
+		"create":          (*Memory).create,
+		"drop":            (*Memory).drop,
+		"dropDatabase":    (*Memory).dropDatabase,
+		"listCollections": (*Memory).listCollections,
+		"listDatabases":   (*Memory).listDatabases,
+		"createIndexes":   (*Memory).createIndexes,
+		"dropIndexes":     (*Memory).dropIndexes,
+		"deleteIndexes":   (*Memory).dropIndexes,
+		"listIndexes":     (*Memory).listIndexes,
+	}
+}
+
+// collection returns the collection a command names, failing if it names
+// none.
+func collection(msg *messages.Message) (string, error) {
+	name := msg.Collection()
+	if len(name) == 0 {
+		return "", &memstore.Error{
+			Code:    messages.InvalidNamespace,
+			Message: fmt.Sprintf("collection name has invalid type %T", msg.Body[0].Value),
+		}
+	}
+	return name, nil
+}
+
+// ordered returns whether a write stops at its first error, which it does
+// unless it says otherwise.
+func ordered(msg *messages.Message) bool {
+	value := argument(msg, "ordered")
+	return value == nil || convert.ToBool(value)
+}
+
+// writeReply returns the reply to a write, with the errors of its
+// statements if there were any.
+func writeReply(n int, writeErrors []interface{}) bson.D {
+	reply := bson.D{{Name: "n", Value: n}}
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.DocElem{Name: "writeErrors", Value: writeErrors})
+	}
+	return reply
+}
+
+func (m *Memory) insert(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := documents(msg, "documents")
+	if err != nil {
+		return nil, err
+	}
+
+	n, errs, err := m.store.Insert(msg.Database(), coll, docs, ordered(msg))
+	if err != nil {
+		return nil, err
+	}
+	writeErrors := []interface{}{}
+	for _, e := range errs {
+		writeErrors = append(writeErrors, writeError(e.Index, e.Err))
+	}
+	return writeReply(n, writeErrors), nil
+}
+
+func (m *Memory) find(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	q := memstore.Query{
+		Skip:  convert.ToInt(argument(msg, "skip")),
+		Limit: convert.ToInt(argument(msg, "limit")),
+	}
+	if q.Skip < 0 {
+		return nil, &memstore.Error{Code: messages.BadValue, Message: "skip value must be non-negative"}
+	}
+	if q.Limit < 0 {
+		return nil, &memstore.Error{Code: messages.BadValue, Message: "limit value must be non-negative"}
+	}
+	if q.Filter, err = document(msg, "filter"); err != nil {
+		return nil, err
+	}
+	if q.Sort, err = document(msg, "sort"); err != nil {
+		return nil, err
+	}
+	if q.Projection, err = document(msg, "projection"); err != nil {
+		return nil, err
+	}
+
+	docs, err := m.store.Find(msg.Database(), coll, q)
+	if err != nil {
+		return nil, err
+	}
+	return cursorReply(msg.Database()+"."+coll, docs), nil
+}
+
+func (m *Memory) aggregate(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, ok := argument(msg, "pipeline").([]interface{})
+	if !ok {
+		return nil, &memstore.Error{Code: messages.TypeMismatch, Message: "“pipeline” must be an array"}
+	}
+	if argument(msg, "explain") != nil {
+		return nil, &memstore.Error{Code: messages.IllegalOperation, Message: "explain is not supported"}
+	}
+	if cursor, err := document(msg, "cursor"); err != nil {
+		return nil, err
+	} else if cursor == nil {
+		return nil, &memstore.Error{Code: messages.FailedToParse, Message: "The 'cursor' option is required, except for aggregate with the explain argument"}
+	}
+
+	docs, err := m.store.Aggregate(msg.Database(), coll, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return cursorReply(msg.Database()+"."+coll, docs), nil
+}
+
+// cursorReply returns the reply to a command that opens a cursor, with
+// every document in its first batch. The cursors module splits it into
+// batches.
+func cursorReply(namespace string, docs []bson.D) bson.D {
+	batch := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		batch[i] = doc
+	}
+	return bson.D{{Name: "cursor", Value: bson.D{
+		{Name: "firstBatch", Value: batch},
+		{Name: "id", Value: int64(0)},
+		{Name: "ns", Value: namespace},
+	}}}
+}
+
+func (m *Memory) update(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	statements, err := documents(msg, "updates")
+	if err != nil {
+		return nil, err
+	}
+
+	n, modified := 0, 0
+	upserted := []interface{}{}
+	writeErrors := []interface{}{}
+	for i, statement := range statements {
+		u := memstore.Update{
+			Multi:  convert.ToBool(bsonutil.FindValueByKey("multi", statement)),
+			Upsert: convert.ToBool(bsonutil.FindValueByKey("upsert", statement)),
+		}
+		u.Filter = bsonutil.ToD(bsonutil.FindValueByKey("q", statement))
+		u.Update = updateArgument(bsonutil.FindValueByKey("u", statement))
+		u.ArrayFilters, err = arrayFilters(bsonutil.FindValueByKey("arrayFilters", statement))
+		if u.Update == nil {
+			err = &memstore.Error{Code: messages.FailedToParse, Message: "“u” must be a document or a pipeline"}
+		} else if err == nil {
+			var result memstore.UpdateResult
+			result, err = m.store.Update(msg.Database(), coll, u)
+			n += result.Matched
+			modified += result.Modified
+			if result.UpsertedID != nil {
+				n++
+				upserted = append(upserted, bson.D{
+					{Name: "index", Value: i},
+					{Name: "_id", Value: result.UpsertedID},
+				})
+			}
+		}
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered(msg) {
+				break
+			}
+		}
+	}
+
+	reply := writeReply(n, writeErrors)
+	if len(upserted) > 0 {
+		reply = append(reply, bson.DocElem{Name: "upserted", Value: upserted})
+	}
+	return append(reply, bson.DocElem{Name: "nModified", Value: modified}), nil
+}
+
+func (m *Memory) delete(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	statements, err := documents(msg, "deletes")
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+	writeErrors := []interface{}{}
+	for i, statement := range statements {
+		limit := convert.ToInt(bsonutil.FindValueByKey("limit", statement))
+		if limit != 0 && limit != 1 {
+			err = &memstore.Error{Code: messages.FailedToParse, Message: "The limit field in delete objects must be 0 or 1"}
+		} else {
+			var removed int
+			removed, err = m.store.Delete(msg.Database(), coll, bsonutil.ToD(bsonutil.FindValueByKey("q", statement)), limit)
+			n += removed
+		}
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered(msg) {
+				break
+			}
+		}
+	}
+	return writeReply(n, writeErrors), nil
+}
+
+func (m *Memory) findAndModify(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	f := memstore.FindAndModify{
+		Remove: convert.ToBool(argument(msg, "remove")),
+		Upsert: convert.ToBool(argument(msg, "upsert")),
+		New:    convert.ToBool(argument(msg, "new")),
+	}
+	if f.Query, err = document(msg, "query"); err != nil {
+		return nil, err
+	}
+	if f.Sort, err = document(msg, "sort"); err != nil {
+		return nil, err
+	}
+	if update := argument(msg, "update"); update != nil {
+		if f.Update = updateArgument(update); f.Update == nil {
+			return nil, &memstore.Error{Code: messages.FailedToParse, Message: "“update” must be a document or a pipeline"}
+		}
+	}
+	if f.ArrayFilters, err = arrayFilters(argument(msg, "arrayFilters")); err != nil {
+		return nil, err
+	}
+	if f.Fields, err = document(msg, "fields"); err != nil {
+		return nil, err
+	}
+	switch {
+	case f.Remove && (f.Update != nil || f.Upsert || f.New):
+		return nil, &memstore.Error{Code: messages.FailedToParse, Message: "Cannot specify remove with update, upsert or new"}
+	case !f.Remove && f.Update == nil:
+		return nil, &memstore.Error{Code: messages.FailedToParse, Message: "Either an update or remove=true must be specified"}
+	}
+
+	doc, result, err := m.store.FindAndModify(msg.Database(), coll, f)
+	if err != nil {
+		return nil, err
+	}
+	lastError := bson.D{{Name: "n", Value: result.N}}
+	if !f.Remove {
+		lastError = append(lastError, bson.DocElem{Name: "updatedExisting", Value: result.UpdatedExisting})
+	}
+	if result.UpsertedID != nil {
+		lastError = append(lastError, bson.DocElem{Name: "upserted", Value: result.UpsertedID})
+	}
+	var value interface{}
+	if doc != nil {
+		value = doc
+	}
+	return bson.D{
+		{Name: "lastErrorObject", Value: lastError},
+		{Name: "value", Value: value},
+	}, nil
+}
+
+func (m *Memory) count(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	query, err := document(msg, "query")
+	if err != nil {
+		return nil, err
+	}
+	limit := convert.ToInt(argument(msg, "limit"))
+	if limit < 0 {
+		limit = -limit
+	}
+	n, err := m.store.Count(msg.Database(), coll, query, convert.ToInt(argument(msg, "skip")), limit)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Name: "n", Value: n}}, nil
+}
+
+func (m *Memory) distinct(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := argument(msg, "key").(string)
+	if !ok || len(key) == 0 {
+		return nil, &memstore.Error{Code: messages.FailedToParse, Message: "“key” must be a non-empty string"}
+	}
+	query, err := document(msg, "query")
+	if err != nil {
+		return nil, err
+	}
+	values, err := m.store.Distinct(msg.Database(), coll, key, query)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Name: "values", Value: values}}, nil
+}
+
+func (m *Memory) create(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{}, m.store.Create(msg.Database(), coll)
+}
+
+func (m *Memory) drop(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	was, err := m.store.Drop(msg.Database(), coll)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{
+		{Name: "nIndexesWas", Value: was},
+		{Name: "ns", Value: msg.Database() + "." + coll},
+	}, nil
+}
+
+func (m *Memory) createIndexes(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	specs, err := documentArray("indexes", argument(msg, "indexes"))
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 {
+		return nil, &memstore.Error{Code: messages.BadValue, Message: "Must specify at least one index to create"}
+	}
+	result, err := m.store.CreateIndexes(msg.Database(), coll, specs)
+	if err != nil {
+		return nil, err
+	}
+	reply := bson.D{
+		{Name: "numIndexesBefore", Value: result.Before},
+		{Name: "numIndexesAfter", Value: result.After},
+		{Name: "createdCollectionAutomatically", Value: result.Created},
+	}
+	if len(result.Note) > 0 {
+		reply = append(reply, bson.DocElem{Name: "note", Value: result.Note})
+	}
+	return reply, nil
+}
+
+func (m *Memory) dropIndexes(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	index := argument(msg, "index")
+	if index == nil {
+		return nil, &memstore.Error{Code: messages.FailedToParse, Message: "“index” is required"}
+	}
+	was, err := m.store.DropIndexes(msg.Database(), coll, index)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Name: "nIndexesWas", Value: was}}, nil
+}
+
+func (m *Memory) listIndexes(msg *messages.Message) (bson.D, error) {
+	coll, err := collection(msg)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := m.store.ListIndexes(msg.Database(), coll)
+	if err != nil {
+		return nil, err
+	}
+	return cursorReply(msg.Database()+"."+coll, docs), nil
+}
+
+func (m *Memory) dropDatabase(msg *messages.Message) (bson.D, error) {
+	if err := m.store.DropDatabase(msg.Database()); err != nil {
+		return nil, err
+	}
+	return bson.D{{Name: "dropped", Value: msg.Database()}}, nil
+}
+
+func (m *Memory) listCollections(msg *messages.Message) (bson.D, error) {
+	filter, err := document(msg, "filter")
+	if err != nil {
+		return nil, err
+	}
+	nameOnly := convert.ToBool(argument(msg, "nameOnly"))
+
+	docs := []bson.D{}
+	for _, name := range m.store.ListCollections(msg.Database()) {
+		doc := bson.D{{Name: "name", Value: name}, {Name: "type", Value: "collection"}}
+		if !nameOnly {
+			doc = append(doc,
+				bson.DocElem{Name: "options", Value: bson.D{}},
+				bson.DocElem{Name: "info", Value: bson.D{{Name: "readOnly", Value: false}}},
+			)
+		}
+		ok, err := query.Match(filter, doc)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, doc)
+		}
+	}
+	return cursorReply(msg.Database()+".$cmd.listCollections", docs), nil
+}
+
+func (m *Memory) listDatabases(msg *messages.Message) (bson.D, error) {
+	nameOnly := convert.ToBool(argument(msg, "nameOnly"))
+	databases := []interface{}{}
+	var total int64
+	for _, info := range m.store.ListDatabases() {
+		total += info.SizeOnDisk
+		if nameOnly {
+			databases = append(databases, bson.D{{Name: "name", Value: info.Name}})
+			continue
+		}
+		databases = append(databases, bson.D{
+			{Name: "name", Value: info.Name},
+			{Name: "sizeOnDisk", Value: info.SizeOnDisk},
+			{Name: "empty", Value: info.Empty},
+		})
+	}
+
+	reply := bson.D{{Name: "databases", Value: databases}}
+	if !nameOnly {
+		reply = append(reply, bson.DocElem{Name: "totalSize", Value: total})
+	}
+	return reply, nil
+}
@@ -0,0 +1,240 @@
+// Package memory contains a module that is a MongoDB backend of its own,
+// keeping databases in memory, for testing and for running the proxy
+// without a server behind it.
+package memory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/memstore"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var logger = GetLogger("memory")
+
+// DefaultStore is the name of the store modules share when they name
+// none.
+const DefaultStore = "default"
+
+// The Memory module answers commands from an in-memory store.
+type Memory struct {
+	store *memstore.Store
+
+	// opened is set for stores with a data directory, which the module
+	// releases when it is closed.
+	opened bool
+}
+
+func init() {
+	server.Publish(&Memory{})
+}
+
+func (_ *Memory) New() server.Module {
+	return &Memory{}
+}
+
+func (_ *Memory) Name() string {
+	return "memory"
+}
+
+func (m *Memory) Configure(conf bson.M) error {
+	name := DefaultStore
+	if value, ok := conf["store"]; ok {
+		name, ok = value.(string)
+		if !ok || len(name) == 0 {
+			return fmt.Errorf("“store” must be a non-empty string, not %v", value)
+		}
+	}
+
+	dir, ok := conf["dataDir"]
+	if !ok {
+		for _, option := range []string{"sync", "syncIntervalSecs", "compactSizeMB"} {
+			if _, ok := conf[option]; ok {
+				return fmt.Errorf("“%s” needs a “dataDir”", option)
+			}
+		}
+		m.store = memstore.Shared(name)
+		return nil
+	}
+
+	opts := memstore.Options{}
+	if opts.Dir, ok = dir.(string); !ok || len(opts.Dir) == 0 {
+		return fmt.Errorf("“dataDir” must be a non-empty string, not %v", dir)
+	}
+	if value, ok := conf["sync"]; ok {
+		policy, _ := value.(string)
+		var err error
+		if opts.Sync, err = memstore.ParseSyncPolicy(policy); err != nil {
+			return fmt.Errorf("“sync” must be interval, always or never, not %v", value)
+		}
+	}
+	if value, ok := conf["syncIntervalSecs"]; ok {
+		secs := convert.ToFloat64(value, -1)
+		if secs <= 0 {
+			return fmt.Errorf("“syncIntervalSecs” must be a positive number, not %v", value)
+		}
+		opts.SyncInterval = time.Duration(secs * float64(time.Second))
+	}
+	if value, ok := conf["compactSizeMB"]; ok {
+		mb := convert.ToFloat64(value, -1)
+		if mb <= 0 {
+			return fmt.Errorf("“compactSizeMB” must be a positive number, not %v", value)
+		}
+		opts.CompactSize = int64(mb * (1 << 20))
+	}
+
+	store, err := memstore.SharedOpen(name, opts)
+	if err != nil {
+		return err
+	}
+	m.store, m.opened = store, true
+	return nil
+}
+
+// Close releases the module's store, which is closed once no module
+// holds it, flushing its journal.
+func (m *Memory) Close() error {
+	if !m.opened {
+		return nil
+	}
+	m.opened = false
+	return m.store.Release()
+}
+
+func (m *Memory) Process(req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	msg, err := messages.ToMessageRequest(req)
+	if err != nil {
+		res.Error(messages.CommandNotFound, "the memory module only answers OP_MSG commands")
+		return
+	}
+
+	name := msg.CommandName()
+	command, ok := commands[name]
+	if !ok {
+		res.Error(messages.CommandNotFound, fmt.Sprintf("no such command: '%s'", name))
+		return
+	}
+
+	reply, err := command(m, msg)
+	if err != nil {
+		logger.LogWith(INFO, messages.LogFields(msg), "%s failed: %v", name, err)
+		res.Write(messages.Message{Body: errorBody(err)})
+		return
+	}
+	res.Write(messages.Message{Body: append(reply, bson.DocElem{Name: "ok", Value: 1.0})})
+}
+
+// errorBody returns the body of the error reply for an error.
+func errorBody(err error) bson.D {
+	switch e := err.(type) {
+	case *memstore.Error:
+		return append(messages.ErrorBody(e.Code, e.Message), e.Details...)
+	case *query.Error:
+		return messages.ErrorBody(e.Code, e.Message)
+	}
+	return messages.ErrorBody(messages.InternalError, err.Error())
+}
+
+// writeError returns the document of an error in a write's writeErrors.
+func writeError(index int, err error) bson.D {
+	e, ok := err.(*memstore.Error)
+	if !ok {
+		e = &memstore.Error{Code: messages.InternalError, Message: err.Error()}
+	}
+	doc := bson.D{
+		{Name: "index", Value: index},
+		{Name: "code", Value: e.Code},
+	}
+	if name := messages.ErrorCodeName(e.Code); len(name) > 0 {
+		doc = append(doc, bson.DocElem{Name: "codeName", Value: name})
+	}
+	doc = append(doc, e.Details...)
+	return append(doc, bson.DocElem{Name: "errmsg", Value: e.Message})
+}
+
+// argument returns a command's argument, or nil.
+func argument(msg *messages.Message, name string) interface{} {
+	for _, elem := range msg.Body {
+		if elem.Name == name {
+			return elem.Value
+		}
+	}
+	return nil
+}
+
+// document returns an argument that is a document, failing if it is
+// something else.
+func document(msg *messages.Message, name string) (bson.D, error) {
+	value := argument(msg, name)
+	if value == nil {
+		return nil, nil
+	}
+	doc := bsonutil.ToD(value)
+	if doc == nil {
+		return nil, &memstore.Error{
+			Code:    messages.TypeMismatch,
+			Message: fmt.Sprintf("“%s” must be a document, not %v", name, value),
+		}
+	}
+	return doc, nil
+}
+
+// documents returns the documents of an argument, which come in the body
+// or in a document sequence section of the message.
+func documents(msg *messages.Message, name string) ([]bson.D, error) {
+	if docs, ok := msg.Auxiliary[name]; ok {
+		return docs, nil
+	}
+	return documentArray(name, argument(msg, name))
+}
+
+// documentArray returns the documents of an argument that is an array of
+// them, failing if it is something else.
+func documentArray(name string, value interface{}) ([]bson.D, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, &memstore.Error{
+			Code:    messages.FailedToParse,
+			Message: fmt.Sprintf("“%s” must be an array of documents", name),
+		}
+	}
+	docs := make([]bson.D, len(values))
+	for i, value := range values {
+		if docs[i] = bsonutil.ToD(value); docs[i] == nil {
+			return nil, &memstore.Error{
+				Code:    messages.TypeMismatch,
+				Message: fmt.Sprintf("“%s” must be an array of documents, not %v", name, value),
+			}
+		}
+	}
+	return docs, nil
+}
+
+// updateArgument returns an update, which is a document or a pipeline, an
+// array of stages, or nil if it is neither.
+func updateArgument(value interface{}) interface{} {
+	if doc := bsonutil.ToD(value); doc != nil {
+		return doc
+	}
+	if stages, ok := value.([]interface{}); ok {
+		return stages
+	}
+	return nil
+}
+
+// arrayFilters returns the arrayFilters of an update, if it has them.
+func arrayFilters(value interface{}) ([]bson.D, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return documentArray("arrayFilters", value)
+}
@@ -0,0 +1,275 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func message(body ...bson.DocElem) *messages.Message {
+	return &messages.Message{Body: append(bson.D(body), bson.DocElem{Name: "$db", Value: "shop"})}
+}
+
+// run sends a command to the module and returns the reply's body.
+func run(m *Memory, msg *messages.Message) bson.M {
+	res := messages.ModuleResponse{}
+	m.Process(msg, &res, func(req messages.Requester, res messages.Responder) {
+		panic("the memory module called the next module")
+	})
+	if res.CommandError != nil {
+		return bson.M{"ok": 0, "code": res.CommandError.ErrorCode, "errmsg": res.CommandError.Message}
+	}
+	return res.Writer.(messages.Message).Body.Map()
+}
+
+func firstBatch(reply bson.M) []interface{} {
+	return reply["cursor"].(bson.D).Map()["firstBatch"].([]interface{})
+}
+
+func TestMemory(t *testing.T) {
+	Convey("Answer commands from memory", t, func() {
+		m := &Memory{}
+		So(m.Configure(bson.M{"store": t.Name()}), ShouldBeNil)
+		run(m, message(bson.DocElem{Name: "dropDatabase", Value: 1}))
+
+		reply := run(m, message(
+			bson.DocElem{Name: "insert", Value: "orders"},
+			bson.DocElem{Name: "documents", Value: []interface{}{
+				bson.D{{Name: "_id", Value: 1}, {Name: "item", Value: "pen"}, {Name: "qty", Value: 10}},
+				bson.D{{Name: "_id", Value: 2}, {Name: "item", Value: "ink"}, {Name: "qty", Value: 3}},
+			}},
+		))
+		So(reply["ok"], ShouldEqual, 1)
+		So(reply["n"], ShouldEqual, 2)
+
+		Convey("taking documents from document sequences", func() {
+			msg := message(bson.DocElem{Name: "insert", Value: "orders"})
+			msg.Auxiliary = messages.MessageAuxiliary{"documents": []bson.D{{{Name: "item", Value: "pad"}}}}
+			So(run(m, msg)["n"], ShouldEqual, 1)
+		})
+
+		Convey("reporting duplicate keys as write errors", func() {
+			reply := run(m, message(
+				bson.DocElem{Name: "insert", Value: "orders"},
+				bson.DocElem{Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: 1}}, bson.D{{Name: "_id", Value: 3}}}},
+				bson.DocElem{Name: "ordered", Value: false},
+			))
+			So(reply["ok"], ShouldEqual, 1)
+			So(reply["n"], ShouldEqual, 1)
+			writeErrors := reply["writeErrors"].([]interface{})
+			So(writeErrors, ShouldHaveLength, 1)
+			e := writeErrors[0].(bson.D).Map()
+			So(e["code"], ShouldEqual, messages.DuplicateKey)
+			So(e["keyValue"], ShouldResemble, bson.D{{Name: "_id", Value: 1}})
+		})
+
+		Convey("finding", func() {
+			reply := run(m, message(
+				bson.DocElem{Name: "find", Value: "orders"},
+				bson.DocElem{Name: "filter", Value: bson.D{{Name: "qty", Value: bson.D{{Name: "$gt", Value: 5}}}}},
+				bson.DocElem{Name: "projection", Value: bson.D{{Name: "item", Value: 1}}},
+			))
+			So(reply["ok"], ShouldEqual, 1)
+			So(firstBatch(reply), ShouldResemble, []interface{}{bson.D{{Name: "_id", Value: 1}, {Name: "item", Value: "pen"}}})
+			So(reply["cursor"].(bson.D).Map()["ns"], ShouldEqual, "shop.orders")
+
+			reply = run(m, message(
+				bson.DocElem{Name: "find", Value: "orders"},
+				bson.DocElem{Name: "filter", Value: bson.D{{Name: "qty", Value: bson.D{{Name: "$near", Value: 5}}}}},
+			))
+			So(reply["code"], ShouldEqual, messages.BadValue)
+		})
+
+		Convey("updating and upserting", func() {
+			reply := run(m, message(
+				bson.DocElem{Name: "update", Value: "orders"},
+				bson.DocElem{Name: "updates", Value: []interface{}{
+					bson.D{{Name: "q", Value: bson.D{}}, {Name: "u", Value: bson.D{{Name: "$inc", Value: bson.D{{Name: "qty", Value: 1}}}}}, {Name: "multi", Value: true}},
+					bson.D{{Name: "q", Value: bson.D{{Name: "item", Value: "nib"}}}, {Name: "u", Value: bson.D{{Name: "$set", Value: bson.D{{Name: "qty", Value: 1}}}}}, {Name: "upsert", Value: true}},
+				}},
+			))
+			So(reply["n"], ShouldEqual, 3)
+			So(reply["nModified"], ShouldEqual, 2)
+			So(reply["upserted"], ShouldHaveLength, 1)
+
+			reply = run(m, message(bson.DocElem{Name: "count", Value: "orders"}, bson.DocElem{Name: "query", Value: bson.D{{Name: "qty", Value: 11}}}))
+			So(reply["n"], ShouldEqual, 1)
+		})
+
+		Convey("updating with pipelines and array filters", func() {
+			reply := run(m, message(
+				bson.DocElem{Name: "update", Value: "orders"},
+				bson.DocElem{Name: "updates", Value: []interface{}{
+					bson.D{{Name: "q", Value: bson.D{{Name: "_id", Value: 1}}}, {Name: "u", Value: []interface{}{
+						bson.D{{Name: "$set", Value: bson.D{{Name: "sizes", Value: []interface{}{1, 5, 9}}}}},
+					}}},
+					bson.D{
+						{Name: "q", Value: bson.D{{Name: "_id", Value: 1}}},
+						{Name: "u", Value: bson.D{{Name: "$set", Value: bson.D{{Name: "sizes.$[big]", Value: 0}}}}},
+						{Name: "arrayFilters", Value: []interface{}{bson.D{{Name: "big", Value: bson.D{{Name: "$gt", Value: 4}}}}}},
+					},
+				}},
+			))
+			So(reply["nModified"], ShouldEqual, 2)
+
+			reply = run(m, message(bson.DocElem{Name: "find", Value: "orders"}, bson.DocElem{Name: "filter", Value: bson.D{{Name: "_id", Value: 1}}}))
+			So(firstBatch(reply)[0].(bson.D).Map()["sizes"], ShouldResemble, []interface{}{1, 0, 0})
+		})
+
+		Convey("deleting", func() {
+			reply := run(m, message(
+				bson.DocElem{Name: "delete", Value: "orders"},
+				bson.DocElem{Name: "deletes", Value: []interface{}{bson.D{{Name: "q", Value: bson.D{}}, {Name: "limit", Value: 0}}}},
+			))
+			So(reply["n"], ShouldEqual, 2)
+		})
+
+		Convey("finding and modifying", func() {
+			reply := run(m, message(
+				bson.DocElem{Name: "findAndModify", Value: "orders"},
+				bson.DocElem{Name: "query", Value: bson.D{{Name: "item", Value: "ink"}}},
+				bson.DocElem{Name: "update", Value: bson.D{{Name: "$set", Value: bson.D{{Name: "qty", Value: 0}}}}},
+				bson.DocElem{Name: "new", Value: true},
+			))
+			So(reply["ok"], ShouldEqual, 1)
+			So(reply["value"], ShouldResemble, bson.D{{Name: "_id", Value: 2}, {Name: "item", Value: "ink"}, {Name: "qty", Value: 0}})
+			So(reply["lastErrorObject"], ShouldResemble, bson.D{{Name: "n", Value: 1}, {Name: "updatedExisting", Value: true}})
+
+			reply = run(m, message(
+				bson.DocElem{Name: "findAndModify", Value: "orders"},
+				bson.DocElem{Name: "remove", Value: true},
+				bson.DocElem{Name: "update", Value: bson.D{}},
+			))
+			So(reply["ok"], ShouldEqual, 0)
+		})
+
+		Convey("aggregating", func() {
+			reply := run(m, message(
+				bson.DocElem{Name: "aggregate", Value: "orders"},
+				bson.DocElem{Name: "pipeline", Value: []interface{}{
+					bson.D{{Name: "$group", Value: bson.D{{Name: "_id", Value: nil}, {Name: "qty", Value: bson.D{{Name: "$sum", Value: "$qty"}}}}}},
+				}},
+				bson.DocElem{Name: "cursor", Value: bson.D{}},
+			))
+			So(firstBatch(reply), ShouldResemble, []interface{}{bson.D{{Name: "_id", Value: nil}, {Name: "qty", Value: 13}}})
+
+			reply = run(m, message(
+				bson.DocElem{Name: "aggregate", Value: "orders"},
+				bson.DocElem{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$out", Value: "copy"}}}},
+				bson.DocElem{Name: "cursor", Value: bson.D{}},
+			))
+			So(reply["code"], ShouldEqual, messages.FailedToParse)
+
+			reply = run(m, message(bson.DocElem{Name: "aggregate", Value: "orders"}, bson.DocElem{Name: "pipeline", Value: []interface{}{}}))
+			So(reply["code"], ShouldEqual, messages.FailedToParse)
+		})
+
+		Convey("listing distinct values", func() {
+			reply := run(m, message(bson.DocElem{Name: "distinct", Value: "orders"}, bson.DocElem{Name: "key", Value: "item"}))
+			So(reply["values"], ShouldResemble, []interface{}{"pen", "ink"})
+		})
+
+		Convey("creating, listing and dropping collections", func() {
+			So(run(m, message(bson.DocElem{Name: "create", Value: "orders"}))["code"], ShouldEqual, messages.NamespaceExists)
+			So(run(m, message(bson.DocElem{Name: "create", Value: "items"}))["ok"], ShouldEqual, 1)
+
+			reply := run(m, message(bson.DocElem{Name: "listCollections", Value: 1}, bson.DocElem{Name: "nameOnly", Value: true}))
+			So(firstBatch(reply), ShouldResemble, []interface{}{
+				bson.D{{Name: "name", Value: "items"}, {Name: "type", Value: "collection"}},
+				bson.D{{Name: "name", Value: "orders"}, {Name: "type", Value: "collection"}},
+			})
+			reply = run(m, message(bson.DocElem{Name: "listCollections", Value: 1}, bson.DocElem{Name: "filter", Value: bson.D{{Name: "name", Value: "items"}}}))
+			So(firstBatch(reply), ShouldHaveLength, 1)
+
+			reply = run(m, message(
+				bson.DocElem{Name: "createIndexes", Value: "items"},
+				bson.DocElem{Name: "indexes", Value: []interface{}{
+					bson.D{{Name: "key", Value: bson.D{{Name: "sku", Value: 1}}}, {Name: "name", Value: "sku"}},
+				}},
+			))
+			So(reply["ok"], ShouldEqual, 1)
+			reply = run(m, message(bson.DocElem{Name: "drop", Value: "items"}))
+			So(reply["ok"], ShouldEqual, 1)
+			So(reply["nIndexesWas"], ShouldEqual, 2)
+			So(run(m, message(bson.DocElem{Name: "drop", Value: "items"}))["code"], ShouldEqual, messages.NamespaceNotFound)
+
+			reply = run(m, message(bson.DocElem{Name: "listDatabases", Value: 1}))
+			So(reply["databases"], ShouldHaveLength, 1)
+			So(reply["totalSize"], ShouldBeGreaterThan, 0)
+		})
+
+		Convey("creating, listing and dropping indexes", func() {
+			reply := run(m, message(
+				bson.DocElem{Name: "createIndexes", Value: "orders"},
+				bson.DocElem{Name: "indexes", Value: []interface{}{
+					bson.D{{Name: "key", Value: bson.D{{Name: "item", Value: 1}}}, {Name: "name", Value: "item"}, {Name: "unique", Value: true}},
+				}},
+			))
+			So(reply["ok"], ShouldEqual, 1)
+			So(reply["numIndexesBefore"], ShouldEqual, 1)
+			So(reply["numIndexesAfter"], ShouldEqual, 2)
+			So(reply["createdCollectionAutomatically"], ShouldEqual, false)
+
+			reply = run(m, message(
+				bson.DocElem{Name: "insert", Value: "orders"},
+				bson.DocElem{Name: "documents", Value: []interface{}{bson.D{{Name: "item", Value: "pen"}}}},
+			))
+			e := reply["writeErrors"].([]interface{})[0].(bson.D).Map()
+			So(e["code"], ShouldEqual, messages.DuplicateKey)
+			So(e["keyPattern"], ShouldResemble, bson.D{{Name: "item", Value: 1}})
+			So(e["keyValue"], ShouldResemble, bson.D{{Name: "item", Value: "pen"}})
+
+			reply = run(m, message(bson.DocElem{Name: "listIndexes", Value: "orders"}))
+			So(firstBatch(reply), ShouldHaveLength, 2)
+			So(firstBatch(reply)[1], ShouldResemble, bson.D{
+				{Name: "v", Value: 2},
+				{Name: "key", Value: bson.D{{Name: "item", Value: 1}}},
+				{Name: "name", Value: "item"},
+				{Name: "unique", Value: true},
+			})
+
+			reply = run(m, message(bson.DocElem{Name: "dropIndexes", Value: "orders"}, bson.DocElem{Name: "index", Value: "item"}))
+			So(reply["nIndexesWas"], ShouldEqual, 2)
+			reply = run(m, message(bson.DocElem{Name: "dropIndexes", Value: "orders"}, bson.DocElem{Name: "index", Value: "item"}))
+			So(reply["code"], ShouldEqual, messages.IndexNotFound)
+			reply = run(m, message(bson.DocElem{Name: "listIndexes", Value: "items"}))
+			So(reply["code"], ShouldEqual, messages.NamespaceNotFound)
+		})
+
+		Convey("keeping data over reconfiguration", func() {
+			again := &Memory{}
+			So(again.Configure(bson.M{"store": t.Name()}), ShouldBeNil)
+			So(run(again, message(bson.DocElem{Name: "count", Value: "orders"}))["n"], ShouldEqual, 2)
+		})
+
+		Convey("failing commands it does not know", func() {
+			So(run(m, message(bson.DocElem{Name: "mapReduce", Value: "orders"}))["code"], ShouldEqual, messages.CommandNotFound)
+		})
+	})
+
+	Convey("Validate the configuration", t, func() {
+		So((&Memory{}).Configure(bson.M{"store": 1}), ShouldNotBeNil)
+		So((&Memory{}).Configure(bson.M{"store": ""}), ShouldNotBeNil)
+		So((&Memory{}).Configure(bson.M{"sync": "always"}), ShouldNotBeNil)
+		So((&Memory{}).Configure(bson.M{"dataDir": 1}), ShouldNotBeNil)
+
+		dir := t.TempDir()
+		So((&Memory{}).Configure(bson.M{"dataDir": dir, "sync": "sometimes"}), ShouldNotBeNil)
+		So((&Memory{}).Configure(bson.M{"dataDir": dir, "compactSizeMB": 0}), ShouldNotBeNil)
+		first, second := &Memory{}, &Memory{}
+		So(first.Configure(bson.M{"store": "disk", "dataDir": dir, "sync": "always"}), ShouldBeNil)
+		So(second.Configure(bson.M{"store": "disk", "dataDir": dir, "sync": "always"}), ShouldBeNil)
+		So((&Memory{}).Configure(bson.M{"store": "disk", "dataDir": dir}), ShouldNotBeNil)
+		So((&Memory{}).Configure(bson.M{"store": "disk", "dataDir": t.TempDir()}), ShouldNotBeNil)
+		So((&Memory{}).Configure(bson.M{"store": "other", "dataDir": dir}), ShouldNotBeNil)
+
+		// other options take effect once the store is closed
+		So(first.Close(), ShouldBeNil)
+		So(second.Close(), ShouldBeNil)
+		third := &Memory{}
+		So(third.Configure(bson.M{"store": "disk", "dataDir": dir}), ShouldBeNil)
+		So(third.Close(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,479 @@
+package mockule
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/redact"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const authConfName = "auth"
+
+// auth adds credentials to requests to the backend. Any of its parts may
+// be unset.
+type auth struct {
+	identity *identityHeaders
+	oauth2   *tokenSource
+	hmac     *hmacSigner
+}
+
+// parseAuth reads the “auth” configuration object, which has optional
+// “identity”, “oauth2” and “hmac” objects.
+func parseAuth(conf bson.M) (auth, error) {
+	a := auth{}
+	if conf == nil {
+		return a, nil
+	}
+
+	for name := range conf {
+		switch name {
+		case "identity", "oauth2", "hmac":
+		default:
+			return a, fmt.Errorf("%s: unknown field “%s”", authConfName, name)
+		}
+	}
+
+	var err error
+	if value, ok := conf["identity"]; ok {
+		a.identity, err = parseIdentityHeaders(convert.ToBSONMap(value))
+		if err != nil {
+			return a, err
+		}
+	}
+	if value, ok := conf["oauth2"]; ok {
+		a.oauth2, err = parseTokenSource(convert.ToBSONMap(value))
+		if err != nil {
+			return a, err
+		}
+	}
+	if value, ok := conf["hmac"]; ok {
+		a.hmac, err = parseHMACSigner(convert.ToBSONMap(value), a.identity)
+		if err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+// apply adds credentials to a request for msg. The HMAC signature comes
+// last, so that it covers the identity headers.
+func (a auth) apply(ctx context.Context, client *http.Client, req *http.Request, msg *messages.Message, body []byte) error {
+	if a.identity != nil {
+		a.identity.apply(req, messages.ClientOf(msg))
+	}
+	if a.oauth2 != nil {
+		token, err := a.oauth2.token(ctx, client)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if a.hmac != nil {
+		a.hmac.sign(req, body, time.Now())
+	}
+	return nil
+}
+
+// rejected is called when the backend answers a request with 401, so that
+// a token it no longer accepts is not used again.
+func (a auth) rejected(req *http.Request) {
+	if a.oauth2 != nil {
+		a.oauth2.invalidate(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	}
+}
+
+// readSecret returns the secret in conf[name], or in the file named by
+// conf[name+"File"], which is read again each time the configuration is
+// loaded, so that secrets can be rotated without editing it.
+func readSecret(conf bson.M, section, name string) (string, error) {
+	value, inline := conf[name]
+	file, inFile := conf[name+"File"]
+	switch {
+	case inline && inFile:
+		return "", fmt.Errorf("%s: give “%s” or “%sFile”, not both", section, name, name)
+	case inline:
+		secret, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("%s.%s must be a string", section, name)
+		}
+		return secret, nil
+	case inFile:
+		contents, err := ioutil.ReadFile(convert.ToString(file))
+		if err != nil {
+			return "", fmt.Errorf("%s: failed to read %sFile: %v", section, name, err)
+		}
+		return strings.TrimSpace(string(contents)), nil
+	}
+	return "", fmt.Errorf("%s: missing “%s” or “%sFile”", section, name, name)
+}
+
+// ----------------------------------------------------------------------
+
+// identityHeaders name the headers that tell the backend who the client
+// is. An empty name leaves that header out.
+type identityHeaders struct {
+	user    string
+	appName string
+}
+
+func parseIdentityHeaders(conf bson.M) (*identityHeaders, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("%s.identity must be an object", authConfName)
+	}
+	identity := &identityHeaders{user: "X-MongoDB-User", appName: "X-MongoDB-App-Name"}
+	fields := map[string]*string{
+		"userHeader":    &identity.user,
+		"appNameHeader": &identity.appName,
+	}
+	for name, value := range conf {
+		field, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("%s.identity: unknown field “%s”", authConfName, name)
+		}
+		if *field, ok = value.(string); !ok {
+			return nil, fmt.Errorf("%s.identity.%s must be a string, not %v", authConfName, name, value)
+		}
+	}
+	return identity, nil
+}
+
+// apply sets the identity headers from the client, removing any that are
+// unknown so that other configured headers cannot stand in for them.
+func (h *identityHeaders) apply(req *http.Request, client *messages.Client) {
+	var user, appName string
+	if client != nil {
+		if u := client.User(); u != nil {
+			user = u.String()
+		}
+		appName = client.AppName()
+	}
+
+	set := func(name, value string) {
+		if len(name) == 0 {
+			return
+		}
+		req.Header.Del(name)
+		if len(value) > 0 {
+			req.Header.Set(name, value)
+		}
+	}
+	set(h.user, user)
+	set(h.appName, appName)
+}
+
+// names returns the headers that are set.
+func (h *identityHeaders) names() []string {
+	names := []string{}
+	for _, name := range []string{h.user, h.appName} {
+		if len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ----------------------------------------------------------------------
+
+// an hmacSigner signs requests with a key shared with the backend.
+//
+// The signature is of these lines, joined with newlines: the method; the
+// escaped path and query; the timestamp, in Unix seconds; the hex digest
+// of the body; and “name:value” for each signed header, in the order
+// listed in the signature header, with names in lower case.
+type hmacSigner struct {
+	keyID           string
+	secret          []byte
+	algorithm       string
+	newHash         func() hash.Hash
+	signatureHeader string
+	timestampHeader string
+	signedHeaders   []string
+}
+
+func parseHMACSigner(conf bson.M, identity *identityHeaders) (*hmacSigner, error) {
+	section := authConfName + ".hmac"
+	if conf == nil {
+		return nil, fmt.Errorf("%s must be an object", section)
+	}
+
+	s := &hmacSigner{
+		algorithm:       "sha256",
+		newHash:         sha256.New,
+		signatureHeader: "X-Signature",
+		timestampHeader: "X-Signature-Timestamp",
+	}
+
+	s.keyID = convert.ToString(conf["keyId"])
+	if len(s.keyID) == 0 {
+		return nil, fmt.Errorf("%s: missing “keyId”", section)
+	}
+	secret, err := readSecret(conf, section, "secret")
+	if err != nil {
+		return nil, err
+	}
+	s.secret = []byte(secret)
+
+	if value, ok := conf["algorithm"]; ok {
+		switch value {
+		case "sha256":
+		case "sha512":
+			s.newHash = sha512.New
+		default:
+			return nil, fmt.Errorf("%s.algorithm must be sha256 or sha512, not %v", section, value)
+		}
+		s.algorithm = value.(string)
+	}
+
+	strs := map[string]*string{
+		"signatureHeader": &s.signatureHeader,
+		"timestampHeader": &s.timestampHeader,
+	}
+	for name, field := range strs {
+		if value, ok := conf[name]; ok {
+			if *field = convert.ToString(value); len(*field) == 0 {
+				return nil, fmt.Errorf("%s.%s must be a header name, not %v", section, name, value)
+			}
+		}
+	}
+
+	signed := []string{"Content-Type"}
+	if identity != nil {
+		signed = append(signed, identity.names()...)
+	}
+	if value, ok := conf["signedHeaders"]; ok {
+		extra, err := convert.ConvertToStringSlice(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s.signedHeaders must be an array of strings, not %v", section, value)
+		}
+		signed = append(signed, extra...)
+	}
+	seen := map[string]bool{}
+	for _, name := range signed {
+		name = strings.ToLower(name)
+		if !seen[name] {
+			seen[name] = true
+			s.signedHeaders = append(s.signedHeaders, name)
+		}
+	}
+	sort.Strings(s.signedHeaders)
+
+	redact.AddHeaders(s.signatureHeader)
+
+	return s, nil
+}
+
+// sign adds the timestamp and signature headers to a request.
+func (s *hmacSigner) sign(req *http.Request, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(s.timestampHeader, timestamp)
+
+	req.Header.Set(s.signatureHeader, fmt.Sprintf("keyId=%s,algorithm=hmac-%s,headers=%s,signature=%s",
+		s.keyID, s.algorithm, strings.Join(s.signedHeaders, ";"), s.signature(req, body, timestamp)))
+}
+
+// signature returns the base64 signature of a request.
+func (s *hmacSigner) signature(req *http.Request, body []byte, timestamp string) string {
+	bodyHash := s.newHash()
+	bodyHash.Write(body)
+
+	lines := []string{
+		req.Method,
+		req.URL.RequestURI(),
+		timestamp,
+		hex.EncodeToString(bodyHash.Sum(nil)),
+	}
+	for _, name := range s.signedHeaders {
+		lines = append(lines, name+":"+strings.TrimSpace(req.Header.Get(name)))
+	}
+
+	mac := hmac.New(s.newHash, s.secret)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ----------------------------------------------------------------------
+
+// oauth2Config holds the settings for getting OAuth2 tokens with the
+// client credentials grant. It is comparable, so that mockules configured
+// alike can share tokens.
+type oauth2Config struct {
+	tokenURL      string
+	clientID      string
+	clientSecret  string
+	scopes        string
+	audience      string
+	refreshBefore time.Duration
+}
+
+// a tokenSource gets tokens and caches them until shortly before they
+// expire, or the backend rejects them.
+type tokenSource struct {
+	conf oauth2Config
+
+	// mutex is held while fetching a token, so that requests waiting on
+	// one do not fetch their own.
+	mutex  sync.Mutex
+	cached string
+	expiry time.Time
+}
+
+// tokenSources are the token sources created so far, by configuration.
+// Like transports, they outlive configuration reloads.
+var tokenSources = make(map[oauth2Config]*tokenSource)
+var tokenSourcesMutex sync.Mutex
+
+func parseTokenSource(conf bson.M) (*tokenSource, error) {
+	section := authConfName + ".oauth2"
+	if conf == nil {
+		return nil, fmt.Errorf("%s must be an object", section)
+	}
+
+	oc := oauth2Config{refreshBefore: time.Minute}
+	oc.tokenURL = convert.ToString(conf["tokenUrl"])
+	if _, err := url.ParseRequestURI(oc.tokenURL); err != nil {
+		return nil, fmt.Errorf("%s: “tokenUrl” must be a URL, not %v", section, conf["tokenUrl"])
+	}
+	oc.clientID = convert.ToString(conf["clientId"])
+	if len(oc.clientID) == 0 {
+		return nil, fmt.Errorf("%s: missing “clientId”", section)
+	}
+	var err error
+	oc.clientSecret, err = readSecret(conf, section, "clientSecret")
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := conf["scopes"]; ok {
+		scopes, err := convert.ConvertToStringSlice(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s.scopes must be an array of strings, not %v", section, value)
+		}
+		oc.scopes = strings.Join(scopes, " ")
+	}
+	oc.audience = convert.ToString(conf["audience"])
+	if value, ok := conf["refreshBeforeSecs"]; ok {
+		secs := convert.ToFloat64(value, -1)
+		if secs < 0 {
+			return nil, fmt.Errorf("%s.refreshBeforeSecs must be a non-negative number, not %v", section, value)
+		}
+		oc.refreshBefore = time.Duration(secs * float64(time.Second))
+	}
+
+	tokenSourcesMutex.Lock()
+	defer tokenSourcesMutex.Unlock()
+	if source, ok := tokenSources[oc]; ok {
+		return source, nil
+	}
+	source := &tokenSource{conf: oc}
+	tokenSources[oc] = source
+	return source, nil
+}
+
+// token returns a cached token, or fetches a new one if there is none, or
+// it is about to expire.
+func (t *tokenSource) token(ctx context.Context, client *http.Client) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.cached) > 0 && (t.expiry.IsZero() || time.Now().Add(t.conf.refreshBefore).Before(t.expiry)) {
+		return t.cached, nil
+	}
+
+	token, expiresIn, err := t.fetch(ctx, client)
+	if err != nil {
+		tokenRequests.With("error").Inc()
+		return "", err
+	}
+	tokenRequests.With("ok").Inc()
+
+	t.cached = token
+	t.expiry = time.Time{}
+	if expiresIn > 0 {
+		t.expiry = time.Now().Add(expiresIn)
+	}
+	return token, nil
+}
+
+// invalidate forgets a token, unless it has already been replaced.
+func (t *tokenSource) invalidate(token string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.cached == token {
+		t.cached = ""
+	}
+}
+
+// fetch requests a token with the client credentials grant. Failures to
+// reach the token endpoint are unavailableErrors, like the backend's.
+func (t *tokenSource) fetch(ctx context.Context, client *http.Client) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(t.conf.scopes) > 0 {
+		form.Set("scope", t.conf.scopes)
+	}
+	if len(t.conf.audience) > 0 {
+		form.Set("audience", t.conf.audience)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.conf.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to initialize OAuth2 token request to %s: %v", t.conf.tokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", jsonContentType)
+	req.SetBasicAuth(url.QueryEscape(t.conf.clientID), url.QueryEscape(t.conf.clientSecret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, unavailableError{fmt.Errorf("Failed to request OAuth2 token from %s: %v", t.conf.tokenURL, err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, unavailableError{fmt.Errorf("Failed to read OAuth2 token response from %s: %v", t.conf.tokenURL, err)}
+	}
+	if !httpRespSucceeded(resp) {
+		err := fmt.Errorf("OAuth2 token request to %s failed: %v %s", t.conf.tokenURL, resp.Status, redact.String(string(body)))
+		if httpRespUnavailable(resp) {
+			return "", 0, unavailableError{err}
+		}
+		return "", 0, err
+	}
+
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		TokenType   string      `json:"token_type"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("Failed to parse OAuth2 token response from %s: %v", t.conf.tokenURL, err)
+	}
+	if len(token.AccessToken) == 0 {
+		return "", 0, fmt.Errorf("OAuth2 token response from %s has no access_token", t.conf.tokenURL)
+	}
+	if len(token.TokenType) > 0 && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("OAuth2 token from %s is of unsupported type “%s”", t.conf.tokenURL, token.TokenType)
+	}
+
+	secs, _ := token.ExpiresIn.Float64()
+	return token.AccessToken, time.Duration(secs * float64(time.Second)), nil
+}
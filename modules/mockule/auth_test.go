@@ -0,0 +1,249 @@
+package mockule
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// authenticate runs a SCRAM conversation for user on client, as the proxy
+// records it.
+func authenticate(client *messages.Client, user string) {
+	ok := func(done bool) messages.ModuleResponse {
+		return messages.ModuleResponse{Writer: messages.Message{Body: bson.D{
+			{Name: "conversationId", Value: 1},
+			{Name: "done", Value: done},
+			{Name: "ok", Value: 1.0},
+		}}}
+	}
+	start := &messages.Message{Client: client, Body: bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: "SCRAM-SHA-256"},
+		{Name: "payload", Value: []byte("n,,n=" + user + ",r=nonce")},
+		{Name: "$db", Value: "admin"},
+	}}
+	messages.RecordAuth(start, ok(false))
+	next := &messages.Message{Client: client, Body: bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: 1},
+		{Name: "$db", Value: "admin"},
+	}}
+	messages.RecordAuth(next, ok(true))
+}
+
+func TestIdentityAndHMAC(t *testing.T) {
+	Convey("Sign requests and pass on the client's identity", t, func() {
+		secret := "s3cret"
+		var verified, user, appName string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			user = r.Header.Get("X-MongoDB-User")
+			appName = r.Header.Get("X-App")
+
+			// check the signature as the spec in the README says
+			params := map[string]string{}
+			for _, part := range strings.Split(r.Header.Get("X-Signature"), ",") {
+				kv := strings.SplitN(part, "=", 2)
+				params[kv[0]] = kv[1]
+			}
+			bodyHash := sha256.Sum256(body)
+			lines := []string{r.Method, r.URL.RequestURI(), r.Header.Get("X-Signature-Timestamp"), hex.EncodeToString(bodyHash[:])}
+			for _, name := range strings.Split(params["headers"], ";") {
+				lines = append(lines, name+":"+r.Header.Get(name))
+			}
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(strings.Join(lines, "\n")))
+			if params["keyId"] == "proxy-1" && params["signature"] == base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+				verified = params["headers"]
+			}
+			okHandler(w, r)
+		}))
+		defer ts.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"urlBase": ts.URL + "/op_msg?v=1",
+			"headers": []interface{}{[]interface{}{"X-MongoDB-User", "spoofed"}},
+			"auth": bson.M{
+				"identity": bson.M{"appNameHeader": "X-App"},
+				"hmac":     bson.M{"keyId": "proxy-1", "secret": secret},
+			},
+		}), ShouldBeNil)
+
+		client := messages.NewClient(1, "127.0.0.1:5000")
+		client.SetMetadata(bson.M{"application": bson.M{"name": "reports"}})
+		msg := findMessage()
+		msg.Client = client
+
+		Convey("leaving the user out until the client authenticates", func() {
+			_, err := m.handleOpMsg(msg)
+			So(err, ShouldBeNil)
+			So(verified, ShouldEqual, "content-type;x-app;x-mongodb-user")
+			So(user, ShouldEqual, "")
+			So(appName, ShouldEqual, "reports")
+		})
+
+		Convey("and naming the user after", func() {
+			authenticate(client, "ann=3Dlee")
+			_, err := m.handleOpMsg(msg)
+			So(err, ShouldBeNil)
+			So(verified, ShouldNotBeEmpty)
+			So(user, ShouldEqual, "ann=lee@admin")
+
+			messages.RecordAuth(&messages.Message{Client: client, Body: bson.D{{Name: "logout", Value: 1}}},
+				messages.ModuleResponse{Writer: messages.Message{Body: bson.D{{Name: "ok", Value: 1}}}})
+			So(client.User(), ShouldBeNil)
+		})
+	})
+
+	Convey("Record users of other mechanisms", t, func() {
+		client := messages.NewClient(1, "127.0.0.1:5000")
+		ok := messages.ModuleResponse{Writer: messages.Message{Body: bson.D{
+			{Name: "done", Value: true}, {Name: "ok", Value: 1},
+		}}}
+
+		Convey("PLAIN", func() {
+			messages.RecordAuth(&messages.Message{Client: client, Body: bson.D{
+				{Name: "saslStart", Value: 1},
+				{Name: "mechanism", Value: "PLAIN"},
+				{Name: "payload", Value: bson.Binary{Data: []byte("\x00bob\x00pw")}},
+				{Name: "$db", Value: "$external"},
+			}}, ok)
+			So(client.User(), ShouldResemble, &messages.User{Name: "bob", Database: "$external", Mechanism: "PLAIN"})
+		})
+
+		Convey("speculative SCRAM in the handshake", func() {
+			messages.RecordAuth(&messages.Message{Client: client, Body: bson.D{
+				{Name: "hello", Value: 1},
+				{Name: "speculativeAuthenticate", Value: bson.D{
+					{Name: "saslStart", Value: 1},
+					{Name: "mechanism", Value: "SCRAM-SHA-1"},
+					{Name: "payload", Value: []byte("n,,n=carol,r=x")},
+					{Name: "db", Value: "shop"},
+				}},
+			}}, messages.ModuleResponse{Writer: messages.Message{Body: bson.D{
+				{Name: "speculativeAuthenticate", Value: bson.D{{Name: "done", Value: false}}},
+				{Name: "ok", Value: 1},
+			}}})
+			So(client.User(), ShouldBeNil)
+
+			messages.RecordAuth(&messages.Message{Client: client, Body: bson.D{
+				{Name: "saslContinue", Value: 1},
+			}}, ok)
+			So(client.User().String(), ShouldEqual, "carol@shop")
+		})
+
+		Convey("but not failed conversations", func() {
+			messages.RecordAuth(&messages.Message{Client: client, Body: bson.D{
+				{Name: "authenticate", Value: 1},
+				{Name: "user", Value: "CN=x"},
+			}}, messages.ModuleResponse{Writer: messages.Message{Body: bson.D{{Name: "ok", Value: 0}}}})
+			So(client.User(), ShouldBeNil)
+		})
+	})
+}
+
+func TestOAuth2(t *testing.T) {
+	Convey("Get OAuth2 tokens with client credentials", t, func() {
+		var fetched int32
+		expiresIn := 3600
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, secret, _ := r.BasicAuth()
+			r.ParseForm()
+			if id != "proxy" || secret != "pw" || r.PostForm.Get("grant_type") != "client_credentials" ||
+				r.PostForm.Get("scope") != "read write" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			n := atomic.AddInt32(&fetched, 1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": %d}`, n, expiresIn)
+		}))
+		defer tokenServer.Close()
+
+		var authorization string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			if authorization == "Bearer token-1" && r.Header.Get("X-Revoked") != "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			okHandler(w, r)
+		}))
+		defer ts.Close()
+
+		conf := func(headers ...interface{}) bson.M {
+			return bson.M{
+				"urlBase": ts.URL,
+				"headers": headers,
+				"auth": bson.M{"oauth2": bson.M{
+					"tokenUrl":          tokenServer.URL,
+					"clientId":          "proxy",
+					"clientSecret":      "pw",
+					"scopes":            []interface{}{"read", "write"},
+					"refreshBeforeSecs": 60,
+					"audience":          ts.URL,
+				}},
+			}
+		}
+
+		Convey("caching them until they are about to expire", func() {
+			m := &Mockule{}
+			So(m.Configure(conf()), ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				_, err := m.handleOpMsg(findMessage())
+				So(err, ShouldBeNil)
+			}
+			So(authorization, ShouldEqual, "Bearer token-1")
+			So(atomic.LoadInt32(&fetched), ShouldEqual, 1)
+		})
+
+		Convey("and fetching a new one once the backend rejects it", func() {
+			m := &Mockule{}
+			So(m.Configure(conf([]interface{}{"X-Revoked", "1"})), ShouldBeNil)
+			_, err := m.handleOpMsg(findMessage())
+			So(err, ShouldNotBeNil)
+			_, err = m.handleOpMsg(findMessage())
+			So(err, ShouldBeNil)
+			So(authorization, ShouldEqual, "Bearer token-2")
+		})
+
+		Convey("or when it expires within refreshBeforeSecs", func() {
+			expiresIn = 30
+			m := &Mockule{}
+			So(m.Configure(conf([]interface{}{"X-Other", "1"})), ShouldBeNil)
+			m.handleOpMsg(findMessage())
+			m.handleOpMsg(findMessage())
+			So(atomic.LoadInt32(&fetched), ShouldEqual, 2)
+		})
+	})
+
+	Convey("Reject bad auth settings", t, func() {
+		bad := []bson.M{
+			{"kerberos": bson.M{}},
+			{"hmac": bson.M{"secret": "x"}},
+			{"hmac": bson.M{"keyId": "k"}},
+			{"hmac": bson.M{"keyId": "k", "secret": "x", "secretFile": "/x"}},
+			{"hmac": bson.M{"keyId": "k", "secret": "x", "algorithm": "md5"}},
+			{"oauth2": bson.M{"clientId": "x", "clientSecret": "y"}},
+			{"oauth2": bson.M{"tokenUrl": "http://x", "clientSecret": "y"}},
+			{"identity": bson.M{"userHeader": 1}},
+		}
+		for _, conf := range bad {
+			_, err := parseAuth(conf)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,389 @@
+package mockule
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/balancer"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/clustertime"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	backendsConfName = "backends"
+	balancerConfName = "balancer"
+)
+
+// backendsConfig holds the settings for a group of REST backends that
+// requests are balanced over, in place of a single urlBase.
+type backendsConfig struct {
+	targets []balancer.Target
+	conf    balancer.Config
+
+	// healthPath, if set, is requested from each backend with GET to check
+	// its health. lagHeader, if set, is the response header that gives a
+	// secondary's lag behind the primary, in seconds.
+	healthPath string
+	lagHeader  string
+
+	defaultReadPreference balancer.ReadPreference
+}
+
+// parseBackends reads the “backends” array and “balancer” object.
+func parseBackends(backends interface{}, conf bson.M) (backendsConfig, error) {
+	bc := backendsConfig{
+		conf:                  balancer.DefaultConfig(),
+		defaultReadPreference: balancer.PrimaryOnly,
+	}
+
+	list, err := convert.ConvertToBSONMapSlice(backends)
+	if err != nil || len(list) == 0 {
+		return bc, fmt.Errorf("“%s” must be a non-empty array of documents, not %v", backendsConfName, backends)
+	}
+	for i, backend := range list {
+		t := balancer.Target{Weight: 1, Role: balancer.RolePrimary}
+
+		urlBase, ok := backend[urlBaseConfName].(string)
+		if !ok || len(urlBase) == 0 {
+			return bc, fmt.Errorf("%s[%d].%s must be a string, not %v", backendsConfName, i, urlBaseConfName, backend[urlBaseConfName])
+		}
+		t.Address = urlBase
+
+		if value, ok := backend["weight"]; ok {
+			t.Weight = convert.ToInt(value, 0)
+		}
+		if value, ok := backend["role"]; ok {
+			role, _ := value.(string)
+			t.Role = balancer.Role(role)
+		}
+		if value, ok := backend["tags"]; ok {
+			tags := convert.ToBSONMap(value)
+			if tags == nil {
+				return bc, fmt.Errorf("%s[%d].tags must be a document, not %v", backendsConfName, i, value)
+			}
+			t.Tags = map[string]string{}
+			for name, tag := range tags {
+				str, ok := tag.(string)
+				if !ok {
+					return bc, fmt.Errorf("%s[%d].tags: value of “%s” must be a string, not %v", backendsConfName, i, name, tag)
+				}
+				t.Tags[name] = str
+			}
+		}
+		bc.targets = append(bc.targets, t)
+	}
+
+	if conf == nil {
+		return bc, nil
+	}
+
+	if value, ok := conf["defaultReadPreference"]; ok {
+		if mode, isString := value.(string); isString {
+			value = bson.M{"mode": mode}
+		}
+		bc.defaultReadPreference, err = balancer.ParseReadPreference(value)
+		if err != nil {
+			return bc, fmt.Errorf("%s.defaultReadPreference: %v", balancerConfName, err)
+		}
+	}
+
+	ints := map[string]*int{
+		"unhealthyThreshold": &bc.conf.UnhealthyThreshold,
+		"healthyThreshold":   &bc.conf.HealthyThreshold,
+	}
+	for name, field := range ints {
+		if value, ok := conf[name]; ok {
+			*field = convert.ToInt(value, 0)
+			if *field < 1 {
+				return bc, fmt.Errorf("%s.%s must be a positive integer, not %v", balancerConfName, name, value)
+			}
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"ejectionSecs":           &bc.conf.EjectionTime,
+		"healthCheckSecs":        &bc.conf.HealthCheckInterval,
+		"healthCheckTimeoutSecs": &bc.conf.HealthCheckTimeout,
+		"localThresholdSecs":     &bc.conf.LocalThreshold,
+	}
+	for name, field := range durations {
+		if value, ok := conf[name]; ok {
+			secs := convert.ToFloat64(value, -1)
+			if secs < 0 {
+				return bc, fmt.Errorf("%s.%s must be a non-negative number, not %v", balancerConfName, name, value)
+			}
+			*field = time.Duration(secs * float64(time.Second))
+		}
+	}
+
+	strs := map[string]*string{
+		"healthPath": &bc.healthPath,
+		"lagHeader":  &bc.lagHeader,
+	}
+	for name, field := range strs {
+		if value, ok := conf[name]; ok {
+			str, ok := value.(string)
+			if !ok {
+				return bc, fmt.Errorf("%s.%s must be a string, not %v", balancerConfName, name, value)
+			}
+			*field = str
+		}
+	}
+
+	return bc, nil
+}
+
+// name returns the name of the group: its backends' URLs.
+func (bc backendsConfig) name() string {
+	urls := []string{}
+	for _, t := range bc.targets {
+		urls = append(urls, t.Address)
+	}
+	return strings.Join(urls, ",")
+}
+
+// groups are the backend groups in use, by configuration, so that
+// reloading the configuration neither restarts health checks nor forgets
+// which backend each cursor is on.
+var groups = make(map[string]*sharedGroupEntry)
+var groupsMutex sync.Mutex
+
+// a sharedGroupEntry is a group, and the client of the mockule configured
+// with it last, which makes its health checks.
+type sharedGroupEntry struct {
+	group  *balancer.Group
+	client *http.Client
+
+	key string
+	// refs counts the modules holding the group, guarded by groupsMutex.
+	refs int
+}
+
+func (e *sharedGroupEntry) healthClient() *http.Client {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+	return e.client
+}
+
+// sharedGroup returns the group for a configuration, creating it if no
+// mockule holds one for that configuration, for a module to hold until it
+// calls release. client makes the health checks from then on, so that
+// they use the latest transport.
+func sharedGroup(bc backendsConfig, client *http.Client) (*sharedGroupEntry, error) {
+	key := fmt.Sprintf("%#v", bc)
+
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+
+	if e, ok := groups[key]; ok {
+		e.client = client
+		e.refs++
+		return e, nil
+	}
+	e := &sharedGroupEntry{client: client, key: key, refs: 1}
+
+	targets := []*balancer.Target{}
+	for i := range bc.targets {
+		t := bc.targets[i]
+		targets = append(targets, &t)
+	}
+
+	var check balancer.Checker
+	if len(bc.healthPath) > 0 {
+		check = func(ctx context.Context, t *balancer.Target) (balancer.Health, error) {
+			return checkBackend(ctx, e.healthClient(), t, bc.healthPath, bc.lagHeader)
+		}
+	}
+
+	g, err := balancer.NewGroup(bc.name(), targets, bc.conf, check)
+	if err != nil {
+		return nil, err
+	}
+	e.group = g
+	groups[key] = e
+	return e, nil
+}
+
+// release gives back a group from sharedGroup. Once every module holding
+// it has, its health checks stop.
+func (e *sharedGroupEntry) release() {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+	if e.refs == 0 {
+		return
+	}
+	if e.refs--; e.refs > 0 {
+		return
+	}
+	delete(groups, e.key)
+	e.group.Close()
+}
+
+// checkBackend requests a backend's health path, which must answer with
+// a success.
+func checkBackend(ctx context.Context, client *http.Client, t *balancer.Target, path string, lagHeader string) (balancer.Health, error) {
+	health := balancer.Health{}
+	url := strings.TrimSuffix(t.Address, "/") + "/" + strings.TrimPrefix(path, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return health, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return health, err
+	}
+	resp.Body.Close()
+
+	if !httpRespSucceeded(resp) {
+		return health, fmt.Errorf("Health check of %s responded %s", url, resp.Status)
+	}
+	if len(lagHeader) > 0 {
+		if lag, err := strconv.ParseFloat(resp.Header.Get(lagHeader), 64); err == nil {
+			health.Lag = time.Duration(lag * float64(time.Second))
+		}
+	}
+	return health, nil
+}
+
+// affinityKey returns the key of the backend a request must go to: that
+// of the cursor it continues.
+func affinityKey(msg *messages.Message) string {
+	switch msg.CommandName() {
+	case "getMore":
+		if len(msg.Body) > 0 {
+			collection, _ := bsonutil.FindValueByKey("collection", msg.Body).(string)
+			return cursorAffinity(msg.Database()+"."+collection, convert.ToInt64(msg.Body[0].Value))
+		}
+	case "killCursors":
+		if cursors, ok := bsonutil.FindValueByKey("cursors", msg.Body).([]interface{}); ok && len(cursors) > 0 {
+			return cursorAffinity(msg.Namespace(), convert.ToInt64(cursors[0]))
+		}
+	}
+	return ""
+}
+
+// cursorAffinity returns the affinity key of a cursor. Backends pick
+// their cursor IDs independently, so IDs are only told apart within a
+// namespace.
+func cursorAffinity(ns string, id int64) string {
+	return fmt.Sprintf("cursor:%s:%d", ns, id)
+}
+
+// transactionAffinity returns the key of the backend the statements of a
+// request's transaction go to, and the request's session, if the request
+// is in a transaction.
+func transactionAffinity(msg *messages.Message) (string, *sessions.Session) {
+	info, ok := messages.BodySession(msg.Body)
+	if !ok || !info.InTransaction {
+		return "", nil
+	}
+	s := sessions.Default.SessionOf(msg)
+	if s == nil {
+		return "", nil
+	}
+	return transactionKey(s), s
+}
+
+// transactionKey returns the affinity key of a session's transactions,
+// which are the user's own.
+func transactionKey(s *sessions.Session) string {
+	return "transaction:" + s.ID + ":" + s.User
+}
+
+// pickBackend returns the URL base to send a request to, and a function
+// to call with the reply, if any, and whether the backend failed. Reads
+// outside transactions go where their read preference allows, and
+// everything else to a primary. Every statement of a transaction goes to
+// the backend its first went to.
+func (m *Mockule) pickBackend(msg *messages.Message) (string, func(*messages.Message, bool), error) {
+	if m.backends == nil {
+		return m.urlBase, func(*messages.Message, bool) {}, nil
+	}
+
+	var target *balancer.Target
+	txnKey, session := transactionAffinity(msg)
+	if len(txnKey) > 0 {
+		target = m.backends.PickBound(txnKey)
+	} else if key := affinityKey(msg); len(key) > 0 {
+		target = m.backends.PickBound(key)
+	}
+	bound := target != nil
+
+	if target == nil {
+		pref := balancer.PrimaryOnly
+		if isRead(msg) && bsonutil.FindValueByKey("autocommit", msg.Body) == nil {
+			var err error
+			pref, err = balancer.ReadPreferenceOf(msg.Body, m.defaultReadPreference)
+			if err != nil {
+				return "", nil, err
+			}
+			if after, ok := clustertime.AfterClusterTime(msg.Body); ok {
+				pref.After = clustertime.Time(after)
+			}
+		}
+
+		var err error
+		target, err = m.backends.Pick(pref)
+		if err != nil {
+			return "", nil, unavailableError{err}
+		}
+	}
+
+	done := func(reply *messages.Message, failed bool) {
+		m.backends.Done(target, failed)
+		if reply == nil {
+			return
+		}
+
+		// the transaction's binding lasts until the session lets go of it
+		if session != nil && !bound && !failed {
+			m.backends.Bind(txnKey, target)
+			unbind := func(interface{}) { m.backends.Unbind(txnKey) }
+			if !session.Pin(fmt.Sprintf("mockule %p", m.backends), target, unbind) {
+				m.backends.Unbind(txnKey)
+			}
+		}
+
+		switch msg.CommandName() {
+		case "getMore":
+			if id, _ := replyCursor(reply); id == 0 {
+				m.backends.Unbind(affinityKey(msg))
+			}
+			return
+		case "killCursors":
+			cursors, _ := bsonutil.FindValueByKey("cursors", msg.Body).([]interface{})
+			for _, id := range cursors {
+				m.backends.Unbind(cursorAffinity(msg.Namespace(), convert.ToInt64(id)))
+			}
+			return
+		}
+		if id, ns := replyCursor(reply); id != 0 {
+			if len(ns) == 0 {
+				ns = msg.Namespace()
+			}
+			m.backends.Bind(cursorAffinity(ns, id), target)
+		}
+	}
+	return target.Address, done, nil
+}
+
+// replyCursor returns the ID of the cursor a reply leaves open, or 0, and
+// its namespace, if the reply gives it.
+func replyCursor(reply *messages.Message) (int64, string) {
+	cursor := convert.ToBSONMap(bsonutil.FindValueByKey("cursor", reply.Body))
+	if cursor == nil {
+		return 0, ""
+	}
+	ns, _ := cursor["ns"].(string)
+	return convert.ToInt64(cursor["id"]), ns
+}
@@ -0,0 +1,269 @@
+package mockule
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// backendServer is a REST backend that answers finds with an open cursor
+// and everything else with { ok: 1 }, and names itself in each reply.
+func backendServer(name string, healthy *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if atomic.LoadInt32(healthy) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		req := messages.Message{}
+		buf := make([]byte, r.ContentLength)
+		r.Body.Read(buf)
+		bson.Unmarshal(buf, &req)
+
+		body := bson.D{{Name: "backend", Value: name}, {Name: "ok", Value: 1}}
+		if req.CommandName() == "find" {
+			body = append(body, bson.DocElem{Name: "cursor", Value: bson.D{{Name: "id", Value: int64(7)}}})
+		}
+		out, _ := bson.Marshal(messages.Message{Body: body})
+		w.Header().Set("Content-Type", bsonContentType)
+		w.Write(out)
+	}))
+}
+
+func backendOf(m *Mockule, body ...bson.DocElem) string {
+	reply, err := m.handleOpMsg(&messages.Message{Body: append(bson.D(body), bson.DocElem{Name: "$db", Value: "shop"})})
+	So(err, ShouldBeNil)
+	return reply.Body.Map()["backend"].(string)
+}
+
+func TestBackends(t *testing.T) {
+	Convey("Balance requests over a group of backends", t, func() {
+		up := int32(1)
+		primary := backendServer("primary", &up)
+		defer primary.Close()
+		east := backendServer("east", &up)
+		defer east.Close()
+		west := backendServer("west", &up)
+		defer west.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"backends": []interface{}{
+				bson.M{"urlBase": primary.URL},
+				bson.M{"urlBase": east.URL, "role": "secondary", "tags": bson.M{"dc": "east"}},
+				bson.M{"urlBase": west.URL, "role": "secondary", "tags": bson.M{"dc": "west"}, "weight": 2},
+			},
+			"balancer": bson.M{"defaultReadPreference": "secondaryPreferred"},
+		}), ShouldBeNil)
+		defer m.Close()
+
+		Convey("sending writes to the primary", func() {
+			So(backendOf(m, bson.DocElem{Name: "insert", Value: "orders"}), ShouldEqual, "primary")
+		})
+
+		Convey("spreading reads over the secondaries", func() {
+			seen := map[string]bool{}
+			for i := 0; i < 20; i++ {
+				seen[backendOf(m, bson.DocElem{Name: "count", Value: "orders"})] = true
+			}
+			So(seen, ShouldResemble, map[string]bool{"east": true, "west": true})
+		})
+
+		Convey("following $readPreference", func() {
+			So(backendOf(m,
+				bson.DocElem{Name: "count", Value: "orders"},
+				bson.DocElem{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primary"}}},
+			), ShouldEqual, "primary")
+
+			So(backendOf(m,
+				bson.DocElem{Name: "count", Value: "orders"},
+				bson.DocElem{Name: "$readPreference", Value: bson.D{
+					{Name: "mode", Value: "secondary"},
+					{Name: "tags", Value: []interface{}{bson.D{{Name: "dc", Value: "east"}}}},
+				}},
+			), ShouldEqual, "east")
+		})
+
+		Convey("sending getMore to the backend of its cursor", func() {
+			for i := 0; i < 5; i++ {
+				first := backendOf(m, bson.DocElem{Name: "find", Value: "orders"})
+				So(backendOf(m,
+					bson.DocElem{Name: "getMore", Value: int64(7)},
+					bson.DocElem{Name: "collection", Value: "orders"},
+				), ShouldEqual, first)
+			}
+		})
+
+		Convey("telling apart cursors with the same ID in different namespaces", func() {
+			orders := backendOf(m, bson.DocElem{Name: "find", Value: "orders"})
+			returns := orders
+			for i := 0; i < 50 && returns == orders; i++ {
+				returns = backendOf(m, bson.DocElem{Name: "find", Value: "returns"})
+			}
+			So(returns, ShouldNotEqual, orders)
+
+			So(backendOf(m,
+				bson.DocElem{Name: "getMore", Value: int64(7)},
+				bson.DocElem{Name: "collection", Value: "orders"},
+			), ShouldEqual, orders)
+			So(backendOf(m,
+				bson.DocElem{Name: "getMore", Value: int64(7)},
+				bson.DocElem{Name: "collection", Value: "returns"},
+			), ShouldEqual, returns)
+		})
+
+		Convey("failing reads no backend can serve", func() {
+			msg := &messages.Message{Body: bson.D{
+				{Name: "count", Value: "orders"},
+				{Name: "$readPreference", Value: bson.D{
+					{Name: "mode", Value: "secondary"},
+					{Name: "tags", Value: []interface{}{bson.D{{Name: "dc", Value: "north"}}}},
+				}},
+				{Name: "$db", Value: "shop"},
+			}}
+			_, err := m.handleOpMsg(msg)
+			So(err, ShouldNotBeNil)
+			reply := m.errors.reply(msg, err)
+			So(reply.Body.Map()["code"], ShouldEqual, messages.FailedToSatisfyReadPreference)
+		})
+	})
+
+	Convey("Send every statement of a transaction to one backend", t, func() {
+		up := int32(1)
+		one := backendServer("one", &up)
+		defer one.Close()
+		two := backendServer("two", &up)
+		defer two.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"backends": []interface{}{bson.M{"urlBase": one.URL}, bson.M{"urlBase": two.URL}},
+		}), ShouldBeNil)
+		defer m.Close()
+
+		// run records statements in sessions as proxy core does
+		run := func(body ...bson.DocElem) string {
+			msg := &messages.Message{Body: append(bson.D(body), bson.DocElem{Name: "$db", Value: "shop"})}
+			sessions.Default.Begin(msg)
+			reply, err := m.handleOpMsg(msg)
+			So(err, ShouldBeNil)
+			sessions.Default.Finish(msg, messages.ModuleResponse{Writer: *reply})
+			return reply.Body.Map()["backend"].(string)
+		}
+
+		lsid := bson.DocElem{Name: "lsid", Value: bson.D{{Name: "id", Value: bson.Binary{Kind: 4, Data: []byte("mockule-txn-test")}}}}
+		seen := map[string]bool{}
+		for n := int64(1); n <= 20; n++ {
+			txn := []bson.DocElem{lsid, {Name: "txnNumber", Value: n}, {Name: "autocommit", Value: false}}
+			first := run(append([]bson.DocElem{
+				{Name: "insert", Value: "orders"},
+				{Name: "startTransaction", Value: true},
+			}, txn...)...)
+			seen[first] = true
+			for i := 0; i < 5; i++ {
+				So(run(append([]bson.DocElem{{Name: "update", Value: "orders"}}, txn...)...), ShouldEqual, first)
+			}
+			So(run(append([]bson.DocElem{{Name: "commitTransaction", Value: 1}}, txn...)...), ShouldEqual, first)
+			So(m.backends.PickBound(transactionKey(&sessions.Session{ID: messages.SessionID(bson.Binary{Kind: 4, Data: []byte("mockule-txn-test")})})), ShouldBeNil)
+		}
+		So(len(seen), ShouldEqual, 2)
+	})
+
+	Convey("Take unhealthy backends out of rotation", t, func() {
+		up, down := int32(1), int32(0)
+		primary := backendServer("primary", &up)
+		defer primary.Close()
+		sick := backendServer("sick", &down)
+		defer sick.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"backends": []interface{}{
+				bson.M{"urlBase": primary.URL},
+				bson.M{"urlBase": sick.URL, "role": "secondary"},
+			},
+			"balancer": bson.M{
+				"defaultReadPreference": "secondaryPreferred",
+				"healthPath":            "/health",
+				"healthCheckSecs":       0.01,
+				"unhealthyThreshold":    1,
+				"healthyThreshold":      1,
+			},
+		}), ShouldBeNil)
+		defer m.Close()
+
+		time.Sleep(50 * time.Millisecond)
+		So(backendOf(m, bson.DocElem{Name: "count", Value: "orders"}), ShouldEqual, "primary")
+
+		atomic.StoreInt32(&down, 1)
+		time.Sleep(50 * time.Millisecond)
+		So(backendOf(m, bson.DocElem{Name: "count", Value: "orders"}), ShouldEqual, "sick")
+	})
+}
+
+func TestGroupSharing(t *testing.T) {
+	Convey("Share backend groups until the last mockule holding one is closed", t, func() {
+		var checks int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&checks, 1)
+		}))
+		defer ts.Close()
+		conf := bson.M{
+			"backends": []interface{}{bson.M{"urlBase": ts.URL}},
+			"balancer": bson.M{"healthPath": "/health", "healthCheckSecs": 0.01},
+		}
+
+		one, two := &Mockule{}, &Mockule{}
+		So(one.Configure(conf), ShouldBeNil)
+		So(two.Configure(conf), ShouldBeNil)
+		So(two.backends, ShouldPointTo, one.backends)
+		e := two.group
+		shared := func() bool {
+			groupsMutex.Lock()
+			defer groupsMutex.Unlock()
+			return groups[e.key] == e
+		}
+
+		So(one.Close(), ShouldBeNil)
+		So(shared(), ShouldBeTrue)
+		So(two.Close(), ShouldBeNil)
+		So(shared(), ShouldBeFalse)
+
+		// health checks stop
+		time.Sleep(30 * time.Millisecond)
+		stopped := atomic.LoadInt32(&checks)
+		time.Sleep(50 * time.Millisecond)
+		So(atomic.LoadInt32(&checks), ShouldEqual, stopped)
+	})
+}
+
+func TestParseBackends(t *testing.T) {
+	Convey("Parse the backends configuration", t, func() {
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"urlBase":  "http://a",
+			"backends": []interface{}{bson.M{"urlBase": "http://b"}},
+		}), ShouldNotBeNil)
+
+		for _, backends := range []interface{}{
+			[]interface{}{},
+			[]interface{}{bson.M{"weight": 1}},
+			[]interface{}{bson.M{"urlBase": "http://a", "role": "arbiter"}},
+			[]interface{}{bson.M{"urlBase": "http://a", "tags": bson.M{"rack": 1}}},
+		} {
+			So((&Mockule{}).Configure(bson.M{"backends": backends}), ShouldNotBeNil)
+		}
+
+		_, err := parseBackends([]interface{}{bson.M{"urlBase": "http://a"}}, bson.M{"defaultReadPreference": "fastest"})
+		So(err, ShouldNotBeNil)
+	})
+}
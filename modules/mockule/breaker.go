@@ -0,0 +1,120 @@
+package mockule
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const breakerConfName = "circuitBreaker"
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// A breaker is a circuit breaker for the REST backend. After enough
+// consecutive requests find the backend unavailable, it opens, and
+// requests fail at once instead of waiting on the backend. Once it has
+// been open for a while, it lets one request through to test the
+// backend, and closes again if that request succeeds.
+//
+// A nil breaker never opens.
+type breaker struct {
+	url       string
+	threshold int
+	openFor   time.Duration
+
+	mutex    sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// parseBreaker reads the “circuitBreaker” configuration object. Without
+// one, requests are never cut off.
+func parseBreaker(url string, conf bson.M) (*breaker, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	b := &breaker{
+		url:       url,
+		threshold: 5,
+		openFor:   30 * time.Second,
+	}
+	if value, ok := conf["failureThreshold"]; ok {
+		b.threshold = convert.ToInt(value, 0)
+		if b.threshold < 1 {
+			return nil, fmt.Errorf("%s.failureThreshold must be a positive integer, not %v", breakerConfName, value)
+		}
+	}
+	if value, ok := conf["openSecs"]; ok {
+		secs := convert.ToFloat64(value, -1)
+		if secs <= 0 {
+			return nil, fmt.Errorf("%s.openSecs must be a positive number, not %v", breakerConfName, value)
+		}
+		b.openFor = time.Duration(secs * float64(time.Second))
+	}
+	return b, nil
+}
+
+// allow returns whether a request may be sent to the backend.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		// let this request through as the trial
+		b.state = breakerHalfOpen
+		logger.Log(NOTICE, "Circuit breaker for %s is half-open; testing the backend", b.url)
+		return true
+	case breakerHalfOpen:
+		// a trial request is already in flight
+		return false
+	}
+	return true
+}
+
+// record records whether a request found the backend available.
+func (b *breaker) record(available bool) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if available {
+		if b.state != breakerClosed {
+			logger.Log(NOTICE, "Circuit breaker for %s closed", b.url)
+			circuitOpen.With(b.url).Set(0)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state == breakerClosed {
+			logger.Log(WARNING, "Circuit breaker for %s opened after %d failures", b.url, b.failures)
+			circuitOpen.With(b.url).Set(1)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,103 @@
+package mockule
+
+import (
+	"fmt"
+	"mime"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	contentTypeConfName = "contentType"
+	extJSONModeConfName = "extendedJsonMode"
+
+	jsonContentType = "application/json"
+)
+
+// an encoding is how the request envelope is sent to the REST backend:
+// as BSON, or as Extended JSON in one of its modes. Either way, the
+// envelope has the same fields: requestid, flagbits, main and auxiliary.
+type encoding struct {
+	contentType string
+	mode        bsonutil.ExtJSONMode
+}
+
+// parseEncoding reads the “contentType” and “extendedJsonMode” options.
+func parseEncoding(conf bson.M) (encoding, error) {
+	enc := encoding{contentType: bsonContentType, mode: bsonutil.Canonical}
+
+	if value, ok := conf[contentTypeConfName]; ok {
+		switch value {
+		case bsonContentType, jsonContentType:
+			enc.contentType = value.(string)
+		default:
+			return enc, fmt.Errorf("“%s” must be %s or %s, not %v", contentTypeConfName, bsonContentType, jsonContentType, value)
+		}
+	}
+
+	if value, ok := conf[extJSONModeConfName]; ok {
+		switch value {
+		case "canonical":
+			enc.mode = bsonutil.Canonical
+		case "relaxed":
+			enc.mode = bsonutil.Relaxed
+		default:
+			return enc, fmt.Errorf("“%s” must be canonical or relaxed, not %v", extJSONModeConfName, value)
+		}
+	}
+
+	return enc, nil
+}
+
+// accept returns the Accept header for requests: the backend may answer
+// in either encoding, though the one requests are sent in is preferred.
+func (e encoding) accept() string {
+	if e.contentType == jsonContentType {
+		return jsonContentType + ", " + bsonContentType + ";q=0.9"
+	}
+	return bsonContentType + ", " + jsonContentType + ";q=0.9"
+}
+
+// encode returns the body of the request for msg.
+func (e encoding) encode(msg *messages.Message) ([]byte, error) {
+	raw, err := bson.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal parsed OP_MSG to BSON: %v", err)
+	}
+	if e.contentType == bsonContentType {
+		return raw, nil
+	}
+
+	// going through BSON keeps the envelope's field names and types the
+	// same in both encodings
+	var envelope bson.D
+	if err := bson.Unmarshal(raw, &envelope); err != nil {
+		return nil, fmt.Errorf("Failed to convert OP_MSG to Extended JSON: %v", err)
+	}
+	body, err := bsonutil.MarshalExtJSON(envelope, e.mode)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to convert OP_MSG to Extended JSON: %v", err)
+	}
+	return body, nil
+}
+
+// responseBSON returns the body of a response as BSON, converting it from
+// Extended JSON if need be. It returns false if the content type is
+// neither.
+func responseBSON(contentType string, body []byte) ([]byte, bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case bsonContentType:
+		return body, true, nil
+	case jsonContentType:
+		doc, err := bsonutil.UnmarshalExtJSONDoc(body)
+		if err != nil {
+			return nil, true, err
+		}
+		raw, err := bson.Marshal(doc)
+		return raw, true, err
+	}
+	return nil, false, nil
+}
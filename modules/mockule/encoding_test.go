@@ -0,0 +1,95 @@
+package mockule
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestExtendedJSON(t *testing.T) {
+	Convey("Talk to a backend in Extended JSON", t, func() {
+		id := bson.NewObjectId()
+
+		var contentType, accept string
+		var received []byte
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			accept = r.Header.Get("Accept")
+			received, _ = ioutil.ReadAll(r.Body)
+
+			reply := bson.D{{Name: "main", Value: bson.D{
+				{Name: "cursor", Value: bson.D{
+					{Name: "firstBatch", Value: []interface{}{
+						bson.D{{Name: "_id", Value: id}, {Name: "n", Value: int64(1) << 40}},
+					}},
+					{Name: "id", Value: int64(0)},
+					{Name: "ns", Value: "shop.orders"},
+				}},
+				{Name: "ok", Value: 1.0},
+			}}}
+			body, _ := bsonutil.MarshalExtJSON(reply, bsonutil.Canonical)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write(body)
+		}))
+		defer ts.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"urlBase":          ts.URL,
+			"contentType":      "application/json",
+			"extendedJsonMode": "relaxed",
+		}), ShouldBeNil)
+
+		msg := findMessage()
+		msg.Body = append(msg.Body, bson.DocElem{Name: "filter", Value: bson.D{{Name: "_id", Value: id}}})
+		reply, err := m.handleOpMsg(msg)
+		So(err, ShouldBeNil)
+
+		Convey("sending the request as Extended JSON", func() {
+			So(contentType, ShouldEqual, "application/json")
+			So(accept, ShouldStartWith, "application/json")
+
+			doc, err := bsonutil.UnmarshalExtJSONDoc(received)
+			So(err, ShouldBeNil)
+			main := bsonutil.FindValueByKey("main", doc).(bson.D)
+			So(main[0], ShouldResemble, bson.DocElem{Name: "find", Value: "orders"})
+			filter := bsonutil.FindValueByKey("filter", main).(bson.D)
+			So(filter, ShouldResemble, bson.D{{Name: "_id", Value: id}})
+		})
+
+		Convey("and reading the reply's types back", func() {
+			cursor := bsonutil.FindValueByKey("cursor", reply.Body).(bson.D)
+			batch := bsonutil.FindValueByKey("firstBatch", cursor).([]interface{})
+			So(batch, ShouldResemble, []interface{}{
+				bson.D{{Name: "_id", Value: id}, {Name: "n", Value: int64(1) << 40}},
+			})
+		})
+	})
+
+	Convey("Read either encoding, whichever is sent", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"main": {"ok": {"$numberInt": "1"}}}`))
+		}))
+		defer ts.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{"urlBase": ts.URL}), ShouldBeNil)
+
+		reply, err := m.handleOpMsg(findMessage())
+		So(err, ShouldBeNil)
+		So(reply.Body, ShouldResemble, bson.D{{Name: "ok", Value: 1}})
+	})
+
+	Convey("Reject bad encoding settings", t, func() {
+		_, err := parseEncoding(bson.M{"contentType": "text/plain"})
+		So(err, ShouldNotBeNil)
+		_, err = parseEncoding(bson.M{"extendedJsonMode": "shell"})
+		So(err, ShouldNotBeNil)
+	})
+}
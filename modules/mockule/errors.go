@@ -0,0 +1,322 @@
+package mockule
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/mongodbinc-interns/mongoproxy/balancer"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const errorMappingConfName = "errorMapping"
+
+// an httpError is a response from the backend that is not a usable reply,
+// kept so that it can be mapped to a MongoDB error.
+type httpError struct {
+	status int
+	header http.Header
+	body   []byte
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+// an errorRule is the MongoDB error that a kind of HTTP response maps to.
+type errorRule struct {
+	code int32
+
+	// errmsg replaces the message from the response, if set.
+	errmsg string
+
+	labels []string
+
+	// writeError makes the reply a successful command with a write error,
+	// as mongod replies to writes that fail, such as on a duplicate key.
+	// Other commands get the error as usual.
+	writeError bool
+}
+
+// writeCommands are the commands whose failures may be write errors.
+var writeCommands = map[string]bool{
+	"insert":        true,
+	"update":        true,
+	"delete":        true,
+	"findAndModify": true,
+}
+
+// defaultErrorRules map HTTP statuses, or classes of them such as "4xx",
+// to MongoDB errors. Configured rules take precedence.
+var defaultErrorRules = map[string]errorRule{
+	"400": {code: messages.BadValue},
+	"401": {code: messages.AuthenticationFailed},
+	"403": {code: messages.Unauthorized},
+	"404": {code: messages.NamespaceNotFound},
+	"409": {code: messages.DuplicateKey, writeError: true},
+	"429": {code: messages.HostUnreachable},
+	"500": {code: messages.InternalError},
+	"503": {code: messages.HostUnreachable},
+	"504": {code: messages.NetworkTimeout},
+	"4xx": {code: messages.CommandFailed},
+	"5xx": {code: messages.HostUnreachable},
+}
+
+// errorBodySchema names the fields of the error documents that the REST
+// service may send with failure responses, as JSON or BSON. Fields may be
+// dotted paths. Fields found in the body override the status's rule.
+type errorBodySchema struct {
+	code        string
+	codeName    string
+	errmsg      string
+	errorLabels string
+	writeErrors string
+}
+
+// an errorMapping turns failures to get a reply from the backend into
+// MongoDB error replies.
+type errorMapping struct {
+	rules map[string]errorRule
+	body  errorBodySchema
+}
+
+// parseErrorMapping reads the “errorMapping” configuration object, which
+// has optional “statuses” and “body” objects.
+func parseErrorMapping(conf bson.M) (errorMapping, error) {
+	mapping := errorMapping{
+		rules: make(map[string]errorRule),
+		body: errorBodySchema{
+			code:        "code",
+			codeName:    "codeName",
+			errmsg:      "errmsg",
+			errorLabels: "errorLabels",
+			writeErrors: "writeErrors",
+		},
+	}
+	if conf == nil {
+		return mapping, nil
+	}
+
+	for status, value := range convert.ToBSONMap(conf["statuses"]) {
+		if !validStatusKey(status) {
+			return mapping, fmt.Errorf("%s: “%s” is not an HTTP status or a class like 4xx", errorMappingConfName, status)
+		}
+		rule, err := parseErrorRule(convert.ToBSONMap(value))
+		if err != nil {
+			return mapping, fmt.Errorf("%s: status %s: %v", errorMappingConfName, status, err)
+		}
+		mapping.rules[status] = rule
+	}
+
+	fields := map[string]*string{
+		"code":        &mapping.body.code,
+		"codeName":    &mapping.body.codeName,
+		"errmsg":      &mapping.body.errmsg,
+		"errorLabels": &mapping.body.errorLabels,
+		"writeErrors": &mapping.body.writeErrors,
+	}
+	for name, value := range convert.ToBSONMap(conf["body"]) {
+		field, ok := fields[name]
+		if !ok {
+			return mapping, fmt.Errorf("%s.body: unknown field “%s”", errorMappingConfName, name)
+		}
+		path, ok := value.(string)
+		if !ok {
+			return mapping, fmt.Errorf("%s.body.%s must be a string, not %v", errorMappingConfName, name, value)
+		}
+		*field = path
+	}
+
+	return mapping, nil
+}
+
+func validStatusKey(key string) bool {
+	if len(key) == 3 && key[1:] == "xx" {
+		return key[0] >= '1' && key[0] <= '5'
+	}
+	status, err := strconv.Atoi(key)
+	return err == nil && status >= 100 && status <= 599
+}
+
+func parseErrorRule(conf bson.M) (errorRule, error) {
+	rule := errorRule{}
+	if conf == nil {
+		return rule, fmt.Errorf("must be an object")
+	}
+
+	if name, ok := conf["codeName"]; ok {
+		code, known := messages.ErrorCodeByName(convert.ToString(name))
+		if !known {
+			return rule, fmt.Errorf("unknown codeName %v; give a code instead", name)
+		}
+		rule.code = code
+	}
+	if code, ok := conf["code"]; ok {
+		rule.code = convert.ToInt32(code)
+	}
+	if rule.code == 0 {
+		return rule, fmt.Errorf("needs a code or codeName")
+	}
+
+	if errmsg, ok := conf["errmsg"]; ok {
+		rule.errmsg = convert.ToString(errmsg)
+	}
+	if labels, ok := conf["errorLabels"]; ok {
+		var err error
+		rule.labels, err = convert.ConvertToStringSlice(labels)
+		if err != nil {
+			return rule, fmt.Errorf("errorLabels: %v", err)
+		}
+	}
+	if writeError, ok := conf["writeError"]; ok {
+		rule.writeError = convert.ToBool(writeError)
+	}
+	return rule, nil
+}
+
+// rule returns the rule for an HTTP status: a configured rule for the
+// status or its class, then a default one, falling back to InternalError.
+func (e errorMapping) rule(status int) errorRule {
+	exact := strconv.Itoa(status)
+	class := exact[:1] + "xx"
+	for _, rules := range []map[string]errorRule{e.rules, defaultErrorRules} {
+		if rule, ok := rules[exact]; ok {
+			return rule
+		}
+		if rule, ok := rules[class]; ok {
+			return rule
+		}
+	}
+	return errorRule{code: messages.InternalError}
+}
+
+// reply returns the error reply to msg for an error from handleOpMsg.
+func (e errorMapping) reply(msg *messages.Message, err error) messages.Message {
+	var failure *httpError
+	if errors.As(err, &failure) && (failure.status < 200 || failure.status >= 300) {
+		rule := e.rule(failure.status)
+		errmsg := fmt.Sprintf("REST backend responded %d %s", failure.status, http.StatusText(failure.status))
+		if len(rule.errmsg) > 0 {
+			errmsg = rule.errmsg
+		}
+		if body := decodeErrorBody(failure); body != nil {
+			return e.replyFromBody(msg, rule, errmsg, body)
+		}
+		return rule.reply(msg, errmsg)
+	}
+
+	// no response, or one that could not be used
+	rule := errorRule{code: messages.InternalError}
+	switch {
+	case errors.Is(err, balancer.ErrNoTarget):
+		rule.code = messages.FailedToSatisfyReadPreference
+	case isUnavailable(err):
+		rule.code = messages.HostUnreachable
+	}
+	return rule.reply(msg, err.Error())
+}
+
+// replyFromBody returns the reply for a failure response whose body is an
+// error document, taking what it can from the body and the rest from rule.
+func (e errorMapping) replyFromBody(msg *messages.Message, rule errorRule, errmsg string, body bson.M) messages.Message {
+	if raw := bsonutil.FindDeepValueInMap(e.body.writeErrors, body); raw != nil && writeCommands[msg.CommandName()] {
+		writeErrors, err := convert.ConvertToBSONMapSlice(raw)
+		if err == nil && len(writeErrors) > 0 {
+			return messages.Message{Body: bson.D{
+				{Name: "ok", Value: 1},
+				{Name: "n", Value: 0},
+				{Name: "writeErrors", Value: writeErrors},
+			}}
+		}
+	}
+
+	if name := bsonutil.FindDeepValueInMap(e.body.codeName, body); name != nil {
+		if code, ok := messages.ErrorCodeByName(convert.ToString(name)); ok {
+			rule.code = code
+		}
+	}
+	if code := bsonutil.FindDeepValueInMap(e.body.code, body); code != nil {
+		rule.code = convert.ToInt32(code, rule.code)
+	}
+	if message := convert.ToString(bsonutil.FindDeepValueInMap(e.body.errmsg, body)); len(message) > 0 {
+		errmsg = message
+	}
+	if labels := bsonutil.FindDeepValueInMap(e.body.errorLabels, body); labels != nil {
+		if parsed, err := convert.ConvertToStringSlice(labels); err == nil {
+			rule.labels = parsed
+		}
+	}
+	return rule.reply(msg, errmsg)
+}
+
+// decodeErrorBody returns the body of a failure response as a document, or
+// nil if it is neither JSON nor BSON.
+func decodeErrorBody(failure *httpError) bson.M {
+	if len(failure.body) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(failure.header.Get("Content-Type"))
+
+	body := bson.M{}
+	switch mediaType {
+	case bsonContentType:
+		if bson.Unmarshal(failure.body, &body) != nil {
+			return nil
+		}
+	case jsonContentType, "application/problem+json":
+		doc, err := bsonutil.UnmarshalExtJSONDoc(failure.body)
+		if err != nil {
+			return nil
+		}
+		body = doc.Map()
+	default:
+		return nil
+	}
+	return body
+}
+
+// reply returns the MongoDB reply to msg for the rule, with the given
+// error message. Retryable writes that fail with a retryable code are
+// labeled as such.
+func (r errorRule) reply(msg *messages.Message, errmsg string) messages.Message {
+	if r.writeError && writeCommands[msg.CommandName()] {
+		writeError := bson.D{
+			{Name: "index", Value: 0},
+			{Name: "code", Value: r.code},
+		}
+		if name := messages.ErrorCodeName(r.code); len(name) > 0 {
+			writeError = append(writeError, bson.DocElem{Name: "codeName", Value: name})
+		}
+		writeError = append(writeError, bson.DocElem{Name: "errmsg", Value: errmsg})
+		return messages.Message{Body: bson.D{
+			{Name: "ok", Value: 1},
+			{Name: "n", Value: 0},
+			{Name: "writeErrors", Value: []interface{}{writeError}},
+		}}
+	}
+
+	body := messages.ErrorBody(r.code, errmsg)
+	labels := append([]string(nil), r.labels...)
+	if messages.IsRetryableCode(r.code) && isRetryableWrite(msg) && !hasLabel(labels, messages.RetryableWriteLabel) {
+		labels = append(labels, messages.RetryableWriteLabel)
+	}
+	if len(labels) > 0 {
+		body = append(body, bson.DocElem{Name: "errorLabels", Value: labels})
+	}
+	return messages.Message{Body: body}
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package mockule
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// replyFrom configures a mockule against a server that always answers
+// with the given status, content type and body, and returns the reply
+// that Process writes for msg.
+func replyFrom(conf bson.M, status int, contentType string, body []byte, msg *messages.Message) bson.M {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(contentType) > 0 {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	conf["urlBase"] = ts.URL
+	m := &Mockule{}
+	So(m.Configure(conf), ShouldBeNil)
+
+	res := &messages.ModuleResponse{}
+	m.Process(msg, res, nil)
+	So(res.Writer, ShouldNotBeNil)
+	return res.Writer.ToBSON()
+}
+
+func TestErrorMapping(t *testing.T) {
+	Convey("Map failure responses to MongoDB errors", t, func() {
+		Convey("by default", func() {
+			reply := replyFrom(bson.M{}, http.StatusNotFound, "", nil, findMessage())
+			So(reply["ok"], ShouldEqual, 0)
+			So(reply["code"], ShouldEqual, messages.NamespaceNotFound)
+			So(reply["codeName"], ShouldEqual, "NamespaceNotFound")
+			So(reply["errmsg"], ShouldEqual, "REST backend responded 404 Not Found")
+		})
+
+		Convey("as write errors", func() {
+			reply := replyFrom(bson.M{}, http.StatusConflict, "", nil, insertMessage(false))
+			So(reply["ok"], ShouldEqual, 1)
+			writeErrors := reply["writeErrors"].([]interface{})
+			So(len(writeErrors), ShouldEqual, 1)
+			So(writeErrors[0].(bson.D).Map()["code"], ShouldEqual, messages.DuplicateKey)
+
+			// but only for writes
+			reply = replyFrom(bson.M{}, http.StatusConflict, "", nil, findMessage())
+			So(reply["ok"], ShouldEqual, 0)
+			So(reply["code"], ShouldEqual, messages.DuplicateKey)
+			So(reply["writeErrors"], ShouldBeNil)
+		})
+
+		Convey("with retryable write labels", func() {
+			reply := replyFrom(bson.M{}, http.StatusTooManyRequests, "", nil, insertMessage(true))
+			So(reply["code"], ShouldEqual, messages.HostUnreachable)
+			So(reply["errorLabels"], ShouldResemble, []string{messages.RetryableWriteLabel})
+		})
+
+		Convey("by configured statuses and classes", func() {
+			conf := bson.M{"errorMapping": bson.M{"statuses": bson.M{
+				"404": bson.M{"codeName": "CommandNotFound", "errmsg": "no such route"},
+				"4xx": bson.M{"code": 96, "errorLabels": []interface{}{"NoRetry"}},
+			}}}
+			reply := replyFrom(conf, http.StatusNotFound, "", nil, findMessage())
+			So(reply["code"], ShouldEqual, messages.CommandNotFound)
+			So(reply["errmsg"], ShouldEqual, "no such route")
+
+			reply = replyFrom(conf, http.StatusGone, "", nil, findMessage())
+			So(reply["code"], ShouldEqual, messages.OperationFailed)
+			So(reply["errorLabels"], ShouldResemble, []string{"NoRetry"})
+
+			// unconfigured statuses keep their defaults
+			reply = replyFrom(conf, http.StatusServiceUnavailable, "", nil, findMessage())
+			So(reply["code"], ShouldEqual, messages.HostUnreachable)
+		})
+
+		Convey("from JSON error bodies", func() {
+			conf := bson.M{"errorMapping": bson.M{"body": bson.M{
+				"codeName": "error.name",
+				"errmsg":   "error.message",
+			}}}
+			body := []byte(`{"error": {"name": "DocumentValidationFailure", "message": "total must be positive"}}`)
+			reply := replyFrom(conf, http.StatusBadRequest, "application/json; charset=utf-8", body, insertMessage(false))
+			So(reply["code"], ShouldEqual, messages.DocumentValidationFailure)
+			So(reply["errmsg"], ShouldEqual, "total must be positive")
+		})
+
+		Convey("from BSON error bodies with write errors", func() {
+			body, _ := bson.Marshal(bson.M{"writeErrors": []bson.M{
+				{"index": 1, "code": 11000, "errmsg": "duplicate key"},
+			}})
+			reply := replyFrom(bson.M{}, http.StatusBadRequest, bsonContentType, body, insertMessage(false))
+			So(reply["ok"], ShouldEqual, 1)
+			writeErrors := reply["writeErrors"].([]bson.M)
+			So(writeErrors[0]["index"], ShouldEqual, 1)
+		})
+
+		Convey("answering unusable successes with InternalError", func() {
+			reply := replyFrom(bson.M{}, http.StatusOK, "text/html", []byte("<html>"), findMessage())
+			So(reply["code"], ShouldEqual, messages.InternalError)
+		})
+	})
+}
+
+func TestParseErrorMapping(t *testing.T) {
+	Convey("Reject invalid error mappings", t, func() {
+		_, err := parseErrorMapping(bson.M{"statuses": bson.M{"4x4": bson.M{"code": 2}}})
+		So(err, ShouldNotBeNil)
+
+		_, err = parseErrorMapping(bson.M{"statuses": bson.M{"404": bson.M{"codeName": "NoSuchName"}}})
+		So(err, ShouldNotBeNil)
+
+		_, err = parseErrorMapping(bson.M{"statuses": bson.M{"404": bson.M{"errmsg": "missing code"}}})
+		So(err, ShouldNotBeNil)
+
+		_, err = parseErrorMapping(bson.M{"body": bson.M{"reason": "why"}})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,52 @@
+package mockule
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+)
+
+var httpResponses = metrics.NewCounterVec("mongoproxy_mockule_http_responses_total",
+	"Responses from the REST backend, by HTTP status code, or \"error\" if the request failed.",
+	"status")
+
+var httpSeconds = metrics.NewHistogramVec("mongoproxy_mockule_http_request_seconds",
+	"Time taken by requests to the REST backend, by HTTP status code.",
+	nil, "status")
+
+var retries = metrics.NewCounterVec("mongoproxy_mockule_retries_total",
+	"Requests resent to the REST backend after it was unavailable, by backend URL.",
+	"url")
+
+var hedgedRequests = metrics.NewCounterVec("mongoproxy_mockule_hedged_requests_total",
+	"Reads sent to the REST backend a second time because the first was slow, by backend URL.",
+	"url")
+
+var circuitOpen = metrics.NewGaugeVec("mongoproxy_mockule_circuit_open",
+	"Whether the circuit breaker for a REST backend is open (1) or not (0), by backend URL.",
+	"url")
+
+var circuitRejections = metrics.NewCounterVec("mongoproxy_mockule_circuit_rejections_total",
+	"Requests failed without being sent because the circuit breaker was open, by backend URL.",
+	"url")
+
+var tokenRequests = metrics.NewCounterVec("mongoproxy_mockule_oauth2_token_requests_total",
+	"Requests for OAuth2 tokens, by result: \"ok\" or \"error\".",
+	"result")
+
+func init() {
+	metrics.MustRegister(httpResponses, httpSeconds, retries, hedgedRequests,
+		circuitOpen, circuitRejections, tokenRequests)
+}
+
+// observeHttp records the outcome of a request to the REST backend that
+// started at start. A status of 0 means the request failed without a response.
+func observeHttp(status int, start time.Time) {
+	label := "error"
+	if status != 0 {
+		label = strconv.Itoa(status)
+	}
+	httpResponses.With(label).Inc()
+	httpSeconds.With(label).ObserveDuration(time.Since(start))
+}
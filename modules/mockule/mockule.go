@@ -1,16 +1,22 @@
-// Package mockule contains a module that can be used as a mock backend for
-// proxy core, which stores inserts and queries finds in memory.
+// Package mockule contains a module that serves as a backend for proxy
+// core by sending requests to a REST service over HTTP. For a backend that
+// keeps its data in memory, see the memory module.
 package mockule
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"net/http"
 	"fmt"
 	"io"
 	"time"
 
+	"github.com/mongodbinc-interns/mongoproxy/balancer"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
 	. "github.com/mongodbinc-interns/mongoproxy/log"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/redact"
 	"github.com/mongodbinc-interns/mongoproxy/server"
 	"gopkg.in/mgo.v2/bson"
 /*
@@ -31,19 +37,29 @@ const (
 	maxWireVersion = 17
 )
 
-// a 'database' in memory. The string keys are the collections, which
-// have an array of bson documents.
-var database = make(map[string][]bson.D)
+var logger = GetLogger("mockule")
 
 type headerType [2]string
 
-// The Mockule is a mock module used for testing. It currently
-// logs requests and sends valid but generally nonsense responses back to
-// the client, without touching mongod.
+// The Mockule is a backend module that answers requests by POSTing them
+// to a REST service, without touching mongod.
 type Mockule struct {
-	httpClient   http.Client
+	httpClient   *http.Client
 	urlBase      string
 	extraHeaders []headerType
+
+	// backends, if set, is the group of backends to balance requests
+	// over, in place of urlBase.
+	backends              *balancer.Group
+	group                 *sharedGroupEntry
+	defaultReadPreference balancer.ReadPreference
+
+	router       router
+	auth         auth
+	encoding     encoding
+	retry        retryPolicy
+	breaker      *breaker
+	errors       errorMapping
 }
 
 func init() {
@@ -59,47 +75,137 @@ func (_ *Mockule) Name() string {
 }
 
 func (m *Mockule) Configure(conf bson.M) error {
-	urlBase, exists := conf[urlBaseConfName]
-	if !exists {
-		return fmt.Errorf("Missing “%s” in config!", urlBaseConfName)
+	var bc *backendsConfig
+	if backends, exists := conf[backendsConfName]; exists {
+		if _, both := conf[urlBaseConfName]; both {
+			return fmt.Errorf("Give either “%s” or “%s” in config, not both", urlBaseConfName, backendsConfName)
+		}
+		parsed, err := parseBackends(backends, convert.ToBSONMap(conf[balancerConfName]))
+		if err != nil {
+			return err
+		}
+		bc = &parsed
+		m.urlBase = bc.name()
+	} else {
+		urlBase, exists := conf[urlBaseConfName]
+		if !exists {
+			return fmt.Errorf("Missing “%s” in config!", urlBaseConfName)
+		}
+
+		urlBaseStr, ok := urlBase.(string)
+		if !ok {
+			return fmt.Errorf("“%s” must be a string, not %v", urlBaseConfName, urlBase)
+		}
+
+		// TODO: Validate?
+		m.urlBase = urlBaseStr
 	}
 
-	urlBaseStr, ok := urlBase.(string)
-	if !ok {
-		return fmt.Errorf("“%s” must be a string, not %v", urlBaseConfName, urlBase)
+	tc, err := parseTransportConfig(convert.ToBSONMap(conf[transportConfName]))
+	if err != nil {
+		return err
+	}
+	transport, err := sharedTransport(tc)
+	if err != nil {
+		return err
+	}
+	m.httpClient = &http.Client{
+		Transport: transport,
+		Timeout:   tc.requestTimeout,
+	}
+
+	m.encoding, err = parseEncoding(conf)
+	if err != nil {
+		return err
+	}
+	m.retry, err = parseRetryPolicy(convert.ToBSONMap(conf[retryConfName]))
+	if err != nil {
+		return err
+	}
+	m.breaker, err = parseBreaker(m.urlBase, convert.ToBSONMap(conf[breakerConfName]))
+	if err != nil {
+		return err
+	}
+	m.errors, err = parseErrorMapping(convert.ToBSONMap(conf[errorMappingConfName]))
+	if err != nil {
+		return err
 	}
 
-	// TODO: Validate?
-	m.urlBase = urlBaseStr
+	m.router, err = parseRouter(conf)
+	if err != nil {
+		return err
+	}
+	m.auth, err = parseAuth(convert.ToBSONMap(conf[authConfName]))
+	if err != nil {
+		return err
+	}
 
-	headers, exists := conf[headersConfName]
-	if exists {
-		array, ok := headers.([]interface{})
-		if !ok {
-			return fmt.Errorf("“%s” must be an array, not %v", headersConfName, array)
+	if headers, exists := conf[headersConfName]; exists {
+		m.extraHeaders, err = parseHeaders(headers)
+		if err != nil {
+			return err
 		}
+	}
 
-		for _, cur := range array {
-			curArray, ok := cur.([]interface{})
-			if !ok || len(curArray) != 2 {
-				return fmt.Errorf("“%s” must be an array of 2-member arrays. (Found: %v)", headersConfName, cur)
-			}
+	// the group is taken last, so that a bad configuration does not hold it
+	var group *sharedGroupEntry
+	if bc != nil {
+		group, err = sharedGroup(*bc, m.httpClient)
+		if err != nil {
+			return err
+		}
+		m.defaultReadPreference = bc.defaultReadPreference
+	}
+	m.Close()
+	m.group = group
+	m.backends = nil
+	if group != nil {
+		m.backends = group.group
+	}
+	return nil
+}
 
-			key, ok := curArray[0].(string)
-			if !ok {
-				return fmt.Errorf("%s: Found non-string header name: %v", headersConfName, curArray[0])
-			}
+// Close releases the module's backend group, whose health checks stop
+// once no module holds it.
+func (m *Mockule) Close() error {
+	if m.group != nil {
+		m.group.release()
+		m.group = nil
+	}
+	return nil
+}
 
-			val, ok := curArray[1].(string)
-			if !ok {
-				return fmt.Errorf("%s: Found non-string header value: %v", headersConfName, curArray[1])
-			}
+// parseHeaders reads an array of [name, value] pairs of HTTP headers.
+func parseHeaders(headers interface{}) ([]headerType, error) {
+	array, ok := headers.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("“%s” must be an array, not %v", headersConfName, headers)
+	}
+
+	parsed := []headerType{}
+	for _, cur := range array {
+		curArray, ok := cur.([]interface{})
+		if !ok || len(curArray) != 2 {
+			return nil, fmt.Errorf("“%s” must be an array of 2-member arrays. (Found: %v)", headersConfName, cur)
+		}
 
-			m.extraHeaders = append( m.extraHeaders, headerType{key, val} )
+		key, ok := curArray[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: Found non-string header name: %v", headersConfName, curArray[0])
 		}
+
+		val, ok := curArray[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: Found non-string header value: %v", headersConfName, curArray[1])
+		}
+
+		parsed = append(parsed, headerType{key, val})
+
+		// configured headers usually carry credentials
+		redact.AddHeaders(key)
 	}
 
-	return nil
+	return parsed, nil
 }
 
 func (m *Mockule) Process(req messages.Requester, res messages.Responder,
@@ -109,7 +215,7 @@ func (m *Mockule) Process(req messages.Requester, res messages.Responder,
 		case messages.MessageType:
 			message, err := messages.ToMessageRequest(req)
 			if err != nil {
-				Log(ERROR, "ToMessageRequest: %v", err)
+				logger.Log(ERROR, "ToMessageRequest: %v", err)
 				break
 			}
 
@@ -118,9 +224,14 @@ func (m *Mockule) Process(req messages.Requester, res messages.Responder,
 				res.Write(*reply)
 				return
 			} else {
-				Log(ERROR, "%v", err)
+				logger.LogWith(ERROR, messages.LogFields(message), "%v", err)
 			}
 
+			// answer with a MongoDB error rather than leave the client
+			// waiting for a reply that no module will give
+			res.Write(m.errors.reply(message, err))
+			return
+
 		case messages.CommandType:
 			command, err := messages.ToCommandRequest(req)
 			if err != nil {
@@ -145,11 +256,11 @@ func (m *Mockule) Process(req messages.Requester, res messages.Responder,
 					res.Write(reply)
 					return
 				default:
-					Log(ERROR, "Unrecognized OP_QUERY command: %s", command.CommandName)
+					logger.Log(ERROR, "Unrecognized OP_QUERY command: %s", command.CommandName)
 			}
 
 		default:
-			Log(ERROR, "Unrecognized request type: %s", req.Type())
+			logger.Log(ERROR, "Unrecognized request type: %s", req.Type())
 	}
 	
 	next(req, res)
@@ -157,98 +268,154 @@ func (m *Mockule) Process(req messages.Requester, res messages.Responder,
 
 // ----------------------------------------------------------------------
 
-func (m *Mockule) getPostUrl() string {
-	urlBase := m.urlBase
+func (m *Mockule) handleOpMsg(msg *messages.Message) (*messages.Message, error) {
+	logger.Log(DEBUG, "Marshalling BSON: %v", msg)
 
-	// Tolerate trailing slash:
-	if urlBase[len(urlBase)-2:] == "/" {
-		urlBase = urlBase[:len(urlBase)-2]
+	reqBody, err := m.encoding.encode(msg)
+	if err != nil {
+		return nil, err
 	}
 
-	//return urlBase + "/op_msg";
-	return urlBase
+	return m.send(msg, reqBody)
 }
 
-func (m *Mockule) handleOpMsg(msg *messages.Message) (*messages.Message, error) {
-	Log(DEBUG, "Marshalling BSON: %v", msg)
-
-	reqBody, err := bson.Marshal(msg)
+// post sends one HTTP request for msg to the REST backend, and parses its
+// response. Failures that mean the backend could not serve the request
+// are returned as unavailableErrors.
+func (m *Mockule) post(ctx context.Context, msg *messages.Message, reqBody []byte) (reply *messages.Message, err error) {
+	urlBase, done, err := m.pickBackend(msg)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal parsed OP_MSG to BSON: %v", err)
+		return nil, err
+	}
+	defer func() {
+		// a hedged request canceled for being slower says nothing about
+		// the backend's health
+		canceled := errors.Is(ctx.Err(), context.Canceled)
+		done(reply, isUnavailable(err) && !canceled)
+	}()
+
+	rt := m.router.route(msg)
+	url := rt.expandURL(urlBase, msg)
+
+	if rt.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rt.timeout)
+		defer cancel()
 	}
 
-	url := m.getPostUrl()
-
-	httpReq, err := http.NewRequest(
-		httpMethod,
+	httpReq, err := http.NewRequestWithContext(
+		ctx,
+		rt.method,
 		url,
 		bytes.NewReader(reqBody),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to initialize HTTP %s request to %s: %v", httpMethod, m.getPostUrl(), err)
+		return nil, fmt.Errorf("Failed to initialize HTTP %s request to %s: %v", rt.method, url, err)
 	}
 
 	for _, hdr := range m.extraHeaders {
 		httpReq.Header.Add(hdr[0], hdr[1])
 	}
 
-	httpReq.Header.Set("Content-Type", bsonContentType)
+	// the route's headers replace any of the same name
+	for _, hdr := range rt.headers {
+		httpReq.Header.Del(hdr[0])
+	}
+	for _, hdr := range rt.headers {
+		httpReq.Header.Add(hdr[0], hdr[1])
+	}
+
+	httpReq.Header.Set("Content-Type", m.encoding.contentType)
+	httpReq.Header.Set("Accept", m.encoding.accept())
+
+	err = m.auth.apply(ctx, m.getHttpClient(), httpReq, msg, reqBody)
+	if err != nil {
+		return nil, err
+	}
 
-	Log(DEBUG, "Sending HTTP request %d: %v", msg.RequestID, httpReq)
+	logger.Log(DEBUG, "Sending HTTP request %d: %v", msg.RequestID, redact.Request(httpReq))
 
+	start := time.Now()
 	resp, err := m.getHttpClient().Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to send HTTP POST to %s: %v", m.getPostUrl(), err)
+		observeHttp(0, start)
+		return nil, unavailableError{fmt.Errorf("Failed to send HTTP %s to %s: %v", rt.method, url, err)}
 	}
+	observeHttp(resp.StatusCode, start)
+
+	// the connection only goes back to the pool once the body is closed
+	defer resp.Body.Close()
 
-	Log(DEBUG, "HTTP response %d: %v", msg.RequestID, resp)
+	logger.Log(DEBUG, "HTTP response %d: %v", msg.RequestID, redact.Response(resp))
 
 	// Every case needs the body, so we read it proactively.
 	body, readErr := io.ReadAll(resp.Body)
 
 	if !httpRespSucceeded(resp) {
 		if readErr != nil {
-			Log(ERROR, "Failed to read non-success HTTP response body: %v", readErr)
+			logger.Log(ERROR, "Failed to read non-success HTTP response body: %v", readErr)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			m.auth.rejected(httpReq)
 		}
 
-		return nil, fmt.Errorf("Received HTTP failure response: %v %s", resp, string(body))
+		err := &httpError{
+			status: resp.StatusCode,
+			header: resp.Header,
+			body:   body,
+			err:    fmt.Errorf("Received HTTP failure response: %v %s", redact.Response(resp), redact.String(string(body))),
+		}
+		if httpRespUnavailable(resp) {
+			return nil, unavailableError{err}
+		}
+		return nil, err
 	}
 
-	Log(DEBUG, "HTTP response is a success")
+	logger.Log(DEBUG, "HTTP response is a success")
 
-	if resp.Header.Get("Content-Type") != bsonContentType {
+	bsonBody, supported, err := responseBSON(resp.Header.Get("Content-Type"), body)
+	if !supported {
 		if readErr != nil {
-			Log(ERROR, "Failed to read non-BSON HTTP response body: %v", readErr)
+			logger.Log(ERROR, "Failed to read non-BSON HTTP response body: %v", readErr)
 		}
 
-		return nil, fmt.Errorf("Received non-BSON HTTP response: %v %s", resp, string(body))
+		return nil, &httpError{
+			status: resp.StatusCode,
+			header: resp.Header,
+			body:   body,
+			err:    fmt.Errorf("Received non-BSON HTTP response: %v %s", redact.Response(resp), redact.String(string(body))),
+		}
 	}
 
-	Log(DEBUG, "HTTP response is the right content type")
+	logger.Log(DEBUG, "HTTP response is the right content type")
 
 	if readErr != nil {
 		return nil, fmt.Errorf("Failed to read HTTP response body: %v", readErr)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse HTTP response body as Extended JSON: %v", err)
+	}
 
-	Log(DEBUG, "Got HTTP response body")
+	logger.Log(DEBUG, "Got HTTP response body")
 
 	respMsg := messages.Message{}
-	err = bson.Unmarshal(body, &respMsg)
+	err = bson.Unmarshal(bsonBody, &respMsg)
 	if err != nil {
 		return nil, fmt.Errorf("Failed parse HTTP response body as BSON: %v", err)
 	}
 
 	if 0 == len(respMsg.Body) {
 		generic := bson.D{}
-		err2 := bson.Unmarshal(body, &generic)
+		err2 := bson.Unmarshal(bsonBody, &generic)
 		if err2 == nil {
-			return nil, fmt.Errorf("Response body (%v) schema is wrong", generic)
+			return nil, fmt.Errorf("Response body (%v) schema is wrong", redact.Value(generic))
 		}
 
 		return nil, fmt.Errorf("Response body (failed to parse: %v) schema is wrong", err2)
 	}
 
-	Log(DEBUG, "Unmarshalled BSON: %v", respMsg)
+	logger.Log(DEBUG, "Unmarshalled BSON: %v", respMsg)
 
 	return &respMsg, nil
 }
@@ -257,12 +424,15 @@ func httpRespSucceeded(resp *http.Response) bool {
 	return resp.StatusCode >= 200 && resp.StatusCode < 300
 }
 
-func (m *Mockule) getHttpClient() *http.Client {
-//	if (nil == m.httpClient.Transport) {
-		m.httpClient.Transport = &http.Transport{
-			IdleConnTimeout: maxTimeoutSecs * time.Second,
-		}
-//	}
+// httpRespUnavailable returns whether a response says the backend cannot
+// serve requests right now, rather than that the request was bad.
+func httpRespUnavailable(resp *http.Response) bool {
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
 
-	return &m.httpClient;
+// getHttpClient returns the client for requests to the REST backend. Its
+// transport is shared with every mockule configured with the same
+// transport settings.
+func (m *Mockule) getHttpClient() *http.Client {
+	return m.httpClient
 }
@@ -0,0 +1,233 @@
+package mockule
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const retryConfName = "retry"
+
+// readCommands are the commands that can safely be sent to the backend
+// more than once.
+var readCommands = map[string]bool{
+	"find":            true,
+	"aggregate":       true,
+	"count":           true,
+	"distinct":        true,
+	"listCollections": true,
+	"listIndexes":     true,
+	"listDatabases":   true,
+	"dbStats":         true,
+	"collStats":       true,
+	"explain":         true,
+	"ping":            true,
+	"hello":           true,
+	"isMaster":        true,
+	"ismaster":        true,
+	"buildInfo":       true,
+	"buildinfo":       true,
+}
+
+// an unavailableError is a failure to get any answer from the backend, as
+// opposed to an answer that could not be used. Only these are retried.
+type unavailableError struct {
+	err error
+}
+
+func (e unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e unavailableError) Unwrap() error {
+	return e.err
+}
+
+func isUnavailable(err error) bool {
+	_, ok := err.(unavailableError)
+	return ok
+}
+
+// retryPolicy is how requests that find the backend unavailable are
+// retried. The zero value sends every request once.
+type retryPolicy struct {
+	// maxAttempts is the number of times a request is sent, including
+	// the first. Only idempotent requests are sent more than once.
+	maxAttempts int
+
+	// retries wait for a random duration up to initialBackoff, doubling
+	// with each retry up to maxBackoff.
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	// if hedgeDelay is positive, a read that has not been answered after
+	// hedgeDelay is sent again, and whichever answer comes first is used.
+	hedgeDelay time.Duration
+}
+
+// parseRetryPolicy reads the “retry” configuration object.
+func parseRetryPolicy(conf bson.M) (retryPolicy, error) {
+	policy := retryPolicy{
+		maxAttempts:    1,
+		initialBackoff: 50 * time.Millisecond,
+		maxBackoff:     2 * time.Second,
+	}
+	if conf == nil {
+		return policy, nil
+	}
+
+	if value, ok := conf["maxAttempts"]; ok {
+		policy.maxAttempts = convert.ToInt(value, 0)
+		if policy.maxAttempts < 1 {
+			return policy, fmt.Errorf("%s.maxAttempts must be a positive integer, not %v", retryConfName, value)
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"initialBackoffMs": &policy.initialBackoff,
+		"maxBackoffMs":     &policy.maxBackoff,
+		"hedgeDelayMs":     &policy.hedgeDelay,
+	}
+	for name, field := range durations {
+		if value, ok := conf[name]; ok {
+			ms := convert.ToFloat64(value, -1)
+			if ms < 0 {
+				return policy, fmt.Errorf("%s.%s must be a non-negative number, not %v", retryConfName, name, value)
+			}
+			*field = time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+
+	return policy, nil
+}
+
+// backoff returns how long to wait before the given retry, counting from
+// 1: a random duration up to the capped exponential backoff, so that
+// clients retrying together spread out.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	limit := p.initialBackoff
+	for i := 1; i < retry && limit < p.maxBackoff; i++ {
+		limit *= 2
+	}
+	if limit > p.maxBackoff {
+		limit = p.maxBackoff
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// isRead returns whether msg is a command that only reads, outside of a
+// transaction. Statements of a transaction must reach the backend once,
+// and in order, whatever they do.
+func isRead(msg *messages.Message) bool {
+	name := msg.CommandName()
+	if !readCommands[name] {
+		return false
+	}
+	if info, ok := messages.BodySession(msg.Body); ok && info.InTransaction {
+		return false
+	}
+	if name == "aggregate" {
+		// $out and $merge write, and are always the last stage
+		stages, err := convert.ConvertToBSONDocSlice(bsonutil.FindValueByKey("pipeline", msg.Body))
+		if err == nil && len(stages) > 0 {
+			last := stages[len(stages)-1]
+			if len(last) > 0 && (last[0].Name == "$out" || last[0].Name == "$merge") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isRetryableWrite returns whether msg is a retryable write: a write with
+// a transaction number outside of a multi-document transaction, which the
+// backend applies at most once however often it is sent.
+func isRetryableWrite(msg *messages.Message) bool {
+	return bsonutil.FindValueByKey("txnNumber", msg.Body) != nil &&
+		bsonutil.FindValueByKey("autocommit", msg.Body) == nil
+}
+
+// send sends msg to the backend following the retry policy, unless the
+// circuit breaker has opened.
+func (m *Mockule) send(msg *messages.Message, reqBody []byte) (*messages.Message, error) {
+	read := isRead(msg)
+	idempotent := read || isRetryableWrite(msg)
+
+	for attempt := 1; ; attempt++ {
+		if !m.breaker.allow() {
+			circuitRejections.With(m.urlBase).Inc()
+			return nil, unavailableError{fmt.Errorf("Circuit breaker for %s is open", m.urlBase)}
+		}
+
+		var reply *messages.Message
+		var err error
+		if read && m.retry.hedgeDelay > 0 {
+			reply, err = m.postHedged(msg, reqBody)
+		} else {
+			reply, err = m.post(context.Background(), msg, reqBody)
+		}
+		m.breaker.record(!isUnavailable(err))
+
+		if !isUnavailable(err) || !idempotent || attempt >= m.retry.maxAttempts {
+			return reply, err
+		}
+
+		wait := m.retry.backoff(attempt)
+		logger.LogWith(WARNING, messages.LogFields(msg), "Retrying in %v after attempt %d failed: %v", wait, attempt, err)
+		retries.With(m.urlBase).Inc()
+		time.Sleep(wait)
+	}
+}
+
+// postHedged sends msg to the backend, and sends it again if there is no
+// answer within the hedge delay, returning the first success, or the last
+// failure. The slower request is canceled.
+func (m *Mockule) postHedged(msg *messages.Message, reqBody []byte) (*messages.Message, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		reply *messages.Message
+		err   error
+	}
+	results := make(chan result, 2)
+	launch := func() {
+		go func() {
+			reply, err := m.post(ctx, msg, reqBody)
+			results <- result{reply, err}
+		}()
+	}
+
+	launch()
+	pending := 1
+	hedged := false
+	timer := time.NewTimer(m.retry.hedgeDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			launch()
+			pending++
+			hedged = true
+			hedgedRequests.With(m.urlBase).Inc()
+		case r := <-results:
+			pending--
+			// a request that fails before the hedge is sent is left to
+			// the retry policy
+			if r.err == nil || !hedged || pending == 0 {
+				return r.reply, r.err
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package mockule
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// flakyServer fails the first failures requests with a 503, and answers
+// the rest with okHandler. It counts the requests it receives.
+func flakyServer(failures int32, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		okHandler(w, r)
+	}))
+}
+
+func findMessage() *messages.Message {
+	return &messages.Message{Body: bson.D{
+		{Name: "find", Value: "orders"},
+		{Name: "$db", Value: "shop"},
+	}}
+}
+
+func insertMessage(txnNumber bool) *messages.Message {
+	body := bson.D{{Name: "insert", Value: "orders"}, {Name: "$db", Value: "shop"}}
+	if txnNumber {
+		body = append(body, bson.DocElem{Name: "txnNumber", Value: int64(1)})
+	}
+	return &messages.Message{Body: body}
+}
+
+func TestRetries(t *testing.T) {
+	Convey("Retry requests when the backend is unavailable", t, func() {
+		var requests int32
+		ts := flakyServer(2, &requests)
+		defer ts.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"urlBase": ts.URL,
+			"retry":   bson.M{"maxAttempts": 3, "initialBackoffMs": 1},
+		}), ShouldBeNil)
+
+		Convey("for reads", func() {
+			reply, err := m.handleOpMsg(findMessage())
+			So(err, ShouldBeNil)
+			So(reply.Body, ShouldResemble, bson.D{{Name: "ok", Value: 1}})
+			So(atomic.LoadInt32(&requests), ShouldEqual, 3)
+		})
+
+		Convey("for retryable writes", func() {
+			_, err := m.handleOpMsg(insertMessage(true))
+			So(err, ShouldBeNil)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 3)
+		})
+
+		Convey("but not for other writes", func() {
+			_, err := m.handleOpMsg(insertMessage(false))
+			So(isUnavailable(err), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		})
+
+		Convey("but not for reads in a transaction", func() {
+			msg := findMessage()
+			msg.Body = append(msg.Body,
+				bson.DocElem{Name: "lsid", Value: bson.D{{Name: "id", Value: bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}}}},
+				bson.DocElem{Name: "txnNumber", Value: int64(1)},
+				bson.DocElem{Name: "autocommit", Value: false},
+			)
+			So(isRead(msg), ShouldBeFalse)
+			_, err := m.handleOpMsg(msg)
+			So(isUnavailable(err), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		})
+
+		Convey("but not for writing aggregations", func() {
+			msg := findMessage()
+			msg.Body = bson.D{
+				{Name: "aggregate", Value: "orders"},
+				{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$out", Value: "copy"}}}},
+			}
+			_, err := m.handleOpMsg(msg)
+			So(isUnavailable(err), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	Convey("Back off exponentially up to a limit", t, func() {
+		policy := retryPolicy{initialBackoff: 10 * time.Millisecond, maxBackoff: 40 * time.Millisecond}
+		for i := 0; i < 20; i++ {
+			So(policy.backoff(1), ShouldBeLessThan, 10*time.Millisecond)
+			So(policy.backoff(3), ShouldBeLessThan, 40*time.Millisecond)
+			So(policy.backoff(10), ShouldBeLessThan, 40*time.Millisecond)
+		}
+	})
+}
+
+func TestHedging(t *testing.T) {
+	Convey("Hedge slow reads", t, func() {
+		var requests int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				// the first request hangs until it is canceled, which the
+				// server only notices once the body has been read
+				ioutil.ReadAll(r.Body)
+				<-r.Context().Done()
+				return
+			}
+			okHandler(w, r)
+		}))
+		defer ts.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"urlBase": ts.URL,
+			"retry":   bson.M{"hedgeDelayMs": 20},
+		}), ShouldBeNil)
+
+		start := time.Now()
+		_, err := m.handleOpMsg(findMessage())
+		So(err, ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		So(atomic.LoadInt32(&requests), ShouldEqual, 2)
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	Convey("Open the circuit after repeated failures", t, func() {
+		var requests int32
+		ts := flakyServer(3, &requests)
+		defer ts.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"urlBase":        ts.URL,
+			"circuitBreaker": bson.M{"failureThreshold": 2, "openSecs": 0.05},
+		}), ShouldBeNil)
+
+		for i := 0; i < 2; i++ {
+			_, err := m.handleOpMsg(findMessage())
+			So(isUnavailable(err), ShouldBeTrue)
+		}
+
+		Convey("failing requests without sending them", func() {
+			_, err := m.handleOpMsg(findMessage())
+			So(isUnavailable(err), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 2)
+		})
+
+		Convey("testing the backend after a while", func() {
+			time.Sleep(60 * time.Millisecond)
+
+			// the trial request fails, so the circuit opens again
+			_, err := m.handleOpMsg(findMessage())
+			So(isUnavailable(err), ShouldBeTrue)
+			_, err = m.handleOpMsg(findMessage())
+			So(isUnavailable(err), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 3)
+
+			time.Sleep(60 * time.Millisecond)
+			_, err = m.handleOpMsg(findMessage())
+			So(err, ShouldBeNil)
+			_, err = m.handleOpMsg(findMessage())
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestUnavailableReply(t *testing.T) {
+	Convey("Reply to requests the backend could not serve", t, func() {
+		m := &Mockule{}
+		So(m.Configure(bson.M{"urlBase": "http://127.0.0.1:1"}), ShouldBeNil)
+
+		Convey("with a retryable error", func() {
+			res := &messages.ModuleResponse{}
+			m.Process(findMessage(), res, nil)
+			reply := res.Writer.ToBSON()
+			So(reply["ok"], ShouldEqual, 0)
+			So(reply["code"], ShouldEqual, messages.HostUnreachable)
+			So(reply["errorLabels"], ShouldBeNil)
+		})
+
+		Convey("labeled for retryable writes", func() {
+			res := &messages.ModuleResponse{}
+			m.Process(insertMessage(true), res, nil)
+			So(res.Writer.ToBSON()["errorLabels"], ShouldResemble, []string{messages.RetryableWriteLabel})
+		})
+	})
+}
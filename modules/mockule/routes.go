@@ -0,0 +1,224 @@
+package mockule
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	routesConfName       = "routes"
+	defaultRouteConfName = "defaultRoute"
+)
+
+// routeMethods are the HTTP methods a route may use. The request document
+// is always sent as the body, so methods without one are not allowed.
+var routeMethods = map[string]bool{
+	"POST":  true,
+	"PUT":   true,
+	"PATCH": true,
+}
+
+// placeholderRE matches the placeholders in a route's URL template.
+var placeholderRE = regexp.MustCompile(`\{[^{}]*\}`)
+
+// routePlaceholders are the placeholders a URL template may use.
+var routePlaceholders = map[string]bool{
+	"{urlBase}":    true,
+	"{command}":    true,
+	"{db}":         true,
+	"{collection}": true,
+	"{ns}":         true,
+}
+
+// a route says where, and how, to send the requests that match it.
+type route struct {
+	// commands and namespaces restrict the requests the route matches.
+	// Either may be nil to match any. namespaces are patterns in which *
+	// matches any characters, such as "shop.*".
+	commands   map[string]bool
+	namespaces []*regexp.Regexp
+
+	url     string
+	method  string
+	headers []headerType
+
+	// timeout bounds requests on this route, if set, on top of the
+	// transport's requestTimeout.
+	timeout time.Duration
+}
+
+// a router picks the route for each request: the first configured one
+// that matches, or else the fallback.
+type router struct {
+	routes   []route
+	fallback route
+}
+
+// parseRouter reads the “routes” array and the “defaultRoute” object.
+// Without a “defaultRoute”, requests that match no route are POSTed to
+// urlBase.
+func parseRouter(conf bson.M) (router, error) {
+	r := router{fallback: route{url: "{urlBase}", method: httpMethod}}
+
+	if value, ok := conf[defaultRouteConfName]; ok {
+		routeConf := convert.ToBSONMap(value)
+		if routeConf == nil {
+			return r, fmt.Errorf("“%s” must be an object, not %v", defaultRouteConfName, value)
+		}
+		if _, ok := routeConf["commands"]; ok {
+			return r, fmt.Errorf("%s: “commands” is only for “%s”", defaultRouteConfName, routesConfName)
+		}
+		if _, ok := routeConf["namespaces"]; ok {
+			return r, fmt.Errorf("%s: “namespaces” is only for “%s”", defaultRouteConfName, routesConfName)
+		}
+		fallback, err := parseRoute(routeConf)
+		if err != nil {
+			return r, fmt.Errorf("%s: %v", defaultRouteConfName, err)
+		}
+		r.fallback = fallback
+	}
+
+	value, ok := conf[routesConfName]
+	if !ok {
+		return r, nil
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		return r, fmt.Errorf("“%s” must be an array, not %v", routesConfName, value)
+	}
+	for i, cur := range array {
+		routeConf := convert.ToBSONMap(cur)
+		if routeConf == nil {
+			return r, fmt.Errorf("%s[%d] must be an object, not %v", routesConfName, i, cur)
+		}
+		rt, err := parseRoute(routeConf)
+		if err != nil {
+			return r, fmt.Errorf("%s[%d]: %v", routesConfName, i, err)
+		}
+		r.routes = append(r.routes, rt)
+	}
+
+	return r, nil
+}
+
+func parseRoute(conf bson.M) (route, error) {
+	rt := route{method: httpMethod}
+
+	value, ok := conf["url"]
+	if !ok {
+		return rt, fmt.Errorf("missing “url”")
+	}
+	rt.url, ok = value.(string)
+	if !ok {
+		return rt, fmt.Errorf("“url” must be a string, not %v", value)
+	}
+	for _, placeholder := range placeholderRE.FindAllString(rt.url, -1) {
+		if !routePlaceholders[placeholder] {
+			return rt, fmt.Errorf("unknown placeholder %s in “url”", placeholder)
+		}
+	}
+
+	if value, ok := conf["method"]; ok {
+		rt.method = strings.ToUpper(convert.ToString(value))
+		if !routeMethods[rt.method] {
+			return rt, fmt.Errorf("“method” must be POST, PUT or PATCH, not %v", value)
+		}
+	}
+
+	if value, ok := conf["commands"]; ok {
+		names, err := convert.ConvertToStringSlice(value)
+		if err != nil {
+			return rt, fmt.Errorf("“commands” must be an array of strings, not %v", value)
+		}
+		rt.commands = make(map[string]bool)
+		for _, name := range names {
+			rt.commands[name] = true
+		}
+	}
+
+	if value, ok := conf["namespaces"]; ok {
+		patterns, err := convert.ConvertToStringSlice(value)
+		if err != nil {
+			return rt, fmt.Errorf("“namespaces” must be an array of strings, not %v", value)
+		}
+		rt.namespaces = []*regexp.Regexp{}
+		for _, pattern := range patterns {
+			rt.namespaces = append(rt.namespaces, namespacePattern(pattern))
+		}
+	}
+
+	if value, ok := conf[headersConfName]; ok {
+		headers, err := parseHeaders(value)
+		if err != nil {
+			return rt, err
+		}
+		rt.headers = headers
+	}
+
+	if value, ok := conf["timeoutSecs"]; ok {
+		secs := convert.ToFloat64(value, -1)
+		if secs < 0 {
+			return rt, fmt.Errorf("“timeoutSecs” must be a non-negative number, not %v", value)
+		}
+		rt.timeout = time.Duration(secs * float64(time.Second))
+	}
+
+	return rt, nil
+}
+
+// matches returns whether the route is for msg.
+func (rt route) matches(msg *messages.Message) bool {
+	if rt.commands != nil && !rt.commands[msg.CommandName()] {
+		return false
+	}
+	if rt.namespaces == nil {
+		return true
+	}
+	ns := msg.Namespace()
+	for _, pattern := range rt.namespaces {
+		if pattern.MatchString(ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespacePattern compiles a namespace pattern. Only * is special, since
+// collection names may contain most other characters.
+func namespacePattern(pattern string) *regexp.Regexp {
+	quoted := strings.Split(pattern, "*")
+	for i := range quoted {
+		quoted[i] = regexp.QuoteMeta(quoted[i])
+	}
+	return regexp.MustCompile("^" + strings.Join(quoted, ".*") + "$")
+}
+
+// route returns the route for msg.
+func (r router) route(msg *messages.Message) route {
+	for _, rt := range r.routes {
+		if rt.matches(msg) {
+			return rt
+		}
+	}
+	return r.fallback
+}
+
+// expandURL fills in the route's URL template for msg. Everything but
+// urlBase is escaped as a path segment.
+func (rt route) expandURL(urlBase string, msg *messages.Message) string {
+	replacer := strings.NewReplacer(
+		"{urlBase}", strings.TrimSuffix(urlBase, "/"),
+		"{command}", url.PathEscape(msg.CommandName()),
+		"{db}", url.PathEscape(msg.Database()),
+		"{collection}", url.PathEscape(msg.Collection()),
+		"{ns}", url.PathEscape(msg.Namespace()),
+	)
+	return replacer.Replace(rt.url)
+}
@@ -0,0 +1,130 @@
+package mockule
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRoutes(t *testing.T) {
+	Convey("Route requests by command and namespace", t, func() {
+		type seen struct {
+			method, path, service, auth string
+		}
+		requests := make(chan seen, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- seen{r.Method, r.URL.EscapedPath(), r.Header.Get("X-Service"), r.Header.Get("Authorization")}
+			if r.URL.Path == "/slow" {
+				// the cancellation is only noticed once the body is read
+				ioutil.ReadAll(r.Body)
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			}
+			okHandler(w, r)
+		}))
+		defer ts.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"urlBase": ts.URL + "/",
+			"headers": []interface{}{
+				[]interface{}{"Authorization", "global"},
+			},
+			"routes": []interface{}{
+				bson.M{
+					"commands":   []interface{}{"find", "aggregate"},
+					"namespaces": []interface{}{"shop.*"},
+					"url":        "{urlBase}/{db}/{collection}/{command}",
+					"headers": []interface{}{
+						[]interface{}{"X-Service", "orders"},
+						[]interface{}{"Authorization", "orders"},
+					},
+				},
+				bson.M{
+					"namespaces": []interface{}{"billing", "billing.*"},
+					"url":        "http://" + ts.Listener.Addr().String() + "/billing/{command}",
+					"method":     "put",
+				},
+				bson.M{
+					"commands":    []interface{}{"count"},
+					"url":         "{urlBase}/slow",
+					"timeoutSecs": 0.05,
+				},
+			},
+			"defaultRoute": bson.M{"url": "{urlBase}/op_msg"},
+		}), ShouldBeNil)
+
+		Convey("to the first matching route's URL, method and headers", func() {
+			_, err := m.handleOpMsg(findMessage())
+			So(err, ShouldBeNil)
+			So(<-requests, ShouldResemble, seen{"POST", "/shop/orders/find", "orders", "orders"})
+
+			msg := findMessage()
+			msg.Body = bson.D{{Name: "listCollections", Value: 1}, {Name: "$db", Value: "billing"}}
+			_, err = m.handleOpMsg(msg)
+			So(err, ShouldBeNil)
+			So(<-requests, ShouldResemble, seen{"PUT", "/billing/listCollections", "", "global"})
+		})
+
+		Convey("escaping names in the URL", func() {
+			msg := findMessage()
+			msg.Body = bson.D{{Name: "find", Value: "a/b c"}, {Name: "$db", Value: "shop"}}
+			_, err := m.handleOpMsg(msg)
+			So(err, ShouldBeNil)
+			So((<-requests).path, ShouldEqual, "/shop/a%2Fb%20c/find")
+		})
+
+		Convey("or else to the default route", func() {
+			_, err := m.handleOpMsg(insertMessage(false))
+			So(err, ShouldBeNil)
+			So(<-requests, ShouldResemble, seen{"POST", "/op_msg", "", "global"})
+		})
+
+		Convey("with the route's timeout", func() {
+			msg := findMessage()
+			msg.Body = bson.D{{Name: "count", Value: "orders"}, {Name: "$db", Value: "shop"}}
+			_, err := m.handleOpMsg(msg)
+			So(err, ShouldNotBeNil)
+			So(isUnavailable(err), ShouldBeTrue)
+			<-requests
+		})
+	})
+
+	Convey("Without routes, post everything to urlBase", t, func() {
+		requests := make(chan string, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r.URL.Path
+			okHandler(w, r)
+		}))
+		defer ts.Close()
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{"urlBase": ts.URL + "/api/"}), ShouldBeNil)
+		_, err := m.handleOpMsg(findMessage())
+		So(err, ShouldBeNil)
+		So(<-requests, ShouldEqual, "/api")
+	})
+
+	Convey("Reject bad routes", t, func() {
+		bad := []bson.M{
+			{"routes": bson.M{"url": "x"}},
+			{"routes": []interface{}{bson.M{"commands": []interface{}{"find"}}}},
+			{"routes": []interface{}{bson.M{"url": "{urlBase}/{database}"}}},
+			{"routes": []interface{}{bson.M{"url": "{urlBase}", "method": "GET"}}},
+			{"routes": []interface{}{bson.M{"url": "{urlBase}", "namespaces": []interface{}{1}}}},
+			{"routes": []interface{}{bson.M{"url": "{urlBase}", "timeoutSecs": -1}}},
+			{"defaultRoute": bson.M{"url": "{urlBase}", "commands": []interface{}{"find"}}},
+		}
+		for _, conf := range bad {
+			_, err := parseRouter(conf)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,260 @@
+package mockule
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const transportConfName = "transport"
+
+// transportConfig holds the settings for the HTTP transport to the REST
+// backend. It is comparable, so that mockules configured alike can share
+// one transport and its pool of connections.
+type transportConfig struct {
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+
+	idleConnTimeout       time.Duration
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+
+	// requestTimeout bounds a whole request, including reading the
+	// response body. It is set on the client rather than the transport.
+	requestTimeout time.Duration
+
+	http2    bool
+	caFile   string
+	certFile string
+	keyFile  string
+	proxyURL string
+}
+
+func defaultTransportConfig() transportConfig {
+	return transportConfig{
+		maxIdleConnsPerHost: 64,
+		idleConnTimeout:     90 * time.Second,
+		dialTimeout:         10 * time.Second,
+		tlsHandshakeTimeout: 10 * time.Second,
+		requestTimeout:      maxTimeoutSecs * time.Second,
+		http2:               true,
+	}
+}
+
+// parseTransportConfig reads the “transport” configuration object. Every
+// field is optional.
+func parseTransportConfig(conf bson.M) (transportConfig, error) {
+	tc := defaultTransportConfig()
+	if conf == nil {
+		return tc, nil
+	}
+
+	ints := map[string]*int{
+		"maxIdleConnsPerHost": &tc.maxIdleConnsPerHost,
+		"maxConnsPerHost":     &tc.maxConnsPerHost,
+	}
+	for name, field := range ints {
+		if value, ok := conf[name]; ok {
+			*field = convert.ToInt(value, -1)
+			if *field < 0 {
+				return tc, fmt.Errorf("%s.%s must be a non-negative integer, not %v", transportConfName, name, value)
+			}
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"idleConnTimeoutSecs":       &tc.idleConnTimeout,
+		"dialTimeoutSecs":           &tc.dialTimeout,
+		"tlsHandshakeTimeoutSecs":   &tc.tlsHandshakeTimeout,
+		"responseHeaderTimeoutSecs": &tc.responseHeaderTimeout,
+		"requestTimeoutSecs":        &tc.requestTimeout,
+	}
+	for name, field := range durations {
+		if value, ok := conf[name]; ok {
+			secs := convert.ToFloat64(value, -1)
+			if secs < 0 {
+				return tc, fmt.Errorf("%s.%s must be a non-negative number, not %v", transportConfName, name, value)
+			}
+			*field = time.Duration(secs * float64(time.Second))
+		}
+	}
+
+	if value, ok := conf["http2"]; ok {
+		enabled, ok := value.(bool)
+		if !ok {
+			return tc, fmt.Errorf("%s.http2 must be a boolean, not %v", transportConfName, value)
+		}
+		tc.http2 = enabled
+	}
+
+	strs := map[string]*string{
+		"caFile":   &tc.caFile,
+		"certFile": &tc.certFile,
+		"keyFile":  &tc.keyFile,
+		"proxyUrl": &tc.proxyURL,
+	}
+	for name, field := range strs {
+		if value, ok := conf[name]; ok {
+			str, ok := value.(string)
+			if !ok {
+				return tc, fmt.Errorf("%s.%s must be a string, not %v", transportConfName, name, value)
+			}
+			*field = str
+		}
+	}
+
+	if (len(tc.certFile) > 0) != (len(tc.keyFile) > 0) {
+		return tc, fmt.Errorf("%s: certFile and keyFile must be given together", transportConfName)
+	}
+
+	return tc, nil
+}
+
+// tlsFiles are the contents of the certificate and key files of a
+// transport configuration.
+type tlsFiles struct {
+	ca   []byte
+	cert []byte
+	key  []byte
+}
+
+// readTLSFiles reads the certificate and key files a configuration names.
+func readTLSFiles(tc transportConfig) (tlsFiles, error) {
+	var files tlsFiles
+	var err error
+	if len(tc.caFile) > 0 {
+		if files.ca, err = ioutil.ReadFile(tc.caFile); err != nil {
+			return files, fmt.Errorf("%s: failed to read caFile: %v", transportConfName, err)
+		}
+	}
+	if len(tc.certFile) > 0 {
+		if files.cert, err = ioutil.ReadFile(tc.certFile); err != nil {
+			return files, fmt.Errorf("%s: failed to load client certificate: %v", transportConfName, err)
+		}
+		if files.key, err = ioutil.ReadFile(tc.keyFile); err != nil {
+			return files, fmt.Errorf("%s: failed to load client certificate: %v", transportConfName, err)
+		}
+	}
+	return files, nil
+}
+
+// digest returns a hash of the files, which tells whether they changed.
+func (files tlsFiles) digest() [sha256.Size]byte {
+	h := sha256.New()
+	for _, contents := range [][]byte{files.ca, files.cert, files.key} {
+		fmt.Fprintf(h, "%d:", len(contents))
+		h.Write(contents)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// a cachedTransport is a transport, with the digest of the files it was
+// created from.
+type cachedTransport struct {
+	transport *http.Transport
+	digest    [sha256.Size]byte
+}
+
+// transports are the transports created so far, by configuration. They
+// live as long as the process, so that reloading the configuration does
+// not drop pooled connections.
+var transports = make(map[transportConfig]cachedTransport)
+var transportsMutex sync.Mutex
+
+// sharedTransport returns the transport for a configuration, creating it
+// if no mockule has used that configuration before, or if its certificate
+// and key files have changed since, as they do when they are rotated. A
+// transport replaced that way keeps the connections in use, and closes
+// its idle ones.
+func sharedTransport(tc transportConfig) (*http.Transport, error) {
+	files, err := readTLSFiles(tc)
+	if err != nil {
+		return nil, err
+	}
+	digest := files.digest()
+
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+
+	cached, ok := transports[tc]
+	if ok && cached.digest == digest {
+		return cached.transport, nil
+	}
+	transport, err := newTransport(tc, files)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cached.transport.CloseIdleConnections()
+	}
+	transports[tc] = cachedTransport{transport: transport, digest: digest}
+	return transport, nil
+}
+
+func newTransport(tc transportConfig, files tlsFiles) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   tc.dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConnsPerHost:   tc.maxIdleConnsPerHost,
+		MaxConnsPerHost:       tc.maxConnsPerHost,
+		IdleConnTimeout:       tc.idleConnTimeout,
+		TLSHandshakeTimeout:   tc.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: tc.responseHeaderTimeout,
+		ForceAttemptHTTP2:     tc.http2,
+	}
+
+	if !tc.http2 {
+		// a non-nil, empty map is how net/http is told not to upgrade
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if len(tc.proxyURL) > 0 {
+		proxyURL, err := url.Parse(tc.proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid proxyUrl “%s”: %v", transportConfName, tc.proxyURL, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if len(tc.caFile) > 0 || len(tc.certFile) > 0 {
+		tlsConfig := &tls.Config{}
+
+		if len(tc.caFile) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(files.ca) {
+				return nil, fmt.Errorf("%s: no certificates found in caFile “%s”", transportConfName, tc.caFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		if len(tc.certFile) > 0 {
+			cert, err := tls.X509KeyPair(files.cert, files.key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: failed to load client certificate: %v", transportConfName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
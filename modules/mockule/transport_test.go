@@ -0,0 +1,163 @@
+package mockule
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// unrelatedCA returns a self-signed certificate, in PEM, that signed no
+// server's.
+func unrelatedCA() []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "unrelated"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// okHandler answers every request with a BSON { ok: 1 } message.
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := bson.Marshal(messages.Message{Body: bson.D{{Name: "ok", Value: 1}}})
+	w.Header().Set("Content-Type", bsonContentType)
+	w.Write(body)
+}
+
+// sameTransport reports whether two mockules send through the same
+// transport. It compares the pointers itself: assertions format the
+// values they compare, reading transports other goroutines are using.
+func sameTransport(a, b *Mockule) bool {
+	return a.getHttpClient().Transport == b.getHttpClient().Transport
+}
+
+func TestParseTransportConfig(t *testing.T) {
+	Convey("Parse a transport configuration", t, func() {
+		Convey("with defaults for missing fields", func() {
+			tc, err := parseTransportConfig(bson.M{"maxConnsPerHost": 8, "requestTimeoutSecs": 2.5})
+			So(err, ShouldBeNil)
+			So(tc.maxConnsPerHost, ShouldEqual, 8)
+			So(tc.requestTimeout, ShouldEqual, 2500*time.Millisecond)
+			So(tc.maxIdleConnsPerHost, ShouldEqual, defaultTransportConfig().maxIdleConnsPerHost)
+			So(tc.http2, ShouldBeTrue)
+		})
+
+		Convey("rejecting invalid values", func() {
+			_, err := parseTransportConfig(bson.M{"dialTimeoutSecs": "soon"})
+			So(err, ShouldNotBeNil)
+
+			_, err = parseTransportConfig(bson.M{"http2": "yes"})
+			So(err, ShouldNotBeNil)
+
+			_, err = parseTransportConfig(bson.M{"certFile": "client.pem"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSharedTransport(t *testing.T) {
+	Convey("Share transports between mockules", t, func() {
+		var connections int32
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(okHandler))
+		ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&connections, 1)
+			}
+		}
+		ts.Start()
+		defer ts.Close()
+
+		first, second := &Mockule{}, &Mockule{}
+		So(first.Configure(bson.M{"urlBase": ts.URL}), ShouldBeNil)
+		So(second.Configure(bson.M{"urlBase": ts.URL}), ShouldBeNil)
+		So(sameTransport(first, second), ShouldBeTrue)
+
+		Convey("reusing connections across requests", func() {
+			for i := 0; i < 5; i++ {
+				for _, m := range []*Mockule{first, second} {
+					_, err := m.handleOpMsg(&messages.Message{Body: bson.D{{Name: "ping", Value: 1}}})
+					So(err, ShouldBeNil)
+				}
+			}
+			So(atomic.LoadInt32(&connections), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestTransportCA(t *testing.T) {
+	Convey("Trust a custom certificate authority", t, func() {
+		ts := httptest.NewTLSServer(http.HandlerFunc(okHandler))
+		defer ts.Close()
+
+		dir, err := ioutil.TempDir("", "mockule")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		caFile := filepath.Join(dir, "ca.pem")
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+		So(ioutil.WriteFile(caFile, certPEM, 0600), ShouldBeNil)
+
+		m := &Mockule{}
+		So(m.Configure(bson.M{
+			"urlBase":   ts.URL,
+			"transport": bson.M{"caFile": caFile},
+		}), ShouldBeNil)
+
+		_, err = m.handleOpMsg(&messages.Message{Body: bson.D{{Name: "ping", Value: 1}}})
+		So(err, ShouldBeNil)
+
+		Convey("reading it again once it changes", func() {
+			So(ioutil.WriteFile(caFile, unrelatedCA(), 0600), ShouldBeNil)
+			stale := &Mockule{}
+			So(stale.Configure(bson.M{"urlBase": ts.URL, "transport": bson.M{"caFile": caFile}}), ShouldBeNil)
+			So(sameTransport(stale, m), ShouldBeFalse)
+			_, err = stale.handleOpMsg(&messages.Message{Body: bson.D{{Name: "ping", Value: 1}}})
+			So(err, ShouldNotBeNil)
+
+			So(ioutil.WriteFile(caFile, certPEM, 0600), ShouldBeNil)
+			rotated := &Mockule{}
+			So(rotated.Configure(bson.M{"urlBase": ts.URL, "transport": bson.M{"caFile": caFile}}), ShouldBeNil)
+			So(sameTransport(rotated, stale), ShouldBeFalse)
+			_, err = rotated.handleOpMsg(&messages.Message{Body: bson.D{{Name: "ping", Value: 1}}})
+			So(err, ShouldBeNil)
+
+			again := &Mockule{}
+			So(again.Configure(bson.M{"urlBase": ts.URL, "transport": bson.M{"caFile": caFile}}), ShouldBeNil)
+			So(sameTransport(again, rotated), ShouldBeTrue)
+		})
+
+		Convey("but not an unknown one", func() {
+			m := &Mockule{}
+			So(m.Configure(bson.M{
+				"urlBase":   ts.URL,
+				"transport": bson.M{"dialTimeoutSecs": 5},
+			}), ShouldBeNil)
+
+			_, err = m.handleOpMsg(&messages.Message{Body: bson.D{{Name: "ping", Value: 1}}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
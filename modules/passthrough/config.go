@@ -0,0 +1,249 @@
+package passthrough
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/upstream"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const tlsConfName = "tls"
+
+// poolConfig holds the settings for the pool of connections to the
+// upstream server. It is comparable, so that modules configured alike can
+// share one pool.
+type poolConfig struct {
+	address string
+
+	minPoolSize         int
+	maxPoolSize         int
+	dialTimeout         time.Duration
+	idleTimeout         time.Duration
+	socketTimeout       time.Duration
+	waitQueueTimeout    time.Duration
+	healthCheckInterval time.Duration
+
+	tls                bool
+	caFile             string
+	certFile           string
+	keyFile            string
+	serverName         string
+	insecureSkipVerify bool
+}
+
+func defaultPoolConfig() poolConfig {
+	return poolConfig{
+		maxPoolSize:         100,
+		dialTimeout:         10 * time.Second,
+		idleTimeout:         300 * time.Second,
+		healthCheckInterval: 10 * time.Second,
+	}
+}
+
+// parsePoolConfig reads the module's configuration. Only the address is
+// required.
+func parsePoolConfig(conf bson.M) (poolConfig, error) {
+	pc := defaultPoolConfig()
+
+	address, ok := conf["address"].(string)
+	if !ok || len(address) == 0 {
+		return pc, fmt.Errorf("Invalid address: %v", conf["address"])
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return pc, fmt.Errorf("Invalid address “%s”: %v", address, err)
+	}
+	pc.address = address
+
+	ints := map[string]*int{
+		"minPoolSize": &pc.minPoolSize,
+		"maxPoolSize": &pc.maxPoolSize,
+	}
+	for name, field := range ints {
+		if value, ok := conf[name]; ok {
+			*field = convert.ToInt(value, -1)
+			if *field < 0 {
+				return pc, fmt.Errorf("%s must be a non-negative integer, not %v", name, value)
+			}
+		}
+	}
+	if pc.maxPoolSize > 0 && pc.minPoolSize > pc.maxPoolSize {
+		return pc, fmt.Errorf("minPoolSize (%d) must not exceed maxPoolSize (%d)", pc.minPoolSize, pc.maxPoolSize)
+	}
+
+	durations := map[string]*time.Duration{
+		"dialTimeoutSecs":         &pc.dialTimeout,
+		"idleTimeoutSecs":         &pc.idleTimeout,
+		"socketTimeoutSecs":       &pc.socketTimeout,
+		"waitQueueTimeoutSecs":    &pc.waitQueueTimeout,
+		"healthCheckIntervalSecs": &pc.healthCheckInterval,
+	}
+	for name, field := range durations {
+		if value, ok := conf[name]; ok {
+			secs := convert.ToFloat64(value, -1)
+			if secs < 0 {
+				return pc, fmt.Errorf("%s must be a non-negative number, not %v", name, value)
+			}
+			*field = time.Duration(secs * float64(time.Second))
+		}
+	}
+
+	switch t := conf[tlsConfName].(type) {
+	case nil:
+	case bool:
+		pc.tls = t
+	default:
+		tlsConf := convert.ToBSONMap(t)
+		if tlsConf == nil {
+			return pc, fmt.Errorf("%s must be a boolean or an object, not %v", tlsConfName, t)
+		}
+		if err := parseTLSConfig(tlsConf, &pc); err != nil {
+			return pc, err
+		}
+	}
+
+	return pc, nil
+}
+
+func parseTLSConfig(conf bson.M, pc *poolConfig) error {
+	pc.tls = true
+
+	strs := map[string]*string{
+		"caFile":     &pc.caFile,
+		"certFile":   &pc.certFile,
+		"keyFile":    &pc.keyFile,
+		"serverName": &pc.serverName,
+	}
+	for name, field := range strs {
+		if value, ok := conf[name]; ok {
+			str, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s.%s must be a string, not %v", tlsConfName, name, value)
+			}
+			*field = str
+		}
+	}
+
+	if value, ok := conf["insecureSkipVerify"]; ok {
+		skip, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s.insecureSkipVerify must be a boolean, not %v", tlsConfName, value)
+		}
+		pc.insecureSkipVerify = skip
+	}
+
+	if (len(pc.certFile) > 0) != (len(pc.keyFile) > 0) {
+		return fmt.Errorf("%s: certFile and keyFile must be given together", tlsConfName)
+	}
+	return nil
+}
+
+// a backend is a pool of connections to an upstream server, along with
+// the connections from it that are pinned to clients.
+type backend struct {
+	pool *upstream.Pool
+	pins *pinner
+
+	config poolConfig
+	// refs counts the modules holding the backend, guarded by
+	// backendsMutex.
+	refs int
+}
+
+// backends are the backends in use, by configuration, so that reloading
+// the configuration neither drops open connections nor forgets pinned
+// ones.
+var backends = make(map[poolConfig]*backend)
+var backendsMutex sync.Mutex
+
+// sharedBackend returns the backend for a configuration, creating it if
+// no module holds one for that configuration, for a module to hold until
+// it calls release.
+func sharedBackend(pc poolConfig) (*backend, error) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	if b, ok := backends[pc]; ok {
+		b.refs++
+		return b, nil
+	}
+
+	conf := upstream.Config{
+		Address:             pc.address,
+		DialTimeout:         pc.dialTimeout,
+		MinPoolSize:         pc.minPoolSize,
+		MaxPoolSize:         pc.maxPoolSize,
+		WaitQueueTimeout:    pc.waitQueueTimeout,
+		IdleTimeout:         pc.idleTimeout,
+		SocketTimeout:       pc.socketTimeout,
+		HealthCheckInterval: pc.healthCheckInterval,
+	}
+	if pc.tls {
+		tlsConfig, err := newTLSConfig(pc)
+		if err != nil {
+			return nil, err
+		}
+		conf.TLS = tlsConfig
+	}
+
+	pool := upstream.NewPool(conf)
+	b := &backend{pool: pool, pins: newPinner(pool, CursorPinTimeout, time.Minute), config: pc, refs: 1}
+	backends[pc] = b
+	return b, nil
+}
+
+// release gives back a backend from sharedBackend. Once every module
+// holding it has, its pinned connections are given back and its pool
+// closed.
+func (b *backend) release() {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	if b.refs == 0 {
+		return
+	}
+	if b.refs--; b.refs > 0 {
+		return
+	}
+	delete(backends, b.config)
+	b.pins.close()
+	b.pool.Close()
+}
+
+func newTLSConfig(pc poolConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         pc.serverName,
+		InsecureSkipVerify: pc.insecureSkipVerify,
+	}
+	if len(tlsConfig.ServerName) == 0 {
+		host, _, _ := net.SplitHostPort(pc.address)
+		tlsConfig.ServerName = host
+	}
+
+	if len(pc.caFile) > 0 {
+		pem, err := ioutil.ReadFile(pc.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to read caFile: %v", tlsConfName, err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found in caFile “%s”", tlsConfName, pc.caFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if len(pc.certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(pc.certFile, pc.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to load certFile and keyFile: %v", tlsConfName, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
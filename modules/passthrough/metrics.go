@@ -0,0 +1,13 @@
+package passthrough
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+)
+
+var pinnedConnections = metrics.NewGaugeVec("mongoproxy_passthrough_pinned_connections",
+	"Upstream connections pinned to clients, by the reason: cursor or transaction.",
+	"reason")
+
+func init() {
+	metrics.MustRegister(pinnedConnections)
+}
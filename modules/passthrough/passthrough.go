@@ -0,0 +1,334 @@
+// Package passthrough contains a module that passes requests on, verbatim,
+// to an upstream MongoDB-compatible server over its own pooled
+// connections, and passes its replies back.
+package passthrough
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/server"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	"github.com/mongodbinc-interns/mongoproxy/upstream"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var logger = GetLogger("passthrough")
+
+// The Passthrough module sends each request to the upstream server as it
+// was received, apart from its requestID, and answers with the server's
+// replies as they were received, apart from their requestIDs and
+// responseTos. It is the last module in a pipeline.
+type Passthrough struct {
+	backend *backend
+	pinning bool
+}
+
+func init() {
+	server.Publish(&Passthrough{})
+}
+
+func (_ *Passthrough) New() server.Module {
+	return &Passthrough{}
+}
+
+func (_ *Passthrough) Name() string {
+	return "passthrough"
+}
+
+func (p *Passthrough) Configure(conf bson.M) error {
+	pc, err := parsePoolConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	p.pinning = true
+	if value, ok := conf["pinning"]; ok {
+		pinning, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("pinning must be a boolean, not %v", value)
+		}
+		p.pinning = pinning
+	}
+
+	b, err := sharedBackend(pc)
+	if err != nil {
+		return err
+	}
+	p.Close()
+	p.backend = b
+	return nil
+}
+
+// Close releases the module's backend, whose connections are closed once
+// no module holds it.
+func (p *Passthrough) Close() error {
+	if p.backend != nil {
+		p.backend.release()
+		p.backend = nil
+	}
+	return nil
+}
+
+func (p *Passthrough) Process(req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+
+	switch req.Type() {
+	case messages.MessageType:
+		message, err := messages.ToMessageRequest(req)
+		if err != nil {
+			break
+		}
+		p.forward(message, res)
+		return
+
+	case messages.CommandType:
+		command, err := messages.ToCommandRequest(req)
+		if err != nil {
+			break
+		}
+		p.forwardCommand(command, res)
+		return
+	}
+
+	next(req, res)
+}
+
+// forward sends an OP_MSG upstream, and writes the reply, or stream of
+// replies, to res.
+func (p *Passthrough) forward(msg *messages.Message, res messages.Responder) {
+	frame := msg.Raw
+	if frame == nil {
+		var err error
+		frame, err = msg.Encode(0, 0)
+		if err != nil {
+			res.Error(messages.InternalError, err.Error())
+			return
+		}
+	}
+
+	flags := messages.FrameFlags(frame)
+	streamer, canStream := res.(messages.StreamResponder)
+	if flags&messages.OP_MSG_FLAG_EXHAUST_ALLOWED != 0 && !canStream {
+		frame = messages.RewriteFlags(frame, flags&^messages.OP_MSG_FLAG_EXHAUST_ALLOWED)
+	}
+
+	conn, err := p.getConn(msg)
+	if err != nil {
+		p.fail(msg, res, err)
+		return
+	}
+
+	id, err := conn.Send(frame)
+	if err != nil {
+		p.release(msg, conn, nil)
+		p.fail(msg, res, err)
+		return
+	}
+
+	if flags&messages.OP_MSG_FLAG_MORE_TO_COME != 0 {
+		// fire and forget
+		p.release(msg, conn, nil)
+		return
+	}
+
+	replyFrame, err := conn.Receive(id)
+	if err != nil {
+		p.release(msg, conn, nil)
+		p.fail(msg, res, err)
+		return
+	}
+
+	reply, err := messages.DecodeMessage(replyFrame)
+	if err != nil {
+		conn.Discard()
+		p.release(msg, conn, nil)
+		res.Error(messages.InternalError, fmt.Sprintf("Failed to decode reply from %s: %v", p.backend.pool.Address(), err))
+		return
+	}
+
+	if reply.FlagBits&messages.OP_MSG_FLAG_MORE_TO_COME == 0 {
+		p.release(msg, conn, reply)
+		res.Write(*reply)
+		return
+	}
+
+	if !canStream {
+		conn.Discard()
+		p.release(msg, conn, nil)
+		res.Error(messages.InternalError, fmt.Sprintf("%s streamed a reply to a request that did not allow it", p.backend.pool.Address()))
+		return
+	}
+	streamer.WriteStream(*reply, &replyStream{
+		module: p,
+		req:    msg,
+		conn:   conn,
+		last:   messages.FrameHeader(replyFrame).RequestID,
+	})
+}
+
+// forwardCommand sends an OP_QUERY command upstream as an OP_MSG, and
+// writes the reply as an OP_REPLY.
+func (p *Passthrough) forwardCommand(command messages.Command, res messages.Responder) {
+	body := command.ToBSON()
+	if bsonutil.FindValueByKey("$db", body) == nil {
+		body = append(body, bson.DocElem{Name: "$db", Value: command.Database})
+	}
+	msg := &messages.Message{
+		RequestID: command.RequestID,
+		Body:      body,
+		Client:    command.Client,
+	}
+
+	frame, err := msg.Encode(0, 0)
+	if err != nil {
+		res.Error(messages.InternalError, err.Error())
+		return
+	}
+
+	conn, err := p.backend.pool.Get(context.Background())
+	if err != nil {
+		p.fail(msg, res, err)
+		return
+	}
+	replyFrame, err := conn.RoundTrip(frame)
+	p.backend.pool.Put(conn)
+	if err != nil {
+		p.fail(msg, res, err)
+		return
+	}
+
+	reply, err := messages.DecodeMessage(replyFrame)
+	if err != nil {
+		res.Error(messages.InternalError, fmt.Sprintf("Failed to decode reply from %s: %v", p.backend.pool.Address(), err))
+		return
+	}
+	res.Write(messages.CommandResponse{Reply: reply.Body.Map()})
+}
+
+// getConn returns the connection pinned to the cursor or transaction a
+// request continues, if there is one, or else a connection from the pool.
+func (p *Passthrough) getConn(msg *messages.Message) (*upstream.Conn, error) {
+	if s := p.transaction(msg); s != nil {
+		if conn := p.backend.pins.takeTransaction(s); conn != nil {
+			return conn, nil
+		}
+	} else if p.pinning && msg.Client != nil {
+		if key, ok := requestPin(msg.Body); ok {
+			if conn := p.backend.pins.take(msg.Client, key); conn != nil {
+				return conn, nil
+			}
+		}
+	}
+	return p.backend.pool.Get(context.Background())
+}
+
+// release pins a connection to the cursor or transaction a request left
+// open, or gives it back to the pool, once the request's last reply has
+// been read. reply is nil if there was none.
+func (p *Passthrough) release(msg *messages.Message, conn *upstream.Conn, reply *messages.Message) {
+	pins := p.backend.pins
+	if !p.pinning || msg.Client == nil || reply == nil || conn.Broken() || len(msg.Body) == 0 {
+		p.backend.pool.Put(conn)
+		return
+	}
+
+	if s := p.transaction(msg); s != nil {
+		switch msg.Body[0].Name {
+		case "commitTransaction", "abortTransaction":
+			p.backend.pool.Put(conn)
+		default:
+			pins.pinTransaction(s, conn)
+		}
+		return
+	}
+
+	if msg.Body[0].Name == "killCursors" {
+		for _, id := range killedCursors(msg.Body) {
+			pins.unpin(msg.Client, cursorKey(id))
+		}
+		p.backend.pool.Put(conn)
+		return
+	}
+
+	if id := replyCursorID(reply.Body); id != 0 {
+		pins.pin(msg.Client, cursorKey(id), conn)
+		return
+	}
+	p.backend.pool.Put(conn)
+}
+
+// transaction returns the session of a request in a multi-statement
+// transaction, if connections are pinned.
+func (p *Passthrough) transaction(msg *messages.Message) *sessions.Session {
+	if !p.pinning {
+		return nil
+	}
+	info, ok := messages.BodySession(msg.Body)
+	if !ok || !info.InTransaction {
+		return nil
+	}
+	return sessions.Default.SessionOf(msg)
+}
+
+// fail answers with the error of a failed exchange with the upstream
+// server.
+func (p *Passthrough) fail(msg *messages.Message, res messages.Responder, err error) {
+	logger.LogWith(ERROR, messages.LogFields(msg), "%v", err)
+	switch {
+	case errors.Is(err, upstream.ErrWaitQueueTimeout):
+		res.Error(messages.ExceededTimeLimit, err.Error())
+	case upstream.IsTimeout(err):
+		res.Error(messages.NetworkTimeout, err.Error())
+	default:
+		res.Error(messages.HostUnreachable, err.Error())
+	}
+}
+
+// a replyStream reads the replies that follow one with moreToCome set,
+// and releases the connection once the last has been read.
+type replyStream struct {
+	module *Passthrough
+	req    *messages.Message
+	conn   *upstream.Conn
+	last   messages.RequestID
+}
+
+func (s *replyStream) Next() (messages.ResponseWriter, error) {
+	address := s.module.backend.pool.Address()
+	if s.conn == nil {
+		return nil, fmt.Errorf("Reply stream from %s has ended", address)
+	}
+
+	frame, err := s.conn.Receive(s.last)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	reply, err := messages.DecodeMessage(frame)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to decode reply from %s: %v", address, err)
+	}
+
+	s.last = messages.FrameHeader(frame).RequestID
+	if reply.FlagBits&messages.OP_MSG_FLAG_MORE_TO_COME == 0 {
+		s.module.release(s.req, s.conn, reply)
+		s.conn = nil
+	}
+	return *reply, nil
+}
+
+// Close gives the connection back, to be closed, since more replies may
+// be on their way over it.
+func (s *replyStream) Close() {
+	if s.conn != nil {
+		s.conn.Discard()
+		s.module.release(s.req, s.conn, nil)
+		s.conn = nil
+	}
+}
@@ -0,0 +1,449 @@
+package passthrough
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	"github.com/mongodbinc-interns/mongoproxy/upstream/upstreamtest"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// run passes a request through a configured module, and returns the reply
+// and whether the request was passed on.
+func run(p *Passthrough, req messages.Requester) (messages.ModuleResponse, bool) {
+	res := messages.ModuleResponse{}
+	passed := false
+	p.Process(req, &res, func(messages.Requester, messages.Responder) {
+		passed = true
+	})
+	return res, passed
+}
+
+// plainResponder is a Responder that cannot take a stream of replies.
+type plainResponder struct {
+	res *messages.ModuleResponse
+}
+
+func (r plainResponder) Type() string                    { return r.res.Type() }
+func (r plainResponder) Write(w messages.ResponseWriter) { r.res.Write(w) }
+func (r plainResponder) Error(code int32, msg string)    { r.res.Error(code, msg) }
+
+// decoded encodes a message and decodes it again, as the proxy would have
+// read it from a client.
+func decoded(msg messages.Message) *messages.Message {
+	frame, err := msg.Encode(42, 0)
+	So(err, ShouldBeNil)
+	out, err := messages.DecodeMessage(frame)
+	So(err, ShouldBeNil)
+	return out
+}
+
+// echo answers each request with its body, plus ok: 1.
+func echo(req *messages.Message) []messages.Message {
+	return []messages.Message{{Body: append(req.Body, bson.DocElem{Name: "ok", Value: 1.0})}}
+}
+
+func TestPassthrough(t *testing.T) {
+	Convey("Pass requests on to an upstream server", t, func() {
+		received := make(chan *messages.Message, 10)
+		var replies []messages.Message
+		ts := upstreamtest.NewServer(func(req *messages.Message) []messages.Message {
+			received <- req
+			if replies != nil {
+				return replies
+			}
+			return echo(req)
+		})
+		defer ts.Close()
+
+		p := &Passthrough{}
+		So(p.Configure(bson.M{"address": ts.Addr}), ShouldBeNil)
+
+		Convey("forwarding OP_MSG frames verbatim, apart from their IDs", func() {
+			msg := decoded(messages.Message{
+				Body: bson.D{
+					{Name: "insert", Value: "orders"},
+					{Name: "$db", Value: "shop"},
+				},
+				Auxiliary: messages.MessageAuxiliary{
+					"documents": []bson.D{{{Name: "_id", Value: 1}}, {{Name: "_id", Value: 2}}},
+				},
+			})
+
+			res, passed := run(p, msg)
+			So(passed, ShouldBeFalse)
+			So(res.CommandError, ShouldBeNil)
+			So(res.Writer.ToBSON()["insert"], ShouldEqual, "orders")
+			So(res.Writer.ToBSON()["ok"], ShouldEqual, 1)
+
+			req := <-received
+			So(req.Raw[16:], ShouldResemble, msg.Raw[16:])
+			So(req.Auxiliary["documents"], ShouldHaveLength, 2)
+
+			Convey("over one pooled connection", func() {
+				for i := 0; i < 3; i++ {
+					res, _ := run(p, msg)
+					So(res.CommandError, ShouldBeNil)
+					<-received
+				}
+				So(ts.Connections(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("streaming replies to exhaust requests", func() {
+			replies = []messages.Message{
+				{Body: bson.D{{Name: "batch", Value: 1}}},
+				{Body: bson.D{{Name: "batch", Value: 2}}},
+				{Body: bson.D{{Name: "batch", Value: 3}}},
+			}
+			msg := decoded(messages.Message{
+				FlagBits: messages.OP_MSG_FLAG_EXHAUST_ALLOWED,
+				Body:     bson.D{{Name: "getMore", Value: int64(9)}, {Name: "$db", Value: "shop"}},
+			})
+
+			res, _ := run(p, msg)
+			So(res.CommandError, ShouldBeNil)
+			So(res.Writer.ToBSON()["batch"], ShouldEqual, 1)
+			So(res.Stream, ShouldNotBeNil)
+
+			next, err := res.Stream.Next()
+			So(err, ShouldBeNil)
+			So(next.ToBSON()["batch"], ShouldEqual, 2)
+			So(next.(messages.Message).FlagBits&messages.OP_MSG_FLAG_MORE_TO_COME, ShouldNotEqual, 0)
+
+			next, err = res.Stream.Next()
+			So(err, ShouldBeNil)
+			So(next.ToBSON()["batch"], ShouldEqual, 3)
+			So(next.(messages.Message).FlagBits&messages.OP_MSG_FLAG_MORE_TO_COME, ShouldEqual, 0)
+
+			_, err = res.Stream.Next()
+			So(err, ShouldNotBeNil)
+			res.Stream.Close()
+
+			Convey("giving the connection back at the end", func() {
+				replies = nil
+				res, _ := run(p, decoded(messages.Message{Body: bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}}))
+				So(res.CommandError, ShouldBeNil)
+				So(ts.Connections(), ShouldEqual, 1)
+			})
+
+			Convey("but not to responders that cannot stream", func() {
+				<-received
+				replies = nil
+				res := messages.ModuleResponse{}
+				p.Process(msg, plainResponder{&res}, nil)
+				So(res.CommandError, ShouldBeNil)
+				So(res.Stream, ShouldBeNil)
+				req := <-received
+				So(req.FlagBits&messages.OP_MSG_FLAG_EXHAUST_ALLOWED, ShouldEqual, 0)
+			})
+		})
+
+		Convey("without waiting for replies to fire-and-forget requests", func() {
+			msg := decoded(messages.Message{
+				FlagBits: messages.OP_MSG_FLAG_MORE_TO_COME,
+				Body: bson.D{
+					{Name: "insert", Value: "events"},
+					{Name: "writeConcern", Value: bson.D{{Name: "w", Value: 0}}},
+					{Name: "$db", Value: "logs"},
+				},
+			})
+			res, passed := run(p, msg)
+			So(passed, ShouldBeFalse)
+			So(res.Writer, ShouldBeNil)
+			So(res.CommandError, ShouldBeNil)
+
+			select {
+			case req := <-received:
+				So(req.Body[0].Value, ShouldEqual, "events")
+			case <-time.After(5 * time.Second):
+				So("no request received", ShouldBeNil)
+			}
+		})
+
+		Convey("translating OP_QUERY commands", func() {
+			res, passed := run(p, messages.Command{
+				CommandName: "isMaster",
+				Database:    "admin",
+				Args:        bson.M{"isMaster": 1},
+			})
+			So(passed, ShouldBeFalse)
+			reply, ok := res.Writer.(messages.CommandResponse)
+			So(ok, ShouldBeTrue)
+			So(reply.Reply["isMaster"], ShouldEqual, 1)
+			So(reply.Reply["$db"], ShouldEqual, "admin")
+		})
+	})
+}
+
+func TestPassthroughUnreachable(t *testing.T) {
+	Convey("Fail requests when the upstream server is unreachable", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		address := listener.Addr().String()
+		listener.Close()
+
+		p := &Passthrough{}
+		So(p.Configure(bson.M{"address": address, "dialTimeoutSecs": 1}), ShouldBeNil)
+
+		res, _ := run(p, decoded(messages.Message{Body: bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}}))
+		So(res.CommandError, ShouldNotBeNil)
+		So(res.CommandError.ErrorCode, ShouldEqual, messages.HostUnreachable)
+	})
+}
+
+func TestParsePoolConfig(t *testing.T) {
+	Convey("Parse the passthrough configuration", t, func() {
+		Convey("with defaults for missing fields", func() {
+			pc, err := parsePoolConfig(bson.M{"address": "db.example.com:27017", "socketTimeoutSecs": 1.5})
+			So(err, ShouldBeNil)
+			So(pc.socketTimeout, ShouldEqual, 1500*time.Millisecond)
+			So(pc.maxPoolSize, ShouldEqual, defaultPoolConfig().maxPoolSize)
+			So(pc.tls, ShouldBeFalse)
+		})
+
+		Convey("with TLS", func() {
+			pc, err := parsePoolConfig(bson.M{"address": "db.example.com:27017", "tls": true})
+			So(err, ShouldBeNil)
+			So(pc.tls, ShouldBeTrue)
+
+			pc, err = parsePoolConfig(bson.M{
+				"address": "db.example.com:27017",
+				"tls":     bson.M{"serverName": "db", "insecureSkipVerify": true},
+			})
+			So(err, ShouldBeNil)
+			So(pc.tls, ShouldBeTrue)
+			So(pc.serverName, ShouldEqual, "db")
+		})
+
+		Convey("rejecting invalid values", func() {
+			_, err := parsePoolConfig(bson.M{})
+			So(err, ShouldNotBeNil)
+
+			_, err = parsePoolConfig(bson.M{"address": "localhost"})
+			So(err, ShouldNotBeNil)
+
+			_, err = parsePoolConfig(bson.M{"address": "localhost:27017", "maxPoolSize": "many"})
+			So(err, ShouldNotBeNil)
+
+			_, err = parsePoolConfig(bson.M{"address": "localhost:27017", "minPoolSize": 10, "maxPoolSize": 5})
+			So(err, ShouldNotBeNil)
+
+			_, err = parsePoolConfig(bson.M{"address": "localhost:27017", "tls": bson.M{"certFile": "client.pem"}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPinning(t *testing.T) {
+	Convey("Pin connections to cursors and transactions", t, func() {
+		// connections records the upstream connection each command
+		// arrived on.
+		connections := make(chan int64, 20)
+		ts := upstreamtest.NewServer(func(req *messages.Message) []messages.Message {
+			connections <- req.Client.ID
+			cursor := bson.D{{Name: "id", Value: int64(0)}, {Name: "ns", Value: "shop.orders"}}
+			switch req.Body[0].Name {
+			case "find":
+				cursor[0].Value = int64(314)
+			case "getMore":
+				if req.Body.Map()["batchSize"] == 1 {
+					cursor[0].Value = int64(314)
+				}
+			}
+			return []messages.Message{{Body: bson.D{
+				{Name: "cursor", Value: cursor},
+				{Name: "ok", Value: 1.0},
+			}}}
+		})
+		defer ts.Close()
+
+		p := &Passthrough{}
+		So(p.Configure(bson.M{"address": ts.Addr, "maxPoolSize": 4}), ShouldBeNil)
+		client := messages.NewClient(1, "10.0.0.1:50000")
+		pins := p.backend.pins
+
+		send := func(body ...bson.DocElem) int64 {
+			res, _ := run(p, decoded(messages.Message{
+				Body: append(bson.D(body), bson.DocElem{Name: "$db", Value: "shop"}),
+			}))
+			So(res.CommandError, ShouldBeNil)
+			return <-connections
+		}
+		// send as the client, recording sessions as proxy core does
+		sendAs := func(body ...bson.DocElem) int64 {
+			msg := decoded(messages.Message{
+				Body: append(bson.D(body), bson.DocElem{Name: "$db", Value: "shop"}),
+			})
+			msg.Client = client
+			sessions.Default.Begin(msg)
+			res, _ := run(p, msg)
+			sessions.Default.Finish(msg, res)
+			So(res.CommandError, ShouldBeNil)
+			return <-connections
+		}
+		session := messages.SessionID(bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")})
+		pinned := func() int {
+			pins.mutex.Lock()
+			n := len(pins.clients[client])
+			pins.mutex.Unlock()
+			if s := sessions.Default.Lookup(session, ""); s != nil && s.Pinned(pins.sessionKey()) != nil {
+				n++
+			}
+			return n
+		}
+
+		Convey("sending getMore over the connection its cursor was opened on", func() {
+			first := sendAs(bson.DocElem{Name: "find", Value: "orders"})
+			So(pinned(), ShouldEqual, 1)
+
+			other := send(bson.DocElem{Name: "ping", Value: 1})
+			So(other, ShouldNotEqual, first)
+
+			So(sendAs(
+				bson.DocElem{Name: "getMore", Value: int64(314)},
+				bson.DocElem{Name: "collection", Value: "orders"},
+				bson.DocElem{Name: "batchSize", Value: 1},
+			), ShouldEqual, first)
+			So(pinned(), ShouldEqual, 1)
+
+			So(sendAs(
+				bson.DocElem{Name: "getMore", Value: int64(314)},
+				bson.DocElem{Name: "collection", Value: "orders"},
+			), ShouldEqual, first)
+			So(pinned(), ShouldEqual, 0)
+
+			Convey("and unpinning it on killCursors", func() {
+				sendAs(bson.DocElem{Name: "find", Value: "orders"})
+				So(pinned(), ShouldEqual, 1)
+				sendAs(
+					bson.DocElem{Name: "killCursors", Value: "orders"},
+					bson.DocElem{Name: "cursors", Value: []interface{}{int64(314)}},
+				)
+				So(pinned(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("sending a transaction's commands over one connection", func() {
+			lsid := bson.DocElem{Name: "lsid", Value: bson.D{{Name: "id", Value: bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}}}}
+			txn := []bson.DocElem{lsid, {Name: "txnNumber", Value: int64(1)}, {Name: "autocommit", Value: false}}
+
+			first := sendAs(append([]bson.DocElem{
+				{Name: "insert", Value: "orders"},
+				{Name: "startTransaction", Value: true},
+			}, txn...)...)
+			So(pinned(), ShouldEqual, 1)
+
+			So(send(bson.DocElem{Name: "ping", Value: 1}), ShouldNotEqual, first)
+			So(sendAs(append([]bson.DocElem{{Name: "find", Value: "orders"}}, txn...)...), ShouldEqual, first)
+			So(sendAs(append([]bson.DocElem{{Name: "commitTransaction", Value: 1}}, txn...)...), ShouldEqual, first)
+			So(pinned(), ShouldEqual, 0)
+
+			Convey("whichever client connection they arrive on", func() {
+				txn[1].Value = int64(2)
+				first := sendAs(append([]bson.DocElem{
+					{Name: "insert", Value: "orders"},
+					{Name: "startTransaction", Value: true},
+				}, txn...)...)
+
+				other := messages.NewClient(2, "10.0.0.1:50001")
+				msg := decoded(messages.Message{
+					Body: append(bson.D{{Name: "find", Value: "orders"}}, append(txn, bson.DocElem{Name: "$db", Value: "shop"})...),
+				})
+				msg.Client = other
+				sessions.Default.Begin(msg)
+				run(p, msg)
+				So(<-connections, ShouldEqual, first)
+				So(pinned(), ShouldEqual, 1)
+
+				Convey("until the session ends", func() {
+					sessions.Default.End(session, "")
+					So(pinned(), ShouldEqual, 0)
+					So(p.backend.pool.Stats().InUse, ShouldEqual, 0)
+				})
+			})
+		})
+
+		Convey("giving connections back when clients disconnect", func() {
+			sendAs(bson.DocElem{Name: "find", Value: "orders"})
+			So(pinned(), ShouldEqual, 1)
+			client.Close()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for pinned() > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(pinned(), ShouldEqual, 0)
+			So(p.backend.pool.Stats().InUse, ShouldEqual, 0)
+		})
+
+		Convey("giving connections pinned to cursors back once unused too long", func() {
+			sendAs(bson.DocElem{Name: "find", Value: "orders"})
+			pins.reap(time.Now().Add(CursorPinTimeout / 2))
+			So(pinned(), ShouldEqual, 1)
+
+			pins.reap(time.Now().Add(CursorPinTimeout + time.Second))
+			So(pinned(), ShouldEqual, 0)
+			So(p.backend.pool.Stats().InUse, ShouldEqual, 0)
+		})
+
+		Convey("unless pinning is off", func() {
+			So(p.Configure(bson.M{"address": ts.Addr, "maxPoolSize": 4, "pinning": false}), ShouldBeNil)
+			sendAs(bson.DocElem{Name: "find", Value: "orders"})
+			So(pinned(), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestPassthroughClosing(t *testing.T) {
+	Convey("Share backends between modules until the last is closed", t, func() {
+		ts := upstreamtest.NewServer(echo)
+		defer ts.Close()
+
+		one, two := &Passthrough{}, &Passthrough{}
+		So(one.Configure(bson.M{"address": ts.Addr}), ShouldBeNil)
+		So(two.Configure(bson.M{"address": ts.Addr}), ShouldBeNil)
+		b := one.backend
+		So(two.backend, ShouldPointTo, b)
+
+		So(one.Close(), ShouldBeNil)
+		res, _ := run(two, decoded(messages.Message{Body: bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}}))
+		So(res.CommandError, ShouldBeNil)
+
+		So(two.Close(), ShouldBeNil)
+		backendsMutex.Lock()
+		_, shared := backends[b.config]
+		backendsMutex.Unlock()
+		So(shared, ShouldBeFalse)
+		So(b.pool.Stats().Open, ShouldEqual, 0)
+
+		// the next module gets a new backend
+		three := &Passthrough{}
+		So(three.Configure(bson.M{"address": ts.Addr}), ShouldBeNil)
+		defer three.Close()
+		So(three.backend, ShouldNotPointTo, b)
+	})
+}
+
+func TestWaitQueueTimeout(t *testing.T) {
+	Convey("Fail requests that find no free connection in time", t, func() {
+		ts := upstreamtest.NewServer(echo)
+		defer ts.Close()
+
+		p := &Passthrough{}
+		So(p.Configure(bson.M{"address": ts.Addr, "maxPoolSize": 1, "waitQueueTimeoutSecs": 0.02}), ShouldBeNil)
+
+		conn, err := p.backend.pool.Get(context.Background())
+		So(err, ShouldBeNil)
+		defer p.backend.pool.Put(conn)
+
+		res, _ := run(p, decoded(messages.Message{Body: bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}}))
+		So(res.CommandError, ShouldNotBeNil)
+		So(res.CommandError.ErrorCode, ShouldEqual, messages.ExceededTimeLimit)
+	})
+}
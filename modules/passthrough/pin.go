@@ -0,0 +1,268 @@
+package passthrough
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	"github.com/mongodbinc-interns/mongoproxy/upstream"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Requests share upstream connections, one request at a time, but some
+// requests continue what an earlier one started: getMore and killCursors
+// continue a cursor, and the commands of a multi-statement transaction
+// continue it. Behind a load balancer, cursors and transactions live on
+// whichever server the connection they started on went to, so requests
+// that continue them must go over that connection. Until then, it is
+// pinned to the client, for cursors, or to the session, for transactions,
+// whose statements may arrive over any of a driver's connections, rather
+// than given back to the pool.
+
+type pinReason string
+
+const (
+	cursorPin      pinReason = "cursor"
+	transactionPin pinReason = "transaction"
+)
+
+// a pinKey identifies what a connection is pinned to: a cursor by its ID,
+// or a transaction by the ID of its session.
+type pinKey struct {
+	reason pinReason
+	id     string
+}
+
+func cursorKey(id int64) pinKey {
+	return pinKey{reason: cursorPin, id: fmt.Sprint(id)}
+}
+
+// requestPin returns the key of the connection a request must go over, if
+// it continues a cursor.
+func requestPin(body bson.D) (pinKey, bool) {
+	if len(body) == 0 {
+		return pinKey{}, false
+	}
+
+	switch body[0].Name {
+	case "getMore":
+		return cursorKey(convert.ToInt64(body[0].Value)), true
+	case "killCursors":
+		if ids := killedCursors(body); len(ids) > 0 {
+			return cursorKey(ids[0]), true
+		}
+	}
+	return pinKey{}, false
+}
+
+// killedCursors returns the cursor IDs of a killCursors command.
+func killedCursors(body bson.D) []int64 {
+	ids := []int64{}
+	if cursors, ok := bsonutil.FindValueByKey("cursors", body).([]interface{}); ok {
+		for _, id := range cursors {
+			ids = append(ids, convert.ToInt64(id))
+		}
+	}
+	return ids
+}
+
+// replyCursorID returns the ID of the cursor a reply leaves open, or 0.
+func replyCursorID(body bson.D) int64 {
+	cursor := convert.ToBSONMap(bsonutil.FindValueByKey("cursor", body))
+	if cursor == nil {
+		return 0
+	}
+	return convert.ToInt64(cursor["id"])
+}
+
+// CursorPinTimeout is how long a connection stays pinned to a cursor that
+// is not used, as with MongoDB's cursor timeout, so that clients that
+// abandon cursors do not use up the pool.
+const CursorPinTimeout = 10 * time.Minute
+
+// a pinned connection, and when it was last pinned.
+type pinned struct {
+	conn  *upstream.Conn
+	since time.Time
+}
+
+// A pinner holds the connections from a pool that are pinned to clients
+// and sessions.
+type pinner struct {
+	pool    *upstream.Pool
+	timeout time.Duration
+
+	mutex   sync.Mutex
+	clients map[*messages.Client]map[pinKey]pinned
+	done    chan struct{}
+}
+
+// newPinner creates a pinner that gives connections pinned to cursors
+// unused for longer than timeout back to the pool, checking every
+// interval.
+func newPinner(pool *upstream.Pool, timeout time.Duration, interval time.Duration) *pinner {
+	p := &pinner{
+		pool:    pool,
+		timeout: timeout,
+		clients: make(map[*messages.Client]map[pinKey]pinned),
+		done:    make(chan struct{}),
+	}
+	go p.reapLoop(interval)
+	return p
+}
+
+func (p *pinner) reapLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.reap(now)
+		}
+	}
+}
+
+// reap gives back the connections pinned to cursors unused since before
+// the timeout. The cursors have timed out upstream by then, too.
+func (p *pinner) reap(now time.Time) {
+	expired := []pinned{}
+	p.mutex.Lock()
+	for _, pins := range p.clients {
+		for key, pin := range pins {
+			if key.reason == cursorPin && now.Sub(pin.since) > p.timeout {
+				delete(pins, key)
+				pinnedConnections.With(string(key.reason)).Dec()
+				expired = append(expired, pin)
+			}
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, pin := range expired {
+		p.pool.Put(pin.conn)
+	}
+}
+
+// close stops reaping, and gives back the connections pinned to clients.
+func (p *pinner) close() {
+	p.mutex.Lock()
+	close(p.done)
+	clients := p.clients
+	p.clients = make(map[*messages.Client]map[pinKey]pinned)
+	p.mutex.Unlock()
+
+	for _, pins := range clients {
+		for key, pin := range pins {
+			pinnedConnections.With(string(key.reason)).Dec()
+			p.pool.Put(pin.conn)
+		}
+	}
+}
+
+// take removes and returns the connection pinned to key for a client, or
+// nil if there is none.
+func (p *pinner) take(client *messages.Client, key pinKey) *upstream.Conn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pin, ok := p.clients[client][key]
+	if !ok {
+		return nil
+	}
+	delete(p.clients[client], key)
+	pinnedConnections.With(string(key.reason)).Dec()
+	return pin.conn
+}
+
+// pin pins a connection to key for a client, or gives it back to the pool
+// if the client has disconnected or the pinner is closed.
+func (p *pinner) pin(client *messages.Client, key pinKey, conn *upstream.Conn) {
+	p.mutex.Lock()
+	select {
+	case <-client.Done():
+		p.mutex.Unlock()
+		p.pool.Put(conn)
+		return
+	case <-p.done:
+		p.mutex.Unlock()
+		p.pool.Put(conn)
+		return
+	default:
+	}
+
+	pins, ok := p.clients[client]
+	if !ok {
+		pins = make(map[pinKey]pinned)
+		p.clients[client] = pins
+		go p.watch(client)
+	}
+	old, replaced := pins[key]
+	pins[key] = pinned{conn: conn, since: time.Now()}
+	if !replaced {
+		pinnedConnections.With(string(key.reason)).Inc()
+	}
+	p.mutex.Unlock()
+
+	if replaced && old.conn != conn {
+		p.pool.Put(old.conn)
+	}
+}
+
+// unpin gives the connection pinned to key for a client back to the pool.
+func (p *pinner) unpin(client *messages.Client, key pinKey) {
+	if conn := p.take(client, key); conn != nil {
+		p.pool.Put(conn)
+	}
+}
+
+// watch gives a client's pinned connections back to the pool once it
+// disconnects. Cursors and transactions it left open time out upstream.
+func (p *pinner) watch(client *messages.Client) {
+	<-client.Done()
+
+	p.mutex.Lock()
+	pins := p.clients[client]
+	delete(p.clients, client)
+	p.mutex.Unlock()
+
+	for key, pin := range pins {
+		pinnedConnections.With(string(key.reason)).Dec()
+		p.pool.Put(pin.conn)
+	}
+}
+
+// sessionKey is the key a pinner's connections are pinned to sessions
+// under, distinct for each pool.
+func (p *pinner) sessionKey() string {
+	return fmt.Sprintf("passthrough %s %p", p.pool.Address(), p)
+}
+
+// takeTransaction removes and returns the connection pinned to a
+// session's transaction, or nil if there is none.
+func (p *pinner) takeTransaction(s *sessions.Session) *upstream.Conn {
+	conn, ok := s.Take(p.sessionKey()).(*upstream.Conn)
+	if !ok {
+		return nil
+	}
+	pinnedConnections.With(string(transactionPin)).Dec()
+	return conn
+}
+
+// pinTransaction pins a connection to a session's open transaction, until
+// it ends, or gives it back to the pool if there is none.
+func (p *pinner) pinTransaction(s *sessions.Session, conn *upstream.Conn) {
+	pinned := s.Pin(p.sessionKey(), conn, func(value interface{}) {
+		pinnedConnections.With(string(transactionPin)).Dec()
+		p.pool.Put(value.(*upstream.Conn))
+	})
+	if pinned {
+		pinnedConnections.With(string(transactionPin)).Inc()
+	} else {
+		p.pool.Put(conn)
+	}
+}
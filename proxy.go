@@ -4,10 +4,14 @@ import (
 	"fmt"
 	"encoding/json"
 	"github.com/BurntSushi/toml"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
 	"github.com/mongodbinc-interns/mongoproxy/convert"
 	. "github.com/mongodbinc-interns/mongoproxy/log"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/redact"
 	"github.com/mongodbinc-interns/mongoproxy/server"
+	"github.com/mongodbinc-interns/mongoproxy/sessions"
+	"github.com/mongodbinc-interns/mongoproxy/slowop"
 	_ "github.com/mongodbinc-interns/mongoproxy/server/config"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -16,6 +20,8 @@ import (
 	"io/ioutil"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 // ParseConfigFromFile takes a filename for a TOML file, and returns a configuration
@@ -50,7 +56,7 @@ func ParseConfigFromFile(configFilename string) (bson.M, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse “%s”: %v", configFilename, err)
 	}
-fmt.Printf("config: %#v\n", result)
+	Log(DEBUG, "config: %#v", server.SanitizeConfig(result))
 
 	return result, nil
 }
@@ -82,33 +88,93 @@ func ParseConfigFromDB(mongoURI string, configNamespace string) (bson.M, error)
 	return result, nil
 }
 
-// Start starts the server at the provided port and with the given module chain.
-func Start(port int, chain *server.ModuleChain) {
+// A ConfigLoader fetches a fresh copy of the proxy configuration, and is
+// used to reload the module pipeline while the proxy is running.
+type ConfigLoader func() (bson.M, error)
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
-	if err != nil {
-		Log(ERROR, "Error listening on port %v: %v", port, err)
-		return
+// A Proxy accepts client connections on a port, and runs every request
+// they send through its module pipeline.
+type Proxy struct {
+	port       int
+	loadConfig ConfigLoader
+
+	mutex        sync.RWMutex
+	current      *generation
+	listener     net.Listener
+	draining     bool
+	clients      map[int64]*clientConn
+	nextClientID int64
+	connections  sync.WaitGroup
+
+	// retiring counts the generations waiting to be closed
+	retiring sync.WaitGroup
+
+	slowOps *slowop.Log
+}
+
+// a generation is a module chain and the pipeline built from it, which
+// is closed once a reload replaces it and the requests in it are done.
+type generation struct {
+	chain    *server.ModuleChain
+	pipeline server.PipelineFunc
+	requests sync.WaitGroup
+}
+
+func newGeneration(chain *server.ModuleChain) *generation {
+	return &generation{chain: chain, pipeline: server.BuildPipeline(chain)}
+}
+
+// retire closes the generation's chain once its requests are done.
+func (g *generation) retire() {
+	g.requests.Wait()
+	if err := g.chain.Close(); err != nil {
+		Log(ERROR, "Error closing the old module pipeline: %v", err)
 	}
+}
 
-	pipeline := server.BuildPipeline(chain)
-	Log(INFO, "Server running on port %v", port)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			Log(ERROR, "error accepting connection: %v", err)
-			continue
-		}
+// a clientConn is an accepted connection along with proxy core's
+// description of it.
+type clientConn struct {
+	conn   net.Conn
+	client *messages.Client
+	busy   bool
 
-		Log(NOTICE, "accepted connection from: %v", conn.RemoteAddr())
-		go handleConnection(conn, pipeline)
+	// gen is the generation its in-flight request is in, if any.
+	gen *generation
+
+	// lastReplyID is the requestID of the last streamed reply, which
+	// the next one answers.
+	lastReplyID messages.RequestID
+}
+
+// NewProxy creates a proxy that listens on the provided port and runs
+// requests through the given module chain.
+func NewProxy(port int, chain *server.ModuleChain) *Proxy {
+	return &Proxy{
+		port:    port,
+		current: newGeneration(chain),
+		clients: make(map[int64]*clientConn),
 	}
+}
 
+// NewProxyWithConfig creates a proxy that listens on the provided port,
+// with a module chain created from the given configuration. If loader is
+// not nil, it is used by Reload to fetch a new configuration.
+func NewProxyWithConfig(port int, config bson.M, loader ConfigLoader) (*Proxy, error) {
+	chain, err := configure(config)
+	if err != nil {
+		return nil, err
+	}
+	p := NewProxy(port, chain)
+	p.loadConfig = loader
+	return p, nil
 }
 
-// StartWithConfig starts the server at the provided port, creating a module chaine
-// with the given configuration.
-func StartWithConfig(port int, config bson.M) {
+// BuildChain creates a module chain from a proxy configuration, creating
+// and configuring each module listed in its "modules" field. Modules that
+// are missing a name or are not in the registry are skipped; an error is
+// returned if the module list or any module configuration is invalid.
+func BuildChain(config bson.M) (*server.ModuleChain, error) {
 	chain := server.CreateChain()
 	var modules []bson.M
 	var err error
@@ -116,8 +182,7 @@ func StartWithConfig(port int, config bson.M) {
 	if ok {
 		modules, err = convert.ConvertToBSONMapSlice(modulesRaw)
 		if err != nil {
-			Log(CRITICAL, "Invalid module configuration: %v. Proxy cannot start .", err)
-			return
+			return nil, fmt.Errorf("Invalid module configuration: %v", err)
 		}
 	} else {
 		Log(WARNING, "No modules provided. Proxy will start without modules.")
@@ -141,48 +206,446 @@ func StartWithConfig(port int, config bson.M) {
 		moduleConfig := convert.ToBSONMap(modules[i]["config"])
 		err := module.Configure(moduleConfig)
 		if err != nil {
-			Log(CRITICAL, "Invalid configuration for module %v: %v", moduleName, err)
-			return
+			chain.Close()
+			return nil, fmt.Errorf("Invalid configuration for module %v: %v", moduleName, err)
 		}
-		chain.AddModule(module)
+
+		alias := convert.ToString(modules[i]["alias"], moduleName)
+		chain.AddModuleAs(alias, module, moduleConfig)
+	}
+	return chain, nil
+}
+
+// configure applies the proxy-wide settings in a proxy configuration, and
+// builds its module chain. Redaction settings are applied first, since
+// modules may extend them as they are configured, and put back if the
+// chain cannot be built; session and metrics settings only once it is,
+// so that a bad configuration leaves the proxy's settings be.
+func configure(config bson.M) (*server.ModuleChain, error) {
+	redactConfig, err := redact.ParseConfig(convert.ToBSONMap(config["redaction"]))
+	if err != nil {
+		return nil, err
+	}
+	sessionsConfig, err := sessions.ParseConfig(convert.ToBSONMap(config["sessions"]))
+	if err != nil {
+		return nil, err
+	}
+	databases, err := parseMetricsConfig(convert.ToBSONMap(config["metrics"]))
+	if err != nil {
+		return nil, err
+	}
+	saved := redact.Save()
+	redact.Configure(redactConfig)
+
+	chain, err := BuildChain(config)
+	if err != nil {
+		redact.Restore(saved)
+		return nil, err
+	}
+	sessions.Default.Configure(sessionsConfig)
+	configureMetrics(databases)
+	return chain, nil
+}
+
+// Start starts the server at the provided port and with the given module chain.
+func Start(port int, chain *server.ModuleChain) {
+	err := NewProxy(port, chain).Run()
+	if err != nil {
+		Log(ERROR, "%v", err)
+	}
+}
+
+// StartWithConfig starts the server at the provided port, creating a module chaine
+// with the given configuration.
+func StartWithConfig(port int, config bson.M) {
+	chain, err := configure(config)
+	if err != nil {
+		Log(CRITICAL, "%v. Proxy cannot start.", err)
+		return
 	}
 	Start(port, chain)
 }
 
-func handleConnection(conn net.Conn, pipeline server.PipelineFunc) {
+// Run listens on the proxy's port and handles client connections until the
+// proxy is drained. It returns once all connections have closed.
+func (p *Proxy) Run() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", p.port))
+	if err != nil {
+		return fmt.Errorf("Error listening on port %v: %v", p.port, err)
+	}
+
+	p.mutex.Lock()
+	p.listener = ln
+	p.mutex.Unlock()
+
+	Log(INFO, "Server running on port %v", p.port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if p.isDraining() {
+				break
+			}
+			Log(ERROR, "error accepting connection: %v", err)
+			continue
+		}
+
+		Log(NOTICE, "accepted connection from: %v", conn.RemoteAddr())
+		connectionsAccepted.Inc()
+		c := p.addClient(conn)
+		if c == nil {
+			continue
+		}
+		go p.handleConnection(c)
+	}
+
+	p.connections.Wait()
+	Log(NOTICE, "Server on port %v drained", p.port)
+
+	p.retiring.Wait()
+	p.mutex.RLock()
+	current := p.current
+	p.mutex.RUnlock()
+	if err := current.chain.Close(); err != nil {
+		Log(ERROR, "Error closing the module pipeline: %v", err)
+	}
+	return nil
+}
+
+// Reload fetches a new configuration with the proxy's ConfigLoader, and
+// replaces the module pipeline with one built from it. Requests already in
+// the old pipeline finish there; later requests use the new one. The old
+// pipeline's modules are closed once its last request is done.
+func (p *Proxy) Reload() error {
+	if p.loadConfig == nil {
+		return fmt.Errorf("Proxy has no configuration source to reload from")
+	}
+
+	config, err := p.loadConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+
+	chain, err := configure(config)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	if p.draining {
+		p.mutex.Unlock()
+		chain.Close()
+		return fmt.Errorf("Proxy is draining")
+	}
+	old := p.current
+	p.current = newGeneration(chain)
+	p.retiring.Add(1)
+	p.mutex.Unlock()
+	go func() {
+		defer p.retiring.Done()
+		old.retire()
+	}()
+
+	Log(NOTICE, "Reloaded module pipeline")
+	return nil
+}
+
+// Drain stops the proxy from accepting new connections, and closes each
+// open connection once its in-flight request, if any, has been answered.
+// It does not wait for connections to close; Run returns once they have.
+func (p *Proxy) Drain() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.draining {
+		return nil
+	}
+	p.draining = true
+	Log(NOTICE, "Draining %v connections", len(p.clients))
+
+	if p.listener != nil {
+		p.listener.Close()
+	}
+
+	// idle connections are blocked reading their next request, so expire
+	// the read to wake them up.
+	for _, c := range p.clients {
+		if !c.busy {
+			c.conn.SetReadDeadline(time.Now())
+		}
+	}
+	return nil
+}
+
+// Modules returns descriptions of the modules in the current pipeline.
+func (p *Proxy) Modules() []server.ModuleInfo {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.current.chain.Modules()
+}
+
+// Clients returns the currently open client connections.
+func (p *Proxy) Clients() []*messages.Client {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	clients := make([]*messages.Client, 0, len(p.clients))
+	for _, c := range p.clients {
+		clients = append(clients, c.client)
+	}
+	return clients
+}
+
+func (p *Proxy) isDraining() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.draining
+}
+
+// enter returns the current pipeline for a connection's request, which
+// keeps its generation open until the request is done.
+func (p *Proxy) enter(c *clientConn) server.PipelineFunc {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	c.gen = p.current
+	c.gen.requests.Add(1)
+	return c.gen.pipeline
+}
+
+// leave marks a connection's request as done with its generation. The
+// proxy must be locked.
+func (c *clientConn) leave() {
+	if c.gen != nil {
+		c.gen.requests.Done()
+		c.gen = nil
+	}
+}
+
+// addClient registers a connection, or closes it and returns nil if the
+// proxy has started draining, since Drain only wakes the connections it
+// knows of.
+func (p *Proxy) addClient(conn net.Conn) *clientConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.draining {
+		conn.Close()
+		return nil
+	}
+	p.nextClientID++
+	c := &clientConn{
+		conn:   conn,
+		client: messages.NewClient(p.nextClientID, conn.RemoteAddr().String()),
+	}
+	p.clients[c.client.ID] = c
+	p.connections.Add(1)
+	connectionsOpen.Inc()
+	return c
+}
+
+func (p *Proxy) removeClient(c *clientConn) {
+	p.mutex.Lock()
+	delete(p.clients, c.client.ID)
+	c.leave()
+	p.mutex.Unlock()
+
+	c.conn.Close()
+	c.client.Close()
+	connectionsOpen.Dec()
+	p.connections.Done()
+}
+
+// setBusy marks whether a connection has a request in flight, letting go
+// of the generation of one that is done. It returns false if the proxy is
+// draining and the connection should close instead.
+func (p *Proxy) setBusy(c *clientConn, busy bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	c.busy = busy
+	if !busy {
+		c.leave()
+	}
+	return !p.draining
+}
+
+// attach returns the request with the client it arrived on, and a trace
+// for the pipeline to record module timings in, attached.
+func attach(req messages.Requester, client *messages.Client, trace *messages.Trace) messages.Requester {
+	switch r := req.(type) {
+	case messages.Command:
+		r.Client = client
+		r.Trace = trace
+		return r
+	case *messages.Message:
+		r.Client = client
+		r.Trace = trace
+		return r
+	}
+	return req
+}
+
+// recordHandshake saves the driver metadata from a hello or isMaster
+// request to the client.
+func recordHandshake(req messages.Requester, client *messages.Client) {
+	var name string
+	var metadata bson.M
+	switch r := req.(type) {
+	case messages.Command:
+		name = r.CommandName
+		metadata = convert.ToBSONMap(r.Args["client"])
+	case *messages.Message:
+		name = r.CommandName()
+		metadata = convert.ToBSONMap(bsonutil.FindValueByKey("client", r.Body))
+	}
+
+	switch name {
+	case "hello", "isMaster", "ismaster":
+		if metadata != nil {
+			client.SetMetadata(metadata)
+		}
+	}
+}
+
+func (p *Proxy) handleConnection(c *clientConn) {
+	defer p.removeClient(c)
+	conn := c.conn
+
 	for {
 
 		message, msgHeader, err := messages.Decode(conn)
 
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !p.isDraining() {
 				Log(ERROR, "Decoding error: %v", err)
 			}
-			conn.Close()
 			return
 		}
 
-		Log(DEBUG, "Request: %#v", message)
+		if !p.setBusy(c, true) {
+			// the proxy started draining while we read this request, but
+			// it will still get an answer.
+			Log(INFO, "Answering final request before closing connection %v", c.client.ID)
+		}
+
+		start := time.Now()
+		countRequest(msgHeader, message)
+		message = attach(message, c.client, messages.NewTrace())
+		c.client.AddRequest()
+		recordHandshake(message, c.client)
+		sessions.Default.Begin(message)
+
+		fields := messages.LogFields(message)
+		LogWith(DEBUG, fields, "Request: %#v", message)
 
 		res := &messages.ModuleResponse{}
-		pipeline(message, res)
+		p.enter(c)(message, res)
+		messages.RecordAuth(message, *res)
+		sessions.Default.Finish(message, *res)
+
+		if isFireAndForget(message) {
+			if res.Stream != nil {
+				res.Stream.Close()
+			}
+			fields.Duration = time.Since(start)
+			LogWith(INFO, fields, "Handled fire-and-forget request")
+			if !p.setBusy(c, false) {
+				return
+			}
+			continue
+		}
 
 		bytes, err := messages.Encode(msgHeader, *res)
 
 		// update, delete, and insert messages do not have a response, so we continue and write the
 		// response on the getLastError that will be called immediately after. Kind of a hack.
 		if err != nil {
-			Log(ERROR, "Encoding error: %v", err)
-			conn.Close()
+			if res.Stream != nil {
+				res.Stream.Close()
+			}
+			LogWith(ERROR, fields, "Encoding error: %v", err)
 			return
 		}
 
+		if res.Stream != nil {
+			bytes = c.stampReply(bytes)
+		}
+
+		responseBytes.Observe(float64(len(bytes)))
+		writeStart := time.Now()
 		_, err = conn.Write(bytes)
 		if err != nil {
-			Log(ERROR, "Error writing to connection: %v", err)
-			conn.Close()
+			if res.Stream != nil {
+				res.Stream.Close()
+			}
+			LogWith(ERROR, fields, "Error writing to connection: %v", err)
+			return
+		}
+
+		bytesOut := len(bytes)
+		if res.Stream != nil {
+			streamed, err := c.writeStream(res.Stream)
+			bytesOut += streamed
+			if err != nil {
+				LogWith(ERROR, fields, "Error streaming replies: %v", err)
+				return
+			}
+		}
+
+		fields.Duration = time.Since(start)
+		LogWith(INFO, fields, "Handled request")
+
+		if p.slowOps.IsSlow(fields.Duration) {
+			p.recordSlowOp(message, *res, int(msgHeader.MessageLength), bytesOut,
+				fields.Duration, time.Since(writeStart))
+		}
+
+		if !p.setBusy(c, false) {
 			return
 		}
+	}
+}
 
+// isFireAndForget returns whether a request has the moreToCome flag set,
+// which means the client expects no reply.
+func isFireAndForget(req messages.Requester) bool {
+	msg, ok := req.(*messages.Message)
+	return ok && msg.FlagBits&messages.OP_MSG_FLAG_MORE_TO_COME != 0
+}
+
+// stampReply gives a reply in a stream a requestID of its own, which the
+// next reply in the stream answers.
+func (c *clientConn) stampReply(frame []byte) []byte {
+	c.lastReplyID++
+	return messages.RewriteIDs(frame, c.lastReplyID, messages.FrameHeader(frame).ResponseTo)
+}
+
+// writeStream writes the replies that follow a reply with moreToCome set,
+// each answering the one before, until one without moreToCome. It returns
+// the number of bytes written.
+func (c *clientConn) writeStream(stream messages.ReplyStream) (int, error) {
+	written := 0
+	for {
+		reply, err := stream.Next()
+		if err != nil {
+			stream.Close()
+			return written, err
+		}
+
+		bytes, err := reply.ToBytes(messages.MsgHeader{RequestID: c.lastReplyID})
+		if err != nil {
+			stream.Close()
+			return written, err
+		}
+		bytes = c.stampReply(bytes)
+
+		responseBytes.Observe(float64(len(bytes)))
+		_, err = c.conn.Write(bytes)
+		if err != nil {
+			stream.Close()
+			return written, err
+		}
+		written += len(bytes)
+
+		if messages.FrameHeader(bytes).OpCode != messages.OP_MSG ||
+			messages.FrameFlags(bytes)&messages.OP_MSG_FLAG_MORE_TO_COME == 0 {
+			return written, nil
+		}
 	}
 }
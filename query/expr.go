@@ -0,0 +1,431 @@
+package query
+
+import (
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// An Expression is a compiled aggregation expression, as $expr takes.
+type Expression struct {
+	eval evaluator
+}
+
+// vars are the variables an expression is evaluated with, by name
+// without the $$: at least ROOT and CURRENT.
+type vars map[string]interface{}
+
+// an evaluator evaluates a compiled expression.
+type evaluator func(v vars) (interface{}, error)
+
+// a scope is the names of the variables defined where an expression is.
+type scope map[string]bool
+
+// builtinVariables are the variables every expression may use.
+var builtinVariables = scope{"ROOT": true, "CURRENT": true, "REMOVE": true}
+
+// an operator compiles the argument of an expression operator.
+type operator func(arg interface{}, s scope) (evaluator, error)
+
+// operators are the expression operators, by name.
+var operators map[string]operator
+
+// CompileExpression compiles an aggregation expression.
+func CompileExpression(expr interface{}) (*Expression, error) {
+	eval, err := compileExpression(expr, builtinVariables)
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{eval: eval}, nil
+}
+
+// Evaluate evaluates the expression with a document as ROOT and CURRENT.
+// Paths the document does not have evaluate to Missing.
+func (e *Expression) Evaluate(doc bson.D) (interface{}, error) {
+	return e.eval(vars{"ROOT": doc, "CURRENT": doc})
+}
+
+func compileExpression(expr interface{}, s scope) (evaluator, error) {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$$") {
+			return compileVariable(e[2:], s)
+		}
+		if strings.HasPrefix(e, "$") {
+			if len(e) == 1 || strings.Contains(e, "..") || strings.HasSuffix(e, ".") {
+				return nil, errorf(messages.BadValue, "Invalid field path: “%s”", e)
+			}
+			parts := strings.Split(e[1:], ".")
+			return func(v vars) (interface{}, error) {
+				return getPath(v["CURRENT"], parts), nil
+			}, nil
+		}
+	case []interface{}:
+		elems := make([]evaluator, len(e))
+		for i, elem := range e {
+			var err error
+			if elems[i], err = compileExpression(elem, s); err != nil {
+				return nil, err
+			}
+		}
+		return func(v vars) (interface{}, error) {
+			out := make([]interface{}, len(elems))
+			for i, elem := range elems {
+				value, err := elem(v)
+				if err != nil {
+					return nil, err
+				}
+				if value == Missing {
+					value = nil
+				}
+				out[i] = value
+			}
+			return out, nil
+		}, nil
+	}
+
+	doc := bsonutil.ToD(expr)
+	if doc == nil {
+		return func(vars) (interface{}, error) {
+			return expr, nil
+		}, nil
+	}
+	if isOperatorDoc(doc) {
+		if len(doc) != 1 {
+			return nil, errorf(messages.BadValue, "an expression specification must contain exactly one field, the name of the expression. Found %d fields", len(doc))
+		}
+		op, ok := operators[doc[0].Name]
+		if !ok {
+			return nil, errorf(messages.BadValue, "Unrecognized expression '%s'", doc[0].Name)
+		}
+		return op(doc[0].Value, s)
+	}
+	return compileObject(doc, s)
+}
+
+func compileVariable(ref string, s scope) (evaluator, error) {
+	name, rest := ref, []string(nil)
+	if i := strings.Index(ref, "."); i >= 0 {
+		name, rest = ref[:i], strings.Split(ref[i+1:], ".")
+	}
+	if !s[name] {
+		return nil, errorf(messages.BadValue, "Use of undefined variable: %s", name)
+	}
+	if name == "REMOVE" {
+		return func(vars) (interface{}, error) {
+			return Missing, nil
+		}, nil
+	}
+	return func(v vars) (interface{}, error) {
+		return getPath(v[name], rest), nil
+	}, nil
+}
+
+// compileObject compiles a document whose fields are expressions. Fields
+// whose expressions evaluate to Missing are left out.
+func compileObject(doc bson.D, s scope) (evaluator, error) {
+	fields := make([]evaluator, len(doc))
+	for i, elem := range doc {
+		if strings.HasPrefix(elem.Name, "$") {
+			return nil, errorf(messages.BadValue, "FieldPath field names may not start with '$', given '%s'", elem.Name)
+		}
+		var err error
+		if fields[i], err = compileExpression(elem.Value, s); err != nil {
+			return nil, err
+		}
+	}
+	return func(v vars) (interface{}, error) {
+		out := bson.D{}
+		for i, f := range fields {
+			value, err := f(v)
+			if err != nil {
+				return nil, err
+			}
+			if value != Missing {
+				out = append(out, bson.DocElem{Name: doc[i].Name, Value: value})
+			}
+		}
+		return out, nil
+	}, nil
+}
+
+// getPath returns the value at a path, as expressions see it: a path
+// into an array is the array of the values at the path in its elements.
+func getPath(v interface{}, parts []string) interface{} {
+	if len(parts) == 0 {
+		return v
+	}
+	if doc := bsonutil.ToD(v); doc != nil {
+		value, ok := field(doc, parts[0])
+		if !ok {
+			return Missing
+		}
+		return getPath(value, parts[1:])
+	}
+	array := bsonutil.ToArray(v)
+	if array == nil {
+		return Missing
+	}
+	out := []interface{}{}
+	for _, elem := range array {
+		if bsonutil.ToD(elem) == nil && bsonutil.ToArray(elem) == nil {
+			continue
+		}
+		if value := getPath(elem, parts); value != Missing {
+			out = append(out, value)
+		}
+	}
+	return out
+}
+
+// compileArgs compiles the arguments of an operator, which are an array,
+// or a single argument on its own, failing if there are fewer than min or
+// more than max, if max is not -1.
+func compileArgs(name string, arg interface{}, min int, max int, s scope) ([]evaluator, error) {
+	args := bsonutil.ToArray(arg)
+	if args == nil {
+		args = []interface{}{arg}
+	}
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		if min == max {
+			return nil, errorf(messages.BadValue, "Expression %s takes exactly %d arguments. %d were passed in.", name, min, len(args))
+		}
+		return nil, errorf(messages.BadValue, "Expression %s takes at least %d arguments, and at most %d. %d were passed in.", name, min, max, len(args))
+	}
+	evals := make([]evaluator, len(args))
+	for i, a := range args {
+		var err error
+		if evals[i], err = compileExpression(a, s); err != nil {
+			return nil, err
+		}
+	}
+	return evals, nil
+}
+
+// evalArgs evaluates the arguments of an operator.
+func evalArgs(args []evaluator, v vars) ([]interface{}, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		var err error
+		if values[i], err = arg(v); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// fixed returns an operator of a fixed number of arguments, evaluated
+// before it is applied to them.
+func fixed(name string, n int, apply func(args []interface{}) (interface{}, error)) operator {
+	return variadic(name, n, n, apply)
+}
+
+// variadic returns an operator of min to max arguments, or more if max is
+// -1, evaluated before it is applied to them.
+func variadic(name string, min int, max int, apply func(args []interface{}) (interface{}, error)) operator {
+	return func(arg interface{}, s scope) (evaluator, error) {
+		args, err := compileArgs(name, arg, min, max, s)
+		if err != nil {
+			return nil, err
+		}
+		return func(v vars) (interface{}, error) {
+			values, err := evalArgs(args, v)
+			if err != nil {
+				return nil, err
+			}
+			return apply(values)
+		}, nil
+	}
+}
+
+// compareValues orders values as aggregation does: as bsonutil.Compare
+// does, with missing values before all others.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == Missing && b == Missing:
+		return 0
+	case a == Missing:
+		return -1
+	case b == Missing:
+		return 1
+	}
+	return bsonutil.Compare(a, b)
+}
+
+func comparison(name string, test func(c int) bool) operator {
+	return fixed(name, 2, func(args []interface{}) (interface{}, error) {
+		return test(compareValues(args[0], args[1])), nil
+	})
+}
+
+func init() {
+	operators = map[string]operator{
+		"$eq":  comparison("$eq", func(c int) bool { return c == 0 }),
+		"$ne":  comparison("$ne", func(c int) bool { return c != 0 }),
+		"$gt":  comparison("$gt", func(c int) bool { return c > 0 }),
+		"$gte": comparison("$gte", func(c int) bool { return c >= 0 }),
+		"$lt":  comparison("$lt", func(c int) bool { return c < 0 }),
+		"$lte": comparison("$lte", func(c int) bool { return c <= 0 }),
+		"$cmp": fixed("$cmp", 2, func(args []interface{}) (interface{}, error) {
+			return compareValues(args[0], args[1]), nil
+		}),
+
+		"$and": variadic("$and", 0, -1, func(args []interface{}) (interface{}, error) {
+			for _, arg := range args {
+				if !Truthy(arg) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}),
+		"$or": variadic("$or", 0, -1, func(args []interface{}) (interface{}, error) {
+			for _, arg := range args {
+				if Truthy(arg) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}),
+		"$not": fixed("$not", 1, func(args []interface{}) (interface{}, error) {
+			return !Truthy(args[0]), nil
+		}),
+
+		"$add":      variadic("$add", 0, -1, add),
+		"$subtract": fixed("$subtract", 2, subtract),
+		"$multiply": variadic("$multiply", 0, -1, multiply),
+		"$divide":   fixed("$divide", 2, divide),
+		"$mod":      fixed("$mod", 2, mod),
+		"$abs":      fixed("$abs", 1, abs),
+
+		"$literal": func(arg interface{}, s scope) (evaluator, error) {
+			return func(vars) (interface{}, error) {
+				return arg, nil
+			}, nil
+		},
+		"$cond":   compileCond,
+		"$ifNull": compileIfNull,
+		"$in": fixed("$in", 2, func(args []interface{}) (interface{}, error) {
+			array := bsonutil.ToArray(args[1])
+			if array == nil {
+				return nil, errorf(messages.BadValue, "$in requires an array as a second argument, found: %s", TypeName(args[1]))
+			}
+			for _, elem := range array {
+				if compareValues(args[0], elem) == 0 {
+					return true, nil
+				}
+			}
+			return false, nil
+		}),
+		"$size": fixed("$size", 1, func(args []interface{}) (interface{}, error) {
+			array := bsonutil.ToArray(args[0])
+			if array == nil {
+				return nil, errorf(messages.BadValue, "The argument to $size must be an array. Type of argument: %s", TypeName(args[0]))
+			}
+			return len(array), nil
+		}),
+		"$type": fixed("$type", 1, func(args []interface{}) (interface{}, error) {
+			return TypeName(args[0]), nil
+		}),
+
+		"$concat": variadic("$concat", 0, -1, func(args []interface{}) (interface{}, error) {
+			var b strings.Builder
+			for _, arg := range args {
+				if isNull(arg) {
+					return nil, nil
+				}
+				s, ok := arg.(string)
+				if !ok {
+					return nil, errorf(messages.TypeMismatch, "$concat only supports strings, not %s", TypeName(arg))
+				}
+				b.WriteString(s)
+			}
+			return b.String(), nil
+		}),
+		"$toLower": fixed("$toLower", 1, func(args []interface{}) (interface{}, error) {
+			s, err := stringArg("$toLower", args[0])
+			return strings.ToLower(s), err
+		}),
+		"$toUpper": fixed("$toUpper", 1, func(args []interface{}) (interface{}, error) {
+			s, err := stringArg("$toUpper", args[0])
+			return strings.ToUpper(s), err
+		}),
+	}
+	addOperators()
+}
+
+// stringArg returns the string argument of a string operator, for which
+// null is the empty string.
+func stringArg(name string, arg interface{}) (string, error) {
+	if isNull(arg) {
+		return "", nil
+	}
+	s, ok := arg.(string)
+	if !ok {
+		return "", errorf(messages.TypeMismatch, "%s requires a string argument, found: %s", name, TypeName(arg))
+	}
+	return s, nil
+}
+
+// compileCond compiles $cond, given as [if, then, else] or as a document.
+func compileCond(arg interface{}, s scope) (evaluator, error) {
+	var parts []interface{}
+	if doc := bsonutil.ToD(arg); doc != nil {
+		parts = make([]interface{}, 3)
+		found := 0
+		for _, elem := range doc {
+			switch elem.Name {
+			case "if":
+				parts[0] = elem.Value
+			case "then":
+				parts[1] = elem.Value
+			case "else":
+				parts[2] = elem.Value
+			default:
+				return nil, errorf(messages.BadValue, "Unrecognized parameter to $cond: %s", elem.Name)
+			}
+			found++
+		}
+		if found != 3 {
+			return nil, errorf(messages.BadValue, "Missing 'if', 'then' or 'else' parameter to $cond")
+		}
+	} else {
+		parts = bsonutil.ToArray(arg)
+	}
+	args, err := compileArgs("$cond", parts, 3, 3, s)
+	if err != nil {
+		return nil, err
+	}
+	return func(v vars) (interface{}, error) {
+		cond, err := args[0](v)
+		if err != nil {
+			return nil, err
+		}
+		if Truthy(cond) {
+			return args[1](v)
+		}
+		return args[2](v)
+	}, nil
+}
+
+// compileIfNull compiles $ifNull, which evaluates to its first argument
+// that is not null or missing, or its last.
+func compileIfNull(arg interface{}, s scope) (evaluator, error) {
+	args, err := compileArgs("$ifNull", arg, 2, -1, s)
+	if err != nil {
+		return nil, err
+	}
+	return func(v vars) (interface{}, error) {
+		for _, a := range args[:len(args)-1] {
+			value, err := a(v)
+			if err != nil {
+				return nil, err
+			}
+			if !isNull(value) {
+				return value, nil
+			}
+		}
+		return args[len(args)-1](v)
+	}, nil
+}
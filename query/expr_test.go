@@ -0,0 +1,177 @@
+package query
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func evaluate(expr interface{}, doc bson.D) (interface{}, error) {
+	e, err := CompileExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	return e.Evaluate(doc)
+}
+
+func TestExpressions(t *testing.T) {
+	doc := d("a", 1, "b", 2.5, "s", "Hi", "items", a(d("n", 1), d("n", 2), d("m", 3)), "at", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	Convey("Evaluate expressions", t, func() {
+		for _, c := range []struct {
+			expr interface{}
+			want interface{}
+		}{
+			{"$a", 1},
+			{"$missing", Missing},
+			{"$items.n", a(1, 2)},
+			{"$$CURRENT.s", "Hi"},
+			{"literal", "literal"},
+			{a("$a", "$missing"), a(1, nil)},
+			{d("x", "$a", "y", "$missing"), d("x", 1)},
+			{d("$literal", "$a"), "$a"},
+			{d("$add", a("$a", 2)), 3},
+			{d("$add", a("$a", "$b")), 3.5},
+			{d("$add", a("$a", int64(2))), int64(3)},
+			{d("$add", a(2147483647, 1)), int64(2147483648)},
+			{d("$add", a("$a", nil)), nil},
+			{d("$add", a("$at", 1000)), time.Date(2020, 1, 1, 0, 0, 1, 0, time.UTC)},
+			{d("$subtract", a("$a", 3)), -2},
+			{d("$subtract", a("$at", "$at")), int64(0)},
+			{d("$multiply", a(3, "$b")), 7.5},
+			{d("$divide", a(3, 2)), 1.5},
+			{d("$mod", a(7, 3)), 1},
+			{d("$mod", a(7.5, 2)), 1.5},
+			{d("$abs", -4), 4},
+			{d("$eq", a("$a", 1.0)), true},
+			{d("$eq", a("$missing", nil)), false},
+			{d("$lt", a("$missing", nil)), true},
+			{d("$gt", a("$s", 5)), true},
+			{d("$cmp", a("$a", 2)), -1},
+			{d("$and", a(1, "$s", true)), true},
+			{d("$and", a(1, 0)), false},
+			{d("$or", a(nil, "$missing", false)), false},
+			{d("$not", a(0)), true},
+			{d("$cond", a(d("$gt", a("$a", 0)), "pos", "neg")), "pos"},
+			{d("$cond", d("if", false, "then", 1, "else", 2)), 2},
+			{d("$ifNull", a("$missing", nil, "default")), "default"},
+			{d("$in", a(2, "$items.n")), true},
+			{d("$size", "$items"), 3},
+			{d("$type", "$b"), "double"},
+			{d("$type", "$missing"), "missing"},
+			{d("$concat", a("$s", " there")), "Hi there"},
+			{d("$concat", a("$s", "$missing")), nil},
+			{d("$toUpper", "$s"), "HI"},
+			{d("$toLower", nil), ""},
+		} {
+			got, err := evaluate(c.expr, doc)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, c.want)
+		}
+	})
+
+	Convey("Evaluate array, string, conversion and date expressions", t, func() {
+		for _, c := range []struct {
+			expr interface{}
+			want interface{}
+		}{
+			{d("$arrayElemAt", a(a(1, 2, 3), -1)), 3},
+			{d("$arrayElemAt", a(a(1), 5)), Missing},
+			{d("$concatArrays", a(a(1), a(2, 3))), a(1, 2, 3)},
+			{d("$first", "$items.n"), 1},
+			{d("$last", a(a(1, 2))), 2},
+			{d("$isArray", "$items"), true},
+			{d("$reverseArray", a(a(1, 2))), a(2, 1)},
+			{d("$slice", a(a(1, 2, 3), -2)), a(2, 3)},
+			{d("$slice", a(a(1, 2, 3), 1, 1)), a(2)},
+			{d("$range", a(0, 5, 2)), a(0, 2, 4)},
+			{d("$range", a(5, 0, -2)), a(5, 3, 1)},
+			{d("$range", a(5, 0)), a()},
+			{d("$filter", d("input", "$items", "as", "i", "cond", d("$gte", a("$$i.n", 2)))), a(d("n", 2))},
+			{d("$map", d("input", a(1, 2), "in", d("$multiply", a("$$this", 10)))), a(10, 20)},
+			{d("$reduce", d("input", a(1, 2, 3), "initialValue", 0, "in", d("$add", a("$$value", "$$this")))), 6},
+			{d("$let", d("vars", d("x", 2), "in", d("$add", a("$$x", "$a")))), 3},
+			{d("$switch", d("branches", a(d("case", false, "then", 1), d("case", true, "then", 2)))), 2},
+			{d("$mergeObjects", a(d("x", 1, "y", 1), nil, d("y", 2))), d("x", 1, "y", 2)},
+			{d("$objectToArray", d("x", 1)), a(d("k", "x", "v", 1))},
+			{d("$sum", "$items.n"), 3},
+			{d("$sum", a("$a", "$b", "$s")), 3.5},
+			{d("$avg", a(1, 2)), 1.5},
+			{d("$max", a(1, "$s", nil)), "Hi"},
+			{d("$min", "$items.n"), 1},
+			{d("$floor", 2.5), 2.0},
+			{d("$ceil", 2), 2},
+			{d("$pow", a(2, 10)), 1024},
+			{d("$sqrt", 16), 4.0},
+			{d("$substrCP", a("héllo", 1, 3)), "éll"},
+			{d("$strLenCP", "héllo"), 5},
+			{d("$strLenBytes", "héllo"), 6},
+			{d("$split", a("a,b", ",")), a("a", "b")},
+			{d("$trim", d("input", "  x ")), "x"},
+			{d("$ltrim", d("input", "xxy", "chars", "x")), "y"},
+			{d("$strcasecmp", a("a", "A")), 0},
+			{d("$regexMatch", d("input", "$s", "regex", "^h", "options", "i")), true},
+			{d("$toString", 2.5), "2.5"},
+			{d("$toString", "$at"), "2020-01-01T00:00:00.000Z"},
+			{d("$toInt", "42"), 42},
+			{d("$toLong", true), int64(1)},
+			{d("$toDouble", "$a"), 1.0},
+			{d("$toBool", 0), false},
+			{d("$year", "$at"), 2020},
+			{d("$dayOfWeek", "$at"), 4},
+			{d("$month", d("date", "$at", "timezone", "UTC")), 1},
+		} {
+			got, err := evaluate(c.expr, doc)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, c.want)
+		}
+	})
+
+	Convey("Fail bad expressions", t, func() {
+		for _, expr := range []interface{}{
+			d("$foo", 1),
+			d("$add", 1, "$sub", 2),
+			"$",
+			"$$undefined",
+			d("$eq", a(1)),
+			d("$cond", d("if", true)),
+			d("x", 1, "$y", 2),
+			d("$map", d("input", a(), "as", "X", "in", 1)),
+			d("$filter", d("input", a())),
+			d("$let", d("vars", d("x", 1), "in", "$$y")),
+			d("$switch", d("branches", 1)),
+			d("$month", d("date", "$at", "timezone", "Europe/Paris")),
+		} {
+			_, err := CompileExpression(expr)
+			So(err, ShouldNotBeNil)
+		}
+
+		for _, expr := range []interface{}{
+			d("$add", a("$s", 1)),
+			d("$add", a("$at", "$at")),
+			d("$divide", a(1, 0)),
+			d("$mod", a(1, 0)),
+			d("$size", "$s"),
+			d("$in", a(1, "$s")),
+			d("$concat", a("$s", 1)),
+			d("$toInt", "abc"),
+			d("$toInt", 1e10),
+			d("$range", a(0, 5, 0)),
+			d("$range", a(0, 100000000, 1)),
+			d("$range", a(int64(math.MaxInt64-1), int64(math.MaxInt64), 1)),
+			d("$range", a(0, 5, 1.5)),
+			d("$arrayElemAt", a(a(1), int64(1)<<40)),
+			d("$switch", d("branches", a(d("case", false, "then", 1)))),
+			d("$year", "$s"),
+		} {
+			_, err := evaluate(expr, doc)
+			So(err, ShouldNotBeNil)
+		}
+		_, err := evaluate(d("$range", a(0, 100000000, 1)), doc)
+		So(err.(*Error).Code, ShouldEqual, messages.ExceededMemoryLimit)
+	})
+}
@@ -0,0 +1,936 @@
+package query
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// addOperators adds the array, string, conversion, date and variable
+// operators to those of expr.go.
+func addOperators() {
+	for name, op := range map[string]operator{
+		"$arrayElemAt":   fixed("$arrayElemAt", 2, arrayElemAt),
+		"$concatArrays":  variadic("$concatArrays", 0, -1, concatArrays),
+		"$first":         fixed("$first", 1, arrayEnd("$first", true)),
+		"$last":          fixed("$last", 1, arrayEnd("$last", false)),
+		"$isArray":       fixed("$isArray", 1, func(args []interface{}) (interface{}, error) { return bsonutil.ToArray(args[0]) != nil, nil }),
+		"$reverseArray":  fixed("$reverseArray", 1, reverseArray),
+		"$slice":         variadic("$slice", 2, 3, slice),
+		"$range":         variadic("$range", 2, 3, numberRange),
+		"$filter":        compileFilterOperator,
+		"$map":           compileMap,
+		"$reduce":        compileReduce,
+		"$let":           compileLet,
+		"$switch":        compileSwitch,
+		"$mergeObjects":  variadic("$mergeObjects", 0, -1, mergeObjects),
+		"$objectToArray": fixed("$objectToArray", 1, objectToArray),
+
+		"$sum":   variadic("$sum", 1, -1, sumOf),
+		"$avg":   variadic("$avg", 1, -1, avgOf),
+		"$min":   variadic("$min", 1, -1, extreme(-1)),
+		"$max":   variadic("$max", 1, -1, extreme(1)),
+		"$floor": fixed("$floor", 1, rounding("$floor", math.Floor)),
+		"$ceil":  fixed("$ceil", 1, rounding("$ceil", math.Ceil)),
+		"$trunc": fixed("$trunc", 1, rounding("$trunc", math.Trunc)),
+		"$sqrt":  fixed("$sqrt", 1, sqrt),
+		"$pow":   fixed("$pow", 2, pow),
+
+		"$substrCP":    fixed("$substrCP", 3, substr("$substrCP", true)),
+		"$substrBytes": fixed("$substrBytes", 3, substr("$substrBytes", false)),
+		"$substr":      fixed("$substr", 3, substr("$substr", false)),
+		"$strLenCP":    fixed("$strLenCP", 1, strLen("$strLenCP", true)),
+		"$strLenBytes": fixed("$strLenBytes", 1, strLen("$strLenBytes", false)),
+		"$split":       fixed("$split", 2, split),
+		"$strcasecmp": fixed("$strcasecmp", 2, func(args []interface{}) (interface{}, error) {
+			a, err := stringArg("$strcasecmp", args[0])
+			if err != nil {
+				return nil, err
+			}
+			b, err := stringArg("$strcasecmp", args[1])
+			return strings.Compare(strings.ToUpper(a), strings.ToUpper(b)), err
+		}),
+		"$trim":       compileTrim("$trim", strings.Trim),
+		"$ltrim":      compileTrim("$ltrim", strings.TrimLeft),
+		"$rtrim":      compileTrim("$rtrim", strings.TrimRight),
+		"$regexMatch": compileRegexMatch,
+
+		"$toString": fixed("$toString", 1, toStringValue),
+		"$toInt":    fixed("$toInt", 1, convertNumber("$toInt", numberInt)),
+		"$toLong":   fixed("$toLong", 1, convertNumber("$toLong", numberLong)),
+		"$toDouble": fixed("$toDouble", 1, convertNumber("$toDouble", numberDouble)),
+		"$toBool": fixed("$toBool", 1, func(args []interface{}) (interface{}, error) {
+			if isNull(args[0]) {
+				return nil, nil
+			}
+			return Truthy(args[0]), nil
+		}),
+
+		"$year":        datePart("$year", func(t time.Time) int { return t.Year() }),
+		"$month":       datePart("$month", func(t time.Time) int { return int(t.Month()) }),
+		"$dayOfMonth":  datePart("$dayOfMonth", func(t time.Time) int { return t.Day() }),
+		"$dayOfYear":   datePart("$dayOfYear", func(t time.Time) int { return t.YearDay() }),
+		"$dayOfWeek":   datePart("$dayOfWeek", func(t time.Time) int { return int(t.Weekday()) + 1 }),
+		"$hour":        datePart("$hour", func(t time.Time) int { return t.Hour() }),
+		"$minute":      datePart("$minute", func(t time.Time) int { return t.Minute() }),
+		"$second":      datePart("$second", func(t time.Time) int { return t.Second() }),
+		"$millisecond": datePart("$millisecond", func(t time.Time) int { return t.Nanosecond() / int(time.Millisecond) }),
+	} {
+		operators[name] = op
+	}
+}
+
+// arrayArg returns the array argument of an array operator, which is nil
+// with ok set for null.
+func arrayArg(name string, arg interface{}) (array []interface{}, ok bool, err error) {
+	if isNull(arg) {
+		return nil, false, nil
+	}
+	if array = bsonutil.ToArray(arg); array == nil {
+		return nil, false, errorf(messages.BadValue, "%s's argument must be an array, but is %s", name, TypeName(arg))
+	}
+	return array, true, nil
+}
+
+// intArg returns an argument that must be a whole number that fits in 32
+// bits.
+func intArg(name string, arg interface{}) (int, error) {
+	f, ok := toFloat(arg)
+	if !ok || f != math.Trunc(f) {
+		return 0, errorf(messages.BadValue, "%s requires an integral argument, found: %s", name, TypeName(arg))
+	}
+	if f < math.MinInt32 || f > math.MaxInt32 {
+		return 0, errorf(messages.BadValue, "%s requires an argument that can be represented as a 32-bit integer, found: %s", name, formatValue(arg))
+	}
+	return int(f), nil
+}
+
+func arrayElemAt(args []interface{}) (interface{}, error) {
+	array, ok, err := arrayArg("$arrayElemAt", args[0])
+	if !ok || isNull(args[1]) {
+		return nil, err
+	}
+	i, err := intArg("$arrayElemAt", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		i += len(array)
+	}
+	if i < 0 || i >= len(array) {
+		return Missing, nil
+	}
+	return array[i], nil
+}
+
+func concatArrays(args []interface{}) (interface{}, error) {
+	out := []interface{}{}
+	for _, arg := range args {
+		array, ok, err := arrayArg("$concatArrays", arg)
+		if !ok {
+			return nil, err
+		}
+		out = append(out, array...)
+	}
+	return out, nil
+}
+
+// arrayEnd returns the first or last element of an array.
+func arrayEnd(name string, first bool) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		array, ok, err := arrayArg(name, args[0])
+		if !ok {
+			if args[0] == Missing {
+				return Missing, err
+			}
+			return nil, err
+		}
+		switch {
+		case len(array) == 0:
+			return Missing, nil
+		case first:
+			return array[0], nil
+		}
+		return array[len(array)-1], nil
+	}
+}
+
+func reverseArray(args []interface{}) (interface{}, error) {
+	array, ok, err := arrayArg("$reverseArray", args[0])
+	if !ok {
+		return nil, err
+	}
+	out := make([]interface{}, len(array))
+	for i, elem := range array {
+		out[len(array)-1-i] = elem
+	}
+	return out, nil
+}
+
+// slice takes n elements from the start, or the end if n is negative, or
+// from a position.
+func slice(args []interface{}) (interface{}, error) {
+	array, ok, err := arrayArg("$slice", args[0])
+	if !ok {
+		return nil, err
+	}
+	for _, arg := range args[1:] {
+		if isNull(arg) {
+			return nil, nil
+		}
+	}
+	n, err := intArg("$slice", args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	if len(args) == 3 {
+		if n <= 0 {
+			return nil, errorf(messages.BadValue, "Third argument to $slice must be positive: %d", n)
+		}
+		if start, err = intArg("$slice", args[1]); err != nil {
+			return nil, err
+		}
+		if start < 0 {
+			start += len(array)
+			if start < 0 {
+				start = 0
+			}
+		}
+	} else if n < 0 {
+		start, n = len(array)+n, -n
+		if start < 0 {
+			start, n = 0, len(array)
+		}
+	}
+	if start > len(array) {
+		start = len(array)
+	}
+	end := start + n
+	if end > len(array) {
+		end = len(array)
+	}
+	return append([]interface{}{}, array[start:end]...), nil
+}
+
+func numberRange(args []interface{}) (interface{}, error) {
+	bounds := make([]int, 3)
+	bounds[2] = 1
+	for i, arg := range args {
+		n, err := intArg("$range", arg)
+		if err != nil {
+			return nil, err
+		}
+		bounds[i] = n
+	}
+	start, end, step := int64(bounds[0]), int64(bounds[1]), int64(bounds[2])
+	if step == 0 {
+		return nil, errorf(messages.BadValue, "$range requires a non-zero step value")
+	}
+	n := int64(0)
+	if (step > 0 && start < end) || (step < 0 && start > end) {
+		n = (end-start-sign(step))/step + 1
+	}
+	if bytes := n * rangeElementSize; bytes > maxRangeBytes {
+		return nil, errorf(messages.ExceededMemoryLimit, "$range would use too much memory (%d bytes) and cannot spill to disk. Memory limit: %d bytes", bytes, maxRangeBytes)
+	}
+	out := make([]interface{}, n)
+	for i := range out {
+		out[i] = int(start + int64(i)*step)
+	}
+	return out, nil
+}
+
+// $range is limited, as in mongod, to arrays of 64MB, counting each
+// element as the size of mongod's values.
+const (
+	maxRangeBytes    = 64 << 20
+	rangeElementSize = 16
+)
+
+func sign(n int64) int64 {
+	if n < 0 {
+		return -1
+	}
+	return 1
+}
+
+// variablePattern is what the names of user variables look like.
+var variablePattern = regexp.MustCompile(`^[a-z\x80-\xff][a-zA-Z0-9_\x80-\xff]*$`)
+
+// define returns a scope with more variables defined.
+func define(s scope, names ...string) (scope, error) {
+	out := scope{}
+	for name := range s {
+		out[name] = true
+	}
+	for _, name := range names {
+		if !variablePattern.MatchString(name) {
+			return nil, errorf(messages.FailedToParse, "'%s' starts with an invalid character for a user variable name", name)
+		}
+		out[name] = true
+	}
+	return out, nil
+}
+
+// with returns variables with more values.
+func with(v vars, names []string, values ...interface{}) vars {
+	out := vars{}
+	for name, value := range v {
+		out[name] = value
+	}
+	for i, name := range names {
+		out[name] = values[i]
+	}
+	return out
+}
+
+// namedArgs returns the arguments of an operator given as a document,
+// failing for unknown or missing ones.
+func namedArgs(name string, arg interface{}, required []string, optional ...string) (bson.M, error) {
+	doc := bsonutil.ToD(arg)
+	if doc == nil {
+		return nil, errorf(messages.FailedToParse, "%s only supports an object as its argument", name)
+	}
+	args := bson.M{}
+	for _, elem := range doc {
+		known := false
+		for _, n := range append(required, optional...) {
+			known = known || n == elem.Name
+		}
+		if !known {
+			return nil, errorf(messages.FailedToParse, "Unrecognized parameter to %s: %s", name, elem.Name)
+		}
+		args[elem.Name] = elem.Value
+	}
+	for _, n := range required {
+		if _, ok := args[n]; !ok {
+			return nil, errorf(messages.FailedToParse, "Missing '%s' parameter to %s", n, name)
+		}
+	}
+	return args, nil
+}
+
+// compileIteration compiles the input of $filter or $map, and the
+// expression evaluated for each element, with the element as the
+// variable named by as.
+func compileIteration(name string, arg interface{}, each string, s scope) (evaluator, evaluator, string, error) {
+	args, err := namedArgs(name, arg, []string{"input", each}, "as")
+	if err != nil {
+		return nil, nil, "", err
+	}
+	as := "this"
+	if v, ok := args["as"]; ok {
+		if as, ok = v.(string); !ok {
+			return nil, nil, "", errorf(messages.FailedToParse, "%s 'as' must be a string", name)
+		}
+	}
+	input, err := compileExpression(args["input"], s)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	inner, err := define(s, as)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	body, err := compileExpression(args[each], inner)
+	return input, body, as, err
+}
+
+func compileFilterOperator(arg interface{}, s scope) (evaluator, error) {
+	input, cond, as, err := compileIteration("$filter", arg, "cond", s)
+	if err != nil {
+		return nil, err
+	}
+	return func(v vars) (interface{}, error) {
+		value, err := input(v)
+		if err != nil {
+			return nil, err
+		}
+		array, ok, err := arrayArg("$filter", value)
+		if !ok {
+			return nil, err
+		}
+		out := []interface{}{}
+		for _, elem := range array {
+			keep, err := cond(with(v, []string{as}, elem))
+			if err != nil {
+				return nil, err
+			}
+			if Truthy(keep) {
+				out = append(out, elem)
+			}
+		}
+		return out, nil
+	}, nil
+}
+
+func compileMap(arg interface{}, s scope) (evaluator, error) {
+	input, in, as, err := compileIteration("$map", arg, "in", s)
+	if err != nil {
+		return nil, err
+	}
+	return func(v vars) (interface{}, error) {
+		value, err := input(v)
+		if err != nil {
+			return nil, err
+		}
+		array, ok, err := arrayArg("$map", value)
+		if !ok {
+			return nil, err
+		}
+		out := make([]interface{}, len(array))
+		for i, elem := range array {
+			if out[i], err = in(with(v, []string{as}, elem)); err != nil {
+				return nil, err
+			}
+			if out[i] == Missing {
+				out[i] = nil
+			}
+		}
+		return out, nil
+	}, nil
+}
+
+func compileReduce(arg interface{}, s scope) (evaluator, error) {
+	args, err := namedArgs("$reduce", arg, []string{"input", "initialValue", "in"})
+	if err != nil {
+		return nil, err
+	}
+	input, err := compileExpression(args["input"], s)
+	if err != nil {
+		return nil, err
+	}
+	initial, err := compileExpression(args["initialValue"], s)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := define(s, "value", "this")
+	if err != nil {
+		return nil, err
+	}
+	in, err := compileExpression(args["in"], inner)
+	if err != nil {
+		return nil, err
+	}
+	return func(v vars) (interface{}, error) {
+		value, err := input(v)
+		if err != nil {
+			return nil, err
+		}
+		array, ok, err := arrayArg("$reduce", value)
+		if !ok {
+			return nil, err
+		}
+		acc, err := initial(v)
+		for _, elem := range array {
+			if err != nil {
+				break
+			}
+			acc, err = in(with(v, []string{"value", "this"}, acc, elem))
+		}
+		return acc, err
+	}, nil
+}
+
+func compileLet(arg interface{}, s scope) (evaluator, error) {
+	args, err := namedArgs("$let", arg, []string{"vars", "in"})
+	if err != nil {
+		return nil, err
+	}
+	defs := bsonutil.ToD(args["vars"])
+	if defs == nil {
+		return nil, errorf(messages.FailedToParse, "invalid parameter: expected an object (vars)")
+	}
+	names := make([]string, len(defs))
+	values := make([]evaluator, len(defs))
+	for i, def := range defs {
+		names[i] = def.Name
+		if values[i], err = compileExpression(def.Value, s); err != nil {
+			return nil, err
+		}
+	}
+	inner, err := define(s, names...)
+	if err != nil {
+		return nil, err
+	}
+	in, err := compileExpression(args["in"], inner)
+	if err != nil {
+		return nil, err
+	}
+	return func(v vars) (interface{}, error) {
+		evaluated, err := evalArgs(values, v)
+		if err != nil {
+			return nil, err
+		}
+		return in(with(v, names, evaluated...))
+	}, nil
+}
+
+func compileSwitch(arg interface{}, s scope) (evaluator, error) {
+	args, err := namedArgs("$switch", arg, []string{"branches"}, "default")
+	if err != nil {
+		return nil, err
+	}
+	branches := bsonutil.ToArray(args["branches"])
+	if branches == nil {
+		return nil, errorf(messages.FailedToParse, "$switch expected an array for 'branches'")
+	}
+	cases := make([][]evaluator, len(branches))
+	for i, branch := range branches {
+		b, err := namedArgs("$switch", branch, []string{"case", "then"})
+		if err != nil {
+			return nil, err
+		}
+		if cases[i], err = compileArgs("$switch", []interface{}{b["case"], b["then"]}, 2, 2, s); err != nil {
+			return nil, err
+		}
+	}
+	var fallback evaluator
+	if d, ok := args["default"]; ok {
+		if fallback, err = compileExpression(d, s); err != nil {
+			return nil, err
+		}
+	}
+	return func(v vars) (interface{}, error) {
+		for _, c := range cases {
+			matched, err := c[0](v)
+			if err != nil {
+				return nil, err
+			}
+			if Truthy(matched) {
+				return c[1](v)
+			}
+		}
+		if fallback == nil {
+			return nil, errorf(messages.BadValue, "$switch could not find a matching branch for an input, and no default was specified.")
+		}
+		return fallback(v)
+	}, nil
+}
+
+func mergeObjects(args []interface{}) (interface{}, error) {
+	out := bson.D{}
+	for _, arg := range args {
+		if isNull(arg) {
+			continue
+		}
+		doc := bsonutil.ToD(arg)
+		if doc == nil {
+			return nil, errorf(messages.TypeMismatch, "$mergeObjects requires object inputs, but input %s is of type %s", formatValue(arg), TypeName(arg))
+		}
+		for _, elem := range doc {
+			out = SetField(out, []string{elem.Name}, elem.Value)
+		}
+	}
+	return out, nil
+}
+
+func objectToArray(args []interface{}) (interface{}, error) {
+	if isNull(args[0]) {
+		return nil, nil
+	}
+	doc := bsonutil.ToD(args[0])
+	if doc == nil {
+		return nil, errorf(messages.TypeMismatch, "$objectToArray requires a document input, found: %s", TypeName(args[0]))
+	}
+	out := make([]interface{}, len(doc))
+	for i, elem := range doc {
+		out[i] = bson.D{{Name: "k", Value: elem.Name}, {Name: "v", Value: elem.Value}}
+	}
+	return out, nil
+}
+
+// numbersOf returns the numbers among the arguments of $sum and the like,
+// which are the elements of a single array argument.
+func numbersOf(args []interface{}) []interface{} {
+	if len(args) == 1 {
+		if array := bsonutil.ToArray(args[0]); array != nil {
+			args = array
+		}
+	}
+	numbers := []interface{}{}
+	for _, arg := range args {
+		if numberType(arg) != notNumber {
+			numbers = append(numbers, arg)
+		}
+	}
+	return numbers
+}
+
+// sumOf sums the numbers among its arguments, ignoring anything else.
+func sumOf(args []interface{}) (interface{}, error) {
+	return add(append([]interface{}{0}, numbersOf(args)...))
+}
+
+func avgOf(args []interface{}) (interface{}, error) {
+	numbers := numbersOf(args)
+	if len(numbers) == 0 {
+		return nil, nil
+	}
+	sum := 0.0
+	for _, n := range numbers {
+		f, _ := toFloat(n)
+		sum += f
+	}
+	return sum / float64(len(numbers)), nil
+}
+
+// extreme returns the least or greatest of its arguments that are not
+// null, by sign.
+func extreme(sign int) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) == 1 {
+			if array := bsonutil.ToArray(args[0]); array != nil {
+				args = array
+			}
+		}
+		var best interface{}
+		for _, arg := range args {
+			if isNull(arg) {
+				continue
+			}
+			if best == nil || bsonutil.Compare(arg, best)*sign > 0 {
+				best = arg
+			}
+		}
+		return best, nil
+	}
+}
+
+// rounding returns an operator that rounds numbers, keeping integers as
+// they are.
+func rounding(name string, round func(float64) float64) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if isNull(args[0]) {
+			return nil, nil
+		}
+		switch numberType(args[0]) {
+		case notNumber:
+			return nil, errorf(messages.TypeMismatch, "%s only supports numeric types, not %s", name, TypeName(args[0]))
+		case numberDouble:
+			f, _ := toFloat(args[0])
+			return round(f), nil
+		}
+		return args[0], nil
+	}
+}
+
+func sqrt(args []interface{}) (interface{}, error) {
+	if isNull(args[0]) {
+		return nil, nil
+	}
+	f, ok := toFloat(args[0])
+	if !ok {
+		return nil, errorf(messages.TypeMismatch, "$sqrt only supports numeric types, not %s", TypeName(args[0]))
+	}
+	if f < 0 {
+		return nil, errorf(messages.BadValue, "$sqrt's argument must be greater than or equal to 0")
+	}
+	return math.Sqrt(f), nil
+}
+
+// pow raises a number to a power, in an integral type if both are and
+// the power is not negative.
+func pow(args []interface{}) (interface{}, error) {
+	if isNull(args[0]) || isNull(args[1]) {
+		return nil, nil
+	}
+	for _, arg := range args {
+		if numberType(arg) == notNumber {
+			return nil, errorf(messages.TypeMismatch, "$pow only supports numeric types, not %s", TypeName(arg))
+		}
+	}
+	base, _ := toFloat(args[0])
+	exp, _ := toFloat(args[1])
+	if base == 0 && exp < 0 {
+		return nil, errorf(messages.BadValue, "$pow cannot take a base of 0 and a negative exponent")
+	}
+	kind := numberType(args[0])
+	if t := numberType(args[1]); t > kind {
+		kind = t
+	}
+	result := math.Pow(base, exp)
+	if kind == numberDouble || exp < 0 || math.Abs(result) > math.MaxInt64 {
+		return result, nil
+	}
+	product := int64(1)
+	for i := int64(0); i < toInt64(args[1]); i++ {
+		product *= toInt64(args[0])
+	}
+	return number(product, kind), nil
+}
+
+// substr takes a substring by code points or bytes.
+func substr(name string, codePoints bool) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		s, err := stringArg(name, args[0])
+		if err != nil {
+			return nil, err
+		}
+		start, err := intArg(name, args[1])
+		if err != nil {
+			return nil, err
+		}
+		length, err := intArg(name, args[2])
+		if err != nil {
+			return nil, err
+		}
+		if codePoints {
+			runes := []rune(s)
+			if start < 0 || start > len(runes) {
+				return "", nil
+			}
+			if length < 0 || start+length > len(runes) {
+				length = len(runes) - start
+			}
+			return string(runes[start : start+length]), nil
+		}
+		if start < 0 || start > len(s) {
+			return "", nil
+		}
+		if length < 0 || start+length > len(s) {
+			length = len(s) - start
+		}
+		if !utf8.ValidString(s[start : start+length]) {
+			return nil, errorf(messages.BadValue, "%s: Invalid range, ending index is in the middle of a UTF-8 character.", name)
+		}
+		return s[start : start+length], nil
+	}
+}
+
+func strLen(name string, codePoints bool) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, errorf(messages.TypeMismatch, "%s requires a string argument, found: %s", name, TypeName(args[0]))
+		}
+		if codePoints {
+			return utf8.RuneCountInString(s), nil
+		}
+		return len(s), nil
+	}
+}
+
+func split(args []interface{}) (interface{}, error) {
+	if isNull(args[0]) {
+		return nil, nil
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, errorf(messages.TypeMismatch, "$split requires an expression that evaluates to a string as a first argument, found: %s", TypeName(args[0]))
+	}
+	sep, ok := args[1].(string)
+	if !ok || len(sep) == 0 {
+		return nil, errorf(messages.BadValue, "$split requires a non-empty separator")
+	}
+	out := []interface{}{}
+	for _, part := range strings.Split(s, sep) {
+		out = append(out, part)
+	}
+	return out, nil
+}
+
+// compileTrim compiles $trim and its one-sided forms, which trim
+// whitespace or the characters given.
+func compileTrim(name string, trim func(s string, cutset string) string) operator {
+	return func(arg interface{}, s scope) (evaluator, error) {
+		args, err := namedArgs(name, arg, []string{"input"}, "chars")
+		if err != nil {
+			return nil, err
+		}
+		exprs := []interface{}{args["input"], " \t\n\v\f\r\x00 "}
+		if chars, ok := args["chars"]; ok {
+			exprs[1] = chars
+		}
+		evals, err := compileArgs(name, exprs, 2, 2, s)
+		if err != nil {
+			return nil, err
+		}
+		return func(v vars) (interface{}, error) {
+			values, err := evalArgs(evals, v)
+			if err != nil || isNull(values[0]) || isNull(values[1]) {
+				return nil, err
+			}
+			input, ok := values[0].(string)
+			if !ok {
+				return nil, errorf(messages.BadValue, "%s requires its input to be a string, got %s", name, TypeName(values[0]))
+			}
+			chars, ok := values[1].(string)
+			if !ok {
+				return nil, errorf(messages.BadValue, "%s requires 'chars' to be a string, got %s", name, TypeName(values[1]))
+			}
+			return trim(input, chars), nil
+		}, nil
+	}
+}
+
+func compileRegexMatch(arg interface{}, s scope) (evaluator, error) {
+	args, err := namedArgs("$regexMatch", arg, []string{"input", "regex"}, "options")
+	if err != nil {
+		return nil, err
+	}
+	exprs := []interface{}{args["input"], args["regex"], ""}
+	if options, ok := args["options"]; ok {
+		exprs[2] = options
+	}
+	evals, err := compileArgs("$regexMatch", exprs, 3, 3, s)
+	if err != nil {
+		return nil, err
+	}
+	return func(v vars) (interface{}, error) {
+		values, err := evalArgs(evals, v)
+		if err != nil {
+			return nil, err
+		}
+		if isNull(values[0]) {
+			return false, nil
+		}
+		input, ok := values[0].(string)
+		if !ok {
+			return nil, errorf(messages.BadValue, "$regexMatch needs 'input' to be of type string")
+		}
+		re, ok := values[1].(bson.RegEx)
+		if pattern, isString := values[1].(string); isString {
+			re, ok = bson.RegEx{Pattern: pattern}, true
+		}
+		options, isString := values[2].(string)
+		if !ok || !isString {
+			return nil, errorf(messages.BadValue, "$regexMatch needs 'regex' to be of type string or regex, and 'options' a string")
+		}
+		re.Options += options
+		compiled, err := CompileRegex(re)
+		if err != nil {
+			return nil, err
+		}
+		return compiled.MatchString(input), nil
+	}, nil
+}
+
+func toStringValue(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case bson.ObjectId:
+		return v.Hex(), nil
+	case time.Time:
+		return v.UTC().Format("2006-01-02T15:04:05.000Z"), nil
+	}
+	if isNull(args[0]) {
+		return nil, nil
+	}
+	switch numberType(args[0]) {
+	case numberInt, numberLong:
+		return strconv.FormatInt(toInt64(args[0]), 10), nil
+	case numberDouble:
+		f, _ := toFloat(args[0])
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	}
+	return nil, errorf(messages.ConversionFailure, "Unsupported conversion from %s to string in $convert with no onError value", TypeName(args[0]))
+}
+
+// convertNumber converts numbers, booleans, dates and numeric strings to
+// a numeric type.
+func convertNumber(name string, kind int) func(args []interface{}) (interface{}, error) {
+	typeNames := map[int]string{numberInt: "int", numberLong: "long", numberDouble: "double"}
+	return func(args []interface{}) (interface{}, error) {
+		arg := args[0]
+		if isNull(arg) {
+			return nil, nil
+		}
+		var f float64
+		switch v := arg.(type) {
+		case bool:
+			if v {
+				f = 1
+			}
+		case time.Time:
+			if kind == numberInt {
+				return nil, errorf(messages.ConversionFailure, "Unsupported conversion from date to int in $convert with no onError value")
+			}
+			f = float64(millis(v))
+		case string:
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || (kind != numberDouble && parsed != math.Trunc(parsed)) {
+				return nil, errorf(messages.ConversionFailure, "Failed to parse number '%s' in $convert with no onError value", v)
+			}
+			f = parsed
+		default:
+			var ok bool
+			if f, ok = toFloat(arg); !ok {
+				return nil, errorf(messages.ConversionFailure, "Unsupported conversion from %s to %s in $convert with no onError value", TypeName(arg), typeNames[kind])
+			}
+		}
+
+		switch kind {
+		case numberDouble:
+			return f, nil
+		case numberInt:
+			if f > math.MaxInt32 || f < math.MinInt32 || math.IsNaN(f) {
+				return nil, errorf(messages.ConversionFailure, "Conversion would overflow target type in $convert with no onError value: %v", f)
+			}
+			return int(f), nil
+		}
+		if f >= math.MaxInt64 || f < math.MinInt64 || math.IsNaN(f) {
+			return nil, errorf(messages.ConversionFailure, "Conversion would overflow target type in $convert with no onError value: %v", f)
+		}
+		if n := numberType(arg); n == numberInt || n == numberLong {
+			return toInt64(arg), nil
+		}
+		return int64(f), nil
+	}
+}
+
+// datePart returns an operator that takes a part of a date, in UTC, given
+// as the date or as a document with it.
+func datePart(name string, part func(t time.Time) int) operator {
+	return func(arg interface{}, s scope) (evaluator, error) {
+		if doc := bsonutil.ToD(arg); doc != nil && !isOperatorDoc(doc) {
+			args, err := namedArgs(name, doc, []string{"date"}, "timezone")
+			if err != nil {
+				return nil, err
+			}
+			if tz, ok := args["timezone"]; ok && tz != "UTC" && tz != "GMT" && tz != "Z" {
+				return nil, errorf(messages.BadValue, "%s supports only the UTC timezone here, not %v", name, tz)
+			}
+			arg = args["date"]
+		}
+		args, err := compileArgs(name, []interface{}{arg}, 1, 1, s)
+		if err != nil {
+			return nil, err
+		}
+		return func(v vars) (interface{}, error) {
+			value, err := args[0](v)
+			if err != nil || isNull(value) {
+				return nil, err
+			}
+			switch t := value.(type) {
+			case time.Time:
+				return part(t.UTC()), nil
+			case bson.ObjectId:
+				return part(t.Time().UTC()), nil
+			case bson.MongoTimestamp:
+				return part(time.Unix(int64(uint64(t)>>32), 0).UTC()), nil
+			}
+			return nil, errorf(messages.TypeMismatch, "can't convert from BSON type %s to Date", TypeName(value))
+		}, nil
+	}
+}
+
+// formatValue writes a value for error messages.
+func formatValue(v interface{}) string {
+	out, err := bsonutil.MarshalExtJSON(v, bsonutil.Relaxed)
+	if err != nil {
+		return TypeName(v)
+	}
+	return string(out)
+}
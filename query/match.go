@@ -0,0 +1,520 @@
+package query
+
+import (
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// a condition tests the values found at a path.
+type condition func(values []interface{}) bool
+
+// a valueTest tests one value.
+type valueTest func(v interface{}) bool
+
+// anyValue returns a condition that holds if a test does for any of the
+// values, or for any element of one that is an array.
+func anyValue(test valueTest) condition {
+	return func(values []interface{}) bool {
+		for _, v := range values {
+			if test(v) {
+				return true
+			}
+			for _, elem := range bsonutil.ToArray(v) {
+				if test(elem) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// anyWhole returns a condition that holds if a test does for any of the
+// values, without looking into arrays.
+func anyWhole(test valueTest) condition {
+	return func(values []interface{}) bool {
+		for _, v := range values {
+			if test(v) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func not(c condition) condition {
+	return func(values []interface{}) bool {
+		return !c(values)
+	}
+}
+
+func allOf(conditions []condition) condition {
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+	return func(values []interface{}) bool {
+		for _, c := range conditions {
+			if !c(values) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// compileCondition compiles the condition on a path: a document of
+// operators, a regular expression, or a value to equal.
+func compileCondition(value interface{}) (condition, error) {
+	if re, ok := value.(bson.RegEx); ok {
+		test, err := regexTest(re)
+		if err != nil {
+			return nil, err
+		}
+		return anyValue(test), nil
+	}
+	cond := bsonutil.ToD(value)
+	if !isOperatorDoc(cond) {
+		return anyValue(equalTest(value)), nil
+	}
+	return compileOperators(cond)
+}
+
+// compileOperators compiles a document of operators on one path, all of
+// which must hold.
+func compileOperators(ops bson.D) (condition, error) {
+	conditions := []condition{}
+	for _, op := range ops {
+		var c condition
+		var err error
+		switch op.Name {
+		case "$eq":
+			c = anyValue(equalTest(op.Value))
+		case "$ne":
+			c = not(anyValue(equalTest(op.Value)))
+		case "$gt", "$gte", "$lt", "$lte":
+			c = anyValue(comparisonTest(op.Name, op.Value))
+		case "$in", "$nin":
+			c, err = compileIn(op.Name, op.Value)
+		case "$exists":
+			want := Truthy(op.Value)
+			c = func(values []interface{}) bool {
+				for _, v := range values {
+					if v != Missing {
+						return want
+					}
+				}
+				return !want
+			}
+		case "$type":
+			c, err = compileType(op.Value)
+		case "$mod":
+			c, err = compileMod(op.Value)
+		case "$regex":
+			c, err = compileRegex(op.Value, ops)
+		case "$options":
+			if _, ok := field(ops, "$regex"); !ok {
+				return nil, errorf(messages.BadValue, "$options needs a $regex")
+			}
+			continue
+		case "$size":
+			c, err = compileSize(op.Value)
+		case "$all":
+			c, err = compileAll(op.Value)
+		case "$elemMatch":
+			c, err = compileElemMatch(op.Value)
+		case "$not":
+			c, err = compileNot(op.Value)
+		case "$comment":
+			continue
+		default:
+			return nil, errorf(messages.BadValue, "unknown operator: %s", op.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return allOf(conditions), nil
+}
+
+// equalTest tests for values equal to another, where null also equals
+// undefined and missing values.
+func equalTest(value interface{}) valueTest {
+	if isNull(value) {
+		return isNull
+	}
+	return func(v interface{}) bool {
+		return v != Missing && bsonutil.Equal(v, value)
+	}
+}
+
+func isMinOrMaxKey(v interface{}) bool {
+	return v == bson.MinKey || v == bson.MaxKey
+}
+
+// comparisonTest tests for values that compare to another as an operator
+// asks. Values only compare to values of the same type, except for
+// MinKey and MaxKey, which compare to everything.
+func comparisonTest(op string, value interface{}) valueTest {
+	if value == nil {
+		// only null is comparable to null, and equal to it
+		if op == "$gte" || op == "$lte" {
+			return isNull
+		}
+		return func(interface{}) bool { return false }
+	}
+	return func(v interface{}) bool {
+		if v == Missing {
+			return false
+		}
+		if !bsonutil.SameType(v, value) && !isMinOrMaxKey(value) {
+			return false
+		}
+		c := bsonutil.Compare(v, value)
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		}
+		return c <= 0
+	}
+}
+
+func compileIn(op string, value interface{}) (condition, error) {
+	values := bsonutil.ToArray(value)
+	if values == nil {
+		return nil, errorf(messages.BadValue, "%s needs an array", op)
+	}
+	tests := make([]valueTest, len(values))
+	for i, v := range values {
+		if re, ok := v.(bson.RegEx); ok {
+			test, err := regexTest(re)
+			if err != nil {
+				return nil, err
+			}
+			tests[i] = test
+			continue
+		}
+		if isOperatorDoc(bsonutil.ToD(v)) {
+			return nil, errorf(messages.BadValue, "cannot nest $ under %s", op)
+		}
+		tests[i] = equalTest(v)
+	}
+
+	c := anyValue(func(v interface{}) bool {
+		for _, test := range tests {
+			if test(v) {
+				return true
+			}
+		}
+		return false
+	})
+	if op == "$nin" {
+		return not(c), nil
+	}
+	return c, nil
+}
+
+func compileType(value interface{}) (condition, error) {
+	specs := bsonutil.ToArray(value)
+	if specs == nil {
+		specs = []interface{}{value}
+	}
+	codes := map[int]bool{}
+	number := false
+	for _, spec := range specs {
+		if alias, ok := spec.(string); ok && alias == "number" {
+			number = true
+			continue
+		}
+		code, err := typeCodeOf(spec)
+		if err != nil {
+			return nil, err
+		}
+		codes[code] = true
+	}
+
+	test := func(v interface{}) bool {
+		if v == Missing {
+			return false
+		}
+		return codes[TypeCode(v)] || (number && bsonutil.IsNumber(v))
+	}
+	elements := anyValue(test)
+	if !codes[typeArray] {
+		return elements, nil
+	}
+	// arrays are arrays themselves, not only for their elements
+	return func(values []interface{}) bool {
+		return elements(values) || anyWhole(func(v interface{}) bool {
+			return bsonutil.ToArray(v) != nil
+		})(values)
+	}, nil
+}
+
+func compileMod(value interface{}) (condition, error) {
+	args := bsonutil.ToArray(value)
+	switch {
+	case args == nil:
+		return nil, errorf(messages.BadValue, "malformed mod, needs to be an array")
+	case len(args) < 2:
+		return nil, errorf(messages.BadValue, "malformed mod, not enough elements")
+	case len(args) > 2:
+		return nil, errorf(messages.BadValue, "malformed mod, too many elements")
+	}
+	divisor, ok := toFloat(args[0])
+	if !ok || math.IsNaN(divisor) || math.IsInf(divisor, 0) {
+		return nil, errorf(messages.BadValue, "malformed mod, divisor not a number")
+	}
+	remainder, ok := toFloat(args[1])
+	if !ok || math.IsNaN(remainder) || math.IsInf(remainder, 0) {
+		return nil, errorf(messages.BadValue, "malformed mod, remainder not a number")
+	}
+	d, r := int64(divisor), int64(remainder)
+	if d == 0 {
+		return nil, errorf(messages.BadValue, "divisor cannot be 0")
+	}
+	return anyValue(func(v interface{}) bool {
+		f, ok := toFloat(v)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+		return int64(f)%d == r
+	}), nil
+}
+
+func compileRegex(value interface{}, ops bson.D) (condition, error) {
+	re := bson.RegEx{}
+	switch v := value.(type) {
+	case string:
+		re.Pattern = v
+	case bson.RegEx:
+		re = v
+	default:
+		return nil, errorf(messages.BadValue, "$regex has to be a string")
+	}
+	if options, ok := field(ops, "$options"); ok {
+		s, ok := options.(string)
+		if !ok {
+			return nil, errorf(messages.BadValue, "$options has to be a string")
+		}
+		if len(re.Options) > 0 && len(s) > 0 {
+			return nil, errorf(messages.BadValue, "options set in both $regex and $options")
+		}
+		if len(s) > 0 {
+			re.Options = s
+		}
+	}
+	test, err := regexTest(re)
+	if err != nil {
+		return nil, err
+	}
+	return anyValue(test), nil
+}
+
+// regexTest tests for strings a regular expression matches, and for the
+// same regular expression.
+func regexTest(re bson.RegEx) (valueTest, error) {
+	compiled, err := CompileRegex(re)
+	if err != nil {
+		return nil, err
+	}
+	return func(v interface{}) bool {
+		switch v := v.(type) {
+		case string:
+			return compiled.MatchString(v)
+		case bson.Symbol:
+			return compiled.MatchString(string(v))
+		case bson.RegEx:
+			return v == re
+		}
+		return false
+	}, nil
+}
+
+// CompileRegex compiles a BSON regular expression, with its i, m, s and x
+// options.
+func CompileRegex(re bson.RegEx) (*regexp.Regexp, error) {
+	flags := ""
+	pattern := re.Pattern
+	for _, option := range re.Options {
+		switch option {
+		case 'i', 'm', 's':
+			flags += string(option)
+		case 'x':
+			pattern = stripExtended(pattern)
+		case 'u', 'l':
+		default:
+			return nil, errorf(messages.BadValue, "invalid flag in regex options: %c", option)
+		}
+	}
+	if len(flags) > 0 {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errorf(messages.BadValue, "Regular expression is invalid: %v", err)
+	}
+	return compiled, nil
+}
+
+// stripExtended removes the whitespace and comments that the x option
+// lets patterns have.
+func stripExtended(pattern string) string {
+	var b strings.Builder
+	escaped, class, comment := false, false, false
+	for _, r := range pattern {
+		switch {
+		case comment:
+			comment = r != '\n'
+			continue
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '[':
+			class = true
+		case r == ']':
+			class = false
+		case class:
+		case r == '#':
+			comment = true
+			continue
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func compileSize(value interface{}) (condition, error) {
+	f, ok := toFloat(value)
+	if !ok || f != math.Trunc(f) {
+		return nil, errorf(messages.BadValue, "$size needs a number")
+	}
+	if f < 0 {
+		return nil, errorf(messages.BadValue, "$size may not be negative")
+	}
+	size := int(f)
+	return anyWhole(func(v interface{}) bool {
+		array := bsonutil.ToArray(v)
+		return array != nil && len(array) == size
+	}), nil
+}
+
+func compileAll(value interface{}) (condition, error) {
+	values := bsonutil.ToArray(value)
+	if values == nil {
+		return nil, errorf(messages.BadValue, "$all needs an array")
+	}
+	if len(values) == 0 {
+		return func([]interface{}) bool { return false }, nil
+	}
+	conditions := make([]condition, len(values))
+	for i, v := range values {
+		doc := bsonutil.ToD(v)
+		if isOperatorDoc(doc) {
+			if doc[0].Name != "$elemMatch" || len(doc) != 1 {
+				return nil, errorf(messages.BadValue, "no $ expressions in $all")
+			}
+			var err error
+			if conditions[i], err = compileElemMatch(doc[0].Value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var err error
+		if conditions[i], err = compileCondition(v); err != nil {
+			return nil, err
+		}
+	}
+	return allOf(conditions), nil
+}
+
+// compileElemMatch compiles an $elemMatch, which holds for arrays with an
+// element that meets all its conditions: operators on the element
+// itself, or a filter on elements that are documents.
+func compileElemMatch(value interface{}) (condition, error) {
+	spec := bsonutil.ToD(value)
+	if spec == nil {
+		return nil, errorf(messages.BadValue, "$elemMatch needs an Object")
+	}
+
+	var test valueTest
+	switch {
+	case isOperatorDoc(spec) && !logicalOperators[spec[0].Name]:
+		c, err := compileOperators(spec)
+		if err != nil {
+			return nil, err
+		}
+		test = func(v interface{}) bool {
+			return c([]interface{}{v})
+		}
+	default:
+		match, err := compileFilter(spec, false)
+		if err != nil {
+			return nil, err
+		}
+		test = func(v interface{}) bool {
+			doc := bsonutil.ToD(v)
+			if doc == nil {
+				return false
+			}
+			// without $expr, nested filters cannot fail
+			ok, _ := match(doc)
+			return ok
+		}
+	}
+
+	return anyWhole(func(v interface{}) bool {
+		for _, elem := range bsonutil.ToArray(v) {
+			if test(elem) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// logicalOperators start filters rather than operators on values, in
+// $elemMatch.
+var logicalOperators = map[string]bool{
+	"$and":  true,
+	"$or":   true,
+	"$nor":  true,
+	"$expr": true,
+}
+
+func compileNot(value interface{}) (condition, error) {
+	if re, ok := value.(bson.RegEx); ok {
+		test, err := regexTest(re)
+		if err != nil {
+			return nil, err
+		}
+		return not(anyValue(test)), nil
+	}
+	ops := bsonutil.ToD(value)
+	if ops == nil {
+		return nil, errorf(messages.BadValue, "$not needs a regex or a document")
+	}
+	if len(ops) == 0 {
+		return nil, errorf(messages.BadValue, "$not cannot be empty")
+	}
+	if !isOperatorDoc(ops) {
+		return nil, errorf(messages.BadValue, "$not needs a document of operators")
+	}
+	c, err := compileOperators(ops)
+	if err != nil {
+		return nil, err
+	}
+	return not(c), nil
+}
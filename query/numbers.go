@@ -0,0 +1,254 @@
+package query
+
+import (
+	"math"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+)
+
+// Numeric types, from narrowest to widest. Arithmetic answers in the
+// widest type of its arguments, and widens ints that overflow to longs,
+// and longs to doubles.
+const (
+	notNumber = iota
+	numberInt
+	numberLong
+	numberDouble
+)
+
+func numberType(v interface{}) int {
+	switch n := v.(type) {
+	case int32:
+		return numberInt
+	case int:
+		if n >= math.MinInt32 && n <= math.MaxInt32 {
+			return numberInt
+		}
+		return numberLong
+	case int64:
+		return numberLong
+	case float64, float32:
+		return numberDouble
+	}
+	return notNumber
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	f, _ := toFloat(v)
+	return int64(f)
+}
+
+// number returns an integer in the narrowest type that holds it, given
+// the narrowest it may be.
+func number(n int64, kind int) interface{} {
+	if kind == numberInt && n >= math.MinInt32 && n <= math.MaxInt32 {
+		return int(n)
+	}
+	return n
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
+}
+
+func arithmeticError(name string, v interface{}) error {
+	return errorf(messages.TypeMismatch, "%s only supports numeric or date types, not %s", name, TypeName(v))
+}
+
+// Add adds numbers as $add does, in the widest of their types.
+func Add(values ...interface{}) (interface{}, error) {
+	return add(values)
+}
+
+// Multiply multiplies numbers as $multiply does, in the widest of their
+// types.
+func Multiply(values ...interface{}) (interface{}, error) {
+	return multiply(values)
+}
+
+// add adds numbers, and a date if there is one, as milliseconds.
+func add(args []interface{}) (interface{}, error) {
+	kind := numberInt
+	var sum int64
+	var fsum float64
+	var date *time.Time
+	for _, arg := range args {
+		if isNull(arg) {
+			return nil, nil
+		}
+		if t, ok := arg.(time.Time); ok {
+			if date != nil {
+				return nil, errorf(messages.TypeMismatch, "only one date allowed in an $add expression")
+			}
+			date = &t
+			continue
+		}
+		t := numberType(arg)
+		if t == notNumber {
+			return nil, arithmeticError("$add", arg)
+		}
+		if t > kind {
+			kind = t
+		}
+		f, _ := toFloat(arg)
+		fsum += f
+		if kind < numberDouble {
+			n := toInt64(arg)
+			if (n > 0 && sum > math.MaxInt64-n) || (n < 0 && sum < math.MinInt64-n) {
+				kind = numberDouble
+			}
+			sum += n
+		}
+	}
+	if date != nil {
+		if kind == numberDouble {
+			return fromMillis(millis(*date) + int64(math.Round(fsum))), nil
+		}
+		return fromMillis(millis(*date) + sum), nil
+	}
+	if kind == numberDouble {
+		return fsum, nil
+	}
+	return number(sum, kind), nil
+}
+
+func subtract(args []interface{}) (interface{}, error) {
+	a, b := args[0], args[1]
+	if isNull(a) || isNull(b) {
+		return nil, nil
+	}
+	if t, ok := a.(time.Time); ok {
+		if u, ok := b.(time.Time); ok {
+			return millis(t) - millis(u), nil
+		}
+		if numberType(b) == notNumber {
+			return nil, arithmeticError("$subtract", b)
+		}
+		f, _ := toFloat(b)
+		return fromMillis(millis(t) - int64(math.Round(f))), nil
+	}
+	if numberType(a) == notNumber {
+		return nil, arithmeticError("$subtract", a)
+	}
+	if numberType(b) == notNumber {
+		return nil, arithmeticError("$subtract", b)
+	}
+	negated, err := multiply([]interface{}{b, -1})
+	if err != nil {
+		return nil, err
+	}
+	return add([]interface{}{a, negated})
+}
+
+func multiply(args []interface{}) (interface{}, error) {
+	kind := numberInt
+	product := int64(1)
+	fproduct := 1.0
+	for _, arg := range args {
+		if isNull(arg) {
+			return nil, nil
+		}
+		t := numberType(arg)
+		if t == notNumber {
+			return nil, arithmeticError("$multiply", arg)
+		}
+		if t > kind {
+			kind = t
+		}
+		f, _ := toFloat(arg)
+		fproduct *= f
+		if kind < numberDouble {
+			n := toInt64(arg)
+			if n != 0 && (product*n)/n != product {
+				kind = numberDouble
+			}
+			product *= n
+		}
+	}
+	if kind == numberDouble {
+		return fproduct, nil
+	}
+	return number(product, kind), nil
+}
+
+func divide(args []interface{}) (interface{}, error) {
+	a, b := args[0], args[1]
+	if isNull(a) || isNull(b) {
+		return nil, nil
+	}
+	x, ok := toFloat(a)
+	if !ok {
+		return nil, errorf(messages.TypeMismatch, "$divide only supports numeric types, not %s", TypeName(a))
+	}
+	y, ok := toFloat(b)
+	if !ok {
+		return nil, errorf(messages.TypeMismatch, "$divide only supports numeric types, not %s", TypeName(b))
+	}
+	if y == 0 {
+		return nil, errorf(messages.BadValue, "can't $divide by zero")
+	}
+	return x / y, nil
+}
+
+func mod(args []interface{}) (interface{}, error) {
+	a, b := args[0], args[1]
+	if isNull(a) || isNull(b) {
+		return nil, nil
+	}
+	ta, tb := numberType(a), numberType(b)
+	if ta == notNumber || tb == notNumber {
+		return nil, errorf(messages.TypeMismatch, "$mod only supports numeric types, not %s and %s", TypeName(a), TypeName(b))
+	}
+	if ta == numberDouble || tb == numberDouble {
+		x, _ := toFloat(a)
+		y, _ := toFloat(b)
+		if y == 0 {
+			return nil, errorf(messages.BadValue, "can't $mod by zero")
+		}
+		return math.Mod(x, y), nil
+	}
+	y := toInt64(b)
+	if y == 0 {
+		return nil, errorf(messages.BadValue, "can't $mod by zero")
+	}
+	kind := ta
+	if tb > kind {
+		kind = tb
+	}
+	return number(toInt64(a)%y, kind), nil
+}
+
+func abs(args []interface{}) (interface{}, error) {
+	a := args[0]
+	if isNull(a) {
+		return nil, nil
+	}
+	switch numberType(a) {
+	case notNumber:
+		return nil, errorf(messages.TypeMismatch, "$abs only supports numeric types, not %s", TypeName(a))
+	case numberDouble:
+		f, _ := toFloat(a)
+		return math.Abs(f), nil
+	}
+	n := toInt64(a)
+	if n == math.MinInt64 {
+		return nil, errorf(messages.BadValue, "can't take $abs of long long min")
+	}
+	if n < 0 {
+		n = -n
+	}
+	return number(n, numberType(a)), nil
+}
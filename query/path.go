@@ -0,0 +1,59 @@
+package query
+
+import (
+	"strconv"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// missingValue is the type of Missing.
+type missingValue struct{}
+
+// Missing is the value of paths that documents do not have. It differs
+// from null, which is a value of its own.
+var Missing = missingValue{}
+
+// lookup returns the values at a path in a value, as filters see them. A
+// path continues into the documents of arrays, so there may be several;
+// numeric parts of a path also index arrays. Branches of the value that
+// do not have the path give Missing, and so does the value if none has
+// it.
+func lookup(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+	if doc := bsonutil.ToD(v); doc != nil {
+		if value, ok := field(doc, parts[0]); ok {
+			return lookup(value, parts[1:])
+		}
+		return []interface{}{Missing}
+	}
+
+	array := bsonutil.ToArray(v)
+	if array == nil {
+		return []interface{}{Missing}
+	}
+	values := []interface{}{}
+	if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 {
+		if i < len(array) {
+			values = append(values, lookup(array[i], parts[1:])...)
+		}
+	} else {
+		for _, elem := range array {
+			if bsonutil.ToD(elem) != nil {
+				values = append(values, lookup(elem, parts)...)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return []interface{}{Missing}
+	}
+	return values
+}
+
+// isNull returns whether a value counts as null in equality: null,
+// undefined and Missing all do.
+func isNull(v interface{}) bool {
+	return v == nil || v == Missing || v == bson.Undefined
+}
@@ -0,0 +1,268 @@
+package query
+
+import (
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A Projection is a compiled projection, as find and $project take:
+// either the fields it includes, with _id unless it excludes that, and
+// fields it computes, or all but the fields it excludes.
+type Projection struct {
+	excluding bool
+	excludeID bool
+	paths     []string
+	computed  []computedField
+}
+
+type computedField struct {
+	parts []string
+	expr  *Expression
+}
+
+// CompileProjection compiles a projection. An empty projection leaves
+// documents as they are.
+func CompileProjection(spec bson.D) (*Projection, error) {
+	p := &Projection{}
+	included, excluded := []string{}, []string{}
+	includeID := false
+	flat, err := flattenProjection(spec, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range flat {
+		if b, ok := projectionFlag(elem.Value); ok {
+			switch {
+			case elem.Name == "_id":
+				p.excludeID, includeID = !b, b
+			case b:
+				included = append(included, elem.Name)
+			default:
+				excluded = append(excluded, elem.Name)
+			}
+			continue
+		}
+		expr, err := CompileExpression(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		p.computed = append(p.computed, computedField{parts: strings.Split(elem.Name, "."), expr: expr})
+	}
+
+	switch {
+	case len(excluded) > 0 && len(included) > 0:
+		return nil, errorf(messages.BadValue, "Cannot do exclusion on field %s in inclusion projection", excluded[0])
+	case len(excluded) > 0 && len(p.computed) > 0:
+		return nil, errorf(messages.BadValue, "Cannot do exclusion on field %s in inclusion projection", excluded[0])
+	case len(excluded) > 0 || (len(included) == 0 && len(p.computed) == 0 && !includeID):
+		p.excluding = true
+		p.paths = excluded
+		if p.excludeID {
+			p.paths = append(p.paths, "_id")
+		}
+	default:
+		p.paths = included
+	}
+	return p, nil
+}
+
+// projectionFlag returns whether a projection value includes or excludes
+// its field, rather than computing it: booleans and numbers do.
+func projectionFlag(v interface{}) (bool, bool) {
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0, true
+	}
+	return false, false
+}
+
+// flattenProjection turns nested projections, { a: { b: 1 } }, into
+// dotted ones, { "a.b": 1 }.
+func flattenProjection(spec bson.D, prefix string) (bson.D, error) {
+	flat := bson.D{}
+	for _, elem := range spec {
+		if len(elem.Name) == 0 || strings.HasPrefix(elem.Name, "$") || strings.Contains(elem.Name, "..") {
+			return nil, errorf(messages.BadValue, "Invalid projection field: “%s”", elem.Name)
+		}
+		name := prefix + elem.Name
+		doc := bsonutil.ToD(elem.Value)
+		if doc == nil || isOperatorDoc(doc) {
+			flat = append(flat, bson.DocElem{Name: name, Value: elem.Value})
+			continue
+		}
+		if len(doc) == 0 {
+			return nil, errorf(messages.BadValue, "An empty sub-projection is not a valid value. Found empty object at path %s", name)
+		}
+		sub, err := flattenProjection(doc, name+".")
+		if err != nil {
+			return nil, err
+		}
+		flat = append(flat, sub...)
+	}
+	return flat, nil
+}
+
+// Apply returns a document with the projection applied to it. It shares
+// values with the document.
+func (p *Projection) Apply(doc bson.D) (bson.D, error) {
+	if p.excluding {
+		return excludeFields(doc, p.paths), nil
+	}
+
+	out := includeFields(doc, p.paths)
+	if id, ok := field(doc, "_id"); ok && !p.excludeID {
+		out = append(bson.D{{Name: "_id", Value: id}}, out...)
+	}
+	for _, c := range p.computed {
+		value, err := c.expr.Evaluate(doc)
+		if err != nil {
+			return nil, err
+		}
+		if value != Missing {
+			out = SetField(out, c.parts, value)
+		}
+	}
+	return out, nil
+}
+
+// subpaths returns the rest of the paths that go into a field.
+func subpaths(paths []string, name string) []string {
+	sub := []string{}
+	for _, path := range paths {
+		if strings.HasPrefix(path, name+".") {
+			sub = append(sub, path[len(name)+1:])
+		}
+	}
+	return sub
+}
+
+func contains(paths []string, name string) bool {
+	for _, path := range paths {
+		if path == name {
+			return true
+		}
+	}
+	return false
+}
+
+// includeFields returns the fields of a document at some paths, leaving
+// out _id unless it is one of them.
+func includeFields(doc bson.D, paths []string) bson.D {
+	out := bson.D{}
+	for _, elem := range doc {
+		if contains(paths, elem.Name) {
+			out = append(out, elem)
+			continue
+		}
+		sub := subpaths(paths, elem.Name)
+		if len(sub) == 0 {
+			continue
+		}
+		if d := bsonutil.ToD(elem.Value); d != nil {
+			out = append(out, bson.DocElem{Name: elem.Name, Value: includeFields(d, sub)})
+		} else if array := bsonutil.ToArray(elem.Value); array != nil {
+			out = append(out, bson.DocElem{Name: elem.Name, Value: includeElements(array, sub)})
+		}
+	}
+	return out
+}
+
+// includeElements includes paths in the documents of an array, and its
+// arrays, dropping other values.
+func includeElements(array []interface{}, paths []string) []interface{} {
+	values := []interface{}{}
+	for _, v := range array {
+		if d := bsonutil.ToD(v); d != nil {
+			values = append(values, includeFields(d, paths))
+		} else if a := bsonutil.ToArray(v); a != nil {
+			values = append(values, includeElements(a, paths))
+		}
+	}
+	return values
+}
+
+// excludeFields returns the fields of a document but those at some
+// paths.
+func excludeFields(doc bson.D, paths []string) bson.D {
+	out := bson.D{}
+	for _, elem := range doc {
+		if contains(paths, elem.Name) {
+			continue
+		}
+		if sub := subpaths(paths, elem.Name); len(sub) > 0 {
+			if d := bsonutil.ToD(elem.Value); d != nil {
+				elem.Value = excludeFields(d, sub)
+			} else if array := bsonutil.ToArray(elem.Value); array != nil {
+				elem.Value = excludeElements(array, sub)
+			}
+		}
+		out = append(out, elem)
+	}
+	return out
+}
+
+func excludeElements(array []interface{}, paths []string) []interface{} {
+	values := make([]interface{}, len(array))
+	for i, v := range array {
+		values[i] = v
+		if d := bsonutil.ToD(v); d != nil {
+			values[i] = excludeFields(d, paths)
+		} else if a := bsonutil.ToArray(v); a != nil {
+			values[i] = excludeElements(a, paths)
+		}
+	}
+	return values
+}
+
+// SetField returns a document with the value at a path set, creating or
+// replacing the documents on the way. It shares values with the document,
+// but does not change it.
+func SetField(doc bson.D, parts []string, value interface{}) bson.D {
+	out := make(bson.D, len(doc), len(doc)+1)
+	copy(out, doc)
+	for i, elem := range out {
+		if elem.Name != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			out[i].Value = value
+		} else {
+			sub := bsonutil.ToD(elem.Value)
+			if sub == nil {
+				sub = bson.D{}
+			}
+			out[i].Value = SetField(sub, parts[1:], value)
+		}
+		return out
+	}
+	if len(parts) > 1 {
+		value = SetField(bson.D{}, parts[1:], value)
+	}
+	return append(out, bson.DocElem{Name: parts[0], Value: value})
+}
+
+// RemoveField returns a document without the value at a path, which may
+// go into documents but not arrays. It does not change the document.
+func RemoveField(doc bson.D, parts []string) bson.D {
+	for i, elem := range doc {
+		if elem.Name != parts[0] {
+			continue
+		}
+		out := make(bson.D, 0, len(doc))
+		out = append(out, doc[:i]...)
+		if len(parts) > 1 {
+			sub := bsonutil.ToD(elem.Value)
+			if sub == nil {
+				return doc
+			}
+			out = append(out, bson.DocElem{Name: elem.Name, Value: RemoveField(sub, parts[1:])})
+		}
+		return append(out, doc[i+1:]...)
+	}
+	return doc
+}
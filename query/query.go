@@ -0,0 +1,220 @@
+// Package query evaluates MongoDB query filters and expressions against
+// BSON documents, with MongoDB's semantics for dotted paths, arrays and
+// the ordering of values of different types.
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// An Error is a filter or expression that cannot be compiled or
+// evaluated, with the MongoDB error code to answer with.
+type Error struct {
+	Code    int32
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func errorf(code int32, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// A Filter is a compiled query filter.
+type Filter struct {
+	match matcher
+}
+
+// A matcher matches documents against a filter, failing if an expression
+// in it cannot be evaluated for a document.
+type matcher func(doc bson.D) (bool, error)
+
+// Compile compiles a query filter. A nil or empty filter matches every
+// document.
+func Compile(filter bson.D) (*Filter, error) {
+	match, err := compileFilter(filter, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{match: match}, nil
+}
+
+// Matches returns whether a document matches the filter. It fails if a
+// $expr in the filter cannot be evaluated for the document, as when it
+// divides by zero.
+func (f *Filter) Matches(doc bson.D) (bool, error) {
+	return f.match(doc)
+}
+
+// Match compiles a filter and matches one document against it.
+func Match(filter bson.D, doc bson.D) (bool, error) {
+	f, err := Compile(filter)
+	if err != nil {
+		return false, err
+	}
+	return f.Matches(doc)
+}
+
+// Equalities returns the paths that a filter requires to equal a value,
+// and the values, as upserts and indexes need: those given as plain values
+// or with $eq, at the top level or under $and.
+func Equalities(filter bson.D) bson.D {
+	out := bson.D{}
+	for _, elem := range filter {
+		if elem.Name == "$and" {
+			for _, clause := range bsonutil.ToArray(elem.Value) {
+				out = append(out, Equalities(bsonutil.ToD(clause))...)
+			}
+			continue
+		}
+		if strings.HasPrefix(elem.Name, "$") {
+			continue
+		}
+		value := elem.Value
+		if cond := bsonutil.ToD(value); isOperatorDoc(cond) {
+			eq, ok := field(cond, "$eq")
+			if !ok {
+				continue
+			}
+			value = eq
+		}
+		if _, ok := value.(bson.RegEx); ok {
+			continue
+		}
+		out = append(out, bson.DocElem{Name: elem.Name, Value: value})
+	}
+	return out
+}
+
+// isOperatorDoc returns whether a document is of operators, rather than
+// a value: whether its first field starts with a dollar sign.
+func isOperatorDoc(doc bson.D) bool {
+	return len(doc) > 0 && strings.HasPrefix(doc[0].Name, "$")
+}
+
+// field returns the value of a document's field, and whether it has it.
+func field(doc bson.D, name string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+func all(matchers []matcher) matcher {
+	if len(matchers) == 1 {
+		return matchers[0]
+	}
+	return func(doc bson.D) (bool, error) {
+		for _, m := range matchers {
+			if ok, err := m(doc); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// compileFilter compiles a filter, which is the top level of a query, or
+// one nested in $elemMatch, where $expr is not allowed.
+func compileFilter(filter bson.D, top bool) (matcher, error) {
+	matchers := []matcher{}
+	for _, elem := range filter {
+		var m matcher
+		var err error
+		switch elem.Name {
+		case "$and", "$or", "$nor":
+			m, err = compileLogical(elem.Name, elem.Value, top)
+		case "$expr":
+			if !top {
+				return nil, errorf(messages.BadValue, "$expr can only be applied to the top-level document")
+			}
+			m, err = compileExpr(elem.Value)
+		case "$comment":
+			continue
+		case "$where", "$text", "$jsonSchema":
+			return nil, errorf(messages.BadValue, "%s is not supported", elem.Name)
+		default:
+			if strings.HasPrefix(elem.Name, "$") {
+				return nil, errorf(messages.BadValue, "unknown top level operator: %s", elem.Name)
+			}
+			m, err = compileField(elem.Name, elem.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return all(matchers), nil
+}
+
+func compileLogical(op string, value interface{}, top bool) (matcher, error) {
+	clauses := bsonutil.ToArray(value)
+	if len(clauses) == 0 {
+		return nil, errorf(messages.BadValue, "%s must be a nonempty array", op)
+	}
+	matchers := make([]matcher, len(clauses))
+	for i, clause := range clauses {
+		doc := bsonutil.ToD(clause)
+		if doc == nil {
+			return nil, errorf(messages.BadValue, "%s argument's entries must be objects", op)
+		}
+		var err error
+		if matchers[i], err = compileFilter(doc, top); err != nil {
+			return nil, err
+		}
+	}
+
+	if op == "$and" {
+		return all(matchers), nil
+	}
+	return func(doc bson.D) (bool, error) {
+		for _, m := range matchers {
+			ok, err := m(doc)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return op == "$or", nil
+			}
+		}
+		return op == "$nor", nil
+	}, nil
+}
+
+func compileExpr(value interface{}) (matcher, error) {
+	e, err := CompileExpression(value)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc bson.D) (bool, error) {
+		v, err := e.Evaluate(doc)
+		if err != nil {
+			return false, err
+		}
+		return Truthy(v), nil
+	}, nil
+}
+
+// compileField compiles the condition on one path of a filter.
+func compileField(path string, value interface{}) (matcher, error) {
+	if len(path) == 0 || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+		return nil, errorf(messages.BadValue, "Invalid path: “%s”", path)
+	}
+	test, err := compileCondition(value)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(path, ".")
+	return func(doc bson.D) (bool, error) {
+		return test(lookup(doc, parts)), nil
+	}, nil
+}
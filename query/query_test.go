@@ -0,0 +1,470 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// d builds documents tersely: d("a", 1, "b", 2).
+func d(pairs ...interface{}) bson.D {
+	doc := bson.D{}
+	for i := 0; i < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
+
+func a(values ...interface{}) []interface{} {
+	return append([]interface{}{}, values...)
+}
+
+// a conformance case is a filter, and documents it matches and does not,
+// as MongoDB decides.
+type conformance struct {
+	name    string
+	filter  bson.D
+	matches []bson.D
+	misses  []bson.D
+}
+
+var conformanceCases = []conformance{
+	{
+		name:    "equality",
+		filter:  d("a", 1),
+		matches: []bson.D{d("a", 1), d("a", 1.0), d("a", int64(1)), d("a", a(2, 1))},
+		misses:  []bson.D{d("a", "1"), d("a", a(a(1))), d("b", 1), d()},
+	},
+	{
+		name:    "equality of arrays",
+		filter:  d("a", a(1, 2)),
+		matches: []bson.D{d("a", a(1, 2)), d("a", a(a(1, 2), 3))},
+		misses:  []bson.D{d("a", a(2, 1)), d("a", 1), d("a", a(1, 2, 3))},
+	},
+	{
+		name:    "equality of documents, in field order",
+		filter:  d("a", d("x", 1, "y", 2)),
+		matches: []bson.D{d("a", d("x", 1, "y", 2)), d("a", a(d("x", 1, "y", 2)))},
+		misses:  []bson.D{d("a", d("y", 2, "x", 1)), d("a", d("x", 1))},
+	},
+	{
+		name:    "dotted paths",
+		filter:  d("a.b.c", 1),
+		matches: []bson.D{d("a", d("b", d("c", 1))), d("a", a(d("b", a(d("c", 1))))), d("a", d("b", d("c", a(1, 2))))},
+		misses:  []bson.D{d("a", d("b", 1)), d("a", a(1, 2)), d("a.b.c", 1)},
+	},
+	{
+		name:    "array indexes",
+		filter:  d("a.1", "y"),
+		matches: []bson.D{d("a", a("x", "y")), d("a", a("x", a("y")))},
+		misses:  []bson.D{d("a", a("y", "x")), d("a", a("x")), d("a", d("2", "y"))},
+	},
+	{
+		name:    "array indexes into documents",
+		filter:  d("a.0.b", 1),
+		matches: []bson.D{d("a", a(d("b", 1)))},
+		misses:  []bson.D{d("a", a(d("b", 2), d("b", 1)))},
+	},
+	{
+		name:    "numeric fields of documents",
+		filter:  d("a.0", 5),
+		matches: []bson.D{d("a", d("0", 5))},
+		misses:  []bson.D{d("a", d("1", 5))},
+	},
+	{
+		name:    "null",
+		filter:  d("a", nil),
+		matches: []bson.D{d("a", nil), d(), d("a", bson.Undefined), d("a", a(1, nil))},
+		misses:  []bson.D{d("a", 0), d("a", a()), d("a", false)},
+	},
+	{
+		name:    "null on paths through arrays",
+		filter:  d("a.b", nil),
+		matches: []bson.D{d("a", a(d("b", 1), d("c", 2))), d("a", d("c", 1)), d("a", 1)},
+		misses:  []bson.D{d("a", a(d("b", 1), d("b", 2)))},
+	},
+	{
+		name:    "$eq",
+		filter:  d("a", d("$eq", 2)),
+		matches: []bson.D{d("a", 2), d("a", a(1, 2))},
+		misses:  []bson.D{d("a", 3), d()},
+	},
+	{
+		name:    "$eq of a regular expression is equality",
+		filter:  d("a", d("$eq", bson.RegEx{Pattern: "^x"})),
+		matches: []bson.D{d("a", bson.RegEx{Pattern: "^x"})},
+		misses:  []bson.D{d("a", "xy")},
+	},
+	{
+		name:    "$ne",
+		filter:  d("a", d("$ne", 2)),
+		matches: []bson.D{d("a", 3), d(), d("a", a(1, 3))},
+		misses:  []bson.D{d("a", 2), d("a", a(1, 2))},
+	},
+	{
+		name:    "$ne null",
+		filter:  d("a.b", d("$ne", nil)),
+		matches: []bson.D{d("a", d("b", 1)), d("a", a(d("b", 1), d("b", 2)))},
+		misses:  []bson.D{d("a", d("c", 1)), d("a", a(d("b", 1), d("c", 2)))},
+	},
+	{
+		name:    "comparisons across numeric types",
+		filter:  d("a", d("$gt", 1, "$lte", int64(3))),
+		matches: []bson.D{d("a", 1.5), d("a", 3), d("a", a(0, 2))},
+		misses:  []bson.D{d("a", 1), d("a", 3.5), d("a", a(0, 0.5))},
+	},
+	{
+		name:    "comparisons within types only",
+		filter:  d("a", d("$gt", 5)),
+		matches: []bson.D{d("a", 6)},
+		misses:  []bson.D{d("a", "6"), d("a", true), d("a", nil), d(), d("a", d("x", 1))},
+	},
+	{
+		name:    "comparisons of strings",
+		filter:  d("a", d("$lt", "b")),
+		matches: []bson.D{d("a", "a"), d("a", "")},
+		misses:  []bson.D{d("a", "b"), d("a", "ba"), d("a", 1)},
+	},
+	{
+		name:    "comparisons of dates",
+		filter:  d("a", d("$gte", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))),
+		matches: []bson.D{d("a", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))},
+		misses:  []bson.D{d("a", time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)), d("a", 1)},
+	},
+	{
+		name:    "comparisons with arrays compare whole arrays too",
+		filter:  d("a", d("$gt", a(1))),
+		matches: []bson.D{d("a", a(2)), d("a", a(1, 0))},
+		misses:  []bson.D{d("a", a(0)), d("a", 5)},
+	},
+	{
+		name:    "$gte null",
+		filter:  d("a", d("$gte", nil)),
+		matches: []bson.D{d("a", nil), d()},
+		misses:  []bson.D{d("a", 1)},
+	},
+	{
+		name:    "$gt MinKey",
+		filter:  d("a", d("$gt", bson.MinKey)),
+		matches: []bson.D{d("a", 1), d("a", "x"), d("a", nil)},
+		misses:  []bson.D{d("a", bson.MinKey), d()},
+	},
+	{
+		name:    "$in",
+		filter:  d("a", d("$in", a(1, "x", nil))),
+		matches: []bson.D{d("a", 1.0), d("a", "x"), d(), d("a", a(5, 1))},
+		misses:  []bson.D{d("a", 2), d("a", a(2, 3))},
+	},
+	{
+		name:    "$in with regular expressions",
+		filter:  d("a", d("$in", a(bson.RegEx{Pattern: "^ab"}, 3))),
+		matches: []bson.D{d("a", "abc"), d("a", 3), d("a", a("zz", "abba"))},
+		misses:  []bson.D{d("a", "cab")},
+	},
+	{
+		name:    "$nin",
+		filter:  d("a", d("$nin", a(1, 2))),
+		matches: []bson.D{d("a", 3), d(), d("a", a(3, 4))},
+		misses:  []bson.D{d("a", 1), d("a", a(3, 2))},
+	},
+	{
+		name:    "$exists",
+		filter:  d("a.b", d("$exists", true)),
+		matches: []bson.D{d("a", d("b", nil)), d("a", a(d("c", 1), d("b", 1)))},
+		misses:  []bson.D{d("a", d("c", 1)), d("a", 1), d()},
+	},
+	{
+		name:    "$exists false",
+		filter:  d("a", d("$exists", 0)),
+		matches: []bson.D{d(), d("b", 1)},
+		misses:  []bson.D{d("a", nil), d("a", a())},
+	},
+	{
+		name:    "$type by alias",
+		filter:  d("a", d("$type", "string")),
+		matches: []bson.D{d("a", "x"), d("a", a(1, "x"))},
+		misses:  []bson.D{d("a", 1), d()},
+	},
+	{
+		name:    "$type by code, and number",
+		filter:  d("a", d("$type", a(16, "number"))),
+		matches: []bson.D{d("a", 1), d("a", 1.5), d("a", int64(2))},
+		misses:  []bson.D{d("a", "1")},
+	},
+	{
+		name:    "$type int and long",
+		filter:  d("a", d("$type", "long")),
+		matches: []bson.D{d("a", int64(1))},
+		misses:  []bson.D{d("a", 1), d("a", 1.0)},
+	},
+	{
+		name:    "$type array",
+		filter:  d("a", d("$type", "array")),
+		matches: []bson.D{d("a", a()), d("a", a(1))},
+		misses:  []bson.D{d("a", 1), d("a", d("0", 1))},
+	},
+	{
+		name:    "$type null",
+		filter:  d("a", d("$type", "null")),
+		matches: []bson.D{d("a", nil)},
+		misses:  []bson.D{d()},
+	},
+	{
+		name:    "$mod",
+		filter:  d("a", d("$mod", a(4, 1))),
+		matches: []bson.D{d("a", 5), d("a", 9.5), d("a", a(2, 13))},
+		misses:  []bson.D{d("a", 4), d("a", -3), d("a", "5"), d()},
+	},
+	{
+		name:    "$regex",
+		filter:  d("a", d("$regex", "^ab", "$options", "i")),
+		matches: []bson.D{d("a", "ABC"), d("a", a("x", "abx")), d("a", bson.Symbol("abc"))},
+		misses:  []bson.D{d("a", "cab"), d("a", 1)},
+	},
+	{
+		name:    "regular expression values",
+		filter:  d("a", bson.RegEx{Pattern: "b$", Options: "m"}),
+		matches: []bson.D{d("a", "ab\ncd"), d("a", bson.RegEx{Pattern: "b$", Options: "m"})},
+		misses:  []bson.D{d("a", "ba")},
+	},
+	{
+		name:    "extended regular expressions",
+		filter:  d("a", d("$regex", "a b # comment\n c", "$options", "x")),
+		matches: []bson.D{d("a", "xabc")},
+		misses:  []bson.D{d("a", "a b c")},
+	},
+	{
+		name:    "$size",
+		filter:  d("a", d("$size", 2)),
+		matches: []bson.D{d("a", a(1, 2)), d("a", a(a(), a()))},
+		misses:  []bson.D{d("a", a(1)), d("a", a(a(1, 2))), d("a", "ab"), d()},
+	},
+	{
+		name:    "$all",
+		filter:  d("a", d("$all", a(1, 2))),
+		matches: []bson.D{d("a", a(2, 3, 1)), d("a", a(a(1), 2, 1))},
+		misses:  []bson.D{d("a", a(1, 3)), d("a", 1)},
+	},
+	{
+		name:    "$all of one value",
+		filter:  d("a", d("$all", a(1))),
+		matches: []bson.D{d("a", 1), d("a", a(1))},
+		misses:  []bson.D{d("a", 2)},
+	},
+	{
+		name:   "$all of nothing",
+		filter: d("a", d("$all", a())),
+		misses: []bson.D{d("a", a()), d("a", a(1))},
+	},
+	{
+		name:    "$all with $elemMatch",
+		filter:  d("a", d("$all", a(d("$elemMatch", d("x", 1)), d("$elemMatch", d("y", 2))))),
+		matches: []bson.D{d("a", a(d("x", 1), d("y", 2)))},
+		misses:  []bson.D{d("a", a(d("x", 1)))},
+	},
+	{
+		name:    "$elemMatch on documents",
+		filter:  d("a", d("$elemMatch", d("x", 1, "y", d("$gt", 1)))),
+		matches: []bson.D{d("a", a(d("x", 1, "y", 2)))},
+		misses:  []bson.D{d("a", a(d("x", 1, "y", 1), d("x", 2, "y", 2))), d("a", d("x", 1, "y", 2))},
+	},
+	{
+		name:    "$elemMatch on values",
+		filter:  d("a", d("$elemMatch", d("$gte", 2, "$lt", 3))),
+		matches: []bson.D{d("a", a(1, 2.5))},
+		misses:  []bson.D{d("a", a(1, 3)), d("a", 2)},
+	},
+	{
+		name:    "without $elemMatch, conditions hold for any elements",
+		filter:  d("a", d("$gte", 2, "$lt", 3)),
+		matches: []bson.D{d("a", a(1, 2.5)), d("a", a(1, 3)), d("a", a(0, 4))},
+		misses:  []bson.D{d("a", a(3, 4))},
+	},
+	{
+		name:    "$elemMatch with logical operators",
+		filter:  d("a", d("$elemMatch", d("$or", a(d("x", 1), d("y", 1))))),
+		matches: []bson.D{d("a", a(d("y", 1)))},
+		misses:  []bson.D{d("a", a(d("z", 1)))},
+	},
+	{
+		name:    "$not",
+		filter:  d("a", d("$not", d("$gt", 5))),
+		matches: []bson.D{d("a", 5), d("a", "x"), d()},
+		misses:  []bson.D{d("a", 6), d("a", a(1, 6))},
+	},
+	{
+		name:    "$not with a regular expression",
+		filter:  d("a", d("$not", bson.RegEx{Pattern: "^x"})),
+		matches: []bson.D{d("a", "yx"), d()},
+		misses:  []bson.D{d("a", "xy")},
+	},
+	{
+		name:    "$and",
+		filter:  d("$and", a(d("a", 1), d("b", 2))),
+		matches: []bson.D{d("a", 1, "b", 2)},
+		misses:  []bson.D{d("a", 1), d("b", 2)},
+	},
+	{
+		name:    "$or",
+		filter:  d("$or", a(d("a", 1), d("b", 2))),
+		matches: []bson.D{d("a", 1), d("b", 2)},
+		misses:  []bson.D{d("a", 2), d()},
+	},
+	{
+		name:    "$nor",
+		filter:  d("$nor", a(d("a", 1), d("b", 2))),
+		matches: []bson.D{d("a", 2), d()},
+		misses:  []bson.D{d("a", 1), d("b", 2)},
+	},
+	{
+		name:    "several conditions",
+		filter:  d("a", 1, "$or", a(d("b", 1), d("c", 1)), "$comment", "either"),
+		matches: []bson.D{d("a", 1, "c", 1)},
+		misses:  []bson.D{d("a", 1), d("c", 1)},
+	},
+	{
+		name:    "$expr",
+		filter:  d("$expr", d("$gt", a("$spent", d("$multiply", a("$budget", 2))))),
+		matches: []bson.D{d("spent", 5, "budget", 2), d("spent", 4)},
+		misses:  []bson.D{d("spent", 4, "budget", 2), d("budget", 2)},
+	},
+	{
+		name:    "$expr with $$ROOT",
+		filter:  d("$expr", d("$eq", a("$$ROOT.a", "$b"))),
+		matches: []bson.D{d("a", 1, "b", 1.0), d()},
+		misses:  []bson.D{d("a", 1)},
+	},
+	{
+		name:    "empty filters",
+		filter:  d(),
+		matches: []bson.D{d(), d("a", 1)},
+	},
+}
+
+func TestConformance(t *testing.T) {
+	Convey("Match documents as MongoDB does", t, func() {
+		for _, c := range conformanceCases {
+			f, err := Compile(c.filter)
+			So(err, ShouldBeNil)
+			for _, doc := range c.matches {
+				So(c.name+": "+matchString(f, doc, true), ShouldEqual, c.name+": "+bsonString(doc))
+			}
+			for _, doc := range c.misses {
+				So(c.name+": "+matchString(f, doc, false), ShouldEqual, c.name+": "+bsonString(doc))
+			}
+		}
+	})
+}
+
+// matchString describes a document, and whether it failed to match as
+// wanted, so that failures name the case and the document.
+func matchString(f *Filter, doc bson.D, want bool) string {
+	matched, err := f.Matches(doc)
+	if err != nil {
+		return bsonString(doc) + " (" + err.Error() + ")"
+	}
+	if matched == want {
+		return bsonString(doc)
+	}
+	if want {
+		return bsonString(doc) + " (did not match)"
+	}
+	return bsonString(doc) + " (matched)"
+}
+
+func bsonString(doc bson.D) string {
+	out, _ := bsonutil.MarshalExtJSON(doc, bsonutil.Relaxed)
+	return string(out)
+}
+
+func TestCompile(t *testing.T) {
+	Convey("Refuse bad filters", t, func() {
+		for _, filter := range []bson.D{
+			d("$foo", 1),
+			d("a", d("$foo", 1)),
+			d("a", d("$in", 1)),
+			d("a", d("$in", a(d("$gt", 1)))),
+			d("$or", a()),
+			d("$and", 1),
+			d("$or", a(1)),
+			d("a", d("$size", -1)),
+			d("a", d("$size", 1.5)),
+			d("a", d("$mod", a(0, 1))),
+			d("a", d("$mod", a(1))),
+			d("a", d("$regex", 1)),
+			d("a", d("$regex", "(?=x)")),
+			d("a", d("$regex", "x", "$options", "q")),
+			d("a", d("$options", "i")),
+			d("a", d("$type", "thing")),
+			d("a", d("$type", 99)),
+			d("a", d("$elemMatch", 1)),
+			d("a", d("$all", a(d("$gt", 1)))),
+			d("a", d("$not", 1)),
+			d("a", d("$not", d())),
+			d("$where", "true"),
+			d("$expr", d("$foo", 1)),
+			d("$expr", "$$nothing"),
+			d("a", d("$elemMatch", d("$expr", true))),
+			d("a..b", 1),
+		} {
+			_, err := Compile(filter)
+			So(err, ShouldNotBeNil)
+			So(err.(*Error).Code, ShouldBeGreaterThan, 0)
+		}
+	})
+
+	Convey("Fail matches whose expressions fail", t, func() {
+		for _, filter := range []bson.D{
+			d("$expr", d("$divide", a(1, "$a"))),
+			d("b", 1, "$expr", d("$divide", a(1, "$a"))),
+			d("$or", a(d("b", 2), d("$expr", d("$divide", a(1, "$a"))))),
+		} {
+			_, err := Match(filter, d("a", 0, "b", 1))
+			So(err, ShouldNotBeNil)
+			So(err.(*Error).Code, ShouldEqual, messages.BadValue)
+		}
+	})
+
+	Convey("Find the equalities of filters", t, func() {
+		So(Equalities(d(
+			"a", 1,
+			"b", d("$eq", 2),
+			"c", d("$gt", 3),
+			"$and", a(d("d.e", 4)),
+			"$or", a(d("f", 5)),
+			"g", bson.RegEx{Pattern: "x"},
+		)), ShouldResemble, d("a", 1, "b", 2, "d.e", 4))
+	})
+}
+
+func TestSortAndProject(t *testing.T) {
+	Convey("Sort documents by fields, arrays by their least or greatest element", t, func() {
+		s, err := CompileSort(d("a", 1, "b", -1))
+		So(err, ShouldBeNil)
+		So(s.Compare(d("a", a(5, 1)), d("a", 2)), ShouldBeLessThan, 0)
+		So(s.Compare(d(), d("a", nil, "b", 1)), ShouldBeGreaterThan, 0)
+		So(s.Compare(d("a", 1, "b", 2), d("a", 1, "b", 1)), ShouldBeLessThan, 0)
+
+		s, err = CompileSort(d("a", -1))
+		So(err, ShouldBeNil)
+		So(s.Compare(d("a", a(5, 1)), d("a", 4)), ShouldBeLessThan, 0)
+
+		_, err = CompileSort(d("a", 2))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Project fields, computed ones included", t, func() {
+		p, err := CompileProjection(d("a.b", 1, "sum", d("$add", a("$x", 1)), "_id", 0))
+		So(err, ShouldBeNil)
+		out, err := p.Apply(d("_id", 1, "a", a(d("b", 1, "c", 2), 3), "x", 4))
+		So(err, ShouldBeNil)
+		So(bsonString(out), ShouldEqual, bsonString(d("a", a(d("b", 1)), "sum", 5)))
+
+		_, err = CompileProjection(d("a", 1, "b", 0))
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,77 @@
+package query
+
+import (
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A Sort is a compiled sort specification.
+type Sort struct {
+	keys []sortKey
+}
+
+type sortKey struct {
+	parts      []string
+	descending bool
+}
+
+// CompileSort compiles a sort specification, such as { a: 1, b: -1 }.
+func CompileSort(spec bson.D) (*Sort, error) {
+	s := &Sort{}
+	for _, elem := range spec {
+		f, ok := toFloat(elem.Value)
+		if !ok || (f != 1 && f != -1) {
+			return nil, errorf(messages.BadValue, "$sort key ordering must be 1 (for ascending) or -1 (for descending)")
+		}
+		if len(elem.Name) == 0 || strings.Contains(elem.Name, "..") {
+			return nil, errorf(messages.BadValue, "Invalid sort key: “%s”", elem.Name)
+		}
+		s.keys = append(s.keys, sortKey{parts: strings.Split(elem.Name, "."), descending: f < 0})
+	}
+	return s, nil
+}
+
+// Compare orders two documents by the sort, returning -1, 0 or 1. Arrays
+// sort by their least element ascending, or greatest descending, and
+// missing fields as null.
+func (s *Sort) Compare(a, b bson.D) int {
+	for _, key := range s.keys {
+		c := bsonutil.Compare(key.value(a), key.value(b))
+		if key.descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// value returns the value a document sorts by for the key.
+func (key sortKey) value(doc bson.D) interface{} {
+	values := []interface{}{}
+	for _, v := range lookup(doc, key.parts) {
+		if v == Missing {
+			continue
+		}
+		if array := bsonutil.ToArray(v); array != nil {
+			values = append(values, array...)
+		} else {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	best := values[0]
+	for _, v := range values[1:] {
+		c := bsonutil.Compare(v, best)
+		if (key.descending && c > 0) || (!key.descending && c < 0) {
+			best = v
+		}
+	}
+	return best
+}
@@ -0,0 +1,184 @@
+package query
+
+import (
+	"math"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BSON type codes, as $type takes them.
+const (
+	typeDouble              = 1
+	typeString              = 2
+	typeObject              = 3
+	typeArray               = 4
+	typeBinary              = 5
+	typeUndefined           = 6
+	typeObjectID            = 7
+	typeBool                = 8
+	typeDate                = 9
+	typeNull                = 10
+	typeRegex               = 11
+	typeJavaScript          = 13
+	typeSymbol              = 14
+	typeJavaScriptWithScope = 15
+	typeInt                 = 16
+	typeTimestamp           = 17
+	typeLong                = 18
+	typeDecimal             = 19
+	typeMinKey              = -1
+	typeMaxKey              = 127
+)
+
+// typeNames are the aliases of the type codes.
+var typeNames = map[int]string{
+	typeDouble:              "double",
+	typeString:              "string",
+	typeObject:              "object",
+	typeArray:               "array",
+	typeBinary:              "binData",
+	typeUndefined:           "undefined",
+	typeObjectID:            "objectId",
+	typeBool:                "bool",
+	typeDate:                "date",
+	typeNull:                "null",
+	typeRegex:               "regex",
+	typeJavaScript:          "javascript",
+	typeSymbol:              "symbol",
+	typeJavaScriptWithScope: "javascriptWithScope",
+	typeInt:                 "int",
+	typeTimestamp:           "timestamp",
+	typeLong:                "long",
+	typeDecimal:             "decimal",
+	typeMinKey:              "minKey",
+	typeMaxKey:              "maxKey",
+}
+
+// typeCodes is the reverse of typeNames.
+var typeCodes = make(map[string]int)
+
+func init() {
+	for code, name := range typeNames {
+		typeCodes[name] = code
+	}
+}
+
+// TypeCode returns the BSON type code of a value, or 0 for Missing and
+// values BSON cannot hold.
+func TypeCode(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return typeNull
+	case float64, float32:
+		return typeDouble
+	case string:
+		return typeString
+	case bson.D, bson.M, map[string]interface{}, bson.RawD:
+		return typeObject
+	case []interface{}, []bson.D, []bson.M, []string:
+		return typeArray
+	case []byte, bson.Binary:
+		return typeBinary
+	case bson.ObjectId:
+		return typeObjectID
+	case bool:
+		return typeBool
+	case time.Time:
+		return typeDate
+	case bson.RegEx:
+		return typeRegex
+	case bson.JavaScript:
+		if v.Scope != nil {
+			return typeJavaScriptWithScope
+		}
+		return typeJavaScript
+	case bson.Symbol:
+		return typeSymbol
+	case int32:
+		return typeInt
+	case int:
+		// as mgo encodes them
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return typeInt
+		}
+		return typeLong
+	case bson.MongoTimestamp:
+		return typeTimestamp
+	case int64:
+		return typeLong
+	case bson.Decimal128:
+		return typeDecimal
+	}
+	switch v {
+	case bson.Undefined:
+		return typeUndefined
+	case bson.MinKey:
+		return typeMinKey
+	case bson.MaxKey:
+		return typeMaxKey
+	}
+	return 0
+}
+
+// TypeName returns the alias of a value's BSON type, as the $type
+// expression does, or "missing".
+func TypeName(v interface{}) string {
+	if name, ok := typeNames[TypeCode(v)]; ok {
+		return name
+	}
+	return "missing"
+}
+
+// typeCodeOf returns the type code a $type argument names, by number or
+// alias.
+func typeCodeOf(spec interface{}) (int, error) {
+	if name, ok := spec.(string); ok {
+		code, ok := typeCodes[name]
+		if !ok {
+			return 0, errorf(messages.BadValue, "Unknown type name alias: %s", name)
+		}
+		return code, nil
+	}
+	f, ok := toFloat(spec)
+	if !ok || f != math.Trunc(f) {
+		return 0, errorf(messages.TypeMismatch, "type must be represented as a number or a string")
+	}
+	if _, ok := typeNames[int(f)]; !ok {
+		return 0, errorf(messages.BadValue, "Invalid numerical type code: %v", spec)
+	}
+	return int(f), nil
+}
+
+// toFloat returns a number as a float64, and whether it is a number.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	}
+	return math.NaN(), false
+}
+
+// Truthy returns whether a value counts as true in expressions: all but
+// false, null, undefined, missing values, and numbers equal to 0 do.
+func Truthy(v interface{}) bool {
+	if isNull(v) {
+		return false
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
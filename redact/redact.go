@@ -0,0 +1,391 @@
+// Package redact masks sensitive values, such as credentials and customer
+// data, in documents and HTTP messages before they are logged.
+//
+// Some values are always masked: the payloads of saslStart and
+// saslContinue commands and their replies, the key of authenticate
+// commands, the passwords given to createUser and updateUser, and the
+// values of sensitive HTTP headers. Further field paths and headers can be
+// configured, as can a maximum length for logged values.
+package redact
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Mask replaces redacted values.
+const Mask = "<redacted>"
+
+// commandFields are the fields masked in the body of particular commands,
+// keyed by command name.
+var commandFields = map[string][]string{
+	"saslStart":       {"payload"},
+	"saslContinue":    {"payload"},
+	"authenticate":    {"key", "nonce"},
+	"createUser":      {"pwd"},
+	"updateUser":      {"pwd"},
+	"copydbsaslstart": {"payload"},
+}
+
+// defaultHeaders are the HTTP headers whose values are always masked.
+var defaultHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// Config holds the configurable parts of redaction.
+type Config struct {
+	// Fields are dotted paths of fields to mask, such as "documents.ssn".
+	// Array elements are traversed without an index, and "*" matches any
+	// single field name.
+	Fields []string
+
+	// Headers are the names of additional HTTP headers to mask.
+	Headers []string
+
+	// MaxValueLength is the number of bytes that strings and binary values
+	// are truncated to. If 0, values are not truncated.
+	MaxValueLength int
+}
+
+var mutex sync.RWMutex
+var fields [][]string
+var headers = canonicalHeaders(defaultHeaders)
+var maxValueLength int
+
+// Configure replaces the redaction settings. Headers added with AddHeaders
+// are forgotten.
+func Configure(conf Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	fields = nil
+	for _, path := range conf.Fields {
+		if len(path) > 0 {
+			fields = append(fields, strings.Split(path, "."))
+		}
+	}
+	headers = canonicalHeaders(append(append([]string{}, defaultHeaders...), conf.Headers...))
+	maxValueLength = conf.MaxValueLength
+}
+
+// ParseConfig reads redaction settings from a configuration object with
+// the optional fields "fields" (an array of paths), "headers" (an array of
+// header names) and "maxValueLength" (an integer).
+func ParseConfig(conf bson.M) (Config, error) {
+	c := Config{}
+	if conf == nil {
+		return c, nil
+	}
+
+	var err error
+	if raw, ok := conf["fields"]; ok {
+		c.Fields, err = convert.ConvertToStringSlice(raw)
+		if err != nil {
+			return c, fmt.Errorf("Invalid redaction fields: %v", err)
+		}
+	}
+	if raw, ok := conf["headers"]; ok {
+		c.Headers, err = convert.ConvertToStringSlice(raw)
+		if err != nil {
+			return c, fmt.Errorf("Invalid redaction headers: %v", err)
+		}
+	}
+	c.MaxValueLength = convert.ToInt(conf["maxValueLength"])
+	if c.MaxValueLength < 0 {
+		return c, fmt.Errorf("Invalid redaction maxValueLength: %v", conf["maxValueLength"])
+	}
+	return c, nil
+}
+
+// AddHeaders adds HTTP headers to mask, in addition to the configured
+// ones. Modules call it for headers that they know to be sensitive.
+func AddHeaders(names ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for name := range canonicalHeaders(names) {
+		headers[name] = true
+	}
+}
+
+// A Snapshot is the redaction settings at some moment, to Restore later.
+type Snapshot struct {
+	fields         [][]string
+	headers        map[string]bool
+	maxValueLength int
+}
+
+// Save returns the current redaction settings, including headers added
+// with AddHeaders.
+func Save() Snapshot {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	saved := Snapshot{fields: fields, headers: make(map[string]bool), maxValueLength: maxValueLength}
+	for name := range headers {
+		saved.headers[name] = true
+	}
+	return saved
+}
+
+// Restore puts back settings returned by Save, such as when a new
+// configuration turns out to be invalid.
+func Restore(saved Snapshot) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	fields = saved.fields
+	headers = make(map[string]bool)
+	for name := range saved.headers {
+		headers[name] = true
+	}
+	maxValueLength = saved.maxValueLength
+}
+
+func canonicalHeaders(names []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	return set
+}
+
+// Document returns a copy of a command or reply document with sensitive
+// values masked and long values truncated.
+func Document(doc bson.D) bson.D {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return redactDoc(doc, nil, commandMask(doc))
+}
+
+// Value returns a copy of any document, array or value with sensitive
+// values masked and long values truncated.
+func Value(v interface{}) interface{} {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if doc, ok := v.(bson.D); ok {
+		return redactDoc(doc, nil, commandMask(doc))
+	}
+	return redactValue(v, nil)
+}
+
+// Args returns a copy of the arguments of a command, given as a map, with
+// sensitive values masked and long values truncated.
+func Args(commandName string, args bson.M) bson.M {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	out := redactMap(args, nil)
+	for _, name := range commandFields[commandName] {
+		if _, ok := out[name]; ok {
+			out[name] = Mask
+		}
+	}
+	return out
+}
+
+// Section returns a copy of the documents of an OP_MSG document sequence
+// with the given identifier, with sensitive values masked and long values
+// truncated. Configured field paths start with the identifier, just as if
+// the documents were an array in the body.
+func Section(identifier string, docs []bson.D) []bson.D {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		out[i] = redactDoc(doc, []string{identifier}, nil)
+	}
+	return out
+}
+
+// String returns s truncated to the maximum value length.
+func String(s string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return truncate(s)
+}
+
+// commandMask returns the top-level fields to mask for the command (or,
+// for SASL replies, the reply) in doc.
+func commandMask(doc bson.D) map[string]bool {
+	if len(doc) == 0 {
+		return nil
+	}
+	mask := make(map[string]bool)
+	for _, name := range commandFields[doc[0].Name] {
+		mask[name] = true
+	}
+	// replies to SASL commands carry the conversation ID along with
+	// their payloads
+	for _, elem := range doc {
+		if elem.Name == "conversationId" {
+			mask["payload"] = true
+		}
+	}
+	return mask
+}
+
+func redactDoc(doc bson.D, path []string, mask map[string]bool) bson.D {
+	if doc == nil {
+		return nil
+	}
+	out := make(bson.D, len(doc))
+	for i, elem := range doc {
+		elemPath := append(path[:len(path):len(path)], elem.Name)
+		if mask[elem.Name] || matchesField(elemPath) {
+			out[i] = bson.DocElem{Name: elem.Name, Value: Mask}
+			continue
+		}
+		out[i] = bson.DocElem{Name: elem.Name, Value: redactValue(elem.Value, elemPath)}
+	}
+	return out
+}
+
+func redactValue(v interface{}, path []string) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		return redactDoc(val, path, nil)
+	case bson.M:
+		return redactMap(val, path)
+	case map[string]interface{}:
+		return redactMap(bson.M(val), path)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = redactValue(item, path)
+		}
+		return out
+	case []bson.D:
+		out := make([]bson.D, len(val))
+		for i, item := range val {
+			out[i] = redactDoc(item, path, nil)
+		}
+		return out
+	case []bson.M:
+		out := make([]bson.M, len(val))
+		for i, item := range val {
+			out[i] = redactMap(item, path)
+		}
+		return out
+	case string:
+		return truncate(val)
+	case []byte:
+		return truncateBinary(val)
+	case bson.Binary:
+		if maxValueLength > 0 && len(val.Data) > maxValueLength {
+			return fmt.Sprintf("<binary subtype %d, %d bytes>", val.Kind, len(val.Data))
+		}
+	}
+	return v
+}
+
+func redactMap(m bson.M, path []string) bson.M {
+	if m == nil {
+		return nil
+	}
+	out := bson.M{}
+	for key, value := range m {
+		keyPath := append(path[:len(path):len(path)], key)
+		if matchesField(keyPath) {
+			out[key] = Mask
+			continue
+		}
+		out[key] = redactValue(value, keyPath)
+	}
+	return out
+}
+
+// matchesField returns whether the path of a field matches a configured
+// field path.
+func matchesField(path []string) bool {
+	for _, field := range fields {
+		if len(field) != len(path) {
+			continue
+		}
+		matched := true
+		for i := range field {
+			if field[i] != "*" && field[i] != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(s string) string {
+	if maxValueLength <= 0 || len(s) <= maxValueLength {
+		return s
+	}
+	cut := maxValueLength
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s…(%d more bytes)", s[:cut], len(s)-cut)
+}
+
+func truncateBinary(b []byte) interface{} {
+	if maxValueLength <= 0 || len(b) <= maxValueLength {
+		return b
+	}
+	return fmt.Sprintf("<%d bytes>", len(b))
+}
+
+// Header returns a copy of HTTP headers with the values of sensitive
+// headers masked.
+func Header(h http.Header) http.Header {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		if headers[http.CanonicalHeaderKey(name)] {
+			out[name] = []string{Mask}
+			continue
+		}
+		out[name] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// Request returns a description of an HTTP request, for logging, with
+// sensitive headers masked. The body is not included.
+func Request(req *http.Request) string {
+	if req == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s %s %s", req.Method, req.URL, formatHeader(Header(req.Header)))
+}
+
+// Response returns a description of an HTTP response, for logging, with
+// sensitive headers masked. The body is not included.
+func Response(resp *http.Response) string {
+	if resp == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s %s", resp.Status, formatHeader(Header(resp.Header)))
+}
+
+func formatHeader(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + ": " + strings.Join(h[name], ", ")
+	}
+	return "{" + strings.Join(parts, "; ") + "}"
+}
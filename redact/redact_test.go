@@ -0,0 +1,154 @@
+package redact
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDocument(t *testing.T) {
+	Convey("Redact a command document", t, func() {
+		defer Configure(Config{})
+
+		Convey("masking SASL payloads", func() {
+			doc := bson.D{
+				{Name: "saslStart", Value: 1},
+				{Name: "mechanism", Value: "SCRAM-SHA-256"},
+				{Name: "payload", Value: []byte("n,,n=user,r=nonce")},
+			}
+			out := Document(doc)
+			So(out[1].Value, ShouldEqual, "SCRAM-SHA-256")
+			So(out[2].Value, ShouldEqual, Mask)
+			So(doc[2].Value, ShouldResemble, []byte("n,,n=user,r=nonce"))
+		})
+
+		Convey("masking SASL reply payloads", func() {
+			out := Document(bson.D{
+				{Name: "conversationId", Value: 1},
+				{Name: "done", Value: false},
+				{Name: "payload", Value: []byte("r=nonce,s=salt")},
+				{Name: "ok", Value: 1},
+			})
+			So(out[2].Value, ShouldEqual, Mask)
+		})
+
+		Convey("masking user passwords", func() {
+			out := Document(bson.D{
+				{Name: "createUser", Value: "app"},
+				{Name: "pwd", Value: "hunter2"},
+				{Name: "roles", Value: []interface{}{"readWrite"}},
+			})
+			So(out[1].Value, ShouldEqual, Mask)
+			So(out[2].Value, ShouldResemble, []interface{}{"readWrite"})
+		})
+
+		Convey("masking configured field paths", func() {
+			Configure(Config{Fields: []string{"filter.ssn", "filter.*.card"}})
+			out := Document(bson.D{
+				{Name: "find", Value: "people"},
+				{Name: "filter", Value: bson.D{
+					{Name: "ssn", Value: "123-45-6789"},
+					{Name: "name", Value: "Ann"},
+					{Name: "billing", Value: bson.M{"card": "4111"}},
+				}},
+			})
+			filter := out[1].Value.(bson.D)
+			So(filter[0].Value, ShouldEqual, Mask)
+			So(filter[1].Value, ShouldEqual, "Ann")
+			So(filter[2].Value, ShouldResemble, bson.M{"card": Mask})
+		})
+
+		Convey("truncating long values", func() {
+			Configure(Config{MaxValueLength: 4})
+			out := Document(bson.D{
+				{Name: "insert", Value: "notes"},
+				{Name: "blob", Value: []byte("0123456789")},
+			})
+			So(out[0].Value, ShouldEqual, "note…(1 more bytes)")
+			So(out[1].Value, ShouldEqual, "<10 bytes>")
+		})
+	})
+}
+
+func TestSection(t *testing.T) {
+	Convey("Redact a document sequence by its identifier", t, func() {
+		Configure(Config{Fields: []string{"documents.ssn"}})
+		defer Configure(Config{})
+
+		out := Section("documents", []bson.D{
+			{{Name: "ssn", Value: "123-45-6789"}, {Name: "name", Value: "Ann"}},
+		})
+		So(out[0][0].Value, ShouldEqual, Mask)
+		So(out[0][1].Value, ShouldEqual, "Ann")
+	})
+}
+
+func TestHeader(t *testing.T) {
+	Convey("Redact HTTP headers", t, func() {
+		defer Configure(Config{})
+
+		req, _ := http.NewRequest("POST", "http://localhost/api", nil)
+		req.Header.Set("Authorization", "Bearer abc")
+		req.Header.Set("X-Customer-Token", "xyz")
+		req.Header.Set("Content-Type", "application/bson")
+
+		Convey("masking default headers", func() {
+			out := Header(req.Header)
+			So(out.Get("Authorization"), ShouldEqual, Mask)
+			So(out.Get("X-Customer-Token"), ShouldEqual, "xyz")
+			So(req.Header.Get("Authorization"), ShouldEqual, "Bearer abc")
+		})
+
+		Convey("masking added headers", func() {
+			AddHeaders("x-customer-token")
+			description := Request(req)
+			So(strings.Contains(description, "abc"), ShouldBeFalse)
+			So(strings.Contains(description, "xyz"), ShouldBeFalse)
+			So(description, ShouldContainSubstring, "Content-Type: application/bson")
+		})
+	})
+}
+
+func TestParseConfig(t *testing.T) {
+	Convey("Parse a redaction configuration", t, func() {
+		conf, err := ParseConfig(bson.M{
+			"fields":         []interface{}{"filter.ssn"},
+			"headers":        []interface{}{"X-Key"},
+			"maxValueLength": 64,
+		})
+		So(err, ShouldBeNil)
+		So(conf.Fields, ShouldResemble, []string{"filter.ssn"})
+		So(conf.Headers, ShouldResemble, []string{"X-Key"})
+		So(conf.MaxValueLength, ShouldEqual, 64)
+
+		_, err = ParseConfig(bson.M{"maxValueLength": -1})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRestore(t *testing.T) {
+	Convey("Restore saved settings", t, func() {
+		defer Configure(Config{})
+
+		Configure(Config{Fields: []string{"filter.ssn"}})
+		AddHeaders("X-Customer-Token")
+		saved := Save()
+
+		Configure(Config{MaxValueLength: 4})
+		Restore(saved)
+
+		out := Document(bson.D{
+			{Name: "find", Value: "people"},
+			{Name: "filter", Value: bson.D{{Name: "ssn", Value: "123-45-6789"}}},
+		})
+		So(out[0].Value, ShouldEqual, "people")
+		So(out[1].Value.(bson.D)[0].Value, ShouldEqual, Mask)
+
+		header := http.Header{}
+		header.Set("X-Customer-Token", "xyz")
+		So(Header(header).Get("X-Customer-Token"), ShouldEqual, Mask)
+	})
+}
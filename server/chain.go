@@ -1,7 +1,11 @@
 package server
 
 import (
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/log"
 	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // PipelineFunc is the function type for the built pipeline, and is called
@@ -15,18 +19,64 @@ type ChainFunc func(PipelineFunc) PipelineFunc
 // A ModuleChain consists of a chain of wrapped modules that can be built
 // into a single pipeline function.
 type ModuleChain struct {
-	chain []Module
+	chain []*chainEntry
+}
+
+// a chainEntry is a module in a chain, along with the alias it was added
+// under, the configuration it was given, and its statistics.
+type chainEntry struct {
+	alias  string
+	module Module
+	config bson.M
+	stats  *ModuleStats
 }
 
 // AddModule adds the module mod to the end of a given module chain.
 func (m *ModuleChain) AddModule(mod Module) *ModuleChain {
-	m.chain = append(m.chain, mod)
+	return m.AddModuleAs(mod.Name(), mod, nil)
+}
+
+// AddModuleAs adds the module mod, configured with config, to the end of a
+// given module chain under the given alias. Aliases tell apart several
+// instances of the same module in one chain.
+func (m *ModuleChain) AddModuleAs(alias string, mod Module, config bson.M) *ModuleChain {
+	m.chain = append(m.chain, &chainEntry{
+		alias:  alias,
+		module: mod,
+		config: config,
+		stats:  &ModuleStats{},
+	})
 	return m
 }
 
-// wrapModule returns a closure ChainFunc that wraps over the module m, which
-// can input and output PipelineFuncs to help with chaining.
-func wrapModule(m Module) ChainFunc {
+// ModuleInfo describes a module in a chain.
+type ModuleInfo struct {
+	Name   string      `json:"name"`
+	Alias  string      `json:"alias"`
+	Config bson.M      `json:"config"`
+	Stats  StatsReport `json:"stats"`
+}
+
+// Modules returns descriptions of the modules in the chain, in pipeline
+// order. Configurations are sanitized with SanitizeConfig.
+func (m *ModuleChain) Modules() []ModuleInfo {
+	info := make([]ModuleInfo, len(m.chain))
+	for i, entry := range m.chain {
+		info[i] = ModuleInfo{
+			Name:   entry.module.Name(),
+			Alias:  entry.alias,
+			Config: SanitizeConfig(entry.config),
+			Stats:  entry.stats.Report(),
+		}
+	}
+	return info
+}
+
+// wrapModule returns a closure ChainFunc that wraps over the module in entry,
+// which can input and output PipelineFuncs to help with chaining. The time
+// the module spends in its own Process, excluding time spent in downstream
+// modules, is recorded in the entry's statistics and the request's Trace.
+func wrapModule(entry *chainEntry) ChainFunc {
 
 	return ChainFunc(func(next PipelineFunc) PipelineFunc {
 		return PipelineFunc(func(r messages.Requester, w messages.Responder) {
@@ -37,7 +87,37 @@ func wrapModule(m Module) ChainFunc {
 					return
 				})
 			}
-			m.Process(r, w, next)
+
+			tracked, t := track(w)
+			var downstream time.Duration
+			timedNext := PipelineFunc(func(r messages.Requester, w messages.Responder) {
+				// errors from downstream modules are not this module's errors
+				if w == tracked {
+					w = t.Responder
+				}
+				start := time.Now()
+				next(r, w)
+				downstream += time.Since(start)
+			})
+
+			start := time.Now()
+			entry.module.Process(r, tracked, timedNext)
+			elapsed := time.Since(start) - downstream
+			entry.stats.record(elapsed, t.failed)
+
+			name := entry.module.Name()
+			messages.TraceOf(r).AddModule(name, entry.alias, elapsed)
+			moduleSeconds.With(name, entry.alias).ObserveDuration(elapsed)
+			if t.failed {
+				moduleErrors.With(name, entry.alias).Inc()
+			}
+
+			if log.Enabled(log.DEBUG) {
+				fields := messages.LogFields(r)
+				fields.Module = entry.alias
+				fields.Duration = elapsed
+				log.LogWith(log.DEBUG, fields, "Module finished (failed: %v)", t.failed)
+			}
 		})
 	})
 }
@@ -67,3 +147,17 @@ func BuildPipeline(m *ModuleChain) PipelineFunc {
 
 	return pipeline
 }
+
+// Close closes the modules of a chain that are Closers, once no request
+// is in its pipeline any longer, returning the first error.
+func (m *ModuleChain) Close() error {
+	var first error
+	for _, entry := range m.chain {
+		if closer, ok := entry.module.(Closer); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -133,3 +133,150 @@ func TestModuleChaining(t *testing.T) {
 
 	})
 }
+
+// ModuleError writes an error response and stops the pipeline.
+type ModuleError struct {
+}
+
+func (m ModuleError) New() Module {
+	return m
+}
+
+func (m ModuleError) Name() string {
+	return "error"
+}
+
+func (m ModuleError) Configure(bson.M) error {
+	return nil
+}
+
+func (m ModuleError) Process(req messages.Requester, res messages.Responder, next PipelineFunc) {
+	res.Error(1, "failed")
+}
+
+func TestModuleStats(t *testing.T) {
+	Convey("Record module statistics", t, func() {
+		chain := CreateChain()
+		chain.AddModuleAs("first", ModuleTwo{}, bson.M{"password": "hunter2"})
+		chain.AddModule(ModuleError{})
+		pipeline := BuildPipeline(chain)
+
+		for i := 0; i < 3; i++ {
+			pipeline(MockReq{}, &MockRes{})
+		}
+
+		modules := chain.Modules()
+		So(len(modules), ShouldEqual, 2)
+
+		Convey("under the module's alias", func() {
+			So(modules[0].Name, ShouldEqual, "two")
+			So(modules[0].Alias, ShouldEqual, "first")
+			So(modules[1].Alias, ShouldEqual, "error")
+		})
+
+		Convey("with sanitized configurations", func() {
+			So(modules[0].Config["password"], ShouldEqual, RedactedValue)
+		})
+
+		Convey("counting errors against the module that reported them", func() {
+			So(modules[0].Stats.Requests, ShouldEqual, 3)
+			So(modules[0].Stats.Errors, ShouldEqual, 0)
+			So(modules[1].Stats.Requests, ShouldEqual, 3)
+			So(modules[1].Stats.Errors, ShouldEqual, 3)
+		})
+
+		Convey("in the request's trace", func() {
+			trace := messages.NewTrace()
+			pipeline(messages.Command{Trace: trace}, &MockRes{})
+
+			// modules finish in reverse order
+			timings := trace.Modules()
+			So(len(timings), ShouldEqual, 2)
+			So(timings[0].Alias, ShouldEqual, "error")
+			So(timings[1].Module, ShouldEqual, "two")
+			So(timings[1].Alias, ShouldEqual, "first")
+		})
+	})
+}
+
+// A ModuleClosing counts the times it is closed, failing after the first.
+type ModuleClosing struct {
+	ModuleOne
+	closed *int
+}
+
+func (m ModuleClosing) Close() error {
+	*m.closed++
+	if *m.closed > 1 {
+		return fmt.Errorf("closed twice")
+	}
+	return nil
+}
+
+func TestModuleClosing(t *testing.T) {
+	Convey("Close the modules of a chain that are Closers", t, func() {
+		closed := 0
+		chain := CreateChain()
+		chain.AddModule(ModuleOne{})
+		chain.AddModule(ModuleClosing{closed: &closed})
+		So(chain.Close(), ShouldBeNil)
+		So(closed, ShouldEqual, 1)
+		So(chain.Close(), ShouldNotBeNil)
+	})
+}
+
+// ModuleStreaming streams its reply when it can, and writes it otherwise.
+type ModuleStreaming struct {
+}
+
+func (m ModuleStreaming) New() Module {
+	return m
+}
+
+func (m ModuleStreaming) Name() string {
+	return "streaming"
+}
+
+func (m ModuleStreaming) Configure(bson.M) error {
+	return nil
+}
+
+func (m ModuleStreaming) Process(req messages.Requester, res messages.Responder, next PipelineFunc) {
+	r := messages.CommandResponse{Reply: msgOne}
+	if streamer, ok := res.(messages.StreamResponder); ok {
+		streamer.WriteStream(r, emptyStream{})
+		return
+	}
+	res.Write(r)
+}
+
+type emptyStream struct {
+}
+
+func (emptyStream) Next() (messages.ResponseWriter, error) {
+	return nil, fmt.Errorf("no more replies")
+}
+
+func (emptyStream) Close() {
+}
+
+func TestModuleStreaming(t *testing.T) {
+	Convey("Let modules stream through the chain", t, func() {
+		chain := CreateChain()
+		chain.AddModule(ModuleTwo{})
+		chain.AddModule(ModuleStreaming{})
+		pipeline := BuildPipeline(chain)
+
+		Convey("to responders that stream", func() {
+			res := &messages.ModuleResponse{}
+			pipeline(MockReq{}, res)
+			So(res.Stream, ShouldNotBeNil)
+		})
+
+		Convey("but not to those that do not", func() {
+			res := &MockRes{}
+			pipeline(MockReq{}, res)
+			So(res.Data[0], ShouldEqual, msgOne)
+		})
+	})
+}
@@ -1,5 +1,10 @@
 package config
 
 //import _ "github.com/mongodbinc-interns/mongoproxy/modules/bi"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/clustertime"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/cursors"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/handshake"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/memory"
 import _ "github.com/mongodbinc-interns/mongoproxy/modules/mockule"
 //import _ "github.com/mongodbinc-interns/mongoproxy/modules/mongod"
+import _ "github.com/mongodbinc-interns/mongoproxy/modules/passthrough"
@@ -0,0 +1,16 @@
+package server
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+)
+
+var moduleSeconds = metrics.NewHistogramVec("mongoproxy_module_process_seconds",
+	"Time modules spend in Process, excluding downstream modules.",
+	nil, "module", "alias")
+
+var moduleErrors = metrics.NewCounterVec("mongoproxy_module_errors_total",
+	"Requests for which a module reported an error.", "module", "alias")
+
+func init() {
+	metrics.MustRegister(moduleSeconds, moduleErrors)
+}
@@ -25,3 +25,9 @@ type Module interface {
 	// New creates a new instance of this module.
 	New() Module
 }
+
+// A Closer is a module that holds something, such as an open file, that
+// must be given back once its pipeline is no longer used.
+type Closer interface {
+	Close() error
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RedactedValue replaces sensitive values in sanitized configurations.
+const RedactedValue = "<redacted>"
+
+// sensitiveKeyParts are substrings of configuration keys whose values
+// should never leave the proxy.
+var sensitiveKeyParts = []string{
+	"password",
+	"secret",
+	"token",
+	"credential",
+	"authorization",
+	"apikey",
+	"privatekey",
+}
+
+// headerKeys name configuration fields that hold HTTP headers, whose values
+// are redacted wholesale since they usually carry credentials.
+var headerKeys = []string{
+	"headers",
+}
+
+func isSensitiveKey(key string) bool {
+	lower := strings.ToLower(key)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(lower, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHeaderKey(key string) bool {
+	for _, headerKey := range headerKeys {
+		if strings.EqualFold(key, headerKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// SanitizeConfig returns a deep copy of a module configuration with the
+// values of sensitive fields, such as passwords, tokens and HTTP header
+// values, replaced with RedactedValue. The original is not modified.
+func SanitizeConfig(config bson.M) bson.M {
+	if config == nil {
+		return nil
+	}
+	return sanitizeValue("", config).(bson.M)
+}
+
+func sanitizeValue(key string, value interface{}) interface{} {
+	if len(key) > 0 && isSensitiveKey(key) {
+		return RedactedValue
+	}
+
+	switch v := value.(type) {
+	case bson.M:
+		out := bson.M{}
+		for k, val := range v {
+			out[k] = sanitizeValue(k, val)
+		}
+		if isHeaderKey(key) {
+			for k := range out {
+				out[k] = RedactedValue
+			}
+		}
+		return out
+	case map[string]interface{}:
+		return sanitizeValue(key, bson.M(v))
+	case bson.D:
+		out := make(bson.D, len(v))
+		for i, elem := range v {
+			out[i] = bson.DocElem{Name: elem.Name, Value: sanitizeValue(elem.Name, elem.Value)}
+		}
+		if isHeaderKey(key) {
+			for i := range out {
+				out[i].Value = RedactedValue
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = sanitizeValue("", val)
+			if isHeaderKey(key) {
+				out[i] = sanitizeHeader(out[i])
+			}
+		}
+		return out
+	}
+	return value
+}
+
+// sanitizeHeader redacts the value of a header given as a [name, value]
+// pair, keeping the name.
+func sanitizeHeader(header interface{}) interface{} {
+	pair, ok := header.([]interface{})
+	if !ok || len(pair) != 2 {
+		return RedactedValue
+	}
+	return []interface{}{pair[0], RedactedValue}
+}
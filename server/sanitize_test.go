@@ -0,0 +1,46 @@
+package server
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestSanitizeConfig(t *testing.T) {
+	Convey("Sanitize a module configuration", t, func() {
+		config := bson.M{
+			"urlBase": "http://localhost",
+			"auth": bson.M{
+				"username": "proxy",
+				"password": "hunter2",
+			},
+			"headers": []interface{}{
+				[]interface{}{"Authorization", "Bearer abc"},
+				[]interface{}{"X-Custom", "value"},
+			},
+			"clientSecret": "shh",
+		}
+
+		sanitized := SanitizeConfig(config)
+
+		Convey("keeping harmless values", func() {
+			So(sanitized["urlBase"], ShouldEqual, "http://localhost")
+			So(sanitized["auth"].(bson.M)["username"], ShouldEqual, "proxy")
+		})
+
+		Convey("redacting sensitive values", func() {
+			So(sanitized["auth"].(bson.M)["password"], ShouldEqual, RedactedValue)
+			So(sanitized["clientSecret"], ShouldEqual, RedactedValue)
+		})
+
+		Convey("redacting header values but not names", func() {
+			headers := sanitized["headers"].([]interface{})
+			So(headers[0], ShouldResemble, []interface{}{"Authorization", RedactedValue})
+			So(headers[1], ShouldResemble, []interface{}{"X-Custom", RedactedValue})
+		})
+
+		Convey("without modifying the original", func() {
+			So(config["auth"].(bson.M)["password"], ShouldEqual, "hunter2")
+		})
+	})
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+)
+
+// ModuleStats records how many requests a module in a chain has processed,
+// how many of them failed, and how long the module took for them.
+type ModuleStats struct {
+	mutex    sync.Mutex
+	requests int64
+	errors   int64
+	total    time.Duration
+	max      time.Duration
+}
+
+// A StatsReport is a snapshot of a module's statistics.
+type StatsReport struct {
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"`
+	TotalMillis   float64 `json:"totalMillis"`
+	AverageMillis float64 `json:"averageMillis"`
+	MaxMillis     float64 `json:"maxMillis"`
+}
+
+func (s *ModuleStats) record(elapsed time.Duration, failed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+	if failed {
+		s.errors++
+	}
+	s.total += elapsed
+	if elapsed > s.max {
+		s.max = elapsed
+	}
+}
+
+// Report returns a snapshot of the statistics.
+func (s *ModuleStats) Report() StatsReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := StatsReport{
+		Requests:    s.requests,
+		Errors:      s.errors,
+		TotalMillis: toMillis(s.total),
+		MaxMillis:   toMillis(s.max),
+	}
+	if s.requests > 0 {
+		r.AverageMillis = r.TotalMillis / float64(s.requests)
+	}
+	return r
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// a trackingResponder wraps the Responder handed to a module, and notes
+// whether the module reported an error, either through Error or by writing
+// a reply with a falsy "ok" field.
+type trackingResponder struct {
+	messages.Responder
+	failed bool
+}
+
+func (t *trackingResponder) Write(w messages.ResponseWriter) {
+	if w != nil && replyFailed(w) {
+		t.failed = true
+	}
+	t.Responder.Write(w)
+}
+
+func (t *trackingResponder) Error(code int32, message string) {
+	t.failed = true
+	t.Responder.Error(code, message)
+}
+
+// a trackingStreamResponder is a trackingResponder around a Responder that
+// can stream, so that modules may stream through it.
+type trackingStreamResponder struct {
+	*trackingResponder
+}
+
+func (t trackingStreamResponder) WriteStream(first messages.ResponseWriter, rest messages.ReplyStream) {
+	if first != nil && replyFailed(first) {
+		t.failed = true
+	}
+	t.Responder.(messages.StreamResponder).WriteStream(first, rest)
+}
+
+// track wraps a Responder in a trackingResponder, returning the Responder
+// to hand the module, which streams if w does.
+func track(w messages.Responder) (messages.Responder, *trackingResponder) {
+	t := &trackingResponder{Responder: w}
+	if _, ok := w.(messages.StreamResponder); ok {
+		return trackingStreamResponder{t}, t
+	}
+	return t, t
+}
+
+func replyFailed(w messages.ResponseWriter) bool {
+	reply := w.ToBSON()
+	ok, exists := reply["ok"]
+	if !exists {
+		return false
+	}
+	if b, isBool := ok.(bool); isBool {
+		return !b
+	}
+	return convert.ToFloat64(ok, 1) == 0
+}
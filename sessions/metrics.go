@@ -0,0 +1,18 @@
+package sessions
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+)
+
+var activeSessions = metrics.NewGauge("mongoproxy_sessions_active",
+	"Logical sessions in use.")
+
+var openTransactions = metrics.NewGauge("mongoproxy_transactions_open",
+	"Multi-statement transactions open.")
+
+var expiredSessions = metrics.NewCounter("mongoproxy_sessions_expired_total",
+	"Logical sessions that expired for going unused too long.")
+
+func init() {
+	metrics.MustRegister(activeSessions, openTransactions, expiredSessions)
+}
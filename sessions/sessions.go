@@ -0,0 +1,438 @@
+// Package sessions follows the logical sessions that drivers run
+// requests in, and the multi-statement transactions in them, so that
+// modules can send all of a transaction to the same backend, over the
+// same connection, whichever client connection its statements arrive on.
+package sessions
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var logger = GetLogger("sessions")
+
+// DefaultTimeout is how long sessions may go unused before they expire,
+// as with MongoDB's default logicalSessionTimeoutMinutes.
+const DefaultTimeout = 30 * time.Minute
+
+// DefaultTransactionLifetime is how long transactions may stay open
+// before they are abandoned, as with MongoDB's default
+// transactionLifetimeLimitSeconds.
+const DefaultTransactionLifetime = 60 * time.Second
+
+// A Session is a logical session, as drivers start them.
+type Session struct {
+	ID string
+
+	// User is the user the session belongs to, or empty for clients that
+	// have not authenticated. As with MongoDB, sessions with the same ID
+	// but different users are different sessions, so that no user can run
+	// statements in another's transaction.
+	User string
+
+	Started time.Time
+
+	// the rest is guarded by the registry's mutex
+	registry      *Registry
+	lastUsed      time.Time
+	txnNumber     int64
+	txnStarted    time.Time
+	inTransaction bool
+	pins          map[string]pin
+	ended         bool
+}
+
+// a pin is a value pinned to a transaction, such as the connection its
+// statements go over, and the function that lets go of it.
+type pin struct {
+	value   interface{}
+	release func(interface{})
+}
+
+// InTransaction returns whether the session has a transaction open, and
+// its number.
+func (s *Session) InTransaction() (bool, int64) {
+	s.registry.mutex.Lock()
+	defer s.registry.mutex.Unlock()
+	return s.inTransaction, s.txnNumber
+}
+
+// Pin pins a value to the session's open transaction under key, until the
+// transaction ends, or the session does, when release is called with it.
+// It returns false, and keeps nothing, if no transaction is open.
+func (s *Session) Pin(key string, value interface{}, release func(interface{})) bool {
+	s.registry.mutex.Lock()
+	if !s.inTransaction || s.ended {
+		s.registry.mutex.Unlock()
+		return false
+	}
+	old, replaced := s.pins[key]
+	s.pins[key] = pin{value: value, release: release}
+	s.registry.mutex.Unlock()
+
+	if replaced && old.value != value {
+		old.release(old.value)
+	}
+	return true
+}
+
+// Take removes and returns the value pinned to key, or nil if there is
+// none. The caller pins it again, or lets go of it.
+func (s *Session) Take(key string) interface{} {
+	s.registry.mutex.Lock()
+	defer s.registry.mutex.Unlock()
+	p, ok := s.pins[key]
+	if !ok {
+		return nil
+	}
+	delete(s.pins, key)
+	return p.value
+}
+
+// Pinned returns the value pinned to key, or nil if there is none.
+func (s *Session) Pinned(key string) interface{} {
+	s.registry.mutex.Lock()
+	defer s.registry.mutex.Unlock()
+	return s.pins[key].value
+}
+
+// endTransaction marks the open transaction as over, and returns its pins
+// to be released once the registry's mutex is unlocked.
+func (s *Session) endTransaction() []pin {
+	if s.inTransaction {
+		s.registry.transactions--
+		openTransactions.Dec()
+	}
+	s.inTransaction = false
+	pins := make([]pin, 0, len(s.pins))
+	for key, p := range s.pins {
+		pins = append(pins, p)
+		delete(s.pins, key)
+	}
+	return pins
+}
+
+func release(pins []pin) {
+	for _, p := range pins {
+		p.release(p.value)
+	}
+}
+
+// Stats are counts of a registry's sessions.
+type Stats struct {
+	Active       int   `json:"active"`
+	Transactions int   `json:"transactions"`
+	Started      int64 `json:"started"`
+	Ended        int64 `json:"ended"`
+	Expired      int64 `json:"expired"`
+	Abandoned    int64 `json:"abandonedTransactions"`
+}
+
+// a key identifies a session in a registry.
+type key struct {
+	id   string
+	user string
+}
+
+func (s *Session) key() key {
+	return key{id: s.ID, user: s.User}
+}
+
+// userOf returns the user of the client a request arrived on, or empty if
+// it has not authenticated.
+func userOf(req messages.Requester) string {
+	if client := messages.ClientOf(req); client != nil && client.User() != nil {
+		return client.User().String()
+	}
+	return ""
+}
+
+// A Registry holds the sessions in use, by ID and user.
+type Registry struct {
+	mutex               sync.Mutex
+	sessions            map[key]*Session
+	timeout             time.Duration
+	transactionLifetime time.Duration
+	transactions        int
+	stats               Stats
+	done                chan struct{}
+}
+
+// Default is the registry that proxy core records requests in, for
+// modules to look sessions up in.
+var Default = NewRegistry(time.Second)
+
+// NewRegistry creates a registry that looks for expired sessions and
+// abandoned transactions every reapInterval.
+func NewRegistry(reapInterval time.Duration) *Registry {
+	r := &Registry{
+		sessions:            make(map[key]*Session),
+		timeout:             DefaultTimeout,
+		transactionLifetime: DefaultTransactionLifetime,
+		done:                make(chan struct{}),
+	}
+	go r.reapLoop(reapInterval)
+	return r
+}
+
+// SetTimeout sets how long sessions may go unused before they expire.
+func (r *Registry) SetTimeout(timeout time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.timeout = timeout
+}
+
+// SetTransactionLifetime sets how long transactions may stay open before
+// they are abandoned. Zero means forever.
+func (r *Registry) SetTransactionLifetime(lifetime time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.transactionLifetime = lifetime
+}
+
+// Timeout returns how long sessions may go unused before they expire.
+func (r *Registry) Timeout() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.timeout
+}
+
+// TransactionLifetime returns how long transactions may stay open before
+// they are abandoned.
+func (r *Registry) TransactionLifetime() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.transactionLifetime
+}
+
+// Config holds the settings of a registry.
+type Config struct {
+	Timeout             time.Duration
+	TransactionLifetime time.Duration
+}
+
+// Configure replaces a registry's settings.
+func (r *Registry) Configure(conf Config) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.timeout = conf.Timeout
+	r.transactionLifetime = conf.TransactionLifetime
+}
+
+// ParseConfig reads session settings from a configuration object with the
+// optional fields "logicalSessionTimeoutMinutes" (a positive integer) and
+// "transactionLifetimeLimitSeconds" (a non-negative number, where zero
+// means forever). Missing fields take their defaults.
+func ParseConfig(conf bson.M) (Config, error) {
+	c := Config{Timeout: DefaultTimeout, TransactionLifetime: DefaultTransactionLifetime}
+	if conf == nil {
+		return c, nil
+	}
+
+	if raw, ok := conf["logicalSessionTimeoutMinutes"]; ok {
+		minutes := convert.ToInt(raw, 0)
+		if minutes < 1 {
+			return c, fmt.Errorf("Invalid sessions logicalSessionTimeoutMinutes: %v", raw)
+		}
+		c.Timeout = time.Duration(minutes) * time.Minute
+	}
+	if raw, ok := conf["transactionLifetimeLimitSeconds"]; ok {
+		secs := convert.ToFloat64(raw, -1)
+		if secs < 0 {
+			return c, fmt.Errorf("Invalid sessions transactionLifetimeLimitSeconds: %v", raw)
+		}
+		c.TransactionLifetime = time.Duration(secs * float64(time.Second))
+	}
+	return c, nil
+}
+
+// Lookup returns the session with an ID and user, or nil if it is not in
+// use.
+func (r *Registry) Lookup(id string, user string) *Session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.sessions[key{id: id, user: user}]
+}
+
+// SessionOf returns the session a request runs in, for its lsid and the
+// user of its client, or nil if it runs in none, or in one not in use.
+func (r *Registry) SessionOf(req messages.Requester) *Session {
+	info, ok := messages.SessionOf(req)
+	if !ok {
+		return nil
+	}
+	return r.Lookup(info.ID, userOf(req))
+}
+
+// Begin records a request before the pipeline runs it, and returns the
+// session it runs in, or nil. The first statement of a transaction starts
+// it, ending the session's previous one.
+func (r *Registry) Begin(req messages.Requester) *Session {
+	info, ok := messages.SessionOf(req)
+	if !ok {
+		return nil
+	}
+
+	var pins []pin
+	defer func() { release(pins) }()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	k := key{id: info.ID, user: userOf(req)}
+	s, ok := r.sessions[k]
+	if !ok {
+		s = &Session{
+			ID:       info.ID,
+			User:     k.user,
+			Started:  now,
+			registry: r,
+			pins:     make(map[string]pin),
+		}
+		r.sessions[k] = s
+		r.stats.Started++
+		activeSessions.Inc()
+	}
+	s.lastUsed = now
+
+	if info.InTransaction && (info.StartTransaction || info.TxnNumber > s.txnNumber) {
+		pins = s.endTransaction()
+		s.txnNumber = info.TxnNumber
+		s.txnStarted = now
+		s.inTransaction = true
+		r.transactions++
+		openTransactions.Inc()
+	} else if !info.InTransaction && info.TxnNumber > s.txnNumber {
+		// a retryable write moves the session past any transaction
+		pins = s.endTransaction()
+		s.txnNumber = info.TxnNumber
+	}
+	return s
+}
+
+// Finish records the response the pipeline gave a request: a transaction
+// ends when it has been committed or aborted, and sessions end with
+// endSessions.
+func (r *Registry) Finish(req messages.Requester, res messages.ModuleResponse) {
+	msg, ok := req.(*messages.Message)
+	if !ok {
+		return
+	}
+
+	switch msg.CommandName() {
+	case "commitTransaction", "abortTransaction":
+		info, ok := messages.BodySession(msg.Body)
+		if !ok || res.CommandError != nil || res.Writer == nil ||
+			convert.ToFloat64(res.Writer.ToBSON()["ok"]) != 1 {
+			return
+		}
+		r.mutex.Lock()
+		var pins []pin
+		if s, ok := r.sessions[key{id: info.ID, user: userOf(req)}]; ok && s.txnNumber == info.TxnNumber {
+			pins = s.endTransaction()
+		}
+		r.mutex.Unlock()
+		release(pins)
+
+	case "endSessions":
+		ended, _ := bsonutil.FindValueByKey("endSessions", msg.Body).([]interface{})
+		for _, lsid := range ended {
+			r.End(messages.SessionID(convert.ToBSONMap(lsid)["id"]), userOf(req))
+		}
+	}
+}
+
+// End ends the session with an ID and user, letting go of what its
+// transaction had pinned.
+func (r *Registry) End(id string, user string) {
+	r.mutex.Lock()
+	s, ok := r.sessions[key{id: id, user: user}]
+	if !ok {
+		r.mutex.Unlock()
+		return
+	}
+	pins := r.remove(s)
+	r.stats.Ended++
+	r.mutex.Unlock()
+	release(pins)
+}
+
+func (r *Registry) remove(s *Session) []pin {
+	pins := s.endTransaction()
+	s.ended = true
+	delete(r.sessions, s.key())
+	activeSessions.Dec()
+	return pins
+}
+
+// Stats returns counts of the registry's sessions.
+func (r *Registry) Stats() Stats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stats := r.stats
+	stats.Active = len(r.sessions)
+	stats.Transactions = r.transactions
+	return stats
+}
+
+// Close ends every session and stops looking for expired ones.
+func (r *Registry) Close() {
+	r.mutex.Lock()
+	select {
+	case <-r.done:
+		r.mutex.Unlock()
+		return
+	default:
+		close(r.done)
+	}
+	var pins []pin
+	for _, s := range r.sessions {
+		pins = append(pins, r.remove(s)...)
+	}
+	r.mutex.Unlock()
+	release(pins)
+}
+
+func (r *Registry) reapLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.reap(now)
+		}
+	}
+}
+
+// reap expires the sessions that have gone unused for longer than the
+// timeout, and abandons transactions open for longer than their lifetime.
+func (r *Registry) reap(now time.Time) {
+	var pins []pin
+	r.mutex.Lock()
+	for _, s := range r.sessions {
+		switch {
+		case r.timeout > 0 && now.Sub(s.lastUsed) > r.timeout:
+			logger.Log(DEBUG, "session %s expired", s.ID)
+			pins = append(pins, r.remove(s)...)
+			r.stats.Expired++
+			expiredSessions.Inc()
+		case s.inTransaction && r.transactionLifetime > 0 &&
+			now.Sub(s.txnStarted) > r.transactionLifetime:
+			logger.Log(INFO, "abandoning transaction %d of session %s", s.txnNumber, s.ID)
+			pins = append(pins, s.endTransaction()...)
+			r.stats.Abandoned++
+		}
+	}
+	r.mutex.Unlock()
+	release(pins)
+}
@@ -0,0 +1,169 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var lsid = bson.D{{Name: "id", Value: bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}}}
+
+var sessionID = messages.SessionID(lsid[0].Value)
+
+func message(body ...bson.DocElem) *messages.Message {
+	return &messages.Message{
+		Body: append(bson.D(body), bson.DocElem{Name: "$db", Value: "shop"}),
+	}
+}
+
+// statement returns a statement of transaction n.
+func statement(n int64, body ...bson.DocElem) *messages.Message {
+	return message(append(body,
+		bson.DocElem{Name: "lsid", Value: lsid},
+		bson.DocElem{Name: "txnNumber", Value: n},
+		bson.DocElem{Name: "autocommit", Value: false},
+	)...)
+}
+
+var ok = messages.ModuleResponse{Writer: messages.Message{Body: bson.D{{Name: "ok", Value: 1.0}}}}
+
+func TestSessions(t *testing.T) {
+	Convey("Follow sessions and their transactions", t, func() {
+		r := NewRegistry(time.Hour)
+		defer r.Close()
+
+		So(r.Begin(message(bson.DocElem{Name: "ping", Value: 1})), ShouldBeNil)
+
+		s := r.Begin(statement(1,
+			bson.DocElem{Name: "insert", Value: "orders"},
+			bson.DocElem{Name: "startTransaction", Value: true},
+		))
+		So(s, ShouldNotBeNil)
+		So(s.ID, ShouldEqual, sessionID)
+		So(r.Lookup(sessionID, ""), ShouldEqual, s)
+		open, n := s.InTransaction()
+		So(open, ShouldBeTrue)
+		So(n, ShouldEqual, 1)
+		So(r.Stats(), ShouldResemble, Stats{Active: 1, Transactions: 1, Started: 1})
+
+		released := []interface{}{}
+		unpin := func(value interface{}) { released = append(released, value) }
+		So(s.Pin("conn", "a", unpin), ShouldBeTrue)
+
+		Convey("keeping pins for the transaction's statements", func() {
+			So(r.Begin(statement(1, bson.DocElem{Name: "find", Value: "orders"})), ShouldEqual, s)
+			So(s.Take("conn"), ShouldEqual, "a")
+			So(s.Take("conn"), ShouldBeNil)
+			So(s.Pin("conn", "a", unpin), ShouldBeTrue)
+			So(s.Pinned("conn"), ShouldEqual, "a")
+			So(released, ShouldBeEmpty)
+		})
+
+		Convey("letting go of them once it commits", func() {
+			commit := statement(1, bson.DocElem{Name: "commitTransaction", Value: 1})
+			r.Begin(commit)
+			r.Finish(commit, messages.ModuleResponse{CommandError: &messages.ResponderError{ErrorCode: messages.HostUnreachable}})
+			So(released, ShouldBeEmpty)
+
+			r.Finish(commit, ok)
+			So(released, ShouldResemble, []interface{}{"a"})
+			open, _ := s.InTransaction()
+			So(open, ShouldBeFalse)
+			So(s.Pin("conn", "b", unpin), ShouldBeFalse)
+		})
+
+		Convey("or the next one starts", func() {
+			r.Begin(statement(2,
+				bson.DocElem{Name: "insert", Value: "orders"},
+				bson.DocElem{Name: "startTransaction", Value: true},
+			))
+			So(released, ShouldResemble, []interface{}{"a"})
+			_, n := s.InTransaction()
+			So(n, ShouldEqual, 2)
+			So(r.Stats().Transactions, ShouldEqual, 1)
+		})
+
+		Convey("or the session ends", func() {
+			end := message(bson.DocElem{Name: "endSessions", Value: []interface{}{lsid}})
+			r.Finish(end, ok)
+			So(released, ShouldResemble, []interface{}{"a"})
+			So(r.Lookup(sessionID, ""), ShouldBeNil)
+			So(r.Stats(), ShouldResemble, Stats{Started: 1, Ended: 1})
+		})
+
+		Convey("abandoning transactions open too long", func() {
+			r.reap(time.Now().Add(2 * DefaultTransactionLifetime))
+			So(released, ShouldResemble, []interface{}{"a"})
+			So(r.Lookup(sessionID, ""), ShouldEqual, s)
+			So(r.Stats().Abandoned, ShouldEqual, 1)
+		})
+
+		Convey("and expiring sessions unused too long", func() {
+			r.SetTimeout(time.Minute)
+			r.SetTransactionLifetime(0)
+			r.reap(time.Now().Add(30 * time.Second))
+			So(r.Lookup(sessionID, ""), ShouldEqual, s)
+
+			r.reap(time.Now().Add(2 * time.Minute))
+			So(released, ShouldResemble, []interface{}{"a"})
+			So(r.Lookup(sessionID, ""), ShouldBeNil)
+			So(r.Stats().Expired, ShouldEqual, 1)
+		})
+	})
+	Convey("Keep sessions with the same ID apart for different users", t, func() {
+		r := NewRegistry(time.Hour)
+		defer r.Close()
+
+		// as sends a request on a client
+		as := func(client *messages.Client, msg *messages.Message) *messages.Message {
+			msg.Client = client
+			return msg
+		}
+		alice := messages.NewClient(1, "10.0.0.1:50000")
+		messages.RecordAuth(as(alice, message(bson.DocElem{Name: "authenticate", Value: 1}, bson.DocElem{Name: "user", Value: "alice"})), ok)
+		mallory := messages.NewClient(2, "10.0.0.2:50000")
+
+		s := r.Begin(as(alice, statement(1, bson.DocElem{Name: "insert", Value: "orders"}, bson.DocElem{Name: "startTransaction", Value: true})))
+		So(s.User, ShouldEqual, "alice@shop")
+		So(s.Pin("conn", "a", func(interface{}) {}), ShouldBeTrue)
+
+		other := r.Begin(as(mallory, statement(1, bson.DocElem{Name: "find", Value: "orders"})))
+		So(other, ShouldNotEqual, s)
+		So(other.Pinned("conn"), ShouldBeNil)
+		So(r.SessionOf(as(alice, statement(1))), ShouldEqual, s)
+		So(r.Lookup(sessionID, ""), ShouldEqual, other)
+
+		r.Finish(as(mallory, message(bson.DocElem{Name: "endSessions", Value: []interface{}{lsid}})), ok)
+		So(r.Lookup(sessionID, ""), ShouldBeNil)
+		So(r.Lookup(sessionID, "alice@shop"), ShouldEqual, s)
+	})
+
+	Convey("Read session settings", t, func() {
+		c, err := ParseConfig(nil)
+		So(err, ShouldBeNil)
+		So(c, ShouldResemble, Config{Timeout: DefaultTimeout, TransactionLifetime: DefaultTransactionLifetime})
+
+		c, err = ParseConfig(bson.M{"logicalSessionTimeoutMinutes": 10, "transactionLifetimeLimitSeconds": 0})
+		So(err, ShouldBeNil)
+		So(c, ShouldResemble, Config{Timeout: 10 * time.Minute})
+
+		r := NewRegistry(time.Hour)
+		defer r.Close()
+		r.Configure(c)
+		So(r.Timeout(), ShouldEqual, 10*time.Minute)
+		So(r.TransactionLifetime(), ShouldEqual, 0)
+
+		bad := []bson.M{
+			{"logicalSessionTimeoutMinutes": 0},
+			{"logicalSessionTimeoutMinutes": "ten"},
+			{"transactionLifetimeLimitSeconds": -5},
+		}
+		for _, conf := range bad {
+			_, err := ParseConfig(conf)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
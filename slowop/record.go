@@ -0,0 +1,171 @@
+package slowop
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NewRecord creates a record of a request and the response the pipeline
+// gave it, with the module timings from the request's Trace. The caller
+// fills in the sizes and durations.
+func NewRecord(req messages.Requester, res messages.ModuleResponse) Record {
+	fields := messages.LogFields(req)
+	r := Record{
+		Time:         time.Now(),
+		ConnectionID: fields.ConnectionID,
+		RequestID:    fields.RequestID,
+		Command:      fields.Command,
+		Namespace:    fields.Namespace,
+		Filter:       Shape(filterOf(req)),
+		OK:           res.CommandError == nil,
+		Modules:      []ModuleTiming{},
+	}
+	if client := messages.ClientOf(req); client != nil {
+		r.AppName = client.AppName()
+	}
+	if res.CommandError != nil {
+		r.ErrorCode = res.CommandError.ErrorCode
+	} else if res.Writer != nil {
+		reply := res.Writer.ToBSON()
+		if ok, found := reply["ok"]; found {
+			r.OK = convert.ToFloat64(ok) != 0
+		}
+		r.DocsReturned = docsReturned(reply)
+		if c, isCommand := res.Writer.(messages.CommandResponse); isCommand {
+			r.DocsReturned += len(c.Documents)
+		}
+	}
+	for _, module := range messages.TraceOf(req).Modules() {
+		r.Modules = append(r.Modules, ModuleTiming{
+			Module:         module.Module,
+			Alias:          module.Alias,
+			DurationMillis: millis(module.Duration),
+		})
+	}
+	return r
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// filterOf returns the query filter of a request: the filter or query of
+// reads, the pipeline of aggregations, or the query of the first statement
+// of updates and deletes.
+func filterOf(req messages.Requester) interface{} {
+	var args bson.M
+	var sections messages.MessageAuxiliary
+	switch r := req.(type) {
+	case messages.Command:
+		args = r.Args
+	case *messages.Message:
+		args = r.Body.Map()
+		sections = r.Auxiliary
+	default:
+		return nil
+	}
+
+	for _, key := range []string{"filter", "query", "pipeline"} {
+		if filter, ok := args[key]; ok {
+			return filter
+		}
+	}
+	for _, key := range []string{"updates", "deletes"} {
+		statements, err := convert.ConvertToBSONDocSlice(args[key])
+		if err != nil || len(statements) == 0 {
+			statements = sections[key]
+		}
+		if len(statements) > 0 {
+			return bsonutil.FindValueByKey("q", statements[0])
+		}
+	}
+	return nil
+}
+
+// docsReturned counts the documents in the cursor batch of a reply.
+func docsReturned(reply bson.M) int {
+	cursor := convert.ToBSONMap(reply["cursor"])
+	for _, key := range []string{"firstBatch", "nextBatch"} {
+		if batch, ok := cursor[key].([]interface{}); ok {
+			return len(batch)
+		}
+	}
+	return 0
+}
+
+// Shape returns the shape of a filter: its field names, operators and
+// nesting, with each value replaced by "?". Arrays of values become a
+// single "?", while arrays of documents, such as the operands of $and,
+// keep each document's shape.
+func Shape(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case bson.D:
+		out := make(shapeDoc, len(val))
+		for i, elem := range val {
+			out[i] = bson.DocElem{Name: elem.Name, Value: Shape(elem.Value)}
+		}
+		return out
+	case bson.M:
+		out := bson.M{}
+		for key, value := range val {
+			out[key] = Shape(value)
+		}
+		return out
+	case map[string]interface{}:
+		return Shape(bson.M(val))
+	case []bson.D:
+		out := make([]interface{}, len(val))
+		for i, doc := range val {
+			out[i] = Shape(doc)
+		}
+		return out
+	case []interface{}:
+		out := []interface{}{}
+		for _, item := range val {
+			switch item.(type) {
+			case bson.D, bson.M, map[string]interface{}:
+				out = append(out, Shape(item))
+			}
+		}
+		if len(out) < len(val) {
+			return "?"
+		}
+		return out
+	}
+	return "?"
+}
+
+// a shapeDoc is the shape of an ordered document. It marshals to a JSON
+// object with its fields in order, where a bson.D would become an array.
+type shapeDoc bson.D
+
+func (d shapeDoc) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, elem := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(elem.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
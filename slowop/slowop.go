@@ -0,0 +1,156 @@
+// Package slowop keeps a log of requests that took longer than a threshold
+// to pass through the proxy, similar to mongod's slow query log. Each
+// record says which command it was, what it asked for and how much it
+// returned, and how the time was split among the modules in the pipeline,
+// so slow requests can be blamed on the proxy, a module's backend, or the
+// client.
+package slowop
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultCapacity is the number of records a Log keeps in memory by default.
+const DefaultCapacity = 1000
+
+// A Record describes one slow request.
+type Record struct {
+	Time         time.Time `json:"t"`
+	ConnectionID int64     `json:"connectionId"`
+	RequestID    int32     `json:"requestId"`
+	AppName      string    `json:"appName,omitempty"`
+	Command      string    `json:"command"`
+	Namespace    string    `json:"ns,omitempty"`
+
+	// Filter is the shape of the request's query filter, as returned by
+	// Shape, so it never holds the values the client sent.
+	Filter interface{} `json:"filter,omitempty"`
+
+	DocsReturned int   `json:"docsReturned"`
+	BytesIn      int   `json:"bytesIn"`
+	BytesOut     int   `json:"bytesOut"`
+	OK           bool  `json:"ok"`
+	ErrorCode    int32 `json:"errorCode,omitempty"`
+
+	// DurationMillis is the time from the request being decoded to the
+	// response being written. WriteMillis is the part of it spent writing
+	// the response to the client.
+	DurationMillis float64        `json:"durationMillis"`
+	WriteMillis    float64        `json:"writeMillis"`
+	Modules        []ModuleTiming `json:"modules"`
+}
+
+// ModuleTiming is the time one module spent on a slow request, excluding
+// the time spent in the modules after it.
+type ModuleTiming struct {
+	Module         string  `json:"module"`
+	Alias          string  `json:"alias"`
+	DurationMillis float64 `json:"durationMillis"`
+}
+
+// A Query selects records from a Log. Zero fields match every record.
+type Query struct {
+	Command   string
+	Namespace string
+	AppName   string
+	MinMillis float64
+
+	// Limit is the maximum number of records returned.
+	Limit int
+}
+
+func (q Query) matches(r *Record) bool {
+	return (len(q.Command) == 0 || q.Command == r.Command) &&
+		(len(q.Namespace) == 0 || q.Namespace == r.Namespace) &&
+		(len(q.AppName) == 0 || q.AppName == r.AppName) &&
+		r.DurationMillis >= q.MinMillis
+}
+
+// A Log keeps the most recent slow records in memory, and optionally
+// appends every slow record to a writer as a line of JSON.
+type Log struct {
+	threshold time.Duration
+
+	mutex   sync.Mutex
+	records []Record
+	next    int
+	full    bool
+	out     io.Writer
+}
+
+// NewLog creates a Log of the requests that take at least threshold,
+// keeping the last capacity of them in memory. If out is not nil, records
+// are also written to it, one JSON object per line.
+func NewLog(threshold time.Duration, capacity int, out io.Writer) *Log {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Log{
+		threshold: threshold,
+		records:   make([]Record, capacity),
+		out:       out,
+	}
+}
+
+// Threshold returns the duration at which requests are logged.
+func (l *Log) Threshold() time.Duration {
+	return l.threshold
+}
+
+// IsSlow returns whether a request that took d should be logged.
+func (l *Log) IsSlow(d time.Duration) bool {
+	return l != nil && d >= l.threshold
+}
+
+// Add adds a record to the log, and writes it out if the log has a writer.
+func (l *Log) Add(r Record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.records[l.next] = r
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+
+	if l.out == nil {
+		return nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("Error marshaling slow operation: %v", err)
+	}
+	_, err = l.out.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("Error writing slow operation: %v", err)
+	}
+	return nil
+}
+
+// Find returns the records in memory that match q, newest first.
+func (l *Log) Find(q Query) []Record {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.records)
+	}
+
+	found := []Record{}
+	for i := 1; i <= count; i++ {
+		r := &l.records[(l.next-i+len(l.records))%len(l.records)]
+		if !q.matches(r) {
+			continue
+		}
+		found = append(found, *r)
+		if q.Limit > 0 && len(found) == q.Limit {
+			break
+		}
+	}
+	return found
+}
@@ -0,0 +1,129 @@
+package slowop
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLog(t *testing.T) {
+	Convey("Keep a log of slow operations", t, func() {
+		var out bytes.Buffer
+		l := NewLog(50*time.Millisecond, 3, &out)
+
+		So(l.IsSlow(10*time.Millisecond), ShouldBeFalse)
+		So(l.IsSlow(50*time.Millisecond), ShouldBeTrue)
+
+		for i, command := range []string{"find", "insert", "find", "aggregate"} {
+			So(l.Add(Record{
+				RequestID:      int32(i),
+				Command:        command,
+				DurationMillis: float64(60 + i),
+			}), ShouldBeNil)
+		}
+
+		Convey("keeping the newest records in memory", func() {
+			records := l.Find(Query{})
+			So(len(records), ShouldEqual, 3)
+			So(records[0].RequestID, ShouldEqual, 3)
+			So(records[2].RequestID, ShouldEqual, 1)
+		})
+
+		Convey("matching queries", func() {
+			records := l.Find(Query{Command: "find"})
+			So(len(records), ShouldEqual, 1)
+			So(records[0].RequestID, ShouldEqual, 2)
+
+			So(len(l.Find(Query{MinMillis: 62})), ShouldEqual, 2)
+			So(len(l.Find(Query{Limit: 1})), ShouldEqual, 1)
+		})
+
+		Convey("writing every record as a line of JSON", func() {
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			So(len(lines), ShouldEqual, 4)
+
+			var first map[string]interface{}
+			So(json.Unmarshal([]byte(lines[0]), &first), ShouldBeNil)
+			So(first["command"], ShouldEqual, "find")
+			So(first["durationMillis"], ShouldEqual, 60)
+		})
+	})
+}
+
+func TestShape(t *testing.T) {
+	Convey("Shape a filter", t, func() {
+		shape := Shape(bson.D{
+			{Name: "ssn", Value: "123-45-6789"},
+			{Name: "age", Value: bson.D{{Name: "$gt", Value: 21}}},
+			{Name: "$or", Value: []interface{}{
+				bson.D{{Name: "tags", Value: bson.D{{Name: "$in", Value: []interface{}{"a", "b"}}}}},
+				bson.M{"vip": true},
+			}},
+		})
+
+		encoded, err := json.Marshal(shape)
+		So(err, ShouldBeNil)
+		So(string(encoded), ShouldEqual,
+			`{"ssn":"?","age":{"$gt":"?"},"$or":[{"tags":{"$in":"?"}},{"vip":"?"}]}`)
+	})
+}
+
+func TestNewRecord(t *testing.T) {
+	Convey("Record a request and its response", t, func() {
+		client := messages.NewClient(4, "127.0.0.1:5000")
+		client.SetMetadata(bson.M{"application": bson.M{"name": "reports"}})
+
+		trace := messages.NewTrace()
+		trace.AddModule("mockule", "backend", 30*time.Millisecond)
+
+		req := &messages.Message{
+			RequestID: 9,
+			Body: bson.D{
+				{Name: "find", Value: "orders"},
+				{Name: "filter", Value: bson.D{{Name: "total", Value: 100}}},
+				{Name: "$db", Value: "shop"},
+			},
+			Client: client,
+			Trace:  trace,
+		}
+		res := messages.ModuleResponse{
+			Writer: messages.CommandResponse{Reply: bson.M{
+				"ok": 1,
+				"cursor": bson.M{
+					"id":         int64(0),
+					"firstBatch": []interface{}{bson.M{"total": 100}, bson.M{"total": 100}},
+				},
+			}},
+		}
+
+		r := NewRecord(req, res)
+		So(r.ConnectionID, ShouldEqual, 4)
+		So(r.RequestID, ShouldEqual, 9)
+		So(r.AppName, ShouldEqual, "reports")
+		So(r.Command, ShouldEqual, "find")
+		So(r.Namespace, ShouldEqual, "shop.orders")
+		So(r.Filter, ShouldResemble, shapeDoc{{Name: "total", Value: "?"}})
+		So(r.DocsReturned, ShouldEqual, 2)
+		So(r.OK, ShouldBeTrue)
+		So(r.Modules, ShouldResemble, []ModuleTiming{{"mockule", "backend", 30}})
+
+		Convey("taking the filter of updates from document sequences", func() {
+			req.Body = bson.D{{Name: "update", Value: "orders"}, {Name: "$db", Value: "shop"}}
+			req.Auxiliary = messages.MessageAuxiliary{
+				"updates": {{{Name: "q", Value: bson.D{{Name: "_id", Value: 1}}}}},
+			}
+			r := NewRecord(req, messages.ModuleResponse{
+				CommandError: &messages.ResponderError{ErrorCode: 11000, Message: "duplicate key"},
+			})
+			So(r.Filter, ShouldResemble, shapeDoc{{Name: "_id", Value: "?"}})
+			So(r.OK, ShouldBeFalse)
+			So(r.ErrorCode, ShouldEqual, 11000)
+		})
+	})
+}
@@ -0,0 +1,44 @@
+package mongoproxy
+
+import (
+	"time"
+
+	. "github.com/mongodbinc-interns/mongoproxy/log"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/slowop"
+)
+
+// SetSlowOpLog sets the log that requests slower than its threshold are
+// recorded in. It must be called before Run; with no log, slow requests
+// are not recorded.
+func (p *Proxy) SetSlowOpLog(l *slowop.Log) {
+	p.slowOps = l
+}
+
+// SlowOps returns the recent slow requests that match q, newest first.
+func (p *Proxy) SlowOps(q slowop.Query) []slowop.Record {
+	if p.slowOps == nil {
+		return []slowop.Record{}
+	}
+	return p.slowOps.Find(q)
+}
+
+// recordSlowOp adds a request that took longer than the slow operation
+// threshold to the slow operation log.
+func (p *Proxy) recordSlowOp(req messages.Requester, res messages.ModuleResponse,
+	bytesIn int, bytesOut int, elapsed time.Duration, writing time.Duration) {
+
+	record := slowop.NewRecord(req, res)
+	record.BytesIn = bytesIn
+	record.BytesOut = bytesOut
+	record.DurationMillis = float64(elapsed) / float64(time.Millisecond)
+	record.WriteMillis = float64(writing) / float64(time.Millisecond)
+
+	fields := messages.LogFields(req)
+	fields.Duration = elapsed
+	LogWith(INFO, fields, "Slow operation")
+
+	if err := p.slowOps.Add(record); err != nil {
+		LogWith(ERROR, fields, "%v", err)
+	}
+}
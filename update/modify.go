@@ -0,0 +1,318 @@
+package update
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// What a modification does to the value at its path.
+type result int
+
+const (
+	unchanged result = iota
+	replaced
+	removed
+)
+
+// A leaf changes the value at the end of a path, given whether there is
+// one.
+type leaf func(value interface{}, exists bool, opts Options) (interface{}, result, error)
+
+// A modification is one field of one update operator.
+type modification struct {
+	op    string
+	path  string
+	parts []string
+	arg   interface{}
+
+	// create is set for operators that create the fields on their path.
+	create bool
+	leaf   leaf
+
+	// to is the new path of $rename.
+	to      string
+	toParts []string
+}
+
+// target is the path that orders the modification among the others.
+func (m *modification) target() []string {
+	return m.parts
+}
+
+// applyModification applies one modification to a document.
+func (u *Update) applyModification(doc bson.D, m *modification, opts Options) (bson.D, error) {
+	if m.op == "$rename" {
+		return rename(doc, m, opts)
+	}
+	parts, err := resolvePositional(doc, m.parts, m.path, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	out, err := u.modify(doc, parts, "", m, opts)
+	if err != nil {
+		return nil, err
+	}
+	return out.(bson.D), nil
+}
+
+// isArrayPart returns whether a part of a path is $[] or $[<identifier>].
+func isArrayPart(part string) bool {
+	return strings.HasPrefix(part, "$[") && strings.HasSuffix(part, "]")
+}
+
+// resolvePositional replaces the positional $ in a path with the index of
+// the first element of its array that the filter's conditions on that
+// array match.
+func resolvePositional(doc bson.D, parts []string, path string, filter bson.D) ([]string, error) {
+	at := -1
+	for i, part := range parts {
+		if part == "$" {
+			at = i
+		}
+	}
+	if at < 0 {
+		return parts, nil
+	}
+	notFound := errorf(messages.BadValue, "The positional operator did not find the match needed from the query.")
+	if at == 0 || !mentions(filter, strings.Join(parts[:at], ".")) {
+		return nil, notFound
+	}
+
+	array, ok := documentPath(doc, parts[:at])
+	elems := bsonutil.ToArray(array)
+	if !ok || elems == nil {
+		return nil, notFound
+	}
+	for i, elem := range elems {
+		single := query.SetField(doc, parts[:at], []interface{}{elem})
+		matched, err := query.Match(filter, single)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			resolved := append([]string{}, parts...)
+			resolved[at] = strconv.Itoa(i)
+			return resolved, nil
+		}
+	}
+	return nil, notFound
+}
+
+// mentions returns whether a filter has conditions on a path or within
+// it.
+func mentions(filter bson.D, path string) bool {
+	for _, elem := range filter {
+		switch elem.Name {
+		case "$and", "$or", "$nor":
+			for _, clause := range bsonutil.ToArray(elem.Value) {
+				if mentions(bsonutil.ToD(clause), path) {
+					return true
+				}
+			}
+		default:
+			if elem.Name == path || strings.HasPrefix(elem.Name, path+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// documentPath returns the value at a path that goes through documents
+// and array indexes, and whether there is one.
+func documentPath(v interface{}, parts []string) (interface{}, bool) {
+	for _, part := range parts {
+		if doc := bsonutil.ToD(v); doc != nil {
+			var ok bool
+			if v, ok = field(doc, part); !ok {
+				return nil, false
+			}
+			continue
+		}
+		array := bsonutil.ToArray(v)
+		i, err := strconv.Atoi(part)
+		if array == nil || err != nil || i < 0 || i >= len(array) {
+			return nil, false
+		}
+		v = array[i]
+	}
+	return v, true
+}
+
+// maxPadding is the most null elements an update may pad an array with to
+// set an element past its end, as for mongod.
+const maxPadding = 1500000
+
+// modify applies a modification at the rest of its path within a
+// document or array, whose own path is prefix, and returns it changed.
+func (u *Update) modify(container interface{}, parts []string, prefix string, m *modification, opts Options) (interface{}, error) {
+	name := parts[0]
+	path := name
+	if len(prefix) > 0 {
+		path = prefix + "." + name
+	}
+
+	if array, ok := container.([]interface{}); ok {
+		indexes, err := u.arrayIndexes(array, name, prefix, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range indexes {
+			var value interface{}
+			exists := i < len(array)
+			if exists {
+				value = array[i]
+			}
+			out, res, err := u.step(value, exists, parts, prefix+"."+strconv.Itoa(i), m, opts)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case res == replaced:
+				for len(array) <= i {
+					array = append(array, nil)
+				}
+				array[i] = out
+			case res == removed && exists:
+				// elements are unset to null, so that the others keep
+				// their positions
+				array[i] = nil
+			}
+		}
+		return array, nil
+	}
+
+	doc := container.(bson.D)
+	if isArrayPart(name) {
+		return nil, errorf(messages.BadValue, "Cannot apply array updates to non-array element %s: %s", lastPart(prefix), format(doc))
+	}
+	at := -1
+	var value interface{}
+	for i, elem := range doc {
+		if elem.Name == name {
+			at, value = i, elem.Value
+			break
+		}
+	}
+	out, res, err := u.step(value, at >= 0, parts, path, m, opts)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res == replaced && at >= 0:
+		doc[at].Value = out
+	case res == replaced:
+		doc = append(doc, bson.DocElem{Name: name, Value: out})
+	case res == removed && at >= 0:
+		doc = append(doc[:at:at], doc[at+1:]...)
+	}
+	return doc, nil
+}
+
+// arrayIndexes returns the indexes of an array's elements that a part of
+// a path selects.
+func (u *Update) arrayIndexes(array []interface{}, part string, prefix string, m *modification) ([]int, error) {
+	indexes := []int{}
+	switch {
+	case part == "$[]":
+		for i := range array {
+			indexes = append(indexes, i)
+		}
+	case isArrayPart(part):
+		filter := u.arrayFilters[part[2:len(part)-1]]
+		for i, elem := range array {
+			matched, err := filter.Matches(bson.D{{Name: part[2 : len(part)-1], Value: elem}})
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				indexes = append(indexes, i)
+			}
+		}
+	default:
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || strings.HasPrefix(part, "+") {
+			if !m.create {
+				return indexes, nil
+			}
+			return nil, errorf(messages.PathNotViable, "Cannot create field '%s' in element {%s: %s}", part, lastPart(prefix), format(array))
+		}
+		if m.create && i-len(array) > maxPadding {
+			return nil, errorf(messages.BadValue, "can't backfill more than %d elements", maxPadding)
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// step applies a modification to the value at one part of its path,
+// which is the last part, or leads to the rest.
+func (u *Update) step(value interface{}, exists bool, parts []string, path string, m *modification, opts Options) (interface{}, result, error) {
+	if len(parts) == 1 {
+		return m.leaf(value, exists, opts)
+	}
+	rest := parts[1:]
+	switch child := value.(type) {
+	case bson.D, []interface{}:
+		out, err := u.modify(child, rest, path, m, opts)
+		return out, replaced, err
+	}
+
+	switch {
+	case !m.create:
+		return nil, unchanged, nil
+	case exists:
+		return nil, unchanged, errorf(messages.PathNotViable, "Cannot create field '%s' in element {%s: %s}", rest[0], lastPart(path), format(value))
+	case isArrayPart(rest[0]):
+		return nil, unchanged, errorf(messages.BadValue, "The path '%s' must exist in the document in order to apply array updates.", path)
+	}
+	out, err := u.modify(bson.D{}, rest, path, m, opts)
+	return out, replaced, err
+}
+
+// lastPart returns the last part of a path.
+func lastPart(path string) string {
+	return path[strings.LastIndex(path, ".")+1:]
+}
+
+// rename applies $rename, which moves a value within documents: neither
+// its path nor its new one may go through arrays.
+func rename(doc bson.D, m *modification, opts Options) (bson.D, error) {
+	value, exists, err := renamePath(doc, m.parts, "source")
+	if err != nil || !exists {
+		return doc, err
+	}
+	if _, _, err := renamePath(doc, m.toParts, "destination"); err != nil {
+		return nil, err
+	}
+	doc = query.RemoveField(doc, m.parts)
+	set := &modification{op: "$set", path: m.to, parts: m.toParts, create: true, leaf: setLeaf(value)}
+	return (&Update{}).applyModification(doc, set, opts)
+}
+
+// renamePath returns the value at a path of $rename, and whether there
+// is one, failing if the path goes through an array.
+func renamePath(doc bson.D, parts []string, which string) (interface{}, bool, error) {
+	var v interface{} = doc
+	for i, part := range parts {
+		d := bsonutil.ToD(v)
+		if d == nil {
+			return nil, false, nil
+		}
+		value, ok := field(d, part)
+		if !ok {
+			return nil, false, nil
+		}
+		if bsonutil.ToArray(value) != nil && i < len(parts)-1 {
+			return nil, false, errorf(messages.BadValue, "The %s field cannot be an array element, '%s' in doc with %s has an array field called '%s'",
+				which, strings.Join(parts, "."), format(doc), part)
+		}
+		v = value
+	}
+	return v, true, nil
+}
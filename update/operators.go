@@ -0,0 +1,449 @@
+package update
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// operators compile the fields of each update operator.
+var operators map[string]func(m *modification) error
+
+func init() {
+	operators = map[string]func(m *modification) error{
+		"$set":         compileSet,
+		"$setOnInsert": compileSet,
+		"$unset":       compileUnset,
+		"$inc":         compileArithmetic,
+		"$mul":         compileArithmetic,
+		"$min":         compileMinMax,
+		"$max":         compileMinMax,
+		"$rename":      compileRename,
+		"$push":        compilePush,
+		"$addToSet":    compileAddToSet,
+		"$pull":        compilePull,
+		"$pullAll":     compilePullAll,
+		"$pop":         compilePop,
+		"$currentDate": compileCurrentDate,
+	}
+}
+
+// setLeaf sets a value.
+func setLeaf(value interface{}) leaf {
+	return func(_ interface{}, _ bool, _ Options) (interface{}, result, error) {
+		return copyValue(value), replaced, nil
+	}
+}
+
+func compileSet(m *modification) error {
+	m.create = true
+	m.leaf = setLeaf(m.arg)
+	return nil
+}
+
+func compileUnset(m *modification) error {
+	m.leaf = func(_ interface{}, exists bool, _ Options) (interface{}, result, error) {
+		if !exists {
+			return nil, unchanged, nil
+		}
+		return nil, removed, nil
+	}
+	return nil
+}
+
+func compileArithmetic(m *modification) error {
+	verb := map[string]string{"$inc": "increment", "$mul": "multiply"}[m.op]
+	if !bsonutil.IsNumber(m.arg) {
+		return errorf(messages.TypeMismatch, "Cannot %s with non-numeric argument: {%s: %s}", verb, m.path, format(m.arg))
+	}
+	m.create = true
+	m.leaf = func(value interface{}, exists bool, _ Options) (interface{}, result, error) {
+		if !exists {
+			if m.op == "$mul" {
+				// multiplying a missing field gives a zero of the
+				// argument's type
+				zero, err := query.Multiply(0, m.arg)
+				return zero, replaced, err
+			}
+			return copyValue(m.arg), replaced, nil
+		}
+		if !bsonutil.IsNumber(value) {
+			return nil, unchanged, errorf(messages.TypeMismatch, "Cannot apply %s to a value of non-numeric type. The field '%s' has non-numeric type %s",
+				m.op, m.path, query.TypeName(value))
+		}
+		var out interface{}
+		var err error
+		if m.op == "$inc" {
+			out, err = query.Add(value, m.arg)
+		} else {
+			out, err = query.Multiply(value, m.arg)
+		}
+		return out, replaced, err
+	}
+	return nil
+}
+
+func compileMinMax(m *modification) error {
+	m.create = true
+	m.leaf = func(value interface{}, exists bool, _ Options) (interface{}, result, error) {
+		c := bsonutil.Compare(m.arg, value)
+		if !exists || (m.op == "$min" && c < 0) || (m.op == "$max" && c > 0) {
+			return copyValue(m.arg), replaced, nil
+		}
+		return nil, unchanged, nil
+	}
+	return nil
+}
+
+func compileRename(m *modification) error {
+	to, ok := m.arg.(string)
+	if !ok {
+		return errorf(messages.BadValue, "The 'to' field for $rename must be a string: %s: %s", m.path, format(m.arg))
+	}
+	if to == m.path {
+		return errorf(messages.BadValue, "The source and target field for $rename must differ: %s: %s", m.path, format(to))
+	}
+	for _, part := range m.parts {
+		if strings.HasPrefix(part, "$") {
+			return errorf(messages.BadValue, "The source field for $rename may not be dynamic: %s", m.path)
+		}
+	}
+	parts, err := parsePath(to)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if strings.HasPrefix(part, "$") {
+			return errorf(messages.BadValue, "The destination field for $rename may not be dynamic: %s", to)
+		}
+	}
+	m.to, m.toParts = to, parts
+	return nil
+}
+
+// eachArgument returns the values of $push and $addToSet, which are one
+// value, or those of a $each modifier, with any other modifiers.
+func eachArgument(m *modification, allowed []string) ([]interface{}, bson.D, error) {
+	doc := bsonutil.ToD(m.arg)
+	if len(doc) == 0 {
+		return []interface{}{m.arg}, nil, nil
+	}
+	each, ok := field(doc, "$each")
+	if !ok {
+		return []interface{}{m.arg}, nil, nil
+	}
+	values := bsonutil.ToArray(each)
+	if values == nil {
+		return nil, nil, errorf(messages.BadValue, "The argument to $each in %s must be an array but it was of type: %s", m.op, query.TypeName(each))
+	}
+	for _, elem := range doc {
+		known := false
+		for _, name := range allowed {
+			known = known || elem.Name == name
+		}
+		if !known {
+			return nil, nil, errorf(messages.BadValue, "Unrecognized clause in %s: %s", m.op, elem.Name)
+		}
+	}
+	return values, doc, nil
+}
+
+// arrayValue returns the array at the end of an operator's path, failing
+// if the value there is not an array.
+func arrayValue(m *modification, value interface{}) ([]interface{}, error) {
+	array := bsonutil.ToArray(value)
+	if array == nil {
+		return nil, errorf(messages.BadValue, "The field '%s' must be an array but is of type %s", m.path, query.TypeName(value))
+	}
+	return array, nil
+}
+
+func compilePush(m *modification) error {
+	values, modifiers, err := eachArgument(m, []string{"$each", "$slice", "$sort", "$position"})
+	if err != nil {
+		return err
+	}
+
+	position, hasPosition := 0, false
+	if v, ok := field(modifiers, "$position"); ok {
+		n, ok := integer(v)
+		if !ok {
+			return errorf(messages.BadValue, "The value for $position must be an integer value, not of type: %s", query.TypeName(v))
+		}
+		position, hasPosition = n, true
+	}
+	slice, hasSlice := 0, false
+	if v, ok := field(modifiers, "$slice"); ok {
+		n, ok := integer(v)
+		if !ok {
+			return errorf(messages.BadValue, "The value for $slice must be an integer value but was given type: %s", query.TypeName(v))
+		}
+		slice, hasSlice = n, true
+	}
+	var less func(a, b interface{}) bool
+	if v, ok := field(modifiers, "$sort"); ok {
+		if less, err = compilePushSort(v); err != nil {
+			return err
+		}
+	}
+
+	m.create = true
+	m.leaf = func(value interface{}, exists bool, _ Options) (interface{}, result, error) {
+		array := []interface{}{}
+		if exists {
+			var err error
+			if array, err = arrayValue(m, value); err != nil {
+				return nil, unchanged, err
+			}
+		}
+
+		at := len(array)
+		if hasPosition {
+			at = position
+			if at < 0 {
+				at += len(array)
+				if at < 0 {
+					at = 0
+				}
+			}
+			if at > len(array) {
+				at = len(array)
+			}
+		}
+		out := make([]interface{}, 0, len(array)+len(values))
+		out = append(out, array[:at]...)
+		for _, v := range values {
+			out = append(out, copyValue(v))
+		}
+		out = append(out, array[at:]...)
+
+		if less != nil {
+			sort.SliceStable(out, func(i, j int) bool {
+				return less(out[i], out[j])
+			})
+		}
+		if hasSlice {
+			switch {
+			case slice >= 0 && slice < len(out):
+				out = out[:slice]
+			case slice < 0 && -slice < len(out):
+				out = out[len(out)+slice:]
+			}
+		}
+		return out, replaced, nil
+	}
+	return nil
+}
+
+// compilePushSort compiles the $sort modifier of $push: 1 or -1 to sort
+// elements whole, or a sort specification for their fields.
+func compilePushSort(spec interface{}) (func(a, b interface{}) bool, error) {
+	if n, ok := integer(spec); ok && (n == 1 || n == -1) {
+		return func(a, b interface{}) bool {
+			return bsonutil.Compare(a, b)*n < 0
+		}, nil
+	}
+	doc := bsonutil.ToD(spec)
+	if len(doc) == 0 {
+		return nil, errorf(messages.BadValue, "The $sort is invalid: use 1/-1 to sort the whole element, or {field:1/-1} to sort embedded fields")
+	}
+	s, err := query.CompileSort(doc)
+	if err != nil {
+		return nil, err
+	}
+	return func(a, b interface{}) bool {
+		return s.Compare(asDocument(a), asDocument(b)) < 0
+	}, nil
+}
+
+// asDocument returns a value as a document for sorting by fields, with
+// values that are not documents sorting as empty ones.
+func asDocument(v interface{}) bson.D {
+	if doc := bsonutil.ToD(v); doc != nil {
+		return doc
+	}
+	return bson.D{}
+}
+
+// integer returns a number as an int, if it is integral.
+func integer(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case float64:
+		if n == math.Trunc(n) {
+			return int(n), true
+		}
+	}
+	return 0, false
+}
+
+func compileAddToSet(m *modification) error {
+	values, _, err := eachArgument(m, []string{"$each"})
+	if err != nil {
+		return err
+	}
+	m.create = true
+	m.leaf = func(value interface{}, exists bool, _ Options) (interface{}, result, error) {
+		array := []interface{}{}
+		if exists {
+			var err error
+			if array, err = arrayValue(m, value); err != nil {
+				return nil, unchanged, err
+			}
+		}
+		added := false
+		for _, v := range values {
+			if !containsValue(array, v) {
+				array = append(array, copyValue(v))
+				added = true
+			}
+		}
+		if exists && !added {
+			return nil, unchanged, nil
+		}
+		return array, replaced, nil
+	}
+	return nil
+}
+
+func containsValue(array []interface{}, v interface{}) bool {
+	for _, elem := range array {
+		if bsonutil.Equal(elem, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullLeaf removes the elements of an array that a test matches.
+func pullLeaf(m *modification, matches func(elem interface{}) (bool, error)) leaf {
+	return func(value interface{}, exists bool, _ Options) (interface{}, result, error) {
+		if !exists {
+			return nil, unchanged, nil
+		}
+		array := bsonutil.ToArray(value)
+		if array == nil {
+			return nil, unchanged, errorf(messages.BadValue, "Cannot apply %s to a non-array value", m.op)
+		}
+		out := []interface{}{}
+		for _, elem := range array {
+			matched, err := matches(elem)
+			if err != nil {
+				return nil, unchanged, err
+			}
+			if !matched {
+				out = append(out, elem)
+			}
+		}
+		if len(out) == len(array) {
+			return nil, unchanged, nil
+		}
+		return out, replaced, nil
+	}
+}
+
+// compilePull compiles a $pull condition: operators for the elements
+// themselves, a filter for elements that are documents, or a value to
+// remove elements equal to.
+func compilePull(m *modification) error {
+	doc := bsonutil.ToD(m.arg)
+	switch {
+	case len(doc) > 0 && strings.HasPrefix(doc[0].Name, "$"):
+		f, err := query.Compile(bson.D{{Name: "element", Value: doc}})
+		if err != nil {
+			return err
+		}
+		m.leaf = pullLeaf(m, func(elem interface{}) (bool, error) {
+			return f.Matches(bson.D{{Name: "element", Value: elem}})
+		})
+	case doc != nil:
+		f, err := query.Compile(doc)
+		if err != nil {
+			return err
+		}
+		m.leaf = pullLeaf(m, func(elem interface{}) (bool, error) {
+			d := bsonutil.ToD(elem)
+			if d == nil {
+				return false, nil
+			}
+			return f.Matches(d)
+		})
+	default:
+		m.leaf = pullLeaf(m, func(elem interface{}) (bool, error) {
+			return bsonutil.Equal(elem, m.arg), nil
+		})
+	}
+	return nil
+}
+
+func compilePullAll(m *modification) error {
+	values := bsonutil.ToArray(m.arg)
+	if values == nil {
+		return errorf(messages.BadValue, "$pullAll requires an array argument but was given a %s", query.TypeName(m.arg))
+	}
+	m.leaf = pullLeaf(m, func(elem interface{}) (bool, error) {
+		return containsValue(values, elem), nil
+	})
+	return nil
+}
+
+func compilePop(m *modification) error {
+	n, ok := integer(m.arg)
+	if !ok || (n != 1 && n != -1) {
+		return errorf(messages.FailedToParse, "$pop expects 1 or -1, found: %s", format(m.arg))
+	}
+	m.leaf = func(value interface{}, exists bool, _ Options) (interface{}, result, error) {
+		if !exists {
+			return nil, unchanged, nil
+		}
+		array := bsonutil.ToArray(value)
+		if array == nil {
+			return nil, unchanged, errorf(messages.TypeMismatch, "Path '%s' contains an element of non-array type '%s'", m.path, query.TypeName(value))
+		}
+		if len(array) == 0 {
+			return nil, unchanged, nil
+		}
+		if n == 1 {
+			return array[:len(array)-1], replaced, nil
+		}
+		return array[1:], replaced, nil
+	}
+	return nil
+}
+
+func compileCurrentDate(m *modification) error {
+	timestamp := false
+	switch arg := m.arg.(type) {
+	case bool:
+	default:
+		doc := bsonutil.ToD(arg)
+		kind, _ := field(doc, "$type")
+		switch {
+		case len(doc) == 1 && kind == "date":
+		case len(doc) == 1 && kind == "timestamp":
+			timestamp = true
+		default:
+			return errorf(messages.BadValue, "%s is not valid type for $currentDate. Please use a boolean ('true') or a $type expression ({$type: 'timestamp/date'}).",
+				format(m.arg))
+		}
+	}
+	m.create = true
+	m.leaf = func(_ interface{}, _ bool, opts Options) (interface{}, result, error) {
+		if timestamp {
+			return bson.MongoTimestamp(opts.Now.Unix()<<32 | 1), replaced, nil
+		}
+		return opts.Now.Truncate(time.Millisecond), replaced, nil
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package update
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/aggregate"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// pipelineStages are the stages updates may have.
+var pipelineStages = map[string]bool{
+	"$addFields":   true,
+	"$set":         true,
+	"$unset":       true,
+	"$project":     true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+}
+
+func compilePipeline(stages []interface{}) (*Update, error) {
+	for _, name := range aggregate.StageNames(stages) {
+		if !pipelineStages[name] {
+			return nil, errorf(messages.InvalidOptions, "%s is not allowed to be used within an update", name)
+		}
+	}
+	p, err := aggregate.Compile(stages)
+	if err != nil {
+		return nil, err
+	}
+	return &Update{kind: pipelineUpdate, pipeline: p}, nil
+}
+
+// applyPipeline runs a pipeline over one document, which its stages each
+// map to one.
+func (u *Update) applyPipeline(doc bson.D, opts Options) (bson.D, error) {
+	out, err := u.pipeline.Run([]bson.D{doc}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return out[0], nil
+}
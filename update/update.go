@@ -0,0 +1,377 @@
+// Package update applies MongoDB updates to BSON documents: update
+// documents of operators, replacement documents and pipeline-style
+// updates.
+package update
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/aggregate"
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errorf returns an error as the query package does, so that callers
+// handle one kind.
+func errorf(code int32, format string, args ...interface{}) *query.Error {
+	return &query.Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// the kinds of updates
+const (
+	operatorUpdate = iota
+	replacementUpdate
+	pipelineUpdate
+)
+
+// An Update is a compiled update.
+type Update struct {
+	kind         int
+	mods         []*modification
+	replacement  bson.D
+	pipeline     *aggregate.Pipeline
+	arrayFilters map[string]*query.Filter
+}
+
+// Options are the circumstances an update is applied in.
+type Options struct {
+	// Filter is the query that selected the document, which the
+	// positional $ operator refers to.
+	Filter bson.D
+
+	// Inserting is set for upserts that insert, which $setOnInsert
+	// applies to.
+	Inserting bool
+
+	// Now is the time $currentDate sets, or the current time if zero.
+	Now time.Time
+}
+
+// identifierPattern is what the identifiers of array filters look like.
+var identifierPattern = regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`)
+
+// Compile compiles an update: a document of update operators, a
+// replacement document, or a pipeline, given as an array of stages. Array
+// filters are for the $[<identifier>] operator.
+func Compile(spec interface{}, arrayFilters []bson.D) (*Update, error) {
+	if stages := bsonutil.ToArray(spec); stages != nil {
+		if len(arrayFilters) > 0 {
+			return nil, errorf(messages.FailedToParse, "arrayFilters may not be specified for pipeline-style updates")
+		}
+		return compilePipeline(stages)
+	}
+	doc := bsonutil.ToD(spec)
+	if doc == nil {
+		return nil, errorf(messages.FailedToParse, "Update argument must be either an object or an array")
+	}
+
+	u := &Update{kind: operatorUpdate}
+	if len(doc) == 0 || !strings.HasPrefix(doc[0].Name, "$") {
+		for _, elem := range doc {
+			if strings.HasPrefix(elem.Name, "$") {
+				return nil, errorf(messages.BadValue, "The dollar ($) prefixed field '%s' in '%s' is not valid for storage.", elem.Name, elem.Name)
+			}
+		}
+		u.kind = replacementUpdate
+		u.replacement = doc
+	} else if err := u.compileOperators(doc); err != nil {
+		return nil, err
+	}
+
+	if err := u.compileArrayFilters(arrayFilters); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// IsReplacement returns whether the update replaces documents whole.
+func (u *Update) IsReplacement() bool {
+	return u.kind == replacementUpdate
+}
+
+func (u *Update) compileOperators(doc bson.D) error {
+	for _, op := range doc {
+		if !strings.HasPrefix(op.Name, "$") {
+			return errorf(messages.FailedToParse, "Unknown modifier: %s. Expected a valid update modifier or pipeline-style update specified as an array", op.Name)
+		}
+		compile, ok := operators[op.Name]
+		if !ok {
+			return errorf(messages.FailedToParse, "Unknown modifier: %s. Expected a valid update modifier or pipeline-style update specified as an array", op.Name)
+		}
+		fields := bsonutil.ToD(op.Value)
+		if fields == nil {
+			return errorf(messages.FailedToParse, "Modifiers operate on fields but we found type %s instead. For example: {$mod: {<field>: ...}} not {%s: %v}",
+				query.TypeName(op.Value), op.Name, op.Value)
+		}
+		for _, f := range fields {
+			parts, err := parsePath(f.Name)
+			if err != nil {
+				return err
+			}
+			m := &modification{op: op.Name, path: f.Name, parts: parts, arg: f.Value}
+			if err := compile(m); err != nil {
+				return err
+			}
+			u.mods = append(u.mods, m)
+		}
+	}
+
+	// fields are updated in the order of their paths, as with mongod
+	sort.SliceStable(u.mods, func(i, j int) bool {
+		return comparePaths(u.mods[i].target(), u.mods[j].target()) < 0
+	})
+	return u.checkConflicts()
+}
+
+// parsePath splits an update path, and checks that it has no empty parts
+// and at most one positional $.
+func parsePath(path string) ([]string, error) {
+	parts := strings.Split(path, ".")
+	positional := 0
+	for _, part := range parts {
+		if len(part) == 0 {
+			return nil, errorf(messages.BadValue, "The update path '%s' contains an empty field name, which is not allowed.", path)
+		}
+		if part == "$" {
+			positional++
+		}
+	}
+	if positional > 1 {
+		return nil, errorf(messages.BadValue, "Too many positional (i.e. '$') elements found in path '%s'", path)
+	}
+	if strings.HasPrefix(parts[0], "$") {
+		return nil, errorf(messages.BadValue, "The dollar ($) prefixed field '%s' in '%s' is not valid for storage.", parts[0], path)
+	}
+	return parts, nil
+}
+
+// comparePaths orders paths part by part, numeric parts by number.
+func comparePaths(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, errA := strconv.Atoi(a[i])
+		y, errB := strconv.Atoi(b[i])
+		if errA == nil && errB == nil && x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+		if a[i] < b[i] {
+			return -1
+		}
+		return 1
+	}
+	return len(a) - len(b)
+}
+
+// checkConflicts fails updates that change a path twice, or a path and
+// a path within it.
+func (u *Update) checkConflicts() error {
+	type use struct {
+		path  string
+		parts []string
+	}
+	uses := []use{}
+	for _, m := range u.mods {
+		uses = append(uses, use{m.path, m.parts})
+		if m.op == "$rename" {
+			uses = append(uses, use{m.to, m.toParts})
+		}
+	}
+	for i, a := range uses {
+		for _, b := range uses[:i] {
+			shorter, longer := a, b
+			if len(b.parts) < len(a.parts) {
+				shorter, longer = b, a
+			}
+			if isPrefix(shorter.parts, longer.parts) {
+				return errorf(messages.ConflictingUpdateOperators, "Updating the path '%s' would create a conflict at '%s'", longer.path, shorter.path)
+			}
+		}
+	}
+	return nil
+}
+
+func isPrefix(prefix, parts []string) bool {
+	if len(prefix) > len(parts) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// compileArrayFilters compiles the filters of the identifiers in
+// $[<identifier>], checking that each identifier has one, and is used.
+func (u *Update) compileArrayFilters(filters []bson.D) error {
+	used := map[string]string{}
+	for _, m := range u.mods {
+		for _, path := range []string{m.path, m.to} {
+			for _, part := range strings.Split(path, ".") {
+				if strings.HasPrefix(part, "$[") && strings.HasSuffix(part, "]") && part != "$[]" {
+					used[part[2:len(part)-1]] = path
+				}
+			}
+		}
+	}
+
+	u.arrayFilters = map[string]*query.Filter{}
+	for _, filter := range filters {
+		id := ""
+		for _, elem := range filter {
+			name := strings.SplitN(elem.Name, ".", 2)[0]
+			if strings.HasPrefix(name, "$") {
+				return errorf(messages.FailedToParse, "Cannot use an expression without a top-level field name in arrayFilters")
+			}
+			if len(id) > 0 && name != id {
+				return errorf(messages.FailedToParse, "Error parsing array filter: Expected a single top-level field name, found '%s' and '%s'", id, name)
+			}
+			id = name
+		}
+		if len(id) == 0 {
+			return errorf(messages.FailedToParse, "Cannot use an expression without a top-level field name in arrayFilters")
+		}
+		if !identifierPattern.MatchString(id) {
+			return errorf(messages.BadValue, "Error parsing array filter: The top-level field name must be an alphanumeric string beginning with a lowercase letter, found '%s'", id)
+		}
+		if _, ok := u.arrayFilters[id]; ok {
+			return errorf(messages.FailedToParse, "Found multiple array filters with the same top-level field name %s", id)
+		}
+		f, err := query.Compile(filter)
+		if err != nil {
+			return err
+		}
+		u.arrayFilters[id] = f
+	}
+
+	for id, path := range used {
+		if _, ok := u.arrayFilters[id]; !ok {
+			return errorf(messages.BadValue, "No array filter found for identifier '%s' in path '%s'", id, path)
+		}
+	}
+	for id := range u.arrayFilters {
+		if _, ok := used[id]; !ok {
+			return errorf(messages.FailedToParse, "The array filter for identifier '%s' was not used in the update", id)
+		}
+	}
+	return nil
+}
+
+// Apply returns a copy of a document with the update applied to it. The
+// document is not changed. Replacements keep the document's _id if they
+// have none; callers check that updates leave _id as it was.
+func (u *Update) Apply(doc bson.D, opts Options) (bson.D, error) {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	switch u.kind {
+	case replacementUpdate:
+		out := copyDoc(u.replacement)
+		if id, ok := field(doc, "_id"); ok {
+			if _, ok := field(out, "_id"); !ok {
+				out = append(bson.D{{Name: "_id", Value: copyValue(id)}}, out...)
+			}
+		}
+		return out, nil
+	case pipelineUpdate:
+		return u.applyPipeline(copyDoc(doc), opts)
+	}
+
+	out := copyDoc(doc)
+	for _, m := range u.mods {
+		if m.op == "$setOnInsert" && !opts.Inserting {
+			continue
+		}
+		var err error
+		if out, err = u.applyModification(out, m, opts); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Upsert returns the document an upsert inserts: the fields its filter
+// requires to equal values, with the update applied to it as an insert.
+func (u *Update) Upsert(filter bson.D, opts Options) (bson.D, error) {
+	base := bson.D{}
+	if u.kind != replacementUpdate {
+		var err error
+		if base, err = upsertBase(filter); err != nil {
+			return nil, err
+		}
+	} else if id, ok := field(query.Equalities(filter), "_id"); ok {
+		base = bson.D{{Name: "_id", Value: id}}
+	}
+	opts.Inserting = true
+	opts.Filter = nil
+	return u.Apply(base, opts)
+}
+
+// upsertBase returns the equality conditions of a filter as a document.
+func upsertBase(filter bson.D) (bson.D, error) {
+	doc := bson.D{}
+	seen := [][]string{}
+	for _, elem := range query.Equalities(filter) {
+		parts := strings.Split(elem.Name, ".")
+		for _, part := range parts {
+			if strings.HasPrefix(part, "$") {
+				return nil, errorf(messages.BadValue, "cannot infer query fields to set, path '%s' is not valid for storage", elem.Name)
+			}
+		}
+		for _, other := range seen {
+			if isPrefix(other, parts) || isPrefix(parts, other) {
+				return nil, errorf(messages.NotSingleValueField, "cannot infer query fields to set, both paths '%s' and '%s' are matched",
+					strings.Join(other, "."), elem.Name)
+			}
+		}
+		seen = append(seen, parts)
+		doc = query.SetField(doc, parts, copyValue(elem.Value))
+	}
+	return doc, nil
+}
+
+// field returns the value of a document's field, and whether it has it.
+func field(doc bson.D, name string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// copyDoc returns a deep copy of a document, with every document in it
+// a bson.D and every array a []interface{}.
+func copyDoc(doc bson.D) bson.D {
+	data, _ := bson.Marshal(doc)
+	out := bson.D{}
+	bson.Unmarshal(data, &out)
+	return out
+}
+
+// copyValue returns a deep copy of a value, as copyDoc does.
+func copyValue(v interface{}) interface{} {
+	return copyDoc(bson.D{{Name: "v", Value: v}})[0].Value
+}
+
+// format writes a value for error messages.
+func format(v interface{}) string {
+	out, err := bsonutil.MarshalExtJSON(v, bsonutil.Relaxed)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
@@ -0,0 +1,288 @@
+package update
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/bsonutil"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/query"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// d builds documents tersely: d("a", 1, "b", 2).
+func d(pairs ...interface{}) bson.D {
+	doc := bson.D{}
+	for i := 0; i < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
+
+func a(values ...interface{}) []interface{} {
+	return append([]interface{}{}, values...)
+}
+
+func bsonString(doc bson.D) string {
+	out, _ := bsonutil.MarshalExtJSON(doc, bsonutil.Relaxed)
+	return string(out)
+}
+
+// an application is an update applied to a document, and the document
+// MongoDB leaves.
+type application struct {
+	name         string
+	update       interface{}
+	arrayFilters []bson.D
+	filter       bson.D
+	doc          bson.D
+	want         bson.D
+}
+
+var now = time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+
+var applications = []application{
+	{
+		name:   "$set, creating documents on the way",
+		update: d("$set", d("a", 1, "b.c", 2)),
+		doc:    d("_id", 1, "b", d("x", 0)),
+		want:   d("_id", 1, "b", d("x", 0, "c", 2), "a", 1),
+	},
+	{
+		name:   "$set in field order",
+		update: d("$set", d("z", 1, "b", 2)),
+		doc:    d("_id", 1),
+		want:   d("_id", 1, "b", 2, "z", 1),
+	},
+	{
+		name:   "$set of array elements, padding with nulls",
+		update: d("$set", d("a.3", 1, "b.1.c", 2)),
+		doc:    d("a", a(0), "b", a(d(), d())),
+		want:   d("a", a(0, nil, nil, 1), "b", a(d(), d("c", 2))),
+	},
+	{
+		name:   "$unset, nulling array elements",
+		update: d("$unset", d("a", "", "b.1", "", "c.x", "")),
+		doc:    d("a", 1, "b", a(1, 2, 3), "c", 5),
+		want:   d("b", a(1, nil, 3), "c", 5),
+	},
+	{
+		name:   "$inc and $mul",
+		update: d("$inc", d("a", 1, "b", 2.5, "c", int64(1)), "$mul", d("d", 2, "e", 3.0)),
+		doc:    d("a", 1, "b", 1, "d", 4),
+		want:   d("a", 2, "b", 3.5, "d", 8, "c", int64(1), "e", 0.0),
+	},
+	{
+		name:   "$inc overflowing to long",
+		update: d("$inc", d("a", 1)),
+		doc:    d("a", 2147483647),
+		want:   d("a", int64(2147483648)),
+	},
+	{
+		name:   "$min and $max",
+		update: d("$min", d("a", 1, "b", 5), "$max", d("c", "x", "d", 1)),
+		doc:    d("a", 2, "b", 3, "c", 10),
+		want:   d("a", 1, "b", 3, "c", "x", "d", 1),
+	},
+	{
+		name:   "$rename",
+		update: d("$rename", d("a", "x.y", "missing", "z")),
+		doc:    d("_id", 1, "a", 1, "x", d("w", 0)),
+		want:   d("_id", 1, "x", d("w", 0, "y", 1)),
+	},
+	{
+		name:   "$push",
+		update: d("$push", d("a", 3, "b", 1)),
+		doc:    d("a", a(1, 2)),
+		want:   d("a", a(1, 2, 3), "b", a(1)),
+	},
+	{
+		name:   "$push with modifiers",
+		update: d("$push", d("a", d("$each", a(5, 0, 4), "$position", 1, "$sort", -1, "$slice", 3))),
+		doc:    d("a", a(1, 3)),
+		want:   d("a", a(5, 4, 3)),
+	},
+	{
+		name:   "$push sorting by fields and slicing from the end",
+		update: d("$push", d("a", d("$each", a(d("n", 2)), "$sort", d("n", 1), "$slice", -2))),
+		doc:    d("a", a(d("n", 3), d("n", 1))),
+		want:   d("a", a(d("n", 2), d("n", 3))),
+	},
+	{
+		name:   "$addToSet",
+		update: d("$addToSet", d("a", d("$each", a(1, 4, 4)), "b", 1.0)),
+		doc:    d("a", a(1, 2), "b", a(1)),
+		want:   d("a", a(1, 2, 4), "b", a(1)),
+	},
+	{
+		name:   "$pull with a value, a condition and a filter",
+		update: d("$pull", d("a", 2, "b", d("$gte", 3), "c", d("x", 1))),
+		doc:    d("a", a(1, 2, 2.0), "b", a(1, 3, 5), "c", a(d("x", 1, "y", 1), d("x", 2), 1)),
+		want:   d("a", a(1), "b", a(1), "c", a(d("x", 2), 1)),
+	},
+	{
+		name:   "$pullAll and $pop",
+		update: d("$pullAll", d("a", a(1, 3)), "$pop", d("b", -1, "c", 1, "d", 1)),
+		doc:    d("a", a(1, 2, 3, 1), "b", a(1, 2), "c", a(1, 2), "d", a()),
+		want:   d("a", a(2), "b", a(2), "c", a(1), "d", a()),
+	},
+	{
+		name:   "$currentDate",
+		update: d("$currentDate", d("a", true, "b", d("$type", "timestamp"))),
+		doc:    d(),
+		want:   d("a", now.Truncate(time.Millisecond), "b", bson.MongoTimestamp(now.Unix()<<32|1)),
+	},
+	{
+		name:   "positional $",
+		update: d("$set", d("a.$.b", 1), "$inc", d("c.$", 1)),
+		filter: d("a.b", 7, "c", d("$gt", 1)),
+		doc:    d("a", a(d("b", 3), d("b", 7), d("b", 7)), "c", a(1, 2)),
+		want:   d("a", a(d("b", 3), d("b", 1), d("b", 7)), "c", a(1, 3)),
+	},
+	{
+		name:   "positional $ with $elemMatch",
+		update: d("$set", d("a.$.ok", true)),
+		filter: d("a", d("$elemMatch", d("x", 1, "y", 2))),
+		doc:    d("a", a(d("x", 1, "y", 1), d("x", 1, "y", 2))),
+		want:   d("a", a(d("x", 1, "y", 1), d("x", 1, "y", 2, "ok", true))),
+	},
+	{
+		name:   "all positional $[]",
+		update: d("$inc", d("a.$[]", 1, "b.$[].n", 1)),
+		doc:    d("a", a(1, 2), "b", a(d("n", 1), d())),
+		want:   d("a", a(2, 3), "b", a(d("n", 2), d("n", 1))),
+	},
+	{
+		name:         "filtered positional $[<identifier>]",
+		update:       d("$set", d("a.$[big].$[odd]", 0)),
+		arrayFilters: []bson.D{d("big.0", d("$gte", 10)), d("odd", d("$mod", a(2, 1)))},
+		doc:          d("a", a(a(1, 2, 3), a(10, 11, 13))),
+		want:         d("a", a(a(1, 2, 3), a(10, 0, 0))),
+	},
+	{
+		name:   "replacement, keeping _id",
+		update: d("b", 1),
+		doc:    d("_id", 7, "a", 1),
+		want:   d("_id", 7, "b", 1),
+	},
+	{
+		name:   "pipeline",
+		update: a(d("$set", d("total", d("$add", a("$a", "$b")), "n.x", 1)), d("$unset", "a"), d("$project", d("b", 0))),
+		doc:    d("_id", 1, "a", 1, "b", 2, "n", d("y", 0)),
+		want:   d("_id", 1, "n", d("y", 0, "x", 1), "total", 3),
+	},
+	{
+		name:   "pipeline replacing the root",
+		update: a(d("$replaceWith", "$sub")),
+		doc:    d("_id", 1, "sub", d("_id", 1, "x", 2)),
+		want:   d("_id", 1, "x", 2),
+	},
+}
+
+func TestApply(t *testing.T) {
+	Convey("Apply updates as MongoDB does", t, func() {
+		for _, c := range applications {
+			u, err := Compile(c.update, c.arrayFilters)
+			So(err, ShouldBeNil)
+			before := bsonString(c.doc)
+			out, err := u.Apply(c.doc, Options{Filter: c.filter, Now: now})
+			So(err, ShouldBeNil)
+			So(c.name+": "+bsonString(out), ShouldEqual, c.name+": "+bsonString(c.want))
+			So(bsonString(c.doc), ShouldEqual, before)
+		}
+	})
+
+	Convey("Apply $setOnInsert only when inserting", t, func() {
+		u, err := Compile(d("$setOnInsert", d("a", 1), "$set", d("b", 1)), nil)
+		So(err, ShouldBeNil)
+		out, err := u.Apply(d("_id", 1), Options{})
+		So(err, ShouldBeNil)
+		So(bsonString(out), ShouldEqual, bsonString(d("_id", 1, "b", 1)))
+
+		out, err = u.Upsert(d("_id", 2, "c", d("$gt", 1), "x.y", "z"), Options{})
+		So(err, ShouldBeNil)
+		So(bsonString(out), ShouldEqual, bsonString(d("_id", 2, "x", d("y", "z"), "a", 1, "b", 1)))
+	})
+
+	Convey("Build upserted replacements with the filter's _id only", t, func() {
+		u, err := Compile(d("a", 1), nil)
+		So(err, ShouldBeNil)
+		So(u.IsReplacement(), ShouldBeTrue)
+		out, err := u.Upsert(d("_id", 3, "b", 2), Options{})
+		So(err, ShouldBeNil)
+		So(bsonString(out), ShouldEqual, bsonString(d("_id", 3, "a", 1)))
+	})
+
+	Convey("Fail updates documents cannot take", t, func() {
+		cases := []struct {
+			update interface{}
+			filter bson.D
+			doc    bson.D
+			code   int32
+		}{
+			{d("$set", d("a.b", 1)), nil, d("a", 5), messages.PathNotViable},
+			{d("$set", d("a.x", 1)), nil, d("a", a(1)), messages.PathNotViable},
+			{d("$inc", d("a", 1)), nil, d("a", "x"), messages.TypeMismatch},
+			{d("$push", d("a", 1)), nil, d("a", 1), messages.BadValue},
+			{d("$pop", d("a", 1)), nil, d("a", 1), messages.TypeMismatch},
+			{d("$set", d("a.$", 1)), d("b", 1), d("a", a(1), "b", 1), messages.BadValue},
+			{d("$set", d("a.$[]", 1)), nil, d(), messages.BadValue},
+			{d("$set", d("a.$[]", 1)), nil, d("a", d()), messages.BadValue},
+			{d("$rename", d("a.0", "b")), nil, d("a", a(1)), messages.BadValue},
+			{d("$set", d("a.99999999999", 1)), nil, d("a", a(1)), messages.BadValue},
+			{d("$set", d("a.1500002", 1)), nil, d("a", a(1)), messages.BadValue},
+			{d("$inc", d("a.0.b.1500001", 1)), nil, d("a", a(d("b", a()))), messages.BadValue},
+		}
+		for _, c := range cases {
+			u, err := Compile(c.update, nil)
+			So(err, ShouldBeNil)
+			_, err = u.Apply(c.doc, Options{Filter: c.filter})
+			So(err, ShouldNotBeNil)
+			So(err.(*query.Error).Code, ShouldEqual, c.code)
+		}
+	})
+
+	Convey("Refuse bad updates", t, func() {
+		cases := []struct {
+			update       interface{}
+			arrayFilters []bson.D
+			code         int32
+		}{
+			{d("$foo", d("a", 1)), nil, messages.FailedToParse},
+			{d("$set", 1), nil, messages.FailedToParse},
+			{d("$set", d("a", 1), "b", 1), nil, messages.FailedToParse},
+			{d("a", 1, "$set", d("b", 1)), nil, messages.BadValue},
+			{d("$set", d("a", 1), "$inc", d("a", 1)), nil, messages.ConflictingUpdateOperators},
+			{d("$set", d("a.b", 1, "a", 1)), nil, messages.ConflictingUpdateOperators},
+			{d("$rename", d("a", "b"), "$set", d("b.c", 1)), nil, messages.ConflictingUpdateOperators},
+			{d("$set", d("a..b", 1)), nil, messages.BadValue},
+			{d("$set", d("a.$.b.$", 1)), nil, messages.BadValue},
+			{d("$inc", d("a", "x")), nil, messages.TypeMismatch},
+			{d("$pop", d("a", 2)), nil, messages.FailedToParse},
+			{d("$push", d("a", d("$each", 1))), nil, messages.BadValue},
+			{d("$push", d("a", d("$each", a(), "$foo", 1))), nil, messages.BadValue},
+			{d("$rename", d("a", 1)), nil, messages.BadValue},
+			{d("$currentDate", d("a", "now")), nil, messages.BadValue},
+			{d("$set", d("a.$[x]", 1)), nil, messages.BadValue},
+			{d("$set", d("a", 1)), []bson.D{d("x", 1)}, messages.FailedToParse},
+			{d("$set", d("a.$[x]", 1)), []bson.D{d("x", 1), d("x", 2)}, messages.FailedToParse},
+			{d("$set", d("a.$[X]", 1)), []bson.D{d("X", 1)}, messages.BadValue},
+			{a(d("$match", d())), nil, messages.InvalidOptions},
+			{a(d("$set", d("a", 1)), 1), nil, messages.TypeMismatch},
+			{"a", nil, messages.FailedToParse},
+		}
+		for _, c := range cases {
+			_, err := Compile(c.update, c.arrayFilters)
+			So(err, ShouldNotBeNil)
+			So(err.(*query.Error).Code, ShouldEqual, c.code)
+		}
+	})
+
+	Convey("Refuse upserts whose filters set a path twice", t, func() {
+		u, err := Compile(d("$set", d("x", 1)), nil)
+		So(err, ShouldBeNil)
+		_, err = u.Upsert(d("a", 1, "a.b", 1), Options{})
+		So(err.(*query.Error).Code, ShouldEqual, messages.NotSingleValueField)
+	})
+}
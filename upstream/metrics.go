@@ -0,0 +1,34 @@
+package upstream
+
+import (
+	"github.com/mongodbinc-interns/mongoproxy/metrics"
+)
+
+var connectionsOpen = metrics.NewGaugeVec("mongoproxy_upstream_connections_open",
+	"Connections currently open to upstream servers, by address.",
+	"address")
+
+var connectionsCreated = metrics.NewCounterVec("mongoproxy_upstream_connections_created_total",
+	"Connections opened to upstream servers, by address.",
+	"address")
+
+var dialErrors = metrics.NewCounterVec("mongoproxy_upstream_dial_errors_total",
+	"Failed attempts to connect to upstream servers, by address.",
+	"address")
+
+var connectionsInUse = metrics.NewGaugeVec("mongoproxy_upstream_connections_in_use",
+	"Connections to upstream servers currently handed out for requests, by address.",
+	"address")
+
+var waitQueueTimeouts = metrics.NewCounterVec("mongoproxy_upstream_wait_queue_timeouts_total",
+	"Requests that timed out waiting for a free connection, by address.",
+	"address")
+
+var healthCheckFailures = metrics.NewCounterVec("mongoproxy_upstream_health_check_failures_total",
+	"Idle connections closed for failing a health check, by address.",
+	"address")
+
+func init() {
+	metrics.MustRegister(connectionsOpen, connectionsCreated, dialErrors,
+		connectionsInUse, waitQueueTimeouts, healthCheckFailures)
+}
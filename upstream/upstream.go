@@ -0,0 +1,470 @@
+// Package upstream contains pools of wire protocol connections to upstream
+// MongoDB-compatible servers, for modules that pass requests on verbatim.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/convert"
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrPoolClosed is returned by Get once a pool has been closed.
+var ErrPoolClosed = errors.New("Upstream connection pool is closed")
+
+// ErrWaitQueueTimeout is returned, wrapped, by Get when no connection
+// became free in time.
+var ErrWaitQueueTimeout = errors.New("Timed out waiting for a connection")
+
+// defaultMaintainInterval is how often a pool without health checks closes
+// idle connections and opens new ones up to its minimum size.
+const defaultMaintainInterval = 10 * time.Second
+
+// Config holds the settings for a pool of connections to one server.
+type Config struct {
+	// Address is the server's host:port.
+	Address string
+
+	// TLS, if set, is used to connect with TLS.
+	TLS *tls.Config
+
+	DialTimeout time.Duration
+
+	// MinPoolSize is the number of connections kept open even when idle,
+	// so that bursts of requests need not wait for new connections.
+	MinPoolSize int
+
+	// MaxPoolSize limits the connections open at once; Get waits for one
+	// to be returned if all are in use. Zero means no limit.
+	MaxPoolSize int
+
+	// WaitQueueTimeout bounds how long Get waits for a connection, for
+	// contexts without a deadline. Zero means for ever.
+	WaitQueueTimeout time.Duration
+
+	// IdleTimeout is how long an unused connection is kept open, if the
+	// pool has more than MinPoolSize.
+	IdleTimeout time.Duration
+
+	// SocketTimeout bounds each read and write, if set.
+	SocketTimeout time.Duration
+
+	// HealthCheckInterval, if set, is how long a connection may go
+	// unused before it is pinged, both in the background and before Get
+	// hands it out.
+	HealthCheckInterval time.Duration
+}
+
+// A Pool keeps connections to a server for reuse. Connections are handed
+// out for one request at a time, so that a pool shared by many clients
+// needs only as many connections as there are requests in flight.
+type Pool struct {
+	conf Config
+
+	// slots holds a token for each connection in use or being dialed or
+	// checked, if the pool size is limited.
+	slots chan struct{}
+
+	mutex  sync.Mutex
+	idle   []*Conn
+	open   int
+	closed bool
+
+	// done is closed by Close, to stop maintenance.
+	done chan struct{}
+}
+
+// NewPool creates a pool, which opens MinPoolSize connections in the
+// background and more as they are needed.
+func NewPool(conf Config) *Pool {
+	p := &Pool{conf: conf, done: make(chan struct{})}
+	if conf.MaxPoolSize > 0 {
+		p.slots = make(chan struct{}, conf.MaxPoolSize)
+		if p.conf.MinPoolSize > conf.MaxPoolSize {
+			p.conf.MinPoolSize = conf.MaxPoolSize
+		}
+	}
+	go p.maintain()
+	return p
+}
+
+// Address returns the address of the pool's server.
+func (p *Pool) Address() string {
+	return p.conf.Address
+}
+
+// Stats are counts of a pool's connections.
+type Stats struct {
+	Open  int
+	Idle  int
+	InUse int
+}
+
+// Stats returns counts of the pool's connections.
+func (p *Pool) Stats() Stats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return Stats{Open: p.open, Idle: len(p.idle), InUse: p.open - len(p.idle)}
+}
+
+// Get returns an idle connection, or a new one if there are none. The
+// connection must be given back with Put.
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	if _, ok := ctx.Deadline(); !ok && p.conf.WaitQueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.conf.WaitQueueTimeout)
+		defer cancel()
+	}
+
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			waitQueueTimeouts.With(p.conf.Address).Inc()
+			return nil, fmt.Errorf("%w to %s: %v", ErrWaitQueueTimeout, p.conf.Address, ctx.Err())
+		}
+	}
+
+	for {
+		c, err := p.popIdle()
+		if err != nil {
+			p.release()
+			return nil, err
+		}
+		if c == nil {
+			break
+		}
+		if p.conf.HealthCheckInterval > 0 && time.Since(c.lastChecked) > p.conf.HealthCheckInterval {
+			if !c.healthy() {
+				p.discard(c)
+				continue
+			}
+		}
+		connectionsInUse.With(p.conf.Address).Inc()
+		return c, nil
+	}
+
+	c, err := p.dial(ctx)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	connectionsInUse.With(p.conf.Address).Inc()
+	return c, nil
+}
+
+// popIdle takes the most recently used idle connection, closing those
+// that have been idle too long, or returns nil if there are none.
+func (p *Pool) popIdle() (*Conn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.idleTooLong(c) {
+			p.closeConn(c)
+			continue
+		}
+		return c, nil
+	}
+	return nil, nil
+}
+
+func (p *Pool) idleTooLong(c *Conn) bool {
+	return p.conf.IdleTimeout > 0 && time.Since(c.lastUsed) > p.conf.IdleTimeout
+}
+
+func (p *Pool) dial(ctx context.Context) (*Conn, error) {
+	dialer := &net.Dialer{Timeout: p.conf.DialTimeout}
+
+	var conn net.Conn
+	var err error
+	if p.conf.TLS != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: p.conf.TLS}).DialContext(ctx, "tcp", p.conf.Address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", p.conf.Address)
+	}
+	if err != nil {
+		dialErrors.With(p.conf.Address).Inc()
+		return nil, fmt.Errorf("Failed to connect to %s: %v", p.conf.Address, err)
+	}
+
+	connectionsCreated.With(p.conf.Address).Inc()
+	connectionsOpen.With(p.conf.Address).Inc()
+	p.mutex.Lock()
+	p.open++
+	p.mutex.Unlock()
+
+	now := time.Now()
+	return &Conn{pool: p, conn: conn, lastUsed: now, lastChecked: now}, nil
+}
+
+// Put gives a connection back to the pool, which closes it if it is
+// broken, or the pool has been closed.
+func (p *Pool) Put(c *Conn) {
+	connectionsInUse.With(p.conf.Address).Dec()
+	c.lastUsed = time.Now()
+	c.lastChecked = c.lastUsed
+	p.putIdle(c)
+}
+
+// putIdle adds a connection to the idle list, or closes it, and frees its
+// slot.
+func (p *Pool) putIdle(c *Conn) {
+	p.mutex.Lock()
+	if c.broken || p.closed {
+		p.closeConn(c)
+	} else {
+		p.idle = append(p.idle, c)
+	}
+	p.mutex.Unlock()
+	p.release()
+}
+
+// tryAcquire takes a slot if one is free, for maintenance, which should
+// not hold up requests.
+func (p *Pool) tryAcquire() bool {
+	if p.slots == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees the slot of a connection, whether it was closed or has
+// gone idle, since idle connections are handed out before new ones.
+func (p *Pool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// discard closes a connection that was taken from the idle list.
+func (p *Pool) discard(c *Conn) {
+	p.mutex.Lock()
+	p.closeConn(c)
+	p.mutex.Unlock()
+}
+
+func (p *Pool) closeConn(c *Conn) {
+	c.conn.Close()
+	p.open--
+	connectionsOpen.With(p.conf.Address).Dec()
+}
+
+// Close closes the idle connections, and connections in use as they are
+// given back.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	for _, c := range p.idle {
+		p.closeConn(c)
+	}
+	p.idle = nil
+}
+
+// maintain periodically closes connections that have been idle too long,
+// pings those due a health check, and opens connections up to the
+// minimum size, until the pool is closed.
+func (p *Pool) maintain() {
+	interval := p.conf.HealthCheckInterval
+	if interval <= 0 {
+		interval = defaultMaintainInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.fill()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.reap()
+			p.checkIdle()
+			p.fill()
+		}
+	}
+}
+
+// reap closes connections that have been idle too long, leaving at least
+// MinPoolSize open.
+func (p *Pool) reap() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	kept := p.idle[:0]
+	for _, c := range p.idle {
+		if p.open > p.conf.MinPoolSize && p.idleTooLong(c) {
+			p.closeConn(c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	p.idle = kept
+}
+
+// checkIdle pings the idle connections that are due a health check, and
+// closes those that fail it.
+func (p *Pool) checkIdle() {
+	if p.conf.HealthCheckInterval <= 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	var due []*Conn
+	kept := p.idle[:0]
+	for _, c := range p.idle {
+		if time.Since(c.lastChecked) > p.conf.HealthCheckInterval && p.tryAcquire() {
+			due = append(due, c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	p.idle = kept
+	p.mutex.Unlock()
+
+	for _, c := range due {
+		if !c.healthy() {
+			c.broken = true
+		}
+		p.putIdle(c)
+	}
+}
+
+// fill opens connections until MinPoolSize are open, stopping at the first
+// that fails.
+func (p *Pool) fill() {
+	for {
+		p.mutex.Lock()
+		enough := p.closed || p.open >= p.conf.MinPoolSize
+		p.mutex.Unlock()
+		if enough || !p.tryAcquire() {
+			return
+		}
+
+		c, err := p.dial(context.Background())
+		if err != nil {
+			p.release()
+			return
+		}
+		p.putIdle(c)
+	}
+}
+
+// A Conn is a connection to an upstream server, used by one request at a
+// time.
+type Conn struct {
+	pool        *Pool
+	conn        net.Conn
+	lastUsed    time.Time
+	lastChecked time.Time
+	nextID      messages.RequestID
+	broken      bool
+}
+
+// Broken returns whether an error has left the connection unusable.
+func (c *Conn) Broken() bool {
+	return c.broken
+}
+
+// Discard marks the connection to be closed when it is given back, such
+// as when a reply stream is abandoned part of the way through.
+func (c *Conn) Discard() {
+	c.broken = true
+}
+
+// Send writes a frame with its requestID replaced by one unique to the
+// connection, and its responseTo cleared, and returns the requestID.
+func (c *Conn) Send(frame []byte) (messages.RequestID, error) {
+	c.nextID++
+	id := c.nextID
+	out := messages.RewriteIDs(frame, id, 0)
+
+	if c.pool.conf.SocketTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.pool.conf.SocketTimeout))
+	}
+	_, err := c.conn.Write(out)
+	if err != nil {
+		c.broken = true
+		return 0, fmt.Errorf("Failed to send to %s: %w", c.pool.conf.Address, err)
+	}
+	return id, nil
+}
+
+// Receive reads a reply, which must answer the message with the given
+// requestID: a request, or the previous reply in a stream.
+func (c *Conn) Receive(responseTo messages.RequestID) ([]byte, error) {
+	if c.pool.conf.SocketTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.pool.conf.SocketTimeout))
+	}
+	frame, header, err := messages.ReadFrame(c.conn)
+	if err != nil {
+		c.broken = true
+		return nil, fmt.Errorf("Failed to read reply from %s: %w", c.pool.conf.Address, err)
+	}
+	if header.ResponseTo != responseTo {
+		c.broken = true
+		return nil, fmt.Errorf("Reply from %s answers request %d, not %d", c.pool.conf.Address, header.ResponseTo, responseTo)
+	}
+	return frame, nil
+}
+
+// RoundTrip sends a frame and reads its reply.
+func (c *Conn) RoundTrip(frame []byte) ([]byte, error) {
+	id, err := c.Send(frame)
+	if err != nil {
+		return nil, err
+	}
+	return c.Receive(id)
+}
+
+// healthy pings the server, to check that an idle connection still works.
+func (c *Conn) healthy() bool {
+	frame, err := messages.Message{
+		Body: bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}},
+	}.Encode(0, 0)
+	if err != nil {
+		return false
+	}
+
+	timeout := c.pool.conf.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultMaintainInterval
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	reply, err := c.RoundTrip(frame)
+	if err != nil {
+		healthCheckFailures.With(c.pool.conf.Address).Inc()
+		return false
+	}
+	c.lastChecked = time.Now()
+	msg, err := messages.DecodeMessage(reply)
+	return err == nil && convert.ToFloat64(msg.Body.Map()["ok"]) == 1
+}
+
+// IsTimeout returns whether err is from a connection timing out.
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
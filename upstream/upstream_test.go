@@ -0,0 +1,199 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+	"github.com/mongodbinc-interns/mongoproxy/upstream/upstreamtest"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func ping() []byte {
+	frame, err := messages.Message{
+		Body: bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}},
+	}.Encode(77, 0)
+	So(err, ShouldBeNil)
+	return frame
+}
+
+func TestPool(t *testing.T) {
+	Convey("Pool connections to an upstream server", t, func() {
+		ts := upstreamtest.NewServer(func(req *messages.Message) []messages.Message {
+			return []messages.Message{{Body: bson.D{{Name: "ok", Value: 1.0}}}}
+		})
+		defer ts.Close()
+
+		pool := NewPool(Config{Address: ts.Addr, MaxPoolSize: 1})
+		defer pool.Close()
+
+		Convey("reusing them for round trips", func() {
+			for i := 0; i < 3; i++ {
+				c, err := pool.Get(context.Background())
+				So(err, ShouldBeNil)
+				reply, err := c.RoundTrip(ping())
+				So(err, ShouldBeNil)
+				msg, err := messages.DecodeMessage(reply)
+				So(err, ShouldBeNil)
+				So(msg.Body.Map()["ok"], ShouldEqual, 1)
+				pool.Put(c)
+			}
+			So(ts.Connections(), ShouldEqual, 1)
+		})
+
+		Convey("waiting for a free connection", func() {
+			c, err := pool.Get(context.Background())
+			So(err, ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err = pool.Get(ctx)
+			So(err, ShouldNotBeNil)
+
+			pool.Put(c)
+			c, err = pool.Get(context.Background())
+			So(err, ShouldBeNil)
+			pool.Put(c)
+		})
+
+		Convey("replacing discarded connections", func() {
+			c, err := pool.Get(context.Background())
+			So(err, ShouldBeNil)
+			_, err = c.RoundTrip(ping())
+			So(err, ShouldBeNil)
+			c.Discard()
+			pool.Put(c)
+
+			c, err = pool.Get(context.Background())
+			So(err, ShouldBeNil)
+			_, err = c.RoundTrip(ping())
+			So(err, ShouldBeNil)
+			pool.Put(c)
+			So(ts.Connections(), ShouldEqual, 2)
+		})
+
+		Convey("refusing requests once closed", func() {
+			pool.Close()
+			_, err := pool.Get(context.Background())
+			So(err, ShouldEqual, ErrPoolClosed)
+		})
+	})
+}
+
+func TestSocketTimeout(t *testing.T) {
+	Convey("Time out reads from a silent server", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				time.Sleep(time.Second)
+				conn.Close()
+			}
+		}()
+
+		pool := NewPool(Config{Address: listener.Addr().String(), SocketTimeout: 50 * time.Millisecond})
+		defer pool.Close()
+
+		c, err := pool.Get(context.Background())
+		So(err, ShouldBeNil)
+		_, err = c.RoundTrip(ping())
+		So(IsTimeout(err), ShouldBeTrue)
+		So(c.Broken(), ShouldBeTrue)
+		pool.Put(c)
+	})
+}
+
+func TestTruncatedReply(t *testing.T) {
+	Convey("Fail replies too short to be an OP_MSG", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, _, err := messages.ReadFrame(conn); err != nil {
+				return
+			}
+			// a header, and two of the four bytes of the flag bits
+			reply := make([]byte, 18)
+			binary.LittleEndian.PutUint32(reply[0:], 18)
+			binary.LittleEndian.PutUint32(reply[12:], uint32(messages.OP_MSG))
+			conn.Write(reply)
+		}()
+
+		pool := NewPool(Config{Address: listener.Addr().String()})
+		defer pool.Close()
+
+		c, err := pool.Get(context.Background())
+		So(err, ShouldBeNil)
+		_, err = c.RoundTrip(ping())
+		So(err, ShouldNotBeNil)
+		So(c.Broken(), ShouldBeTrue)
+		pool.Put(c)
+
+		_, err = messages.DecodeMessage(make([]byte, 18))
+		So(err, ShouldNotBeNil)
+		So(messages.FrameFlags(make([]byte, 18)), ShouldEqual, 0)
+	})
+}
+
+func TestPoolMaintenance(t *testing.T) {
+	Convey("Maintain a pool's connections", t, func() {
+		ts := upstreamtest.NewServer(func(req *messages.Message) []messages.Message {
+			return []messages.Message{{Body: bson.D{{Name: "ok", Value: 1.0}}}}
+		})
+		defer ts.Close()
+
+		Convey("opening the minimum up front", func() {
+			pool := NewPool(Config{Address: ts.Addr, MinPoolSize: 2, MaxPoolSize: 4})
+			defer pool.Close()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for pool.Stats().Idle < 2 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(pool.Stats(), ShouldResemble, Stats{Open: 2, Idle: 2, InUse: 0})
+			So(ts.Connections(), ShouldEqual, 2)
+		})
+
+		Convey("replacing connections that fail health checks", func() {
+			pool := NewPool(Config{Address: ts.Addr, HealthCheckInterval: 20 * time.Millisecond})
+			defer pool.Close()
+
+			c, err := pool.Get(context.Background())
+			So(err, ShouldBeNil)
+			pool.Put(c)
+			ts.CloseClientConnections()
+			time.Sleep(50 * time.Millisecond)
+
+			c, err = pool.Get(context.Background())
+			So(err, ShouldBeNil)
+			_, err = c.RoundTrip(ping())
+			So(err, ShouldBeNil)
+			pool.Put(c)
+			So(ts.Connections(), ShouldEqual, 2)
+		})
+
+		Convey("timing out requests waiting for a connection", func() {
+			pool := NewPool(Config{Address: ts.Addr, MaxPoolSize: 1, WaitQueueTimeout: 20 * time.Millisecond})
+			defer pool.Close()
+
+			c, err := pool.Get(context.Background())
+			So(err, ShouldBeNil)
+			defer pool.Put(c)
+
+			_, err = pool.Get(context.Background())
+			So(errors.Is(err, ErrWaitQueueTimeout), ShouldBeTrue)
+		})
+	})
+}
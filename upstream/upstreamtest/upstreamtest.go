@@ -0,0 +1,135 @@
+// Package upstreamtest contains an in-process MongoDB-compatible server for
+// testing modules that talk to upstream servers, much as httptest does
+// for HTTP.
+package upstreamtest
+
+import (
+	"net"
+	"sync"
+
+	"github.com/mongodbinc-interns/mongoproxy/messages"
+)
+
+// A Handler answers a request with any number of replies. All but the last
+// are sent with moreToCome set, as for exhaust cursors. Requests with
+// moreToCome set get no reply, whatever the handler returns. The request's
+// Client describes the connection it arrived on, numbered from 1.
+type Handler func(req *messages.Message) []messages.Message
+
+// A Server listens on a local port and answers OP_MSG requests with its
+// handler.
+type Server struct {
+	// Addr is the server's host:port.
+	Addr string
+
+	handler  Handler
+	listener net.Listener
+
+	mutex       sync.Mutex
+	conns       map[net.Conn]bool
+	connections int
+	wg          sync.WaitGroup
+}
+
+// NewServer starts a server with the given handler.
+func NewServer(handler Handler) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("upstreamtest: failed to listen: " + err.Error())
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		handler:  handler,
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.connections++
+		client := messages.NewClient(int64(s.connections), conn.RemoteAddr().String())
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn, client)
+	}
+}
+
+func (s *Server) handle(conn net.Conn, client *messages.Client) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+	}()
+
+	var lastID messages.RequestID
+	for {
+		frame, header, err := messages.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		req, err := messages.DecodeMessage(frame)
+		if err != nil {
+			return
+		}
+		req.Client = client
+
+		replies := s.handler(req)
+		if req.FlagBits&messages.OP_MSG_FLAG_MORE_TO_COME != 0 {
+			continue
+		}
+
+		responseTo := header.RequestID
+		for i, reply := range replies {
+			if i < len(replies)-1 {
+				reply.FlagBits |= messages.OP_MSG_FLAG_MORE_TO_COME
+			}
+			lastID++
+			out, err := reply.Encode(lastID, responseTo)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(out); err != nil {
+				return
+			}
+			responseTo = lastID
+		}
+	}
+}
+
+// Connections returns the number of connections accepted so far.
+func (s *Server) Connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connections
+}
+
+// CloseClientConnections closes the open connections, as a server that
+// restarts would.
+func (s *Server) CloseClientConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server and waits for its connections to close.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.CloseClientConnections()
+	s.wg.Wait()
+}